@@ -0,0 +1,137 @@
+// Package client is a client for the API of Debian Code Search (dcs-web),
+// e.g. https://codesearch.debian.net/.
+//
+// A query is started using Client.Start, which returns a Search. Search.Wait
+// waits until the query is done (reporting its progress), after which its
+// results can be read page by page (Search.Page) or one by one
+// (Search.Results):
+//
+//	c := client.New("https://codesearch.debian.net")
+//	s, err := c.Start(ctx, client.Query{
+//		Pattern: "XCreateWindow",
+//		Literal: true,
+//		Filters: []client.Filter{client.FileType("c")},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	results := s.Results(client.ResultsOptions{})
+//	for {
+//		match, err := results.Next(ctx)
+//		if err == client.Done {
+//			break
+//		}
+//		if err != nil {
+//			return err
+//		}
+//		fmt.Printf("%s:%d: %s\n", match.Path, match.Line, match.Context)
+//	}
+//
+// All requests are cancelled when their context is done.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// protocolVersion is the version of the event protocol (see dcs-web’s
+// eventschema.go) this package speaks.
+const protocolVersion = 4
+
+// apiKeyHeader is the HTTP header which carries Client.APIKey.
+const apiKeyHeader = "X-Dcs-Api-Key"
+
+// A Client sends requests to a dcs-web instance. Its fields must not be
+// modified once requests were sent.
+type Client struct {
+	// BaseURL is the URL of the dcs-web instance, e.g.
+	// “https://codesearch.debian.net”.
+	BaseURL string
+
+	// APIKey, if non-empty, identifies the tenant on whose behalf queries
+	// are run (see dcs-web’s -tenants). Queries of a tenant can only be
+	// accessed using its API key.
+	APIKey string
+
+	// HTTPClient sends the requests. If nil, http.DefaultClient is used.
+	// Waiting for a query uses long-polling requests (see dcs-web’s
+	// -longpoll_timeout), so its Timeout must not be too short.
+	HTTPClient *http.Client
+}
+
+// New returns a Client for the dcs-web instance at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// HTTPError is returned for requests which dcs-web replied to with an HTTP
+// status other than 200 OK or 202 Accepted.
+type HTTPError struct {
+	StatusCode int
+
+	// Message is the (trimmed) body of the reply, which explains the error.
+	Message string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("HTTP status %d: %s", e.StatusCode, e.Message)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// do sends a request for path (relative to BaseURL, including the query
+// string) and decodes the JSON reply into v. body, if non-nil, is sent
+// JSON-encoded.
+func (c *Client) do(ctx context.Context, method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set(apiKeyHeader, c.APIKey)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		// Invalid queries are described by an error event.
+		if qe := decodeQueryError(b); qe != nil {
+			return qe
+		}
+		return &HTTPError{
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(b)),
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding reply of %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer implements the parts of the dcs-web API which the client uses.
+// Queries find results matches and are done after two long-poll requests.
+type fakeServer struct {
+	t       *testing.T
+	results int
+
+	// fail, if non-empty, is the ErrorType of an error event.
+	fail string
+
+	// started is the body of the last POST /api/v1/query request.
+	started queryOptions
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if got, want := r.Header.Get(apiKeyHeader), "secret"; got != want {
+		http.Error(w, "Unknown API key.", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.URL.Path == "/api/v1/query":
+		if err := json.NewDecoder(r.Body).Decode(&f.started); err != nil {
+			f.t.Error(err)
+		}
+		if strings.HasPrefix(f.started.Query, "(") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"Type":"error","ErrorType":"invalidquery","ErrorMessage":"missing closing )"}`)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"QueryId":"0123","Cached":false,"Status":"running"}`)
+
+	case r.URL.Path == "/api/v1/poll/0123":
+		if got, want := r.FormValue("v"), strconv.Itoa(protocolVersion); got != want {
+			f.t.Errorf("v = %q, want %q", got, want)
+		}
+		switch since := r.FormValue("since"); since {
+		case "":
+			fmt.Fprintf(w, `{"QueryId":"0123","Events":[{"Type":"progress","FilesProcessed":1,"FilesTotal":2,"Results":0}],"LastEventId":"0.0"}`)
+		case "0.0":
+			ev := fmt.Sprintf(`{"Type":"progress","FilesProcessed":2,"FilesTotal":2,"Results":%d}`, f.results)
+			if f.fail != "" {
+				ev = fmt.Sprintf(`{"Type":"error","ErrorType":%q}`, f.fail)
+			}
+			fmt.Fprintf(w, `{"QueryId":"0123","Events":[%s],"LastEventId":"0.1","Done":true}`, ev)
+		default:
+			f.t.Errorf("unexpected since=%q", since)
+		}
+
+	case r.URL.Path == "/results/0123/query.json":
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+		page, _ := strconv.Atoi(r.FormValue("page"))
+		if got, want := r.FormValue("order"), "desc"; got != want {
+			f.t.Errorf("order = %q, want %q", got, want)
+		}
+		matches := []Match{}
+		for i := page * limit; i < (page+1)*limit && i < f.results; i++ {
+			matches = append(matches, Match{
+				Path: fmt.Sprintf("i3-wm_4.8-1/src/file%d.c", i),
+				Line: i + 1,
+			})
+		}
+		json.NewEncoder(w).Encode(matches)
+
+	case r.URL.Path == "/api/v1/meta/0123":
+		fmt.Fprintf(w, `{"QueryId":"0123","TotalResults":%d,"Packages":[{"Package":"i3-wm","Results":%d,"Page":0}]}`, f.results, f.results)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestClient(t *testing.T, f *fakeServer) (*Client, func()) {
+	f.t = t
+	srv := httptest.NewServer(f)
+	c := New(srv.URL + "/")
+	c.APIKey = "secret"
+	return c, srv.Close
+}
+
+func TestQueryOptions(t *testing.T) {
+	maxPerFile := 3
+	q := Query{
+		Pattern:    "XCreateWindow",
+		Literal:    true,
+		Filters:    []Filter{FileType("c"), Not(Path("^debian/"))},
+		MaxPerFile: &maxPerFile,
+		Priority:   PriorityBatch,
+	}
+	opts, err := q.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"Query":"XCreateWindow filetype:c -path:^debian/","Literal":true,"MaxPerFile":3,"Priority":"batch"}`; got != want {
+		t.Errorf("options = %s, want %s", got, want)
+	}
+
+	for _, q := range []Query{
+		{},
+		{Pattern: "foo", Filters: []Filter{Path("a b")}},
+		{Pattern: "foo", Filters: []Filter{{Keyword: "filetype"}}},
+	} {
+		if _, err := q.options(); err == nil {
+			t.Errorf("options(%+v) did not return an error", q)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	f := &fakeServer{results: 2500}
+	c, cleanup := newTestClient(t, f)
+	defer cleanup()
+	ctx := context.Background()
+
+	s, err := c.Start(ctx, Query{Pattern: "main", Literal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.QueryId, "0123"; got != want {
+		t.Errorf("QueryId = %q, want %q", got, want)
+	}
+	var progress []Progress
+	if err := s.Wait(ctx, func(p Progress) { progress = append(progress, p) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(progress) != 2 || progress[1].Results != f.results {
+		t.Errorf("progress = %+v, want 2 updates ending with %d results", progress, f.results)
+	}
+
+	results := s.Results(ResultsOptions{})
+	var n int
+	for {
+		m, err := results.Next(ctx)
+		if err == Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("i3-wm_4.8-1/src/file%d.c", n); m.Path != want {
+			t.Fatalf("result %d: Path = %q, want %q", n, m.Path, want)
+		}
+		n++
+	}
+	if n != f.results {
+		t.Errorf("Results returned %d results, want %d", n, f.results)
+	}
+
+	page, err := s.Page(ctx, ResultsOptions{PerPage: 10}, 249)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 10 || page[9].Line != f.results {
+		t.Errorf("last page = %+v, want 10 results ending with line %d", page, f.results)
+	}
+
+	meta, err := s.Meta(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := meta.Pages(10), 250; got != want {
+		t.Errorf("Pages(10) = %d, want %d", got, want)
+	}
+}
+
+func TestSearchErrors(t *testing.T) {
+	f := &fakeServer{fail: "toobroad"}
+	c, cleanup := newTestClient(t, f)
+	defer cleanup()
+	ctx := context.Background()
+
+	_, err := c.Start(ctx, Query{Pattern: "(main"})
+	if qe, ok := err.(*QueryError); !ok || qe.ErrorType != "invalidquery" {
+		t.Errorf("Start(invalid query) = %v, want a *QueryError of type invalidquery", err)
+	}
+
+	s, err := c.Start(ctx, Query{Pattern: "main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Results(ResultsOptions{}).Next(ctx); err == nil || err == Done {
+		t.Errorf("Next() = %v for a failed query, want its error", err)
+	}
+	if qe, ok := s.Wait(ctx, nil).(*QueryError); !ok || qe.ErrorType != "toobroad" {
+		t.Errorf("Wait() = %v, want a *QueryError of type toobroad", qe)
+	}
+
+	c.APIKey = "wrong"
+	if _, err := c.Start(ctx, Query{Pattern: "main"}); err == nil {
+		t.Errorf("Start() with an unknown API key did not return an error")
+	} else if he, ok := err.(*HTTPError); !ok || he.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Start() with an unknown API key = %v, want HTTP status %d", err, http.StatusUnauthorized)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	stall := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-stall:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(stall)
+	s := &Search{c: New(srv.URL), QueryId: "0123"}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Wait(ctx, nil); err == nil {
+		t.Fatalf("Wait() = nil, want an error once the context is done")
+	}
+	if s.err != nil {
+		t.Errorf("cancelling Wait() marked the query as failed: %v", s.err)
+	}
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Filter restricts a query to some files, e.g. “filetype:c” or
+// “-package:linux”. Filters are added to the pattern of the query, see the
+// FAQ of Debian Code Search for their meaning.
+type Filter struct {
+	// Keyword is the name of the filter, e.g. “filetype”.
+	Keyword string
+	Value   string
+
+	// Negated excludes the files which the filter matches.
+	Negated bool
+}
+
+// String returns the filter as it is written in a query, e.g.
+// “-filetype:c”.
+func (f Filter) String() string {
+	s := f.Keyword + ":" + f.Value
+	if f.Negated {
+		s = "-" + s
+	}
+	return s
+}
+
+// FileType restricts the query to files of the specified type, e.g. “c” or
+// “python”.
+func FileType(filetype string) Filter { return Filter{Keyword: "filetype", Value: filetype} }
+
+// Package restricts the query to source packages whose name matches the
+// regular expression re.
+func Package(re string) Filter { return Filter{Keyword: "package", Value: re} }
+
+// Path restricts the query to files whose path (within the source package)
+// matches the regular expression re.
+func Path(re string) Filter { return Filter{Keyword: "path", Value: re} }
+
+// License restricts the query to files whose license matches the regular
+// expression re.
+func License(re string) Filter { return Filter{Keyword: "license", Value: re} }
+
+// BinaryPackage restricts the query to source packages which build a binary
+// package whose name matches the regular expression re.
+func BinaryPackage(re string) Filter { return Filter{Keyword: "binpkg", Value: re} }
+
+// Maintainer restricts the query to source packages whose maintainer matches
+// the regular expression re.
+func Maintainer(re string) Filter { return Filter{Keyword: "maintainer", Value: re} }
+
+// Size restricts the query to files of the specified size, e.g. “<10k” or
+// “>=1M”.
+func Size(size string) Filter { return Filter{Keyword: "size", Value: size} }
+
+// Encoding restricts the query to UTF-8 (“utf8”) or other (“latin1”) files, or
+// searches files which are not UTF-8 without converting them (“raw”).
+func Encoding(encoding string) Filter { return Filter{Keyword: "encoding", Value: encoding} }
+
+// Not returns the negation of f, e.g. Not(Path("^debian/")).
+func Not(f Filter) Filter {
+	f.Negated = !f.Negated
+	return f
+}
+
+// Priority is the scheduling priority of a query (see dcs-web’s
+// -interactive_weight).
+type Priority string
+
+const (
+	// PriorityInteractive is for queries whose results a user waits for.
+	// It is the default.
+	PriorityInteractive Priority = "interactive"
+
+	// PriorityBatch is for queries of scripts and other programs, which
+	// yield to interactive queries.
+	PriorityBatch Priority = "batch"
+)
+
+// Query describes a query. Only Pattern must be set.
+type Query struct {
+	// Pattern is the search pattern, a regular expression unless Literal
+	// is set.
+	Pattern string
+	Literal bool
+
+	// Filters are added to Pattern.
+	Filters []Filter
+
+	// Count only counts the matches per package instead of returning them.
+	Count bool
+
+	// Normalize and Fold make the pattern match irrespective of Unicode
+	// normalization and case, respectively.
+	Normalize bool
+	Fold      bool
+
+	// Force runs queries which the server considers too complex.
+	Force bool
+
+	// FilterExpression is an expression which results must match, e.g.
+	// `pkg~"^lib" && !(path~"test")`.
+	FilterExpression string
+
+	// Sample, if non-zero, returns a random sample of that many results.
+	Sample int
+
+	// MaxResults, if non-zero, stops the query after that many results.
+	MaxResults int
+
+	// MaxPerFile and MaxLineLength, if non-nil, limit the number of matches
+	// per file and the length of the returned lines, respectively.
+	MaxPerFile    *int
+	MaxLineLength *int
+
+	Priority Priority
+}
+
+// queryOptions is the request body of POST /api/v1/query (QueryOptions in
+// dcs-web).
+type queryOptions struct {
+	Query         string
+	Literal       bool   `json:",omitempty"`
+	Count         bool   `json:",omitempty"`
+	Normalize     bool   `json:",omitempty"`
+	Fold          bool   `json:",omitempty"`
+	Force         bool   `json:",omitempty"`
+	Filter        string `json:",omitempty"`
+	Sample        int    `json:",omitempty"`
+	MaxResults    int    `json:",omitempty"`
+	MaxPerFile    *int   `json:",omitempty"`
+	MaxLineLength *int   `json:",omitempty"`
+	Priority      string `json:",omitempty"`
+}
+
+// String returns the query as it is entered on the search page, i.e. the
+// pattern followed by the filters.
+func (q *Query) String() string {
+	words := []string{q.Pattern}
+	for _, f := range q.Filters {
+		words = append(words, f.String())
+	}
+	return strings.Join(words, " ")
+}
+
+func (q *Query) options() (*queryOptions, error) {
+	if q.Pattern == "" {
+		return nil, fmt.Errorf("Pattern must not be empty")
+	}
+	for _, f := range q.Filters {
+		if f.Keyword == "" || f.Value == "" {
+			return nil, fmt.Errorf("invalid filter %q: Keyword and Value must not be empty", f)
+		}
+		if strings.ContainsAny(f.Value, " \t\n\r\f") {
+			return nil, fmt.Errorf("invalid filter %q: Value must not contain whitespace", f)
+		}
+	}
+	return &queryOptions{
+		Query:         q.String(),
+		Literal:       q.Literal,
+		Count:         q.Count,
+		Normalize:     q.Normalize,
+		Fold:          q.Fold,
+		Force:         q.Force,
+		Filter:        q.FilterExpression,
+		Sample:        q.Sample,
+		MaxResults:    q.MaxResults,
+		MaxPerFile:    q.MaxPerFile,
+		MaxLineLength: q.MaxLineLength,
+		Priority:      string(q.Priority),
+	}, nil
+}
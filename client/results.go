@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+// Done is returned by Results.Next once all results were returned.
+var Done = errors.New("no more results")
+
+// Match is a result of a query.
+type Match struct {
+	// Path is the path of the file, starting with the source package and
+	// its version, e.g. “i3-wm_4.16.1-1/i3bar/src/xcb.c”.
+	Path string `json:"path"`
+	Line int    `json:"line"`
+
+	// Context is the matching line, Ctxp2 and Ctxp1 are the two lines
+	// before and Ctxn1 and Ctxn2 the two lines after it. All lines are
+	// HTML-escaped.
+	Ctxp2   string `json:"ctxp2"`
+	Ctxp1   string `json:"ctxp1"`
+	Context string `json:"context"`
+	Ctxn1   string `json:"ctxn1"`
+	Ctxn2   string `json:"ctxn2"`
+
+	Pathrank float32 `json:"pathrank"`
+	Ranking  float32 `json:"ranking"`
+
+	// Package is the source package, including its version.
+	Package string `json:"package"`
+	Version string `json:"version,omitempty"`
+
+	// SourcesURL displays the matching line on sources.debian.org.
+	SourcesURL string `json:"sources_url"`
+
+	// Fingerprint identifies the result independently of the package
+	// version, e.g. for comparing the results of different index versions.
+	Fingerprint string `json:"fingerprint"`
+
+	License        string   `json:"license,omitempty"`
+	BinaryPackages []string `json:"binary_packages,omitempty"`
+
+	// FileMatchesOmitted is the number of further matches in the file
+	// which were omitted (see Query.MaxPerFile).
+	FileMatchesOmitted int `json:"file_matches_omitted,omitempty"`
+
+	// HighlightRanges are the [start, end) byte offsets of the matching
+	// parts of Context.
+	HighlightRanges [][2]int `json:"highlight_ranges,omitempty"`
+}
+
+// Sort is the order of results, see ResultsOptions.
+type Sort string
+
+const (
+	// SortRanking sorts the best results first. It is the default.
+	SortRanking Sort = "ranking"
+	SortPackage Sort = "package"
+	SortPath    Sort = "path"
+)
+
+// ResultsOptions select and order the results of a query when reading them.
+// The zero value returns all results, best first.
+type ResultsOptions struct {
+	// Package, if non-empty, only returns results in the source package of
+	// that name (without version).
+	Package string
+
+	// Path, if non-empty, only returns results whose path matches the glob
+	// pattern, e.g. “*/src/*.c”.
+	Path string
+
+	// FilterExpression, if non-empty, only returns results matching the
+	// expression, see Query.FilterExpression.
+	FilterExpression string
+
+	Sort Sort
+
+	// Reverse reverses the order of Sort.
+	Reverse bool
+
+	// PerPage is the number of results per page (at most 1000). If zero,
+	// Page uses the default of the server, and Results uses 1000.
+	PerPage int
+}
+
+// maxPerPage is the maximum number of results per request which dcs-web
+// accepts.
+const maxPerPage = 1000
+
+func (o *ResultsOptions) params(page, perPage int) url.Values {
+	params := url.Values{}
+	if o.Package != "" {
+		params.Set("package", o.Package)
+	}
+	if o.Path != "" {
+		params.Set("path", o.Path)
+	}
+	if o.FilterExpression != "" {
+		params.Set("filter", o.FilterExpression)
+	}
+	sort := o.Sort
+	if sort == "" {
+		sort = SortRanking
+	}
+	params.Set("sort", string(sort))
+	// Ranking sorts descending by default, package and path ascending.
+	descending := (sort == SortRanking) != o.Reverse
+	if descending {
+		params.Set("order", "desc")
+	} else {
+		params.Set("order", "asc")
+	}
+	if perPage > 0 {
+		params.Set("limit", strconv.Itoa(perPage))
+	}
+	params.Set("page", strconv.Itoa(page))
+	return params
+}
+
+// Page returns the specified page (counting from 0) of the results, waiting
+// for the query to finish first (see Wait). Pages after the last page are
+// empty.
+func (s *Search) Page(ctx context.Context, opts ResultsOptions, page int) ([]Match, error) {
+	return s.page(ctx, &opts, page, opts.PerPage)
+}
+
+func (s *Search) page(ctx context.Context, opts *ResultsOptions, page, perPage int) ([]Match, error) {
+	if err := s.Wait(ctx, nil); err != nil {
+		return nil, err
+	}
+	var matches []Match
+	path := "/results/" + url.PathEscape(s.QueryId) + "/query.json?" + opts.params(page, perPage).Encode()
+	if err := s.c.do(ctx, "GET", path, nil, &matches); err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// Results iterates over the results of a query, requesting them page by page
+// as needed. Create Results using Search.Results.
+type Results struct {
+	s       *Search
+	opts    ResultsOptions
+	perPage int
+
+	page    int
+	pending []Match
+	last    bool
+}
+
+// Results returns an iterator over all results of the query selected by opts.
+func (s *Search) Results(opts ResultsOptions) *Results {
+	perPage := opts.PerPage
+	if perPage <= 0 || perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	return &Results{
+		s:       s,
+		opts:    opts,
+		perPage: perPage,
+	}
+}
+
+// Next returns the next result, or Done once all results were returned. The
+// first call waits for the query to finish (see Search.Wait). Errors other
+// than Done can be retried by calling Next again.
+func (r *Results) Next(ctx context.Context) (*Match, error) {
+	for len(r.pending) == 0 {
+		if r.last {
+			return nil, Done
+		}
+		matches, err := r.s.page(ctx, &r.opts, r.page, r.perPage)
+		if err != nil {
+			return nil, err
+		}
+		r.page++
+		r.pending = matches
+		r.last = len(matches) < r.perPage
+	}
+	m := &r.pending[0]
+	r.pending = r.pending[1:]
+	return m, nil
+}
+
+// Meta summarizes the results of a finished query.
+type Meta struct {
+	QueryId string
+
+	// Generation is the index generation the query was run on.
+	Generation int
+
+	// CountOnly is set for queries with Query.Count, whose results are
+	// only counted (see Packages).
+	CountOnly bool
+
+	// TotalResults is the number of results, or the total number of
+	// matches if CountOnly is set.
+	TotalResults int
+
+	// Packages lists the number of results per source package.
+	Packages []PackageResults
+}
+
+// PackageResults is the number of results within a source package.
+type PackageResults struct {
+	// Package is the source package name, without version.
+	Package string
+	Results int
+}
+
+// Pages returns the number of pages (see Search.Page) of perPage results each,
+// e.g. for displaying links to all pages. perPage must be positive.
+func (m *Meta) Pages(perPage int) int {
+	return (m.TotalResults + perPage - 1) / perPage
+}
+
+// Meta returns the summary of the results, waiting for the query to finish
+// first (see Wait).
+func (s *Search) Meta(ctx context.Context) (*Meta, error) {
+	if err := s.Wait(ctx, nil); err != nil {
+		return nil, err
+	}
+	var meta Meta
+	if err := s.c.do(ctx, "GET", "/api/v1/meta/"+url.PathEscape(s.QueryId), nil, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// ErrStaleIndex is returned by Search.Wait if the index was replaced while
+// waiting (see dcs-web’s -index_generation). The query needs to be started
+// again to get results from the new index.
+var ErrStaleIndex = errors.New("the index was replaced, the query needs to be started again")
+
+// QueryError describes why a query failed, see the error event of dcs-web.
+type QueryError struct {
+	// ErrorType is e.g. “invalidquery”, “toobroad” or “overloaded”.
+	ErrorType string
+
+	// Reason further specifies ErrorType, e.g. “toocomplex” for
+	// “invalidquery” (which can be run anyway using Query.Force).
+	Reason string `json:",omitempty"`
+
+	// Detail explains the error to users.
+	Detail string `json:",omitempty"`
+
+	// ErrorMessage is the underlying error, if any.
+	ErrorMessage string `json:",omitempty"`
+}
+
+func (e *QueryError) Error() string {
+	msg := "query failed: " + e.ErrorType
+	if e.Reason != "" {
+		msg += " (" + e.Reason + ")"
+	}
+	if e.ErrorMessage != "" {
+		msg += ": " + e.ErrorMessage
+	} else if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// decodeQueryError returns the QueryError in the error event b, or nil if b is
+// not an error event.
+func decodeQueryError(b []byte) *QueryError {
+	var ev struct {
+		Type string
+		QueryError
+	}
+	if err := json.Unmarshal(b, &ev); err != nil || ev.Type != "error" {
+		return nil
+	}
+	return &ev.QueryError
+}
+
+// Progress describes how far a running query got.
+type Progress struct {
+	FilesProcessed int
+	FilesTotal     int
+
+	// Results is the number of results found so far.
+	Results int
+}
+
+// A Search is a query which was started using Client.Start. Its methods must
+// not be called concurrently.
+type Search struct {
+	c *Client
+
+	// QueryId identifies the query on the server. Queries which only differ
+	// in their spelling have the same QueryId.
+	QueryId string
+
+	// Cached is set if the results of the query already existed, i.e. the
+	// query was not run again.
+	Cached bool
+
+	// Partial is set by Wait if some source backends did not reply, i.e.
+	// the results are incomplete.
+	Partial *QueryError
+
+	done bool
+	err  error
+
+	// lastEventId is the id of the last event received by Wait.
+	lastEventId string
+}
+
+// queryStarted is the reply of POST /api/v1/query (QueryStarted in dcs-web).
+type queryStarted struct {
+	QueryId string
+	Cached  bool
+	Status  string
+}
+
+// Start starts the query q (or finds the results of an identical query) and
+// returns without waiting for the query to finish.
+func (c *Client) Start(ctx context.Context, q Query) (*Search, error) {
+	opts, err := q.options()
+	if err != nil {
+		return nil, err
+	}
+	var started queryStarted
+	if err := c.do(ctx, "POST", "/api/v1/query", opts, &started); err != nil {
+		return nil, err
+	}
+	if started.QueryId == "" {
+		return nil, fmt.Errorf("no QueryId in reply to POST /api/v1/query")
+	}
+	return &Search{
+		c:       c,
+		QueryId: started.QueryId,
+		Cached:  started.Cached,
+		// Results of finished queries might have been reloaded from disk
+		// by the server, in which case there are no events to wait for.
+		done: started.Status == "finished",
+	}, nil
+}
+
+// longPollReply is the reply of /api/v1/poll/<queryid>?since= (LongPollReply in
+// dcs-web).
+type longPollReply struct {
+	Events      []json.RawMessage
+	LastEventId string
+	Done        bool
+}
+
+// Wait waits until the query is done. If progress is non-nil, it is called
+// with the progress of the query while waiting. Wait returns a *QueryError
+// if the query failed. Other errors (e.g. when ctx is done) do not affect the
+// query, so Wait can be called again.
+func (s *Search) Wait(ctx context.Context, progress func(Progress)) error {
+	for !s.done && s.err == nil {
+		params := url.Values{
+			"v":     []string{strconv.Itoa(protocolVersion)},
+			"since": []string{s.lastEventId},
+		}
+		var reply longPollReply
+		if err := s.c.do(ctx, "GET", "/api/v1/poll/"+url.PathEscape(s.QueryId)+"?"+params.Encode(), nil, &reply); err != nil {
+			return err
+		}
+		for _, ev := range reply.Events {
+			if err := s.handleEvent(ev, progress); err != nil {
+				if _, ok := err.(*QueryError); ok || err == ErrStaleIndex {
+					s.err = err
+				}
+				return err
+			}
+		}
+		s.lastEventId = reply.LastEventId
+		s.done = reply.Done
+	}
+	return s.err
+}
+
+func (s *Search) handleEvent(ev json.RawMessage, progress func(Progress)) error {
+	var typ struct {
+		Type        string
+		WarningType string
+	}
+	if err := json.Unmarshal(ev, &typ); err != nil {
+		return fmt.Errorf("decoding event %s: %v", ev, err)
+	}
+	switch typ.Type {
+	case "progress":
+		if progress == nil {
+			return nil
+		}
+		var p Progress
+		if err := json.Unmarshal(ev, &p); err != nil {
+			return fmt.Errorf("decoding event %s: %v", ev, err)
+		}
+		progress(p)
+
+	case "error":
+		qe := decodeQueryError(ev)
+		if qe.ErrorType == "partialresults" {
+			s.Partial = qe
+			return nil
+		}
+		return qe
+
+	case "warning":
+		if typ.WarningType == "staleindex" {
+			return ErrStaleIndex
+		}
+	}
+	// Other events (e.g. matches, of which only the top results are sent,
+	// or pagination) are not needed, as the results are read once the
+	// query is done.
+	return nil
+}
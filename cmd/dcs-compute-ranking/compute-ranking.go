@@ -28,6 +28,14 @@ var (
 	outputPath = flag.String("output_path",
 		"/var/dcs/ranking.json",
 		"Path to store the resulting ranking JSON data at. Will be overwritten atomically using rename(2), which also implies that TMPDIR= must point to a directory on the same file system as -output_path.")
+
+	binaryPackagesOutputPath = flag.String("binary_packages_output_path",
+		"/var/dcs/binary-packages.json",
+		"Path to store the mapping from source packages to the binary packages built from them at (read by dcs-source-backend). Will be overwritten atomically like -output_path. Empty disables writing the mapping")
+
+	metadataOutputPath = flag.String("metadata_output_path",
+		"/var/dcs/metadata.json",
+		"Path to store the maintainers, descriptions and upstream projects of source packages at (read by dcs-web for the maintainer: and description: keywords and groupby=upstream). Will be overwritten atomically like -output_path. Empty disables writing the metadata")
 )
 
 func mustLoadMirroredControlFile(name string) []godebiancontrol.Paragraph {
@@ -53,6 +61,25 @@ func mustLoadMirroredControlFile(name string) []godebiancontrol.Paragraph {
 	return contents
 }
 
+// writeJSON atomically replaces the file at path with the JSON encoding of v.
+func writeJSON(path string, v interface{}) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "dcs-compute-ranking")
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
 func main() {
 	flag.Parse()
 
@@ -101,8 +128,29 @@ func main() {
 		Rdep float32
 	}
 	rankings := make(map[string]storedRanking)
+	binaries := make(map[string][]string)
+
+	// packageMetadata must match the type of the same name in dcs-web.
+	type packageMetadata struct {
+		Maintainers  []string `json:",omitempty"`
+		Descriptions []string `json:",omitempty"`
+		Upstream     string   `json:",omitempty"`
+		Description  string   `json:",omitempty"`
+		Section      string   `json:",omitempty"`
+		Homepage     string   `json:",omitempty"`
+	}
+	metadata := make(map[string]*packageMetadata)
+	metadataFor := func(srcpkg string) *packageMetadata {
+		m, ok := metadata[srcpkg]
+		if !ok {
+			m = &packageMetadata{}
+			metadata[srcpkg] = m
+		}
+		return m
+	}
 
 	for _, pkg := range sourcePackages {
+		srcpkg := pkg["Package"]
 		rdepcount := float32(0)
 		for _, packageName := range strings.Split(pkg["Binary"], ",") {
 			packageName = strings.TrimSpace(packageName)
@@ -110,8 +158,15 @@ func main() {
 				continue
 			}
 			rdepcount += float32(reverseDeps[packageName])
+			binaries[srcpkg] = appendUnique(binaries[srcpkg], packageName)
 		}
-		srcpkg := pkg["Package"]
+		m := metadataFor(srcpkg)
+		for _, maintainer := range splitMaintainers(pkg["Maintainer"] + "," + pkg["Uploaders"]) {
+			m.Maintainers = appendUnique(m.Maintainers, maintainer)
+		}
+		m.Upstream = upstreamOf(srcpkg, pkg["Version"], pkg["Homepage"])
+		m.Section = pkg["Section"]
+		m.Homepage = strings.TrimSpace(pkg["Homepage"])
 		packageRank := popconInstSrc[srcpkg]
 		rdepcount = 1.0 - (1.0 / float32(rdepcount+1))
 		if *verbose {
@@ -120,20 +175,72 @@ func main() {
 		rankings[srcpkg] = storedRanking{packageRank, rdepcount}
 	}
 
-	f, err := ioutil.TempFile(filepath.Dir(*outputPath), "dcs-compute-ranking")
-	if err != nil {
-		log.Fatal(err)
+	for _, pkg := range binaryPackages {
+		srcpkg, ok := pkg["Source"]
+		if !ok {
+			srcpkg = pkg["Package"]
+		}
+		if idx := strings.Index(srcpkg, " "); idx > -1 {
+			srcpkg = srcpkg[:idx] // strip the version, e.g. “i3-wm (4.16-1)”
+		}
+		// Only the synopsis (first line) of the description is used.
+		description := strings.TrimSpace(strings.SplitN(pkg["Description"], "\n", 2)[0])
+		if description == "" {
+			continue
+		}
+		m := metadataFor(srcpkg)
+		m.Descriptions = appendUnique(m.Descriptions, description)
+		if pkg["Package"] == srcpkg {
+			m.Description = description
+		}
+	}
+	for _, m := range metadata {
+		if m.Description == "" && len(m.Descriptions) > 0 {
+			m.Description = m.Descriptions[0]
+		}
 	}
 
-	if err := json.NewEncoder(f).Encode(rankings); err != nil {
+	if err := writeJSON(*outputPath, rankings); err != nil {
 		log.Fatal(err)
 	}
 
-	if err := f.Close(); err != nil {
-		log.Fatal(err)
+	if *binaryPackagesOutputPath != "" {
+		if err := writeJSON(*binaryPackagesOutputPath, binaries); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	if err := os.Rename(f.Name(), *outputPath); err != nil {
-		log.Fatal(err)
+	if *metadataOutputPath != "" {
+		if err := writeJSON(*metadataOutputPath, metadata); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// splitMaintainers splits the value of the Maintainer and Uploaders fields,
+// e.g. “Jane Doe <jane@debian.org>, Debian X Strike Force
+// <debian-x@lists.debian.org>”, into individual maintainers. Names can contain
+// commas, so only commas following an email address separate maintainers.
+func splitMaintainers(value string) []string {
+	var maintainers []string
+	for _, m := range strings.SplitAfter(value, ">") {
+		m = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(m), ","))
+		if m == "" {
+			continue
+		}
+		maintainers = append(maintainers, m)
+	}
+	return maintainers
+}
+
+// appendUnique appends name to names unless it is already contained. Sources
+// indices can list multiple versions of the same source package, which
+// usually build the same binary packages.
+func appendUnique(names []string, name string) []string {
+	for _, n := range names {
+		if n == name {
+			return names
+		}
 	}
+	return append(names, name)
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var unpackedPath = flag.String("unpacked_path",
+	"",
+	"Path to the unpacked source packages (e.g. i3-wm_4.16-1/), as imported by dcs-package-importer. If set, the Repository field of debian/upstream/metadata determines the upstream project of a source package, falling back to the Homepage field of the Sources index")
+
+// forgeHosts are the hosts whose URLs identify projects by their first two
+// path components (owner and repository), e.g. github.com/i3/i3.
+var forgeHosts = map[string]bool{
+	"github.com":       true,
+	"gitlab.com":       true,
+	"salsa.debian.org": true,
+	"bitbucket.org":    true,
+	"codeberg.org":     true,
+	"gitlab.gnome.org": true,
+	"invent.kde.org":   true,
+	"git.sr.ht":        true,
+}
+
+// normalizeUpstream returns the upstream project identified by the URL u,
+// e.g. “github.com/i3/i3” for https://github.com/i3/i3.git, so that source
+// packages of the same upstream share the same value. Returns the empty
+// string for values which are not URLs.
+func normalizeUpstream(u string) string {
+	parsed, err := url.Parse(strings.TrimSpace(u))
+	if err != nil || parsed.Host == "" {
+		return ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(parsed.Host), "www.")
+	var components []string
+	for _, c := range strings.Split(parsed.Path, "/") {
+		if c != "" {
+			components = append(components, c)
+		}
+	}
+	if forgeHosts[host] && len(components) > 2 {
+		components = components[:2]
+	}
+	if n := len(components); n > 0 {
+		components[n-1] = strings.TrimSuffix(components[n-1], ".git")
+	}
+	return strings.ToLower(strings.Join(append([]string{host}, components...), "/"))
+}
+
+// repositoryFromUpstreamMetadata returns the Repository field of the
+// debian/upstream/metadata file (a YAML document) of the unpacked source
+// package dir, or the empty string.
+func repositoryFromUpstreamMetadata(dir string) string {
+	f, err := os.Open(filepath.Join(dir, "debian", "upstream", "metadata"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Only top-level keys are considered.
+		if !strings.HasPrefix(line, "Repository:") {
+			continue
+		}
+		value := strings.TrimSpace(strings.TrimPrefix(line, "Repository:"))
+		return strings.Trim(value, `"'`)
+	}
+	return ""
+}
+
+// upstreamOf returns the upstream project of the source package srcpkg of the
+// specified version, see normalizeUpstream.
+func upstreamOf(srcpkg, version, homepage string) string {
+	if *unpackedPath != "" {
+		// The package directories do not contain the epoch.
+		if idx := strings.Index(version, ":"); idx > -1 {
+			version = version[idx+1:]
+		}
+		dir := filepath.Join(*unpackedPath, srcpkg+"_"+version)
+		if upstream := normalizeUpstream(repositoryFromUpstreamMetadata(dir)); upstream != "" {
+			return upstream
+		}
+	}
+	return normalizeUpstream(homepage)
+}
@@ -33,7 +33,7 @@ import (
 
 	_ "net/http/pprof"
 
-	_ "github.com/Debian/dcs/varz"
+	"github.com/Debian/dcs/varz"
 )
 
 type mergeState struct {
@@ -71,6 +71,10 @@ var (
 
 	dryRun = flag.Bool("dry_run", false, "Only print changes")
 
+	shardAssignment = flag.String("shard_assignment",
+		"",
+		"Path to a JSON file (see cmd/dcs-rebalance) which assigns source packages to shards, overriding the hash-based assignment. Re-read before each sanity check, which feeds moved packages to their new shard and garbage-collects them on their old shard")
+
 	packageImporters []*packageImporter
 
 	mergeStates   = make(map[int]mergeState)
@@ -312,10 +316,28 @@ func lookfor(dscName string) {
 	}
 }
 
+// loadShardAssignment reads -shard_assignment, if set.
+func loadShardAssignment() error {
+	if *shardAssignment == "" {
+		return nil
+	}
+	a, err := shardmapping.ReadAssignment(*shardAssignment)
+	if err != nil {
+		return err
+	}
+	shardmapping.SetAssignment(a)
+	log.Printf("Loaded shard assignment of %d packages to %d shards\n", len(a.Packages), a.Shards)
+	return nil
+}
+
 func checkSources() {
 	log.Printf("checking sources\n")
 	lastSanityCheckStarted.Set(float64(time.Now().Unix()))
 
+	if err := loadShardAssignment(); err != nil {
+		log.Printf("Could not reload -shard_assignment, keeping the previous one: %v\n", err)
+	}
+
 	// Store packages by shard.
 	type pkgStatus int
 	const (
@@ -473,6 +495,10 @@ func checkSources() {
 func main() {
 	flag.Parse()
 
+	if err := loadShardAssignment(); err != nil {
+		log.Fatal(err)
+	}
+
 	shards := strings.Split(*shardsStr, ",")
 	packageImporters = make([]*packageImporter, len(shards))
 	log.Printf("Configuration: %d shards:\n", len(shards))
@@ -506,6 +532,7 @@ func main() {
 	http.HandleFunc("/lookfor", lookforHandler)
 	http.HandleFunc("/goroutinez", goroutinez.Goroutinez)
 	http.Handle("/metrics", prometheus.Handler())
+	http.HandleFunc("/varz", varz.Handler)
 
 	log.Fatal(http.ListenAndServe(*listenAddress, nil))
 }
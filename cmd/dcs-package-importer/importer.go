@@ -2,6 +2,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -18,18 +19,24 @@ import (
 	"time"
 
 	"github.com/Debian/dcs/grpcutil"
+	"github.com/Debian/dcs/internal/copyright"
+	"github.com/Debian/dcs/internal/decompress"
 	"github.com/Debian/dcs/internal/filter"
 	"github.com/Debian/dcs/internal/index"
+	"github.com/Debian/dcs/ranking"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stapelberg/godebiancontrol"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
+	"github.com/Debian/dcs/internal/ident"
 	"github.com/Debian/dcs/internal/proto/packageimporterpb"
 	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/Debian/dcs/internal/xref"
 
 	_ "net/http/pprof"
 
-	_ "github.com/Debian/dcs/varz"
+	"github.com/Debian/dcs/varz"
 	_ "golang.org/x/net/trace"
 )
 
@@ -44,16 +51,28 @@ var (
 
 	shardPath = flag.String("shard_path",
 		"/srv/dcs/shard0",
-		"Path to the shard directory (containing src, idx, full)")
+		"Path to the shard directory (containing src, idx, licenses, versions, xref, ident, full)")
 
 	cpuProfile = flag.String("cpuprofile",
 		"",
 		"write cpu profile to this file")
 
+	identIndex = flag.Bool("ident_index",
+		false,
+		"Whether to record the identifiers of all files, from which an identifier index (ident.json) is built when merging, so that source backends can answer ident: queries without using the trigram index. The identifier index is only built once all packages in the shard were imported with -ident_index")
+
 	debugSkip = flag.Bool("debug_skip",
 		false,
 		"Print log messages when files are skipped")
 
+	rankingDataPath = flag.String("ranking_data_path",
+		"/var/dcs/ranking.json",
+		"Path to the JSON containing ranking data, from which the static ranking components of each file are precomputed when merging (see -ranking_data_path of dcs-source-backend). Empty disables the precomputation")
+
+	// rankingDataLoaded is true if ranking data was read from
+	// -ranking_data_path, see mergeFileRanks.
+	rankingDataLoaded bool
+
 	tmpdir string
 
 	failedDpkgSourceExtracts = prometheus.NewCounter(
@@ -276,6 +295,22 @@ func (s *server) GarbageCollect(ctx context.Context, req *packageimporterpb.Garb
 		return nil, err
 	}
 
+	if err := os.RemoveAll(filepath.Join(*shardPath, "licenses", pkg)); err != nil {
+		return nil, err
+	}
+
+	if err := os.RemoveAll(filepath.Join(*shardPath, "versions", pkg)); err != nil {
+		return nil, err
+	}
+
+	if err := os.RemoveAll(filepath.Join(*shardPath, "xref", pkg)); err != nil {
+		return nil, err
+	}
+
+	if err := os.RemoveAll(filepath.Join(*shardPath, "ident", pkg)); err != nil {
+		return nil, err
+	}
+
 	successfulGarbageCollects.Inc()
 	return &packageimporterpb.GarbageCollectReply{}, nil
 }
@@ -350,6 +385,21 @@ func mergeToShard() error {
 	}
 	t1 := time.Now()
 	log.Printf("merged in %v\n", t1.Sub(t0))
+	if err := mergeLicenses(tmpIndexPath, names); err != nil {
+		return err
+	}
+	if err := mergeVersions(tmpIndexPath, names); err != nil {
+		return err
+	}
+	if err := mergeXref(tmpIndexPath, names); err != nil {
+		return err
+	}
+	if err := mergeIdent(tmpIndexPath, names); err != nil {
+		return err
+	}
+	if err := mergeFileRanks(tmpIndexPath); err != nil {
+		return err
+	}
 	//for i := 1; i < len(indexFiles); i++ {
 	//	log.Printf("merging %s with %s\n", indexFiles[i-1], indexFiles[i])
 	//	t0 := time.Now()
@@ -381,6 +431,245 @@ func mergeToShard() error {
 	return nil
 }
 
+// mergeLicenses combines the license information of all packages (see
+// storeLicenses) into the licenses.json file of the shard, which the source
+// backend loads along with the index.
+func mergeLicenses(indexPath string, names []string) error {
+	licenses := make(copyright.Licenses)
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(*shardPath, "licenses", name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		var c copyright.Copyright
+		if err := json.Unmarshal(b, &c); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		licenses[name] = &c
+	}
+	b, err := json.Marshal(licenses)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(indexPath, "licenses.json"), b, 0644)
+}
+
+// storeLicenses parses the debian/copyright file of the package, if it is
+// machine-readable, and stores the result for mergeLicenses.
+func storeLicenses(pkg, unpacked string) error {
+	path := filepath.Join(*shardPath, "licenses", pkg)
+	// Remove license information of a previous import, if any.
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	f, err := os.Open(filepath.Join(unpacked, "debian", "copyright"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	c, err := copyright.Parse(f)
+	if err != nil {
+		log.Printf("%s: not storing license information: %v", pkg, err)
+		return nil
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// mergeVersions combines the versions of all packages (see storeVersion) into
+// the versions.json file of the shard, which the source backend loads along
+// with the index.
+func mergeVersions(indexPath string, names []string) error {
+	versions := make(map[string]string)
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(*shardPath, "versions", name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		versions[name] = strings.TrimSpace(string(b))
+	}
+	b, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(indexPath, "versions.json"), b, 0644)
+}
+
+// storeVersion stores the version of the package, as declared in its .dsc
+// file, for mergeVersions. In contrast to the version contained in the package
+// directory name (e.g. i3-wm_4.16-1), it includes the epoch, if any.
+func storeVersion(pkg, dscPath string) error {
+	f, err := os.Open(dscPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	paragraphs, err := godebiancontrol.Parse(godebiancontrol.PGPSignatureStripper(f))
+	if err != nil {
+		return err
+	}
+	if len(paragraphs) == 0 || paragraphs[0]["Version"] == "" {
+		return fmt.Errorf("%s: no Version field", dscPath)
+	}
+	path := filepath.Join(*shardPath, "versions", pkg)
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(paragraphs[0]["Version"]+"\n"), 0644)
+}
+
+// mergeXref combines the includes/imports of all packages (see storeXref)
+// into the xref.json file of the shard, which the source backend loads along
+// with the index.
+func mergeXref(indexPath string, names []string) error {
+	x := make(xref.Index)
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(*shardPath, "xref", name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		var pkgx xref.Index
+		if err := json.Unmarshal(b, &pkgx); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		x.Merge(pkgx)
+	}
+	b, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(indexPath, "xref.json"), b, 0644)
+}
+
+// storeXref stores the includes/imports of the package (see xref.Extract) for
+// mergeXref.
+func storeXref(pkg string, x xref.Index) error {
+	b, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(*shardPath, "xref", pkg)
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// mergeIdent combines the identifiers of all packages (see storeIdent) into
+// the ident.json file of the shard, which the source backend loads along with
+// the index. As lookups must not miss any files, no ident.json is written
+// unless all packages were imported with -ident_index.
+func mergeIdent(indexPath string, names []string) error {
+	if !*identIndex {
+		return nil
+	}
+	x := ident.NewIndex()
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(*shardPath, "ident", name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				log.Printf("not building identifier index: %s was imported without -ident_index", name)
+				return nil
+			}
+			return err
+		}
+		pkgx := ident.NewIndex()
+		if err := json.Unmarshal(b, pkgx); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		x.Merge(pkgx)
+	}
+	b, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(indexPath, "ident.json"), b, 0644)
+}
+
+// storeIdent stores the identifiers of the package (see ident.Collector) for
+// mergeIdent.
+func storeIdent(pkg string, x *ident.Index) error {
+	b, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(*shardPath, "ident", pkg)
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// mergeFileRanks precomputes the static ranking components of all files of the
+// merged index into the ranks.bin file of the shard, which the source backend
+// loads along with the index. Without ranking data, no ranks.bin is written, so
+// that the source backend computes the components itself.
+func mergeFileRanks(indexPath string) error {
+	if !rankingDataLoaded {
+		return nil
+	}
+	ix, err := index.Open(indexPath)
+	if err != nil {
+		return err
+	}
+	defer ix.Close()
+	f, err := os.Create(filepath.Join(indexPath, "ranks.bin"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := ranking.WriteFileRanks(f, ix.DocidMap.All()); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// copyCompressed copies the compressed file at path to f as-is (the source
+// backend decompresses it when searching, see -decompress_extensions), and
+// collects the identifiers of its decompressed contents.
+func copyCompressed(f *os.File, path, name, compression string, identifiers *ident.Index) error {
+	input, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Could not open input file %q: %v\n", path, err)
+	}
+	defer input.Close()
+	if _, err := io.Copy(f, input); err != nil {
+		return fmt.Errorf("Could not copy %q to %q: %v\n", path, f.Name(), err)
+	}
+	if !*identIndex {
+		return nil
+	}
+	decompressed, err := decompress.Open(path, compression)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+	var c ident.Collector
+	if _, err := io.Copy(&c, decompressed); err != nil {
+		return fmt.Errorf("Could not decompress %q: %v\n", path, err)
+	}
+	identifiers.Add(name, c.Components())
+	return nil
+}
+
 func indexPackage(pkg string) error {
 	log.Printf("Indexing %s\n", pkg)
 	unpacked := filepath.Join(tmpdir, pkg, pkg)
@@ -388,6 +677,10 @@ func indexPackage(pkg string) error {
 		return err
 	}
 
+	if err := storeLicenses(pkg, unpacked); err != nil {
+		return err
+	}
+
 	// Write to a temporary file first so that merges can happen at the same
 	// time. If we don’t do that, merges will try to use incomplete index
 	// files, which are interpreted as corrupted.
@@ -398,6 +691,8 @@ func indexPackage(pkg string) error {
 	}
 	// +1 because of the / that should not be included in the index.
 	stripLen := len(filepath.Join(tmpdir, pkg)) + 1
+	includes := make(xref.Index)
+	identifiers := ident.NewIndex()
 
 	if err := index.AddDir(
 		unpacked,
@@ -419,24 +714,53 @@ func indexPackage(pkg string) error {
 			if err := os.MkdirAll(filepath.Dir(outputPath), os.FileMode(0755)); err != nil {
 				return fmt.Errorf("Could not create directory: %v\n", err)
 			}
-			output, err := os.Create(outputPath)
+			f, err := os.Create(outputPath)
 			if err != nil {
 				return fmt.Errorf("Could not create output file %q: %v\n", outputPath, err)
 			}
-			defer output.Close()
+			defer f.Close()
+			if compression := decompress.Compression(path); compression != "" {
+				return copyCompressed(f, path, path[stripLen:], compression, identifiers)
+			}
+			var output io.Writer = f
+			if *identIndex {
+				var c ident.Collector
+				output = io.MultiWriter(f, &c)
+				defer func() { identifiers.Add(path[stripLen:], c.Components()) }()
+			}
 			input, err := os.Open(path)
 			if err != nil {
 				return fmt.Errorf("Could not open input file %q: %v\n", path, err)
 			}
 			defer input.Close()
+			if !xref.Supported(path) {
+				if _, err := io.Copy(output, input); err != nil {
+					return fmt.Errorf("Could not copy %q to %q: %v\n", path, outputPath, err)
+				}
+				return nil
+			}
+			extracted, err := xref.Extract(path, io.TeeReader(input, output))
+			if err != nil {
+				return fmt.Errorf("Could not copy %q to %q: %v\n", path, outputPath, err)
+			}
+			// Extract stops reading at overly long lines.
 			if _, err := io.Copy(output, input); err != nil {
 				return fmt.Errorf("Could not copy %q to %q: %v\n", path, outputPath, err)
 			}
+			includes.Add(path[stripLen:], extracted)
 			return nil
 		},
 	); err != nil {
 		return err
 	}
+	if err := storeXref(pkg, includes); err != nil {
+		return err
+	}
+	if *identIndex {
+		if err := storeIdent(pkg, identifiers); err != nil {
+			return err
+		}
+	}
 	if err := index.Flush(); err != nil {
 		return err
 	}
@@ -521,6 +845,9 @@ func unpackAndIndex(dscPath string) error {
 	}
 
 	successfulDpkgSourceExtracts.Inc()
+	if err := storeVersion(pkg, filepath.Join(tmpdir, dscPath)); err != nil {
+		return err
+	}
 	if err := indexPackage(pkg); err != nil {
 		return err
 	}
@@ -564,6 +891,14 @@ func main() {
 
 	filter.Init()
 
+	if *rankingDataPath != "" {
+		if err := ranking.ReadRankingData(*rankingDataPath); err != nil {
+			log.Printf("Not precomputing file ranks: %v", err)
+		} else {
+			rankingDataLoaded = true
+		}
+	}
+
 	var err error
 	tmpdir, err = ioutil.TempDir("", "dcs-importer")
 	if err != nil {
@@ -571,6 +906,7 @@ func main() {
 	}
 
 	http.Handle("/metrics", prometheus.Handler())
+	http.HandleFunc("/varz", varz.Handler)
 
 	log.Fatal(grpcutil.ListenAndServeTLS(*listenAddress,
 		*tlsCertPath,
@@ -0,0 +1,343 @@
+// Computes a new assignment of source packages to shards, so that index size
+// and query load are balanced across shards, e.g. when one shard is hot or
+// when shards are added to split hot shards.
+//
+// The current layout is read from the output of dcs du for each shard:
+//
+//	% dcs du -pos /srv/dcs/shard0/idx/* > shard0.du
+//
+// With -output_dir, dcs-rebalance writes the new assignment (assignment.json,
+// for the -shard_assignment flag of dcs-feeder and dcs-web) and one move
+// manifest per shard (moves-<shard>.json), listing the packages which need
+// to be moved off that shard. Once dcs-feeder uses the new assignment, its
+// next sanity check feeds moved packages to their new shard and
+// garbage-collects them on their old shard. The manifests allow copying the
+// unpacked packages and their indexes beforehand instead, like dcs-reshard.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Debian/dcs/shardmapping"
+	"github.com/google/renameio"
+)
+
+var (
+	sizes = flag.String("sizes",
+		"",
+		"Comma-separated list of files (one per shard, in shard order) containing the output of dcs du -pos <shard>/idx/*")
+
+	load = flag.String("load",
+		"",
+		"Comma-separated list of the query load of each shard (in shard order), e.g. the average search duration of each source backend. If empty, only the index size is balanced")
+
+	loadWeight = flag.Float64("load_weight",
+		0.5,
+		"Weight of the query load (between 0 and 1) relative to the index size. Ignored if -load is empty")
+
+	newShards = flag.Int("new_shards",
+		0,
+		"Number of shards after rebalancing. Additional shards start out empty, i.e. packages are moved from the existing shards onto them. 0 means the current number of shards")
+
+	tolerance = flag.Float64("tolerance",
+		0.05,
+		"How much (as a fraction) the cost of a shard may exceed the average cost of all shards")
+
+	maxMoves = flag.Int("max_moves",
+		0,
+		"Maximum number of packages to move. 0 means unlimited")
+
+	outputDir = flag.String("output_dir",
+		"",
+		"Directory in which to write assignment.json and moves-<shard>.json. If empty, only the planned moves are printed")
+)
+
+// pkg is a source package on a shard.
+type pkg struct {
+	// name includes the version, e.g. “i3-wm_4.8-1”.
+	name  string
+	bytes int64
+	// cost is the package’s share of the size and load of all shards.
+	cost  float64
+	shard int
+}
+
+// move moves a package between shards. Move manifests (moves-<shard>.json)
+// contain a list of moves.
+type move struct {
+	Package string
+	From    int
+	To      int
+	Bytes   int64
+}
+
+// readSizes parses the output of dcs du (without -h), returning the size of
+// each package directory.
+func readSizes(r io.Reader) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[1] == "total" {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q (dcs du -h output is not supported)", fields[0])
+		}
+		sizes[filepath.Base(fields[1])] = n
+	}
+	return sizes, scanner.Err()
+}
+
+// assignCosts sets the cost of each package to its share of the total index
+// size and (if loads is non-nil) its share of the total query load, weighted
+// by weight. The load of a shard is distributed among its packages
+// proportionally to their size.
+func assignCosts(pkgs []*pkg, loads []float64, weight float64) {
+	var totalBytes int64
+	shardBytes := make(map[int]int64)
+	for _, p := range pkgs {
+		totalBytes += p.bytes
+		shardBytes[p.shard] += p.bytes
+	}
+	var totalLoad float64
+	for _, l := range loads {
+		totalLoad += l
+	}
+	if loads == nil || totalLoad == 0 {
+		weight = 0
+	}
+	for _, p := range pkgs {
+		if totalBytes == 0 {
+			p.cost = 0
+			continue
+		}
+		p.cost = (1 - weight) * float64(p.bytes) / float64(totalBytes)
+		if weight > 0 && shardBytes[p.shard] > 0 {
+			share := float64(p.bytes) / float64(shardBytes[p.shard])
+			p.cost += weight * loads[p.shard] * share / totalLoad
+		}
+	}
+}
+
+// shardCosts returns the sum of the package costs of each shard.
+func shardCosts(pkgs []*pkg, shards int) []float64 {
+	costs := make([]float64, shards)
+	for _, p := range pkgs {
+		costs[p.shard] += p.cost
+	}
+	return costs
+}
+
+// rebalance moves packages (by changing their shard) from the most expensive
+// to the cheapest shard until no shard exceeds the average cost by more than
+// tolerance, or until maxMoves packages were moved (0 means unlimited). Each
+// package is moved at most once. Returns the moves.
+func rebalance(pkgs []*pkg, shards int, tolerance float64, maxMoves int) []move {
+	costs := shardCosts(pkgs, shards)
+	var total float64
+	for _, c := range costs {
+		total += c
+	}
+	limit := total / float64(shards) * (1 + tolerance)
+
+	// The packages of each shard which were not moved yet, cheapest first.
+	candidates := make([][]*pkg, shards)
+	for _, p := range pkgs {
+		candidates[p.shard] = append(candidates[p.shard], p)
+	}
+	for _, c := range candidates {
+		sort.Slice(c, func(i, j int) bool {
+			if c[i].cost != c[j].cost {
+				return c[i].cost < c[j].cost
+			}
+			return c[i].name < c[j].name
+		})
+	}
+
+	from := make(map[*pkg]int)
+	for maxMoves == 0 || len(from) < maxMoves {
+		hot, cold := 0, 0
+		for idx, c := range costs {
+			if c > costs[hot] {
+				hot = idx
+			}
+			if c < costs[cold] {
+				cold = idx
+			}
+		}
+		if costs[hot] <= limit {
+			break
+		}
+		// Moving a package of cost c reduces the difference between the
+		// two shards to |diff - 2c|, so the best package costs diff/2.
+		diff := costs[hot] - costs[cold]
+		c := candidates[hot]
+		idx := sort.Search(len(c), func(i int) bool { return c[i].cost > diff/2 })
+		best := -1
+		if idx > 0 {
+			best = idx - 1
+		}
+		if idx < len(c) && c[idx].cost < diff && (best == -1 || c[idx].cost-diff/2 < diff/2-c[best].cost) {
+			best = idx
+		}
+		if best == -1 || c[best].cost == 0 {
+			break // no move improves the balance
+		}
+		p := c[best]
+		candidates[hot] = append(c[:best], c[best+1:]...)
+		from[p] = p.shard
+		p.shard = cold
+		costs[hot] -= p.cost
+		costs[cold] += p.cost
+	}
+
+	moves := make([]move, 0, len(from))
+	for p, shard := range from {
+		moves = append(moves, move{
+			Package: p.name,
+			From:    shard,
+			To:      p.shard,
+			Bytes:   p.bytes,
+		})
+	}
+	sort.Slice(moves, func(i, j int) bool {
+		return moves[i].Package < moves[j].Package
+	})
+	return moves
+}
+
+// assignment returns the assignment which places each package on its shard.
+// Only packages which hashing would place elsewhere are listed.
+func assignment(pkgs []*pkg, shards int) *shardmapping.Assignment {
+	a := &shardmapping.Assignment{
+		Shards:   shards,
+		Packages: make(map[string]int),
+	}
+	for _, p := range pkgs {
+		if shardmapping.HashTaskIdx(p.name, shards) == p.shard {
+			continue
+		}
+		name := p.name
+		if idx := strings.IndexByte(name, '_'); idx > -1 {
+			name = name[:idx]
+		}
+		a.Packages[name] = p.shard
+	}
+	return a
+}
+
+func writeManifests(dir string, moves []move, shards int) error {
+	byShard := make([][]move, shards)
+	for _, m := range moves {
+		byShard[m.From] = append(byShard[m.From], m)
+	}
+	for idx, shardMoves := range byShard {
+		if shardMoves == nil {
+			shardMoves = []move{}
+		}
+		b, err := json.MarshalIndent(shardMoves, "", "  ")
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, fmt.Sprintf("moves-%d.json", idx))
+		if err := renameio.WriteFile(path, append(b, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPackages(paths []string) ([]*pkg, error) {
+	var pkgs []*pkg
+	for idx, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		shardSizes, err := readSizes(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for name, bytes := range shardSizes {
+			pkgs = append(pkgs, &pkg{name: name, bytes: bytes, shard: idx})
+		}
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].name < pkgs[j].name
+	})
+	return pkgs, nil
+}
+
+func main() {
+	flag.Parse()
+
+	if *sizes == "" {
+		log.Fatalf("-sizes must be specified")
+	}
+	paths := strings.Split(*sizes, ",")
+	shards := *newShards
+	if shards == 0 {
+		shards = len(paths)
+	}
+	if shards < len(paths) {
+		log.Fatalf("-new_shards must be at least the number of current shards (%d): removing shards is not supported", len(paths))
+	}
+	var loads []float64
+	if *load != "" {
+		for _, l := range strings.Split(*load, ",") {
+			f, err := strconv.ParseFloat(l, 64)
+			if err != nil {
+				log.Fatalf("invalid -load value %q: %v", l, err)
+			}
+			loads = append(loads, f)
+		}
+		if len(loads) != len(paths) {
+			log.Fatalf("-load has %d values, but -sizes has %d files", len(loads), len(paths))
+		}
+	}
+
+	pkgs, err := readPackages(paths)
+	if err != nil {
+		log.Fatal(err)
+	}
+	assignCosts(pkgs, loads, *loadWeight)
+	before := shardCosts(pkgs, shards)
+	moves := rebalance(pkgs, shards, *tolerance, *maxMoves)
+	after := shardCosts(pkgs, shards)
+
+	var moved int64
+	for _, m := range moves {
+		log.Printf("moving %s (%d bytes) from shard %d to shard %d\n", m.Package, m.Bytes, m.From, m.To)
+		moved += m.Bytes
+	}
+	for idx := range before {
+		log.Printf("shard %d: cost %.3f → %.3f\n", idx, before[idx], after[idx])
+	}
+	log.Printf("%d of %d packages (%d bytes) moved\n", len(moves), len(pkgs), moved)
+
+	if *outputDir == "" {
+		return
+	}
+	if err := os.MkdirAll(*outputDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := shardmapping.WriteAssignment(filepath.Join(*outputDir, "assignment.json"), assignment(pkgs, shards)); err != nil {
+		log.Fatal(err)
+	}
+	if err := writeManifests(*outputDir, moves, shards); err != nil {
+		log.Fatal(err)
+	}
+}
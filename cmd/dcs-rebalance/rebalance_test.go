@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/Debian/dcs/shardmapping"
+)
+
+func TestReadSizes(t *testing.T) {
+	sizes, err := readSizes(strings.NewReader(`4613734 /srv/dcs/shard5/idx/zypper_1.14.11-1
+150732 /srv/dcs/shard5/idx/zzz-to-char_0.1.3-1
+4764466 total
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(sizes), 2; got != want {
+		t.Fatalf("len(sizes) = %d, want %d", got, want)
+	}
+	if got, want := sizes["zypper_1.14.11-1"], int64(4613734); got != want {
+		t.Errorf("sizes[zypper] = %d, want %d", got, want)
+	}
+
+	if _, err := readSizes(strings.NewReader("4.4M /srv/dcs/shard5/idx/zypper_1.14.11-1\n")); err == nil {
+		t.Errorf("readSizes unexpectedly accepted human-readable sizes")
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	// Shard 0 is hot: it holds 8 of 10 equally sized packages.
+	var pkgs []*pkg
+	for i := 0; i < 10; i++ {
+		shard := 0
+		if i >= 8 {
+			shard = 1
+		}
+		pkgs = append(pkgs, &pkg{
+			name:  "pkg" + string('a'+rune(i)) + "_1.0-1",
+			bytes: 100,
+			shard: shard,
+		})
+	}
+	assignCosts(pkgs, nil, 0.5)
+
+	// Split the hot shard by adding a third one.
+	moves := rebalance(pkgs, 3, 0.25, 0)
+	costs := shardCosts(pkgs, 3)
+	for idx, c := range costs {
+		if c > 1.0/3*1.25+1e-9 {
+			t.Errorf("shard %d still too expensive after rebalancing: %.3f (costs %v)", idx, c, costs)
+		}
+	}
+	// 4/3/3 packages is within tolerance.
+	if got, want := len(moves), 4; got != want {
+		t.Errorf("len(moves) = %d, want %d (%+v)", got, want, moves)
+	}
+	for _, m := range moves {
+		if m.From != 0 {
+			t.Errorf("package %s moved off the cold shard %d", m.Package, m.From)
+		}
+	}
+
+	// The assignment places every package on its new shard.
+	shardmapping.SetAssignment(assignment(pkgs, 3))
+	defer shardmapping.SetAssignment(nil)
+	for _, p := range pkgs {
+		if got := shardmapping.TaskIdxForPackage(p.name, 3); got != p.shard {
+			t.Errorf("TaskIdxForPackage(%q) = %d, want %d", p.name, got, p.shard)
+		}
+	}
+}
+
+func TestRebalanceMaxMoves(t *testing.T) {
+	pkgs := []*pkg{
+		{name: "a_1", bytes: 100, shard: 0},
+		{name: "b_1", bytes: 100, shard: 0},
+		{name: "c_1", bytes: 100, shard: 0},
+		{name: "d_1", bytes: 100, shard: 0},
+	}
+	assignCosts(pkgs, nil, 0)
+	if got, want := len(rebalance(pkgs, 2, 0, 1)), 1; got != want {
+		t.Errorf("len(moves) = %d, want %d", got, want)
+	}
+}
+
+func TestAssignCostsLoad(t *testing.T) {
+	pkgs := []*pkg{
+		{name: "a_1", bytes: 100, shard: 0},
+		{name: "b_1", bytes: 100, shard: 1},
+	}
+	// Shard 0 receives three times the load of shard 1.
+	assignCosts(pkgs, []float64{3, 1}, 1)
+	if got, want := pkgs[0].cost, 0.75; math.Abs(got-want) > 1e-9 {
+		t.Errorf("cost = %v, want %v", got, want)
+	}
+}
@@ -10,19 +10,25 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/Debian/dcs/grpcutil"
+	"github.com/Debian/dcs/internal/copyright"
+	"github.com/Debian/dcs/internal/ident"
 	"github.com/Debian/dcs/internal/index"
 	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
 	"github.com/Debian/dcs/internal/sourcebackend"
+	"github.com/Debian/dcs/internal/xref"
 	"github.com/Debian/dcs/ranking"
-	_ "github.com/Debian/dcs/varz"
+	"github.com/Debian/dcs/varz"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/uber/jaeger-client-go"
 	jaegercfg "github.com/uber/jaeger-client-go/config"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 var (
@@ -35,6 +41,9 @@ var (
 	rankingDataPath = flag.String("ranking_data_path",
 		"/var/dcs/ranking.json",
 		"Path to the JSON containing ranking data")
+	binaryPackagesPath = flag.String("binary_packages_path",
+		"/var/dcs/binary-packages.json",
+		"Path to the JSON containing the binary packages built from each source package (see dcs-compute-ranking -binary_packages_output_path)")
 	tlsCertPath = flag.String("tls_cert_path", "", "Path to a .pem file containing the TLS certificate.")
 	tlsKeyPath  = flag.String("tls_key_path", "", "Path to a .pem file containing the TLS private key.")
 	jaegerAgent = flag.String("jaeger_agent",
@@ -44,6 +53,25 @@ var (
 	usePositionalIndex = flag.Bool("use_positional_index",
 		false,
 		"use the pos and posrel index sections for identifier queries")
+
+	maxMatchesPerFile = flag.Int("max_matches_per_file",
+		50,
+		"Maximum number of matches to return per file (0 means unlimited), so that large generated files do not dominate the results. Queries can override this with max_per_file=")
+
+	maxLineLength = flag.Int("max_line_length",
+		500,
+		"Maximum length in bytes of the context lines of results (0 means unlimited), so that e.g. minified files do not bloat result pages. Longer lines are truncated (around the match, for the matching line). Queries can override this with max_line_length=")
+
+	snapshot = flag.String("snapshot",
+		"",
+		"Archive snapshot date (e.g. 2015-06-01) of the index shard, if it does not contain the current archive. Must match the dcs-web -snapshot_backends configuration")
+
+	candidateCacheBytes = flag.Int("candidate_cache_bytes",
+		64*1024*1024,
+		"Approximate memory size of the cache of candidate files per trigram query, so that repeated and related queries skip the posting list work. 0 disables the cache")
+	candidateCacheTTL = flag.Duration("candidate_cache_ttl",
+		1*time.Hour,
+		"Maximum age of candidate cache entries (0 means no limit). Entries are always discarded when the index is replaced")
 )
 
 func main() {
@@ -79,6 +107,11 @@ func main() {
 		log.Fatal(err)
 	}
 
+	binaries, err := sourcebackend.ReadBinaryPackages(*binaryPackagesPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	idx := *indexPath
 	if _, err := os.Stat(idx); os.IsNotExist(err) {
 		tmp, err := ioutil.TempDir("", "dcs-index-backend")
@@ -101,18 +134,68 @@ func main() {
 		log.Fatal(err)
 	}
 
+	licenses, err := copyright.ReadLicenses(filepath.Join(idx, "licenses.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	versions, err := sourcebackend.ReadVersions(filepath.Join(idx, "versions.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	includes, err := xref.ReadIndex(filepath.Join(idx, "xref.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	identifiers, err := ident.ReadIndex(filepath.Join(idx, "ident.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ranks, err := sourcebackend.ReadFileRanks(filepath.Join(idx, "ranks.bin"), ix.DocidMap.Count)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	srv := &sourcebackend.Server{
 		Index:              ix,
+		Licenses:           licenses,
+		Versions:           versions,
+		Includes:           includes,
+		Identifiers:        identifiers,
+		FileRanks:          ranks,
+		BinaryPackages:     binaries,
 		UnpackedPath:       *unpackedPath,
 		IndexPath:          *indexPath,
 		UsePositionalIndex: *usePositionalIndex,
+		MaxMatchesPerFile:  *maxMatchesPerFile,
+		MaxLineLength:      *maxLineLength,
+		Snapshot:           *snapshot,
+	}
+	if *candidateCacheBytes > 0 {
+		srv.CandidateCache = sourcebackend.NewCandidateCache(*candidateCacheBytes, *candidateCacheTTL)
 	}
 
+	// The gRPC health service (which dcs-web checks, see its /readyz) and
+	// /readyz report the server as ready once the index is warmed up.
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	go func() {
+		srv.WarmUp()
+		healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	}()
+
 	http.Handle("/metrics", prometheus.Handler())
+	http.HandleFunc("/varz", varz.Handler)
+	http.HandleFunc("/healthz", sourcebackend.HealthzHandler)
+	http.HandleFunc("/readyz", srv.ReadyzHandler)
 	log.Fatal(grpcutil.ListenAndServeTLS(*listenAddress,
 		*tlsCertPath,
 		*tlsKeyPath,
 		func(s *grpc.Server) {
 			sourcebackendpb.RegisterSourceBackendServer(s, srv)
+			healthpb.RegisterHealthServer(s, healthServer)
 		}))
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	abandonedQueryGrace = flag.Duration("abandoned_query_grace",
+		0,
+		"If non-zero, queries are cancelled once no client has been streaming their events (via /events, /instantws or gRPC) for this long. Clients which reattach within this duration keep the query running; later, the query is started anew. 0 disables cancelling abandoned queries")
+
+	abandonedQueries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "queries_abandoned",
+			Help: "Number of queries cancelled because all clients disconnected (see -abandoned_query_grace).",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(abandonedQueries)
+}
+
+// querySubscribers tracks how many clients are streaming the events of each
+// query, so that queries without clients can be cancelled after
+// -abandoned_query_grace, see abandonQuery.
+//
+// Unlike queryUsage, which also counts e.g. result page requests, only
+// clients waiting for the query to finish are counted.
+//
+// Lock order: stateMu before querySubscribers.mu.
+type querySubscribers struct {
+	mu     sync.Mutex
+	count  map[string]int
+	timers map[string]*time.Timer
+}
+
+var subscribers = &querySubscribers{
+	count:  make(map[string]int),
+	timers: make(map[string]*time.Timer),
+}
+
+// subscribeQuery marks a client as streaming the events of the query until the
+// returned function is called, which may be called more than once.
+func subscribeQuery(queryid string) func() {
+	subscribers.mu.Lock()
+	subscribers.count[queryid]++
+	if timer, ok := subscribers.timers[queryid]; ok {
+		// A client reattached within the grace period.
+		timer.Stop()
+		delete(subscribers.timers, queryid)
+	}
+	subscribers.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() { unsubscribeQuery(queryid) })
+	}
+}
+
+// watchSubscriber subscribes to the query until the returned function is called
+// or ctx is done, whichever happens first: a client which disconnects is
+// otherwise only noticed when sending it the next event fails.
+func watchSubscriber(ctx context.Context, queryid string) func() {
+	unsubscribe := subscribeQuery(queryid)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			unsubscribe()
+		case <-stop:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stop) })
+		unsubscribe()
+	}
+}
+
+func unsubscribeQuery(queryid string) {
+	// Checked before acquiring subscribers.mu, see the lock order.
+	done := queryDone(queryid)
+	subscribers.mu.Lock()
+	defer subscribers.mu.Unlock()
+	subscribers.count[queryid]--
+	if subscribers.count[queryid] > 0 {
+		return
+	}
+	delete(subscribers.count, queryid)
+	if *abandonedQueryGrace <= 0 || done {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(*abandonedQueryGrace, func() {
+		subscribers.mu.Lock()
+		// The timer might have been replaced after a client reattached and
+		// disconnected again.
+		current := subscribers.timers[queryid] == timer && subscribers.count[queryid] == 0
+		if current {
+			delete(subscribers.timers, queryid)
+		}
+		subscribers.mu.Unlock()
+		if current {
+			abandonQuery(queryid)
+		}
+	})
+	subscribers.timers[queryid] = timer
+}
+
+// abandonQuery cancels the Search RPCs of the query, unless it is already done.
+// The query finishes with the results received so far, and is treated like an
+// expired query once done (see queryExistsLocked), i.e. clients which request
+// it later start it anew.
+func abandonQuery(queryid string) {
+	stateMu.Lock()
+	s, ok := state[queryid]
+	if !ok || s.done || s.abandoned {
+		stateMu.Unlock()
+		return
+	}
+	s.abandoned = true
+	state[queryid] = s
+	stateMu.Unlock()
+
+	log.Printf("[%s] no clients for %v, cancelling query\n", queryid, *abandonedQueryGrace)
+	abandonedQueries.Inc()
+	addEventMarshal(queryid, newError(errorTypeCancelled, "abandoned"))
+	s.cancel()
+}
+
+func queryAbandoned(queryid string) bool {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return state[queryid].abandoned
+}
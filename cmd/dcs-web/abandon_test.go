@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitDone waits until the query is done and returns its state.
+func waitDone(t *testing.T, queryid string) queryState {
+	deadline := time.Now().Add(10 * time.Second)
+	for !queryDone(queryid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("query %s not done within 10s", queryid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return state[queryid]
+}
+
+func TestAbandonedQuery(t *testing.T) {
+	defer useFakeBackends(t, &fakeBackend{stall: true})()
+	oldGrace := *abandonedQueryGrace
+	*abandonedQueryGrace = 50 * time.Millisecond
+	defer func() { *abandonedQueryGrace = oldGrace }()
+
+	const query = "q=abandoned&literal=1"
+	queryid := queryIdentifier(query)
+	unsubscribe := subscribeQuery(queryid)
+	if _, err := maybeStartQuery(context.Background(), queryid, "test", query); err != nil {
+		t.Fatal(err)
+	}
+	defer forgetQuery(queryid)
+
+	// A client which reattaches within the grace period keeps the query
+	// running.
+	unsubscribe()
+	unsubscribe = subscribeQuery(queryid)
+	time.Sleep(2 * *abandonedQueryGrace)
+	if queryAbandoned(queryid) {
+		t.Fatalf("query abandoned even though a client reattached")
+	}
+
+	unsubscribe()
+	s := waitDone(t, queryid)
+	if !s.abandoned {
+		t.Fatalf("query done, but not abandoned")
+	}
+	if got, want := s.errorType, "cancelled"; got != want {
+		t.Errorf("errorType = %q, want %q", got, want)
+	}
+
+	// Clients which request the query later start it anew.
+	if queryExists(queryid) {
+		t.Errorf("abandoned query still exists once done")
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"flag"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/Debian/dcs/cmd/dcs-web/search"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	analyticsPath = flag.String("analytics_path",
+		"",
+		"Where to periodically (see -analytics_interval) export anonymized query analytics as CSV, one row per finished query: pattern shape (see analyticsShape), filter keywords, options, latency, results, error type and approximate resource usage (see ResourceUsage). Neither queries nor clients are exported. Rotated according to -search_log_max_bytes and -search_log_keep. Disabled if empty")
+
+	analyticsMetrics = flag.Bool("analytics_metrics",
+		false,
+		"Export query analytics (query kind and filter keywords, latency, results) as prometheus metrics, in addition to -analytics_path")
+
+	analyticsInterval = flag.Duration("analytics_interval",
+		5*time.Minute,
+		"How often query analytics are exported to -analytics_path and the prometheus metrics (see -analytics_metrics)")
+
+	analyticsQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "analytics_queries",
+			Help: "Number of finished queries, by kind (literal, regexp or count) and filter keywords (e.g. “filetype+-package”, “none”). See -analytics_metrics.",
+		},
+		[]string{"kind", "filters"})
+
+	analyticsLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "analytics_query_duration_ms",
+			Help:    "Duration of finished queries in milliseconds, by kind. See -analytics_metrics.",
+			Buckets: prometheus.ExponentialBuckets(10, 2, 14),
+		},
+		[]string{"kind"})
+
+	analyticsResults = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "analytics_query_results",
+			Help:    "Number of results of finished queries, by kind. See -analytics_metrics.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+		},
+		[]string{"kind"})
+
+	analyticsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "analytics_dropped",
+			Help: "Number of finished queries which were not exported because more than maxAnalyticsRecords queries finished within -analytics_interval, or were not written to -analytics_path after failed exports.",
+		})
+
+	analyticsExportErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "analytics_export_errors",
+			Help: "Number of failed writes to -analytics_path. The records are written when retrying, with exponential backoff up to -analytics_interval.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(analyticsQueries)
+	prometheus.MustRegister(analyticsLatency)
+	prometheus.MustRegister(analyticsResults)
+	prometheus.MustRegister(analyticsDropped)
+	prometheus.MustRegister(analyticsExportErrors)
+}
+
+// maxAnalyticsRecords limits the number of records buffered between exports.
+const maxAnalyticsRecords = 100000
+
+// analyticsRetryMin is the delay before retrying the first failed export,
+// which doubles with each further failure up to -analytics_interval.
+const analyticsRetryMin = 1 * time.Second
+
+// maxShapeLength limits the length of pattern shapes, see analyticsShape.
+const maxShapeLength = 64
+
+// analyticsRecord describes a finished query without identifying the query or
+// the client.
+type analyticsRecord struct {
+	Time time.Time
+
+	// Kind is literal, regexp or count (count-only queries).
+	Kind string
+
+	// Shape is the shape of the search pattern, see analyticsShape.
+	Shape string
+
+	// Filters are the filter keywords of the query, see analyticsFilters.
+	Filters string
+
+	// Options are the options the query was started with (e.g. “fold”,
+	// “sample”), sorted and separated by “+”.
+	Options string
+
+	LatencyMs int64
+	Results   int
+	ErrorType string
+
+	// BackendBytes, TempFileBytes and ProcessingMs approximate the resources
+	// the query used, see ResourceUsage.
+	BackendBytes  int64
+	TempFileBytes int64
+	ProcessingMs  int64
+}
+
+var analyticsHeader = []string{"time", "kind", "shape", "filters", "options", "latency_ms", "results", "error_type", "backend_bytes", "temp_file_bytes", "processing_ms"}
+
+func (r *analyticsRecord) csvRow() []string {
+	return []string{
+		r.Time.UTC().Format(time.RFC3339),
+		r.Kind,
+		r.Shape,
+		r.Filters,
+		r.Options,
+		strconv.FormatInt(r.LatencyMs, 10),
+		strconv.Itoa(r.Results),
+		r.ErrorType,
+		strconv.FormatInt(r.BackendBytes, 10),
+		strconv.FormatInt(r.TempFileBytes, 10),
+		strconv.FormatInt(r.ProcessingMs, 10),
+	}
+}
+
+var analytics struct {
+	mu      sync.Mutex
+	records []analyticsRecord
+
+	f *rotatingFile
+
+	// partial is the remainder of a CSV row which was only partially
+	// written to f, and unwritten contains the CSV rows of records which
+	// were not written at all, see exportAnalytics. Only accessed by
+	// exportAnalytics.
+	partial   []byte
+	unwritten [][]byte
+}
+
+func analyticsEnabled() bool {
+	return *analyticsPath != "" || *analyticsMetrics
+}
+
+// analyticsShape returns the shape of a search pattern, which preserves its
+// structure but not its words: runs of letters are replaced by “a”, runs of
+// digits by “0” and runs of whitespace by a single space, e.g. “a\(” for
+// “XCreateWindow\(” and “a.*a” for “foo.*bar”.
+func analyticsShape(pattern string) string {
+	var b strings.Builder
+	var last rune
+	for _, r := range pattern {
+		switch {
+		case unicode.IsLetter(r) || r == '_':
+			r = 'a'
+		case unicode.IsDigit(r):
+			r = '0'
+		case unicode.IsSpace(r):
+			r = ' '
+		default:
+			last = 0
+			b.WriteRune(r)
+			continue
+		}
+		if r != last {
+			b.WriteRune(r)
+		}
+		last = r
+		if b.Len() >= maxShapeLength {
+			break
+		}
+	}
+	shape := b.String()
+	if len(shape) > maxShapeLength {
+		shape = shape[:maxShapeLength]
+	}
+	return shape
+}
+
+// analyticsFilters returns the sorted, distinct filter keywords of the query
+// (negated keywords prefixed with “-”), separated by “+”, or “none”.
+func analyticsFilters(filters []search.FilterAtom) string {
+	seen := make(map[string]bool)
+	var keywords []string
+	for _, f := range filters {
+		kw := f.Keyword
+		if f.Negated {
+			kw = "-" + kw
+		}
+		if seen[kw] {
+			continue
+		}
+		seen[kw] = true
+		keywords = append(keywords, kw)
+	}
+	if len(keywords) == 0 {
+		return "none"
+	}
+	sort.Strings(keywords)
+	return strings.Join(keywords, "+")
+}
+
+// analyticsOptions are the URL parameters of a query (see
+// QueryOptions.encode) which are exported as options.
+var analyticsOptions = []string{"count", "normalize", "fold", "sample", "max_results", "max_per_file", "max_line_length", "force", "federated", "filter"}
+
+// newAnalyticsRecord returns the analytics record of a query which was
+// started with the query string query.
+func newAnalyticsRecord(query string, started time.Time, results int, errorType string) analyticsRecord {
+	rec := analyticsRecord{
+		Time:      started,
+		LatencyMs: int64(time.Since(started) / time.Millisecond),
+		Results:   results,
+		ErrorType: errorType,
+		Filters:   "none",
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return rec
+	}
+	rec.Kind = "regexp"
+	if params.Get("literal") == "1" {
+		rec.Kind = "literal"
+	}
+	if params.Get("count") == "1" {
+		rec.Kind = "count"
+	}
+	pattern := params.Get("q")
+	if parsed, err := search.ParseQuery(pattern); err == nil {
+		pattern = parsed.Pattern
+		rec.Filters = analyticsFilters(parsed.Filters)
+	}
+	rec.Shape = analyticsShape(pattern)
+	var options []string
+	for _, opt := range analyticsOptions {
+		if params.Get(opt) != "" {
+			options = append(options, opt)
+		}
+	}
+	rec.Options = strings.Join(options, "+")
+	return rec
+}
+
+// recordAnalytics buffers the analytics record of the finished query queryid
+// until the next export.
+func recordAnalytics(queryid string) {
+	if !analyticsEnabled() {
+		return
+	}
+	stateMu.RLock()
+	s := state[queryid]
+	query, started, errorType := s.query, s.started, s.errorType
+	results := s.numMatches()
+	usage := resourceUsageLocked(s)
+	stateMu.RUnlock()
+	rec := newAnalyticsRecord(query, started, results, errorType)
+	rec.BackendBytes = usage.BackendBytes
+	rec.TempFileBytes = usage.TempFileBytes
+	rec.ProcessingMs = int64(usage.ProcessingTime() / time.Millisecond)
+
+	analytics.mu.Lock()
+	defer analytics.mu.Unlock()
+	if len(analytics.records) >= maxAnalyticsRecords {
+		analyticsDropped.Inc()
+		return
+	}
+	analytics.records = append(analytics.records, rec)
+}
+
+// exportAnalytics writes the buffered records to -analytics_path and the
+// prometheus metrics. Records which cannot be written are retried with the
+// next export (see startAnalyticsExporter), so that exporting never blocks
+// finishing queries. At most maxAnalyticsRecords records are retained for
+// retrying, older ones are dropped (see analyticsDropped). A partially
+// written row is always completed, so that the file contains no truncated
+// rows. Returns false if writing failed.
+func exportAnalytics() bool {
+	analytics.mu.Lock()
+	records := analytics.records
+	analytics.records = nil
+	analytics.mu.Unlock()
+
+	if *analyticsMetrics {
+		for _, rec := range records {
+			analyticsQueries.WithLabelValues(rec.Kind, rec.Filters).Inc()
+			analyticsLatency.WithLabelValues(rec.Kind).Observe(float64(rec.LatencyMs))
+			analyticsResults.WithLabelValues(rec.Kind).Observe(float64(rec.Results))
+		}
+	}
+
+	if analytics.f == nil {
+		return true
+	}
+	if len(analytics.unwritten)+len(records) > maxAnalyticsRecords {
+		log.Printf("Dropping %d analytics records which could not be exported\n", len(analytics.unwritten))
+		analyticsDropped.Add(float64(len(analytics.unwritten)))
+		analytics.unwritten = nil
+	}
+	rows := analytics.unwritten
+	for _, rec := range records {
+		var row bytes.Buffer
+		w := csv.NewWriter(&row)
+		w.Write(rec.csvRow())
+		w.Flush()
+		rows = append(rows, row.Bytes())
+	}
+	if len(analytics.partial) == 0 && len(rows) == 0 {
+		return true
+	}
+	var buf bytes.Buffer
+	buf.Write(analytics.partial)
+	for _, row := range rows {
+		buf.Write(row)
+	}
+	written, err := analytics.f.Write(buf.Bytes())
+	if err == nil {
+		analytics.partial, analytics.unwritten = nil, nil
+		return true
+	}
+	log.Printf("Could not export %d analytics records, retrying: %v\n", len(rows), err)
+	analyticsExportErrors.Inc()
+	// Only the remainder is retried: the rest of the partially written row
+	// (if any), followed by the rows which were not written at all.
+	if written < len(analytics.partial) {
+		analytics.partial = analytics.partial[written:]
+		analytics.unwritten = rows
+		return false
+	}
+	written -= len(analytics.partial)
+	analytics.partial = nil
+	for len(rows) > 0 && written >= len(rows[0]) {
+		written -= len(rows[0])
+		rows = rows[1:]
+	}
+	if written > 0 {
+		analytics.partial = rows[0][written:]
+		rows = rows[1:]
+	}
+	analytics.unwritten = rows
+	return false
+}
+
+// startAnalyticsExporter opens -analytics_path and starts exporting analytics
+// every -analytics_interval. Must be called after flag.Parse().
+func startAnalyticsExporter() {
+	if !analyticsEnabled() {
+		return
+	}
+	if *analyticsPath != "" {
+		var header bytes.Buffer
+		w := csv.NewWriter(&header)
+		w.Write(analyticsHeader)
+		w.Flush()
+		f, err := openRotatingFile(*analyticsPath, *searchLogMaxBytes, *searchLogKeep, header.Bytes())
+		if err != nil {
+			log.Fatal(err)
+		}
+		analytics.f = f
+	}
+	go func() {
+		delay, backoff := *analyticsInterval, analyticsRetryMin
+		for {
+			time.Sleep(delay)
+			if exportAnalytics() {
+				delay, backoff = *analyticsInterval, analyticsRetryMin
+				continue
+			}
+			// Retry failed exports sooner than -analytics_interval.
+			delay = backoff
+			if delay > *analyticsInterval {
+				delay = *analyticsInterval
+			}
+			backoff *= 2
+		}
+	}()
+}
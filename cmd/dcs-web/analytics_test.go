@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useAnalyticsFile makes exportAnalytics write to a new rotating file with
+// header "h\n", rotated after maxBytes. It returns the file, its path and a
+// function which restores the previous analytics file and state and deletes
+// the new one.
+func useAnalyticsFile(t *testing.T, maxBytes int64) (*rotatingFile, string, func()) {
+	dir, err := ioutil.TempDir("", "dcs-analytics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "analytics.csv")
+	rf, err := openRotatingFile(path, maxBytes, 1, []byte("h\n"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	oldF := analytics.f
+	analytics.f = rf
+	return rf, path, func() {
+		analytics.f = oldF
+		analytics.partial, analytics.unwritten = nil, nil
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAnalyticsShape(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		want    string
+	}{
+		{`XCreateWindow\(`, `a\(`},
+		{`foo.*bar`, `a.*a`},
+		{`i3_font_t`, `a0a`},
+		{`int  main(int argc`, `a a(a a`},
+		{`[0-9]+ \w+`, `[0-0]+ \a+`},
+		{`ünïcödé`, `a`},
+		{"", ""},
+	} {
+		if got := analyticsShape(tt.pattern); got != tt.want {
+			t.Errorf("analyticsShape(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+
+	long := analyticsShape(`a.b.c.d.e.f.g.h.i.j.k.l.m.n.o.p.q.r.s.t.u.v.w.x.y.z.a.b.c.d.e.f.g.h.i.j`)
+	if got, want := len(long), maxShapeLength; got != want {
+		t.Errorf("len(shape of long pattern) = %d, want %d", got, want)
+	}
+}
+
+func TestNewAnalyticsRecord(t *testing.T) {
+	started := time.Now().Add(-2 * time.Second)
+	for _, tt := range []struct {
+		query string
+		want  analyticsRecord
+	}{
+		{
+			query: "q=XCreateWindow&literal=1",
+			want:  analyticsRecord{Kind: "literal", Shape: "a", Filters: "none"},
+		},
+		{
+			query: "q=filetype%3Ac+-pkg%3Alinux+foo.*bar+-pkg%3Axorg&literal=0&fold=1&max_per_file=1",
+			want:  analyticsRecord{Kind: "regexp", Shape: "a.*a", Filters: "-package+filetype", Options: "fold+max_per_file"},
+		},
+		{
+			query: "q=main&literal=0&count=1",
+			want:  analyticsRecord{Kind: "count", Shape: "a", Filters: "none", Options: "count"},
+		},
+	} {
+		got := newAnalyticsRecord(tt.query, started, 42, "")
+		if got.LatencyMs < 2000 || got.Results != 42 || !got.Time.Equal(started) {
+			t.Errorf("newAnalyticsRecord(%q): unexpected latency/results/time: %+v", tt.query, got)
+		}
+		got.Time, got.LatencyMs, got.Results = time.Time{}, 0, 0
+		if got != tt.want {
+			t.Errorf("newAnalyticsRecord(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestRotatingFileHeader(t *testing.T) {
+	rf, path, cleanup := useAnalyticsFile(t, 20)
+	defer cleanup()
+	for _, entry := range []string{"first row\n", "second row\n"} {
+		if _, err := rf.Write([]byte(entry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{path, "h\nsecond row\n"},
+		{path + ".1", "h\nfirst row\n"},
+	} {
+		b, err := ioutil.ReadFile(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestExportAnalyticsRetry(t *testing.T) {
+	rf, path, cleanup := useAnalyticsFile(t, 0)
+	defer cleanup()
+
+	started := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	record := func(kind string) {
+		analytics.mu.Lock()
+		defer analytics.mu.Unlock()
+		analytics.records = append(analytics.records, analyticsRecord{Time: started, Kind: kind})
+	}
+
+	// Make writes fail.
+	rf.f.Close()
+	record("literal")
+	if exportAnalytics() {
+		t.Fatalf("exportAnalytics() = true, want false")
+	}
+	if got, want := len(analytics.unwritten), 1; got != want {
+		t.Fatalf("len(unwritten) = %d, want %d", got, want)
+	}
+
+	if err := rf.open(); err != nil {
+		t.Fatal(err)
+	}
+	record("regexp")
+	if !exportAnalytics() {
+		t.Errorf("exportAnalytics() = false, want true")
+	}
+	if got, want := len(analytics.unwritten), 0; got != want {
+		t.Errorf("len(unwritten) = %d, want %d", got, want)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "h\n" +
+		"2020-01-01T12:00:00Z,literal,,,,0,0,,0,0,0\n" +
+		"2020-01-01T12:00:00Z,regexp,,,,0,0,,0,0,0\n"
+	if got := string(b); got != want {
+		t.Errorf("%s: got %q, want %q", path, got, want)
+	}
+}
+
+func TestExportAnalyticsPartialRow(t *testing.T) {
+	rf, path, cleanup := useAnalyticsFile(t, 0)
+	defer cleanup()
+
+	// The previous export failed after writing the first part of a row, so
+	// its remainder must be written first, even without new records.
+	if _, err := rf.Write([]byte("2020-01-01T12:00:00Z,lit")); err != nil {
+		t.Fatal(err)
+	}
+	analytics.partial = []byte("eral,,,,0,0,,0,0,0\n")
+	analytics.unwritten = [][]byte{[]byte("2020-01-01T12:00:00Z,regexp,,,,0,0,,0,0,0\n")}
+	if !exportAnalytics() {
+		t.Fatalf("exportAnalytics() = false, want true")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "h\n" +
+		"2020-01-01T12:00:00Z,literal,,,,0,0,,0,0,0\n" +
+		"2020-01-01T12:00:00Z,regexp,,,,0,0,,0,0,0\n"
+	if got := string(b); got != want {
+		t.Errorf("%s: got %q, want %q", path, got, want)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/Debian/dcs/shardmapping"
+	"github.com/google/renameio"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stapelberg/godebiancontrol"
+)
+
+var (
+	annotateCachePath = flag.String("annotate_cache_path",
+		"",
+		"Path to a directory in which upstream git repositories are cloned and blame information is cached for /annotate. Empty disables /annotate")
+	annotateTimeout = flag.Duration("annotate_timeout",
+		2*time.Minute,
+		"Timeout for cloning or updating an upstream git repository and running git blame for one /annotate request")
+
+	annotateRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "annotate_requests",
+			Help: "Requests for /annotate, by outcome (cached, ok or failed).",
+		},
+		[]string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(annotateRequests)
+}
+
+// annotation is the blame information for a line, as returned by /annotate.
+type annotation struct {
+	// Repository is the git repository which was used.
+	Repository string
+
+	// Revision is the tag or branch (or HEAD) which was annotated.
+	Revision string
+
+	Commit     string
+	Author     string
+	AuthorTime int64 // seconds since the UNIX epoch
+	Summary    string
+}
+
+// upstreamRepo is a git repository of a source package, along with the
+// revisions which most likely correspond to the indexed version, in order of
+// preference.
+type upstreamRepo struct {
+	url  string
+	revs []string
+}
+
+// readSourceFile returns the contents of path (e.g.
+// “i3-wm_4.16-1/debian/control”), or nil if it does not exist.
+func readSourceFile(ctx context.Context, snapshot, pkg, path string) ([]byte, error) {
+	backends := common.SourceBackendsFor(snapshot)
+	if backends == nil {
+		return nil, fmt.Errorf("unknown snapshot %q", snapshot)
+	}
+	shard := backends[shardmapping.TaskIdxForPackage(pkg, len(backends))]
+	resp, err := shard.File(ctx, &sourcebackendpb.FileRequest{
+		Path: pkg + "/" + path,
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "no such file or directory") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return resp.Contents, nil
+}
+
+// validRepoURL reports whether u can be handed to git. The URLs come from
+// package metadata, so only (anonymous) network transports are permitted.
+func validRepoURL(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	switch parsed.Scheme {
+	case "https", "http", "git":
+		return parsed.Host != ""
+	}
+	return false
+}
+
+// upstreamVersion strips the epoch, Debian revision and repack suffixes
+// (e.g. +dfsg) from version.
+func upstreamVersion(version string) string {
+	if idx := strings.Index(version, ":"); idx > -1 {
+		version = version[idx+1:]
+	}
+	if idx := strings.LastIndex(version, "-"); idx > -1 {
+		version = version[:idx]
+	}
+	if idx := strings.IndexAny(version, "+~"); idx > -1 {
+		version = version[:idx]
+	}
+	return version
+}
+
+// findUpstreamRepo locates the upstream git repository of pkg using the
+// Repository field of debian/upstream/metadata and, failing that, the
+// packaging repository from the Vcs-Git field of debian/control.
+func findUpstreamRepo(ctx context.Context, snapshot, pkg, version string) (*upstreamRepo, error) {
+	metadata, err := readSourceFile(ctx, snapshot, pkg, "debian/upstream/metadata")
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(metadata))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Repository:") {
+			continue
+		}
+		u := strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "Repository:")), `"'`)
+		if !validRepoURL(u) {
+			break
+		}
+		uv := upstreamVersion(version)
+		return &upstreamRepo{
+			url:  u,
+			revs: []string{"v" + uv, uv, "HEAD"},
+		}, nil
+	}
+
+	control, err := readSourceFile(ctx, snapshot, pkg, "debian/control")
+	if err != nil {
+		return nil, err
+	}
+	paragraphs, err := godebiancontrol.Parse(bytes.NewReader(control))
+	if err != nil {
+		return nil, err
+	}
+	if len(paragraphs) == 0 {
+		return nil, nil
+	}
+	// Vcs-Git: <url> [-b <branch>] [[<path>]]
+	fields := strings.Fields(paragraphs[0]["Vcs-Git"])
+	if len(fields) == 0 || !validRepoURL(fields[0]) {
+		return nil, nil
+	}
+	// Tag names as per DEP-14.
+	tag := strings.NewReplacer(":", "%", "~", "_").Replace(version)
+	repo := &upstreamRepo{
+		url:  fields[0],
+		revs: []string{"debian/" + tag},
+	}
+	if len(fields) > 2 && fields[1] == "-b" {
+		repo.revs = append(repo.revs, fields[2])
+	}
+	repo.revs = append(repo.revs, "HEAD")
+	return repo, nil
+}
+
+var (
+	// annotateRepoMu serializes git operations on the same repository.
+	annotateRepoMu   = make(map[string]*sync.Mutex)
+	annotateRepoMuMu sync.Mutex
+)
+
+func lockRepo(dir string) func() {
+	annotateRepoMuMu.Lock()
+	mu, ok := annotateRepoMu[dir]
+	if !ok {
+		mu = &sync.Mutex{}
+		annotateRepoMu[dir] = mu
+	}
+	annotateRepoMuMu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+func git(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{
+		// Only allow anonymous network transports, see validRepoURL.
+		"-c", "protocol.allow=never",
+		"-c", "protocol.https.allow=always",
+		"-c", "protocol.http.allow=always",
+		"-c", "protocol.git.allow=always",
+	}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v (stderr: %s)", cmd.Args, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// resolveRev returns the commit of the first of revs which exists in the
+// repository at dir.
+func resolveRev(ctx context.Context, dir string, revs []string) (rev, commit string) {
+	for _, rev := range revs {
+		if strings.HasPrefix(rev, "-") {
+			continue
+		}
+		out, err := git(ctx, "--git-dir", dir, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+		if err == nil {
+			return rev, strings.TrimSpace(string(out))
+		}
+	}
+	return "", ""
+}
+
+// checkoutRepo clones (or, if none of the preferred revisions exist, updates)
+// the repository and returns the revision to annotate.
+func checkoutRepo(ctx context.Context, dir string, repo *upstreamRepo) (rev, commit string, _ error) {
+	defer lockRepo(dir)()
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+			return "", "", err
+		}
+		tmp, err := ioutil.TempDir(filepath.Dir(dir), "clone")
+		if err != nil {
+			return "", "", err
+		}
+		defer os.RemoveAll(tmp)
+		if _, err := git(ctx, "clone", "--quiet", "--bare", "--", repo.url, tmp); err != nil {
+			return "", "", err
+		}
+		if err := os.Rename(tmp, dir); err != nil {
+			return "", "", err
+		}
+	} else if err != nil {
+		return "", "", err
+	} else if rev, _ := resolveRev(ctx, dir, repo.revs[:len(repo.revs)-1]); rev == "" {
+		// The version might have been released after the repository was
+		// cloned.
+		if _, err := git(ctx, "--git-dir", dir, "fetch", "--quiet", "--tags", "origin", "+refs/heads/*:refs/heads/*"); err != nil {
+			return "", "", err
+		}
+	}
+	rev, commit = resolveRev(ctx, dir, repo.revs)
+	if rev == "" {
+		return "", "", fmt.Errorf("none of the revisions %v found", repo.revs)
+	}
+	return rev, commit, nil
+}
+
+// parseBlame parses the output of git blame --porcelain for a single line.
+func parseBlame(out []byte) (*annotation, error) {
+	var a annotation
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if a.Commit == "" {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("unexpected git blame output %q", line)
+			}
+			a.Commit = fields[0]
+			continue
+		}
+		if strings.HasPrefix(line, "\t") {
+			break // contents of the line
+		}
+		idx := strings.Index(line, " ")
+		if idx == -1 {
+			continue
+		}
+		key, value := line[:idx], line[idx+1:]
+		switch key {
+		case "author":
+			a.Author = value
+		case "author-time":
+			a.AuthorTime, _ = strconv.ParseInt(value, 10, 64)
+		case "summary":
+			a.Summary = value
+		}
+	}
+	if a.Commit == "" {
+		return nil, fmt.Errorf("empty git blame output")
+	}
+	return &a, scanner.Err()
+}
+
+func annotate(ctx context.Context, snapshot, filename, version string, line int) (_ *annotation, cached bool, _ error) {
+	idx := strings.Index(filename, "/")
+	if idx == -1 {
+		return nil, false, fmt.Errorf("filename does not contain a package")
+	}
+	pkg, path := filename[:idx], filename[idx+1:]
+	if version == "" {
+		if idx := strings.Index(pkg, "_"); idx > -1 {
+			version = pkg[idx+1:]
+		}
+	}
+	repo, err := findUpstreamRepo(ctx, snapshot, pkg, version)
+	if err != nil {
+		return nil, false, err
+	}
+	if repo == nil {
+		return nil, false, nil
+	}
+
+	dir := filepath.Join(*annotateCachePath, "repos", fmt.Sprintf("%x", sha256.Sum256([]byte(repo.url))))
+	rev, commit, err := checkoutRepo(ctx, dir, repo)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Blame information for a commit never changes, so it can be cached
+	// indefinitely.
+	key := sha256.Sum256([]byte(strings.Join([]string{repo.url, commit, path, strconv.Itoa(line)}, "\x00")))
+	cachePath := filepath.Join(*annotateCachePath, "blame", fmt.Sprintf("%x.json", key))
+	if b, err := ioutil.ReadFile(cachePath); err == nil {
+		var a annotation
+		if err := json.Unmarshal(b, &a); err == nil {
+			return &a, true, nil
+		}
+	}
+
+	out, err := git(ctx, "--git-dir", dir, "blame", "--porcelain", "-L", fmt.Sprintf("%d,%d", line, line), commit, "--", path)
+	if err != nil {
+		return nil, false, err
+	}
+	a, err := parseBlame(out)
+	if err != nil {
+		return nil, false, err
+	}
+	a.Repository = repo.url
+	a.Revision = rev
+
+	b, err := json.Marshal(a)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return nil, false, err
+	}
+	if err := renameio.WriteFile(cachePath, b, 0644); err != nil {
+		return nil, false, err
+	}
+	return a, false, nil
+}
+
+// AnnotateHandler serves /annotate?file=<path>&line=<line>[&version=…], which
+// returns the upstream git blame information for the line as JSON. As the
+// unpacked sources have the Debian patches applied, the line might not
+// correspond exactly to the upstream line.
+func AnnotateHandler(w http.ResponseWriter, r *http.Request) {
+	if *annotateCachePath == "" {
+		http.Error(w, "Annotations are not enabled on this instance.", http.StatusNotFound)
+		return
+	}
+	filename := r.FormValue("file")
+	line, err := strconv.Atoi(r.FormValue("line"))
+	if err != nil || line < 1 || filename == "" {
+		http.Error(w, "The file and line parameters must be specified.", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), *annotateTimeout)
+	defer cancel()
+	a, cached, err := annotate(ctx, r.FormValue("snapshot"), filename, r.FormValue("version"), line)
+	if err != nil {
+		annotateRequests.WithLabelValues("failed").Inc()
+		log.Printf("Could not annotate %s:%d: %v\n", filename, line, err)
+		http.Error(w, "Could not annotate the line.", http.StatusInternalServerError)
+		return
+	}
+	if a == nil {
+		annotateRequests.WithLabelValues("failed").Inc()
+		http.Error(w, "No upstream git repository known for this package.", http.StatusNotFound)
+		return
+	}
+	if cached {
+		annotateRequests.WithLabelValues("cached").Inc()
+	} else {
+		annotateRequests.WithLabelValues("ok").Inc()
+	}
+
+	startJsonResponse(w)
+	if err := json.NewEncoder(w).Encode(a); err != nil {
+		log.Printf("Could not write annotation: %v\n", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	backendSkewFactor = flag.Float64("backend_skew_factor",
+		10,
+		"A source backend whose share of the results of a query differs from its share of all indexed files by more than this factor is flagged as skewed (see /queryz and the backend_skewed_queries metric), which may indicate a stale or mis-sharded index. Queries restricted to few packages are naturally skewed, so only a high rate of skewed queries is worth investigating. 0 disables")
+
+	backendSkewMinResults = flag.Int("backend_skew_min_results",
+		1000,
+		"Minimum number of results of a query for its results to be checked for skew, see -backend_skew_factor")
+
+	backendResults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "backend_results",
+			Help: "Number of results each source backend (or federation peer) contributed to queries.",
+		},
+		[]string{"backend"})
+
+	backendDurations = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "backend_query_duration_ms",
+			Help:    "Time each source backend (or federation peer) took to reply to a query, in milliseconds.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+		},
+		[]string{"backend"})
+
+	backendSkewedQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "backend_skewed_queries",
+			Help: "Number of queries for which the source backend’s share of results deviated from its share of indexed files by more than -backend_skew_factor.",
+		},
+		[]string{"backend"})
+)
+
+func init() {
+	prometheus.MustRegister(backendResults)
+	prometheus.MustRegister(backendDurations)
+	prometheus.MustRegister(backendSkewedQueries)
+}
+
+// backendStats is the contribution of one source backend (or federation
+// peer) to a query, as shown on /queryz.
+type backendStats struct {
+	Index   int
+	Results int
+	// Duration is empty if the backend was not queried, e.g. because the
+	// query was resumed with its stored replies.
+	Duration time.Duration
+	// IndexFiles is the number of files in the backend’s index, or 0 if
+	// unknown (e.g. for federation peers).
+	IndexFiles int
+	Skewed     bool
+}
+
+// results returns the number of results the backend contributed, which is
+// larger than len(resultPointers) for sampled queries.
+func (b *perBackendState) results() int {
+	if b.sampler != nil {
+		return b.sampler.seen
+	}
+	return len(b.resultPointers)
+}
+
+// skewedBackends returns which backends contributed a share of the results
+// that deviates from their share of all indexed files by more than factor.
+// Backends of unknown index size are never skewed.
+func skewedBackends(results, indexFiles []int, factor float64, minResults int) []bool {
+	skewed := make([]bool, len(results))
+	var totalResults, totalFiles int
+	for idx := range results {
+		if indexFiles[idx] == 0 {
+			continue
+		}
+		totalResults += results[idx]
+		totalFiles += indexFiles[idx]
+	}
+	if factor <= 0 || totalResults < minResults || totalFiles == 0 {
+		return skewed
+	}
+	for idx := range results {
+		if indexFiles[idx] == 0 {
+			continue
+		}
+		actual := float64(results[idx]) / float64(totalResults)
+		expected := float64(indexFiles[idx]) / float64(totalFiles)
+		skewed[idx] = actual > expected*factor || actual < expected/factor
+	}
+	return skewed
+}
+
+// attributeBackends records how many results and how much latency each
+// backend contributed to the query, and flags skewed backends. Must be called
+// once all backends of the query returned.
+func attributeBackends(queryid string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s := state[queryid]
+	results := make([]int, len(s.perBackend))
+	indexFiles := make([]int, len(s.perBackend))
+	for idx, bstate := range s.perBackend {
+		results[idx] = bstate.results()
+		indexFiles[idx] = bstate.indexFiles
+	}
+	var totalResults, totalFiles int
+	for idx := range results {
+		totalResults += results[idx]
+		totalFiles += indexFiles[idx]
+	}
+	skewed := skewedBackends(results, indexFiles, *backendSkewFactor, *backendSkewMinResults)
+	for idx, bstate := range s.perBackend {
+		label := strconv.Itoa(idx)
+		backendResults.WithLabelValues(label).Add(float64(results[idx]))
+		if t := bstate.timings; !t.started.IsZero() {
+			backendDurations.WithLabelValues(label).Observe(float64(t.finished.Sub(t.started) / time.Millisecond))
+		}
+		if skewed[idx] {
+			bstate.skewed = true
+			backendSkewedQueries.WithLabelValues(label).Inc()
+			log.Printf("[%s] [src:%d] skewed: %d of %d results, %d of %d indexed files\n", queryid, idx, results[idx], totalResults, indexFiles[idx], totalFiles)
+		}
+	}
+}
+
+// backendStatsLocked returns the contribution of each backend to the query,
+// or nil if not all backends returned yet. Caller needs to hold stateMu.
+func backendStatsLocked(s queryState) []backendStats {
+	if !s.backendsReturned {
+		return nil
+	}
+	stats := make([]backendStats, len(s.perBackend))
+	for idx, bstate := range s.perBackend {
+		stats[idx] = backendStats{
+			Index:      idx,
+			Results:    bstate.results(),
+			IndexFiles: bstate.indexFiles,
+			Skewed:     bstate.skewed,
+		}
+		if t := bstate.timings; !t.started.IsZero() {
+			stats[idx].Duration = t.finished.Sub(t.started)
+		}
+	}
+	return stats
+}
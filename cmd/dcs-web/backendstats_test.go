@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSkewedBackends(t *testing.T) {
+	for _, tt := range []struct {
+		desc       string
+		results    []int
+		indexFiles []int
+		want       []bool
+	}{
+		{
+			desc:       "proportional",
+			results:    []int{1000, 2100, 900},
+			indexFiles: []int{100, 200, 100},
+			want:       []bool{false, false, false},
+		},
+		{
+			desc:       "stale backend",
+			results:    []int{2000, 2000, 10},
+			indexFiles: []int{100, 100, 100},
+			want:       []bool{false, false, true},
+		},
+		{
+			desc:       "too few results",
+			results:    []int{10, 10, 0},
+			indexFiles: []int{100, 100, 100},
+			want:       []bool{false, false, false},
+		},
+		{
+			desc:       "unknown index size",
+			results:    []int{2000, 2000, 5000},
+			indexFiles: []int{100, 100, 0},
+			want:       []bool{false, false, false},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := skewedBackends(tt.results, tt.indexFiles, 10, 1000)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("skewedBackends(%v, %v) = %v, want %v", tt.results, tt.indexFiles, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/cmd/dcs-web/i18n"
+)
+
+// backendzBackend is a source backend as shown on /backendz.
+type backendzBackend struct {
+	common.SourceBackend
+
+	// Missing are the capabilities which other source backends have, but
+	// this one lacks, i.e. for which queries are degraded.
+	Missing []string
+}
+
+// backendzStatus is the state of all source backends, as served on /backendz.
+type backendzStatus struct {
+	Backends []backendzBackend
+
+	// Versions are the distinct versions of all source backends, sorted.
+	// Source backends of unknown version are not counted.
+	Versions []string
+
+	// Mixed is set if the source backends differ in version or capabilities,
+	// e.g. during a rolling upgrade.
+	Mixed bool
+}
+
+func newBackendzStatus(backends []common.SourceBackend) backendzStatus {
+	var status backendzStatus
+	versions := make(map[string]bool)
+	union := make(map[string]bool)
+	for _, b := range backends {
+		if b.Capabilities == nil {
+			continue
+		}
+		if b.Capabilities.Version != "" {
+			versions[b.Capabilities.Version] = true
+		}
+		for _, capability := range b.Capabilities.Capabilities {
+			union[capability] = true
+		}
+	}
+	all := make([]string, 0, len(union))
+	for capability := range union {
+		all = append(all, capability)
+	}
+	sort.Strings(all)
+	for version := range versions {
+		status.Versions = append(status.Versions, version)
+	}
+	sort.Strings(status.Versions)
+	status.Mixed = len(status.Versions) > 1
+	for _, b := range backends {
+		var missing []string
+		if b.Capabilities != nil {
+			missing = b.Capabilities.Missing(all)
+		}
+		if len(missing) > 0 {
+			status.Mixed = true
+		}
+		status.Backends = append(status.Backends, backendzBackend{
+			SourceBackend: b,
+			Missing:       missing,
+		})
+	}
+	return status
+}
+
+// BackendzHandler serves /backendz, which lists the source backends with
+// their negotiated version and capabilities, so that mixed-version
+// deployments can be spotted.
+func BackendzHandler(w http.ResponseWriter, r *http.Request) {
+	status := newBackendzStatus(common.SourceBackends())
+
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Printf("Could not write /backendz reply: %v\n", err)
+		}
+		return
+	}
+
+	if err := common.Templates.ExecuteTemplate(w, "backendz.html", map[string]interface{}{
+		"backendz": status,
+		"i18n":     i18n.FromRequest(r),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
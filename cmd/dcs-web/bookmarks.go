@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+var bookmarkRetention = flag.Duration("bookmark_retention",
+	90*24*time.Hour,
+	"How long bookmarked results (see /api/v1/bookmarks) are kept. Bookmarks are stored in -query_results_path, but are not removed together with query results")
+
+// bookmarksDir is the directory within -query_results_path which contains
+// the bookmarks. Its name cannot clash with a query id.
+const bookmarksDir = "_bookmarks"
+
+// maxBookmarksPerToken limits the number of bookmarks per token, so that a
+// single client cannot fill up the disk.
+const maxBookmarksPerToken = 1000
+
+// minBookmarkTokenLength is the minimum length of a bookmark token. As tokens
+// are the only thing protecting bookmarks, they must not be guessable.
+const minBookmarkTokenLength = 16
+
+var errTooManyBookmarks = fmt.Errorf("too many bookmarks (at most %d are kept)", maxBookmarksPerToken)
+
+// A bookmark marks a result of a query, e.g. for triaging the results of a
+// security review.
+type bookmark struct {
+	QueryId string
+
+	// Query is the query (in the same format that EventsHandler uses), so
+	// that the bookmark remains meaningful after the query’s results expired.
+	Query string
+
+	// Fingerprint identifies the result, see matchFingerprint.
+	Fingerprint string
+
+	Note    string
+	Created time.Time
+}
+
+// bookmarksMu serializes reading and writing bookmark files.
+var bookmarksMu sync.Mutex
+
+// bookmarksPath returns the path of the file containing the bookmarks of
+// token. Tokens are hashed so that they are not stored on disk.
+func bookmarksPath(token string) string {
+	return filepath.Join(*queryResultsPath, bookmarksDir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(token))))
+}
+
+// readBookmarksLocked returns the bookmarks of token which did not expire yet
+// (see -bookmark_retention). bookmarksMu must be held.
+func readBookmarksLocked(token string) ([]bookmark, error) {
+	b, err := ioutil.ReadFile(bookmarksPath(token))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var all []bookmark
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	bookmarks := all[:0]
+	for _, bm := range all {
+		if time.Since(bm.Created) > *bookmarkRetention {
+			continue
+		}
+		bookmarks = append(bookmarks, bm)
+	}
+	return bookmarks, nil
+}
+
+// writeBookmarksLocked replaces the bookmarks of token. bookmarksMu must be
+// held.
+func writeBookmarksLocked(token string, bookmarks []bookmark) error {
+	path := bookmarksPath(token)
+	if len(bookmarks) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(bookmarks)
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(path, b, 0644)
+}
+
+// addBookmark adds bm to the bookmarks of token, replacing an existing
+// bookmark of the same result.
+func addBookmark(token string, bm bookmark) error {
+	bookmarksMu.Lock()
+	defer bookmarksMu.Unlock()
+	bookmarks, err := readBookmarksLocked(token)
+	if err != nil {
+		return err
+	}
+	for idx, existing := range bookmarks {
+		if existing.QueryId == bm.QueryId && existing.Fingerprint == bm.Fingerprint {
+			bookmarks = append(bookmarks[:idx], bookmarks[idx+1:]...)
+			break
+		}
+	}
+	if len(bookmarks) >= maxBookmarksPerToken {
+		return errTooManyBookmarks
+	}
+	return writeBookmarksLocked(token, append(bookmarks, bm))
+}
+
+// listBookmarks returns the bookmarks of token, oldest first.
+func listBookmarks(token string) ([]bookmark, error) {
+	bookmarksMu.Lock()
+	defer bookmarksMu.Unlock()
+	return readBookmarksLocked(token)
+}
+
+// BookmarksHandler serves /api/v1/bookmarks. POST requests with the queryid,
+// fingerprint (see matchFingerprint) and optionally note parameters bookmark a
+// result of a completed query, GET requests return all bookmarks. Bookmarks
+// belong to the token parameter, which clients choose.
+func BookmarksHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if len(token) < minBookmarkTokenLength {
+		http.Error(w, fmt.Sprintf("The token parameter must be at least %d characters long.", minBookmarkTokenLength), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		bookmarks, err := listBookmarks(token)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Could not read bookmarks: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if bookmarks == nil {
+			bookmarks = []bookmark{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct{ Bookmarks []bookmark }{bookmarks}); err != nil {
+			http.Error(w, fmt.Sprintf("Could not encode bookmarks: %v", err), http.StatusInternalServerError)
+		}
+
+	case http.MethodPost:
+		queryid, fingerprint := r.FormValue("queryid"), r.FormValue("fingerprint")
+		if queryid == "" || strings.Contains(queryid, "/") || fingerprint == "" {
+			http.Error(w, "The queryid and fingerprint parameters must be specified.", http.StatusBadRequest)
+			return
+		}
+		// Bookmarks contain the query, so queries of other tenants must
+		// not be bookmarked.
+		if !checkTenant(w, r, queryid) {
+			return
+		}
+		defer pinQuery(queryid)()
+		s, msg, code := completedQuery(queryid)
+		if code != http.StatusOK {
+			http.Error(w, msg, code)
+			return
+		}
+		fps, err := fingerprints(queryid, s.resultPointers)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Could not read results: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !fps[fingerprint] {
+			http.Error(w, "No such result.", http.StatusNotFound)
+			return
+		}
+		bm := bookmark{
+			QueryId:     queryid,
+			Query:       s.query,
+			Fingerprint: fingerprint,
+			Note:        r.FormValue("note"),
+			Created:     time.Now(),
+		}
+		if err := addBookmark(token, bm); err == errTooManyBookmarks {
+			http.Error(w, fmt.Sprintf("Too many bookmarks, at most %d are kept.", maxBookmarksPerToken), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Could not store bookmark: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[%s] bookmarked %q\n", queryid, fingerprint)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(bm); err != nil {
+			http.Error(w, fmt.Sprintf("Could not encode bookmark: %v", err), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, "Only GET and POST requests are supported.", http.StatusMethodNotAllowed)
+	}
+}
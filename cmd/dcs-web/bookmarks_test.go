@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBookmarks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcs-bookmarks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldPath := *queryResultsPath
+	*queryResultsPath = dir
+	defer func() { *queryResultsPath = oldPath }()
+
+	const token = "0123456789abcdef"
+	if err := addBookmark(token, bookmark{
+		QueryId:     "q1",
+		Fingerprint: "i3-wm/src/main.c:23",
+		Created:     time.Now().Add(-2 * *bookmarkRetention),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, note := range []string{"first", "second"} {
+		if err := addBookmark(token, bookmark{
+			QueryId:     "q1",
+			Fingerprint: "i3-wm/src/x.c:42",
+			Note:        note,
+			Created:     time.Now(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bookmarks, err := listBookmarks(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(bookmarks), 1; got != want {
+		t.Fatalf("unexpected number of bookmarks: got %d, want %d (%+v)", got, want, bookmarks)
+	}
+	if got, want := bookmarks[0].Note, "second"; got != want {
+		t.Errorf("unexpected note: got %q, want %q", got, want)
+	}
+
+	other, err := listBookmarks("fedcba9876543210")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(other) != 0 {
+		t.Errorf("bookmarks of another token returned: %+v", other)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/url"
+	"regexp/syntax"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/Debian/dcs/cmd/dcs-web/search"
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	broadenQueryFiles = flag.Int("broaden_query_files",
+		10,
+		"Queries which are estimated to require grepping at most this many files (e.g. because of an over-anchored regular expression) result in a “broaden” warning, which suggests broader variants of the query with their estimated number of files. 0 disables")
+
+	broadenSuggestions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "query_broaden_suggestions",
+			Help: "Number of broader variants suggested for narrow queries (see -broaden_query_files), by reason.",
+		},
+		[]string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(broadenSuggestions)
+}
+
+// Suggestion is a broader variant of a query, sent in “broaden” warnings.
+type Suggestion struct {
+	// Reason is how the query was broadened: “anchors” (anchors and word
+	// boundaries were dropped), “charclass” (character classes were
+	// replaced by .) or “case” (the query was made case-insensitive).
+	Reason string
+
+	// Query is the suggested query: the original query (including its
+	// keywords) with the search pattern replaced.
+	Query string
+
+	// EstimatedFiles is the number of files the suggested query is estimated
+	// to require grepping, like the EstimatedFiles of the warning for the
+	// original query.
+	EstimatedFiles int
+}
+
+// Kinds of regexpTokens.
+const (
+	tokenOther = iota
+	tokenAnchor
+	tokenClass
+)
+
+// regexpToken is a part of a regular expression, see tokenizeRegexp.
+type regexpToken struct {
+	text string
+	kind int
+}
+
+// tokenizeRegexp splits pattern into anchors (e.g. ^ or \b), character
+// classes (e.g. [A-Z] or \d) and everything else. Broadening queries works on
+// tokens instead of the parsed regular expression, so that the suggested
+// queries look like the original query. Returns false if pattern is
+// malformed.
+func tokenizeRegexp(pattern string) ([]regexpToken, bool) {
+	var tokens []regexpToken
+	for i := 0; i < len(pattern); {
+		kind := tokenOther
+		end := i + 1
+		switch pattern[i] {
+		case '^', '$':
+			kind = tokenAnchor
+		case '[':
+			end = i + 1
+			if end < len(pattern) && pattern[end] == '^' {
+				end++
+			}
+			if end < len(pattern) && pattern[end] == ']' {
+				end++
+			}
+			for end < len(pattern) && pattern[end] != ']' {
+				switch {
+				case pattern[end] == '\\':
+					end += 2
+				case strings.HasPrefix(pattern[end:], "[:"):
+					idx := strings.Index(pattern[end:], ":]")
+					if idx == -1 {
+						return nil, false
+					}
+					end += idx + 2
+				default:
+					end++
+				}
+			}
+			if end >= len(pattern) {
+				return nil, false
+			}
+			end++
+			kind = tokenClass
+		case '\\':
+			if i+1 >= len(pattern) {
+				return nil, false
+			}
+			switch pattern[i+1] {
+			case 'b', 'B', 'A', 'z':
+				kind = tokenAnchor
+				end = i + 2
+			case 'd', 'D', 'w', 'W', 's', 'S':
+				kind = tokenClass
+				end = i + 2
+			case 'p', 'P':
+				kind = tokenClass
+				end = i + 3
+				if i+2 < len(pattern) && pattern[i+2] == '{' {
+					idx := strings.IndexByte(pattern[i:], '}')
+					if idx == -1 {
+						return nil, false
+					}
+					end = i + idx + 1
+				}
+			case 'Q':
+				end = len(pattern)
+				if idx := strings.Index(pattern[i+2:], `\E`); idx > -1 {
+					end = i + 2 + idx + 2
+				}
+			default:
+				_, size := utf8.DecodeRuneInString(pattern[i+1:])
+				end = i + 1 + size
+			}
+		default:
+			_, size := utf8.DecodeRuneInString(pattern[i:])
+			end = i + size
+		}
+		if end > len(pattern) {
+			return nil, false
+		}
+		tokens = append(tokens, regexpToken{text: pattern[i:end], kind: kind})
+		i = end
+	}
+	return tokens, true
+}
+
+// replaceTokens returns the pattern with all tokens of the specified kind
+// replaced by replacement.
+func replaceTokens(tokens []regexpToken, kind int, replacement string) string {
+	var b strings.Builder
+	for _, t := range tokens {
+		if t.kind == kind {
+			b.WriteString(replacement)
+		} else {
+			b.WriteString(t.text)
+		}
+	}
+	return b.String()
+}
+
+// broadenings are the ways in which queries are broadened, each resulting in
+// a separate suggestion.
+var broadenings = []struct {
+	reason string
+	apply  func(pattern string, tokens []regexpToken) string
+}{
+	{"anchors", func(pattern string, tokens []regexpToken) string {
+		return replaceTokens(tokens, tokenAnchor, "")
+	}},
+	{"charclass", func(pattern string, tokens []regexpToken) string {
+		return replaceTokens(tokens, tokenClass, ".")
+	}},
+	{"case", func(pattern string, tokens []regexpToken) string {
+		if strings.Contains(pattern, "(?i") {
+			return pattern
+		}
+		// Escape sequences (e.g. \n) are not affected by case folding.
+		for _, t := range tokens {
+			if t.kind == tokenOther && t.text[0] != '\\' && strings.ToLower(t.text) != strings.ToUpper(t.text) {
+				return "(?i)" + pattern
+			}
+		}
+		return pattern
+	}},
+}
+
+// broadened is a broader variant of a query, see broadenQuery.
+type broadened struct {
+	reason  string
+	pattern string // search pattern of query
+	query   string
+}
+
+// broadenQuery returns the broader variants of query (the q parameter, i.e.
+// search pattern and keywords) which differ from query. Literal queries and
+// identifier queries are not broadened. fold reports whether the query is
+// case-insensitive already.
+func broadenQuery(query string, literal, fold bool) []broadened {
+	parsed, err := search.ParseQuery(query)
+	if err != nil || literal || parsed.Ident() != "" {
+		return nil
+	}
+	tokens, ok := tokenizeRegexp(parsed.Pattern)
+	if !ok {
+		return nil
+	}
+	var variants []broadened
+	for _, b := range broadenings {
+		if fold && b.reason == "case" {
+			continue
+		}
+		pattern := b.apply(parsed.Pattern, tokens)
+		if pattern == "" || pattern == parsed.Pattern {
+			continue
+		}
+		if _, err := syntax.Parse(pattern, syntax.Perl); err != nil {
+			continue
+		}
+		end := parsed.PatternOffset + len(parsed.Pattern)
+		variants = append(variants, broadened{
+			reason:  b.reason,
+			pattern: pattern,
+			query:   query[:parsed.PatternOffset] + pattern + query[end:],
+		})
+	}
+	return variants
+}
+
+// suggestBroadening returns broader variants of the query (see broadenQuery)
+// with their estimated number of files. Variants which no source backend
+// could estimate are omitted.
+func suggestBroadening(ctx context.Context, queryid string, backends []sourcebackendpb.SourceBackendClient, searchRequest *sourcebackendpb.SearchRequest) []Suggestion {
+	stateMu.RLock()
+	query := state[queryid].query
+	stateMu.RUnlock()
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil
+	}
+	rewritten, err := url.Parse(searchRequest.RewrittenUrl)
+	if err != nil {
+		return nil
+	}
+	rq := rewritten.Query()
+	variants := broadenQuery(values.Get("q"), values.Get("literal") == "1", rq.Get("fold") == "1")
+	estimates := make([]int, len(variants))
+	var wg sync.WaitGroup
+	for idx, variant := range variants {
+		rq.Set("q", variant.pattern)
+		rewritten.RawQuery = rq.Encode()
+		req := &sourcebackendpb.TrigramStatsRequest{
+			Query:        variant.pattern,
+			RewrittenUrl: rewritten.String(),
+		}
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			estimates[idx], _ = estimateFiles(ctx, queryid, backends, req, nil)
+		}(idx)
+	}
+	wg.Wait()
+	var suggestions []Suggestion
+	for idx, variant := range variants {
+		if estimates[idx] == -1 {
+			continue
+		}
+		log.Printf("[%s] suggesting broader query %q (%s), estimated to grep %d files\n", queryid, variant.query, variant.reason, estimates[idx])
+		broadenSuggestions.WithLabelValues(variant.reason).Inc()
+		suggestions = append(suggestions, Suggestion{
+			Reason:         variant.reason,
+			Query:          variant.query,
+			EstimatedFiles: estimates[idx],
+		})
+	}
+	return suggestions
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBroadenQuery(t *testing.T) {
+	for _, tt := range []struct {
+		query   string
+		literal bool
+		fold    bool
+		want    []broadened
+	}{
+		{
+			query: `^func\s+main\(\)$ package:i3-wm`,
+			want: []broadened{
+				{reason: "anchors", pattern: `func\s+main\(\)`, query: `func\s+main\(\) package:i3-wm`},
+				{reason: "charclass", pattern: `^func.+main\(\)$`, query: `^func.+main\(\)$ package:i3-wm`},
+				{reason: "case", pattern: `(?i)^func\s+main\(\)$`, query: `(?i)^func\s+main\(\)$ package:i3-wm`},
+			},
+		},
+		{
+			query: `path:\.c$ \bFOO_[A-Z0-9]+\b`,
+			fold:  true,
+			want: []broadened{
+				{reason: "anchors", pattern: `FOO_[A-Z0-9]+`, query: `path:\.c$ FOO_[A-Z0-9]+`},
+				{reason: "charclass", pattern: `\bFOO_.+\b`, query: `path:\.c$ \bFOO_.+\b`},
+			},
+		},
+		{
+			// Classes may contain ] and escape sequences.
+			query: `[]\]x][[:digit:]]`,
+			want: []broadened{
+				{reason: "charclass", pattern: `..`, query: `..`},
+			},
+		},
+		{
+			// Nothing to broaden.
+			query: `\d+`,
+			want: []broadened{
+				{reason: "charclass", pattern: `.+`, query: `.+`},
+			},
+		},
+		{query: `^foo$`, literal: true},
+		{query: `^$`, want: nil},
+		{query: `foo[`, want: nil},
+	} {
+		got := broadenQuery(tt.query, tt.literal, tt.fold)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("broadenQuery(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/Debian/dcs/internal/sourcebackend"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var degradedQueries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "backend_degraded_queries",
+		Help: "Number of queries sent to a source backend without a parameter the source backend lacks the capability for, by capability.",
+	},
+	[]string{"capability"})
+
+func init() {
+	prometheus.MustRegister(degradedQueries)
+}
+
+// capabilityParams maps capabilities to the rewritten URL parameter which
+// source backends lacking the capability do not understand.
+var capabilityParams = map[string]string{
+	sourcebackend.CapabilityCount:         "count",
+	sourcebackend.CapabilityMaxPerFile:    "max_per_file",
+	sourcebackend.CapabilityMaxLineLength: "max_line_length",
+	sourcebackend.CapabilityFileMeta:      "size",
+}
+
+// degradeRequest returns searchRequest without the rewritten URL parameters
+// which the source backend lacks the capability for (see capabilityParams),
+// and the capabilities whose parameters were removed. searchRequest itself is
+// shared between source backends, so it is not modified.
+func degradeRequest(caps *common.Capabilities, searchRequest *sourcebackendpb.SearchRequest) (*sourcebackendpb.SearchRequest, []string) {
+	rewritten, err := url.Parse(searchRequest.RewrittenUrl)
+	if err != nil {
+		return searchRequest, nil
+	}
+	query := rewritten.Query()
+	var removed []string
+	for capability, param := range capabilityParams {
+		if _, ok := query[param]; !ok || caps.Has(capability) {
+			continue
+		}
+		query.Del(param)
+		removed = append(removed, capability)
+		degradedQueries.WithLabelValues(capability).Inc()
+	}
+	if len(removed) == 0 {
+		return searchRequest, nil
+	}
+	rewritten.RawQuery = query.Encode()
+	return &sourcebackendpb.SearchRequest{
+		Query:        searchRequest.Query,
+		RewrittenUrl: rewritten.String(),
+	}, removed
+}
+
+// matchCounter counts the matches of a source backend which lacks
+// sourcebackend.CapabilityCount, so that count=1 queries can be answered
+// nevertheless (at the cost of transferring all matches).
+type matchCounter map[string]uint64
+
+func (mc matchCounter) add(match *sourcebackendpb.Match) {
+	pkg := match.Package
+	if pkg == "" {
+		pkg = match.Path
+		if idx := strings.Index(pkg, "/"); idx > -1 {
+			pkg = pkg[:idx]
+		}
+	}
+	mc[pkg]++
+}
+
+// packageCounts returns the counts in the format of a COUNTS reply.
+func (mc matchCounter) packageCounts() []*sourcebackendpb.SearchReply_PackageCount {
+	counts := make([]*sourcebackendpb.SearchReply_PackageCount, 0, len(mc))
+	for pkg, count := range mc {
+		counts = append(counts, &sourcebackendpb.SearchReply_PackageCount{
+			Package: pkg,
+			Count:   count,
+		})
+	}
+	return counts
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/Debian/dcs/internal/sourcebackend"
+)
+
+func TestDegradeRequest(t *testing.T) {
+	req := &sourcebackendpb.SearchRequest{
+		Query:        "foo",
+		RewrittenUrl: "/search?q=foo&count=1&max_line_length=80",
+	}
+
+	// Source backends with all capabilities get the request as-is.
+	if got, removed := degradeRequest(nil, req); got != req || removed != nil {
+		t.Errorf("degradeRequest(nil) = %v, %v, want unmodified request", got, removed)
+	}
+
+	caps := &common.Capabilities{
+		Capabilities: []string{sourcebackend.CapabilityMaxPerFile},
+	}
+	got, removed := degradeRequest(caps, req)
+	u, err := url.Parse(got.RewrittenUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := u.Query(), (url.Values{"q": []string{"foo"}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("degraded query = %v, want %v", got, want)
+	}
+	if got, want := len(removed), 2; got != want {
+		t.Errorf("len(removed) = %d, want %d (%v)", got, want, removed)
+	}
+	if req.RewrittenUrl != "/search?q=foo&count=1&max_line_length=80" {
+		t.Errorf("degradeRequest modified the shared request")
+	}
+}
+
+func TestMatchCounter(t *testing.T) {
+	mc := make(matchCounter)
+	mc.add(&sourcebackendpb.Match{Package: "i3-wm_4.8-1", Path: "i3-wm_4.8-1/src/main.c"})
+	mc.add(&sourcebackendpb.Match{Path: "i3-wm_4.8-1/src/x.c"})
+	mc.add(&sourcebackendpb.Match{Package: "vim_8.1-1", Path: "vim_8.1-1/src/main.c"})
+	counts := make(map[string]uint64)
+	for _, pc := range mc.packageCounts() {
+		counts[pc.Package] = pc.Count
+	}
+	want := map[string]uint64{"i3-wm_4.8-1": 2, "vim_8.1-1": 1}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("packageCounts() = %v, want %v", counts, want)
+	}
+}
+
+func TestBackendzStatus(t *testing.T) {
+	status := newBackendzStatus([]common.SourceBackend{
+		{Addr: "shard0:28082", Capabilities: &common.Capabilities{
+			Version:      "2",
+			Capabilities: []string{"count", "xref"},
+		}},
+		{Addr: "shard1:28082", Capabilities: &common.Capabilities{
+			Version:      "1",
+			Capabilities: []string{"count"},
+		}},
+		{Addr: "shard2:28082"},
+	})
+	if !status.Mixed {
+		t.Errorf("mixed-version deployment not detected")
+	}
+	if got, want := status.Versions, []string{"1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Versions = %v, want %v", got, want)
+	}
+	if got, want := status.Backends[1].Missing, []string{"xref"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Missing = %v, want %v", got, want)
+	}
+
+	status = newBackendzStatus([]common.SourceBackend{
+		{Addr: "shard0:28082", Capabilities: &common.Capabilities{Version: "2", Capabilities: []string{"count"}}},
+		{Addr: "shard1:28082", Capabilities: &common.Capabilities{Version: "2", Capabilities: []string{"count"}}},
+	})
+	if status.Mixed {
+		t.Errorf("uniform deployment considered mixed")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Query timing relies on the monotonic clock reading which time.Now()
+// includes, so that durations are not affected by wall clock jumps (e.g. NTP
+// corrections). Times which were persisted (see persistQuery) carry no
+// monotonic reading, so durations derived from them use the wall clock and
+// can be off, or even negative, after a jump (or a restart on a machine with a
+// different clock). Hence, the duration of a query is measured once, when it
+// finishes, and persisted along with its wall clock timestamps, and durations
+// derived from persisted times are clamped (see elapsedBetween).
+
+var (
+	clockSkewThreshold = flag.Duration("clock_skew_threshold",
+		1*time.Second,
+		"Wall clock jumps (relative to the monotonic clock) of more than this are logged and counted in the clock_jumps metric. Query durations are not affected by such jumps, but the wall clock timestamps of queries are. 0 disables monitoring")
+
+	clockSkew = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "clock_skew_seconds",
+			Help: "How much further the wall clock advanced than the monotonic clock since dcs-web started, i.e. the sum of all wall clock jumps.",
+		})
+
+	clockJumps = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "clock_jumps",
+			Help: "Number of wall clock jumps larger than -clock_skew_threshold.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(clockSkew)
+	prometheus.MustRegister(clockJumps)
+}
+
+// clockSkewInterval is how often the wall clock is compared to the monotonic
+// clock.
+const clockSkewInterval = 10 * time.Second
+
+// elapsedBetween returns end.Sub(start), or 0 if end is before start, which
+// can happen when the wall clock jumped and either time has no monotonic
+// clock reading.
+func elapsedBetween(start, end time.Time) time.Duration {
+	if d := end.Sub(start); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// elapsed is like time.Since, but see elapsedBetween.
+func elapsed(start time.Time) time.Duration {
+	return elapsedBetween(start, time.Now())
+}
+
+// wallSkew returns how much further the wall clock advanced than the
+// monotonic clock between base and now, which must both carry monotonic
+// clock readings.
+func wallSkew(base, now time.Time) time.Duration {
+	// Round(0) strips the monotonic clock reading.
+	return now.Round(0).Sub(base.Round(0)) - now.Sub(base)
+}
+
+// startClockSkewMonitor periodically compares the wall clock to the monotonic
+// clock (see -clock_skew_threshold). Must be called after flag.Parse().
+func startClockSkewMonitor() {
+	if *clockSkewThreshold == 0 {
+		return
+	}
+	go func() {
+		base := time.Now()
+		var last time.Duration
+		for range time.Tick(clockSkewInterval) {
+			skew := wallSkew(base, time.Now())
+			clockSkew.Set(skew.Seconds())
+			jump := skew - last
+			last = skew
+			if jump > *clockSkewThreshold || -jump > *clockSkewThreshold {
+				clockJumps.Inc()
+				log.Printf("Wall clock jumped by %v (relative to the monotonic clock), wall clock timestamps of queries may be off\n", jump)
+			}
+		}
+	}()
+}
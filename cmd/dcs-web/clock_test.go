@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestElapsedBetween(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		end  time.Time
+		want time.Duration
+	}{
+		{start.Add(3 * time.Second), 3 * time.Second},
+		{start, 0},
+		// The wall clock jumped backwards between start and end.
+		{start.Add(-time.Hour), 0},
+	} {
+		if got := elapsedBetween(start, tt.end); got != tt.want {
+			t.Errorf("elapsedBetween(%v, %v) = %v, want %v", start, tt.end, got, tt.want)
+		}
+	}
+
+	if got := wallSkew(time.Now(), time.Now().Add(time.Hour)); got != 0 {
+		t.Errorf("wallSkew without clock jumps = %v, want 0", got)
+	}
+}
+
+// waitPersisted waits until the index of the query was persisted, which
+// finishQuery does after adding the done marker.
+func waitPersisted(t *testing.T, queryid string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := store.ReadIndex(queryid); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("query %s not persisted within 10s", queryid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQueryDurationAcrossRestarts(t *testing.T) {
+	defer useFakeBackends(t, newFakeBackend("i3-wm_4.8-1/i3bar/src/main.c"))()
+
+	queryid, cleanup := runQuery(t, "q=main&literal=1")
+	defer cleanup()
+	s := waitDone(t, queryid)
+	if got, want := s.duration, s.ended.Sub(s.started); got != want || got <= 0 {
+		t.Fatalf("duration = %v, want %v (> 0)", got, want)
+	}
+	waitPersisted(t, queryid)
+
+	// Simulate a restart: the query is reloaded from disk, without monotonic
+	// clock readings.
+	stateMu.Lock()
+	state[queryid].storage.Close()
+	delete(state, queryid)
+	stateMu.Unlock()
+	if !reloadQuery(queryid) {
+		t.Fatalf("reloadQuery(%s) = false", queryid)
+	}
+	stateMu.RLock()
+	reloaded := state[queryid]
+	stateMu.RUnlock()
+	if got, want := reloaded.duration, s.duration; got != want {
+		t.Errorf("duration after reload = %v, want %v", got, want)
+	}
+	if !reloaded.started.Equal(s.started) {
+		t.Errorf("started after reload = %v, want %v", reloaded.started, s.started)
+	}
+
+	// Simulate the wall clock jumping backwards by an hour since the query
+	// ran.
+	stateMu.Lock()
+	reloaded.started = time.Now().Add(time.Hour).Round(0)
+	reloaded.ended = reloaded.started.Add(s.duration)
+	state[queryid] = reloaded
+	stats := queryStatsLocked(queryid, reloaded)
+	_, expired := queryExistsLocked(queryid)
+	stateMu.Unlock()
+	if got, want := stats.StartedFromNow, time.Duration(0); got != want {
+		t.Errorf("StartedFromNow = %v, want %v", got, want)
+	}
+	if got, want := stats.Duration, s.duration; got != want {
+		t.Errorf("Duration = %v, want %v", got, want)
+	}
+	if expired {
+		t.Errorf("query unexpectedly expired")
+	}
+}
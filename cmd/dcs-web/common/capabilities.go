@@ -0,0 +1,199 @@
+package common
+
+import (
+	"context"
+	"flag"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/Debian/dcs/internal/sourcebackend"
+)
+
+var capabilitiesInterval = flag.Duration("capabilities_interval",
+	5*time.Minute,
+	"Interval in which the capabilities of the source backends are negotiated again, so that upgraded (or downgraded) source backends are noticed without restarting dcs-web")
+
+// capabilitiesTimeout bounds each Capabilities RPC.
+const capabilitiesTimeout = 10 * time.Second
+
+// Capabilities are the features of the source backend protocol which a source
+// backend understands (see the sourcebackend package for their names), as
+// negotiated when connecting. A nil *Capabilities has all capabilities, so
+// that source backends which were never negotiated with (e.g. in tests) are
+// not degraded.
+type Capabilities struct {
+	// Version of the source backend, or empty if unknown.
+	Version string
+
+	// Legacy is set for source backends which predate capability
+	// negotiation, which are assumed to have
+	// sourcebackend.LegacyCapabilities.
+	Legacy bool
+
+	// Capabilities are sorted.
+	Capabilities []string
+
+	// Err is the error of the last negotiation, if it failed. The
+	// capabilities of the previous negotiation are kept (or the legacy
+	// capabilities, if there was none).
+	Err string
+
+	Negotiated time.Time
+}
+
+// Has returns whether the source backend understands capability.
+func (c *Capabilities) Has(capability string) bool {
+	if c == nil {
+		return true
+	}
+	idx := sort.SearchStrings(c.Capabilities, capability)
+	return idx < len(c.Capabilities) && c.Capabilities[idx] == capability
+}
+
+// Missing returns those of capabilities which the source backend lacks.
+func (c *Capabilities) Missing(capabilities []string) []string {
+	var missing []string
+	for _, capability := range capabilities {
+		if !c.Has(capability) {
+			missing = append(missing, capability)
+		}
+	}
+	return missing
+}
+
+var (
+	// capabilitiesMu protects capabilities.
+	capabilitiesMu sync.RWMutex
+
+	// capabilities are keyed by source backend stub, as queries only
+	// reference source backends by stub.
+	capabilities = make(map[sourcebackendpb.SourceBackendClient]*Capabilities)
+)
+
+// CapabilitiesOf returns the capabilities of the specified source backend, or
+// nil (i.e. all capabilities) if they were never negotiated.
+func CapabilitiesOf(backend sourcebackendpb.SourceBackendClient) *Capabilities {
+	capabilitiesMu.RLock()
+	defer capabilitiesMu.RUnlock()
+	return capabilities[backend]
+}
+
+// negotiateCapabilities calls the Capabilities RPC of the source backend.
+func negotiateCapabilities(ctx context.Context, backend sourcebackendpb.SourceBackendClient) (*Capabilities, error) {
+	ctx, cancel := context.WithTimeout(ctx, capabilitiesTimeout)
+	defer cancel()
+	reply, err := backend.Capabilities(ctx, &sourcebackendpb.CapabilitiesRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		return &Capabilities{
+			Legacy:       true,
+			Capabilities: sortedCopy(sourcebackend.LegacyCapabilities),
+			Negotiated:   time.Now(),
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Capabilities{
+		Version:      reply.Version,
+		Capabilities: sortedCopy(reply.Capabilities),
+		Negotiated:   time.Now(),
+	}, nil
+}
+
+func sortedCopy(s []string) []string {
+	s = append([]string(nil), s...)
+	sort.Strings(s)
+	return s
+}
+
+// updateCapabilities negotiates the capabilities of the specified source
+// backends (in parallel), logging changes.
+func updateCapabilities(conns []sourceBackendConn) {
+	var wg sync.WaitGroup
+	for _, bc := range conns {
+		wg.Add(1)
+		go func(bc sourceBackendConn) {
+			defer wg.Done()
+			caps, err := negotiateCapabilities(context.Background(), bc.stub)
+			capabilitiesMu.Lock()
+			defer capabilitiesMu.Unlock()
+			prev := capabilities[bc.stub]
+			if err != nil {
+				log.Printf("Could not negotiate capabilities of source backend %s: %v", bc.addr, err)
+				if prev == nil {
+					prev = &Capabilities{
+						Legacy:       true,
+						Capabilities: sortedCopy(sourcebackend.LegacyCapabilities),
+					}
+				}
+				failed := *prev
+				failed.Err = err.Error()
+				capabilities[bc.stub] = &failed
+				return
+			}
+			if prev == nil || prev.Version != caps.Version || !reflect.DeepEqual(prev.Capabilities, caps.Capabilities) {
+				log.Printf("Source backend %s (version %q, legacy %v) has capabilities %v", bc.addr, caps.Version, caps.Legacy, caps.Capabilities)
+			}
+			capabilities[bc.stub] = caps
+		}(bc)
+	}
+	wg.Wait()
+}
+
+// watchCapabilities negotiates the capabilities of all source backends every
+// -capabilities_interval. Capabilities of source backends which are no
+// longer used are forgotten.
+func watchCapabilities() {
+	for range time.Tick(*capabilitiesInterval) {
+		updateCapabilities(allConns())
+		// Source backends might have been replaced in the meantime.
+		conns := allConns()
+		inUse := make(map[sourcebackendpb.SourceBackendClient]bool, len(conns))
+		for _, bc := range conns {
+			inUse[bc.stub] = true
+		}
+		capabilitiesMu.Lock()
+		for stub := range capabilities {
+			if !inUse[stub] {
+				delete(capabilities, stub)
+			}
+		}
+		capabilitiesMu.Unlock()
+	}
+}
+
+// SourceBackend describes a source backend of -source_backends (or
+// -source_backends_srv) or -snapshot_backends, as shown on /backendz.
+type SourceBackend struct {
+	Addr string
+
+	// Snapshot is the archive snapshot which the source backend serves, or
+	// empty for the current archive.
+	Snapshot string
+
+	// Capabilities is nil if they were not negotiated yet.
+	Capabilities *Capabilities
+}
+
+// SourceBackends returns all source backends, current archive first.
+func SourceBackends() []SourceBackend {
+	conns := allConns()
+	backends := make([]SourceBackend, len(conns))
+	capabilitiesMu.RLock()
+	defer capabilitiesMu.RUnlock()
+	for idx, bc := range conns {
+		backends[idx] = SourceBackend{
+			Addr:         bc.addr,
+			Snapshot:     bc.snapshot,
+			Capabilities: capabilities[bc.stub],
+		}
+	}
+	return backends
+}
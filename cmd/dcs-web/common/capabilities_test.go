@@ -0,0 +1,81 @@
+package common
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/Debian/dcs/internal/rpctest"
+	"github.com/Debian/dcs/internal/sourcebackend"
+)
+
+// capabilitiesBackend only implements the Capabilities RPC. A nil reply makes
+// it behave like a source backend which predates capability negotiation.
+type capabilitiesBackend struct {
+	sourcebackendpb.SourceBackendServer
+
+	reply *sourcebackendpb.CapabilitiesReply
+}
+
+func (b *capabilitiesBackend) Capabilities(context.Context, *sourcebackendpb.CapabilitiesRequest) (*sourcebackendpb.CapabilitiesReply, error) {
+	if b.reply == nil {
+		return nil, status.Error(codes.Unimplemented, "unknown method Capabilities")
+	}
+	return b.reply, nil
+}
+
+func negotiateWith(t *testing.T, b *capabilitiesBackend) *Capabilities {
+	conn, cleanup := rpctest.Loopback(func(s *grpc.Server) {
+		sourcebackendpb.RegisterSourceBackendServer(s, b)
+	})
+	defer cleanup()
+	caps, err := negotiateCapabilities(context.Background(), sourcebackendpb.NewSourceBackendClient(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caps
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	caps := negotiateWith(t, &capabilitiesBackend{
+		reply: &sourcebackendpb.CapabilitiesReply{
+			Version:      "2019-06-01.1200",
+			Capabilities: []string{"xref", "count", "frobnicate"},
+		},
+	})
+	if caps.Legacy {
+		t.Errorf("source backend unexpectedly considered legacy")
+	}
+	if got, want := caps.Version, "2019-06-01.1200"; got != want {
+		t.Errorf("Version = %q, want %q", got, want)
+	}
+	for _, capability := range []string{"count", "xref", "frobnicate"} {
+		if !caps.Has(capability) {
+			t.Errorf("Has(%q) = false, want true", capability)
+		}
+	}
+	missing := caps.Missing([]string{sourcebackend.CapabilityCount, sourcebackend.CapabilityMaxPerFile})
+	if want := []string{sourcebackend.CapabilityMaxPerFile}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("Missing() = %v, want %v", missing, want)
+	}
+
+	legacy := negotiateWith(t, &capabilitiesBackend{})
+	if !legacy.Legacy {
+		t.Errorf("source backend without Capabilities RPC not considered legacy")
+	}
+	for _, capability := range sourcebackend.LegacyCapabilities {
+		if !legacy.Has(capability) {
+			t.Errorf("legacy source backend lacks %q", capability)
+		}
+	}
+
+	var unknown *Capabilities
+	if !unknown.Has("frobnicate") {
+		t.Errorf("nil *Capabilities lacks a capability")
+	}
+}
@@ -4,18 +4,31 @@
 package common
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 
 	"github.com/Debian/dcs/grpcutil"
+	"github.com/Debian/dcs/internal/faultinject"
 	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/Debian/dcs/shardmapping"
 )
 
 var Version string = "unknown"
@@ -25,30 +38,250 @@ var templatePattern = flag.String("template_pattern",
 	"Pattern matching the HTML templates (./templates/* by default)")
 var sourceBackends = flag.String("source_backends",
 	"localhost:28082",
-	"host:port (multiple values are comma-separated) of the source-backend(s)")
+	"host:port (multiple values are comma-separated, IPv6 addresses in brackets, e.g. [2001:db8::1]:28082) of the source-backend(s). Ignored if -source_backends_srv is set")
 var SourceBackendStubs []sourcebackendpb.SourceBackendClient
+var snapshotBackends = flag.String("snapshot_backends",
+	"",
+	"Source backends serving the index shards of archive snapshots, as semicolon-separated date=host:port[,host:port…] entries, e.g. 2015-06-01=snap-0:28082,snap-1:28082. Queries select a snapshot using the snapshot: keyword")
+
+// SnapshotBackendStubs maps archive snapshot dates (e.g. 2015-06-01) to the
+// source backends serving the index shards of that snapshot.
+var SnapshotBackendStubs = make(map[string][]sourcebackendpb.SourceBackendClient)
+var shardAssignment = flag.String("shard_assignment",
+	"",
+	"Path to a JSON file (see cmd/dcs-rebalance) which assigns source packages to shards, overriding the hash-based assignment. Must match the -shard_assignment of dcs-feeder")
 var UseSourcesDebianNet = flag.Bool("use_sources_debian_net",
 	false,
 	"Redirect to sources.debian.net instead of handling /show on our own.")
 var Templates *template.Template
 
+var peerMaxIdleConns = flag.Int("peer_max_idle_conns",
+	32,
+	"Maximum number of idle (keep-alive) connections kept open to each other dcs-web instance (see -peers and -federation_peers), so that requests under load do not each dial a new connection. Source backends are not affected: all queries to a source backend share one multiplexed gRPC connection")
+
+// HTTPClient is used for requests to other dcs-web instances (federation
+// peers and -peers). Its connections are pooled, see -peer_max_idle_conns.
+var HTTPClient = http.DefaultClient
+
+// backendFaults is only set when building with -tags faultinject, see
+// faultinject.go.
+var backendFaults func() (faultinject.Faults, error)
+
+// faultDialOptions are added to the dial options of source backends when
+// faults are injected (see -fault_injection).
+var faultDialOptions []grpc.DialOption
+
 // Must be called after flag.Parse()
 func Init(tlsCertPath, tlsKeyPath, staticPath string) {
 	loadTemplates()
+	if *shardAssignment != "" {
+		a, err := shardmapping.ReadAssignment(*shardAssignment)
+		if err != nil {
+			log.Fatal(err)
+		}
+		shardmapping.SetAssignment(a)
+	}
 	b, err := ioutil.ReadFile(filepath.Join(staticPath, "critical.min.css"))
 	if err != nil {
 		log.Fatal(err)
 	}
 	CriticalCss = template.CSS(string(b))
-	addrs := strings.Split(*sourceBackends, ",")
-	SourceBackendStubs = make([]sourcebackendpb.SourceBackendClient, len(addrs))
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = *peerMaxIdleConns
+	HTTPClient = &http.Client{Transport: transport}
+	if backendFaults != nil {
+		initFaultInjection()
+	}
+	// Each source backend is dialed once: gRPC multiplexes the streams of
+	// all concurrent queries over the resulting HTTP/2 connection.
+	if *sourceBackendsSRV != "" {
+		addrs, err := resolveSourceBackends(*sourceBackendsSRV)
+		if err != nil {
+			log.Fatalf("Could not resolve -source_backends_srv: %v", err)
+		}
+		SourceBackendStubs, currentConns = dialSourceBackends(addrs, tlsCertPath, tlsKeyPath)
+		go watchSourceBackends(addrs, tlsCertPath, tlsKeyPath)
+	} else {
+		SourceBackendStubs, currentConns = dialSourceBackends(splitBackends("-source_backends", *sourceBackends), tlsCertPath, tlsKeyPath)
+	}
+	for _, entry := range strings.Split(*snapshotBackends, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		idx := strings.Index(entry, "=")
+		if idx == -1 {
+			log.Fatalf("Invalid -snapshot_backends entry %q: expected date=host:port[,host:port…]", entry)
+		}
+		date := strings.TrimSpace(entry[:idx])
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			log.Fatalf("Invalid -snapshot_backends entry %q: %v", entry, err)
+		}
+		stubs, conns := dialSourceBackends(splitBackends("-snapshot_backends", entry[idx+1:]), tlsCertPath, tlsKeyPath)
+		for idx := range conns {
+			conns[idx].snapshot = date
+		}
+		SnapshotBackendStubs[date] = stubs
+		snapshotConns = append(snapshotConns, conns...)
+	}
+	updateCapabilities(allConns())
+	go watchCapabilities()
+}
+
+// sourceBackendConn is a connection to a source backend (of -source_backends or
+// -snapshot_backends), see CheckSourceBackends.
+type sourceBackendConn struct {
+	addr string
+	conn *grpc.ClientConn
+	stub sourcebackendpb.SourceBackendClient
+
+	// snapshot is empty for -source_backends.
+	snapshot string
+}
+
+var (
+	// backendsMu protects SourceBackendStubs and currentConns, which
+	// watchSourceBackends replaces when -source_backends_srv is used.
+	backendsMu sync.RWMutex
+
+	currentConns  []sourceBackendConn // of SourceBackendStubs
+	snapshotConns []sourceBackendConn // of SnapshotBackendStubs
+)
+
+// splitBackends splits the comma-separated host:port list of the specified
+// flag, exiting if an entry is invalid.
+func splitBackends(flagName, backends string) []string {
+	addrs := strings.Split(backends, ",")
 	for idx, addr := range addrs {
-		conn, err := grpcutil.DialTLS(addr, tlsCertPath, tlsKeyPath, grpc.WithBlock())
+		addrs[idx] = strings.TrimSpace(addr)
+		if _, _, err := net.SplitHostPort(addrs[idx]); err != nil {
+			log.Fatalf("Invalid %s entry %q: %v", flagName, addr, err)
+		}
+	}
+	return addrs
+}
+
+func dialSourceBackend(addr, tlsCertPath, tlsKeyPath string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append(append([]grpc.DialOption{grpc.WithBlock()}, faultDialOptions...), opts...)
+	return grpcutil.DialTLS(addr, tlsCertPath, tlsKeyPath, opts...)
+}
+
+func dialSourceBackends(addrs []string, tlsCertPath, tlsKeyPath string) ([]sourcebackendpb.SourceBackendClient, []sourceBackendConn) {
+	stubs := make([]sourcebackendpb.SourceBackendClient, len(addrs))
+	conns := make([]sourceBackendConn, len(addrs))
+	for idx, addr := range addrs {
+		conn, err := dialSourceBackend(addr, tlsCertPath, tlsKeyPath)
 		if err != nil {
 			log.Fatalf("could not connect to %q: %v", addr, err)
 		}
-		SourceBackendStubs[idx] = sourcebackendpb.NewSourceBackendClient(conn)
+		stubs[idx] = sourcebackendpb.NewSourceBackendClient(conn)
+		conns[idx] = sourceBackendConn{addr: addr, conn: conn, stub: stubs[idx]}
+	}
+	return stubs, conns
+}
+
+// allConns returns the connections to all source backends, current archive
+// first.
+func allConns() []sourceBackendConn {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	return append(append([]sourceBackendConn(nil), currentConns...), snapshotConns...)
+}
+
+// CheckSourceBackends queries the gRPC health service of all source backends,
+// which report themselves as serving once their index is warmed up. It returns
+// the error of each backend which is unreachable or not serving, keyed by
+// address. Backends which do not implement the health service are considered
+// serving if they are reachable.
+func CheckSourceBackends(ctx context.Context) map[string]error {
+	type result struct {
+		addr string
+		err  error
+	}
+	conns := allConns()
+	results := make(chan result, len(conns))
+	for _, bc := range conns {
+		go func(bc sourceBackendConn) {
+			resp, err := healthpb.NewHealthClient(bc.conn).Check(ctx, &healthpb.HealthCheckRequest{})
+			if status.Code(err) == codes.Unimplemented {
+				err = nil
+			} else if err == nil && resp.Status != healthpb.HealthCheckResponse_SERVING {
+				err = fmt.Errorf("status %v", resp.Status)
+			}
+			results <- result{bc.addr, err}
+		}(bc)
+	}
+	errs := make(map[string]error)
+	for range conns {
+		r := <-results
+		if r.err != nil {
+			errs[r.addr] = r.err
+		}
+	}
+	return errs
+}
+
+// NumSourceBackends returns the number of source backends which
+// CheckSourceBackends checks.
+func NumSourceBackends() int {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	return len(currentConns) + len(snapshotConns)
+}
+
+func initFaultInjection() {
+	faults, err := backendFaults()
+	if err != nil {
+		log.Fatalf("Invalid -fault_injection: %v", err)
+	}
+	if faults == (faultinject.Faults{}) {
+		return
+	}
+	log.Printf("Injecting faults into backend connections: %v\n", faults)
+	dial := faults.DialContext((&net.Dialer{}).DialContext)
+	faultDialOptions = []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dial(ctx, "tcp", addr)
+		}),
+	}
+	transport := HTTPClient.Transport.(*http.Transport)
+	transport.DialContext = faults.DialContext(transport.DialContext)
+}
+
+// SourceBackendsFor returns the source backends serving the specified archive
+// snapshot (see -snapshot_backends), or the source backends serving the
+// current archive if snapshot is empty. Returns nil for unknown snapshots.
+func SourceBackendsFor(snapshot string) []sourcebackendpb.SourceBackendClient {
+	if snapshot == "" {
+		backendsMu.RLock()
+		defer backendsMu.RUnlock()
+		return SourceBackendStubs
+	}
+	return SnapshotBackendStubs[snapshot]
+}
+
+// SourcesURL returns the sources.debian.org URL of line in the file at path
+// (e.g. “vim_8.1.0875-5/src/main.c”) in the specified version of its source
+// package (e.g. “2:8.1.0875-5”). As sources.debian.org keeps old versions,
+// the URL keeps referring to the same file contents. An empty version falls
+// back to the version contained in path, which lacks the epoch.
+func SourcesURL(path, version string, line int) string {
+	pkg := strings.Replace(path, "_", "/", 1)
+	if version != "" {
+		if idx := strings.Index(path, "_"); idx != -1 {
+			rest := ""
+			if slash := strings.Index(path, "/"); slash != -1 {
+				rest = path[slash:]
+			}
+			pkg = path[:idx] + "/" + version + rest
+		}
 	}
+	u, _ := url.Parse("https://sources.debian.org/")
+	u.Path = "/src/" + pkg
+	q := u.Query()
+	q.Set("hl", strconv.Itoa(line))
+	u.RawQuery = q.Encode()
+	u.Fragment = "L" + strconv.Itoa(line)
+	return u.String()
 }
 
 func loadTemplates() {
@@ -0,0 +1,135 @@
+package common
+
+import (
+	"flag"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+var (
+	sourceBackendsSRV = flag.String("source_backends_srv",
+		"",
+		"DNS SRV name (e.g. _dcs-source-backend._tcp.dcs.example.net) whose records list the source backends of the current archive, instead of -source_backends. The records are re-resolved every -source_backends_srv_interval")
+	sourceBackendsSRVInterval = flag.Duration("source_backends_srv_interval",
+		1*time.Minute,
+		"Interval in which -source_backends_srv is re-resolved. Queries which are already running keep using the source backends they started with")
+
+	// lookupSRV is overridden in tests.
+	lookupSRV = net.LookupSRV
+)
+
+// resolveSourceBackends returns the host:port addresses of the source backends
+// listed in the SRV records of name. The addresses are sorted by priority,
+// weight, target and port, so that backends keep their index as long as the
+// records do not change.
+func resolveSourceBackends(name string) ([]string, error) {
+	_, srvs, err := lookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(srvs, func(i, j int) bool {
+		a, b := srvs[i], srvs[j]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		if a.Weight != b.Weight {
+			return a.Weight > b.Weight
+		}
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		return a.Port < b.Port
+	})
+	addrs := make([]string, len(srvs))
+	for idx, srv := range srvs {
+		// JoinHostPort adds the brackets which IPv6 addresses need.
+		addrs[idx] = net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+	}
+	return addrs, nil
+}
+
+// watchSourceBackends re-resolves -source_backends_srv periodically and
+// replaces the source backends of the current archive when the records changed.
+// Connections which are still in use are re-used, and the capabilities of new
+// source backends are negotiated before queries use them.
+func watchSourceBackends(addrs []string, tlsCertPath, tlsKeyPath string) {
+	for range time.Tick(*sourceBackendsSRVInterval) {
+		resolved, err := resolveSourceBackends(*sourceBackendsSRV)
+		if err != nil {
+			log.Printf("Could not re-resolve -source_backends_srv, keeping %d source backends: %v", len(addrs), err)
+			continue
+		}
+		if len(resolved) == 0 || reflect.DeepEqual(resolved, addrs) {
+			continue
+		}
+		if err := replaceSourceBackends(resolved, tlsCertPath, tlsKeyPath); err != nil {
+			log.Printf("Not replacing source backends %v with %v: %v", addrs, resolved, err)
+			continue
+		}
+		log.Printf("Replaced source backends %v with %v", addrs, resolved)
+		addrs = resolved
+	}
+}
+
+// obsoleteConnGrace is how long connections to source backends which are no
+// longer listed are kept open, so that running queries can finish.
+const obsoleteConnGrace = 15 * time.Minute
+
+func replaceSourceBackends(addrs []string, tlsCertPath, tlsKeyPath string) error {
+	backendsMu.RLock()
+	existing := make(map[string]sourceBackendConn, len(currentConns))
+	for _, bc := range currentConns {
+		existing[bc.addr] = bc
+	}
+	backendsMu.RUnlock()
+
+	stubs := make([]sourcebackendpb.SourceBackendClient, len(addrs))
+	conns := make([]sourceBackendConn, len(addrs))
+	var dialed []sourceBackendConn
+	for idx, addr := range addrs {
+		bc, ok := existing[addr]
+		if ok {
+			delete(existing, addr)
+		} else {
+			conn, err := dialSourceBackend(addr, tlsCertPath, tlsKeyPath, grpc.WithTimeout(10*time.Second))
+			if err != nil {
+				for _, bc := range dialed {
+					bc.conn.Close()
+				}
+				return err
+			}
+			bc = sourceBackendConn{
+				addr: addr,
+				conn: conn,
+				stub: sourcebackendpb.NewSourceBackendClient(conn),
+			}
+			dialed = append(dialed, bc)
+		}
+		stubs[idx] = bc.stub
+		conns[idx] = bc
+	}
+	// Queries must not use the new source backends before their
+	// capabilities are known.
+	updateCapabilities(dialed)
+
+	backendsMu.Lock()
+	SourceBackendStubs, currentConns = stubs, conns
+	backendsMu.Unlock()
+
+	for addr, bc := range existing {
+		log.Printf("Closing connection to source backend %s in %v", addr, obsoleteConnGrace)
+		time.AfterFunc(obsoleteConnGrace, func(conn *grpc.ClientConn) func() {
+			return func() { conn.Close() }
+		}(bc.conn))
+	}
+	return nil
+}
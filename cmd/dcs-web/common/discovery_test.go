@@ -0,0 +1,32 @@
+package common
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestResolveSourceBackends(t *testing.T) {
+	defer func(old func(string, string, string) (string, []*net.SRV, error)) { lookupSRV = old }(lookupSRV)
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return name, []*net.SRV{
+			{Target: "backup.example.net.", Port: 28082, Priority: 20},
+			{Target: "2001:db8::2", Port: 28082, Priority: 10, Weight: 5},
+			{Target: "shard1.example.net.", Port: 28083, Priority: 10, Weight: 10},
+			{Target: "shard0.example.net.", Port: 28082, Priority: 10, Weight: 10},
+		}, nil
+	}
+	got, err := resolveSourceBackends("_dcs-source-backend._tcp.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"shard0.example.net:28082",
+		"shard1.example.net:28083",
+		"[2001:db8::2]:28082",
+		"backup.example.net:28082",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resolveSourceBackends() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,19 @@
+// +build faultinject
+
+package common
+
+import (
+	"flag"
+
+	"github.com/Debian/dcs/internal/faultinject"
+)
+
+var faultInjection = flag.String("fault_injection",
+	"",
+	"Faults to inject into the connections to source backends and federation peers, for testing failure handling, e.g. delay=2s,trickle=16/10ms (see internal/faultinject). Disabled if empty")
+
+func init() {
+	backendFaults = func() (faultinject.Faults, error) {
+		return faultinject.Parse(*faultInjection)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"regexp/syntax"
+	"time"
+
+	dcsregexp "github.com/Debian/dcs/regexp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	maxRegexpComplexity = flag.Int("max_regexp_complexity",
+		40,
+		"Queries whose regular expression scores higher than this (see regexpComplexity) are refused unless started with force=1, so that accidentally super-linear patterns do not tie up the source backends. 0 disables")
+
+	complexQueryBackendTimeout = flag.Duration("complex_query_backend_timeout",
+		30*time.Second,
+		"Deadline for the Search RPC to each individual source backend for queries exceeding -max_regexp_complexity which were started with force=1. Replaces -backend_timeout if that is longer (or 0). 0 means -backend_timeout applies")
+
+	complexQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queries_complex",
+			Help: "Number of queries exceeding -max_regexp_complexity, by outcome (refused or forced).",
+		},
+		[]string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(complexQueries)
+}
+
+// Weights of the components of a complexity score, see complexity.score.
+const (
+	depthWeight            = 2
+	broadRepetitionWeight  = 5
+	alternationWeight      = 1
+	nestedRepetitionWeight = 10
+)
+
+// broadClassRunes is the number of runes a character class needs to match to
+// count as broad, e.g. \w (63 runes) or [^,].
+const broadClassRunes = 62
+
+// complexity describes the parts of a regular expression which make it
+// expensive to match.
+type complexity struct {
+	// Depth is the maximum nesting depth of groups, repetitions and
+	// alternations.
+	Depth int
+
+	// BroadRepetitions is the number of unbounded repetitions of broad
+	// character classes, e.g. .* or \w+.
+	BroadRepetitions int
+
+	// NestedRepetitions is the number of unbounded repetitions within
+	// another unbounded repetition, e.g. (a+)*.
+	NestedRepetitions int
+
+	// Alternations is the number of alternatives (beyond the first one of
+	// each alternation), e.g. 2 for foo|bar|baz.
+	Alternations int
+}
+
+func (c complexity) score() int {
+	return c.Depth*depthWeight +
+		c.BroadRepetitions*broadRepetitionWeight +
+		c.NestedRepetitions*nestedRepetitionWeight +
+		c.Alternations*alternationWeight
+}
+
+// isBroad returns whether re matches (at least) broadClassRunes runes.
+func isBroad(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return true
+	case syntax.OpCharClass:
+		var runes int
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			runes += int(re.Rune[i+1]-re.Rune[i]) + 1
+			if runes >= broadClassRunes {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unbounded returns whether re is a repetition without an upper bound.
+func unbounded(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus:
+		return true
+	case syntax.OpRepeat:
+		return re.Max == -1
+	}
+	return false
+}
+
+// regexpComplexity scores re (which must not be simplified, so that counted
+// repetitions are not expanded).
+func regexpComplexity(re *syntax.Regexp) complexity {
+	var c complexity
+	var walk func(re *syntax.Regexp, depth int, inRepetition bool)
+	walk = func(re *syntax.Regexp, depth int, inRepetition bool) {
+		switch re.Op {
+		case syntax.OpCapture, syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat, syntax.OpAlternate:
+			depth++
+		}
+		if depth > c.Depth {
+			c.Depth = depth
+		}
+		if re.Op == syntax.OpAlternate {
+			c.Alternations += len(re.Sub) - 1
+		}
+		if unbounded(re) {
+			if inRepetition {
+				c.NestedRepetitions++
+			}
+			if isBroad(re.Sub[0]) {
+				c.BroadRepetitions++
+			}
+			inRepetition = true
+		}
+		for _, sub := range re.Sub {
+			walk(sub, depth, inRepetition)
+		}
+	}
+	walk(re, 0, false)
+	return c
+}
+
+// complexityError is returned by validateQuery for queries exceeding
+// -max_regexp_complexity which were not started with force=1.
+type complexityError struct {
+	complexity complexity
+}
+
+func (e *complexityError) Error() string {
+	return fmt.Sprintf("regular expression too complex (score %d > %d: %+v), add force=1 to search anyway", e.complexity.score(), *maxRegexpComplexity, e.complexity)
+}
+
+// tooComplex returns the complexity of the regular expression of the
+// rewritten query, and whether it exceeds -max_regexp_complexity.
+func tooComplex(rewritten url.Values) (complexity, bool) {
+	if *maxRegexpComplexity <= 0 {
+		return complexity{}, false
+	}
+	re, err := dcsregexp.CompileOptions(rewritten.Get("q"), dcsregexp.OptionsFromQuery(rewritten))
+	if err != nil {
+		return complexity{}, false
+	}
+	c := regexpComplexity(re.Syntax)
+	return c, c.score() > *maxRegexpComplexity
+}
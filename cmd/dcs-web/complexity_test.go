@@ -0,0 +1,47 @@
+package main
+
+import (
+	"regexp/syntax"
+	"testing"
+)
+
+func TestRegexpComplexity(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		want    complexity
+	}{
+		{`main`, complexity{}},
+		{`func\s+main`, complexity{Depth: 1}},
+		{`\w+\(`, complexity{Depth: 1, BroadRepetitions: 1}},
+		{`foo.*bar.*baz`, complexity{Depth: 1, BroadRepetitions: 2}},
+		{`foo|bar|qux`, complexity{Depth: 1, Alternations: 2}},
+		{`(x+)*`, complexity{Depth: 3, NestedRepetitions: 1}},
+		{`[^,]{3,}`, complexity{Depth: 1, BroadRepetitions: 1}},
+		{`[a-z]{3,5}`, complexity{Depth: 1}},
+		{`((.*\w+)*foo)+`, complexity{Depth: 5, BroadRepetitions: 2, NestedRepetitions: 3}},
+	} {
+		re, err := syntax.Parse(tt.pattern, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := regexpComplexity(re); got != tt.want {
+			t.Errorf("regexpComplexity(%q) = %+v, want %+v", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestValidateQueryComplexity(t *testing.T) {
+	defer useFakeBackends(t, newFakeBackend("i3-wm_4.8-1/i3bar/src/main.c"))()
+
+	const pattern = `((.*\w+)*(foo|bar|baz))+main`
+	err := validateQuery("?q=" + pattern + "&literal=0")
+	if _, ok := err.(*complexityError); !ok {
+		t.Fatalf("validateQuery(%q) = %v, want complexityError", pattern, err)
+	}
+	if got, want := invalidQueryError(err).Reason, "toocomplex"; got != want {
+		t.Fatalf("invalidQueryError(%v).Reason = %q, want %q", err, got, want)
+	}
+	if err := validateQuery("?q=" + pattern + "&literal=0&force=1"); err != nil {
+		t.Fatalf("validateQuery(%q, force=1) = %v", pattern, err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var configPath = flag.String("config",
+	"",
+	"Path to a configuration file (TOML subset: key = value lines, keys are flag names without the leading dash, [section] headers prefix keys with section_). Flags specified on the command line override values from the file. On SIGHUP, the file is re-read and numerical, boolean and duration values (limits, timeouts, ranking weights, retention) are updated; other values require a restart.")
+
+// parseConfig parses a configuration file in a subset of TOML:
+//
+//	# Source backends and limits.
+//	source_backends = ["localhost:28082", "localhost:28083"]
+//	max_concurrent_queries = 20
+//	query_timeout = "5m"
+//
+//	[s3]
+//	bucket = "dcs-results"  # results in key s3_bucket
+//
+// Arrays are joined with commas, which is what flags listing multiple values
+// (e.g. -source_backends) expect.
+func parseConfig(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated section header", lineno)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		idx := strings.Index(line, "=")
+		if idx == -1 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+		key := strings.TrimSpace(line[:idx])
+		if key == "" {
+			return nil, fmt.Errorf("line %d: empty key", lineno)
+		}
+		if section != "" {
+			key = section + "_" + key
+		}
+		value, err := parseConfigValue(strings.TrimSpace(line[idx+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", lineno, key, err)
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %s", lineno, key)
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// stripConfigComment removes a trailing # comment, unless the # is part of
+// a quoted string.
+func stripConfigComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == 0 && c == '#':
+			return line[:i]
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case c == quote:
+			quote = 0
+		}
+	}
+	return line
+}
+
+func parseConfigValue(value string) (string, error) {
+	switch {
+	case value == "":
+		return "", fmt.Errorf("missing value")
+
+	case strings.HasPrefix(value, "["):
+		if !strings.HasSuffix(value, "]") {
+			return "", fmt.Errorf("unterminated array (arrays must be on one line)")
+		}
+		var elems []string
+		for _, elem := range splitConfigArray(value[1 : len(value)-1]) {
+			elem = strings.TrimSpace(elem)
+			if elem == "" {
+				continue // trailing comma
+			}
+			parsed, err := parseConfigValue(elem)
+			if err != nil {
+				return "", err
+			}
+			elems = append(elems, parsed)
+		}
+		return strings.Join(elems, ","), nil
+
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("unterminated string")
+		}
+		return value[1 : len(value)-1], nil
+	}
+	// Numbers and booleans are passed to flag.Value.Set verbatim.
+	return value, nil
+}
+
+// splitConfigArray splits the contents of an array on commas outside of
+// quoted strings.
+func splitConfigArray(s string) []string {
+	var (
+		elems []string
+		quote byte
+		start int
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == 0 && c == ',':
+			elems = append(elems, s[start:i])
+			start = i + 1
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case c == quote:
+			quote = 0
+		}
+	}
+	return append(elems, s[start:])
+}
+
+// reloadable reports whether f can be updated while dcs-web is running.
+// Handlers read limits, timeouts and weights on every request, whereas
+// e.g. -source_backends is only read at startup. Only word-sized values are
+// updated so that concurrent readers never observe a partial update.
+func reloadable(f *flag.Flag) bool {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return false
+	}
+	switch getter.Get().(type) {
+	case bool, int, int64, uint, uint64, float64, time.Duration:
+		return true
+	}
+	return false
+}
+
+// applyConfig sets the flags named in values, except for flags specified on
+// the command line. If startup is false, only reloadable flags are updated.
+func applyConfig(values map[string]string, startup bool) error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for key := range values {
+		if flag.Lookup(key) == nil {
+			return fmt.Errorf("unknown key %q (not a flag)", key)
+		}
+		if key == "config" {
+			return fmt.Errorf("the config key cannot be set in the configuration file")
+		}
+	}
+	for key, value := range values {
+		if explicit[key] {
+			continue
+		}
+		f := flag.Lookup(key)
+		if !startup {
+			if f.Value.String() == value {
+				continue
+			}
+			if !reloadable(f) {
+				log.Printf("config: not updating -%s to %q: takes effect after a restart\n", key, value)
+				continue
+			}
+		}
+		old := f.Value.String()
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %v", value, key, err)
+		}
+		if !startup {
+			log.Printf("config: updated -%s from %q to %q\n", key, old, value)
+		}
+	}
+	return nil
+}
+
+func loadConfig(path string, startup bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	values, err := parseConfig(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if err := applyConfig(values, startup); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// initConfig loads -config (if specified) and re-loads it on SIGHUP. Must be
+// called after flag.Parse().
+func initConfig() {
+	if *configPath == "" {
+		return
+	}
+	if err := loadConfig(*configPath, true); err != nil {
+		log.Fatal(err)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("config: SIGHUP received, reloading %s\n", *configPath)
+			// Keep the previous configuration if the file is invalid.
+			if err := loadConfig(*configPath, false); err != nil {
+				log.Printf("config: could not reload: %v\n", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	const config = `
+# Source backends and limits.
+source_backends = ["localhost:28082", 'localhost:28083',]
+max_concurrent_queries = 20 # per instance
+query_timeout = "5m"
+headroom_percentage = 0.05
+
+[s3]
+bucket = "dcs-#results"
+`
+	got, err := parseConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"source_backends":        "localhost:28082,localhost:28083",
+		"max_concurrent_queries": "20",
+		"query_timeout":          "5m",
+		"headroom_percentage":    "0.05",
+		"s3_bucket":              "dcs-#results",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseConfig() = %v, want %v", got, want)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		"source_backends",
+		"query_timeout =",
+		"[s3\nbucket = \"x\"",
+		"source_backends = [\"a\",",
+		"a = 1\na = 2",
+	} {
+		if _, err := parseConfig(strings.NewReader(config)); err == nil {
+			t.Errorf("parseConfig(%q) unexpectedly succeeded", config)
+		}
+	}
+}
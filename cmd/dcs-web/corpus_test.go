@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/grpcutil"
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"google.golang.org/grpc"
+)
+
+var (
+	recordCorpus = flag.String("record_corpus",
+		"",
+		"Comma-separated host:port of source backends (dialed using -tls_cert_path and -tls_key_path) whose replies to the queries in testdata/corpus/queries.txt are recorded into the corpus. Implies -update_corpus")
+
+	updateCorpus = flag.Bool("update_corpus",
+		false,
+		"Write the golden files of the corpus (see TestCorpus) instead of comparing them")
+)
+
+const corpusDir = "testdata/corpus"
+
+// Pagination of the golden files, independent of the flag defaults.
+const (
+	corpusResultsPerPage    = 10
+	corpusPackagesPerPage   = 5
+	corpusResultsPerPackage = 2
+)
+
+// corpusQuery is a line of testdata/corpus/queries.txt: a name (used for the
+// file names of the recording and golden file) and a query string.
+type corpusQuery struct {
+	name  string
+	query string
+}
+
+func readCorpusQueries(t *testing.T) []corpusQuery {
+	f, err := os.Open(filepath.Join(corpusDir, "queries.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var queries []corpusQuery
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			t.Fatalf("queries.txt: invalid line %q, expected name and query string", line)
+		}
+		queries = append(queries, corpusQuery{name: fields[0], query: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return queries
+}
+
+// recordingClient records the replies of the Search RPCs of a source backend.
+type recordingClient struct {
+	sourcebackendpb.SourceBackendClient
+
+	mu      sync.Mutex
+	replies []*sourcebackendpb.SearchReply
+}
+
+type recordingStream struct {
+	sourcebackendpb.SourceBackend_SearchClient
+	client *recordingClient
+}
+
+func (s *recordingStream) Recv() (*sourcebackendpb.SearchReply, error) {
+	reply, err := s.SourceBackend_SearchClient.Recv()
+	if err == nil {
+		s.client.mu.Lock()
+		s.client.replies = append(s.client.replies, reply)
+		s.client.mu.Unlock()
+	}
+	return reply, err
+}
+
+func (c *recordingClient) Search(ctx context.Context, in *sourcebackendpb.SearchRequest, opts ...grpc.CallOption) (sourcebackendpb.SourceBackend_SearchClient, error) {
+	stream, err := c.SourceBackendClient.Search(ctx, in, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingStream{SourceBackend_SearchClient: stream, client: c}, nil
+}
+
+// recordQuery runs q on the source backends of -record_corpus and writes
+// their replies to the corpus.
+func recordQuery(t *testing.T, q corpusQuery) {
+	oldStubs := common.SourceBackendStubs
+	defer func() { common.SourceBackendStubs = oldStubs }()
+	var recorders []*recordingClient
+	common.SourceBackendStubs = nil
+	for _, addr := range strings.Split(*recordCorpus, ",") {
+		conn, err := grpcutil.DialTLS(addr, *tlsCertPath, *tlsKeyPath, grpc.WithBlock())
+		if err != nil {
+			t.Fatalf("could not connect to %q: %v", addr, err)
+		}
+		defer conn.Close()
+		recorder := &recordingClient{SourceBackendClient: sourcebackendpb.NewSourceBackendClient(conn)}
+		recorders = append(recorders, recorder)
+		common.SourceBackendStubs = append(common.SourceBackendStubs, recorder)
+	}
+	dir, err := ioutil.TempDir("", "dcs-corpus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldPath, oldStore := *queryResultsPath, store
+	*queryResultsPath, store = dir, fileStore{}
+	defer func() { *queryResultsPath, store = oldPath, oldStore }()
+
+	_, cleanup := runQuery(t, q.query)
+	cleanup()
+
+	replies := make([][]*sourcebackendpb.SearchReply, len(recorders))
+	for idx, recorder := range recorders {
+		replies[idx] = recorder.replies
+	}
+	b, err := json.MarshalIndent(replies, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(corpusDir, q.name+".replies.json"), append(b, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type corpusResult struct {
+	Path    string  `json:"path"`
+	Line    int     `json:"line"`
+	Ranking float64 `json:"ranking"`
+}
+
+type corpusPackage struct {
+	Package string
+	Paths   []string
+}
+
+// corpusGolden is the ranked and paginated output of a corpus query.
+type corpusGolden struct {
+	Query      string
+	Results    int
+	Pages      [][]corpusResult
+	PerPackage [][]corpusPackage
+}
+
+// replayQuery runs q on fake source backends which send the recorded replies
+// and returns the output of the aggregation pipeline.
+func replayQuery(t *testing.T, q corpusQuery, replies [][]*sourcebackendpb.SearchReply) *corpusGolden {
+	var backends []*fakeBackend
+	for _, r := range replies {
+		backends = append(backends, &fakeBackend{replies: r})
+	}
+	defer useFakeBackends(t, backends...)()
+
+	queryid, cleanup := runQuery(t, q.query)
+	defer cleanup()
+
+	stateMu.RLock()
+	s := state[queryid]
+	stateMu.RUnlock()
+	golden := &corpusGolden{
+		Query:   q.query,
+		Results: s.numResults(),
+	}
+	for page := 0; page < s.resultPages; page++ {
+		var buf bytes.Buffer
+		path := fmt.Sprintf("/results/%s/page_%d.json", queryid, page)
+		if err := writeResults(queryid, page, &buf, httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		var results []corpusResult
+		if err := json.Unmarshal(buf.Bytes(), &results); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		golden.Pages = append(golden.Pages, results)
+	}
+	pages := (len(s.allPackagesSorted) + corpusPackagesPerPage - 1) / corpusPackagesPerPage
+	for page := 0; page < pages; page++ {
+		var buf bytes.Buffer
+		path := fmt.Sprintf("/results/%s/perpackage_%d_page_%d.json", queryid, corpusResultsPerPackage, page)
+		if err := writePerPkgResults(queryid, page, corpusResultsPerPackage, &buf, httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		var perPkg []struct {
+			Package string
+			Results []corpusResult
+		}
+		if err := json.Unmarshal(buf.Bytes(), &perPkg); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		packages := make([]corpusPackage, len(perPkg))
+		for idx, pkg := range perPkg {
+			packages[idx].Package = pkg.Package
+			for _, result := range pkg.Results {
+				packages[idx].Paths = append(packages[idx].Paths, result.Path)
+			}
+		}
+		golden.PerPackage = append(golden.PerPackage, packages)
+	}
+	return golden
+}
+
+func readJSONFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+// TestCorpus replays the recorded source backend replies of representative
+// queries through the aggregation pipeline and compares the ranked and
+// paginated results against golden files, so that changes to ranking and
+// pagination are noticed before they are deployed.
+//
+// To add a query, add it to testdata/corpus/queries.txt and run
+// go test -run=TestCorpus -record_corpus=host:port,… against production-like
+// source backends. After intended changes in ranking or pagination, run
+// go test -run=TestCorpus -update_corpus and review the diff.
+func TestCorpus(t *testing.T) {
+	defer func(results, packages, perPackage int) {
+		*resultsPerPage, *packagesPerPage, *resultsPerPackage = results, packages, perPackage
+	}(*resultsPerPage, *packagesPerPage, *resultsPerPackage)
+	*resultsPerPage, *packagesPerPage, *resultsPerPackage = corpusResultsPerPage, corpusPackagesPerPage, corpusResultsPerPackage
+
+	for _, q := range readCorpusQueries(t) {
+		q := q
+		t.Run(q.name, func(t *testing.T) {
+			if *recordCorpus != "" {
+				recordQuery(t, q)
+			}
+			var replies [][]*sourcebackendpb.SearchReply
+			repliesPath := filepath.Join(corpusDir, q.name+".replies.json")
+			if err := readJSONFile(repliesPath, &replies); err != nil {
+				if os.IsNotExist(err) {
+					t.Skipf("%s not recorded yet, run with -record_corpus", q.name)
+				}
+				t.Fatal(err)
+			}
+			got := replayQuery(t, q, replies)
+
+			goldenPath := filepath.Join(corpusDir, q.name+".golden.json")
+			if *updateCorpus || *recordCorpus != "" {
+				b, err := json.MarshalIndent(got, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(goldenPath, append(b, '\n'), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var want corpusGolden
+			if err := readJSONFile(goldenPath, &want); err != nil {
+				t.Fatalf("%v (run with -update_corpus to create it)", err)
+			}
+			if !reflect.DeepEqual(got, &want) {
+				gotJSON, _ := json.MarshalIndent(got, "", "  ")
+				t.Fatalf("output differs from %s, run with -update_corpus after verifying that the change is intended. got:\n%s", goldenPath, gotJSON)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+var countsPathRe = regexp.MustCompile(`^/results/([^/]+)/counts.json$`)
+
+// Counts is sent to clients once a query which was started with count=1
+// finishes. Instead of the individual matches, source backends only return
+// the number of matches per package, which is much faster to compute and
+// transfer.
+type Counts struct {
+	// Set to “counts”.
+	Type    string
+	QueryId string
+
+	// Total number of matches.
+	Total int
+
+	// Number of matches per source package (without version).
+	Packages map[string]int
+}
+
+func storeCounts(queryid string, packageCounts []*sourcebackendpb.SearchReply_PackageCount) {
+	stateMu.RLock()
+	s := state[queryid]
+	stateMu.RUnlock()
+	s.countsMu.Lock()
+	defer s.countsMu.Unlock()
+	for _, pc := range packageCounts {
+		pkg := pc.Package
+		if idx := strings.Index(pkg, "_"); idx > -1 {
+			pkg = pkg[:idx]
+		}
+		s.packageCounts[pkg] += int(pc.Count)
+	}
+}
+
+func queryCounts(queryid string) *Counts {
+	stateMu.RLock()
+	s := state[queryid]
+	stateMu.RUnlock()
+	s.countsMu.Lock()
+	defer s.countsMu.Unlock()
+	counts := &Counts{
+		Type:     eventTypeCounts,
+		QueryId:  queryid,
+		Packages: make(map[string]int, len(s.packageCounts)),
+	}
+	for pkg, count := range s.packageCounts {
+		counts.Packages[pkg] = count
+		counts.Total += count
+	}
+	return counts
+}
+
+func sendCountsUpdate(queryid string) {
+	addEventMarshal(queryid, queryCounts(queryid))
+}
+
+// serveCounts serves /results/<queryid>/counts.json.
+func serveCounts(w http.ResponseWriter, r *http.Request, queryid string) {
+	stateMu.RLock()
+	s, ok := state[queryid]
+	stateMu.RUnlock()
+	if !ok || !s.countOnly {
+		http.Error(w, "No such query.", http.StatusNotFound)
+		return
+	}
+	if !s.done {
+		http.Error(w, "Query not finished yet.", http.StatusInternalServerError)
+		return
+	}
+	startJsonResponse(w)
+	if err := json.NewEncoder(w).Encode(queryCounts(queryid)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
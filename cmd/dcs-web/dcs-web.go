@@ -5,8 +5,6 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"hash/fnv"
-	"io"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
@@ -20,9 +18,13 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/Debian/dcs/cmd/dcs-web/common"
 	"github.com/Debian/dcs/cmd/dcs-web/health"
+	"github.com/Debian/dcs/cmd/dcs-web/i18n"
 	"github.com/Debian/dcs/cmd/dcs-web/search"
 	"github.com/Debian/dcs/cmd/dcs-web/show"
 	"github.com/Debian/dcs/goroutinez"
@@ -30,8 +32,9 @@ import (
 	"github.com/Debian/dcs/internal/index"
 	"github.com/Debian/dcs/internal/proto/dcspb"
 	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/Debian/dcs/internal/socketactivation"
 	dcsregexp "github.com/Debian/dcs/regexp"
-	_ "github.com/Debian/dcs/varz"
+	"github.com/Debian/dcs/varz"
 	"github.com/opentracing-contrib/go-stdlib/nethttp"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
@@ -63,7 +66,7 @@ var (
 
 	accessLog *os.File
 
-	resultsPathRe  = regexp.MustCompile(`^/results/([^/]+)/(perpackage_` + strconv.Itoa(resultsPerPackage) + `_)?page_([0-9]+).json$`)
+	resultsPathRe  = regexp.MustCompile(`^/results/([^/]+)/(?:perpackage_([0-9]+)_)?page_([0-9]+).json$`)
 	packagesPathRe = regexp.MustCompile(`^/results/([^/]+)/packages.(json|txt)$`)
 	redirectPathRe = regexp.MustCompile(`^/(?:perpackage-)?results/([^/]+)(?:/[0-9]+)?/page_([0-9]+)`)
 
@@ -92,12 +95,41 @@ func validateQuery(query string) error {
 	if err != nil {
 		return err
 	}
+	parsed, err := search.ParseQuery(fakeUrl.Query().Get("q"))
+	if err != nil {
+		return err
+	}
 	rewritten := search.RewriteQuery(*fakeUrl)
 	log.Printf("rewritten query = %q\n", rewritten.String())
-	re, err := dcsregexp.Compile(rewritten.Query().Get("q"))
+	if snapshot := rewritten.Query().Get("snapshot"); common.SourceBackendsFor(snapshot) == nil {
+		return fmt.Errorf("Unknown snapshot %q", snapshot)
+	}
+	// RewriteQuery leaves PCRE-specific syntax in place if it cannot be
+	// rewritten, so check again to get a descriptive error.
+	if _, err := search.RewritePCRE(rewritten.Query().Get("q")); err != nil {
+		if uerr, ok := err.(*search.UnsupportedSyntaxError); ok {
+			// Point to the construct within the whole query, not only
+			// within the search pattern.
+			uerr.Offset += parsed.PatternOffset
+		}
+		return err
+	}
+	reopts := dcsregexp.OptionsFromQuery(rewritten.Query())
+	re, err := dcsregexp.CompileOptions(rewritten.Query().Get("q"), reopts)
 	if err != nil {
 		return err
 	}
+	for _, key := range []string{"lookahead", "nlookahead"} {
+		for _, pattern := range rewritten.Query()[key] {
+			if _, err := dcsregexp.CompileOptions(pattern, reopts); err != nil {
+				return err
+			}
+		}
+	}
+	if c := regexpComplexity(re.Syntax); *maxRegexpComplexity > 0 && c.score() > *maxRegexpComplexity && rewritten.Query().Get("force") != "1" {
+		complexQueries.WithLabelValues("refused").Inc()
+		return &complexityError{complexity: c}
+	}
 	indexQuery := index.RegexpQuery(re.Syntax)
 	log.Printf("trigram = %v, sub = %v", indexQuery.Trigram, indexQuery.Sub)
 	if len(indexQuery.Trigram) == 0 && len(indexQuery.Sub) == 0 {
@@ -106,6 +138,41 @@ func validateQuery(query string) error {
 	return nil
 }
 
+// invalidQueryError returns the event which is sent to clients when
+// validateQuery fails.
+func invalidQueryError(err error) *Error {
+	ev := newError(errorTypeInvalidQuery, "")
+	ev.ErrorMessage = err.Error()
+	switch err := err.(type) {
+	case *search.UnsupportedSyntaxError:
+		ev.Unsupported = err
+		ev.Syntax = &search.QuerySyntaxError{
+			Offset: err.Offset,
+			Length: len(err.Construct),
+			Reason: err.Reason,
+		}
+	case *search.QuerySyntaxError:
+		ev.Syntax = err
+	case *complexityError:
+		// Clients can offer to search anyway, i.e. with force=1.
+		ev.Reason = "toocomplex"
+	}
+	return ev
+}
+
+// requestSource returns the address of the client which sent r, for logging.
+func requestSource(r *http.Request) string {
+	// The additional ":" at the end is necessary so that we don’t need to
+	// distinguish between the two cases (X-Forwarded-For, without a port, and
+	// RemoteAddr, with a part) in the code below.
+	src := r.Header.Get("X-Forwarded-For") + ":"
+	if src == ":" || (!strings.HasPrefix(r.RemoteAddr, "[::1]:") &&
+		!strings.HasPrefix(r.RemoteAddr, "127.0.0.1:")) {
+		src = r.RemoteAddr
+	}
+	return src
+}
+
 func EventsHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	query := r.FormValue("q")
@@ -116,32 +183,48 @@ func EventsHandler(w http.ResponseWriter, r *http.Request) {
 	span.SetOperationName("Events: " + query)
 	w.Header().Set("Content-Type", "text/event-stream")
 
-	// The additional ":" at the end is necessary so that we don’t need to
-	// distinguish between the two cases (X-Forwarded-For, without a port, and
-	// RemoteAddr, with a part) in the code below.
-	src := r.Header.Get("X-Forwarded-For") + ":"
-	if src == ":" || (!strings.HasPrefix(r.RemoteAddr, "[::1]:") &&
-		!strings.HasPrefix(r.RemoteAddr, "127.0.0.1:")) {
-		src = r.RemoteAddr
+	src := requestSource(r)
+	var requestedVersion int
+	if v := r.FormValue("v"); v != "" {
+		var err error
+		if requestedVersion, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "v must be a number", http.StatusBadRequest)
+			return
+		}
 	}
-	literal := r.FormValue("literal")
-	if literal == "" {
-		literal = "0"
+	version, err := negotiateVersion(requestedVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The priority is not part of the query: clients of different
+	// priorities share the same query.
+	priority, err := parsePriority(r.FormValue("priority"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tenant, err := tenantFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unknown API key.", http.StatusUnauthorized)
+		return
+	}
+	opts, err := queryOptionsFromForm(r, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q, err := opts.encode()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	q := "q=" + url.QueryEscape(query) + "&literal=" + literal
 
 	log.Printf("[%s] (events) Received query %q\n", src, q)
 	if err := validateQuery("?" + q); err != nil {
 		log.Printf("[%s] Query %q failed validation: %v\n", src, q, err)
-		b, _ := json.Marshal(struct {
-			Type         string
-			ErrorType    string
-			ErrorMessage string
-		}{
-			Type:         "error",
-			ErrorType:    "invalidquery",
-			ErrorMessage: err.Error(),
-		})
+		recordRefusedStatz(errorTypeInvalidQuery)
+		b, _ := json.Marshal(invalidQueryError(err))
 		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", 0, string(b)); err != nil {
 			log.Printf("[%s] aborting, could not write: %v\n", src, err)
 			return
@@ -149,16 +232,46 @@ func EventsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Uniquely (well, good enough) identify this query for a couple of minutes
-	// (as long as we want to cache results). We could try to normalize the
-	// query before hashing it, but that seems hardly worth the complexity.
-	h := fnv.New64()
-	io.WriteString(h, q)
-	identifier := fmt.Sprintf("%x", h.Sum64())
+	identifier := tenantQueryIdentifier(tenant, q)
 
-	cached, err := maybeStartQuery(ctx, identifier, src, q)
+	if proxyToOwner(w, r, identifier, EventsHandler) {
+		return
+	}
+
+	// Clients which reconnect (EventSource does so automatically, sending the
+	// Last-Event-ID header) resume right after the last event they received.
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.FormValue("since")
+	}
+	if staleEventId(lastEventId) {
+		// The events the client received belong to a query run on an
+		// older index, whose results are not served anymore.
+		log.Printf("[%s] client reconnected with event id %q of an older index generation\n", src, lastEventId)
+		b, _ := json.Marshal(&Warning{
+			Type:        eventTypeWarning,
+			WarningType: "staleindex",
+		})
+		if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", formatEventId(*indexGeneration, -1), b); err != nil {
+			log.Printf("[%s] aborting, could not write: %v\n", src, err)
+		}
+		return
+	}
+
+	if err := admitTenantQuery(tenant, identifier); err != nil {
+		log.Printf("[%s] not starting query: %v\n", src, err)
+		recordRefusedStatz(errorTypeFor(err))
+		http.Error(w, "Too many queries for this API key, please try again later.", http.StatusTooManyRequests)
+		return
+	}
+
+	defer pinQuery(identifier)()
+	defer watchSubscriber(ctx, identifier)()
+	started := time.Now()
+	cached, err := maybeStartQuery(withPriority(ctx, priority), identifier, src, q)
 	if err != nil {
 		log.Printf("[%s] could not start query: %+v\n", src, err)
+		recordRefusedStatz(errorTypeFor(err))
 		http.Error(w, "Could not start query", http.StatusInternalServerError)
 		return
 	}
@@ -177,29 +290,74 @@ func EventsHandler(w http.ResponseWriter, r *http.Request) {
 			remoteIP, time.Now().Format("02/Jan/2006:15:04:05 -0700"), q, responseCode)
 	}
 
-	// TODO: use Last-Event-ID header
-	lastseen := -1
+	lastseen := resumeFrom(identifier, lastEventId)
+	generation := queryGeneration(identifier)
+	// Clients speaking protocol version 1 opt into batches using batch=1.
+	batching := *eventBatchInterval > 0 && (version >= 2 || r.FormValue("batch") == "1")
+	// The hello and started events precede the first batch.
+	var prelude [][]byte
+	if hello := helloEvent(version); hello != nil {
+		prelude = append(prelude, hello)
+	}
+	if started := startedEvent(version, identifier); started != nil {
+		prelude = append(prelude, started)
+	}
 	sent := 0
-	for {
-		message, sequence := getEvent(identifier, lastseen)
-		lastseen = sequence
-		// This message was obsoleted by a more recent one, e.g. a more
-		// recent progress update obsoletes all earlier progress updates.
-		if *message.obsolete {
+	for done := false; !done; {
+		message, _ := getEvent(identifier, lastseen)
+		messages := []event{message}
+		if batching && len(message.data) > 0 {
+			time.Sleep(*eventBatchInterval)
+			messages = append(messages, pendingEvents(identifier, message.sequence)...)
+		}
+		// Preparing the batch (e.g. inlining result pages) is done in a
+		// turn of the query, see -max_concurrent_processing.
+		release, err := queryTurn(ctx, identifier)
+		if err != nil {
+			log.Printf("[%s] aborting, waiting for a turn: %v\n", src, err)
+			return
+		}
+		var batch [][]byte
+		for _, message := range messages {
+			if len(message.data) == 0 {
+				done = true
+				break
+			}
+			lastseen = message.sequence
+			// This message was obsoleted by a more recent one, e.g. a more
+			// recent progress update obsoletes all earlier progress updates.
+			// Within a batch, this also skips all but the most recent
+			// progress update.
+			if *message.obsolete || supersededLater(identifier, message.sequence) {
+				continue
+			}
+			if !eventSupported(message.original, version) {
+				continue
+			}
+			data := message.data
+			if p, ok := message.original.(*Pagination); ok {
+				data = pushOrInline(w, identifier, p, data)
+			}
+			batch = append(batch, data)
+		}
+		release()
+		if len(batch) == 0 {
 			continue
 		}
-		if len(message.data) == 0 {
-			break
+		if prelude != nil {
+			batch = append(prelude, batch...)
+			prelude = nil
 		}
-		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", sequence, message.data); err != nil {
+		if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", formatEventId(generation, lastseen), encodeEventBatch(batch)); err != nil {
 			log.Printf("[%s] aborting, could not write: %v\n", src, err)
 			return
 		}
 		if flusher, ok := w.(http.Flusher); ok {
 			flusher.Flush()
 		}
-		sent++
+		sent += len(batch)
 	}
+	logSearch("events", src, q, identifier, cached, started)
 
 	if sent == 0 {
 		w.WriteHeader(http.StatusNoContent)
@@ -219,11 +377,25 @@ func InstantServer(ws *websocket.Conn) {
 		src = remoteaddr
 	}
 	log.Printf("Accepted websocket connection from %q\n", src)
+	tenant, err := tenantFromRequest(ws.Request())
+	if err != nil {
+		log.Printf("[%s] %v\n", src, err)
+		ev := newError(errorTypeInvalidQuery, "")
+		ev.ErrorMessage = err.Error()
+		b, _ := json.Marshal(ev)
+		ws.Write(b)
+		return
+	}
 
 	type Query struct {
 		Query string
+
+		// Newest protocol version the client supports, see
+		// negotiateVersion. Only considered in the first query.
+		Version int
 	}
 	var q Query
+	version := 0
 	for {
 		err := json.NewDecoder(ws).Decode(&q)
 		if err != nil {
@@ -232,37 +404,94 @@ func InstantServer(ws *websocket.Conn) {
 		}
 		log.Printf("[%s] Received query %v\n", src, q)
 
+		if version == 0 {
+			if version, err = negotiateVersion(q.Version); err != nil {
+				log.Printf("[%s] %v\n", src, err)
+				ev := newError(errorTypeUnsupportedVersion, "")
+				ev.ErrorMessage = err.Error()
+				b, _ := json.Marshal(ev)
+				ws.Write(b)
+				return
+			}
+			if hello := helloEvent(version); hello != nil {
+				if _, err := ws.Write(hello); err != nil {
+					log.Printf("[%s] Error writing to websocket, closing: %v\n", src, err)
+					return
+				}
+			}
+		}
+
 		// span := opentracing.SpanFromContext(ctx)
 		// span.SetOperationName("Websocket: " + q.Query)
 
 		if err := validateQuery("?" + q.Query); err != nil {
 			log.Printf("[%s] Query %q failed validation: %v\n", src, q.Query, err)
-			b, _ := json.Marshal(struct {
-				Type         string
-				ErrorType    string
-				ErrorMessage string
-			}{
-				Type:         "error",
-				ErrorType:    "invalidquery",
-				ErrorMessage: err.Error(),
-			})
+			recordRefusedStatz(errorTypeInvalidQuery)
+			b, _ := json.Marshal(invalidQueryError(err))
 			ws.Write(b)
 			continue
 		}
 
-		// Uniquely (well, good enough) identify this query for a couple of minutes
-		// (as long as we want to cache results). We could try to normalize the
-		// query before hashing it, but that seems hardly worth the complexity.
-		h := fnv.New64()
-		io.WriteString(h, q.Query)
-		identifier := fmt.Sprintf("%x", h.Sum64())
+		identifier := tenantQueryIdentifier(tenant, q.Query)
+		// Websocket connections cannot be proxied to the owner of the query
+		// (see proxyToOwner), so relay its events instead.
+		sentStarted := false
+		var writeErr error
+		relayed, err := relayFromOwner(ctx, identifier, q.Query, priorityInteractive, ws.Request().Header.Get(apiKeyHeader), version, func(data []byte) error {
+			if !sentStarted {
+				sentStarted = true
+				if started := startedEvent(version, identifier); started != nil {
+					if _, writeErr = ws.Write(started); writeErr != nil {
+						return writeErr
+					}
+				}
+			}
+			_, writeErr = ws.Write(data)
+			return writeErr
+		})
+		if writeErr != nil {
+			log.Printf("[%s] Error writing to websocket, closing: %v\n", src, writeErr)
+			return
+		}
+		if relayed {
+			if err != nil {
+				log.Printf("[%s] could not relay query: %v\n", src, err)
+				b, _ := json.Marshal(newError(errorTypeFor(err), ""))
+				ws.Write(b)
+			}
+			continue
+		}
+		if err := admitTenantQuery(tenant, identifier); err != nil {
+			log.Printf("[%s] not starting query: %v\n", src, err)
+			recordRefusedStatz(errorTypeFor(err))
+			b, _ := json.Marshal(newError(errorTypeFor(err), ""))
+			ws.Write(b)
+			continue
+		}
 
+		unpinQuery := pinQuery(identifier)
+		unsubscribe := watchSubscriber(ctx, identifier)
+		unpin := func() {
+			unsubscribe()
+			unpinQuery()
+		}
+		started := time.Now()
 		cached, err := maybeStartQuery(ctx, identifier, src, q.Query)
 		if err != nil {
+			unpin()
 			log.Printf("[%s] could not start query: %v\n", src, err)
-			ws.Write([]byte(`{"Type":"error", "ErrorType":"failed"}`))
+			recordRefusedStatz(errorTypeFor(err))
+			b, _ := json.Marshal(newError(errorTypeFor(err), ""))
+			ws.Write(b)
 			continue
 		}
+		if started := startedEvent(version, identifier); started != nil {
+			if _, err := ws.Write(started); err != nil {
+				unpin()
+				log.Printf("[%s] Error writing to websocket, closing: %v\n", src, err)
+				return
+			}
+		}
 
 		// Create an apache common log format entry.
 		if accessLog != nil {
@@ -284,7 +513,7 @@ func InstantServer(ws *websocket.Conn) {
 			lastseen = sequence
 			// This message was obsoleted by a more recent one, e.g. a more
 			// recent progress update obsoletes all earlier progress updates.
-			if *message.obsolete {
+			if *message.obsolete || !eventSupported(message.original, version) {
 				continue
 			}
 			if len(message.data) == 0 {
@@ -293,14 +522,18 @@ func InstantServer(ws *websocket.Conn) {
 			}
 			written, err := ws.Write(message.data)
 			if err != nil {
+				unpin()
 				log.Printf("[%s] Error writing to websocket, closing: %v\n", src, err)
 				return
 			}
 			if written != len(message.data) {
+				unpin()
 				log.Printf("[%s] Could only write %d of %d bytes to websocket, closing.\n", src, written, len(message.data))
 				return
 			}
 		}
+		unpin()
+		logSearch("instantws", src, q.Query, identifier, cached, started)
 		log.Printf("[%s] query done. waiting for a new one\n", src)
 	}
 }
@@ -308,7 +541,24 @@ func InstantServer(ws *websocket.Conn) {
 func ResultsHandler(w http.ResponseWriter, r *http.Request) {
 	// TODO: ideally, this would also start the search in the background to avoid waiting for the round-trip to the client.
 
-	// Try to match /page_n.json or /perpackage_2_page_n.json
+	if matches := countsPathRe.FindStringSubmatch(r.URL.Path); matches != nil {
+		serveCounts(w, r, matches[1])
+		return
+	}
+	if matches := facetsPathRe.FindStringSubmatch(r.URL.Path); matches != nil {
+		serveFacets(w, r, matches[1])
+		return
+	}
+	if matches := exportPathRe.FindStringSubmatch(r.URL.Path); matches != nil {
+		serveExport(w, r, matches[1], matches[2])
+		return
+	}
+	if matches := filteredResultsPathRe.FindStringSubmatch(r.URL.Path); matches != nil {
+		serveFilteredResults(w, r, matches[1])
+		return
+	}
+
+	// Try to match /page_n.json or /perpackage_<results per package>_page_n.json
 	matches := resultsPathRe.FindStringSubmatch(r.URL.Path)
 	log.Printf("matches for %q = %v\n", r.URL.Path, matches)
 	if matches == nil || len(matches) != 4 {
@@ -340,6 +590,11 @@ func ResultsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		packages := state[queryid].allPackagesSorted
+		if packages == nil {
+			// E.g. restored from the query cache, which does not distinguish
+			// empty slices from nil.
+			packages = []string{}
+		}
 
 		switch matches[2] {
 		case "json":
@@ -359,7 +614,7 @@ func ResultsHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Fatalf("Could not convert %q into a number: %v\n", matches[3], err)
 	}
-	perpackage := (matches[2] == "perpackage_2_")
+	perpackage := (matches[2] != "")
 	_, ok := state[queryid]
 	if !ok {
 		http.Error(w, "No such query.", http.StatusNotFound)
@@ -369,7 +624,17 @@ func ResultsHandler(w http.ResponseWriter, r *http.Request) {
 	if !perpackage {
 		err = writeResults(queryid, page, w, w, r)
 	} else {
-		err = writePerPkgResults(queryid, page, w, w, r)
+		var perPackage int
+		if perPackage, err = strconv.Atoi(matches[2]); err != nil || perPackage < 1 {
+			http.Error(w, "Invalid number of results per package.", http.StatusBadRequest)
+			return
+		}
+		write, werr := groupedResultsWriter(r)
+		if werr != nil {
+			http.Error(w, werr.Error(), http.StatusBadRequest)
+			return
+		}
+		err = write(queryid, page, perPackage, w, w, r)
 	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -378,8 +643,14 @@ func ResultsHandler(w http.ResponseWriter, r *http.Request) {
 
 type server struct{}
 
+// Search runs the query without a tenant: gRPC clients cannot authenticate
+// with an API key, so requests carrying one (as apiKeyHeader metadata) are
+// refused instead of bypassing the tenant’s namespace and limits.
 func (s *server) Search(req *dcspb.SearchRequest, stream dcspb.DCS_SearchServer) error {
 	ctx := stream.Context()
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(apiKeyHeader)) > 0 {
+		return status.Error(codes.InvalidArgument, "API keys are not supported via gRPC")
+	}
 	query := req.GetQuery()
 	span := opentracing.SpanFromContext(ctx)
 	span.SetOperationName("gRPC: Search: " + query)
@@ -397,14 +668,28 @@ func (s *server) Search(req *dcspb.SearchRequest, stream dcspb.DCS_SearchServer)
 		return fmt.Errorf("invalid query: %v", err)
 	}
 
-	// Uniquely (well, good enough) identify this query for a couple of minutes
-	// (as long as we want to cache results). We could try to normalize the
-	// query before hashing it, but that seems hardly worth the complexity.
-	h := fnv.New64()
-	io.WriteString(h, q)
-	identifier := fmt.Sprintf("%x", h.Sum64())
+	identifier := queryIdentifier(q)
+
+	// gRPC streams cannot be proxied to the owner of the query (see
+	// proxyToOwner), so relay its events instead.
+	if relayed, err := relayFromOwner(ctx, identifier, q, priorityBatch, "", protocolVersion, func(data []byte) error {
+		ev, err := toEventProto(data)
+		if err != nil {
+			return err
+		}
+		if ev == nil {
+			return nil // not representable in the gRPC API
+		}
+		return stream.Send(ev)
+	}); relayed {
+		return err
+	}
 
-	cached, err := maybeStartQuery(ctx, identifier, src, q)
+	defer pinQuery(identifier)()
+	defer watchSubscriber(ctx, identifier)()
+	started := time.Now()
+	// API clients do not wait for the results interactively.
+	cached, err := maybeStartQuery(withPriority(ctx, priorityBatch), identifier, src, q)
 	if err != nil {
 		return fmt.Errorf("query(%s): %v", query, err)
 	}
@@ -435,14 +720,23 @@ func (s *server) Search(req *dcspb.SearchRequest, stream dcspb.DCS_SearchServer)
 		if len(message.data) == 0 {
 			break
 		}
+		release, err := queryTurn(ctx, identifier)
+		if err != nil {
+			return err
+		}
 		ev, err := toEventProto(message.data)
+		release()
 		if err != nil {
 			return err
 		}
+		if ev == nil {
+			continue // not representable in the gRPC API
+		}
 		if err := stream.Send(ev); err != nil {
 			return err
 		}
 	}
+	logSearch("grpc", src, q, identifier, cached, started)
 
 	return nil
 }
@@ -457,7 +751,7 @@ func toEventProto(data []byte) (*dcspb.Event, error) {
 		return nil, err
 	}
 	switch messageType.Type {
-	case "progress":
+	case eventTypeProgress:
 		var p struct {
 			QueryId        string
 			FilesProcessed int
@@ -478,7 +772,7 @@ func toEventProto(data []byte) (*dcspb.Event, error) {
 			},
 		}, nil
 
-	case "pagination":
+	case eventTypePagination:
 		var p struct {
 			QueryId     string
 			ResultPages int
@@ -495,6 +789,9 @@ func toEventProto(data []byte) (*dcspb.Event, error) {
 			},
 		}, nil
 
+	case eventTypeCounts, eventTypeFacets, eventTypeQueued, eventTypeWarning, eventTypeNoResults:
+		return nil, nil
+
 	default: // match
 		var m sourcebackendpb.Match
 		if err := json.Unmarshal(data, &m); err != nil {
@@ -512,6 +809,7 @@ func toEventProto(data []byte) (*dcspb.Event, error) {
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	flag.Parse()
+	initConfig()
 
 	// Initialize the global tracer as early as possible:
 	// common.Init uses gRPC.
@@ -536,6 +834,7 @@ func main() {
 	defer closer.Close()
 
 	common.Init(*tlsCertPath, *tlsKeyPath, *staticPath)
+	i18n.Init()
 
 	if *accessLogPath != "" {
 		var err error
@@ -545,6 +844,8 @@ func main() {
 		}
 	}
 
+	initSearchLog()
+
 	if *clickLogPath != "" {
 		var err error
 		clickLog, err = os.OpenFile(*clickLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
@@ -553,6 +854,42 @@ func main() {
 		}
 	}
 
+	if err := parseExperiments(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadPresets(*presetsPath); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadTenants(*tenantsPath); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := loadMetadata(*metadataPath); err != nil {
+		log.Fatal(err)
+	}
+
+	if store, err = newResultsStore(*resultsStoreName); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkGCPolicy(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Verifies -peers and -self_peer.
+	peerURLs()
+	startPeerResolver()
+	startResultsGC()
+
+	initAdminQuery()
+	resumeInterruptedQueries()
+
+	startStatzAggregator()
+	startAnalyticsExporter()
+	startClockSkewMonitor()
+
 	fmt.Printf("Debian Code Search webapp, version %s\n", common.Version)
 
 	health.StartChecking()
@@ -579,6 +916,7 @@ func main() {
 			"criticalcss": common.CriticalCss,
 			"version":     common.Version,
 			"host":        r.Host,
+			"uiconfig":    currentUIConfig(),
 		}); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -587,6 +925,7 @@ func main() {
 	http.HandleFunc("/favicon.ico", http.NotFound)
 	http.HandleFunc("/goroutinez", goroutinez.Goroutinez)
 	http.HandleFunc("/show", show.Show)
+	http.HandleFunc("/annotate", AnnotateHandler)
 	http.HandleFunc("/memprof", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("writing memprof")
 		if *memprofile != "" {
@@ -600,10 +939,32 @@ func main() {
 		}
 	})
 
-	http.HandleFunc("/results/", ResultsHandler)
-	http.HandleFunc("/perpackage-results/", PerPackageResultsHandler)
+	http.HandleFunc("/results/", withQuery(ResultsHandler))
+	http.HandleFunc("/perpackage-results/", withQuery(PerPackageResultsHandler))
+	http.HandleFunc("/perdir-results/", withQuery(PerDirResultsHandler))
 	http.HandleFunc("/queryz", QueryzHandler)
+	http.HandleFunc("/queryz/events", QueryzEventsHandler)
+	http.HandleFunc("/statz", StatzHandler)
+	http.HandleFunc("/backendz", BackendzHandler)
+	http.HandleFunc("/gcz", GCHandler)
 	http.HandleFunc("/track", Track)
+	http.HandleFunc("/api/v1/presets", PresetsHandler)
+	http.HandleFunc("/api/v1/presets/", PresetsHandler)
+	http.HandleFunc("/api/v1/diff", DiffHandler)
+	http.HandleFunc("/api/v1/bookmarks", BookmarksHandler)
+	http.HandleFunc("/api/v1/refine", RefineHandler)
+	http.HandleFunc("/api/v1/xref", XrefHandler)
+	http.HandleFunc("/api/v1/uiconfig", UIConfigHandler)
+	http.HandleFunc("/api/v1/eventschema", EventSchemaHandler)
+	http.HandleFunc("/api/v1/debug/", DebugBundleHandler)
+	http.HandleFunc("/api/v1/meta/", MetaHandler)
+	http.HandleFunc("/api/v1/query", QueryHandler)
+	http.HandleFunc("/api/v1/tail/", TailHandler)
+	http.HandleFunc("/api/v1/poll/", LongPollHandler)
+	http.HandleFunc("/opensearch.xml", OpenSearchDescriptionHandler)
+	http.HandleFunc("/opensearch", OpenSearchHandler)
+	http.HandleFunc("/healthz", HealthzHandler)
+	http.HandleFunc("/readyz", ReadyzHandler)
 
 	traced := http.NewServeMux()
 	traced.HandleFunc("/search", Search)
@@ -623,6 +984,7 @@ func main() {
 			"criticalcss": common.CriticalCss,
 			"version":     common.Version,
 			"host":        r.Host,
+			"uiconfig":    currentUIConfig(),
 			"q":           "%q%",
 			"literal":     true,
 		}); err != nil {
@@ -632,10 +994,15 @@ func main() {
 	})
 
 	http.Handle("/metrics", prometheus.Handler())
+	http.HandleFunc("/varz", varz.Handler)
 
 	if *listenAddressPlain != "" {
+		ln, err := socketactivation.Listen(*listenAddressPlain)
+		if err != nil {
+			log.Fatal(err)
+		}
 		go func() {
-			log.Fatal(http.ListenAndServe(*listenAddressPlain, nil))
+			log.Fatal(http.Serve(ln, nil))
 		}()
 	}
 
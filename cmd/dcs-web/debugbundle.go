@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// debugBundleQuery is stored as query.json in debug bundles.
+type debugBundleQuery struct {
+	QueryId        string
+	Query          string
+	RewrittenQuery string
+	Priority       string
+	Started        time.Time
+	Ended          time.Time `json:",omitempty"`
+	Done           bool
+	Duration       string
+	ErrorType      string `json:",omitempty"`
+	NumResults     int
+	Truncated      bool
+	Abandoned      bool
+	Corrupt        bool
+
+	// TimelineTruncated is set if the query had more than maxTimelineEntries
+	// events, in which case timeline.json only contains the first ones.
+	TimelineTruncated bool
+}
+
+// debugBundleEvent is one event of the query which was not obsoleted.
+type debugBundleEvent struct {
+	Sequence int
+	// Data is empty for the final event, which marks the query as done.
+	Data json.RawMessage `json:",omitempty"`
+}
+
+// debugBundleManifest is stored as manifest.json in debug bundles. It
+// describes the stored results of the query without containing them.
+type debugBundleManifest struct {
+	// Storage is only set once the query is done.
+	Storage       []storageManifest `json:",omitempty"`
+	ResultPages   int
+	ResultsDigest string
+	Pointers      []persistedPointer
+}
+
+// DebugBundleHandler serves /api/v1/debug/<queryid>, a tarball with
+// diagnostics of the query (the query as sent to the backends, per-backend
+// timings and progress, the event log and timeline, and the result pointers,
+// but not the results themselves), which users can attach to bug reports.
+func DebugBundleHandler(w http.ResponseWriter, r *http.Request) {
+	queryid := strings.TrimPrefix(r.URL.Path, "/api/v1/debug/")
+	if queryid == "" || strings.Contains(queryid, "/") {
+		http.Error(w, "Invalid query id.", http.StatusBadRequest)
+		return
+	}
+	if !checkTenant(w, r, queryid) {
+		return
+	}
+	if proxyToOwner(w, r, queryid, DebugBundleHandler) {
+		return
+	}
+	defer pinQuery(queryid)()
+	if !reloadQuery(queryid) {
+		http.Error(w, "No such query.", http.StatusNotFound)
+		return
+	}
+
+	files, err := debugBundleFiles(queryid)
+	if err != nil {
+		log.Printf("[%s] could not create debug bundle: %v\n", queryid, err)
+		http.Error(w, "Could not create debug bundle.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "dcs-debug-"+queryid+".tar.gz"))
+	w.Header().Set("Cache-Control", "no-store")
+	if err := writeDebugBundle(w, queryid, files); err != nil {
+		log.Printf("[%s] could not write debug bundle: %v\n", queryid, err)
+	}
+}
+
+// debugBundleFile is one file of a debug bundle. Its contents are encoded as
+// JSON.
+type debugBundleFile struct {
+	name     string
+	contents interface{}
+}
+
+func debugBundleFiles(queryid string) ([]debugBundleFile, error) {
+	stateMu.RLock()
+	s, ok := state[queryid]
+	if !ok {
+		stateMu.RUnlock()
+		return nil, fmt.Errorf("query not found")
+	}
+	query := debugBundleQuery{
+		QueryId:           queryid,
+		Query:             s.query,
+		RewrittenQuery:    s.rewrittenQuery,
+		Priority:          s.priority.String(),
+		Started:           s.started,
+		Done:              s.done,
+		Duration:          s.runningFor().String(),
+		ErrorType:         s.errorType,
+		Truncated:         s.truncated,
+		Abandoned:         s.abandoned,
+		Corrupt:           s.corrupt,
+		TimelineTruncated: len(s.timeline) >= maxTimelineEntries,
+	}
+	if s.done {
+		query.Ended = s.ended
+		query.NumResults = s.numResults()
+	}
+	backends := backendReports(&s)
+	timeline := append([]timelineEntry(nil), s.timeline...)
+	events := make([]debugBundleEvent, 0, len(s.events))
+	for _, ev := range s.events {
+		if *ev.obsolete {
+			continue
+		}
+		events = append(events, debugBundleEvent{
+			Sequence: ev.sequence,
+			Data:     json.RawMessage(ev.data),
+		})
+	}
+	manifest := debugBundleManifest{
+		ResultPages:   s.resultPages,
+		ResultsDigest: s.resultsDigest,
+	}
+	// resultPointers are only complete (and no longer modified) once the
+	// query is done.
+	if s.done {
+		manifest.Pointers = persistPointers(s.resultPointers)
+	}
+	stateMu.RUnlock()
+
+	// Like persistQuery, the storage is read without holding stateMu. The
+	// query is pinned by the caller, so the storage is not closed meanwhile.
+	if s.done && s.storage != nil {
+		storage, err := newStorageManifest(s.storage, len(s.perBackend))
+		if err != nil {
+			return nil, err
+		}
+		manifest.Storage = storage
+	}
+
+	return []debugBundleFile{
+		{"query.json", query},
+		{"backends.json", backends},
+		{"timeline.json", timeline},
+		{"events.json", events},
+		{"manifest.json", manifest},
+	}, nil
+}
+
+// writeDebugBundle writes files as a gzip-compressed tarball to w, all within
+// a directory named after the query.
+func writeDebugBundle(w io.Writer, queryid string, files []debugBundleFile) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, f := range files {
+		b, err := json.MarshalIndent(f.contents, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    "dcs-debug-" + queryid + "/" + f.name,
+			Mode:    0644,
+			Size:    int64(len(b)),
+			ModTime: now,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
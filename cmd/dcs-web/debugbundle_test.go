@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugBundle(t *testing.T) {
+	defer useFakeBackends(t,
+		newFakeBackend("i3-wm_4.8-1/i3bar/src/main.c", "i3-wm_4.8-1/src/main.c"),
+		newFakeBackend("dcs_0.1-1/cmd/dcs-web/dcs-web.go"))()
+
+	const query = "q=main&literal=1"
+	queryid := queryIdentifier(query)
+	if _, err := maybeStartQuery(context.Background(), queryid, "test", query); err != nil {
+		t.Fatal(err)
+	}
+	defer forgetQuery(queryid)
+	waitDone(t, queryid)
+
+	rec := httptest.NewRecorder()
+	DebugBundleHandler(rec, httptest.NewRequest("GET", "/api/v1/debug/"+queryid, nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+	}
+
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = b
+	}
+
+	prefix := "dcs-debug-" + queryid + "/"
+	for _, name := range []string{"query.json", "backends.json", "timeline.json", "events.json", "manifest.json"} {
+		if _, ok := files[prefix+name]; !ok {
+			t.Errorf("debug bundle does not contain %s%s", prefix, name)
+		}
+	}
+
+	var q debugBundleQuery
+	if err := json.Unmarshal(files[prefix+"query.json"], &q); err != nil {
+		t.Fatal(err)
+	}
+	if !q.Done || q.Query != query || q.NumResults != 3 {
+		t.Errorf("unexpected query.json: got %+v, want done query %q with 3 results", q, query)
+	}
+
+	var backends []slowQueryBackend
+	if err := json.Unmarshal(files[prefix+"backends.json"], &backends); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(backends), 2; got != want {
+		t.Fatalf("unexpected number of backends: got %d, want %d", got, want)
+	}
+	if got, want := backends[0].FilesProcessed, 2; got != want {
+		t.Errorf("backend 0: unexpected FilesProcessed: got %d, want %d", got, want)
+	}
+
+	var timeline []timelineEntry
+	if err := json.Unmarshal(files[prefix+"timeline.json"], &timeline); err != nil {
+		t.Fatal(err)
+	}
+	progress := 0
+	for _, entry := range timeline {
+		if entry.Progress != nil {
+			progress++
+		}
+	}
+	if progress == 0 {
+		t.Errorf("timeline.json contains no progress updates: %+v", timeline)
+	}
+
+	var manifest debugBundleManifest
+	if err := json.Unmarshal(files[prefix+"manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(manifest.Pointers), 3; got != want {
+		t.Errorf("unexpected number of pointers: got %d, want %d", got, want)
+	}
+	if got, want := len(manifest.Storage), 2; got != want {
+		t.Errorf("unexpected number of storage manifests: got %d, want %d", got, want)
+	}
+}
+
+func TestDebugBundleNotFound(t *testing.T) {
+	defer useFakeBackends(t)()
+	rec := httptest.NewRecorder()
+	DebugBundleHandler(rec, httptest.NewRequest("GET", "/api/v1/debug/doesnotexist", nil))
+	if got, want := rec.Code, http.StatusNotFound; got != want {
+		t.Errorf("unexpected HTTP status: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+// fingerprintVersion prefixes the fingerprints returned by matchFingerprint.
+// Fingerprints without a version prefix were computed by
+// legacyMatchFingerprint.
+const fingerprintVersion = "v2:"
+
+// matchFingerprint identifies a match independently of the package version,
+// so that results can be compared across index versions: the source package
+// name (without version), the path within the source package and a hash of
+// the contents of the matching line, e.g.
+// “v2:i3-wm/src/main.c:9c1185a5c5e9fc54”. Unlike line numbers, the contents
+// usually remain the same when lines are added or removed elsewhere in the
+// file. Whitespace is normalized, so that re-indenting a line does not change
+// its fingerprint.
+//
+// Fingerprints are included in results (see WriteMatchJSON), and are used by
+// bookmarks and diffs.
+func matchFingerprint(match *sourcebackendpb.Match) string {
+	pkg, path := fingerprintLocation(match)
+	h := fnv.New64a()
+	io.WriteString(h, strings.Join(strings.Fields(match.Context), " "))
+	return fingerprintVersion + pkg + path + ":" + strconv.FormatUint(h.Sum64(), 16)
+}
+
+// legacyMatchFingerprint returns the fingerprint of match as computed before
+// fingerprintVersion was introduced, using the line number instead of the
+// contents, e.g. “i3-wm/src/main.c:42”. Such fingerprints are still stored in
+// bookmarks and preset feed snapshots, so they remain valid.
+func legacyMatchFingerprint(match *sourcebackendpb.Match) string {
+	pkg, path := fingerprintLocation(match)
+	return pkg + path + ":" + strconv.FormatUint(uint64(match.Line), 10)
+}
+
+func fingerprintLocation(match *sourcebackendpb.Match) (pkg, path string) {
+	path = match.Path
+	if idx := strings.Index(path, "/"); idx > -1 {
+		path = path[idx:]
+	}
+	pkg = match.Package
+	if idx := strings.Index(pkg, "_"); idx > -1 {
+		pkg = pkg[:idx]
+	}
+	return pkg, path
+}
+
+// completedQuery returns the state of the specified query (reloading it from
+// disk if it was evicted), or an error message and HTTP status code if the
+// query does not exist or is not yet done.
+func completedQuery(queryid string) (queryState, string, int) {
+	reloadQuery(queryid)
+	stateMu.RLock()
+	s, ok := state[queryid]
+	stateMu.RUnlock()
+	if !ok {
+		return s, "No such query.", http.StatusNotFound
+	}
+	if !s.done {
+		return s, "Query not finished yet.", http.StatusInternalServerError
+	}
+	return s, "", http.StatusOK
+}
+
+// fingerprints returns the fingerprints of the specified matches of queryid,
+// including their legacy fingerprints (see legacyMatchFingerprint), so that
+// both can be looked up.
+func fingerprints(queryid string, pointers []resultPointer) (map[string]bool, error) {
+	result := make(map[string]bool, 2*len(pointers))
+	err := forEachMatch(queryid, pointers, func(idx int, match *sourcebackendpb.Match) error {
+		result[matchFingerprint(match)] = true
+		result[legacyMatchFingerprint(match)] = true
+		return nil
+	})
+	return result, err
+}
+
+// missing returns all matches of queryid (encoded like in result pages, see
+// WriteMatchJSON) whose fingerprint is not contained in other.
+func missing(queryid string, pointers []resultPointer, other map[string]bool) ([]json.RawMessage, error) {
+	result := []json.RawMessage{}
+	err := forEachMatch(queryid, pointers, func(idx int, match *sourcebackendpb.Match) error {
+		if other[matchFingerprint(match)] {
+			return nil
+		}
+		var buf bytes.Buffer
+		if err := WriteMatchJSON(match, &buf); err != nil {
+			return err
+		}
+		result = append(result, buf.Bytes())
+		return nil
+	})
+	return result, err
+}
+
+// Diff is the reply of /api/v1/diff.
+type Diff struct {
+	A string
+	B string
+
+	// Added are the matches only in B, Removed are the matches only in A.
+	Added   []json.RawMessage
+	Removed []json.RawMessage
+}
+
+// DiffHandler serves /api/v1/diff?a=<queryid>&b=<queryid>, which returns the
+// matches which were added (only in b) and removed (only in a), e.g. to
+// compare the results of a refined pattern or of different index versions.
+// Matches are compared by their fingerprint (see matchFingerprint), i.e. by
+// package name, path and the contents of the matching line, so a match whose
+// line moved within the file is neither added nor removed.
+func DiffHandler(w http.ResponseWriter, r *http.Request) {
+	a := r.FormValue("a")
+	b := r.FormValue("b")
+	if a == "" || b == "" {
+		http.Error(w, "Both the a and b parameters must be specified.", http.StatusBadRequest)
+		return
+	}
+	if !checkTenant(w, r, a) || !checkTenant(w, r, b) {
+		return
+	}
+	defer pinQuery(a)()
+	defer pinQuery(b)()
+	sa, msg, code := completedQuery(a)
+	if code != http.StatusOK {
+		http.Error(w, msg, code)
+		return
+	}
+	sb, msg, code := completedQuery(b)
+	if code != http.StatusOK {
+		http.Error(w, msg, code)
+		return
+	}
+
+	fpa, err := fingerprints(a, sa.resultPointers)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not read results: %v", err), http.StatusInternalServerError)
+		return
+	}
+	fpb, err := fingerprints(b, sb.resultPointers)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not read results: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	diff := Diff{
+		A: a,
+		B: b,
+	}
+	if diff.Added, err = missing(b, sb.resultPointers, fpa); err != nil {
+		http.Error(w, fmt.Sprintf("Could not read results: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if diff.Removed, err = missing(a, sa.resultPointers, fpb); err != nil {
+		http.Error(w, fmt.Sprintf("Could not read results: %v", err), http.StatusInternalServerError)
+		return
+	}
+	startJsonResponse(w)
+	enc := json.NewEncoder(w)
+	// Matches are HTML-escaped by the source backends already.
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(&diff); err != nil {
+		log.Printf("[%s] diff with %s failed: %v\n", a, b, err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+func TestMatchFingerprint(t *testing.T) {
+	base := &sourcebackendpb.Match{
+		Path:    "i3-wm_4.8-1/src/main.c",
+		Package: "i3-wm_4.8-1",
+		Line:    23,
+		Context: "int main(int argc, char *argv[]) {",
+	}
+	fp := matchFingerprint(base)
+	if !strings.HasPrefix(fp, "v2:i3-wm/src/main.c:") {
+		t.Errorf("matchFingerprint = %q, want prefix v2:i3-wm/src/main.c:", fp)
+	}
+	// Bookmarks and preset feed snapshots may contain fingerprints from
+	// before fingerprintVersion.
+	if got, want := legacyMatchFingerprint(base), "i3-wm/src/main.c:23"; got != want {
+		t.Errorf("legacyMatchFingerprint = %q, want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		desc  string
+		match sourcebackendpb.Match
+		same  bool
+	}{
+		{
+			desc: "newer version, shifted line",
+			match: sourcebackendpb.Match{
+				Path:    "i3-wm_4.16-1/src/main.c",
+				Package: "i3-wm_4.16-1",
+				Line:    42,
+				Context: "int main(int argc, char *argv[]) {",
+			},
+			same: true,
+		},
+		{
+			desc: "re-indented",
+			match: sourcebackendpb.Match{
+				Path:    "i3-wm_4.8-1/src/main.c",
+				Package: "i3-wm_4.8-1",
+				Line:    23,
+				Context: "\tint  main(int argc,  char *argv[]) { ",
+			},
+			same: true,
+		},
+		{
+			desc: "changed line",
+			match: sourcebackendpb.Match{
+				Path:    "i3-wm_4.8-1/src/main.c",
+				Package: "i3-wm_4.8-1",
+				Line:    23,
+				Context: "int main(int argc, char **argv) {",
+			},
+			same: false,
+		},
+		{
+			desc: "other file",
+			match: sourcebackendpb.Match{
+				Path:    "i3-wm_4.8-1/i3bar/src/main.c",
+				Package: "i3-wm_4.8-1",
+				Line:    23,
+				Context: "int main(int argc, char *argv[]) {",
+			},
+			same: false,
+		},
+	} {
+		got := matchFingerprint(&tt.match)
+		if (got == fp) != tt.same {
+			t.Errorf("%s: matchFingerprint = %q, base fingerprint %q, want equal = %v", tt.desc, got, fp, tt.same)
+		}
+	}
+}
+
+func TestDiffHandler(t *testing.T) {
+	// The fake source backend returns the same matches for every query.
+	defer useFakeBackends(t, newFakeBackend(
+		"i3-wm_4.8-1/src/main.c",
+		"dcs_0.1-1/cmd/dcs-web/dcs-web.go"))()
+	a, cleanupA := runQuery(t, "q=main&literal=1")
+	defer cleanupA()
+	b, cleanupB := runQuery(t, "q=int+main&literal=1")
+	defer cleanupB()
+	waitDone(t, a)
+	waitDone(t, b)
+
+	rec := httptest.NewRecorder()
+	DiffHandler(rec, httptest.NewRequest("GET", "/api/v1/diff?a="+url.QueryEscape(a)+"&b="+url.QueryEscape(b), nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+	}
+	var diff Diff
+	if err := json.Unmarshal(rec.Body.Bytes(), &diff); err != nil {
+		t.Fatalf("%v (body: %s)", err, rec.Body.String())
+	}
+	if diff.A != a || diff.B != b || len(diff.Added) != 0 || len(diff.Removed) != 0 {
+		t.Errorf("unexpected diff: %s", rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"Added":[]`) {
+		t.Errorf("Added is not an empty array: %s", rec.Body.String())
+	}
+}
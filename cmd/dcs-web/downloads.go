@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	queryRetention = flag.Duration("query_retention",
+		30*time.Minute,
+		"How long the results of a query are served after the query started. Afterwards, the query is re-run when requested again")
+
+	downloadSigningKey = flag.String("download_signing_key",
+		"",
+		"Key for signing the download links in pagination events. If set, result pages, packages.json and exports are only served via signed links. If empty, a random key is generated at startup, i.e. the links become invalid when dcs-web restarts, and unsigned requests are served as well")
+
+	// downloadPathRe matches the paths which Downloads contains links to.
+	downloadPathRe = regexp.MustCompile(`^/results/[^/]+/(page_[0-9]+\.json|packages\.json|export/.*)$`)
+)
+
+var (
+	signingKeyOnce sync.Once
+	signingKey     []byte
+)
+
+func downloadKey() []byte {
+	signingKeyOnce.Do(func() {
+		if *downloadSigningKey != "" {
+			signingKey = []byte(*downloadSigningKey)
+			return
+		}
+		signingKey = make([]byte, 32)
+		if _, err := rand.Read(signingKey); err != nil {
+			log.Fatalf("Could not generate -download_signing_key: %v", err)
+		}
+	})
+	return signingKey
+}
+
+// downloadSignature returns the signature of a download link for path which
+// expires at expires (in seconds since the epoch). Links to the files of an
+// export share the signature of the export directory, so that the part files
+// (which are relative to the manifest) can be fetched using the expires and
+// sig parameters of the manifest link.
+func downloadSignature(path string, expires int64) string {
+	if idx := strings.Index(path, "/export/"); idx > -1 {
+		path = path[:idx+len("/export/")]
+	}
+	mac := hmac.New(sha256.New, downloadKey())
+	fmt.Fprintf(mac, "%s\n%d", path, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// downloadExpiry returns when the download links of a query which started at
+// started expire: once its results may be deleted (see -results_retention).
+// Without -results_retention, results are only deleted to keep enough disk
+// space free, so the links expire with the query (see -query_retention).
+func downloadExpiry(started time.Time) time.Time {
+	if *resultsRetention <= 0 {
+		return started.Add(*queryRetention)
+	}
+	return started.Add(*resultsRetention)
+}
+
+// signDownload returns a link to path which is valid until expires.
+func signDownload(path string, expires time.Time) string {
+	v := url.Values{}
+	v.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	v.Set("sig", downloadSignature(path, expires.Unix()))
+	return path + "?" + v.Encode()
+}
+
+// Downloads lists where the results of a finished query can be fetched, see
+// Pagination.
+type Downloads struct {
+	// Expires is when the results of the query may be deleted (see
+	// -results_retention). Until then, the links below can be fetched
+	// (unless the results need to be deleted earlier to keep enough disk
+	// space free, see -headroom_percentage). Afterwards, requests for the
+	// links fail with HTTP status 410 (Gone).
+	Expires time.Time
+
+	// Pages contains one link per page of results (page_<n>.json).
+	Pages []string
+
+	// Packages links to the list of packages containing results
+	// (packages.json).
+	Packages string
+
+	// Export links to the manifest of a full result export (see
+	// exportManifest). The part files are relative to the manifest, and
+	// need to be fetched with the same expires and sig parameters.
+	Export string
+}
+
+// queryDownloads returns the signed download links of the finished query
+// which started at started.
+func queryDownloads(queryid string, started time.Time, resultPages int) *Downloads {
+	expires := downloadExpiry(started)
+	d := &Downloads{
+		Expires:  expires.UTC().Truncate(time.Second),
+		Pages:    make([]string, resultPages),
+		Packages: signDownload("/results/"+queryid+"/packages.json", expires),
+		Export:   signDownload("/results/"+queryid+"/export/manifest.json", expires),
+	}
+	for page := range d.Pages {
+		d.Pages[page] = signDownload(fmt.Sprintf("/results/%s/page_%d.json", queryid, page), expires)
+	}
+	return d
+}
+
+// checkDownload verifies the signature of download links (see Downloads) and
+// replies with an error if the signature is invalid or the link expired.
+// Requests without a signature are only served if -download_signing_key is
+// not set or the path is not one of the download links. Returns whether the
+// request should be served.
+func checkDownload(w http.ResponseWriter, r *http.Request) bool {
+	sig := r.FormValue("sig")
+	if sig == "" {
+		if *downloadSigningKey != "" && downloadPathRe.MatchString(r.URL.Path) {
+			http.Error(w, "This download link requires a signature, see the Downloads of the pagination event.", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	expires, err := strconv.ParseInt(r.FormValue("expires"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(sig), []byte(downloadSignature(r.URL.Path, expires))) {
+		http.Error(w, "Invalid download link signature.", http.StatusForbidden)
+		return false
+	}
+	if time.Now().Unix() >= expires {
+		http.Error(w, "This download link has expired. Please run the query again.", http.StatusGone)
+		return false
+	}
+	return true
+}
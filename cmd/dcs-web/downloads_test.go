@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryDownloads(t *testing.T) {
+	started := time.Now()
+	d := queryDownloads("abc", started, 2)
+	if got, want := d.Expires, started.Add(*resultsRetention).UTC().Truncate(time.Second); !got.Equal(want) {
+		t.Errorf("Expires = %v, want %v", got, want)
+	}
+	if len(d.Pages) != 2 || !strings.HasPrefix(d.Pages[1], "/results/abc/page_1.json?") {
+		t.Errorf("unexpected Pages: %q", d.Pages)
+	}
+	if !strings.HasPrefix(d.Export, "/results/abc/export/manifest.json?") {
+		t.Errorf("unexpected Export: %q", d.Export)
+	}
+}
+
+func TestCheckDownload(t *testing.T) {
+	valid := signDownload("/results/abc/page_0.json", time.Now().Add(time.Hour))
+	expired := signDownload("/results/abc/page_0.json", time.Now().Add(-time.Minute))
+	for _, tt := range []struct {
+		desc   string
+		url    string
+		status int
+	}{
+		{"unsigned", "/results/abc/page_0.json", http.StatusOK},
+		{"valid", valid, http.StatusOK},
+		{"other path", strings.Replace(valid, "page_0", "page_1", 1), http.StatusForbidden},
+		{"extended", strings.Replace(valid, "expires=", "expires=1", 1), http.StatusForbidden},
+		{"expired", expired, http.StatusGone},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			if checkDownload(rec, httptest.NewRequest("GET", tt.url, nil)) {
+				rec.WriteHeader(http.StatusOK)
+			}
+			if got := rec.Code; got != tt.status {
+				t.Errorf("status = %d, want %d", got, tt.status)
+			}
+		})
+	}
+}
+
+func TestCheckDownloadRequiresSignature(t *testing.T) {
+	old := *downloadSigningKey
+	*downloadSigningKey = "secret"
+	defer func() { *downloadSigningKey = old }()
+
+	manifest := signDownload("/results/abc/export/manifest.json", time.Now().Add(time.Hour))
+	part := strings.Replace(manifest, "manifest.json", "part_0.ndjson", 1)
+	for _, tt := range []struct {
+		desc   string
+		url    string
+		status int
+	}{
+		{"unsigned page", "/results/abc/page_0.json", http.StatusForbidden},
+		{"unsigned packages", "/results/abc/packages.json", http.StatusForbidden},
+		{"unsigned export", "/results/abc/export/part_0.ndjson", http.StatusForbidden},
+		// Pages rendered for the web interface are not download links.
+		{"unsigned html page", "/results/abc/page_0.html", http.StatusOK},
+		{"unsigned per-package page", "/perpackage-results/abc/2/page_0.json", http.StatusOK},
+		{"signed manifest", manifest, http.StatusOK},
+		// Part files are fetched with the parameters of the manifest link.
+		{"part with manifest signature", part, http.StatusOK},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			if checkDownload(rec, httptest.NewRequest("GET", tt.url, nil)) {
+				rec.WriteHeader(http.StatusOK)
+			}
+			if got := rec.Code; got != tt.status {
+				t.Errorf("status = %d, want %d", got, tt.status)
+			}
+		})
+	}
+}
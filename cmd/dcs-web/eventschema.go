@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+// The events which are sent to clients of /events/ and /instantws (see
+// static/instant.js) are JSON objects whose Type field identifies the Go type
+// they were marshaled from. Matches are the exception: they are marshaled
+// sourcebackendpb.Match messages, which do not have a Type.
+//
+// The schema of all events is generated from the Go types (see eventSchema)
+// and served at /api/v1/eventschema. A copy is checked in as
+// static/eventschema.json, which TestEventSchema keeps in sync, so that
+// changes to the events are visible in code review and can be compared with
+// the event types which static/instant.js handles.
+//
+// Clients announce the newest protocol version they support when connecting
+// (v=N for /events/, the Version field for /instantws), see negotiateVersion.
+// Clients which do not announce a version speak version 1.
+const (
+	// protocolVersion is the newest protocol version. Version 2 added the
+	// hello event and sends batches without requiring batch=1. Version 3
+	// added the started event. Version 4 added the noresults event.
+	protocolVersion = 4
+
+	// minProtocolVersion is the oldest protocol version which clients may
+	// still speak.
+	minProtocolVersion = 1
+)
+
+// Values of the Type field of events.
+const (
+	eventTypeProgress   = "progress"
+	eventTypePagination = "pagination"
+	eventTypeError      = "error"
+	eventTypeWarning    = "warning"
+	eventTypeQueued     = "queued"
+	eventTypeCounts     = "counts"
+	eventTypeFacets     = "facets"
+	eventTypeBatch      = "batch"
+	eventTypeHello      = "hello"
+	eventTypeStarted    = "started"
+	eventTypeNoResults  = "noresults"
+)
+
+// Hello is the first event sent to clients which announced a protocol version
+// of 2 or newer.
+type Hello struct {
+	// Set to “hello”.
+	Type string
+
+	// Version is the negotiated protocol version, i.e. the smaller of the
+	// version the client announced and protocolVersion.
+	Version int
+}
+
+// Batch contains events which were added in quick succession, see
+// encodeEventBatch.
+type Batch struct {
+	// Set to “batch”.
+	Type string
+
+	// Events are any events but batches.
+	Events []json.RawMessage
+}
+
+// eventTypes lists all events with the protocol version which introduced them.
+// The first entry describes matches, which do not have a Type.
+var eventTypes = []struct {
+	name    string // name of the definition in the schema
+	since   int
+	example interface{}
+}{
+	{"match", 1, sourcebackendpb.Match{}},
+	{eventTypeProgress, 1, ProgressUpdate{}},
+	{eventTypePagination, 1, Pagination{}},
+	{eventTypeError, 1, Error{}},
+	{eventTypeWarning, 1, Warning{}},
+	{eventTypeQueued, 1, Queued{}},
+	{eventTypeCounts, 1, Counts{}},
+	{eventTypeFacets, 1, Facets{}},
+	{eventTypeBatch, 1, Batch{}},
+	{eventTypeHello, 2, Hello{}},
+	{eventTypeStarted, 3, Started{}},
+	{eventTypeNoResults, 4, NoResults{}},
+}
+
+// eventSupported reports whether clients speaking the specified protocol
+// version understand the event. Events of types which were introduced in a
+// newer version are not sent to them.
+func eventSupported(original obsoletableEvent, version int) bool {
+	if original == nil {
+		return true
+	}
+	for _, et := range eventTypes {
+		if et.name == original.EventType() {
+			return et.since <= version
+		}
+	}
+	return true
+}
+
+// negotiateVersion returns the protocol version to speak with a client which
+// announced that it supports versions up to requested (0 if the client did not
+// announce a version).
+func negotiateVersion(requested int) (int, error) {
+	if requested == 0 {
+		return 1, nil
+	}
+	if requested < minProtocolVersion {
+		return 0, fmt.Errorf("unsupported protocol version %d, this server supports versions %d to %d", requested, minProtocolVersion, protocolVersion)
+	}
+	if requested > protocolVersion {
+		return protocolVersion, nil
+	}
+	return requested, nil
+}
+
+// helloEvent returns the hello event for the negotiated protocol version, or
+// nil if the version does not have hello events.
+func helloEvent(version int) []byte {
+	if version < 2 {
+		return nil
+	}
+	b, _ := json.Marshal(&Hello{
+		Type:    eventTypeHello,
+		Version: version,
+	})
+	return b
+}
+
+// eventSchema returns the JSON schema (draft-07) of the events of the
+// specified protocol version.
+func eventSchema(version int) map[string]interface{} {
+	definitions := make(map[string]interface{})
+	var all, unbatched []interface{}
+	for _, et := range eventTypes {
+		if et.since > version {
+			continue
+		}
+		def := typeSchema(reflect.TypeOf(et.example))
+		if et.name != "match" {
+			// The Type field identifies the event.
+			def["properties"].(map[string]interface{})["Type"] = map[string]interface{}{
+				"const": et.name,
+			}
+		} else {
+			// WriteMatchJSON adds the sources.debian.org URL and the
+			// fingerprint (see matchFingerprint) to all matches, whereas all
+			// fields of sourcebackendpb.Match are optional.
+			for _, name := range []string{"sources_url", "fingerprint"} {
+				def["properties"].(map[string]interface{})[name] = map[string]interface{}{
+					"type": "string",
+				}
+			}
+			def["required"] = []string{"sources_url", "fingerprint"}
+			// WriteMatchJSON encodes highlight ranges as [start, end].
+			def["properties"].(map[string]interface{})["highlight_ranges"] = map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type":     "array",
+					"items":    map[string]interface{}{"type": "integer"},
+					"minItems": 2,
+					"maxItems": 2,
+				},
+			}
+		}
+		definitions[et.name] = def
+		ref := map[string]interface{}{"$ref": "#/definitions/" + et.name}
+		all = append(all, ref)
+		if et.name != eventTypeBatch {
+			unbatched = append(unbatched, ref)
+		}
+	}
+	batch := definitions[eventTypeBatch].(map[string]interface{})
+	batch["properties"].(map[string]interface{})["Events"] = map[string]interface{}{
+		"type":  "array",
+		"items": map[string]interface{}{"anyOf": unbatched},
+	}
+	return map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       fmt.Sprintf("Debian Code Search events (protocol version %d)", version),
+		"anyOf":       all,
+		"definitions": definitions,
+	}
+}
+
+var (
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+	timeType       = reflect.TypeOf(time.Time{})
+)
+
+// typeSchema returns the JSON schema of the encoding/json encoding of values of
+// type t.
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case rawMessageType:
+		return map[string]interface{}{}
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return nullable(typeSchema(t.Elem()))
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string"} // base64
+		}
+		return nullable(map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem()),
+		})
+	case reflect.Map:
+		return nullable(map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem()),
+		})
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		var required []string
+		addStructFields(t, properties, &required)
+		schema := map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
+
+// nullable allows null in addition to the type of schema: encoding/json
+// encodes nil pointers, slices and maps as null.
+func nullable(schema map[string]interface{}) map[string]interface{} {
+	if typ, ok := schema["type"].(string); ok {
+		schema["type"] = []string{typ, "null"}
+	}
+	return schema
+}
+
+// addStructFields adds the fields of struct type t, as encoded by
+// encoding/json, to properties. Fields which are always encoded are appended
+// to required.
+func addStructFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			// The fields of embedded structs are promoted.
+			addStructFields(f.Type, properties, required)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		name := f.Name
+		opts := ""
+		if idx := strings.Index(tag, ","); idx > -1 {
+			tag, opts = tag[:idx], tag[idx:]
+		}
+		if tag != "" {
+			name = tag
+		}
+		properties[name] = typeSchema(f.Type)
+		if !strings.Contains(opts, ",omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// EventSchemaHandler serves /api/v1/eventschema, the JSON schema of the events
+// of protocol version v (default: the newest version).
+func EventSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	version := protocolVersion
+	if v := r.FormValue("v"); v != "" {
+		var err error
+		version, err = strconv.Atoi(v)
+		if err != nil || version < minProtocolVersion || version > protocolVersion {
+			http.Error(w, fmt.Sprintf("v must be between %d and %d", minProtocolVersion, protocolVersion), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Header().Set("Cache-Control", "max-age=3600, public")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(eventSchema(version)); err != nil {
+		log.Printf("Could not write event schema: %v\n", err)
+	}
+}
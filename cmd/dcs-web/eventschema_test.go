@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Debian/dcs/cmd/dcs-web/search"
+)
+
+var updateEventSchema = flag.Bool("update_eventschema",
+	false,
+	"Write the generated event schema to static/eventschema.json instead of comparing it")
+
+const eventSchemaPath = "../../static/eventschema.json"
+
+func marshalEventSchema(t *testing.T, version int) []byte {
+	b, err := json.MarshalIndent(eventSchema(version), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(b, '\n')
+}
+
+func TestEventSchema(t *testing.T) {
+	generated := marshalEventSchema(t, protocolVersion)
+	if *updateEventSchema {
+		if err := ioutil.WriteFile(eventSchemaPath, generated, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	checkedIn, err := ioutil.ReadFile(eventSchemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(checkedIn, generated) {
+		t.Fatalf("%s is out of date, run go test -run=TestEventSchema -update_eventschema", eventSchemaPath)
+	}
+}
+
+// TestEventSchemaInstantJS verifies that static/instant.js handles exactly the
+// event types of the schema.
+func TestEventSchemaInstantJS(t *testing.T) {
+	b, err := ioutil.ReadFile("../../static/instant.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	js := string(b)
+
+	matches := regexp.MustCompile(`var protocolVersion = (\d+);`).FindStringSubmatch(js)
+	if matches == nil {
+		t.Fatalf("protocolVersion not found in instant.js")
+	}
+	if got, _ := strconv.Atoi(matches[1]); got != protocolVersion {
+		t.Errorf("instant.js speaks protocol version %d, want %d", got, protocolVersion)
+	}
+
+	handled := make(map[string]bool)
+	for _, m := range regexp.MustCompile(`case "(\w+)":|msg\.Type === "(\w+)"`).FindAllStringSubmatch(js, -1) {
+		handled[m[1]+m[2]] = true
+	}
+	for _, et := range eventTypes {
+		if et.name == "match" {
+			continue // handled by the default case
+		}
+		if !handled[et.name] {
+			t.Errorf("instant.js does not handle %q events", et.name)
+		}
+		delete(handled, et.name)
+	}
+	for name := range handled {
+		t.Errorf("instant.js handles %q events, which are not in the schema", name)
+	}
+}
+
+// validate returns an error if value (as decoded by encoding/json) does not
+// conform to schema. Only the subset of JSON schema which eventSchema generates
+// is supported.
+func validate(root, schema map[string]interface{}, value interface{}, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/definitions/")
+		def, ok := root["definitions"].(map[string]interface{})[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: unknown $ref %q", path, ref)
+		}
+		return validate(root, def, value, path)
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		var errs []string
+		for _, sub := range anyOf {
+			err := validate(root, sub.(map[string]interface{}), value, path)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return fmt.Errorf("%s: no alternative matches: %s", path, strings.Join(errs, "; "))
+	}
+	if c, ok := schema["const"]; ok && value != c {
+		return fmt.Errorf("%s: got %v, want %v", path, value, c)
+	}
+	if typ, ok := schema["type"]; ok {
+		var types []string
+		switch typ := typ.(type) {
+		case string:
+			types = []string{typ}
+		case []string:
+			types = typ
+		}
+		if !hasJSONType(value, types) {
+			return fmt.Errorf("%s: %v (%T) is not of type %v", path, value, value, types)
+		}
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]string)
+		for _, name := range required {
+			if _, ok := value[name]; !ok {
+				return fmt.Errorf("%s: required property %q missing", path, name)
+			}
+		}
+		for name, v := range value {
+			sub, ok := properties[name].(map[string]interface{})
+			if !ok {
+				sub, ok = schema["additionalProperties"].(map[string]interface{})
+			}
+			if !ok {
+				if schema["additionalProperties"] == false {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				continue
+			}
+			if err := validate(root, sub, v, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for idx, v := range value {
+				if err := validate(root, items, v, fmt.Sprintf("%s[%d]", path, idx)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func hasJSONType(value interface{}, types []string) bool {
+	for _, typ := range types {
+		switch v := value.(type) {
+		case nil:
+			if typ == "null" {
+				return true
+			}
+		case bool:
+			if typ == "boolean" {
+				return true
+			}
+		case float64:
+			if typ == "number" || (typ == "integer" && v == math.Trunc(v)) {
+				return true
+			}
+		case string:
+			if typ == "string" {
+				return true
+			}
+		case []interface{}:
+			if typ == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if typ == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateEvent validates the event data against the (generated, then
+// marshaled and unmarshaled) schema of the specified protocol version.
+func validateEvent(t *testing.T, version int, data []byte) error {
+	var schema map[string]interface{}
+	if err := json.Unmarshal(marshalEventSchema(t, version), &schema); err != nil {
+		t.Fatal(err)
+	}
+	// Restore the []string values which encoding/json decodes as
+	// []interface{}, for the benefit of validate.
+	fixStringSlices(schema)
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	if _, ok := value.(map[string]interface{}); !ok {
+		return errors.New("event is not a JSON object")
+	}
+	return validate(schema, schema, value, "event")
+}
+
+func fixStringSlices(v interface{}) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for key, val := range m {
+		if s, ok := val.([]interface{}); ok && (key == "type" || key == "required") {
+			strs := make([]string, len(s))
+			for idx, elem := range s {
+				strs[idx] = elem.(string)
+			}
+			m[key] = strs
+			continue
+		}
+		switch val := val.(type) {
+		case map[string]interface{}:
+			fixStringSlices(val)
+		case []interface{}:
+			for _, elem := range val {
+				fixStringSlices(elem)
+			}
+		}
+	}
+}
+
+func TestEventsConformToSchema(t *testing.T) {
+	defer useFakeBackends(t,
+		newFakeBackend(
+			"i3-wm_4.8-1/i3bar/src/main.c",
+			"zsh_5.7.1-1/Src/main.c"),
+	)()
+
+	queryid, cleanup := runQuery(t, "q=main&literal=0")
+	defer cleanup()
+
+	stateMu.RLock()
+	var events [][]byte
+	for _, ev := range state[queryid].events {
+		if len(ev.data) > 0 {
+			events = append(events, ev.data)
+		}
+	}
+	stateMu.RUnlock()
+	events = append(events, encodeEventBatch(events))
+
+	for _, err := range []error{
+		errors.New("query too short"),
+		&search.QuerySyntaxError{Offset: 3, Reason: "missing closing )"},
+		&search.UnsupportedSyntaxError{Construct: `\1`, Offset: 2, Reason: "backreferences"},
+	} {
+		b, _ := json.Marshal(invalidQueryError(err))
+		events = append(events, b)
+	}
+	for _, ev := range []interface{}{
+		&Queued{Type: eventTypeQueued, QueryId: queryid, Position: 1},
+		&Warning{Type: eventTypeWarning, WarningType: "broadquery"},
+		queryCounts(queryid),
+	} {
+		b, _ := json.Marshal(ev)
+		events = append(events, b)
+	}
+
+	for _, data := range events {
+		if err := validateEvent(t, protocolVersion, data); err != nil {
+			t.Errorf("%s: %v", data, err)
+		}
+	}
+
+	hello := helloEvent(protocolVersion)
+	if err := validateEvent(t, protocolVersion, hello); err != nil {
+		t.Errorf("%s: %v", hello, err)
+	}
+	if err := validateEvent(t, 1, hello); err == nil {
+		t.Errorf("%s unexpectedly valid in protocol version 1", hello)
+	}
+	started := startedEvent(protocolVersion, queryid)
+	if err := validateEvent(t, protocolVersion, started); err != nil {
+		t.Errorf("%s: %v", started, err)
+	}
+	if err := validateEvent(t, 2, started); err == nil {
+		t.Errorf("%s unexpectedly valid in protocol version 2", started)
+	}
+	if got := startedEvent(2, queryid); got != nil {
+		t.Errorf("startedEvent(2) = %s, want nil", got)
+	}
+	noresults, _ := json.Marshal(&NoResults{
+		Type:        eventTypeNoResults,
+		QueryId:     queryid,
+		Suggestions: []Suggestion{{Reason: "case", Query: "q=foo", EstimatedFiles: 3}},
+	})
+	if err := validateEvent(t, protocolVersion, noresults); err != nil {
+		t.Errorf("%s: %v", noresults, err)
+	}
+	if err := validateEvent(t, 3, noresults); err == nil {
+		t.Errorf("%s unexpectedly valid in protocol version 3", noresults)
+	}
+	if eventSupported(&NoResults{Type: eventTypeNoResults}, 3) {
+		t.Errorf("noresults events unexpectedly sent to protocol version 3 clients")
+	}
+	if !eventSupported(&Pagination{Type: eventTypePagination}, 1) {
+		t.Errorf("pagination events unexpectedly not sent to protocol version 1 clients")
+	}
+	for _, data := range []string{
+		`{"Type":"progress","QueryId":"x"}`,
+		`{"Type":"progress","QueryId":"x","FilesProcessed":"1","FilesTotal":2,"Results":0}`,
+		`{"Type":"nonexistent"}`,
+		`{"Type":"batch","Events":[{"Type":"batch","Events":[]}]}`,
+	} {
+		if err := validateEvent(t, protocolVersion, []byte(data)); err == nil {
+			t.Errorf("%s unexpectedly valid", data)
+		}
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, tt := range []struct {
+		requested int
+		want      int
+		wantErr   bool
+	}{
+		{0, 1, false},
+		{1, 1, false},
+		{protocolVersion, protocolVersion, false},
+		{protocolVersion + 1, protocolVersion, false},
+		{-1, 0, true},
+	} {
+		got, err := negotiateVersion(tt.requested)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("negotiateVersion(%d): got err %v, want err %v", tt.requested, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("negotiateVersion(%d) = %d, want %d", tt.requested, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Experiments route a percentage of queries through alternative code paths,
+// so that larger changes (e.g. a new ranking policy) can be rolled out
+// gradually and compared against the remaining queries in the metrics.
+//
+// Whether a query is part of an experiment only depends on the query id and
+// the experiment id, so a query is in the same arm on every dcs-web instance
+// and when it is resumed after a restart. Experiments are independent of
+// each other, i.e. a query can be part of multiple experiments.
+
+var (
+	experimentsList = flag.String("experiments",
+		"",
+		"Comma-separated list of experiments, each id:percent[:params], e.g. “pathweight:10:pathweight=1”. The specified percentage of queries (0-100) is part of the experiment: params (URL parameters, e.g. ranking options) are added to the query sent to the source backends, and code paths checking the experiment id are enabled. The experiments of a query are recorded in its progress events, on /queryz and in the experiment_* metrics")
+
+	experimentQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "experiment_queries",
+			Help: "Number of started queries per experiment (see -experiments), by arm (“experiment” or “control”).",
+		},
+		[]string{"experiment", "arm"})
+
+	experimentDurations = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "experiment_query_duration_ms",
+			Help:    "Duration of finished queries in milliseconds per experiment (see -experiments), by arm (“experiment” or “control”).",
+			Buckets: prometheus.ExponentialBuckets(10, 2, 14),
+		},
+		[]string{"experiment", "arm"})
+
+	experimentErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "experiment_query_errors",
+			Help: "Number of finished queries with an error per experiment (see -experiments), by arm (“experiment” or “control”).",
+		},
+		[]string{"experiment", "arm"})
+)
+
+func init() {
+	prometheus.MustRegister(experimentQueries)
+	prometheus.MustRegister(experimentDurations)
+	prometheus.MustRegister(experimentErrors)
+}
+
+type experiment struct {
+	id string
+
+	// permille is the share of queries which are part of the experiment, in
+	// thousandths (so that fractional percentages work).
+	permille uint64
+
+	// params are added to the rewritten query.
+	params url.Values
+}
+
+// experiments is set by parseExperiments and not modified afterwards.
+var experiments []experiment
+
+// parseExperiments parses -experiments. Must be called after flag.Parse().
+func parseExperiments() error {
+	parsed, err := parseExperimentsList(*experimentsList)
+	if err != nil {
+		return err
+	}
+	experiments = parsed
+	return nil
+}
+
+func parseExperimentsList(list string) ([]experiment, error) {
+	var result []experiment
+	seen := make(map[string]bool)
+	for _, spec := range strings.Split(list, ",") {
+		if spec == "" {
+			continue
+		}
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, fmt.Errorf("-experiments: %q is not of the form id:percent[:params]", spec)
+		}
+		e := experiment{id: parts[0]}
+		if seen[e.id] {
+			return nil, fmt.Errorf("-experiments: duplicate experiment %q", e.id)
+		}
+		seen[e.id] = true
+		percent, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("-experiments: %q: percent must be between 0 and 100, got %q", e.id, parts[1])
+		}
+		e.permille = uint64(percent * 10)
+		if len(parts) == 3 {
+			if e.params, err = url.ParseQuery(parts[2]); err != nil {
+				return nil, fmt.Errorf("-experiments: %q: invalid params: %v", e.id, err)
+			}
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// includes reports whether the query is part of the experiment.
+func (e *experiment) includes(queryid string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(e.id))
+	h.Write([]byte{0})
+	h.Write([]byte(queryid))
+	return h.Sum64()%1000 < e.permille
+}
+
+// queryExperiments returns the ids of the experiments which the query is part
+// of, and the rewritten query with the params of these experiments added.
+func queryExperiments(queryid string, rewritten url.URL) ([]string, url.URL) {
+	var ids []string
+	query := rewritten.Query()
+	modified := false
+	for _, e := range experiments {
+		if !e.includes(queryid) {
+			continue
+		}
+		ids = append(ids, e.id)
+		for key, values := range e.params {
+			query[key] = values
+			modified = true
+		}
+	}
+	if modified {
+		rewritten.RawQuery = query.Encode()
+	}
+	return ids, rewritten
+}
+
+// inExperiment reports whether the query is part of the experiment id (see
+// -experiments). Code paths under experiment check it to decide which
+// implementation to use.
+func (s *queryState) inExperiment(id string) bool {
+	return experimentArm(s.experiments, id) == "experiment"
+}
+
+// experimentArm returns the metric label of the arm of experiment id which a
+// query with the specified experiment ids is in.
+func experimentArm(ids []string, id string) string {
+	for _, e := range ids {
+		if e == id {
+			return "experiment"
+		}
+	}
+	return "control"
+}
+
+// recordExperimentStart counts a started query with the specified experiment
+// ids in the experiment_queries metric.
+func recordExperimentStart(ids []string) {
+	for _, e := range experiments {
+		experimentQueries.WithLabelValues(e.id, experimentArm(ids, e.id)).Inc()
+	}
+}
+
+// recordExperimentFinish records the outcome of a query with the specified
+// experiment ids in the experiment_* metrics.
+func recordExperimentFinish(ids []string, duration time.Duration, errorType string) {
+	for _, e := range experiments {
+		arm := experimentArm(ids, e.id)
+		experimentDurations.WithLabelValues(e.id, arm).Observe(float64(duration / time.Millisecond))
+		if errorType != "" {
+			experimentErrors.WithLabelValues(e.id, arm).Inc()
+		}
+	}
+}
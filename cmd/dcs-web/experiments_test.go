@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseExperimentsList(t *testing.T) {
+	parsed, err := parseExperimentsList("pathweight:10:pathweight=1&weighted=0,dedup:0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []experiment{
+		{id: "pathweight", permille: 100, params: url.Values{"pathweight": {"1"}, "weighted": {"0"}}},
+		{id: "dedup", permille: 5},
+	}
+	if !reflect.DeepEqual(parsed, want) {
+		t.Errorf("parseExperimentsList = %+v, want %+v", parsed, want)
+	}
+
+	for _, list := range []string{
+		"pathweight",
+		":10",
+		"pathweight:ten",
+		"pathweight:101",
+		"pathweight:10,pathweight:20",
+		"pathweight:10:%zz",
+	} {
+		if _, err := parseExperimentsList(list); err == nil {
+			t.Errorf("parseExperimentsList(%q) unexpectedly succeeded", list)
+		}
+	}
+}
+
+func TestExperimentAssignment(t *testing.T) {
+	e := experiment{id: "pathweight", permille: 100}
+	const queries = 10000
+	var included int
+	for i := 0; i < queries; i++ {
+		queryid := queryIdentifier(fmt.Sprintf("q=query%d&literal=1", i))
+		if e.includes(queryid) {
+			included++
+		}
+		if e.includes(queryid) != e.includes(queryid) {
+			t.Fatalf("assignment of %s is not stable", queryid)
+		}
+	}
+	// 10% ± 2 percentage points.
+	if included < 800 || included > 1200 {
+		t.Errorf("%d of %d queries included in a 10%% experiment", included, queries)
+	}
+
+	for _, e := range []experiment{{id: "none", permille: 0}, {id: "all", permille: 1000}} {
+		for i := 0; i < 100; i++ {
+			queryid := queryIdentifier(fmt.Sprintf("q=query%d&literal=1", i))
+			if got, want := e.includes(queryid), e.permille > 0; got != want {
+				t.Errorf("experiment %q: includes(%s) = %v, want %v", e.id, queryid, got, want)
+			}
+		}
+	}
+}
+
+func TestQueryExperiments(t *testing.T) {
+	defer useFakeBackends(t, newFakeBackend("i3-wm_4.8-1/i3bar/src/main.c"))()
+	oldExperiments := experiments
+	defer func() { experiments = oldExperiments }()
+	experiments = []experiment{
+		{id: "pathweight", permille: 1000, params: url.Values{"pathweight": {"1"}}},
+		{id: "never", permille: 0, params: url.Values{"weighted": {"0"}}},
+	}
+
+	queryid, cleanup := runQuery(t, "q=main&literal=1")
+	defer cleanup()
+	s := waitDone(t, queryid)
+	if got, want := s.experiments, []string{"pathweight"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("experiments = %v, want %v", got, want)
+	}
+	if !s.inExperiment("pathweight") || s.inExperiment("never") {
+		t.Errorf("inExperiment(pathweight) = %v, inExperiment(never) = %v, want true, false", s.inExperiment("pathweight"), s.inExperiment("never"))
+	}
+	rewritten, err := url.Parse(s.rewrittenQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rewritten.Query().Get("pathweight"), "1"; got != want {
+		t.Errorf("rewritten query %q: pathweight = %q, want %q", s.rewrittenQuery, got, want)
+	}
+	if _, ok := rewritten.Query()["weighted"]; ok {
+		t.Errorf("rewritten query %q unexpectedly contains weighted", s.rewrittenQuery)
+	}
+
+	var progress *ProgressUpdate
+	for _, ev := range s.events {
+		var p ProgressUpdate
+		if err := json.Unmarshal(ev.data, &p); err == nil && p.Type == eventTypeProgress {
+			progress = &p
+		}
+	}
+	if progress == nil {
+		t.Fatalf("no progress event found")
+	}
+	if got, want := progress.Experiments, []string{"pathweight"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("progress event experiments = %v, want %v", got, want)
+	}
+}
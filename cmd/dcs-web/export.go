@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sync"
+
+	"github.com/Debian/dcs/cmd/dcs-web/search"
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/google/renameio"
+)
+
+var (
+	exportPartResults = flag.Int("export_part_results",
+		10000,
+		"Number of results per part file of a full result export (see /results/<queryid>/export/manifest.json)")
+
+	exportWorkers = flag.Int("export_workers",
+		0,
+		"Number of goroutines writing the part files of a full result export. 0 uses GOMAXPROCS, 1 writes the part files one after the other")
+
+	exportPathRe = regexp.MustCompile(`^/results/([^/]+)/export/(manifest.json|part_[0-9]+.ndjson)$`)
+
+	// exportMu serializes writing the exports of the same query, so that
+	// concurrent requests for the same (large) export do not all write it.
+	// Exports of different queries are written concurrently.
+	exportMu   = make(map[string]*exportLock)
+	exportMuMu sync.Mutex
+)
+
+type exportLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockExport locks the exports of the specified query and returns a function
+// to unlock them. Locks are removed once nobody holds or waits for them.
+func lockExport(queryid string) func() {
+	exportMuMu.Lock()
+	mu, ok := exportMu[queryid]
+	if !ok {
+		mu = &exportLock{}
+		exportMu[queryid] = mu
+	}
+	mu.refs++
+	exportMuMu.Unlock()
+	mu.Lock()
+	return func() {
+		mu.Unlock()
+		exportMuMu.Lock()
+		defer exportMuMu.Unlock()
+		mu.refs--
+		if mu.refs == 0 {
+			delete(exportMu, queryid)
+		}
+	}
+}
+
+type exportPart struct {
+	Name    string
+	Results int
+	Size    int64
+	SHA256  string
+}
+
+// exportManifest lists the part files of a full result export. Each part file
+// contains one JSON-encoded match per line, so the parts can be downloaded
+// independently (and resumed using HTTP Range requests) and then
+// concatenated.
+//
+// When requested with filter=…, the export only contains the results matching
+// the filter expression (see search.Filter). The same filter= parameter must
+// be specified when requesting the part files.
+type exportManifest struct {
+	QueryId string
+	Filter  string `json:",omitempty"`
+	Results int
+	Parts   []exportPart
+}
+
+func writeExportPart(path string, queryid string, pointers []resultPointer, filter *search.Filter) (exportPart, error) {
+	part := exportPart{
+		Name: filepath.Base(path),
+	}
+	f, err := renameio.TempFile(filepath.Dir(path), path)
+	if err != nil {
+		return part, err
+	}
+	defer f.Cleanup()
+	h := sha256.New()
+	w := io.MultiWriter(f, h)
+	err = forEachMatch(queryid, pointers, func(idx int, match *sourcebackendpb.Match) error {
+		if filter != nil && !filter.Matches(match) {
+			return nil
+		}
+		part.Results++
+		if err := WriteMatchJSON(match, w); err != nil {
+			return err
+		}
+		_, err := w.Write([]byte("\n"))
+		return err
+	})
+	if err != nil {
+		return part, err
+	}
+	if part.Size, err = f.Seek(0, io.SeekCurrent); err != nil {
+		return part, err
+	}
+	part.SHA256 = fmt.Sprintf("%x", h.Sum(nil))
+	return part, f.CloseAtomicallyReplace()
+}
+
+// exportDir returns the directory containing the export of the specified
+// query. Filtered exports are stored separately for each filter expression.
+func exportDir(queryid, filter string) string {
+	if filter == "" {
+		return filepath.Join(*queryResultsPath, queryid, "export")
+	}
+	return filepath.Join(*queryResultsPath, queryid, fmt.Sprintf("export-%x", sha256.Sum256([]byte(filter))))
+}
+
+// ensureExport writes the export for the specified (completed) query, unless
+// it was already written.
+func ensureExport(queryid string, s queryState, filter string) error {
+	defer lockExport(queryid)()
+
+	dir := exportDir(queryid, filter)
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	ensureEnoughSpaceAvailable()
+
+	var parsed *search.Filter
+	if filter != "" {
+		var err error
+		if parsed, err = search.ParseFilter(filter); err != nil {
+			return err
+		}
+	}
+
+	// The part files are written by up to -export_workers goroutines. The
+	// results storage is read using ReadAt (or equivalent, see
+	// resultsStorage), so the workers do not share any file offsets.
+	var chunks [][]resultPointer
+	for pointers := s.resultPointers; len(pointers) > 0; {
+		n := *exportPartResults
+		if n > len(pointers) {
+			n = len(pointers)
+		}
+		chunks = append(chunks, pointers[:n])
+		pointers = pointers[n:]
+	}
+	workers := *exportWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	parts := make([]exportPart, len(chunks))
+	errs := make([]error, len(chunks))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for idx, chunk := range chunks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int, chunk []resultPointer) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			path := filepath.Join(dir, fmt.Sprintf("part_%d.ndjson", idx))
+			parts[idx], errs[idx] = writeExportPart(path, queryid, chunk, parsed)
+		}(idx, chunk)
+	}
+	wg.Wait()
+
+	manifest := exportManifest{
+		QueryId: queryid,
+		Filter:  filter,
+		Parts:   parts,
+	}
+	for idx, part := range parts {
+		if errs[idx] != nil {
+			return errs[idx]
+		}
+		manifest.Results += part.Results
+	}
+
+	// The manifest is written last: its existence marks the export complete.
+	b, err := json.Marshal(&manifest)
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(filepath.Join(dir, "manifest.json"), b, 0644)
+}
+
+// serveExport serves /results/<queryid>/export/manifest.json and the part
+// files it lists. Part files are served using http.ServeFile, which handles
+// Range and If-Range requests.
+func serveExport(w http.ResponseWriter, r *http.Request, queryid, name string) {
+	if *exportPartResults < 1 {
+		http.Error(w, "-export_part_results must be positive", http.StatusInternalServerError)
+		return
+	}
+	filter := r.FormValue("filter")
+	if filter != "" {
+		if _, err := search.ParseFilter(filter); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	s, msg, code := completedQuery(queryid)
+	if code != http.StatusOK {
+		http.Error(w, msg, code)
+		return
+	}
+	if err := ensureExport(queryid, s, filter); err != nil {
+		log.Printf("[%s] could not export results: %v\n", queryid, err)
+		http.Error(w, "Could not export results", http.StatusInternalServerError)
+		return
+	}
+	if filepath.Ext(name) == ".ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeFile(w, r, filepath.Join(exportDir(queryid, filter), name))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+func TestEnsureExportParallel(t *testing.T) {
+	defer useFakeBackends(t, newFakeBackend(
+		"i3-wm_4.8-1/i3bar/src/main.c",
+		"i3-wm_4.8-1/src/main.c",
+		"dcs_0.1-1/cmd/dcs-web/dcs-web.go",
+		"zsh_5.0-1/Src/main.c"))()
+	oldResults, oldWorkers := *exportPartResults, *exportWorkers
+	*exportPartResults, *exportWorkers = 1, 2
+	defer func() { *exportPartResults, *exportWorkers = oldResults, oldWorkers }()
+
+	queryid, cleanup := runQuery(t, "q=main&literal=1")
+	defer cleanup()
+	s := waitDone(t, queryid)
+	if err := ensureExport(queryid, s, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := exportDir(queryid, "")
+	b, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest exportManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(manifest.Parts), len(s.resultPointers); got != want {
+		t.Fatalf("len(Parts) = %d, want %d", got, want)
+	}
+	if got, want := manifest.Results, len(s.resultPointers); got != want {
+		t.Errorf("Results = %d, want %d", got, want)
+	}
+
+	// Each part file holds the results in the order of the result pointers,
+	// regardless of which worker wrote it.
+	err = forEachMatch(queryid, s.resultPointers, func(idx int, match *sourcebackendpb.Match) error {
+		part := manifest.Parts[idx]
+		if got, want := part.Name, fmt.Sprintf("part_%d.ndjson", idx); got != want {
+			return fmt.Errorf("Parts[%d].Name = %q, want %q", idx, got, want)
+		}
+		var want bytes.Buffer
+		if err := WriteMatchJSON(match, &want); err != nil {
+			return err
+		}
+		want.WriteString("\n")
+		got, err := ioutil.ReadFile(filepath.Join(dir, part.Name))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want.Bytes()) {
+			return fmt.Errorf("%s = %q, want %q", part.Name, got, want.String())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
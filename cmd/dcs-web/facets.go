@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+var facetsPathRe = regexp.MustCompile(`^/results/([^/]+)/facets.json$`)
+
+// facetCounts holds the number of results per package (without version),
+// per file extension (e.g. “.c”, empty for files without extension) and per
+// top-level directory within the source package (e.g. “src”, “/” for files
+// in the package root). This allows clients to offer drill-down filters
+// without starting another query.
+type facetCounts struct {
+	Packages    map[string]int
+	Extensions  map[string]int
+	Directories map[string]int
+}
+
+func newFacetCounts() facetCounts {
+	return facetCounts{
+		Packages:    make(map[string]int),
+		Extensions:  make(map[string]int),
+		Directories: make(map[string]int),
+	}
+}
+
+func (f facetCounts) add(match *sourcebackendpb.Match) {
+	pkg := match.Package
+	if idx := strings.Index(pkg, "_"); idx > -1 {
+		pkg = pkg[:idx]
+	}
+	f.Packages[pkg]++
+	f.Extensions[strings.ToLower(path.Ext(match.Path))]++
+	dir := "/"
+	if rel := strings.SplitN(match.Path, "/", 3); len(rel) == 3 {
+		dir = rel[1]
+	}
+	f.Directories[dir]++
+}
+
+func (f facetCounts) merge(other facetCounts) {
+	for k, v := range other.Packages {
+		f.Packages[k] += v
+	}
+	for k, v := range other.Extensions {
+		f.Extensions[k] += v
+	}
+	for k, v := range other.Directories {
+		f.Directories[k] += v
+	}
+}
+
+// Facets is sent to clients once all results are in.
+type Facets struct {
+	// Set to “facets”.
+	Type    string
+	QueryId string
+	facetCounts
+}
+
+func sendFacetsUpdate(queryid string, s queryState) {
+	addEventMarshal(queryid, &Facets{
+		Type:        eventTypeFacets,
+		QueryId:     queryid,
+		facetCounts: s.facets,
+	})
+}
+
+// serveFacets serves /results/<queryid>/facets.json.
+func serveFacets(w http.ResponseWriter, r *http.Request, queryid string) {
+	stateMu.RLock()
+	s, ok := state[queryid]
+	stateMu.RUnlock()
+	if !ok {
+		http.Error(w, "No such query.", http.StatusNotFound)
+		return
+	}
+	if !s.done {
+		http.Error(w, "Query not finished yet.", http.StatusInternalServerError)
+		return
+	}
+	startJsonResponse(w)
+	if err := json.NewEncoder(w).Encode(&Facets{
+		Type:        eventTypeFacets,
+		QueryId:     queryid,
+		facetCounts: s.facets,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
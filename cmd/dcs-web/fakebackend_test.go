@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/internal/faultinject"
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/Debian/dcs/internal/rpctest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeBackend is a source backend which replies to every query with a canned
+// stream of replies, see newFakeBackend. Only Search and TrigramStats are
+// implemented.
+type fakeBackend struct {
+	sourcebackendpb.SourceBackendServer
+
+	replies []*sourcebackendpb.SearchReply
+
+	// failAfter, if non-zero, makes Search fail after sending this many
+	// replies.
+	failAfter int
+
+	// stall makes Search wait until it is cancelled after sending all
+	// replies.
+	stall bool
+}
+
+// newFakeBackend returns a fakeBackend which finds one match in each of the
+// specified files (e.g. “i3-wm_4.8-1/i3bar/src/main.c”), ranked in the
+// specified order, with a progress update after each match.
+func newFakeBackend(paths ...string) *fakeBackend {
+	var replies []*sourcebackendpb.SearchReply
+	for idx, path := range paths {
+		ranking := 1 - float32(idx)/float32(len(paths))
+		replies = append(replies, &sourcebackendpb.SearchReply{
+			Type: sourcebackendpb.SearchReply_MATCH,
+			Match: &sourcebackendpb.Match{
+				Path:     path,
+				Line:     uint32(idx + 1),
+				Ctxp2:    "#include <stdio.h>",
+				Context:  "int main(int argc, char *argv[]) {",
+				Ctxn1:    "    return 0;",
+				Ctxn2:    "}",
+				Pathrank: ranking,
+				Ranking:  ranking,
+			},
+		}, &sourcebackendpb.SearchReply{
+			Type: sourcebackendpb.SearchReply_PROGRESS_UPDATE,
+			ProgressUpdate: &sourcebackendpb.ProgressUpdate{
+				FilesProcessed: uint64(idx + 1),
+				FilesTotal:     uint64(len(paths)),
+			},
+		})
+	}
+	if len(paths) == 0 {
+		replies = append(replies, &sourcebackendpb.SearchReply{
+			Type:           sourcebackendpb.SearchReply_PROGRESS_UPDATE,
+			ProgressUpdate: &sourcebackendpb.ProgressUpdate{},
+		})
+	}
+	return &fakeBackend{replies: replies}
+}
+
+func (b *fakeBackend) Search(req *sourcebackendpb.SearchRequest, stream sourcebackendpb.SourceBackend_SearchServer) error {
+	for idx, reply := range b.replies {
+		if b.failAfter > 0 && idx == b.failAfter {
+			return status.Error(codes.Internal, "index corrupt")
+		}
+		if err := stream.Send(reply); err != nil {
+			return err
+		}
+	}
+	if b.stall {
+		<-stream.Context().Done()
+		return stream.Context().Err()
+	}
+	return nil
+}
+
+func (b *fakeBackend) TrigramStats(context.Context, *sourcebackendpb.TrigramStatsRequest) (*sourcebackendpb.TrigramStatsReply, error) {
+	// Makes planQuery skip the query plan, like older source backends.
+	return nil, status.Error(codes.Unimplemented, "not implemented by fakeBackend")
+}
+
+// dial returns a client connected to b over a loopback gRPC connection which
+// injects faults, and a function to close the connection.
+func (b *fakeBackend) dial(faults faultinject.Faults) (sourcebackendpb.SourceBackendClient, func()) {
+	conn, cleanup := rpctest.LoopbackConn(func(s *grpc.Server) {
+		sourcebackendpb.RegisterSourceBackendServer(s, b)
+	}, faults.Conn)
+	return sourcebackendpb.NewSourceBackendClient(conn), cleanup
+}
+
+// useFakeBackends makes queries use the specified source backends and store
+// their results in a temporary -query_results_path. The returned function
+// restores the previous configuration.
+func useFakeBackends(t *testing.T, backends ...*fakeBackend) func() {
+	dir, err := ioutil.TempDir("", "dcs-fakebackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPath, oldStore, oldStubs := *queryResultsPath, store, common.SourceBackendStubs
+	*queryResultsPath, store = dir, fileStore{}
+	var cleanups []func()
+	common.SourceBackendStubs = nil
+	for _, b := range backends {
+		stub, cleanup := b.dial(faultinject.Faults{})
+		common.SourceBackendStubs = append(common.SourceBackendStubs, stub)
+		cleanups = append(cleanups, cleanup)
+	}
+	return func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+		*queryResultsPath, store, common.SourceBackendStubs = oldPath, oldStore, oldStubs
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	federationPeersList = flag.String("federation_peers",
+		"",
+		"Comma-separated list of name=base URL pairs (e.g. snapshot-2015=https://dcs-2015.example.net) of remote dcs-web instances, e.g. one per archive snapshot or organization. Queries are additionally sent to each of them, and their results are merged into the local results, tagged with the peer’s name. Empty disables federation")
+	federationName = flag.String("federation_name",
+		"",
+		"Name of this cluster, used to tag local results when federation (see -federation_peers) is enabled")
+
+	federationQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "federation_queries",
+			Help: "Queries sent to federation peers, by peer and outcome (ok or failed).",
+		},
+		[]string{"peer", "outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(federationQueries)
+}
+
+type federationPeer struct {
+	name string
+	url  string
+}
+
+var (
+	federationPeersOnce sync.Once
+	federationPeers     []federationPeer
+)
+
+func parseFederationPeers() []federationPeer {
+	federationPeersOnce.Do(func() {
+		for _, entry := range strings.Split(*federationPeersList, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			idx := strings.Index(entry, "=")
+			if idx == -1 {
+				log.Fatalf("Invalid -federation_peers entry %q: expected name=url", entry)
+			}
+			name, base := entry[:idx], entry[idx+1:]
+			if _, err := url.Parse(base); err != nil {
+				log.Fatalf("Invalid -federation_peers entry %q: %v", entry, err)
+			}
+			federationPeers = append(federationPeers, federationPeer{
+				name: name,
+				url:  strings.TrimSuffix(base, "/"),
+			})
+		}
+	})
+	return federationPeers
+}
+
+// federationPeersFor returns the federation peers to which the query should
+// be sent. Queries received from a federation peer (federated=1) are not
+// federated again, which prevents loops. Queries started with count=1 are
+// answered locally only, as federation peers only provide matches.
+func federationPeersFor(query string) []federationPeer {
+	values, err := url.ParseQuery(query)
+	if err != nil || values.Get("federated") == "1" || values.Get("count") == "1" {
+		return nil
+	}
+	return parseFederationPeers()
+}
+
+// federationEvent contains the fields of the events of a federation peer
+// which queryFederationPeer needs. Matches (which do not have a Type) are
+// ignored, as the full results are fetched from the peer’s export.
+type federationEvent struct {
+	Type           string
+	QueryId        string
+	FilesProcessed int
+	FilesTotal     int
+	ErrorType      string
+}
+
+func federationGet(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := common.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: unexpected HTTP status: %v", u, resp.Status)
+	}
+	return resp, nil
+}
+
+// queryFederationPeer sends the query to the federation peer, which is
+// treated like an additional source backend: its progress is merged into the
+// query’s progress and, once the peer finished the query, its results are
+// imported from its export (see serveExport).
+func queryFederationPeer(ctx context.Context, queryid string, peer federationPeer, backendidx int, query string) {
+	outcome := "failed"
+	defer func() {
+		federationQueries.WithLabelValues(peer.name, outcome).Inc()
+		finishBackend(ctx, ctx, false, queryid, backendidx)
+	}()
+
+	u := peer.url + "/events/?" + query + "&federated=1"
+	stateMu.RLock()
+	if priority := state[queryid].priority; priority != priorityInteractive {
+		u += "&priority=" + priority.String()
+	}
+	stateMu.RUnlock()
+	resp, err := federationGet(ctx, u)
+	if err != nil {
+		log.Printf("[%s] [peer:%s] %v\n", queryid, peer.name, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	sink := newReplySink(queryid, backendidx)
+	var (
+		final    *sourcebackendpb.SearchReply
+		remoteid string
+	)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, []byte("data: ")) {
+			continue
+		}
+		var ev federationEvent
+		if err := json.Unmarshal(line[len("data: "):], &ev); err != nil {
+			log.Printf("[%s] [peer:%s] invalid event: %v\n", queryid, peer.name, err)
+			continue
+		}
+		switch ev.Type {
+		case eventTypeError:
+			log.Printf("[%s] [peer:%s] error: %s\n", queryid, peer.name, ev.ErrorType)
+		case eventTypeProgress:
+			progress := &sourcebackendpb.SearchReply{
+				Type: sourcebackendpb.SearchReply_PROGRESS_UPDATE,
+				ProgressUpdate: &sourcebackendpb.ProgressUpdate{
+					FilesProcessed: uint64(ev.FilesProcessed),
+					FilesTotal:     uint64(ev.FilesTotal),
+				},
+			}
+			if ev.FilesProcessed == ev.FilesTotal {
+				// Stored after the results were imported, as it might
+				// finish the query.
+				final, remoteid = progress, ev.QueryId
+				continue
+			}
+			if err := sink.store(progress); err != nil {
+				log.Printf("[%s] [peer:%s] %v\n", queryid, peer.name, err)
+				return
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("[%s] [peer:%s] Error reading events: %v\n", queryid, peer.name, err)
+		return
+	}
+	// The event stream ends once the query is done on the peer, so that its
+	// export is available now.
+	if final == nil {
+		log.Printf("[%s] [peer:%s] events ended before the query was done\n", queryid, peer.name)
+		return
+	}
+	if err := importFederatedResults(ctx, sink, peer, remoteid); err != nil {
+		log.Printf("[%s] [peer:%s] could not import results: %v\n", queryid, peer.name, err)
+		return
+	}
+	if err := sink.store(final); err != nil {
+		log.Printf("[%s] [peer:%s] %v\n", queryid, peer.name, err)
+		return
+	}
+	outcome = "ok"
+	log.Printf("[%s] [peer:%s] query done, disconnecting\n", queryid, peer.name)
+}
+
+// importFederatedResults stores all results of the (finished) query remoteid
+// of the federation peer, tagged with the peer’s name.
+func importFederatedResults(ctx context.Context, sink *replySink, peer federationPeer, remoteid string) error {
+	base := peer.url + "/results/" + url.PathEscape(remoteid) + "/export/"
+	resp, err := federationGet(ctx, base+"manifest.json")
+	if err != nil {
+		return err
+	}
+	var manifest exportManifest
+	err = json.NewDecoder(resp.Body).Decode(&manifest)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, part := range manifest.Parts {
+		if err := importFederatedPart(ctx, sink, peer, base+url.PathEscape(part.Name)); err != nil {
+			return err
+		}
+		if queryTruncated(sink.queryid) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func importFederatedPart(ctx context.Context, sink *replySink, peer federationPeer, u string) error {
+	resp, err := federationGet(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var match sourcebackendpb.Match
+		if err := dec.Decode(&match); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// Exported rankings are final (see forEachMatch). Storing them as
+		// the path ranking, with a zero post-ranking, preserves them when
+		// the ranking is combined locally.
+		match.Pathrank = match.Ranking
+		match.Ranking = 0
+		match.Origin = peer.name
+		if err := sink.store(&sourcebackendpb.SearchReply{
+			Type:  sourcebackendpb.SearchReply_MATCH,
+			Match: &match,
+		}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/cmd/dcs-web/i18n"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	gcPolicyName = flag.String("gc_policy",
+		"lru",
+		"Which queries are evicted from memory (see -max_queries_in_memory) and whose results are deleted from -query_results_path when the file system runs out of space (see -headroom_percentage) first: “lru” (least recently accessed first) or “size” (largest results first, weighted by the time since the last access). Queries which are running or in use are never evicted")
+
+	resultsRetention = flag.Duration("results_retention",
+		24*time.Hour,
+		"How long the results of a query are kept in -query_results_path after the query started. Older results are deleted even if enough disk space is available, and the download links of pagination events expire at the same time. Results may be deleted earlier to keep -headroom_percentage free (see -gc_policy)")
+
+	deletedQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queries_deleted",
+			Help: "Number of queries whose results were deleted from -query_results_path to keep -headroom_percentage free, by -gc_policy (or “retention” for results older than -results_retention).",
+		},
+		[]string{"policy"})
+
+	deletedQueryBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queries_deleted_bytes",
+			Help: "Size of the results which were deleted from -query_results_path to keep -headroom_percentage free, by -gc_policy (or “retention” for results older than -results_retention).",
+		},
+		[]string{"policy"})
+)
+
+func init() {
+	prometheus.MustRegister(deletedQueries)
+	prometheus.MustRegister(deletedQueryBytes)
+}
+
+// gcCandidate is a query which can be evicted from memory or whose results
+// can be deleted.
+type gcCandidate struct {
+	QueryId    string
+	LastAccess time.Time
+
+	// Modified is when the query’s directory in -query_results_path was
+	// last modified, i.e. not before the query started.
+	Modified time.Time
+
+	// Bytes is the size of the query’s results.
+	Bytes int64
+}
+
+// gcPolicy decides which queries are evicted first, see -gc_policy.
+type gcPolicy interface {
+	// order sorts candidates, which are evicted in that order.
+	order(candidates []gcCandidate, now time.Time)
+}
+
+// lruPolicy evicts the least recently accessed query first.
+type lruPolicy struct{}
+
+func (lruPolicy) order(candidates []gcCandidate, now time.Time) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].LastAccess.Before(candidates[j].LastAccess)
+	})
+}
+
+// sizePolicy evicts the query with the highest size × time since the last
+// access first, i.e. large results are evicted before small results of the
+// same age.
+type sizePolicy struct{}
+
+func (sizePolicy) order(candidates []gcCandidate, now time.Time) {
+	weight := func(c gcCandidate) float64 {
+		return float64(c.Bytes) * now.Sub(c.LastAccess).Seconds()
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return weight(candidates[i]) > weight(candidates[j])
+	})
+}
+
+var gcPolicies = map[string]gcPolicy{
+	"lru":  lruPolicy{},
+	"size": sizePolicy{},
+}
+
+// currentGCPolicy returns the policy selected by -gc_policy, falling back to
+// lru for unknown names (see checkGCPolicy).
+func currentGCPolicy() gcPolicy {
+	if p, ok := gcPolicies[*gcPolicyName]; ok {
+		return p
+	}
+	return lruPolicy{}
+}
+
+// checkGCPolicy verifies -gc_policy.
+func checkGCPolicy() error {
+	if _, ok := gcPolicies[*gcPolicyName]; !ok {
+		return fmt.Errorf("unknown -gc_policy %q, expected one of lru or size", *gcPolicyName)
+	}
+	return nil
+}
+
+// dirBytes returns the size of all files within dir.
+func dirBytes(dir string) int64 {
+	var total int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// diskGCCandidates returns the queries in -query_results_path whose results
+// can be deleted, in the order of the policy. Queries which are running or
+// pinned (see pinQuery) are exempt.
+func diskGCCandidates(policy gcPolicy) ([]gcCandidate, error) {
+	dir, err := os.Open(*queryResultsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	infos, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []gcCandidate
+	stateMu.RLock()
+	usage.mu.Lock()
+	for _, info := range infos {
+		queryid := info.Name()
+		if !info.IsDir() || queryid == bookmarksDir || queryid == feedsDir {
+			continue
+		}
+		if s, ok := state[queryid]; (ok && !s.done) || usage.refs[queryid] > 0 {
+			continue
+		}
+		lastAccess := info.ModTime()
+		if t, ok := usage.lastAccess[queryid]; ok && t.After(lastAccess) {
+			lastAccess = t
+		}
+		candidates = append(candidates, gcCandidate{
+			QueryId:    queryid,
+			LastAccess: lastAccess,
+			Modified:   info.ModTime(),
+		})
+	}
+	usage.mu.Unlock()
+	stateMu.RUnlock()
+	for idx, c := range candidates {
+		candidates[idx].Bytes = dirBytes(filepath.Join(*queryResultsPath, c.QueryId))
+	}
+	policy.order(candidates, time.Now())
+	return candidates, nil
+}
+
+// resultsGCInterval is how often results older than -results_retention are
+// deleted.
+const resultsGCInterval = 10 * time.Minute
+
+// expiredCandidates returns the candidates whose results are older than
+// -results_retention, i.e. whose download links expired (see downloadExpiry).
+func expiredCandidates(candidates []gcCandidate, now time.Time) []gcCandidate {
+	var expired []gcCandidate
+	for _, c := range candidates {
+		if !now.Before(downloadExpiry(c.Modified)) {
+			expired = append(expired, c)
+		}
+	}
+	return expired
+}
+
+// deleteExpiredResults deletes the results which are older than
+// -results_retention.
+func deleteExpiredResults() {
+	candidates, err := diskGCCandidates(currentGCPolicy())
+	if err != nil {
+		log.Printf("Could not list query results: %v\n", err)
+		return
+	}
+	for _, c := range expiredCandidates(candidates, time.Now()) {
+		log.Printf("Removing query results for %q, last modified %v ago (-results_retention=%v)\n", c.QueryId, time.Since(c.Modified), *resultsRetention)
+		if err := os.RemoveAll(filepath.Join(*queryResultsPath, c.QueryId)); err != nil {
+			log.Printf("Could not remove query results for %q: %v\n", c.QueryId, err)
+			continue
+		}
+		deletedQueries.WithLabelValues("retention").Inc()
+		deletedQueryBytes.WithLabelValues("retention").Add(float64(c.Bytes))
+	}
+}
+
+// startResultsGC deletes results older than -results_retention every
+// resultsGCInterval.
+func startResultsGC() {
+	if *resultsRetention <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(resultsGCInterval) {
+			deleteExpiredResults()
+		}
+	}()
+}
+
+// headroomMissing returns how many bytes need to be freed in
+// -query_results_path to keep -headroom_percentage free.
+func headroomMissing() int64 {
+	available, total := fsBytes(*queryResultsPath)
+	headroom := uint64(*headroomPercentage * float64(total))
+	if available >= headroom {
+		return 0
+	}
+	return int64(headroom - available)
+}
+
+// gcPlan returns the candidates whose results would be deleted to free
+// missing bytes, assuming that deleting a query frees its Bytes.
+func gcPlan(candidates []gcCandidate, missing int64) []gcCandidate {
+	var freed int64
+	for idx, c := range candidates {
+		if freed >= missing {
+			return candidates[:idx]
+		}
+		freed += c.Bytes
+	}
+	return candidates
+}
+
+// GCStatus is the dry-run preview served on /gcz.
+type GCStatus struct {
+	Policy string
+
+	// MissingBytes is how many bytes need to be freed to keep
+	// -headroom_percentage free.
+	MissingBytes int64
+
+	// Delete are the queries whose results would be deleted right now.
+	Delete []gcCandidate
+
+	// Expired are the queries whose results are older than
+	// -results_retention, which are deleted regardless of MissingBytes.
+	Expired []gcCandidate
+
+	// Candidates are all queries whose results can be deleted, in the order
+	// of the policy.
+	Candidates []gcCandidate
+}
+
+// GCHandler serves /gcz, which previews which query results would be deleted
+// (see ensureEnoughSpaceAvailable) without deleting anything. The policy can
+// be overridden using the policy parameter to compare policies.
+func GCHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("policy")
+	if name == "" {
+		name = *gcPolicyName
+	}
+	policy, ok := gcPolicies[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown policy %q.", name), http.StatusBadRequest)
+		return
+	}
+	candidates, err := diskGCCandidates(policy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	status := GCStatus{
+		Policy:       name,
+		MissingBytes: headroomMissing(),
+		Candidates:   candidates,
+	}
+	if status.MissingBytes > 0 {
+		status.Delete = gcPlan(candidates, status.MissingBytes)
+	}
+	if *resultsRetention > 0 {
+		status.Expired = expiredCandidates(candidates, time.Now())
+	}
+
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Printf("Could not write /gcz reply: %v\n", err)
+		}
+		return
+	}
+
+	if err := common.Templates.ExecuteTemplate(w, "gcz.html", map[string]interface{}{
+		"gcz":      status,
+		"policies": []string{"lru", "size"},
+		"i18n":     i18n.FromRequest(r),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func candidateIds(candidates []gcCandidate) []string {
+	ids := make([]string, len(candidates))
+	for idx, c := range candidates {
+		ids[idx] = c.QueryId
+	}
+	return ids
+}
+
+func TestGCPolicies(t *testing.T) {
+	now := time.Now()
+	candidates := []gcCandidate{
+		{QueryId: "recent-large", LastAccess: now.Add(-1 * time.Hour), Bytes: 100 << 20},
+		{QueryId: "old-small", LastAccess: now.Add(-10 * time.Hour), Bytes: 1 << 20},
+		{QueryId: "medium", LastAccess: now.Add(-5 * time.Hour), Bytes: 10 << 20},
+	}
+	for _, tt := range []struct {
+		policy string
+		want   []string
+	}{
+		{"lru", []string{"old-small", "medium", "recent-large"}},
+		{"size", []string{"recent-large", "medium", "old-small"}},
+	} {
+		ordered := append([]gcCandidate(nil), candidates...)
+		gcPolicies[tt.policy].order(ordered, now)
+		if got := candidateIds(ordered); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("policy %s: got %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestGCPlan(t *testing.T) {
+	candidates := []gcCandidate{
+		{QueryId: "a", Bytes: 10},
+		{QueryId: "b", Bytes: 20},
+		{QueryId: "c", Bytes: 30},
+	}
+	for _, tt := range []struct {
+		missing int64
+		want    []string
+	}{
+		{1, []string{"a"}},
+		{10, []string{"a"}},
+		{11, []string{"a", "b"}},
+		{100, []string{"a", "b", "c"}},
+	} {
+		if got := candidateIds(gcPlan(candidates, tt.missing)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("gcPlan(%d) = %v, want %v", tt.missing, got, tt.want)
+		}
+	}
+}
+
+func TestExpiredCandidates(t *testing.T) {
+	now := time.Now()
+	candidates := []gcCandidate{
+		{QueryId: "old", Modified: now.Add(-*resultsRetention - time.Minute)},
+		// Recently accessed results expire nevertheless, like their
+		// download links.
+		{QueryId: "old-accessed", Modified: now.Add(-*resultsRetention - time.Minute), LastAccess: now},
+		{QueryId: "recent", Modified: now.Add(-time.Minute)},
+	}
+	got := candidateIds(expiredCandidates(candidates, now))
+	if want := []string{"old", "old-accessed"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expiredCandidates() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,155 @@
+// Localized formatting of numbers, durations and dates, and translation of
+// messages in the HTML templates, so that deployments can localize the web
+// interface.
+//
+// Templates receive a *Localizer as .i18n, e.g.:
+//
+//	{{ .i18n.T "Filter by package:" }}
+//	{{ .i18n.T "%d results in %d packages" .numresults .numpackages }}
+//	{{ .i18n.Count .NumResults }} {{ .i18n.Duration .Duration }} {{ .i18n.Date .Started }}
+//
+// Translations are read from -translations_dir, which contains one JSON file
+// per language, named after its BCP 47 tag (e.g. de.json, pt-BR.json), mapping
+// the English messages to their translation:
+//
+//	{"Filter by package:": "Nach Paket filtern:"}
+//
+// The date layout (see Localizer.Date) is translated like a message.
+package i18n
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/message/catalog"
+	"golang.org/x/text/number"
+)
+
+var translationsDir = flag.String("translations_dir",
+	"",
+	"Directory containing translations of the web interface as <language>.json files (e.g. de.json), see cmd/dcs-web/i18n. Disabled if empty")
+
+// dateLayout is the default layout of Localizer.Date, see time.Format.
+const dateLayout = "2006-01-02 15:04:05 MST"
+
+var (
+	cat       = catalog.NewBuilder(catalog.Fallback(language.English))
+	supported = []language.Tag{language.English}
+	matcher   = language.NewMatcher(supported)
+)
+
+// Init loads the translations from -translations_dir. Must be called after
+// flag.Parse().
+func Init() {
+	if *translationsDir == "" {
+		return
+	}
+	if err := loadTranslations(*translationsDir); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loadTranslations(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		tag, err := language.Parse(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return fmt.Errorf("%s: file name is not a language tag: %v", path, err)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(b, &messages); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		for key, msg := range messages {
+			if err := cat.SetString(tag, key, msg); err != nil {
+				return fmt.Errorf("%s: %q: %v", path, key, err)
+			}
+		}
+		if tag != language.English {
+			supported = append(supported, tag)
+		}
+		log.Printf("Loaded %d translations for %v\n", len(messages), tag)
+	}
+	matcher = language.NewMatcher(supported)
+	return nil
+}
+
+// A Localizer formats values and translates messages for one language.
+type Localizer struct {
+	Tag language.Tag
+	p   *message.Printer
+}
+
+// New returns a Localizer for the specified language.
+func New(tag language.Tag) *Localizer {
+	return &Localizer{
+		Tag: tag,
+		p:   message.NewPrinter(tag, message.Catalog(cat)),
+	}
+}
+
+// FromRequest returns a Localizer for the best supported language according
+// to the Accept-Language header of r.
+func FromRequest(r *http.Request) *Localizer {
+	tags, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if err != nil || len(tags) == 0 {
+		return New(language.English)
+	}
+	_, idx, _ := matcher.Match(tags...)
+	return New(supported[idx])
+}
+
+// Lang returns the language as BCP 47 tag, e.g. for the lang attribute of the
+// html element.
+func (l *Localizer) Lang() string {
+	return l.Tag.String()
+}
+
+// T translates msg, which is a format string for args (see fmt.Printf).
+func (l *Localizer) T(msg string, args ...interface{}) string {
+	return l.p.Sprintf(msg, args...)
+}
+
+// Count formats n using the language’s digit grouping, e.g. “12,345”.
+func (l *Localizer) Count(n int) string {
+	return l.p.Sprint(number.Decimal(n))
+}
+
+// Duration formats d in the largest fitting unit, e.g. “1.5 s” or “3 min”.
+func (l *Localizer) Duration(d time.Duration) string {
+	oneDecimal := number.MaxFractionDigits(1)
+	switch {
+	case d < time.Second:
+		return l.p.Sprintf("%v ms", number.Decimal(d.Seconds()*1000, number.MaxFractionDigits(0)))
+	case d < time.Minute:
+		return l.p.Sprintf("%v s", number.Decimal(d.Seconds(), oneDecimal))
+	case d < time.Hour:
+		return l.p.Sprintf("%v min", number.Decimal(d.Minutes(), oneDecimal))
+	default:
+		return l.p.Sprintf("%v h", number.Decimal(d.Hours(), oneDecimal))
+	}
+}
+
+// Date formats t using the (translatable) layout “2006-01-02 15:04:05 MST”.
+func (l *Localizer) Date(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(l.p.Sprintf(dateLayout))
+}
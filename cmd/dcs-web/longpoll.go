@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Some proxies break both EventSource (by buffering the response) and
+// WebSockets. Clients behind such proxies start their query using
+// /api/v1/query and then poll /api/v1/poll/<queryid>?since=<event id>, which
+// replies with the events after since as soon as there are any (or after
+// -longpoll_timeout), so that each request is short-lived.
+
+var longPollTimeout = flag.Duration("longpoll_timeout",
+	25*time.Second,
+	"How long a long-poll request (/api/v1/poll/<queryid>?since=) waits for new events before replying without events. Should be shorter than the request timeouts of proxies between clients and dcs-web")
+
+// LongPollReply is the reply to a long-poll request.
+type LongPollReply struct {
+	QueryId string
+
+	// Events are the events after since, in the format in which they are
+	// sent via /events (i.e. never batches).
+	Events []json.RawMessage
+
+	// LastEventId is the id of the last event the client received, to be
+	// sent as since= in the next request.
+	LastEventId string
+
+	// Done is set once the query is finished, i.e. no further events follow.
+	Done bool `json:",omitempty"`
+}
+
+// LongPollHandler serves /api/v1/poll/<queryid>?since=<event id>. since is
+// the id of the last event the client received (LastEventId of the previous
+// reply), or empty for the first request. Unlike since= on /events/ (see
+// resumeFrom), which resumes an event stream, each request returns at most
+// one batch of events.
+func LongPollHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	queryid := strings.TrimPrefix(r.URL.Path, "/api/v1/poll/")
+	if queryid == "" || strings.Contains(queryid, "/") || queryid == adminQueryId {
+		http.Error(w, "Invalid query id.", http.StatusBadRequest)
+		return
+	}
+	var requestedVersion int
+	if v := r.FormValue("v"); v != "" {
+		var err error
+		if requestedVersion, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "v must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	version, err := negotiateVersion(requestedVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkTenant(w, r, queryid) {
+		return
+	}
+	if proxyToOwner(w, r, queryid, LongPollHandler) {
+		return
+	}
+	if !queryExists(queryid) {
+		http.Error(w, "No such query.", http.StatusNotFound)
+		return
+	}
+
+	since := r.FormValue("since")
+	reply := LongPollReply{
+		QueryId:     queryid,
+		Events:      []json.RawMessage{},
+		LastEventId: since,
+	}
+	if staleEventId(since) {
+		// Like EventsHandler: the events the client received belong to a
+		// query run on an older index.
+		b, _ := json.Marshal(&Warning{
+			Type:        eventTypeWarning,
+			WarningType: "staleindex",
+		})
+		reply.Events = append(reply.Events, b)
+		reply.LastEventId = formatEventId(*indexGeneration, -1)
+		reply.Done = true
+		writeLongPollReply(w, &reply)
+		return
+	}
+
+	defer pinQuery(queryid)()
+	// Waiting counts as streaming the query’s events, so that the query is
+	// not abandoned (see -abandoned_query_grace) while the client polls.
+	defer watchSubscriber(ctx, queryid)()
+	lastseen := resumeFrom(queryid, since)
+	generation := queryGeneration(queryid)
+	if !waitEvent(ctx, queryid, lastseen, *longPollTimeout) {
+		reply.LastEventId = formatEventId(generation, lastseen)
+		writeLongPollReply(w, &reply)
+		return
+	}
+
+	release, err := queryTurn(ctx, queryid)
+	if err != nil {
+		log.Printf("[%s] aborting long poll, waiting for a turn: %v\n", queryid, err)
+		return
+	}
+	for _, message := range pendingEvents(queryid, lastseen) {
+		if len(message.data) == 0 {
+			reply.Done = true
+			break
+		}
+		lastseen = message.sequence
+		if *message.obsolete || supersededLater(queryid, message.sequence) {
+			continue
+		}
+		if !eventSupported(message.original, version) {
+			continue
+		}
+		data := message.data
+		if p, ok := message.original.(*Pagination); ok {
+			data = pushOrInline(w, queryid, p, data)
+		}
+		reply.Events = append(reply.Events, data)
+	}
+	release()
+	reply.LastEventId = formatEventId(generation, lastseen)
+	writeLongPollReply(w, &reply)
+}
+
+func writeLongPollReply(w http.ResponseWriter, reply *LongPollReply) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		log.Printf("[%s] could not write long poll reply: %v\n", reply.QueryId, err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestWaitEvent(t *testing.T) {
+	const queryid = "waitevent"
+	defer newTestQuery(queryid)()
+
+	if waitEvent(context.Background(), queryid, -1, 10*time.Millisecond) {
+		t.Fatalf("waitEvent() = true for a query without events")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		addEvent(queryid, []byte(`{"Type":"result"}`), nil)
+	}()
+	if !waitEvent(context.Background(), queryid, -1, 10*time.Second) {
+		t.Fatalf("waitEvent() = false, want true once an event was added")
+	}
+	if waitEvent(context.Background(), queryid, 0, 10*time.Millisecond) {
+		t.Fatalf("waitEvent() = true for a client which received all events")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	started := time.Now()
+	if waitEvent(ctx, queryid, 0, 10*time.Second) {
+		t.Fatalf("waitEvent() = true for a cancelled request")
+	}
+	if d := time.Since(started); d > 5*time.Second {
+		t.Errorf("waitEvent() returned after %v despite the cancelled request", d)
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	defer useFakeBackends(t, newFakeBackend(
+		"i3-wm_4.8-1/i3bar/src/main.c",
+		"zsh_5.8-1/Src/main.c"))()
+	queryid, cleanup := runQuery(t, "q=main&literal=1")
+	defer cleanup()
+
+	poll := func(since string) LongPollReply {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		LongPollHandler(rec, httptest.NewRequest("GET", "/api/v1/poll/"+queryid+"?v=4&since="+since, nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+		}
+		var reply LongPollReply
+		if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("%v (body: %s)", err, rec.Body.String())
+		}
+		return reply
+	}
+
+	reply := poll("")
+	if !reply.Done {
+		t.Errorf("Done = false for a finished query")
+	}
+	types := make(map[string]bool)
+	for _, ev := range reply.Events {
+		var typ struct{ Type string }
+		if err := json.Unmarshal(ev, &typ); err != nil {
+			t.Fatal(err)
+		}
+		types[typ.Type] = true
+	}
+	for _, typ := range []string{eventTypeProgress, eventTypePagination} {
+		if !types[typ] {
+			t.Errorf("no %s event in %s", typ, reply.Events)
+		}
+	}
+
+	// Clients which already received all events get the end of the query.
+	if reply := poll(reply.LastEventId); !reply.Done || len(reply.Events) != 0 {
+		t.Errorf("poll(%q) = %+v, want no events and Done", reply.LastEventId, reply)
+	}
+
+	rec := httptest.NewRecorder()
+	LongPollHandler(rec, httptest.NewRequest("GET", "/api/v1/poll/0123456789abcdef?since=", nil))
+	if got, want := rec.Code, http.StatusNotFound; got != want {
+		t.Errorf("unknown query: unexpected HTTP status: got %d, want %d", got, want)
+	}
+}
+
+// since= on /events/ resumes the event stream (see resumeFrom), it must not be
+// mistaken for a long-poll request.
+func TestEventsSinceStreams(t *testing.T) {
+	defer useFakeBackends(t, newFakeBackend(
+		"i3-wm_4.8-1/i3bar/src/main.c",
+		"zsh_5.8-1/Src/main.c"))()
+	queryid, cleanup := runQuery(t, "q=main&literal=1")
+	defer cleanup()
+	waitDone(t, queryid)
+
+	rec := httptest.NewRecorder()
+	EventsHandler(rec, httptest.NewRequest("GET", "/events/main?literal=1&since=0", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+	}
+	if got, want := rec.Header().Get("Content-Type"), "text/event-stream"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+	if !strings.Contains(rec.Body.String(), "data: ") {
+		t.Errorf("no server-sent events in %q", rec.Body.String())
+	}
+}
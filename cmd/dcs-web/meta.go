@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// metaTopFacets is the number of most frequent values per facet which are
+// included in QueryMeta.
+const metaTopFacets = 10
+
+// QueryMeta describes the results of a finished query, so that API clients do
+// not need to infer their structure from URL naming conventions. Served on
+// /api/v1/meta/<queryid>.
+type QueryMeta struct {
+	QueryId string
+
+	// Generation is the index generation (see -index_generation) the query
+	// was run on.
+	Generation int
+
+	CountOnly bool
+
+	// TotalResults is the number of results on all Pages, or the total
+	// number of matches for count-only queries.
+	TotalResults int
+
+	ResultsPerPage int
+	Pages          []MetaPage
+
+	// PackagesPerPage is the number of packages on each per-package page
+	// (see Packages), of which there are PerPackagePages.
+	PackagesPerPage int
+	PerPackagePages int
+
+	// Packages lists the packages in the order of the per-package pages.
+	// For count-only queries, packages are sorted by name.
+	Packages []MetaPackage
+
+	// Facets summarizes the facets (see Facets events) of the results.
+	// Unset for count-only queries.
+	Facets *MetaFacets `json:",omitempty"`
+}
+
+// MetaPage describes a page of results, i.e. results First to First+Count-1
+// (counting from 0).
+type MetaPage struct {
+	Page int
+
+	// URL is a signed download link to the page, see Downloads.
+	URL   string
+	First int
+	Count int
+}
+
+// MetaPackage describes the results within a package.
+type MetaPackage struct {
+	// Package is the source package name, without version.
+	Package string
+
+	// Results is the number of results (matches for count-only queries)
+	// within the package.
+	Results int
+
+	// Page is the per-package page listing the package, or -1 for
+	// count-only queries.
+	Page int
+}
+
+// MetaFacet summarizes a facet: how many distinct values it has, and which
+// are the most frequent (up to metaTopFacets, most frequent first).
+type MetaFacet struct {
+	Distinct int
+	Top      []MetaFacetValue
+}
+
+type MetaFacetValue struct {
+	Value   string
+	Results int
+}
+
+type MetaFacets struct {
+	Extensions  MetaFacet
+	Directories MetaFacet
+}
+
+func summarizeFacet(counts map[string]int) MetaFacet {
+	values := make([]MetaFacetValue, 0, len(counts))
+	for value, results := range counts {
+		values = append(values, MetaFacetValue{value, results})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Results == values[j].Results {
+			return values[i].Value < values[j].Value
+		}
+		return values[i].Results > values[j].Results
+	})
+	if len(values) > metaTopFacets {
+		values = values[:metaTopFacets]
+	}
+	return MetaFacet{
+		Distinct: len(counts),
+		Top:      values,
+	}
+}
+
+// newQueryMeta returns the QueryMeta of the (finished) query s.
+func newQueryMeta(queryid string, s queryState) *QueryMeta {
+	meta := &QueryMeta{
+		QueryId:         queryid,
+		Generation:      s.generation,
+		CountOnly:       s.countOnly,
+		ResultsPerPage:  *resultsPerPage,
+		Pages:           []MetaPage{},
+		PackagesPerPage: *packagesPerPage,
+		Packages:        []MetaPackage{},
+	}
+	if s.countOnly {
+		counts := queryCounts(queryid)
+		meta.TotalResults = counts.Total
+		for pkg, count := range counts.Packages {
+			meta.Packages = append(meta.Packages, MetaPackage{
+				Package: pkg,
+				Results: count,
+				Page:    -1,
+			})
+		}
+		sort.Slice(meta.Packages, func(i, j int) bool {
+			return meta.Packages[i].Package < meta.Packages[j].Package
+		})
+		return meta
+	}
+
+	meta.TotalResults = len(s.resultPointers)
+	for page := 0; page < s.resultPages; page++ {
+		first := page * *resultsPerPage
+		count := *resultsPerPage
+		if first+count > meta.TotalResults {
+			count = meta.TotalResults - first
+		}
+		meta.Pages = append(meta.Pages, MetaPage{
+			Page:  page,
+			URL:   signDownload(fmt.Sprintf("/results/%s/page_%d.json", queryid, page), downloadExpiry(s.started)),
+			First: first,
+			Count: count,
+		})
+	}
+	meta.PerPackagePages = (len(s.allPackagesSorted) + *packagesPerPage - 1) / *packagesPerPage
+	for idx, pkg := range s.allPackagesSorted {
+		meta.Packages = append(meta.Packages, MetaPackage{
+			Package: pkg,
+			Results: s.facets.Packages[pkg],
+			Page:    idx / *packagesPerPage,
+		})
+	}
+	meta.Facets = &MetaFacets{
+		Extensions:  summarizeFacet(s.facets.Extensions),
+		Directories: summarizeFacet(s.facets.Directories),
+	}
+	return meta
+}
+
+// MetaHandler serves /api/v1/meta/<queryid>.
+func MetaHandler(w http.ResponseWriter, r *http.Request) {
+	queryid := strings.TrimPrefix(r.URL.Path, "/api/v1/meta/")
+	if queryid == "" || strings.Contains(queryid, "/") {
+		http.Error(w, "Invalid query id.", http.StatusBadRequest)
+		return
+	}
+	if !checkTenant(w, r, queryid) {
+		return
+	}
+	if proxyToOwner(w, r, queryid, MetaHandler) {
+		return
+	}
+	defer pinQuery(queryid)()
+	s, msg, code := completedQuery(queryid)
+	if code != http.StatusOK {
+		http.Error(w, msg, code)
+		return
+	}
+	if s.generation != *indexGeneration {
+		http.Error(w, staleGenerationMessage, http.StatusGone)
+		return
+	}
+	startJsonResponse(w)
+	if err := json.NewEncoder(w).Encode(newQueryMeta(queryid, s)); err != nil {
+		log.Printf("[%s] could not write response: %v\n", queryid, err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMeta(t *testing.T) {
+	defer useFakeBackends(t,
+		newFakeBackend("i3-wm_4.8-1/i3bar/src/main.c", "i3-wm_4.8-1/src/main.c"),
+		newFakeBackend("dcs_0.1-1/cmd/dcs-web/dcs-web.go"))()
+
+	const query = "q=main&literal=1"
+	queryid := queryIdentifier(query)
+	if _, err := maybeStartQuery(context.Background(), queryid, "test", query); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, queryid)
+	defer forgetQuery(queryid)
+
+	rec := httptest.NewRecorder()
+	MetaHandler(rec, httptest.NewRequest("GET", "/api/v1/meta/"+queryid, nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+	}
+	var meta QueryMeta
+	if err := json.Unmarshal(rec.Body.Bytes(), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := meta.TotalResults, 3; got != want {
+		t.Errorf("unexpected TotalResults: got %d, want %d", got, want)
+	}
+	if len(meta.Pages) == 1 && !strings.HasPrefix(meta.Pages[0].URL, "/results/"+queryid+"/page_0.json?") {
+		t.Errorf("unexpected Pages[0].URL: %q", meta.Pages[0].URL)
+	}
+	wantPages := []MetaPage{{Page: 0, First: 0, Count: 3}}
+	for idx := range meta.Pages {
+		meta.Pages[idx].URL = ""
+	}
+	if !reflect.DeepEqual(meta.Pages, wantPages) {
+		t.Errorf("unexpected Pages: got %+v, want %+v", meta.Pages, wantPages)
+	}
+	results := make(map[string]int)
+	for _, pkg := range meta.Packages {
+		results[pkg.Package] = pkg.Results
+	}
+	if want := map[string]int{"i3-wm": 2, "dcs": 1}; !reflect.DeepEqual(results, want) {
+		t.Errorf("unexpected Packages: got %+v, want %v", meta.Packages, want)
+	}
+	if meta.Facets == nil || meta.Facets.Extensions.Distinct != 2 {
+		t.Errorf("unexpected Facets: got %+v, want 2 distinct extensions", meta.Facets)
+	}
+}
+
+func TestMetaRequiresCompletedQuery(t *testing.T) {
+	defer useFakeBackends(t)()
+	rec := httptest.NewRecorder()
+	MetaHandler(rec, httptest.NewRequest("GET", "/api/v1/meta/doesnotexist", nil))
+	if got, want := rec.Code, http.StatusNotFound; got != want {
+		t.Errorf("unexpected HTTP status: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+var metadataPath = flag.String("metadata_path",
+	"/var/dcs/metadata.json",
+	"Path to the maintainers, descriptions and upstream projects of source packages, as written by dcs-compute-ranking -metadata_output_path. Used for the maintainer: and description: keywords and for grouping per-package results by upstream project (groupby=upstream). A missing file results in no package matching these keywords")
+
+// packageMetadata is the metadata of a source package from the Sources and
+// Packages indices (and debian/upstream/metadata).
+type packageMetadata struct {
+	// Maintainers contains the Maintainer and Uploaders, e.g. “Debian X
+	// Strike Force <debian-x@lists.debian.org>”.
+	Maintainers []string `json:",omitempty"`
+	// Descriptions contains the synopses of the binary packages.
+	Descriptions []string `json:",omitempty"`
+	// Upstream is the upstream project, e.g. “github.com/i3/i3”, see
+	// groupByUpstream.
+	Upstream string `json:",omitempty"`
+	// Description is the synopsis of the binary package of the same name,
+	// or of the first binary package, e.g. “improved dynamic tiling window
+	// manager”.
+	Description string `json:",omitempty"`
+	// Section is the archive section, e.g. “x11” or “contrib/games”.
+	Section string `json:",omitempty"`
+	// Homepage is the upstream homepage, e.g. “https://i3wm.org/”.
+	Homepage string `json:",omitempty"`
+}
+
+// metadataIndex maps source package names (e.g. “i3-wm”) to their metadata.
+type metadataIndex map[string]*packageMetadata
+
+var (
+	metadata   metadataIndex
+	metadataMu sync.RWMutex
+)
+
+// loadMetadata replaces the metadata index with the contents of the JSON file
+// at path.
+func loadMetadata(path string) error {
+	index := make(metadataIndex)
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&index); err != nil {
+			return fmt.Errorf("could not decode %q: %v", path, err)
+		}
+	}
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+	metadata = index
+	return nil
+}
+
+// lookupMetadata returns the metadata of the source package pkg, or empty
+// metadata if unknown.
+func lookupMetadata(pkg string) packageMetadata {
+	metadataMu.RLock()
+	defer metadataMu.RUnlock()
+	if m, ok := metadata[pkg]; ok {
+		return *m
+	}
+	return packageMetadata{}
+}
+
+// metadataKeywords maps the URL parameters of the keywords which dcs-web
+// handles itself (see search.ParseQuery) to the metadata they match.
+var metadataKeywords = map[string]func(*packageMetadata) []string{
+	"maintainer":  func(m *packageMetadata) []string { return m.Maintainers },
+	"description": func(m *packageMetadata) []string { return m.Descriptions },
+}
+
+// metadataFilter restricts the results of a query to the source packages
+// whose metadata matches the maintainer: and description: keywords. The
+// source backends do not know about package metadata, so results are filtered
+// as they arrive (see replySink.store).
+type metadataFilter struct {
+	packages map[string]bool
+	// unknown is whether packages without metadata match, which is the
+	// case for e.g. -maintainer:… keywords.
+	unknown bool
+}
+
+// newMetadataFilter returns a metadataFilter for the keywords in query, or nil
+// if query does not contain any. Values are case-insensitive regular
+// expressions, e.g. maintainer:pkg-go-maintainers.
+func newMetadataFilter(query url.Values) (*metadataFilter, error) {
+	type condition struct {
+		values  func(*packageMetadata) []string
+		re      *regexp.Regexp
+		negated bool
+	}
+	var conditions []condition
+	for keyword, values := range metadataKeywords {
+		for _, param := range []string{keyword, "n" + keyword} {
+			for _, value := range query[param] {
+				re, err := regexp.Compile("(?i)" + value)
+				if err != nil {
+					return nil, err
+				}
+				conditions = append(conditions, condition{
+					values:  values,
+					re:      re,
+					negated: param != keyword,
+				})
+			}
+		}
+	}
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+
+	matches := func(m *packageMetadata) bool {
+		for _, c := range conditions {
+			found := false
+			for _, value := range c.values(m) {
+				if c.re.MatchString(value) {
+					found = true
+					break
+				}
+			}
+			if found == c.negated {
+				return false
+			}
+		}
+		return true
+	}
+
+	metadataMu.RLock()
+	defer metadataMu.RUnlock()
+	f := &metadataFilter{
+		packages: make(map[string]bool),
+		unknown:  matches(&packageMetadata{}),
+	}
+	for name, m := range metadata {
+		f.packages[name] = matches(m)
+	}
+	return f, nil
+}
+
+// Matches returns whether match belongs to one of the source packages
+// selected by the filter.
+func (f *metadataFilter) Matches(match *sourcebackendpb.Match) bool {
+	pkg := match.Package
+	if idx := strings.Index(pkg, "_"); idx > -1 {
+		pkg = pkg[:idx]
+	}
+	matches, ok := f.packages[pkg]
+	if !ok {
+		return f.unknown
+	}
+	return matches
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+func TestMetadataFilter(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dcs-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "metadata.json")
+	const contents = `{
+  "golang-x-crypto": {"Maintainers": ["Debian Go Packaging Team <pkg-go-maintainers@lists.alioth.debian.org>"], "Descriptions": ["Go supplementary cryptography libraries"]},
+  "openssl": {"Maintainers": ["Debian OpenSSL Team <pkg-openssl-devel@lists.alioth.debian.org>"], "Descriptions": ["Secure Sockets Layer toolkit - cryptographic utility", "Secure Sockets Layer toolkit - development files"]},
+  "i3-wm": {"Maintainers": ["Michael Stapelberg <stapelberg@debian.org>"], "Descriptions": ["improved dynamic tiling window manager"]}
+}`
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadMetadata(path); err != nil {
+		t.Fatal(err)
+	}
+	defer loadMetadata(filepath.Join(tmp, "nonexistent.json"))
+
+	packages := []string{"golang-x-crypto_0.1-1", "openssl_1.1.1-1", "i3-wm_4.16-1", "unknown_1.0-1"}
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"maintainer=PKG-GO", []string{"golang-x-crypto_0.1-1"}},
+		{"description=crypto", []string{"golang-x-crypto_0.1-1", "openssl_1.1.1-1"}},
+		{"description=crypto&maintainer=openssl", []string{"openssl_1.1.1-1"}},
+		{"description=development+files", []string{"openssl_1.1.1-1"}},
+		{"nmaintainer=alioth", []string{"i3-wm_4.16-1", "unknown_1.0-1"}},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := newMetadataFilter(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, pkg := range packages {
+				if f.Matches(&sourcebackendpb.Match{Package: pkg}) {
+					got = append(got, pkg)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matching packages = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if f, err := newMetadataFilter(url.Values{"q": []string{"foo"}}); err != nil || f != nil {
+		t.Errorf("newMetadataFilter without keywords = %v, %v, want nil, nil", f, err)
+	}
+}
+
+func TestPerPackageResultsMetadata(t *testing.T) {
+	defer useUpstreamMetadata(t)()
+	defer useFakeBackends(t,
+		newFakeBackend("i3-wm_4.8-1/i3bar/src/main.c", "zsh_5.8-1/Src/main.c"),
+	)()
+
+	queryid, cleanup := runQuery(t, "q=main&literal=1")
+	defer cleanup()
+
+	rec := httptest.NewRecorder()
+	PerPackageResultsHandler(rec, httptest.NewRequest("GET", "/perpackage-results/"+queryid+"/2/page_0.json", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+	}
+	var results []PerPackageResults
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("%v (body: %s)", err, rec.Body.String())
+	}
+	got := make(map[string]PerPackageResults)
+	for _, r := range results {
+		r.Results = nil
+		r.Ranking = RankingSummary{}
+		got[r.Package] = r
+	}
+	want := map[string]PerPackageResults{
+		"i3-wm": {
+			Package:      "i3-wm",
+			Upstream:     "github.com/i3/i3",
+			Description:  "improved dynamic tiling window manager",
+			Section:      "x11",
+			Homepage:     "https://i3wm.org/",
+			TotalResults: 1,
+			ShownResults: 1,
+		},
+		// Packages without (or with partial) metadata omit the fields.
+		"zsh": {
+			Package:      "zsh",
+			TotalResults: 1,
+			ShownResults: 1,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected per-package results: got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+// Debian Code Search can be added as a search provider to browsers and
+// federated search tools using its OpenSearch description
+// (https://github.com/dewitt/opensearch), served at /opensearch.xml. Besides
+// the search page, it describes /opensearch, which returns the results of a
+// query as Atom feed or JSON in a single request.
+
+var opensearchTimeout = flag.Duration("opensearch_timeout",
+	10*time.Second,
+	"How long /opensearch waits for a query to finish. Queries which take longer result in HTTP 503 (with a Retry-After header), the query keeps running so that retrying returns its results")
+
+const (
+	// opensearchDefaultCount is the number of results /opensearch returns
+	// unless count= is specified.
+	opensearchDefaultCount = 10
+
+	// opensearchMaxCount is the maximum of count=.
+	opensearchMaxCount = 100
+)
+
+type opensearchURL struct {
+	Type     string `xml:"type,attr"`
+	Method   string `xml:"method,attr"`
+	Template string `xml:"template,attr"`
+}
+
+type opensearchQuery struct {
+	Role        string `xml:"role,attr"`
+	SearchTerms string `xml:"searchTerms,attr"`
+}
+
+type opensearchDescription struct {
+	XMLName       xml.Name        `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName     string          `xml:"ShortName"`
+	Description   string          `xml:"Description"`
+	InputEncoding string          `xml:"InputEncoding"`
+	URLs          []opensearchURL `xml:"Url"`
+	Query         opensearchQuery `xml:"Query"`
+}
+
+// baseURL returns the scheme and host under which the request was received,
+// e.g. “https://codesearch.debian.net”.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// OpenSearchDescriptionHandler serves /opensearch.xml, the OpenSearch
+// description of this instance.
+func OpenSearchDescriptionHandler(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	desc := opensearchDescription{
+		ShortName:     "Debian Code Search",
+		Description:   "Search the source code of all Debian packages",
+		InputEncoding: "UTF-8",
+		URLs: []opensearchURL{
+			{"text/html", "get", base + "/search?q={searchTerms}"},
+			{"application/atom+xml", "get", base + "/opensearch?q={searchTerms}&startIndex={startIndex?}&count={count?}&format=atom"},
+			{"application/json", "get", base + "/opensearch?q={searchTerms}&startIndex={startIndex?}&count={count?}&format=json"},
+		},
+		Query: opensearchQuery{Role: "example", SearchTerms: "xcb_create_window"},
+	}
+	w.Header().Set("Content-Type", "application/opensearchdescription+xml")
+	w.Header().Set("Cache-Control", "max-age=3600, public")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", " ")
+	if err := enc.Encode(&desc); err != nil {
+		log.Printf("Could not write OpenSearch description: %v\n", err)
+	}
+}
+
+// OpenSearchResult is a result of /opensearch?format=json.
+type OpenSearchResult struct {
+	// Package is the source package (without version).
+	Package string
+	Path    string
+	Line    uint32
+
+	// Context is the matching line (not HTML-escaped).
+	Context string
+
+	// URL displays the result in its file.
+	URL string
+}
+
+// OpenSearchResponse is the reply of /opensearch?format=json. The fields
+// correspond to the OpenSearch response elements.
+type OpenSearchResponse struct {
+	Query        string
+	QueryId      string
+	TotalResults int
+	StartIndex   int
+	ItemsPerPage int
+	Results      []OpenSearchResult
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Content string   `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName      xml.Name        `xml:"http://www.w3.org/2005/Atom feed"`
+	XMLNSOS      string          `xml:"xmlns:opensearch,attr"`
+	Title        string          `xml:"title"`
+	ID           string          `xml:"id"`
+	Updated      string          `xml:"updated"`
+	Links        []atomLink      `xml:"link"`
+	TotalResults int             `xml:"opensearch:totalResults"`
+	StartIndex   int             `xml:"opensearch:startIndex"`
+	ItemsPerPage int             `xml:"opensearch:itemsPerPage"`
+	Query        opensearchQuery `xml:"opensearch:Query"`
+	Entries      []atomEntry     `xml:"entry"`
+}
+
+// showURL returns the absolute URL which displays match in its file.
+func showURL(base string, match *sourcebackendpb.Match) string {
+	show := url.Values{
+		"file": []string{match.Path},
+		"line": []string{strconv.Itoa(int(match.Line))},
+	}
+	if match.Compression != "" {
+		show.Set("compression", match.Compression)
+	}
+	return fmt.Sprintf("%s/show?%s#L%d", base, show.Encode(), match.Line)
+}
+
+// opensearchResults returns count results of the finished query, starting
+// with the result at (1-based) startIndex, in the order of their ranking.
+func opensearchResults(queryid, base string, startIndex, count int) ([]OpenSearchResult, error) {
+	stateMu.RLock()
+	pointers := state[queryid].resultPointers
+	stateMu.RUnlock()
+	start := startIndex - 1
+	if start > len(pointers) {
+		start = len(pointers)
+	}
+	end := start + count
+	if end > len(pointers) {
+		end = len(pointers)
+	}
+	results := make([]OpenSearchResult, 0, end-start)
+	err := forEachMatch(queryid, pointers[start:end], func(idx int, match *sourcebackendpb.Match) error {
+		pkg := match.Path
+		if idx := strings.Index(pkg, "/"); idx > -1 {
+			pkg = pkg[:idx]
+		}
+		if idx := strings.Index(pkg, "_"); idx > -1 {
+			pkg = pkg[:idx]
+		}
+		results = append(results, OpenSearchResult{
+			Package: pkg,
+			Path:    match.Path,
+			Line:    match.Line,
+			// Matches are HTML-escaped by the source backends.
+			Context: html.UnescapeString(match.Context),
+			URL:     showURL(base, match),
+		})
+		return nil
+	})
+	return results, err
+}
+
+// waitForQuery waits until the query is done, the request is cancelled or
+// -opensearch_timeout passed, whichever happens first. Returns whether the
+// query is done.
+func waitForQuery(r *http.Request, queryid string) bool {
+	// Waiting counts as streaming the query’s events, so that it is not
+	// abandoned (see -abandoned_query_grace).
+	defer watchSubscriber(r.Context(), queryid)()
+	deadline := time.After(*opensearchTimeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for !queryDone(queryid) {
+		select {
+		case <-r.Context().Done():
+			return false
+		case <-deadline:
+			return queryDone(queryid)
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// OpenSearchHandler serves /opensearch, which runs the query q= (a regular
+// expression unless literal=1, like on the search page) and returns its
+// results as Atom feed (format=atom, the default) or JSON (format=json).
+// startIndex= (1-based) and count= select the results.
+func OpenSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	src := requestSource(r)
+	query := r.FormValue("q")
+	if query == "" {
+		http.Error(w, "Empty query.", http.StatusBadRequest)
+		return
+	}
+	format := r.FormValue("format")
+	switch format {
+	case "":
+		format = "atom"
+	case "atom", "json":
+	default:
+		http.Error(w, "format must be atom or json.", http.StatusBadRequest)
+		return
+	}
+	startIndex, err := formInt(r, "startIndex", 1)
+	if err != nil || startIndex < 1 {
+		http.Error(w, "Invalid startIndex, must be 1 or larger.", http.StatusBadRequest)
+		return
+	}
+	count, err := formInt(r, "count", opensearchDefaultCount)
+	if err != nil || count < 1 || count > opensearchMaxCount {
+		http.Error(w, fmt.Sprintf("Invalid count, must be between 1 and %d.", opensearchMaxCount), http.StatusBadRequest)
+		return
+	}
+	literal := "0"
+	if r.FormValue("literal") == "1" {
+		literal = "1"
+	}
+	// Like the search page, so that both share the query’s results.
+	q := url.Values{"q": []string{query}}.Encode() + "&literal=" + literal
+	tenant, err := tenantFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unknown API key.", http.StatusUnauthorized)
+		return
+	}
+	queryid := tenantQueryIdentifier(tenant, q)
+
+	if err := validateQuery("?" + q); err != nil {
+		log.Printf("[%s] Query %q failed validation: %v\n", src, q, err)
+		recordRefusedStatz(errorTypeInvalidQuery)
+		http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if proxyToOwner(w, r, queryid, OpenSearchHandler) {
+		return
+	}
+
+	if err := admitTenantQuery(tenant, queryid); err != nil {
+		log.Printf("[%s] not starting query: %v\n", src, err)
+		recordRefusedStatz(errorTypeFor(err))
+		http.Error(w, "Too many queries for this API key, please try again later.", http.StatusTooManyRequests)
+		return
+	}
+
+	defer pinQuery(queryid)()
+	if _, err := maybeStartQuery(r.Context(), queryid, src, q); err != nil {
+		log.Printf("[%s] could not start query: %v\n", src, err)
+		recordRefusedStatz(errorTypeFor(err))
+		http.Error(w, "Could not start query.", http.StatusInternalServerError)
+		return
+	}
+	if !waitForQuery(r, queryid) {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Query not finished yet, please retry.", http.StatusServiceUnavailable)
+		return
+	}
+
+	base := baseURL(r)
+	results, err := opensearchResults(queryid, base, startIndex, count)
+	if err != nil {
+		log.Printf("[%s] could not read results: %v\n", queryid, err)
+		http.Error(w, "Could not read results, please retry.", http.StatusInternalServerError)
+		return
+	}
+	stateMu.RLock()
+	s := state[queryid]
+	stateMu.RUnlock()
+	total := len(s.resultPointers)
+
+	if format == "json" {
+		startJsonResponse(w)
+		if err := json.NewEncoder(w).Encode(&OpenSearchResponse{
+			Query:        query,
+			QueryId:      queryid,
+			TotalResults: total,
+			StartIndex:   startIndex,
+			ItemsPerPage: count,
+			Results:      results,
+		}); err != nil {
+			log.Printf("[%s] could not write response: %v\n", queryid, err)
+		}
+		return
+	}
+
+	updated := s.ended.UTC().Format(time.RFC3339)
+	feed := atomFeed{
+		XMLNSOS: "http://a9.com/-/spec/opensearch/1.1/",
+		Title:   "Debian Code Search: " + query,
+		ID:      base + "/results/" + queryid,
+		Updated: updated,
+		Links: []atomLink{
+			{Href: base + "/search?" + q, Rel: "alternate", Type: "text/html"},
+			{Href: base + "/opensearch.xml", Rel: "search", Type: "application/opensearchdescription+xml"},
+		},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: count,
+		Query:        opensearchQuery{Role: "request", SearchTerms: query},
+	}
+	for _, result := range results {
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   fmt.Sprintf("%s:%d", result.Path, result.Line),
+			ID:      fmt.Sprintf("%s/results/%s/%s:%d", base, queryid, result.Path, result.Line),
+			Updated: updated,
+			Link:    atomLink{Href: result.URL},
+			Content: result.Context,
+		})
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(&feed); err != nil {
+		log.Printf("[%s] could not write response: %v\n", queryid, err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenSearchDescription(t *testing.T) {
+	rec := httptest.NewRecorder()
+	OpenSearchDescriptionHandler(rec, httptest.NewRequest("GET", "http://codesearch.example/opensearch.xml", nil))
+	var desc opensearchDescription
+	if err := xml.Unmarshal(rec.Body.Bytes(), &desc); err != nil {
+		t.Fatalf("%v (body: %s)", err, rec.Body.String())
+	}
+	templates := make(map[string]string)
+	for _, u := range desc.URLs {
+		templates[u.Type] = u.Template
+	}
+	if got, want := templates["text/html"], "http://codesearch.example/search?q={searchTerms}"; got != want {
+		t.Errorf("text/html template = %q, want %q", got, want)
+	}
+	for _, typ := range []string{"application/atom+xml", "application/json"} {
+		if !strings.HasPrefix(templates[typ], "http://codesearch.example/opensearch?q={searchTerms}") {
+			t.Errorf("%s template = %q, want a /opensearch URL", typ, templates[typ])
+		}
+	}
+}
+
+func TestOpenSearch(t *testing.T) {
+	defer useFakeBackends(t, newFakeBackend(
+		"i3-wm_4.8-1/i3bar/src/main.c",
+		"i3-wm_4.8-1/src/main.c",
+		"zsh_5.8-1/Src/main.c"))()
+	defer func() {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		queryid := queryIdentifier("q=main&literal=1")
+		if s, ok := state[queryid]; ok {
+			s.storage.Close()
+			delete(state, queryid)
+		}
+	}()
+
+	rec := httptest.NewRecorder()
+	OpenSearchHandler(rec, httptest.NewRequest("GET", "http://codesearch.example/opensearch?q=main&literal=1&format=json&startIndex=2&count=5", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+	}
+	var resp OpenSearchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v (body: %s)", err, rec.Body.String())
+	}
+	if got, want := resp.TotalResults, 3; got != want {
+		t.Errorf("TotalResults = %d, want %d", got, want)
+	}
+	if got, want := len(resp.Results), 2; got != want {
+		t.Fatalf("got %d results, want %d (startIndex=2)", got, want)
+	}
+	for _, result := range resp.Results {
+		if !strings.HasPrefix(result.Path, result.Package+"_") {
+			t.Errorf("result %+v: Package does not match Path", result)
+		}
+		if !strings.HasPrefix(result.URL, "http://codesearch.example/show?") {
+			t.Errorf("result %+v: URL is not an absolute /show URL", result)
+		}
+	}
+
+	// The query is finished, so the Atom feed is served from the same results.
+	rec = httptest.NewRecorder()
+	OpenSearchHandler(rec, httptest.NewRequest("GET", "http://codesearch.example/opensearch?q=main&literal=1", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+	}
+	var feed struct {
+		Entries []struct {
+			Title string `xml:"title"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(rec.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("%v (body: %s)", err, rec.Body.String())
+	}
+	if got, want := len(feed.Entries), 3; got != want {
+		t.Errorf("got %d feed entries, want %d", got, want)
+	}
+
+	for _, path := range []string{
+		"/opensearch",
+		"/opensearch?q=main&format=rss",
+		"/opensearch?q=main&count=1000",
+		"/opensearch?q=main&startIndex=0",
+	} {
+		rec := httptest.NewRecorder()
+		OpenSearchHandler(rec, httptest.NewRequest("GET", path, nil))
+		if got, want := rec.Code, http.StatusBadRequest; got != want {
+			t.Errorf("%s: unexpected HTTP status: got %d, want %d", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	peers = flag.String("peers",
+		"",
+		"Comma-separated list of base URLs (e.g. http://dcs-web-1:28080) of all dcs-web instances behind the same load balancer, including this one (see -self_peer). Each query is owned by exactly one of them, chosen by rendezvous hashing of the query id. Only the owner sends the query to the source backends; the other instances proxy event streams and result requests to the owner, which only trusts proxied requests coming from the address of a listed instance. Empty disables coordination")
+	selfPeer = flag.String("self_peer",
+		"",
+		"Base URL of this instance, exactly as listed in -peers")
+
+	proxiedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "requests_proxied",
+			Help: "Requests proxied to the dcs-web instance owning the query, by outcome (ok or fallback, i.e. the owner was unreachable and the request was handled locally).",
+		},
+		[]string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(proxiedRequests)
+}
+
+// proxiedHeader is set on proxied requests so that they are always handled by
+// the receiving instance, even if its view of -peers differs. Its value is the
+// -self_peer of the proxying instance, see proxiedByPeer.
+const proxiedHeader = "X-Dcs-Proxied"
+
+// handleLocallyKey is set in the context of requests which proxyToOwner
+// passes to its fallback.
+type handleLocallyKey struct{}
+
+var (
+	peerProxiesOnce sync.Once
+	peerProxies     map[string]*url.URL
+)
+
+func peerURLs() map[string]*url.URL {
+	peerProxiesOnce.Do(func() {
+		peerProxies = make(map[string]*url.URL)
+		for _, peer := range strings.Split(*peers, ",") {
+			peer = strings.TrimSpace(peer)
+			if peer == "" {
+				continue
+			}
+			u, err := url.Parse(peer)
+			if err != nil {
+				log.Fatalf("Invalid -peers entry %q: %v", peer, err)
+			}
+			peerProxies[peer] = u
+		}
+		if len(peerProxies) > 0 {
+			if _, ok := peerProxies[*selfPeer]; !ok {
+				log.Fatalf("-self_peer %q is not contained in -peers %q", *selfPeer, *peers)
+			}
+		}
+	})
+	return peerProxies
+}
+
+// queryOwner returns the base URL of the instance which owns the query, using
+// rendezvous (highest random weight) hashing: when an instance is added or
+// removed, only the queries it owns (or will own) move. Refined queries (see
+// refinedQueryId) are owned by the owner of their parent query.
+func queryOwner(queryid string) string {
+	// Tenant names (see tenantOf) can contain dashes, too.
+	start := strings.Index(queryid, tenantSeparator) + 1
+	if idx := strings.IndexByte(queryid[start:], '-'); idx > -1 {
+		queryid = queryid[:start+idx]
+	}
+	var (
+		owner     string
+		maxWeight uint64
+	)
+	for peer := range peerURLs() {
+		h := fnv.New64a()
+		io.WriteString(h, peer)
+		io.WriteString(h, queryid)
+		if weight := h.Sum64(); owner == "" || weight > maxWeight ||
+			(weight == maxWeight && peer < owner) {
+			owner, maxWeight = peer, weight
+		}
+	}
+	return owner
+}
+
+// peerResolveInterval is how often the addresses of -peers are resolved
+// again, see startPeerResolver.
+const peerResolveInterval = 1 * time.Minute
+
+var (
+	peerAddrsMu sync.RWMutex
+	// peerAddrs contains the IP addresses of each peer (except this
+	// instance), see resolvePeers.
+	peerAddrs map[string]map[string]bool
+)
+
+// resolvePeers resolves the host names of -peers. If a peer cannot be
+// resolved, its previously resolved addresses are kept.
+func resolvePeers() {
+	peerAddrsMu.RLock()
+	old := peerAddrs
+	peerAddrsMu.RUnlock()
+	resolved := make(map[string]map[string]bool)
+	for peer, u := range peerURLs() {
+		if peer == *selfPeer {
+			continue
+		}
+		addrs, err := net.LookupHost(u.Hostname())
+		if err != nil {
+			log.Printf("Could not resolve peer %q: %v\n", peer, err)
+			resolved[peer] = old[peer]
+			continue
+		}
+		resolved[peer] = make(map[string]bool, len(addrs))
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil {
+				resolved[peer][ip.String()] = true
+			}
+		}
+	}
+	peerAddrsMu.Lock()
+	defer peerAddrsMu.Unlock()
+	peerAddrs = resolved
+}
+
+// startPeerResolver resolves the addresses of -peers (see proxiedByPeer) and
+// keeps them up to date every peerResolveInterval. Must be called after
+// flag.Parse().
+func startPeerResolver() {
+	if len(peerURLs()) == 0 {
+		return
+	}
+	resolvePeers()
+	go func() {
+		for range time.Tick(peerResolveInterval) {
+			resolvePeers()
+		}
+	}()
+}
+
+// proxiedByPeer returns whether the request was proxied by another instance
+// listed in -peers, i.e. whether proxiedHeader names one of them and the
+// request comes from one of that instance’s addresses (see resolvePeers).
+// Clients can set proxiedHeader themselves, which must not make a non-owner
+// send their query to the source backends.
+func proxiedByPeer(r *http.Request) bool {
+	peer := r.Header.Get(proxiedHeader)
+	if peer == "" {
+		return false
+	}
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(remote)
+	if ip == nil {
+		return false
+	}
+	peerAddrsMu.RLock()
+	defer peerAddrsMu.RUnlock()
+	return peerAddrs[peer][ip.String()]
+}
+
+// proxyToOwner proxies the request to the owner of the query and returns
+// true, unless this instance owns the query (or coordination is disabled), in
+// which case the caller handles the request. If the owner is unreachable, the
+// request is handled locally using fallback.
+func proxyToOwner(w http.ResponseWriter, r *http.Request, queryid string, fallback http.HandlerFunc) bool {
+	if r.Context().Value(handleLocallyKey{}) != nil {
+		return false
+	}
+	if r.Header.Get(proxiedHeader) != "" {
+		if proxiedByPeer(r) {
+			return false
+		}
+		r.Header.Del(proxiedHeader)
+	}
+	owner := queryOwner(queryid)
+	if owner == "" || owner == *selfPeer {
+		return false
+	}
+	log.Printf("[%s] proxying %s to owner %s\n", queryid, r.URL.Path, owner)
+	proxy := httputil.NewSingleHostReverseProxy(peerURLs()[owner])
+	proxy.Transport = common.HTTPClient.Transport
+	// Flush immediately so that event streams are not delayed.
+	proxy.FlushInterval = -1
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Header.Set(proxiedHeader, *selfPeer)
+	}
+	failed := false
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		log.Printf("[%s] could not proxy to owner %s, handling locally: %v\n", queryid, owner, err)
+		failed = true
+		proxiedRequests.With(prometheus.Labels{"outcome": "fallback"}).Inc()
+		// Prevent fallback from trying to proxy again.
+		fallback(w, r.WithContext(context.WithValue(r.Context(), handleLocallyKey{}, true)))
+	}
+	proxy.ServeHTTP(w, r)
+	if !failed {
+		proxiedRequests.With(prometheus.Labels{"outcome": "ok"}).Inc()
+	}
+	return true
+}
+
+// relayFromOwner runs the query q (see QueryOptions.encode) on the owner of
+// queryid and calls send with each of its events (in the format of
+// LongPollReply.Events), for clients of /instantws and the gRPC API, whose
+// connections cannot be proxied like HTTP requests (see proxyToOwner).
+// apiKey (if any) is passed on to the owner. Returns false if this instance
+// owns the query (or coordination is disabled) or the owner is unreachable,
+// in which case the caller runs the query itself.
+func relayFromOwner(ctx context.Context, queryid, q string, priority queryPriority, apiKey string, version int, send func(data []byte) error) (bool, error) {
+	owner := queryOwner(queryid)
+	if owner == "" || owner == *selfPeer {
+		return false, nil
+	}
+	form, err := http.NewRequest("GET", "/?"+q, nil)
+	if err != nil {
+		return false, nil
+	}
+	opts, err := queryOptionsFromForm(form, form.FormValue("q"))
+	if err != nil {
+		return false, nil
+	}
+	opts.Priority = priority.String()
+	body, err := json.Marshal(opts)
+	if err != nil {
+		return false, nil
+	}
+	do := func(method, path string, body []byte, v interface{}) (int, error) {
+		req, err := http.NewRequest(method, owner+path, bytes.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set(proxiedHeader, *selfPeer)
+		if apiKey != "" {
+			req.Header.Set(apiKeyHeader, apiKey)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := common.HTTPClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return resp.StatusCode, fmt.Errorf("%s %s: unexpected HTTP status %q", method, path, resp.Status)
+		}
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+	}
+
+	log.Printf("[%s] relaying events from owner %s\n", queryid, owner)
+	var started QueryStarted
+	if code, err := do("POST", "/api/v1/query", body, &started); err != nil {
+		if code == http.StatusTooManyRequests {
+			return true, errTenantRateLimited
+		}
+		if code >= 400 && code < 500 {
+			return true, err
+		}
+		log.Printf("[%s] could not start query on owner %s, handling locally: %v\n", queryid, owner, err)
+		proxiedRequests.With(prometheus.Labels{"outcome": "fallback"}).Inc()
+		return false, nil
+	}
+	since := ""
+	for {
+		params := url.Values{
+			"v":     []string{strconv.Itoa(version)},
+			"since": []string{since},
+		}
+		var reply LongPollReply
+		if _, err := do("GET", "/api/v1/poll/"+url.PathEscape(started.QueryId)+"?"+params.Encode(), nil, &reply); err != nil {
+			return true, err
+		}
+		for _, data := range reply.Events {
+			if err := send(data); err != nil {
+				return true, err
+			}
+		}
+		since = reply.LastEventId
+		if reply.Done {
+			break
+		}
+	}
+	proxiedRequests.With(prometheus.Labels{"outcome": "ok"}).Inc()
+	return true, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestProxiedByPeer(t *testing.T) {
+	oldPeers, oldSelf := *peers, *selfPeer
+	*peers, *selfPeer = "http://127.0.0.1:28080,http://127.0.0.2:28080", "http://127.0.0.1:28080"
+	peerProxiesOnce = sync.Once{}
+	resolvePeers()
+	defer func() {
+		*peers, *selfPeer = oldPeers, oldSelf
+		peerProxiesOnce = sync.Once{}
+		peerAddrs = nil
+	}()
+
+	for _, tt := range []struct {
+		header     string
+		remoteAddr string
+		want       bool
+	}{
+		{"http://127.0.0.2:28080", "127.0.0.2:41234", true},
+		// The header names a peer, but the request comes from elsewhere.
+		{"http://127.0.0.2:28080", "192.0.2.1:41234", false},
+		{"http://192.0.2.1:28080", "192.0.2.1:41234", false},
+		{"http://127.0.0.1:28080", "127.0.0.1:41234", false},
+		{"", "127.0.0.2:41234", false},
+	} {
+		req := httptest.NewRequest("GET", "/api/v1/meta/0123abcd", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.header != "" {
+			req.Header.Set(proxiedHeader, tt.header)
+		}
+		if got := proxiedByPeer(req); got != tt.want {
+			t.Errorf("proxiedByPeer(%s %q from %s) = %v, want %v", proxiedHeader, tt.header, tt.remoteAddr, got, tt.want)
+		}
+	}
+}
+
+func TestQueryOwnerRefined(t *testing.T) {
+	oldPeers, oldSelf := *peers, *selfPeer
+	*peers, *selfPeer = "http://127.0.0.1:28080,http://127.0.0.2:28080,http://127.0.0.3:28080", "http://127.0.0.1:28080"
+	peerProxiesOnce = sync.Once{}
+	defer func() {
+		*peers, *selfPeer = oldPeers, oldSelf
+		peerProxiesOnce = sync.Once{}
+	}()
+
+	for _, parent := range []string{
+		"0123abcd",
+		"team-a.0123abcd",
+		"team-a.4567ef01",
+	} {
+		refined := refinedQueryId(parent, "pattern=foo")
+		if got, want := queryOwner(refined), queryOwner(parent); got != want {
+			t.Errorf("queryOwner(%q) = %q, want %q (owner of %q)", refined, got, want, parent)
+		}
+	}
+	// Queries of a tenant whose name contains dashes are not all owned by
+	// the owner of the tenant name’s first part.
+	owners := make(map[string]bool)
+	for i := 0; i < 32; i++ {
+		owners[queryOwner(fmt.Sprintf("foo-bar.%08x", i))] = true
+	}
+	if len(owners) < 2 {
+		t.Errorf("all queries of tenant foo-bar are owned by %v", owners)
+	}
+}
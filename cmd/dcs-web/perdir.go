@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var perDirPathRe = regexp.MustCompile(`^/perdir-results/([^/]+)/([^/]+)/([0-9]+)/page_([0-9]+).json$`)
+
+// topLevelDir returns the top-level directory within the package of the file
+// at path (e.g. “drivers” for “linux_6.1.4-1/drivers/net/tun.c”), or "" for
+// files at the top level of the package.
+func topLevelDir(path string) string {
+	slash := strings.IndexByte(path, '/')
+	if slash == -1 {
+		return ""
+	}
+	path = path[slash+1:]
+	slash = strings.IndexByte(path, '/')
+	if slash == -1 {
+		return ""
+	}
+	return path[:slash]
+}
+
+// dirResults are the results of a query within one top-level directory of a
+// package, see topLevelDir.
+type dirResults struct {
+	dir string
+
+	// count is the number of results within dir, of which only the best
+	// -results_per_package are kept in pointers.
+	count    int
+	pointers []resultPointer
+}
+
+// dirGroups groups the results of a query by package and top-level directory.
+type dirGroups map[string]map[string]*dirResults
+
+// add adds the pointer (of a result in the newest version of the package pkg)
+// to its directory. Pointers must be added in ranking order.
+func (g dirGroups) add(pkg string, pointer resultPointer) {
+	dirs, ok := g[pkg]
+	if !ok {
+		dirs = make(map[string]*dirResults)
+		g[pkg] = dirs
+	}
+	var dir string
+	if pointer.dir != nil {
+		dir = *pointer.dir
+	}
+	d, ok := dirs[dir]
+	if !ok {
+		d = &dirResults{dir: dir}
+		dirs[dir] = d
+	}
+	d.count++
+	if len(d.pointers) < *resultsPerPackage {
+		d.pointers = append(d.pointers, pointer)
+	}
+}
+
+// sorted returns the directories of each package, those with the most results
+// first.
+func (g dirGroups) sorted() map[string][]dirResults {
+	result := make(map[string][]dirResults, len(g))
+	for pkg, dirs := range g {
+		sorted := make([]dirResults, 0, len(dirs))
+		for _, d := range dirs {
+			sorted = append(sorted, *d)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if sorted[i].count != sorted[j].count {
+				return sorted[i].count > sorted[j].count
+			}
+			return sorted[i].dir < sorted[j].dir
+		})
+		result[pkg] = sorted
+	}
+	return result
+}
+
+// PerDirResultsHandler serves
+// /perdir-results/<queryid>/<package>/<perDir>/page_<n>.json, i.e. the results
+// within the newest version of <package> grouped by top-level directory, so
+// that large packages such as linux can be browsed by subsystem.
+func PerDirResultsHandler(w http.ResponseWriter, r *http.Request) {
+	matches := perDirPathRe.FindStringSubmatch(r.URL.Path)
+	if matches == nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	queryid := matches[1]
+	pkg := matches[2]
+	perDir, err := strconv.Atoi(matches[3])
+	if err != nil || perDir < 1 {
+		http.Error(w, "Invalid number of results per directory.", http.StatusBadRequest)
+		return
+	}
+	pagenr, err := strconv.Atoi(matches[4])
+	if err != nil {
+		http.Error(w, "Invalid page number.", http.StatusBadRequest)
+		return
+	}
+	if !awaitQueryDone(w, queryid) {
+		return
+	}
+
+	if err := writePerDirResults(queryid, pkg, pagenr, perDir, w, w, r); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writePerDirResults writes page of the per-directory results of pkg as a JSON
+// array of {"Package", "Directory", "Count", "Results"} objects. Directories
+// are paginated like packages (see -packages_per_page).
+func writePerDirResults(queryid, pkg string, page, perDir int, results io.Writer, w http.ResponseWriter, r *http.Request) error {
+	stateMu.RLock()
+	dirs, ok := state[queryid].dirsByPkg[pkg]
+	stateMu.RUnlock()
+	if !ok {
+		http.Error(w, "No results in this package.", http.StatusNotFound)
+		return nil
+	}
+
+	pages := int(math.Ceil(float64(len(dirs)) / float64(*packagesPerPage)))
+	if page >= pages {
+		http.Error(w, "No such page.", http.StatusNotFound)
+		return nil
+	}
+	start := page * *packagesPerPage
+	end := (page + 1) * *packagesPerPage
+	if end > len(dirs) {
+		end = len(dirs)
+	}
+
+	if notModified(w, r, pageETag(queryid, fmt.Sprintf("perdir%s/%d", pkg, perDir), page)) {
+		return nil
+	}
+
+	// See writeResults for why the page is rendered before sending it.
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for idx, d := range dirs[start:end] {
+		if idx > 0 {
+			buf.WriteString(",")
+		}
+		pkgJSON, _ := json.Marshal(pkg)
+		dirJSON, _ := json.Marshal(d.dir)
+		fmt.Fprintf(&buf, `{"Package": %s, "Directory": %s, "Count": %d, "Results":`, pkgJSON, dirJSON, d.count)
+		pointers := d.pointers
+		if len(pointers) > perDir {
+			pointers = pointers[:perDir]
+		}
+		if err := writeFromPointers(queryid, &buf, pointers); err != nil {
+			markQueryCorrupt(queryid, err)
+			return fmt.Errorf("Could not return results, please retry the query: %v", err)
+		}
+		buf.WriteString("}")
+	}
+	buf.WriteString("]")
+	startJsonResponse(w)
+	_, err := results.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTopLevelDir(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"linux_6.1.4-1/drivers/net/tun.c", "drivers"},
+		{"linux_6.1.4-1/kernel/fork.c", "kernel"},
+		{"linux_6.1.4-1/Makefile", ""},
+		{"i3-wm_4.16-1", ""},
+	} {
+		if got := topLevelDir(tt.path); got != tt.want {
+			t.Errorf("topLevelDir(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestDirGroups(t *testing.T) {
+	defer func(old int) { *resultsPerPackage = old }(*resultsPerPackage)
+	*resultsPerPackage = 2
+
+	pointer := func(offset int64, dir string) resultPointer {
+		return resultPointer{offset: offset, dir: &dir}
+	}
+	groups := make(dirGroups)
+	groups.add("linux", pointer(0, "kernel"))
+	groups.add("linux", pointer(1, "drivers"))
+	groups.add("linux", pointer(2, "drivers"))
+	groups.add("linux", pointer(3, "drivers"))
+	groups.add("linux", pointer(4, ""))
+	groups.add("i3-wm", pointer(5, "src"))
+
+	sorted := groups.sorted()
+	var got []string
+	for _, d := range sorted["linux"] {
+		got = append(got, d.dir)
+	}
+	if want := []string{"drivers", "", "kernel"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected directory order: got %q, want %q", got, want)
+	}
+	drivers := sorted["linux"][0]
+	if got, want := drivers.count, 3; got != want {
+		t.Errorf("unexpected count: got %d, want %d", got, want)
+	}
+	if got, want := len(drivers.pointers), 2; got != want {
+		t.Fatalf("unexpected number of pointers: got %d, want %d", got, want)
+	}
+	if drivers.pointers[0].offset != 1 || drivers.pointers[1].offset != 2 {
+		t.Errorf("pointers not kept in ranking order: %+v", drivers.pointers)
+	}
+	if got, want := len(sorted["i3-wm"]), 1; got != want {
+		t.Errorf("unexpected number of i3-wm directories: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// forgetQuery closes the storage of the query and deletes its state, so that
+// other tests can start it again.
+func forgetQuery(queryid string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	state[queryid].storage.Close()
+	delete(state, queryid)
+}
+
+// runQuery starts the query on the source backends (see useFakeBackends),
+// waits until it is done and returns its queryid and a function which deletes
+// the query.
+func runQuery(t *testing.T, query string) (string, func()) {
+	queryid := queryIdentifier(query)
+	cached, err := maybeStartQuery(context.Background(), queryid, "test", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached {
+		t.Fatalf("query %q unexpectedly cached", query)
+	}
+	cleanup := func() { forgetQuery(queryid) }
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lastseen := -1
+		for {
+			message, sequence := getEvent(queryid, lastseen)
+			lastseen = sequence
+			if len(message.data) == 0 {
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		cleanup()
+		t.Fatalf("query %q not done within 10s", query)
+	}
+	return queryid, cleanup
+}
+
+type perPackageResults []struct {
+	Package string
+	Results []struct {
+		Path string `json:"path"`
+	}
+}
+
+// perPackagePaths requests the specified page of per-package results and
+// returns the paths of the results of each package.
+func perPackagePaths(t *testing.T, queryid, page string) map[string][]string {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/perpackage-results/"+queryid+"/2/page_"+page+".json", nil)
+	PerPackageResultsHandler(rec, req)
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("%s: unexpected HTTP status: got %d, want %d (body: %s)", req.URL.Path, got, want, rec.Body.String())
+	}
+	var results perPackageResults
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("%s: %v (body: %s)", req.URL.Path, err, rec.Body.String())
+	}
+	paths := make(map[string][]string)
+	for _, pkg := range results {
+		for _, result := range pkg.Results {
+			paths[pkg.Package] = append(paths[pkg.Package], result.Path)
+		}
+	}
+	return paths
+}
+
+func TestPipeline(t *testing.T) {
+	defer useFakeBackends(t,
+		newFakeBackend(
+			"i3-wm_4.8-1/i3bar/src/main.c",
+			"i3-wm_4.8-1/src/main.c",
+			"i3-wm_4.8-1/i3-config-wizard/main.c",
+			"zsh_5.7.1-1/Src/main.c"),
+		newFakeBackend(
+			"i3-wm_4.7.2-1/src/main.c",
+			"coreutils_8.30-3/src/ls.c",
+			"zsh_5.8-1/Src/main.c"),
+	)()
+
+	queryid, cleanup := runQuery(t, "q=main&literal=0")
+	defer cleanup()
+
+	stateMu.RLock()
+	s := state[queryid]
+	stateMu.RUnlock()
+	if got, want := s.errorType, ""; got != want {
+		t.Errorf("errorType = %q, want %q", got, want)
+	}
+	if got, want := s.numResults(), 7; got != want {
+		t.Errorf("numResults = %d, want %d", got, want)
+	}
+
+	// Only results in the newest version of each package are shown, at
+	// most 2 per package (in order of their ranking).
+	want := map[string][]string{
+		"i3-wm": {
+			"i3-wm_4.8-1/i3bar/src/main.c",
+			"i3-wm_4.8-1/src/main.c",
+		},
+		"coreutils": {"coreutils_8.30-3/src/ls.c"},
+		"zsh":       {"zsh_5.8-1/Src/main.c"},
+	}
+	if got := perPackagePaths(t, queryid, "0"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("per-package results: got %v, want %v", got, want)
+	}
+}
+
+func TestPipelinePerPackageSummary(t *testing.T) {
+	defer useFakeBackends(t,
+		newFakeBackend(
+			"i3-wm_4.8-1/i3bar/src/main.c",
+			"i3-wm_4.8-1/src/main.c",
+			"i3-wm_4.8-1/i3-config-wizard/main.c",
+			"zsh_5.7.1-1/Src/main.c"),
+	)()
+
+	queryid, cleanup := runQuery(t, "q=main&literal=1")
+	defer cleanup()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/perpackage-results/"+queryid+"/2/page_0.json", nil)
+	PerPackageResultsHandler(rec, req)
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+	}
+	var results []PerPackageResults
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("%v (body: %s)", err, rec.Body.String())
+	}
+	for _, pkg := range results {
+		if pkg.Package != "i3-wm" {
+			continue
+		}
+		if got, want := pkg.ShownResults, 2; got != want {
+			t.Errorf("ShownResults = %d, want %d", got, want)
+		}
+		if got, want := pkg.TotalResults, 3; got != want {
+			t.Errorf("TotalResults = %d, want %d", got, want)
+		}
+		if pkg.Ranking.Best <= 0 || pkg.Ranking.Mean > pkg.Ranking.Best {
+			t.Errorf("implausible ranking summary: %+v", pkg.Ranking)
+		}
+		return
+	}
+	t.Fatalf("package i3-wm not found in per-package results: %s", rec.Body.String())
+}
+
+func TestSummarizeRankings(t *testing.T) {
+	got := summarizeRankings([]resultPointer{{ranking: 0.5}, {ranking: 0.75}, {ranking: 0.25}})
+	if want := (RankingSummary{Best: 0.75, Mean: 0.5}); got != want {
+		t.Errorf("summarizeRankings = %+v, want %+v", got, want)
+	}
+	if got := summarizeRankings(nil); got != (RankingSummary{}) {
+		t.Errorf("summarizeRankings(nil) = %+v, want zero", got)
+	}
+}
+
+func TestPipelineBackendFailure(t *testing.T) {
+	failing := newFakeBackend(
+		"i3-wm_4.8-1/i3bar/src/main.c",
+		"i3-wm_4.8-1/src/main.c")
+	failing.failAfter = 2 // one match and one progress update
+	defer useFakeBackends(t,
+		failing,
+		newFakeBackend("zsh_5.8-1/Src/main.c"),
+	)()
+
+	queryid, cleanup := runQuery(t, "q=main&literal=1")
+	defer cleanup()
+
+	stateMu.RLock()
+	s := state[queryid]
+	stateMu.RUnlock()
+	if got, want := s.errorType, errorTypePartialResults; got != want {
+		t.Errorf("errorType = %q, want %q", got, want)
+	}
+
+	// The results received before the backend failed are still served.
+	want := map[string][]string{
+		"i3-wm": {"i3-wm_4.8-1/i3bar/src/main.c"},
+		"zsh":   {"zsh_5.8-1/Src/main.c"},
+	}
+	if got := perPackagePaths(t, queryid, "0"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("per-package results: got %v, want %v", got, want)
+	}
+}
+
+func TestPipelineNoResults(t *testing.T) {
+	defer useFakeBackends(t, newFakeBackend(), newFakeBackend())()
+
+	queryid, cleanup := runQuery(t, "q=nonexistent&literal=1")
+	defer cleanup()
+
+	stateMu.RLock()
+	s := state[queryid]
+	stateMu.RUnlock()
+	var types []string
+	for _, ev := range s.events {
+		var msg struct {
+			Type    string
+			QueryId string
+		}
+		if err := json.Unmarshal(ev.data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == eventTypeNoResults && msg.QueryId != queryid {
+			t.Errorf("noresults event: QueryId = %q, want %q", msg.QueryId, queryid)
+		}
+		types = append(types, msg.Type)
+	}
+	var noresults, pagination int
+	for _, typ := range types {
+		switch typ {
+		case eventTypeNoResults:
+			noresults++
+		case eventTypePagination:
+			pagination++
+		}
+	}
+	if noresults != 1 || pagination != 0 {
+		t.Errorf("events %v: got %d noresults and %d pagination events, want 1 and 0", types, noresults, pagination)
+	}
+
+	// The empty result pages are served like any others, including an ETag.
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/results/" + queryid + "/page_0.json", "[]"},
+		{"/results/" + queryid + "/packages.json", `{"Packages":[]}`},
+	} {
+		rec := httptest.NewRecorder()
+		ResultsHandler(rec, httptest.NewRequest("GET", tt.path, nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Fatalf("%s: unexpected HTTP status: got %d, want %d (body: %s)", tt.path, got, want, rec.Body.String())
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.path, got, tt.want)
+		}
+	}
+	if pageETag(queryid, "page", 0) == "" {
+		t.Errorf("page_0.json of a query without results has no ETag")
+	}
+}
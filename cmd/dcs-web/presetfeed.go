@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/google/renameio"
+)
+
+// Each preset can be subscribed to in a feed reader using the Atom feed at
+// /api/v1/presets/<name>/feed, whose entries are the matches which are new in
+// the current index generation (see -index_generation), i.e. which were not
+// found on the previous one.
+//
+// Results of older generations are not kept (see reloadQuery), so the first
+// feed request of every generation stores the fingerprints (see
+// matchFingerprint) of the preset’s matches. Until fingerprints of a previous
+// generation were stored, the feed has no entries.
+
+// feedsDir is the directory within -query_results_path which contains the
+// stored fingerprints of the presets. Its name cannot clash with a query id.
+const feedsDir = "_feeds"
+
+// maxFeedEntries is the maximum number of entries of a preset feed. Further
+// new matches are only counted (see opensearch:totalResults).
+const maxFeedEntries = 100
+
+// A feedSnapshot contains the fingerprints of the matches of a preset on one
+// index generation.
+type feedSnapshot struct {
+	Generation int
+
+	// Recorded is when the snapshot was stored, which is used as the time
+	// at which the matches of the generation were published.
+	Recorded time.Time
+
+	Fingerprints []string
+}
+
+// presetFeedState is stored in feedsDir for each preset.
+type presetFeedState struct {
+	// Query is the query of the preset (see preset.q) when the snapshots
+	// were stored. Snapshots of a different query are discarded.
+	Query string
+
+	// Snapshots contains the snapshots of the current and of the previous
+	// generation (if known), oldest first.
+	Snapshots []feedSnapshot
+}
+
+// feedsMu serializes reading and writing preset feed files.
+var feedsMu sync.Mutex
+
+// presetFeedPath returns the path of the file containing the state of the
+// feed of the preset name. Names are hashed as they are not restricted to
+// characters which are safe in file names.
+func presetFeedPath(name string) string {
+	return filepath.Join(*queryResultsPath, feedsDir, hashString(name)+".json")
+}
+
+func readPresetFeedLocked(name string) (presetFeedState, error) {
+	var st presetFeedState
+	b, err := ioutil.ReadFile(presetFeedPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return st, err
+	}
+	err = json.Unmarshal(b, &st)
+	return st, err
+}
+
+func writePresetFeedLocked(name string, st presetFeedState) error {
+	path := presetFeedPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(&st)
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(path, b, 0644)
+}
+
+// recordFeedSnapshot stores the fingerprints of the matches of the preset p on
+// the current index generation, unless they were stored already, and returns
+// the snapshot of the current generation and, if known, the snapshot of the
+// previous generation.
+func recordFeedSnapshot(p preset, fps map[string]bool) (current feedSnapshot, previous *feedSnapshot, _ error) {
+	feedsMu.Lock()
+	defer feedsMu.Unlock()
+	st, err := readPresetFeedLocked(p.Name)
+	if err != nil {
+		return current, nil, err
+	}
+	if st.Query != p.q() {
+		st = presetFeedState{Query: p.q()}
+	}
+	// Only keep snapshots of older generations, in case the generation was
+	// reset.
+	snapshots := st.Snapshots[:0]
+	found := false
+	for _, snapshot := range st.Snapshots {
+		if snapshot.Generation == *indexGeneration {
+			found = true
+		}
+		if snapshot.Generation <= *indexGeneration {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	if !found {
+		snapshot := feedSnapshot{
+			Generation:   *indexGeneration,
+			Recorded:     time.Now(),
+			Fingerprints: make([]string, 0, len(fps)),
+		}
+		for fp := range fps {
+			snapshot.Fingerprints = append(snapshot.Fingerprints, fp)
+		}
+		sort.Strings(snapshot.Fingerprints)
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Generation < snapshots[j].Generation
+	})
+	if len(snapshots) > 2 {
+		snapshots = snapshots[len(snapshots)-2:]
+	}
+	st.Snapshots = snapshots
+	if !found {
+		if err := writePresetFeedLocked(p.Name, st); err != nil {
+			return current, nil, err
+		}
+	}
+	current = snapshots[len(snapshots)-1]
+	if len(snapshots) > 1 {
+		previous = &snapshots[0]
+	}
+	return current, previous, nil
+}
+
+// presetFeedHandler serves /api/v1/presets/<name>/feed (see PresetsHandler),
+// the Atom feed of the matches of the preset p which are new in the current
+// index generation.
+func presetFeedHandler(w http.ResponseWriter, r *http.Request, p preset) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	q := p.q()
+	queryid := queryIdentifier(q)
+	defer pinQuery(queryid)()
+	if _, err := maybeStartQuery(withPriority(r.Context(), priorityBatch), queryid, r.RemoteAddr, q); err != nil {
+		log.Printf("[%s] could not start query: %v\n", r.RemoteAddr, err)
+		http.Error(w, "Could not start query.", http.StatusInternalServerError)
+		return
+	}
+	if !waitForQuery(r, queryid) {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Query not finished yet, please retry.", http.StatusServiceUnavailable)
+		return
+	}
+
+	s, msg, code := completedQuery(queryid)
+	if code != http.StatusOK {
+		http.Error(w, msg, code)
+		return
+	}
+	fps, err := fingerprints(queryid, s.resultPointers)
+	if err != nil {
+		log.Printf("[%s] could not read results: %v\n", queryid, err)
+		http.Error(w, "Could not read results, please retry.", http.StatusInternalServerError)
+		return
+	}
+	current, previous, err := recordFeedSnapshot(p, fps)
+	if err != nil {
+		log.Printf("[%s] could not store feed of preset %q: %v\n", queryid, p.Name, err)
+		http.Error(w, "Could not store feed state.", http.StatusInternalServerError)
+		return
+	}
+
+	base := baseURL(r)
+	feedURL := base + "/api/v1/presets/" + url.PathEscape(p.Name) + "/feed"
+	updated := current.Recorded.UTC().Format(time.RFC3339)
+	feed := atomFeed{
+		XMLNSOS: "http://a9.com/-/spec/opensearch/1.1/",
+		Title:   fmt.Sprintf("Debian Code Search: new matches of preset %s", p.Name),
+		ID:      feedURL,
+		Updated: updated,
+		Links: []atomLink{
+			{Href: feedURL, Rel: "self", Type: "application/atom+xml"},
+			{Href: base + "/search?" + q, Rel: "alternate", Type: "text/html"},
+		},
+		StartIndex: 1,
+		Query:      opensearchQuery{Role: "request", SearchTerms: p.Query},
+	}
+	if previous != nil {
+		known := make(map[string]bool, len(previous.Fingerprints))
+		for _, fp := range previous.Fingerprints {
+			known[fp] = true
+		}
+		err := forEachMatch(queryid, s.resultPointers, func(idx int, match *sourcebackendpb.Match) error {
+			fp := matchFingerprint(match)
+			// Snapshots recorded before fingerprintVersion contain
+			// legacy fingerprints.
+			if known[fp] || known[legacyMatchFingerprint(match)] {
+				return nil
+			}
+			// Duplicate fingerprints (identical lines within a file) are
+			// only listed once.
+			known[fp] = true
+			feed.TotalResults++
+			if len(feed.Entries) >= maxFeedEntries {
+				return nil
+			}
+			feed.Entries = append(feed.Entries, atomEntry{
+				Title:   fmt.Sprintf("%s:%d", match.Path, match.Line),
+				ID:      fmt.Sprintf("%s/%d/%s", feedURL, current.Generation, fp),
+				Updated: updated,
+				Link:    atomLink{Href: showURL(base, match)},
+				// Matches are HTML-escaped by the source backends.
+				Content: html.UnescapeString(match.Context),
+			})
+			return nil
+		})
+		if err != nil {
+			log.Printf("[%s] could not read results: %v\n", queryid, err)
+			http.Error(w, "Could not read results, please retry.", http.StatusInternalServerError)
+			return
+		}
+	}
+	feed.ItemsPerPage = len(feed.Entries)
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(&feed); err != nil {
+		log.Printf("[%s] could not write feed of preset %q: %v\n", queryid, p.Name, err)
+	}
+}
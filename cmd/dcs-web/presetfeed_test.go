@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPresetFeed(t *testing.T) {
+	b := newFakeBackend(
+		"i3-wm_4.8-1/i3bar/src/main.c",
+		"zsh_5.8-1/Src/main.c")
+	defer useFakeBackends(t, b)()
+	defer func(generation int) { *indexGeneration = generation }(*indexGeneration)
+	p := preset{Name: "main", Query: "main", Literal: true}
+	presetsMu.Lock()
+	oldPresets := presets
+	presets = map[string]preset{p.Name: p}
+	presetsMu.Unlock()
+	defer func() {
+		presetsMu.Lock()
+		defer presetsMu.Unlock()
+		presets = oldPresets
+	}()
+	var queryids []string
+	defer func() {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		for _, queryid := range queryids {
+			if s, ok := state[queryid]; ok {
+				s.storage.Close()
+				delete(state, queryid)
+			}
+		}
+	}()
+
+	type feed struct {
+		Updated string `xml:"updated"`
+		Total   int    `xml:"totalResults"`
+		Entries []struct {
+			Title string `xml:"title"`
+			ID    string `xml:"id"`
+		} `xml:"entry"`
+	}
+	get := func() feed {
+		t.Helper()
+		queryids = append(queryids, queryIdentifier(p.q()))
+		rec := httptest.NewRecorder()
+		PresetsHandler(rec, httptest.NewRequest("GET", "http://codesearch.example/api/v1/presets/main/feed", nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+		}
+		var f feed
+		if err := xml.Unmarshal(rec.Body.Bytes(), &f); err != nil {
+			t.Fatalf("%v (body: %s)", err, rec.Body.String())
+		}
+		return f
+	}
+
+	// Without a previous generation, no matches are known to be new.
+	if f := get(); len(f.Entries) != 0 {
+		t.Errorf("feed on the first generation has entries %+v, want none", f.Entries)
+	}
+
+	// The new index contains a newer version of i3-wm and a new package.
+	b.replies = newFakeBackend(
+		"i3-wm_4.16-1/i3bar/src/main.c",
+		"zsh_5.8-1/Src/main.c",
+		"bash_5.0-4/shell.c").replies
+	*indexGeneration++
+	f := get()
+	if got, want := f.Total, 1; got != want {
+		t.Errorf("totalResults = %d, want %d", got, want)
+	}
+	if len(f.Entries) != 1 || f.Entries[0].Title != "bash_5.0-4/shell.c:3" {
+		t.Fatalf("feed entries = %+v, want only bash_5.0-4/shell.c:3", f.Entries)
+	}
+
+	// Polling the feed again does not change it.
+	again := get()
+	if again.Updated != f.Updated || len(again.Entries) != 1 || again.Entries[0].ID != f.Entries[0].ID {
+		t.Errorf("feed changed on the same generation: got %+v, want %+v", again, f)
+	}
+
+	rec := httptest.NewRecorder()
+	PresetsHandler(rec, httptest.NewRequest("GET", "/api/v1/presets/unknown/feed", nil))
+	if got, want := rec.Code, http.StatusNotFound; got != want {
+		t.Errorf("unknown preset: unexpected HTTP status: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	presetsPath = flag.String("presets_path",
+		"",
+		"Path to a JSON file containing additional query presets (a list of objects with Name, Description, Query and Literal). Presets with the same name as a built-in preset replace the built-in one.")
+)
+
+// A preset is a named, curated query which can be run by name, e.g. to find
+// common uses of dangerous APIs.
+type preset struct {
+	Name        string
+	Description string
+	Query       string
+	Literal     bool
+
+	// Force starts the query even if it exceeds -max_regexp_complexity.
+	Force bool
+}
+
+// q returns the query string which is used to identify and start the query,
+// in the same format that EventsHandler uses.
+func (p *preset) q() string {
+	literal := "0"
+	if p.Literal {
+		literal = "1"
+	}
+	q := "q=" + url.QueryEscape(p.Query) + "&literal=" + literal
+	if p.Force {
+		q += "&force=1"
+	}
+	return q
+}
+
+var builtinPresets = []preset{
+	{
+		Name:        "gets",
+		Description: "Calls to gets(3), which cannot be used safely.",
+		Query:       `\bgets\s*\( filetype:c`,
+	},
+	{
+		Name:        "strcpy",
+		Description: "Calls to strcpy(3) and strcat(3), which do not check the destination buffer size.",
+		Query:       `\bstr(cpy|cat)\s*\( filetype:c`,
+	},
+	{
+		Name:        "sprintf",
+		Description: "Calls to sprintf(3) and vsprintf(3), which do not check the destination buffer size.",
+		Query:       `\bv?sprintf\s*\( filetype:c`,
+	},
+	{
+		Name:        "go-insecure-skip-verify",
+		Description: "Go code which disables TLS certificate verification.",
+		Query:       `InsecureSkipVerify:\s*true filetype:go`,
+	},
+	{
+		Name:        "curl-ssl-verifypeer",
+		Description: "libcurl users which disable TLS certificate verification.",
+		Query:       `CURLOPT_SSL_VERIFY(PEER|HOST)\s*,\s*(0|false|FALSE)`,
+	},
+	{
+		Name:        "python-verify-false",
+		Description: "Python code which disables TLS certificate verification in requests.",
+		Query:       `verify\s*=\s*False filetype:python`,
+	},
+	{
+		Name:        "ssl-cert-none",
+		Description: "Python code which disables TLS certificate verification in the ssl module.",
+		Query:       `ssl.CERT_NONE filetype:python`,
+		Literal:     true,
+	},
+}
+
+var (
+	presets   = make(map[string]preset)
+	presetsMu sync.RWMutex
+)
+
+// loadPresets initializes the presets from builtinPresets and, if non-empty,
+// the JSON file at path.
+func loadPresets(path string) error {
+	loaded := make(map[string]preset, len(builtinPresets))
+	for _, p := range builtinPresets {
+		loaded[p.Name] = p
+	}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var custom []preset
+		if err := json.NewDecoder(f).Decode(&custom); err != nil {
+			return fmt.Errorf("could not decode %q: %v", path, err)
+		}
+		for _, p := range custom {
+			if p.Name == "" || p.Query == "" {
+				return fmt.Errorf("%q: presets must have a Name and a Query (got %+v)", path, p)
+			}
+			loaded[p.Name] = p
+		}
+	}
+	for name, p := range loaded {
+		if err := validateQuery("?" + p.q()); err != nil {
+			return fmt.Errorf("preset %q: invalid query %q: %v", name, p.Query, err)
+		}
+	}
+	presetsMu.Lock()
+	defer presetsMu.Unlock()
+	presets = loaded
+	return nil
+}
+
+// PresetsHandler serves /api/v1/presets (a JSON list of all presets),
+// /api/v1/presets/<name>, which starts the preset’s query and returns where
+// its results can be found, and /api/v1/presets/<name>/feed, an Atom feed of
+// the preset’s new matches (see presetFeedHandler). Presets are shared by all
+// clients, so their queries run without a tenant, and requests carrying an
+// API key are refused.
+func PresetsHandler(w http.ResponseWriter, r *http.Request) {
+	if rejectAPIKey(w, r) {
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/presets"), "/")
+	feed := strings.HasSuffix(name, "/feed")
+	name = strings.TrimSuffix(name, "/feed")
+
+	if name == "" {
+		presetsMu.RLock()
+		list := make([]preset, 0, len(presets))
+		for _, p := range presets {
+			list = append(list, p)
+		}
+		presetsMu.RUnlock()
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Name < list[j].Name
+		})
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct{ Presets []preset }{list}); err != nil {
+			http.Error(w, fmt.Sprintf("Could not encode presets: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	presetsMu.RLock()
+	p, ok := presets[name]
+	presetsMu.RUnlock()
+	if !ok {
+		http.Error(w, "No such preset.", http.StatusNotFound)
+		return
+	}
+	if feed {
+		presetFeedHandler(w, r, p)
+		return
+	}
+
+	q := p.q()
+	queryid := queryIdentifier(q)
+	log.Printf("[%s] running preset %q (%q)\n", r.RemoteAddr, name, q)
+	if _, err := maybeStartQuery(withPriority(r.Context(), priorityBatch), queryid, r.RemoteAddr, q); err != nil {
+		log.Printf("[%s] could not start query: %v\n", r.RemoteAddr, err)
+		http.Error(w, "Could not start query", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Preset  preset
+		QueryId string
+		Events  string
+		Results string
+		Feed    string
+	}{
+		Preset:  p,
+		QueryId: queryid,
+		Events:  "/events/?" + q,
+		Results: "/results/" + queryid + "/page_0.json",
+		Feed:    "/api/v1/presets/" + url.PathEscape(name) + "/feed",
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("Could not encode response: %v", err), http.StatusInternalServerError)
+	}
+}
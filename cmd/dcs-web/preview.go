@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+var paginationPreviewResults = flag.Int("pagination_preview_results",
+	5,
+	"Number of top results which are included in pagination events (see Pagination.Preview), so that clients can display them before the first page of results is loaded. 0 disables the preview")
+
+// previewContextLen is the maximum number of characters of the matching line
+// which are included in a PreviewResult.
+const previewContextLen = 160
+
+// PreviewResult is a compact version of a result, as included in pagination
+// events. The field names match those of the results on result pages.
+type PreviewResult struct {
+	Path string `json:"path"`
+	Line uint32 `json:"line"`
+
+	// Context is the (HTML-escaped) matching line, shortened to at most
+	// previewContextLen characters.
+	Context  string  `json:"context"`
+	Pathrank float32 `json:"pathrank"`
+	Ranking  float32 `json:"ranking"`
+}
+
+// trimContext shortens the HTML-escaped line s to at most n characters,
+// without cutting an HTML entity in half.
+func trimContext(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	cut := 0
+	for i := 0; i < n; i++ {
+		_, size := utf8.DecodeRuneInString(s[cut:])
+		cut += size
+	}
+	s = s[:cut]
+	if amp := strings.LastIndexByte(s, '&'); amp > strings.LastIndexByte(s, ';') {
+		s = s[:amp]
+	}
+	return s + "…"
+}
+
+// paginationPreview returns the preview of the top results of the query,
+// which pointers must be sorted by ranking.
+func paginationPreview(queryid string, pointers []resultPointer) []PreviewResult {
+	if *paginationPreviewResults <= 0 || len(pointers) == 0 {
+		return nil
+	}
+	if len(pointers) > *paginationPreviewResults {
+		pointers = pointers[:*paginationPreviewResults]
+	}
+	preview := make([]PreviewResult, 0, len(pointers))
+	err := forEachMatch(queryid, pointers, func(idx int, match *sourcebackendpb.Match) error {
+		preview = append(preview, PreviewResult{
+			Path:     match.Path,
+			Line:     match.Line,
+			Context:  trimContext(match.Context, previewContextLen),
+			Pathrank: match.Pathrank,
+			Ranking:  match.Ranking,
+		})
+		return nil
+	})
+	if err != nil {
+		// The preview is optional, clients load the first page anyway.
+		log.Printf("[%s] could not read preview results: %v\n", queryid, err)
+		return nil
+	}
+	return preview
+}
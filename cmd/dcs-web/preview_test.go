@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestTrimContext(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"int main() {", 20, "int main() {"},
+		{"int main(int argc) {", 8, "int main…"},
+		{"if (a &amp;&amp; b) {", 11, "if (a &amp;…"},
+		{"if (a &amp;&amp; b) {", 9, "if (a …"},
+		{"grüße, welt", 5, "grüße…"},
+	} {
+		if got := trimContext(tt.in, tt.n); got != tt.want {
+			t.Errorf("trimContext(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	maxConcurrentBatchQueries = flag.Int("max_concurrent_batch_queries",
+		0,
+		"Maximum number of batch queries (see the priority= parameter) which are sent to the source backends at the same time, so that interactive queries find a free slot (see -max_concurrent_queries). 0 means up to -max_concurrent_queries")
+
+	batchLimitsFactor = flag.Float64("batch_limits_factor",
+		4,
+		"Factor by which -query_timeout, -backend_timeout, -max_query_result_bytes and -broad_query_max_results are multiplied for batch queries (see the priority= parameter), which nobody is waiting for interactively")
+)
+
+// queryPriority determines how a query is scheduled. Interactive queries are
+// admitted before queued batch queries, whereas batch queries (e.g. started
+// via the API or from presets) get relaxed deadlines and result caps.
+type queryPriority int
+
+const (
+	priorityInteractive queryPriority = iota
+	priorityBatch
+)
+
+func (p queryPriority) String() string {
+	if p == priorityBatch {
+		return "batch"
+	}
+	return "interactive"
+}
+
+// parsePriority parses the priority= parameter. The empty string means
+// interactive.
+func parsePriority(s string) (queryPriority, error) {
+	switch s {
+	case "", "interactive":
+		return priorityInteractive, nil
+	case "batch":
+		return priorityBatch, nil
+	default:
+		return priorityInteractive, fmt.Errorf("priority must be interactive or batch")
+	}
+}
+
+// limitsFactor returns the factor by which deadlines and result caps are
+// multiplied for queries of priority p.
+func (p queryPriority) limitsFactor() float64 {
+	if p == priorityBatch {
+		return *batchLimitsFactor
+	}
+	return 1
+}
+
+// schedulingWeight returns the number of turns queries of priority p get for
+// each turn of a batch query, see fairScheduler.
+func (p queryPriority) schedulingWeight() int {
+	if p == priorityBatch || *interactiveWeight < 1 {
+		return 1
+	}
+	return *interactiveWeight
+}
+
+func (p queryPriority) scaleDuration(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * p.limitsFactor())
+}
+
+type priorityKey struct{}
+
+// withPriority returns a context for starting a query (see maybeStartQuery)
+// with priority p.
+func withPriority(ctx context.Context, p queryPriority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityFrom returns the priority set using withPriority, or interactive.
+func priorityFrom(ctx context.Context) queryPriority {
+	p, _ := ctx.Value(priorityKey{}).(queryPriority)
+	return p
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnqueueByPriority(t *testing.T) {
+	qs := &querySlots{running: make(map[string]queryPriority)}
+	qs.enqueue("batch1", priorityBatch)
+	qs.enqueue("interactive1", priorityInteractive)
+	qs.enqueue("batch2", priorityBatch)
+	qs.enqueue("interactive2", priorityInteractive)
+
+	var got []string
+	for _, q := range qs.queue {
+		got = append(got, q.queryid)
+	}
+	want := []string{"interactive1", "interactive2", "batch1", "batch2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected queue order: got %v, want %v", got, want)
+	}
+}
+
+func TestBatchSlots(t *testing.T) {
+	oldMax, oldBatch := *maxConcurrentQueries, *maxConcurrentBatchQueries
+	defer func() { *maxConcurrentQueries, *maxConcurrentBatchQueries = oldMax, oldBatch }()
+	*maxConcurrentQueries, *maxConcurrentBatchQueries = 3, 1
+
+	qs := &querySlots{running: make(map[string]queryPriority)}
+	if err := qs.acquire("batch1", priorityBatch); err != nil {
+		t.Fatal(err)
+	}
+	if qs.available(priorityBatch) {
+		t.Errorf("a second batch query got a slot despite -max_concurrent_batch_queries=1")
+	}
+	if !qs.available(priorityInteractive) {
+		t.Errorf("interactive query did not get a slot")
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    queryPriority
+		wantErr bool
+	}{
+		{"", priorityInteractive, false},
+		{"interactive", priorityInteractive, false},
+		{"batch", priorityBatch, false},
+		{"urgent", priorityInteractive, true},
+	} {
+		got, err := parsePriority(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePriority(%q): unexpected error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parsePriority(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// inlinePage0 returns the JSON encoding of p with the first page of results
+// inlined as Page0, so that clients which cannot receive pushed resources
+// do not need another round trip to display the results.
+func inlinePage0(queryid string, p *Pagination) []byte {
+	stateMu.RLock()
+	pointers := state[queryid].resultPointers
+	stateMu.RUnlock()
+	if len(pointers) > *resultsPerPage {
+		pointers = pointers[:*resultsPerPage]
+	}
+	var page0 bytes.Buffer
+	if err := writeFromPointers(queryid, &page0, pointers); err != nil {
+		log.Printf("[%s] could not inline page 0: %v\n", queryid, err)
+		return nil
+	}
+	b, err := json.Marshal(struct {
+		*Pagination
+		Page0 json.RawMessage
+	}{p, page0.Bytes()})
+	if err != nil {
+		log.Printf("[%s] could not inline page 0: %v\n", queryid, err)
+		return nil
+	}
+	return b
+}
+
+// pushOrInline is called before a pagination event is sent to a client. On
+// HTTP/2 connections, the first page of results and of per-package results
+// are pushed alongside the event. Otherwise, the returned data (which should
+// be sent instead of the original event data) contains page 0 inline.
+func pushOrInline(w http.ResponseWriter, queryid string, p *Pagination, data []byte) []byte {
+	pushed := false
+	if pusher, ok := w.(http.Pusher); ok {
+		pushed = true
+		for _, target := range []string{
+			"/results/" + queryid + "/page_0.json",
+			"/results/" + queryid + "/perpackage_" + strconv.Itoa(*resultsPerPackage) + "_page_0.json",
+		} {
+			if err := pusher.Push(target, nil); err != nil {
+				if err != http.ErrNotSupported {
+					log.Printf("[%s] could not push %q: %v\n", queryid, target, err)
+				}
+				pushed = false
+				break
+			}
+		}
+	}
+	if pushed {
+		return data
+	}
+	if inlined := inlinePage0(queryid, p); inlined != nil {
+		return inlined
+	}
+	return data
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Debian/dcs/internal/faultinject"
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+// fakePaths returns n paths in different versions of the same package.
+func fakePaths(n int) []string {
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("i3-wm_4.%d-1/src/main.c", i)
+	}
+	return paths
+}
+
+// queryFakeBackend runs queryBackend against backend, injecting faults into
+// the connection, and returns the final query state.
+func queryFakeBackend(t *testing.T, queryid string, backend *fakeBackend, faults faultinject.Faults) queryState {
+	dir, err := ioutil.TempDir("", "dcs-querybackend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldPath, oldStore := *queryResultsPath, store
+	*queryResultsPath, store = dir, fileStore{}
+	defer func() { *queryResultsPath, store = oldPath, oldStore }()
+
+	if err := os.MkdirAll(filepath.Join(dir, queryid), 0755); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := store.Create(queryid, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	querystate := newQueryState("q="+queryid, "q="+queryid, 1)
+	querystate.storage = storage
+	stateMu.Lock()
+	state[queryid] = querystate
+	stateMu.Unlock()
+	defer forgetQuery(queryid)
+
+	client, cleanup := backend.dial(faults)
+	defer cleanup()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		queryBackend(context.Background(), queryid, "test", client, 0, &sourcebackendpb.SearchRequest{
+			Query: queryid,
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("queryBackend did not return within 10s (faults: %v)", faults)
+	}
+
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return state[queryid]
+}
+
+// firstError returns the first Error event of the query, if any.
+func firstError(s queryState) *Error {
+	for _, ev := range s.events {
+		var e Error
+		if err := json.Unmarshal(ev.data, &e); err != nil || e.Type != eventTypeError {
+			continue
+		}
+		return &e
+	}
+	return nil
+}
+
+func failingFakeBackend(paths []string, failAfter int) *fakeBackend {
+	b := newFakeBackend(paths...)
+	b.failAfter = failAfter
+	return b
+}
+
+func TestQueryBackendFaults(t *testing.T) {
+	oldTimeout := *backendTimeout
+	defer func() { *backendTimeout = oldTimeout }()
+	*backendTimeout = 2 * time.Second
+
+	for _, tt := range []struct {
+		name    string
+		backend *fakeBackend
+		faults  string
+		// wantReason is the Reason of the query’s “partialresults”
+		// error, or empty if the query must succeed.
+		wantReason string
+	}{
+		{
+			name:    "ok",
+			backend: newFakeBackend(fakePaths(100)...),
+		},
+		{
+			name:    "trickle",
+			backend: newFakeBackend(fakePaths(100)...),
+			faults:  "trickle=1024/1ms",
+		},
+		{
+			name:       "reset",
+			backend:    newFakeBackend(fakePaths(100)...),
+			faults:     "reset_after=2048",
+			wantReason: "backendunavailable",
+		},
+		{
+			name:       "truncated",
+			backend:    newFakeBackend(fakePaths(100)...),
+			faults:     "truncate_after=2048",
+			wantReason: "backendunavailable",
+		},
+		{
+			name:       "backenderror",
+			backend:    failingFakeBackend(fakePaths(100), 100),
+			wantReason: "backendunavailable",
+		},
+		{
+			name:       "timeout",
+			backend:    newFakeBackend(fakePaths(100)...),
+			faults:     "delay=3s",
+			wantReason: "backendtimeout",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			faults, err := faultinject.Parse(tt.faults)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := queryFakeBackend(t, "faults-"+tt.name, tt.backend, faults)
+
+			wantError := ""
+			if tt.wantReason != "" {
+				wantError = errorTypePartialResults
+			}
+			if got, want := s.errorType, wantError; got != want {
+				t.Errorf("errorType = %q, want %q", got, want)
+			}
+			if ev := firstError(s); ev != nil && ev.Reason != tt.wantReason {
+				t.Errorf("Reason = %q, want %q", ev.Reason, tt.wantReason)
+			}
+			// Failed backends must not leave the query running forever.
+			if got, want := s.filesProcessed[0], s.filesTotal[0]; got != want {
+				t.Errorf("filesProcessed = %d, want %d (filesTotal)", got, want)
+			}
+			if tt.wantReason != "" {
+				return
+			}
+			if got, want := s.numResults(), 100; got != want {
+				t.Errorf("numResults = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestBackendDeadline(t *testing.T) {
+	oldShare := *backendDeadlineShare
+	defer func() { *backendDeadlineShare = oldShare }()
+	*backendDeadlineShare = 0.5
+
+	now := time.Now()
+	withDeadline, cancel := context.WithDeadline(context.Background(), now.Add(10*time.Second))
+	defer cancel()
+	for _, tt := range []struct {
+		name          string
+		ctx           context.Context
+		timeout       time.Duration
+		wantDeadline  time.Time
+		wantFromQuery bool
+	}{
+		{
+			name: "none",
+			ctx:  context.Background(),
+		},
+		{
+			name:         "timeout",
+			ctx:          context.Background(),
+			timeout:      2 * time.Second,
+			wantDeadline: now.Add(2 * time.Second),
+		},
+		{
+			name:          "query",
+			ctx:           withDeadline,
+			wantDeadline:  now.Add(5 * time.Second),
+			wantFromQuery: true,
+		},
+		{
+			name:          "query before timeout",
+			ctx:           withDeadline,
+			timeout:       8 * time.Second,
+			wantDeadline:  now.Add(5 * time.Second),
+			wantFromQuery: true,
+		},
+		{
+			name:         "timeout before query",
+			ctx:          withDeadline,
+			timeout:      2 * time.Second,
+			wantDeadline: now.Add(2 * time.Second),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			deadline, fromQuery := backendDeadline(tt.ctx, now, tt.timeout)
+			if !deadline.Equal(tt.wantDeadline) {
+				t.Errorf("deadline = %v, want %v", deadline, tt.wantDeadline)
+			}
+			if fromQuery != tt.wantFromQuery {
+				t.Errorf("fromQuery = %v, want %v", fromQuery, tt.wantFromQuery)
+			}
+		})
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Debian/dcs/stringpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	maxQueriesInMemory = flag.Int("max_queries_in_memory",
+		10,
+		"Number of queries whose state is kept in memory. When exceeded, finished queries which are not currently in use are evicted in least-recently-used order. Their results remain servable from -query_results_path")
+
+	queryPathRe = regexp.MustCompile(`^/(?:perpackage-|perdir-)?results/([^/]+)/`)
+
+	evictedQueries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "queries_evicted",
+			Help: "Number of finished queries whose state was evicted from memory.",
+		})
+
+	reloadedQueries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "queries_reloaded",
+			Help: "Number of evicted queries whose state was loaded from disk again.",
+		})
+
+	corruptQueries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "queries_corrupt",
+			Help: "Number of queries whose stored results were found to be corrupt (and will be re-run when requested again).",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(evictedQueries)
+	prometheus.MustRegister(reloadedQueries)
+	prometheus.MustRegister(corruptQueries)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "queries_in_memory",
+			Help: "Number of queries whose state is held in memory.",
+		},
+		func() float64 {
+			stateMu.RLock()
+			defer stateMu.RUnlock()
+			return float64(len(state))
+		}))
+}
+
+// queryUsage tracks which queries are in use (e.g. a client is streaming
+// events or a result page is being served) and when each query was last
+// accessed, so that evictQueriesLocked() evicts the least recently used query
+// which is not in use.
+//
+// Lock order: stateMu before queryUsage.mu.
+type queryUsage struct {
+	mu         sync.Mutex
+	refs       map[string]int
+	lastAccess map[string]time.Time
+}
+
+var usage = &queryUsage{
+	refs:       make(map[string]int),
+	lastAccess: make(map[string]time.Time),
+}
+
+// pinQuery marks the query as in use until the returned function is called.
+// The query does not need to exist (yet).
+func pinQuery(queryid string) func() {
+	usage.mu.Lock()
+	usage.refs[queryid]++
+	usage.lastAccess[queryid] = time.Now()
+	usage.mu.Unlock()
+	return func() {
+		stateMu.RLock()
+		_, exists := state[queryid]
+		usage.mu.Lock()
+		usage.refs[queryid]--
+		if usage.refs[queryid] == 0 {
+			delete(usage.refs, queryid)
+			if !exists {
+				delete(usage.lastAccess, queryid)
+			}
+		}
+		usage.mu.Unlock()
+		stateMu.RUnlock()
+	}
+}
+
+// evictQueriesLocked evicts finished, unused queries (in the order of
+// -gc_policy) until fewer than -max_queries_in_memory queries are in memory.
+// The caller must hold stateMu.
+func evictQueriesLocked() {
+	if len(state) < *maxQueriesInMemory {
+		return
+	}
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	var candidates []gcCandidate
+	for queryid, s := range state {
+		if !s.done || usage.refs[queryid] > 0 {
+			continue
+		}
+		lastAccess := s.ended
+		if t, ok := usage.lastAccess[queryid]; ok && t.After(lastAccess) {
+			lastAccess = t
+		}
+		var bytes int64
+		if s.storage != nil {
+			for idx := range s.perBackend {
+				bytes += s.storage.Size(idx)
+			}
+		}
+		candidates = append(candidates, gcCandidate{
+			QueryId:    queryid,
+			LastAccess: lastAccess,
+			Bytes:      bytes,
+		})
+	}
+	currentGCPolicy().order(candidates, time.Now())
+	for _, c := range candidates {
+		if len(state) < *maxQueriesInMemory {
+			break
+		}
+		log.Printf("[%s] evicting from memory (last accessed %v ago)\n", c.QueryId, time.Since(c.LastAccess))
+		state[c.QueryId].storage.Close()
+		delete(state, c.QueryId)
+		delete(usage.lastAccess, c.QueryId)
+		evictedQueries.Inc()
+	}
+	log.Printf("%d queries remaining in memory\n", len(state))
+}
+
+type persistedPointer struct {
+	Backend  int
+	Ranking  float32
+	Offset   int64
+	Length   int
+	PathHash uint64
+	Package  string
+	Dir      string
+}
+
+// persistedDir is the serialized representation of dirResults.
+type persistedDir struct {
+	Dir      string
+	Count    int
+	Pointers []persistedPointer
+}
+
+// persistedQuery is the serialized representation (see resultsStore.WriteIndex)
+// of the state of a
+// finished query which is needed for serving its results. The matches
+// themselves remain in the query’s results storage (see resultsStore).
+type persistedQuery struct {
+	Query         string
+	Started       time.Time
+	Ended         time.Time
+	FirstPathRank float32
+	Backends      int
+
+	// Generation is the -index_generation the query was run on.
+	Generation int
+
+	// Duration is how long the query ran, see queryState.duration. Zero
+	// for queries persisted by older versions.
+	Duration time.Duration
+
+	// Data of all events which were not obsoleted, including the final
+	// (empty) event.
+	Events [][]byte
+
+	// EventSequences are the sequence numbers of Events, which have gaps
+	// once events were obsoleted. Clients resume by sequence number (see
+	// resumeFrom), so they must survive reloading the query. Empty for
+	// queries persisted by older versions, whose events are renumbered.
+	EventSequences []int
+	NextSequence   int
+
+	Pointers          []persistedPointer
+	PointersByPkg     map[string][]persistedPointer
+	DirsByPkg         map[string][]persistedDir
+	AllPackagesSorted []string
+	ResultPages       int
+	ResultsDigest     string
+	Facets            facetCounts
+
+	CountOnly     bool
+	PackageCounts map[string]int
+
+	// Manifest describes the results storage of each backend as of when the
+	// query finished. Empty for queries persisted by older versions.
+	Manifest []storageManifest
+}
+
+// storageManifest describes the results stored for one backend, so that
+// reloadQuery can detect results storage which does not match the persisted
+// pointers, e.g. because dcs-web crashed before flushing, or the disk filled
+// up.
+type storageManifest struct {
+	Size int64
+	// CRC32 is only set (HasCRC32) for storage implementing
+	// checksummedResults.
+	CRC32    uint32
+	HasCRC32 bool
+}
+
+// newStorageManifest describes storage with the specified number of backends.
+func newStorageManifest(storage resultsStorage, backends int) ([]storageManifest, error) {
+	manifest := make([]storageManifest, backends)
+	for idx := range manifest {
+		manifest[idx].Size = storage.Size(idx)
+		if cr, ok := storage.(checksummedResults); ok {
+			crc, err := cr.Checksum(idx)
+			if err != nil {
+				return nil, err
+			}
+			manifest[idx].CRC32 = crc
+			manifest[idx].HasCRC32 = true
+		}
+	}
+	return manifest, nil
+}
+
+// verifyStorage returns an error if storage does not match manifest.
+func verifyStorage(storage resultsStorage, manifest []storageManifest) error {
+	for idx, want := range manifest {
+		if got := storage.Size(idx); got != want.Size {
+			return fmt.Errorf("backend %d: results storage has %d bytes, expected %d", idx, got, want.Size)
+		}
+		cr, ok := storage.(checksummedResults)
+		if !ok || !want.HasCRC32 {
+			continue
+		}
+		crc, err := cr.Checksum(idx)
+		if err != nil {
+			return err
+		}
+		if crc != want.CRC32 {
+			return fmt.Errorf("backend %d: results storage has checksum %08x, expected %08x", idx, crc, want.CRC32)
+		}
+	}
+	return nil
+}
+
+// markQueryCorrupt is called when the stored results of a query cannot be
+// read. The query is then treated like an expired query, i.e. it is re-run
+// the next time it is requested.
+func markQueryCorrupt(queryid string, err error) {
+	log.Printf("[%s] results are corrupt, query will be re-run: %v\n", queryid, err)
+	corruptQueries.Inc()
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s, ok := state[queryid]
+	if !ok {
+		return
+	}
+	s.corrupt = true
+	state[queryid] = s
+}
+
+func persistPointers(pointers []resultPointer) []persistedPointer {
+	result := make([]persistedPointer, len(pointers))
+	for idx, p := range pointers {
+		result[idx] = persistedPointer{
+			Backend:  p.backendidx,
+			Ranking:  p.ranking,
+			Offset:   p.offset,
+			Length:   p.length,
+			PathHash: p.pathHash,
+			Package:  *p.packageName,
+		}
+		if p.dir != nil {
+			result[idx].Dir = *p.dir
+		}
+	}
+	return result
+}
+
+func restorePointers(pool *stringpool.ShardedStringPool, pointers []persistedPointer) []resultPointer {
+	result := make([]resultPointer, len(pointers))
+	for idx, p := range pointers {
+		result[idx] = resultPointer{
+			backendidx:  p.Backend,
+			ranking:     p.Ranking,
+			offset:      p.Offset,
+			length:      p.Length,
+			pathHash:    p.PathHash,
+			packageName: pool.Get(p.Package),
+			dir:         pool.Get(p.Dir),
+		}
+	}
+	return result
+}
+
+// persistQuery stores the index of the specified (finished) query, so that its
+// results can be served after it was evicted from memory. The index of a
+// previous run of the query is removed by resultsStore.Create.
+func persistQuery(queryid string) error {
+	stateMu.RLock()
+	s := state[queryid]
+	pq := persistedQuery{
+		Query:             s.query,
+		Started:           s.started,
+		Generation:        s.generation,
+		Ended:             s.ended,
+		Duration:          s.duration,
+		FirstPathRank:     s.FirstPathRank,
+		Backends:          len(s.perBackend),
+		AllPackagesSorted: s.allPackagesSorted,
+		ResultPages:       s.resultPages,
+		ResultsDigest:     s.resultsDigest,
+		Facets:            s.facets,
+		CountOnly:         s.countOnly,
+		NextSequence:      s.nextSequence,
+	}
+	for _, ev := range s.events {
+		if *ev.obsolete {
+			continue
+		}
+		pq.Events = append(pq.Events, ev.data)
+		pq.EventSequences = append(pq.EventSequences, ev.sequence)
+	}
+	stateMu.RUnlock()
+
+	manifest, err := newStorageManifest(s.storage, len(s.perBackend))
+	if err != nil {
+		return err
+	}
+	pq.Manifest = manifest
+	pq.Pointers = persistPointers(s.resultPointers)
+	pq.PointersByPkg = make(map[string][]persistedPointer, len(s.resultPointersByPkg))
+	for pkg, pointers := range s.resultPointersByPkg {
+		pq.PointersByPkg[pkg] = persistPointers(pointers)
+	}
+	pq.DirsByPkg = make(map[string][]persistedDir, len(s.dirsByPkg))
+	for pkg, dirs := range s.dirsByPkg {
+		persisted := make([]persistedDir, len(dirs))
+		for idx, d := range dirs {
+			persisted[idx] = persistedDir{
+				Dir:      d.dir,
+				Count:    d.count,
+				Pointers: persistPointers(d.pointers),
+			}
+		}
+		pq.DirsByPkg[pkg] = persisted
+	}
+	if s.countOnly {
+		pq.PackageCounts = queryCounts(queryid).Packages
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&pq); err != nil {
+		return err
+	}
+	return store.WriteIndex(queryid, buf.Bytes())
+}
+
+// reloadQuery loads the state of an evicted query from disk, unless the
+// query is in memory already. Returns whether the query is in memory.
+func reloadQuery(queryid string) bool {
+	stateMu.RLock()
+	_, exists := state[queryid]
+	stateMu.RUnlock()
+	if exists {
+		return true
+	}
+
+	b, err := store.ReadIndex(queryid)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[%s] could not reload query: %v\n", queryid, err)
+		}
+		return false
+	}
+	var pq persistedQuery
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&pq); err != nil {
+		log.Printf("[%s] could not reload query: %v\n", queryid, err)
+		return false
+	}
+
+	if pq.Duration == 0 {
+		pq.Duration = elapsedBetween(pq.Started, pq.Ended)
+	}
+	s := queryState{
+		started:             pq.Started,
+		ended:               pq.Ended,
+		duration:            pq.Duration,
+		done:                true,
+		query:               pq.Query,
+		generation:          pq.Generation,
+		newEvent:            sync.NewCond(&stateMu),
+		filesTotal:          make([]int, pq.Backends),
+		filesProcessed:      make([]int, pq.Backends),
+		filesMu:             &sync.Mutex{},
+		perBackend:          make([]*perBackendState, pq.Backends),
+		allPackagesSorted:   pq.AllPackagesSorted,
+		resultPages:         pq.ResultPages,
+		resultsDigest:       pq.ResultsDigest,
+		facets:              pq.Facets,
+		FirstPathRank:       pq.FirstPathRank,
+		countOnly:           pq.CountOnly,
+		countsMu:            &sync.Mutex{},
+		packageCounts:       pq.PackageCounts,
+		resultPointersByPkg: make(map[string][]resultPointer, len(pq.PointersByPkg)),
+		dirsByPkg:           make(map[string][]dirResults, len(pq.DirsByPkg)),
+	}
+	if s.packageCounts == nil {
+		s.packageCounts = make(map[string]int)
+	}
+	if s.facets.Packages == nil {
+		s.facets = newFacetCounts()
+	}
+	restoreSequences := len(pq.EventSequences) == len(pq.Events)
+	for idx, data := range pq.Events {
+		sequence := idx
+		if restoreSequences {
+			sequence = pq.EventSequences[idx]
+		}
+		s.events = append(s.events, event{
+			sequence: sequence,
+			data:     data,
+			obsolete: new(bool),
+		})
+	}
+	s.nextSequence = len(s.events)
+	if restoreSequences && pq.NextSequence > 0 {
+		s.nextSequence = pq.NextSequence
+	}
+	pool := stringpool.NewShardedStringPool(packagePoolShards)
+	s.packagePool = pool
+	s.resultPointers = restorePointers(pool, pq.Pointers)
+	for pkg, pointers := range pq.PointersByPkg {
+		s.resultPointersByPkg[pkg] = restorePointers(pool, pointers)
+	}
+	for pkg, dirs := range pq.DirsByPkg {
+		restored := make([]dirResults, len(dirs))
+		for idx, d := range dirs {
+			restored[idx] = dirResults{
+				dir:      d.Dir,
+				count:    d.Count,
+				pointers: restorePointers(pool, d.Pointers),
+			}
+		}
+		s.dirsByPkg[pkg] = restored
+	}
+	storage, err := store.Open(queryid, pq.Backends)
+	if err != nil {
+		log.Printf("[%s] could not reload query: %v\n", queryid, err)
+		return false
+	}
+	if err := verifyStorage(storage, pq.Manifest); err != nil {
+		// The query will be re-run, replacing the stored results.
+		log.Printf("[%s] not reloading corrupt query: %v\n", queryid, err)
+		corruptQueries.Inc()
+		storage.Close()
+		return false
+	}
+	s.storage = storage
+	for i := range s.perBackend {
+		s.perBackend[i] = &perBackendState{
+			allPackages: make(map[string]bool),
+			facets:      newFacetCounts(),
+		}
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if _, exists := state[queryid]; exists {
+		// Reloaded (or restarted) concurrently.
+		s.storage.Close()
+		return true
+	}
+	evictQueriesLocked()
+	state[queryid] = s
+	reloadedQueries.Inc()
+	log.Printf("[%s] reloaded from disk\n", queryid)
+	return true
+}
+
+// withQuery wraps handlers for /results/<queryid>/…,
+// /perpackage-results/<queryid>/… and /perdir-results/<queryid>/…, proxying the request to the instance owning
+// the query (see -peers), reloading the query from disk if necessary and
+// preventing its eviction while the request is being served. Results of queries
+// run on an older index generation (see -index_generation) are not served.
+func withQuery(h http.HandlerFunc) http.HandlerFunc {
+	var handler http.HandlerFunc
+	handler = func(w http.ResponseWriter, r *http.Request) {
+		if matches := queryPathRe.FindStringSubmatch(r.URL.Path); matches != nil {
+			if !checkTenant(w, r, matches[1]) {
+				return
+			}
+			if redirectLegacyQuery(w, r, matches[1]) {
+				return
+			}
+			if proxyToOwner(w, r, matches[1], handler) {
+				return
+			}
+			if !checkDownload(w, r) {
+				return
+			}
+			defer pinQuery(matches[1])()
+			reloadQuery(matches[1])
+			if staleGeneration(matches[1]) {
+				http.Error(w, staleGenerationMessage, http.StatusGone)
+				return
+			}
+		}
+		h(w, r)
+	}
+	return handler
+}
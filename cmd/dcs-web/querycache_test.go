@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestReloadKeepsEventSequences(t *testing.T) {
+	// Each match is followed by a progress update, which obsoletes the
+	// previous one, so the stored events have gaps in their sequence numbers.
+	defer useFakeBackends(t, newFakeBackend(
+		"i3-wm_4.8-1/i3bar/src/main.c",
+		"i3-wm_4.8-1/src/main.c",
+		"dcs_0.1-1/cmd/dcs-web/dcs-web.go"))()
+
+	queryid, cleanup := runQuery(t, "q=main&literal=1")
+	defer cleanup()
+	s := waitDone(t, queryid)
+	waitPersisted(t, queryid)
+	gaps := false
+	for idx, ev := range s.events {
+		if ev.sequence != idx {
+			gaps = true
+			break
+		}
+	}
+	if !gaps {
+		t.Fatalf("events of %s have no gaps, cannot test renumbering", queryid)
+	}
+
+	// Evict the query and reload it from disk.
+	stateMu.Lock()
+	state[queryid].storage.Close()
+	delete(state, queryid)
+	stateMu.Unlock()
+	if !reloadQuery(queryid) {
+		t.Fatalf("reloadQuery(%s) = false", queryid)
+	}
+	stateMu.RLock()
+	reloaded := state[queryid]
+	stateMu.RUnlock()
+	if got, want := reloaded.nextSequence, s.nextSequence; got != want {
+		t.Errorf("nextSequence after reload = %d, want %d", got, want)
+	}
+	if got, want := len(reloaded.events), len(s.events); got != want {
+		t.Fatalf("len(events) after reload = %d, want %d", got, want)
+	}
+	for idx, ev := range reloaded.events {
+		if got, want := ev.sequence, s.events[idx].sequence; got != want {
+			t.Errorf("events[%d].sequence after reload = %d, want %d", idx, got, want)
+		}
+	}
+
+	// A client which saw the first event before the query was evicted
+	// resumes with exactly the events it did not see yet.
+	lastseen := resumeFrom(queryid, strconv.Itoa(s.events[0].sequence))
+	pending := pendingEvents(queryid, lastseen)
+	if got, want := len(pending), len(s.events)-1; got != want {
+		t.Fatalf("pendingEvents after resuming = %d events, want %d", got, want)
+	}
+	for idx, ev := range pending {
+		if got, want := ev.sequence, s.events[idx+1].sequence; got != want {
+			t.Errorf("pending[%d].sequence = %d, want %d", idx, got, want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"syscall"
+
+	"golang.org/x/xerrors"
+)
+
+// Values of the ErrorType field of Error events. Clients should display the
+// Detail of Error events, and use the ErrorType to decide how to proceed, e.g.
+// whether the results received so far are worth showing.
+const (
+	// The query was refused before it started, see invalidQueryError.
+	// Reason “toocomplex” means that the query exceeds
+	// -max_regexp_complexity and can be started anyway with force=1.
+	errorTypeInvalidQuery = "invalidquery"
+
+	// The query was estimated to require grepping more than
+	// -max_query_files files, and was not started.
+	errorTypeTooBroad = "toobroad"
+
+	// The results of the query exceeded -max_query_result_bytes. The
+	// query was stopped, the results received so far are served.
+	errorTypeQuotaExceeded = "quotaexceeded"
+
+	// At least one source backend failed (Reason “backendunavailable”) or
+	// did not reply within -backend_timeout (Reason “backendtimeout”). The
+	// results of the other source backends are served.
+	errorTypePartialResults = "partialresults"
+
+	// The results could not be stored, as the disk is full.
+	errorTypeStorageFull = "storagefull"
+
+	// The query did not finish within -query_timeout, or a source backend
+	// used up its share of it (see -backend_deadline_share). The results
+	// received so far are served.
+	errorTypeDeadline = "deadline"
+
+	// The query could not get a slot, see -max_concurrent_queries.
+	errorTypeOverloaded = "overloaded"
+
+	// The tenant of the API key exceeds its MaxConcurrentQueries or
+	// QueriesPerMinute (see -tenants_path).
+	errorTypeTenantLimit = "tenantlimit"
+
+	// The query was cancelled via /queryz, or abandoned by all clients
+	// (see -abandoned_query_grace).
+	errorTypeCancelled = "cancelled"
+
+	// The client speaks an unsupported protocol version, see
+	// negotiateVersion.
+	errorTypeUnsupportedVersion = "unsupportedversion"
+
+	// Any other (internal) error.
+	errorTypeFailed = "failed"
+)
+
+// errorDetails are the human-readable explanations of each ErrorType, which are
+// sent to clients as Detail.
+var errorDetails = map[string]string{
+	errorTypeInvalidQuery:       "This query was refused by the server. Please correct the query and try again.",
+	errorTypeTooBroad:           "This query is too broad: too many files would need to be searched. Please make the query more specific, e.g. using package: or path:.",
+	errorTypeQuotaExceeded:      "This query has too many results, only the first ones are shown. Please make the query more specific to see all results.",
+	errorTypePartialResults:     "The results may be incomplete, not all Debian Code Search servers are okay right now.",
+	errorTypeStorageFull:        "The server ran out of space for storing results. Please try again later.",
+	errorTypeDeadline:           "This query took too long and was stopped, the results may be incomplete. Please make the query more specific.",
+	errorTypeOverloaded:         "The server is busy right now. Please try again later.",
+	errorTypeTenantLimit:        "Too many queries were started using this API key. Please try again later.",
+	errorTypeCancelled:          "This query has been cancelled by the server administrator (to preserve overall service health).",
+	errorTypeUnsupportedVersion: "This page is outdated. Please reload it.",
+	errorTypeFailed:             "This query failed due to an unexpected internal server error.",
+}
+
+// newError returns the Error event for errorType. reason is optional and
+// further specifies the error for programs, e.g. “backendtimeout”.
+func newError(errorType, reason string) *Error {
+	return &Error{
+		Type:      eventTypeError,
+		ErrorType: errorType,
+		Reason:    reason,
+		Detail:    errorDetails[errorType],
+	}
+}
+
+// errTooBroad is returned by planQuery for queries exceeding -max_query_files.
+var errTooBroad = errors.New("query too broad")
+
+// errorTypeFor returns the ErrorType of err, which made a query fail.
+func errorTypeFor(err error) string {
+	switch {
+	case xerrors.Is(err, errTooBroad):
+		return errorTypeTooBroad
+	case xerrors.Is(err, errQueueFull), xerrors.Is(err, errQueueTimeout):
+		return errorTypeOverloaded
+	case xerrors.Is(err, errTenantRateLimited), xerrors.Is(err, errTenantConcurrentLimit):
+		return errorTypeTenantLimit
+	case xerrors.Is(err, syscall.ENOSPC), xerrors.Is(err, syscall.EDQUOT):
+		return errorTypeStorageFull
+	case xerrors.Is(err, context.DeadlineExceeded):
+		return errorTypeDeadline
+	}
+	return errorTypeFailed
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/xerrors"
+)
+
+func TestErrorTypeFor(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{errors.New("something went wrong"), errorTypeFailed},
+		{xerrors.Errorf("estimated to grep 5 files: %w", errTooBroad), errorTypeTooBroad},
+		{errQueueFull, errorTypeOverloaded},
+		{errQueueTimeout, errorTypeOverloaded},
+		{
+			xerrors.Errorf("could not create results storage: %w",
+				&os.PathError{Op: "write", Path: "/srv/dcs/queries/x", Err: syscall.ENOSPC}),
+			errorTypeStorageFull,
+		},
+		{xerrors.Errorf("flush: %w", context.DeadlineExceeded), errorTypeDeadline},
+	} {
+		if got := errorTypeFor(tt.err); got != tt.want {
+			t.Errorf("errorTypeFor(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+		if newError(tt.want, "").Detail == "" {
+			t.Errorf("no Detail for ErrorType %q", tt.want)
+		}
+	}
+}
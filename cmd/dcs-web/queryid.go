@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Debian/dcs/cmd/dcs-web/search"
+)
+
+var indexGeneration = flag.Int("index_generation",
+	0,
+	"Generation of the index currently served by the source backends. Query ids include the generation, so bump it (e.g. using -config and SIGHUP) whenever the index is replaced to ensure that results computed on the previous index are not served anymore")
+
+// staleGenerationMessage is the error message for requests for the results of
+// a query which was run on an older index generation.
+const staleGenerationMessage = "These results are from an older version of the index. Please run the query again."
+
+// maxLegacyQueryIds is the number of legacy query ids (see
+// legacyQueryIdentifier) which are remembered for redirecting.
+const maxLegacyQueryIds = 10000
+
+// canonicalQuery returns the normalized form of the query q (the
+// URL-encoded parameters of a query, e.g. “q=foo&literal=1”): parameters are
+// sorted, empty parameters and parameters set to their default are removed,
+// and the filter atoms of the q= parameter are separated from the search
+// pattern, sorted and spelled using their canonical keyword names. Queries
+// which only differ in their spelling have the same canonical form.
+func canonicalQuery(q string) string {
+	values, err := url.ParseQuery(q)
+	if err != nil {
+		return q
+	}
+	canonical := make(url.Values)
+	for key, vals := range values {
+		for _, val := range vals {
+			if val == "" || (key == "literal" && val == "0") {
+				continue
+			}
+			canonical.Add(key, val)
+		}
+	}
+	if pattern := canonical.Get("q"); pattern != "" {
+		if parsed, err := search.ParseQuery(pattern); err == nil {
+			canonical.Set("q", parsed.Pattern)
+			atoms := append([]search.FilterAtom(nil), parsed.Filters...)
+			sort.SliceStable(atoms, func(i, j int) bool {
+				if atoms[i].Param() != atoms[j].Param() {
+					return atoms[i].Param() < atoms[j].Param()
+				}
+				return atoms[i].Value < atoms[j].Value
+			})
+			// The “:” cannot be part of a URL parameter which
+			// clients send, so the atoms do not clash with them.
+			for _, atom := range atoms {
+				canonical.Add("q:"+atom.Param(), atom.Value)
+			}
+		}
+	}
+	return canonical.Encode()
+}
+
+// queryIdentifier uniquely (well, good enough) identifies the query q for as
+// long as we keep its results (see -query_retention). The identifier is
+// derived from the canonical form of the query (see canonicalQuery) and
+// -index_generation, so that differently spelled queries share their results,
+// and so that results are not reused once the index was replaced.
+func queryIdentifier(q string) string {
+	h := fnv.New64()
+	fmt.Fprintf(h, "%d\n%s", *indexGeneration, canonicalQuery(q))
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// queryGeneration returns the index generation the query was run on.
+func queryGeneration(queryid string) int {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return state[queryid].generation
+}
+
+// staleGeneration returns whether the query (which must be in memory, see
+// reloadQuery) was run on an older index generation.
+func staleGeneration(queryid string) bool {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	s, ok := state[queryid]
+	return ok && s.generation != *indexGeneration
+}
+
+// hashString returns a short hash of s, suitable for use in query ids.
+func hashString(s string) string {
+	h := fnv.New64()
+	io.WriteString(h, s)
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// legacyQueryIdentifier returns the identifier which older versions of
+// dcs-web used for the query q, i.e. a hash of the query as sent by the
+// client. Links containing legacy identifiers (e.g. bookmarked result pages)
+// are redirected, see redirectLegacyQuery.
+func legacyQueryIdentifier(q string) string {
+	return hashString(q)
+}
+
+type canonicalQueryRef struct {
+	queryid    string
+	generation int
+}
+
+var legacyQueryIds struct {
+	mu sync.Mutex
+	// canonical maps legacy query ids to the query id of the same query.
+	canonical map[string]canonicalQueryRef
+	// order contains the legacy query ids in the order they were added, so
+	// that the oldest are forgotten first.
+	order []string
+}
+
+// rememberLegacyQueryId remembers the legacy query id of the query q, which
+// has the id queryid.
+func rememberLegacyQueryId(queryid, q string) {
+	legacy := legacyQueryIdentifier(q)
+	if legacy == queryid {
+		return
+	}
+	legacyQueryIds.mu.Lock()
+	defer legacyQueryIds.mu.Unlock()
+	if legacyQueryIds.canonical == nil {
+		legacyQueryIds.canonical = make(map[string]canonicalQueryRef)
+	}
+	if _, ok := legacyQueryIds.canonical[legacy]; !ok {
+		legacyQueryIds.order = append(legacyQueryIds.order, legacy)
+	}
+	legacyQueryIds.canonical[legacy] = canonicalQueryRef{
+		queryid:    queryid,
+		generation: *indexGeneration,
+	}
+	if len(legacyQueryIds.order) > maxLegacyQueryIds {
+		delete(legacyQueryIds.canonical, legacyQueryIds.order[0])
+		legacyQueryIds.order = legacyQueryIds.order[1:]
+	}
+}
+
+// canonicalQueryId returns the query id of the query with the legacy query id
+// legacy, if known. Queries of older index generations are forgotten.
+func canonicalQueryId(legacy string) (string, bool) {
+	legacyQueryIds.mu.Lock()
+	defer legacyQueryIds.mu.Unlock()
+	ref, ok := legacyQueryIds.canonical[legacy]
+	if !ok || ref.generation != *indexGeneration {
+		return "", false
+	}
+	return ref.queryid, true
+}
+
+// redirectLegacyQuery redirects requests for the results of a query which
+// refer to the query by its legacy query id (see legacyQueryIdentifier).
+// Returns whether the request was redirected.
+func redirectLegacyQuery(w http.ResponseWriter, r *http.Request, queryid string) bool {
+	if queryExists(queryid) {
+		return false
+	}
+	canonical, ok := canonicalQueryId(queryid)
+	if !ok {
+		return false
+	}
+	u := *r.URL
+	u.Path = strings.Replace(u.Path, "/"+queryid+"/", "/"+canonical+"/", 1)
+	log.Printf("[%s] redirecting legacy query id to %s\n", queryid, canonical)
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	return true
+}
+
+// Started is sent to clients speaking protocol version 3 or newer once the
+// query was started (or found in the cache), before any other event of the
+// query.
+type Started struct {
+	// Set to “started”.
+	Type string
+
+	// QueryId identifies the query, e.g. in /results/<QueryId>/page_0.json.
+	// It is derived by the server, see queryIdentifier.
+	QueryId string
+
+	// IndexGeneration is the generation of the index the query is run on
+	// (see -index_generation). Results of older generations are not served.
+	IndexGeneration int
+}
+
+// startedEvent returns the started event for the negotiated protocol
+// version, or nil if the version does not have started events.
+func startedEvent(version int, queryid string) []byte {
+	if version < 3 {
+		return nil
+	}
+	b, _ := json.Marshal(&Started{
+		Type:            eventTypeStarted,
+		QueryId:         queryid,
+		IndexGeneration: queryGeneration(queryid),
+	})
+	return b
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueryIdentifier(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+	}{
+		{"q=foo", "q=foo&literal=0"},
+		{"q=foo&literal=1", "literal=1&q=foo"},
+		{"q=foo+pkg%3Abar", "q=package%3Abar+foo"},
+		{"q=foo+filetype%3Ac+-path%3Atest", "q=-path%3Atest+foo+filetype%3AC"},
+		{"q=foo&filter=", "q=foo"},
+	} {
+		if got, want := queryIdentifier(tt.a), queryIdentifier(tt.b); got != want {
+			t.Errorf("queryIdentifier(%q) = %s, want %s (= queryIdentifier(%q))", tt.a, got, want, tt.b)
+		}
+	}
+
+	for _, tt := range []struct {
+		a, b string
+	}{
+		{"q=foo", "q=foo&literal=1"},
+		{"q=foo+", "q=foo"},
+		{"q=foo+bar", "q=bar+foo"},
+		{"q=foo+pkg%3Abar", "q=foo+-pkg%3Abar"},
+		{"q=foo+pkg%3Abar", "q=foo&package=bar"},
+	} {
+		if got, other := queryIdentifier(tt.a), queryIdentifier(tt.b); got == other {
+			t.Errorf("queryIdentifier(%q) = queryIdentifier(%q) = %s, want different ids", tt.a, tt.b, got)
+		}
+	}
+
+	before := queryIdentifier("q=foo")
+	defer func(generation int) { *indexGeneration = generation }(*indexGeneration)
+	*indexGeneration++
+	if after := queryIdentifier("q=foo"); after == before {
+		t.Errorf("queryIdentifier did not change with -index_generation")
+	}
+}
+
+func TestRedirectLegacyQuery(t *testing.T) {
+	const query = "q=redirectlegacy&literal=0"
+	queryid := queryIdentifier(query)
+	legacy := legacyQueryIdentifier(query)
+	rememberLegacyQueryId(queryid, query)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/results/"+legacy+"/page_0.json", nil)
+	if !redirectLegacyQuery(rec, req, legacy) {
+		t.Fatalf("redirectLegacyQuery(%s) = false, want true", legacy)
+	}
+	if got, want := rec.Code, http.StatusMovedPermanently; got != want {
+		t.Errorf("unexpected HTTP status: got %d, want %d", got, want)
+	}
+	if got, want := rec.Header().Get("Location"), "/results/"+queryid+"/page_0.json"; got != want {
+		t.Errorf("unexpected redirect: got %q, want %q", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/results/"+queryid+"/page_0.json", nil)
+	if redirectLegacyQuery(rec, req, queryid) {
+		t.Errorf("redirectLegacyQuery(%s) = true for a canonical query id", queryid)
+	}
+}
+
+func TestStaleGeneration(t *testing.T) {
+	const queryid = "stalegeneration"
+	defer func(generation int) { *indexGeneration = generation }(*indexGeneration)
+	stateMu.Lock()
+	state[queryid] = queryState{
+		started:    time.Now(),
+		generation: *indexGeneration,
+		newEvent:   sync.NewCond(&stateMu),
+	}
+	stateMu.Unlock()
+	defer func() {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		delete(state, queryid)
+	}()
+
+	if !queryExists(queryid) || staleGeneration(queryid) {
+		t.Fatalf("query of the current index generation is not served")
+	}
+	*indexGeneration++
+	if queryExists(queryid) {
+		t.Errorf("query of an older index generation still exists")
+	}
+	if !staleGeneration(queryid) {
+		t.Errorf("staleGeneration = false for a query of an older index generation")
+	}
+
+	rec := httptest.NewRecorder()
+	withQuery(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("results of an older index generation served")
+	})(rec, httptest.NewRequest("GET", "/results/"+queryid+"/page_0.json", nil))
+	if got, want := rec.Code, http.StatusGone; got != want {
+		t.Errorf("unexpected HTTP status: got %d, want %d", got, want)
+	}
+}
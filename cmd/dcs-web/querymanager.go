@@ -1,8 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"hash/fnv"
@@ -18,14 +18,18 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/cmd/dcs-web/i18n"
 	"github.com/Debian/dcs/cmd/dcs-web/search"
 	"github.com/Debian/dcs/dpkgversion"
 	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/Debian/dcs/internal/sourcebackend"
 	"github.com/Debian/dcs/stringpool"
+	"github.com/Debian/dcs/varz"
 	"github.com/golang/protobuf/proto"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
@@ -38,8 +42,7 @@ var (
 		"/tmp/qr/",
 		"Path where query results files (page_0.json etc.) are stored")
 
-	perPackagePathRe = regexp.MustCompile(`^/perpackage-results/([^/]+)/` +
-		strconv.Itoa(resultsPerPackage) + `/page_([0-9]+).json$`)
+	perPackagePathRe = regexp.MustCompile(`^/perpackage-results/([^/]+)/([0-9]+)/page_([0-9]+).json$`)
 
 	queryDurations = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
@@ -55,28 +58,157 @@ var (
 			},
 		})
 
+	queryResults = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "query_results",
+			Help:    "Number of results of a query.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 12),
+		})
+
+	backendTempFileBytes = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "backend_temp_file_bytes",
+			Help:    "Size of the temporary results file of one source backend for one query.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+		})
+
+	queryEvents = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "query_events",
+			Help:    "Number of events stored for a query once it is done (obsoleted events are not stored).",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+		})
+
+	packagePoolLookups = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "package_pool_lookups",
+			Help: "Number of package name and directory lookups in the string pools of finished queries.",
+		})
+
+	packagePoolHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "package_pool_hits",
+			Help: "Number of package_pool_lookups which returned an already pooled string, i.e. which saved memory.",
+		})
+
+	resultsRate = varz.NewRate(
+		prometheus.GaugeOpts{
+			Name: "results_per_second",
+			Help: "Results received from source backends per second, averaged over the last minute.",
+		}, 1*time.Minute)
+
+	queriesRate = varz.NewRate(
+		prometheus.GaugeOpts{
+			Name: "queries_per_second",
+			Help: "Queries started per second, averaged over the last minute.",
+		}, 1*time.Minute)
+
+	queryTimeout = flag.Duration("query_timeout",
+		0,
+		"Deadline for a query, starting when the query is received (i.e. including time spent in the queue). Source backends which have not returned all results by then are stopped, and the query is reported as exceeding its deadline. 0 means no deadline")
+
+	backendTimeout = flag.Duration("backend_timeout",
+		0,
+		"Deadline for the Search RPC to each individual source backend. Applies in addition to -backend_deadline_share. 0 means no deadline")
+
+	backendDeadlineShare = flag.Float64("backend_deadline_share",
+		0.9,
+		"Share of the time remaining until the query deadline (see -query_timeout) which each source backend may spend on the query, so that backends are stopped (and their results are processed) before the query itself is stopped")
+
+	maxResultsMinRanking = flag.Float64("max_results_min_ranking",
+		0,
+		"Only results ranked at least this high count towards the max_results= limit of a query")
+
+	maxQueryResultBytes = flag.Int64("max_query_result_bytes",
+		0,
+		"Maximum size of the (serialized) results of a query. Queries exceeding it are truncated like queries exceeding max_results=, and clients are told that the quota was exceeded. 0 means unlimited")
+
 	headroomPercentage = flag.Float64("headroom_percentage",
 		0.2,
 		"How much space should be kept free on the file system containing -query_results_path in order to be able to write query state. Default: 0.2, i.e. 20% of the total space should be kept free. Set to 0 to disable")
-)
 
-const (
-	// NB: All of these constants needs to match those in static/instant.js.
-	packagesPerPage   = 5
-	resultsPerPackage = 2
-	resultsPerPage    = 10
+	// static/instant.js obtains these values via /api/v1/uiconfig (or the
+	// uiconfig template variable), see uiconfig.go.
+	packagesPerPage = flag.Int("packages_per_page",
+		5,
+		"Number of packages per page of per-package results")
+	resultsPerPackage = flag.Int("results_per_package",
+		2,
+		"Number of results per package on pages of per-package results")
+	resultsPerPage = flag.Int("results_per_page",
+		10,
+		"Number of results per page")
 )
 
 func init() {
 	prometheus.MustRegister(queryDurations)
+	prometheus.MustRegister(queryResults)
+	prometheus.MustRegister(backendTempFileBytes)
+	prometheus.MustRegister(queryEvents)
+	prometheus.MustRegister(packagePoolLookups)
+	prometheus.MustRegister(packagePoolHits)
+	prometheus.MustRegister(resultsRate)
+	prometheus.MustRegister(queriesRate)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "events_in_memory",
+			Help: "Number of events of all queries currently held in memory.",
+		},
+		func() float64 {
+			stateMu.RLock()
+			defer stateMu.RUnlock()
+			var n int
+			for _, s := range state {
+				n += len(s.events)
+			}
+			return float64(n)
+		}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "package_pool_strings",
+			Help: "Number of distinct package names and directories in the string pools of all queries currently held in memory.",
+		},
+		func() float64 {
+			stateMu.RLock()
+			defer stateMu.RUnlock()
+			var n int
+			for _, s := range state {
+				if s.packagePool != nil {
+					n += s.packagePool.Stats().Strings
+				}
+			}
+			return float64(n)
+		}))
 }
 
+// packagePoolShards is the number of shards of the string pool of each query:
+// results of all source backends are stored concurrently.
+const packagePoolShards = 16
+
 type Error struct {
 	// This is set to “error” to distinguish the message type on the client.
 	Type string
 
-	// Currently only “backendunavailable”
+	// One of the errorType constants, e.g. “partialresults”.
 	ErrorType string
+
+	// Reason further specifies the ErrorType for programs, e.g.
+	// “backendtimeout” for “partialresults”. Optional.
+	Reason string `json:",omitempty"`
+
+	// Detail explains the error to users, see errorDetails.
+	Detail string `json:",omitempty"`
+
+	// The error which the ErrorType was derived from, e.g. why the query
+	// is invalid (see invalidQueryError). Optional.
+	ErrorMessage string `json:",omitempty"`
+
+	// Set if the query uses PCRE syntax which is not supported.
+	Unsupported *search.UnsupportedSyntaxError `json:",omitempty"`
+
+	// Set if the offending part of the query is known, so that clients
+	// can point it out.
+	Syntax *search.QuerySyntaxError `json:",omitempty"`
 }
 
 type ProgressUpdate struct {
@@ -85,6 +217,10 @@ type ProgressUpdate struct {
 	FilesProcessed int
 	FilesTotal     int
 	Results        int
+
+	// Experiments are the ids of the experiments the query is part of (see
+	// -experiments), if any.
+	Experiments []string `json:",omitempty"`
 }
 
 func (p *ProgressUpdate) EventType() string {
@@ -106,8 +242,12 @@ type resultPointer struct {
 	// source backends.
 	pathHash uint64
 
-	// Used for per-package results. Points into a stringpool.StringPool
+	// Used for per-package results. Points into queryState.packagePool.
 	packageName *string
+
+	// Used for per-directory results, see topLevelDir. Points into the same
+	// pool as packageName.
+	dir *string
 }
 
 type pointerByRanking []resultPointer
@@ -117,10 +257,7 @@ func (s pointerByRanking) Len() int {
 }
 
 func (s pointerByRanking) Less(i, j int) bool {
-	if s[i].ranking == s[j].ranking {
-		return s[i].pathHash > s[j].pathHash
-	}
-	return s[i].ranking > s[j].ranking
+	return rankedBefore(s[i], s[j])
 }
 
 func (s pointerByRanking) Swap(i, j int) {
@@ -128,25 +265,66 @@ func (s pointerByRanking) Swap(i, j int) {
 }
 
 type perBackendState struct {
-	// One file per backend, containing JSON-serialized results. When writing,
-	// we keep the offsets, so that we can later sort the pointers and write
-	// the resulting files.
-	tempFile       *os.File
-	tempFileWriter *bufio.Writer
-	tempFileOffset int64
-	packagePool    *stringpool.StringPool
 	resultPointers []resultPointer
 	allPackages    map[string]bool
+	facets         facetCounts
+
+	// Only set for queries started with sample=N.
+	sampler *sampler
+
+	// For the slow query log, see logSlowQuery.
+	timings backendTimings
+
+	// indexFiles is the number of files in the backend’s index, as
+	// reported by TrigramStats (see estimateQuery). skewed is set by
+	// attributeBackends.
+	indexFiles int
+	skewed     bool
 }
 
 type queryState struct {
-	started  time.Time
-	ended    time.Time
+	started time.Time
+	ended   time.Time
+
+	// duration is how long the query ran, measured using the monotonic
+	// clock (see clock.go). Set once the query is done.
+	duration time.Duration
+
 	events   []event
 	newEvent *sync.Cond
 	done     bool
 	query    string
 
+	// generation is the -index_generation the query was run on. Queries of
+	// other generations are treated like expired queries.
+	generation int
+
+	// corrupt is set by markQueryCorrupt if the stored results cannot be
+	// read. Corrupt queries are treated like expired queries.
+	corrupt bool
+
+	// errorType is the ErrorType of the first Error event of the query (e.g.
+	// “partialresults”), if any. Used to list failed queries on /queryz.
+	errorType string
+
+	// rewrittenQuery is the query as sent to the source backends.
+	rewrittenQuery string
+
+	// experiments are the ids of the experiments the query is part of, see
+	// -experiments and inExperiment.
+	experiments []string
+
+	// timeline records the first maxTimelineEntries events of the query, see
+	// logSlowQuery and DebugBundleHandler.
+	timeline []timelineEntry
+
+	// backendsReturned is set once the goroutines querying the backends
+	// returned, after which perBackend[].timings can be read.
+	backendsReturned bool
+
+	// Sequence number of the next event, see addEvent().
+	nextSequence int
+
 	results [10]resultPointer
 
 	filesTotal     []int
@@ -155,16 +333,81 @@ type queryState struct {
 
 	resultPages int
 
-	// This guards concurrent access to any perBackend[].tempFile.
-	tempFilesMu *sync.Mutex
-	perBackend  []*perBackendState
+	// The serialized results of all source backends, which are later read
+	// using resultPointers.
+	storage    resultsStorage
+	perBackend []*perBackendState
+
+	// packagePool stores the package names and directories of all
+	// resultPointers, see storeResult. It is shared by all source backends
+	// of the query.
+	packagePool *stringpool.ShardedStringPool
 
 	resultPointers      []resultPointer
 	resultPointersByPkg map[string][]resultPointer
+	// dirsByPkg maps package names to the results within the newest version
+	// of the package, grouped by top-level directory, see dirGroups.
+	dirsByPkg map[string][]dirResults
+
+	// resultsDigest identifies the contents of all result pages, see
+	// writeToDisk(). Used for generating ETags.
+	resultsDigest string
 
 	allPackagesSorted []string
 
+	// Merged from all perBackend[].facets in writeToDisk().
+	facets facetCounts
+
 	FirstPathRank float32
+
+	// countOnly is set for queries started with count=1, in which case source
+	// backends only return the number of matches per package.
+	countOnly     bool
+	countsMu      *sync.Mutex
+	packageCounts map[string]int
+
+	// sampleSize is set for queries started with sample=N, in which case
+	// only a uniformly sampled subset of N results is stored.
+	sampleSize int
+
+	// maxResults is set for queries started with max_results=N: once
+	// qualifyingResults (results ranked at least -max_results_min_ranking)
+	// reaches N, the query is truncated, i.e. the source backends are
+	// cancelled and the query finishes with the results received so far.
+	maxResults        int
+	qualifyingResults *int64
+	truncated         bool
+
+	// resultBytes is the size of all stored results, which is limited by
+	// -max_query_result_bytes.
+	resultBytes *int64
+
+	// resources is nil for queries which were restored from disk.
+	resources *queryResources
+
+	// abandoned is set by abandonQuery if no client streamed the events of
+	// the query for -abandoned_query_grace. Its results are incomplete.
+	abandoned bool
+
+	// postFilter is set for queries started with filter=…, in which case
+	// only results matching the filter expression are stored.
+	postFilter *search.Filter
+
+	// metadataFilter is set for queries with maintainer: or description:
+	// keywords, in which case only results from the selected source
+	// packages are stored.
+	metadataFilter *metadataFilter
+
+	// cancel cancels the Search RPCs to all source backends.
+	cancel context.CancelFunc
+
+	// priority is the priority of the client which started the query.
+	priority queryPriority
+
+	// complex is set for queries exceeding -max_regexp_complexity (which
+	// were started with force=1), which are subject to
+	// -complex_query_backend_timeout.
+	complex bool
 }
 
 func (qs *queryState) numResults() int {
@@ -175,52 +418,240 @@ func (qs *queryState) numResults() int {
 	return result
 }
 
+// numMatches returns the number of matches the source backends returned,
+// which is larger than numResults() for sampled queries.
+func (qs *queryState) numMatches() int {
+	var result int
+	for _, bstate := range qs.perBackend {
+		if bstate.sampler != nil {
+			result += bstate.sampler.seen
+		} else {
+			result += len(bstate.resultPointers)
+		}
+	}
+	return result
+}
+
+// runningFor returns how long the query ran, or has been running so far if
+// it is not done.
+func (qs *queryState) runningFor() time.Duration {
+	if qs.done {
+		return qs.duration
+	}
+	return elapsed(qs.started)
+}
+
 var (
 	state   = make(map[string]queryState)
 	stateMu sync.RWMutex
 )
 
-func queryBackend(ctx context.Context, queryid, src string, backend sourcebackendpb.SourceBackendClient, backendidx int, searchRequest *sourcebackendpb.SearchRequest) {
-	// When exiting this function, check that all results were processed. If
-	// not, the backend query must have failed for some reason. Send a progress
-	// update to prevent the query from running forever.
-	defer func() {
-		stateMu.RLock()
-		filesTotal := state[queryid].filesTotal[backendidx]
+// replySink stores the replies of one source backend (or federation peer, see
+// queryFederationPeer) of a query.
+type replySink struct {
+	queryid    string
+	backendidx int
+	storage    resultsStorage
+	bstate     *perBackendState
+	postFilter *search.Filter
+	metadata   *metadataFilter
+	resources  *queryResources
+	buf        *proto.Buffer
+
+	// counter, if non-nil, counts matches instead of storing them, for
+	// count=1 queries sent to a source backend which lacks
+	// sourcebackend.CapabilityCount.
+	counter matchCounter
+}
 
-		if state[queryid].filesProcessed[backendidx] == filesTotal {
-			stateMu.RUnlock()
-			return
+func newReplySink(queryid string, backendidx int) *replySink {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return &replySink{
+		queryid:    queryid,
+		backendidx: backendidx,
+		storage:    state[queryid].storage,
+		bstate:     state[queryid].perBackend[backendidx],
+		postFilter: state[queryid].postFilter,
+		metadata:   state[queryid].metadataFilter,
+		resources:  state[queryid].resources,
+		buf:        proto.NewBuffer(nil),
+	}
+}
+
+// store writes msg to the query’s results storage and updates the query state
+// accordingly.
+func (rs *replySink) store(msg *sourcebackendpb.SearchReply) error {
+	if rs.bstate.timings.replies == 0 {
+		rs.bstate.timings.firstReply = time.Now()
+	}
+	rs.bstate.timings.replies++
+	atomic.AddInt64(&rs.resources.backendBytes, int64(proto.Size(msg)))
+
+	if rs.counter != nil {
+		switch msg.Type {
+		case sourcebackendpb.SearchReply_MATCH:
+			rs.counter.add(msg.Match)
+			return nil
+		case sourcebackendpb.SearchReply_PROGRESS_UPDATE:
+			// The counts need to be stored before the final progress
+			// update, which sends them to clients.
+			if p := msg.ProgressUpdate; p.FilesProcessed == p.FilesTotal {
+				storeCounts(rs.queryid, rs.counter.packageCounts())
+				rs.counter = nil
+			}
+		}
+	}
+
+	// Results which do not match the filter= expression are discarded
+	// before they are written, i.e. they count neither towards facets
+	// nor towards sample= or max_results=.
+	if msg.Type == sourcebackendpb.SearchReply_MATCH && rs.postFilter != nil &&
+		!rs.postFilter.Matches(msg.Match) {
+		return nil
+	}
+	if msg.Type == sourcebackendpb.SearchReply_MATCH && rs.metadata != nil &&
+		!rs.metadata.Matches(msg.Match) {
+		return nil
+	}
+
+	sampleSlot := -1
+	if msg.Type == sourcebackendpb.SearchReply_MATCH && rs.bstate.sampler != nil {
+		if sampleSlot = rs.bstate.sampler.offer(); sampleSlot == -1 {
+			// Not part of the sample, so it is not stored at all, but
+			// facets still reflect all matches.
+			rs.bstate.facets.add(msg.Match)
+			return nil
 		}
+	}
+
+	rs.buf.Reset()
+	if err := rs.buf.Marshal(msg); err != nil {
+		return fmt.Errorf("Error encoding proto: %v", err)
+	}
+	offset, err := rs.storage.Append(rs.backendidx, msg, rs.buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Error writing proto: %v", err)
+	}
+	atomic.AddInt64(&rs.resources.tempFileBytes, int64(len(rs.buf.Bytes())))
+
+	switch msg.Type {
+	case sourcebackendpb.SearchReply_MATCH:
+		started := time.Now()
+		storeResult(rs.queryid, rs.backendidx, msg.Match, offset, len(rs.buf.Bytes()), sampleSlot)
+		atomic.AddInt64(&rs.resources.storeResultNanos, int64(time.Since(started)))
+	case sourcebackendpb.SearchReply_PROGRESS_UPDATE:
+		storeProgress(rs.queryid, rs.backendidx, msg.ProgressUpdate)
+	case sourcebackendpb.SearchReply_COUNTS:
+		storeCounts(rs.queryid, msg.PackageCounts)
+	}
+	return nil
+}
+
+// finishBackend checks that all results of the backend were processed. If
+// not, the backend query must have failed for some reason, so a progress
+// update is stored to prevent the query from running forever. queryCtx is the
+// context of the query, ctx the context of the backend’s RPC (derived from
+// queryCtx, possibly with an earlier deadline). fromQuery is whether that
+// deadline was derived from the query deadline, see backendDeadline.
+func finishBackend(queryCtx, ctx context.Context, fromQuery bool, queryid string, backendidx int) {
+	stateMu.RLock()
+	filesTotal := state[queryid].filesTotal[backendidx]
+
+	if state[queryid].filesProcessed[backendidx] == filesTotal {
 		stateMu.RUnlock()
+		return
+	}
+	stateMu.RUnlock()
 
-		if filesTotal == -1 {
-			filesTotal = 0
+	if filesTotal == -1 {
+		filesTotal = 0
+	}
+
+	// The error is sent before the progress update, which finishes the query
+	// if this was the last backend: clients stop reading once the query is
+	// finished. A truncated query is not an error: we stopped reading on
+	// purpose. Abandoned queries already have an error.
+	if !queryTruncated(queryid) && !queryAbandoned(queryid) {
+		ev := newError(errorTypePartialResults, "backendunavailable")
+		if queryCtx.Err() == context.DeadlineExceeded ||
+			(fromQuery && ctx.Err() == context.DeadlineExceeded) {
+			ev = newError(errorTypeDeadline, "")
+		} else if ctx.Err() == context.DeadlineExceeded {
+			ev.Reason = "backendtimeout"
 		}
+		addEventMarshal(queryid, ev)
+	}
 
-		storeProgress(queryid, backendidx, &sourcebackendpb.ProgressUpdate{
-			FilesProcessed: uint64(filesTotal),
-			FilesTotal:     uint64(filesTotal),
-		})
+	storeProgress(queryid, backendidx, &sourcebackendpb.ProgressUpdate{
+		FilesProcessed: uint64(filesTotal),
+		FilesTotal:     uint64(filesTotal),
+	})
+}
 
-		addEventMarshal(queryid, &Error{
-			Type:      "error",
-			ErrorType: "backendunavailable",
-		})
+// backendDeadline returns the deadline for the Search RPC to a source backend
+// of a query with context ctx, or the zero time for no deadline. The backend
+// may spend -backend_deadline_share of the time remaining until the query
+// deadline, but no more than timeout (if non-zero). fromQuery is whether the
+// query deadline determined the result.
+func backendDeadline(ctx context.Context, now time.Time, timeout time.Duration) (deadline time.Time, fromQuery bool) {
+	if timeout > 0 {
+		deadline = now.Add(timeout)
+	}
+	if queryDeadline, ok := ctx.Deadline(); ok {
+		share := now.Add(time.Duration(float64(queryDeadline.Sub(now)) * *backendDeadlineShare))
+		if deadline.IsZero() || share.Before(deadline) {
+			return share, true
+		}
+	}
+	return deadline, false
+}
+
+func queryBackend(ctx context.Context, queryid, src string, backend sourcebackendpb.SourceBackendClient, backendidx int, searchRequest *sourcebackendpb.SearchRequest) {
+	// When exiting this function, check that all results were processed.
+	// ctx is evaluated when exiting, as it is replaced by a context with a
+	// deadline below.
+	queryCtx := ctx
+	fromQuery := false
+	defer func() {
+		finishBackend(queryCtx, ctx, fromQuery, queryid, backendidx)
 	}()
 
-	ctx, cancelfunc := context.WithCancel(ctx)
+	// The deadline (if any) is propagated to the source backend by gRPC, so
+	// that it can stop searching once the results are no longer needed.
+	var cancelfunc context.CancelFunc
+	stateMu.RLock()
+	priority := state[queryid].priority
+	countOnly := state[queryid].countOnly
+	isComplex := state[queryid].complex
+	stateMu.RUnlock()
+	timeout := priority.scaleDuration(*backendTimeout)
+	if isComplex && *complexQueryBackendTimeout > 0 && (timeout == 0 || *complexQueryBackendTimeout < timeout) {
+		timeout = *complexQueryBackendTimeout
+	}
+	var deadline time.Time
+	deadline, fromQuery = backendDeadline(ctx, time.Now(), timeout)
+	if !deadline.IsZero() {
+		ctx, cancelfunc = context.WithDeadline(ctx, deadline)
+	} else {
+		ctx, cancelfunc = context.WithCancel(ctx)
+	}
+	defer cancelfunc()
+	caps := common.CapabilitiesOf(backend)
+	searchRequest, degraded := degradeRequest(caps, searchRequest)
+	if len(degraded) > 0 {
+		log.Printf("[%s] [src:%s] source backend lacks %v, degrading query\n", queryid, src, degraded)
+	}
 	stream, err := backend.Search(ctx, searchRequest)
 	if err != nil {
 		log.Printf("[%s] [src:%s] Search RPC failed: %v\n", queryid, src, err)
 		return
 	}
 
-	stateMu.RLock()
-	bstate := state[queryid].perBackend[backendidx]
-	stateMu.RUnlock()
-	tempFileWriter := bstate.tempFileWriter
-	buf := proto.NewBuffer(nil)
+	sink := newReplySink(queryid, backendidx)
+	if countOnly && !caps.Has(sourcebackend.CapabilityCount) {
+		sink.counter = make(matchCounter)
+	}
 	orderlyFinished := false
 	done := false
 
@@ -235,31 +666,33 @@ func queryBackend(ctx context.Context, queryid, src string, backend sourcebacken
 			return
 		}
 
-		buf.Reset()
-		if err := buf.Marshal(msg); err != nil {
-			log.Printf("[%s] [src:%s] Error encoding proto: %v\n", queryid, src, err)
+		if msg.Type == sourcebackendpb.SearchReply_MATCH {
+			msg.Match.Origin = *federationName
+		}
+		// Replies are processed in turns, so that all running queries
+		// make progress (see -max_concurrent_processing).
+		release, err := scheduler.turn(ctx, queryid, priority)
+		if err != nil {
+			log.Printf("[%s] [src:%s] Waiting for a turn: %v\n", queryid, src, err)
 			return
 		}
-		if _, err := tempFileWriter.Write(buf.Bytes()); err != nil {
-			log.Printf("[%s] [src:%s] Error writing proto: %v\n", queryid, src, err)
+		err = sink.store(msg)
+		release()
+		if err != nil {
+			log.Printf("[%s] [src:%s] %v\n", queryid, src, err)
 			return
 		}
-
-		switch msg.Type {
-		case sourcebackendpb.SearchReply_MATCH:
-			storeResult(queryid, backendidx, msg.Match, len(buf.Bytes()))
-		case sourcebackendpb.SearchReply_PROGRESS_UPDATE:
-			storeProgress(queryid, backendidx, msg.ProgressUpdate)
+		if msg.Type == sourcebackendpb.SearchReply_PROGRESS_UPDATE {
 			orderlyFinished = msg.ProgressUpdate.FilesProcessed == msg.ProgressUpdate.FilesTotal
 		}
 
-		bstate.tempFileOffset += int64(len(buf.Bytes()))
 		stateMu.RLock()
-		done = state[queryid].done
+		done = state[queryid].done || state[queryid].truncated
 		stateMu.RUnlock()
 	}
 
-	// Drain the stream: the above loop might finish early (when the query is cancelled)
+	// Drain the stream: the above loop might finish early (when the query is cancelled
+	// or truncated)
 	if orderlyFinished {
 		// We got everything we need, but we need to try receiving one more
 		// message to make gRPC realize the streaming RPC is finished (by
@@ -274,10 +707,14 @@ func queryBackend(ctx context.Context, queryid, src string, backend sourcebacken
 }
 
 // queryExistsLocked returns whether state for the query exists and whether
-// that state is expired.
+// that state is expired (or corrupt, see markQueryCorrupt, or abandoned and
+// done, see abandonQuery, or of an older index generation).
 func queryExistsLocked(queryid string) (bool, bool) {
 	querystate, exists := state[queryid]
-	return exists, time.Since(querystate.started) > 30*time.Minute
+	return exists, elapsed(querystate.started) > *queryRetention ||
+		querystate.corrupt ||
+		querystate.generation != *indexGeneration ||
+		(querystate.abandoned && querystate.done)
 }
 
 // queryExists returns true if a query with the specified queryid exists and is
@@ -291,34 +728,54 @@ func queryExists(queryid string) bool {
 
 func startQuery(queryid string, querystate queryState) error {
 	stateMu.Lock()
-	defer stateMu.Unlock()
 	exists, expired := queryExistsLocked(queryid)
 	if exists && !expired {
+		stateMu.Unlock()
 		return fmt.Errorf("query already exists")
 	}
-	// See if we need to garbage collect old queries. This is unnecessary when
-	// the query is expired, as we can just re-use the previous slot.
-	if !exists && len(state) >= 10 {
-		log.Printf("Trying to garbage collect queries (currently %d)\n", len(state))
-		for queryid, s := range state {
-			if len(state) < 10 {
-				break
-			}
-			if !s.done {
-				continue
-			}
-			for _, state := range s.perBackend {
-				state.tempFile.Close()
-			}
-			delete(state, queryid)
-		}
-		log.Printf("Garbage collection done. %d queries remaining", len(state))
+	// Evicting old queries is unnecessary when the query is expired, as we
+	// can just re-use the previous slot.
+	if !exists {
+		evictQueriesLocked()
 	}
 	state[queryid] = querystate
 	activeQueries.Add(1)
+	queriesRate.Mark(1)
+	stateMu.Unlock()
+	publishQueryzEvent(queryid, queryzEventStarted)
 	return nil
 }
 
+// newQueryState returns the state of a query which is sent to numBackends
+// source backends (including federation peers). The storage is not set.
+func newQueryState(query, rewrittenQuery string, numBackends int) queryState {
+	querystate := queryState{
+		started:        time.Now(),
+		query:          query,
+		generation:     *indexGeneration,
+		rewrittenQuery: rewrittenQuery,
+		newEvent:       sync.NewCond(&stateMu),
+		filesTotal:     make([]int, numBackends),
+		filesProcessed: make([]int, numBackends),
+		filesMu:        &sync.Mutex{},
+		perBackend:     make([]*perBackendState, numBackends),
+		countsMu:       &sync.Mutex{},
+		packageCounts:  make(map[string]int),
+		facets:         newFacetCounts(),
+		resultBytes:    new(int64),
+		resources:      &queryResources{},
+		packagePool:    stringpool.NewShardedStringPool(packagePoolShards),
+	}
+	for i := 0; i < numBackends; i++ {
+		querystate.filesTotal[i] = -1
+		querystate.perBackend[i] = &perBackendState{
+			allPackages: make(map[string]bool),
+			facets:      newFacetCounts(),
+		}
+	}
+	return querystate
+}
+
 // XXX: Starting a new query while there may still be clients reading that
 // query is not a great idea. Best fix may be to make getEvent() use a
 // querystate instead of the string identifier.
@@ -327,6 +784,8 @@ func startQuery(queryid string, querystate queryState) error {
 // exist. Returns whether the query existed and any errors during query
 // creation.
 func maybeStartQuery(ctx context.Context, queryid, src, query string) (bool, error) {
+	rememberLegacyQueryId(queryid, query)
+	reloadQuery(queryid)
 	if queryExists(queryid) {
 		return true, nil
 	}
@@ -337,19 +796,52 @@ func maybeStartQuery(ctx context.Context, queryid, src, query string) (bool, err
 	// TODO(golang.org/issues/19643): replace the code below once a “detach” API
 	// is available
 	span := opentracing.SpanFromContext(ctx)
+	priority := priorityFrom(ctx)
 	ctx = opentracing.ContextWithSpan(context.Background(), span)
 
-	querystate := queryState{
-		started:        time.Now(),
-		query:          query,
-		newEvent:       sync.NewCond(&stateMu),
-		filesTotal:     make([]int, len(common.SourceBackendStubs)),
-		filesProcessed: make([]int, len(common.SourceBackendStubs)),
-		filesMu:        &sync.Mutex{},
-		perBackend:     make([]*perBackendState, len(common.SourceBackendStubs)),
-		tempFilesMu:    &sync.Mutex{},
+	return launchQuery(ctx, queryid, src, query, priority, nil)
+}
+
+// launchQuery starts the specified query. If resume is non-nil, the query was
+// interrupted by a restart (see resumeInterruptedQueries) and only the
+// backends which did not return all of their replies are queried again.
+func launchQuery(ctx context.Context, queryid, src, query string, priority queryPriority, resume *runningQuery) (bool, error) {
+	// Rewrite the query into a query for source backends.
+	fakeUrl, err := url.Parse("?" + query)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rewritten := search.RewriteQuery(*fakeUrl)
+	// Experiments may change the query sent to the source backends (e.g.
+	// ranking options), see -experiments.
+	experimentIds, rewritten := queryExperiments(queryid, rewritten)
+
+	// Queries for an archive snapshot (snapshot: keyword) are sent to the
+	// source backends serving that snapshot.
+	snapshot := rewritten.Query().Get("snapshot")
+	backends := common.SourceBackendsFor(snapshot)
+	if backends == nil {
+		return false, xerrors.Errorf("unknown snapshot %q", snapshot)
+	}
+
+	// Federation peers (see -federation_peers) are queried in addition to
+	// the source backends, using the backend indexes following theirs.
+	fpeers := federationPeersFor(query)
+	numBackends := len(backends) + len(fpeers)
+	if resume != nil {
+		if numBackends != resume.Backends {
+			return false, xerrors.Errorf("query was sent to %d backends, but there are %d backends now", resume.Backends, numBackends)
+		}
+		// Which results are part of the sample cannot be reconstructed.
+		if rewritten.Query().Get("sample") != "" {
+			return false, xerrors.New("sampled queries cannot be resumed")
+		}
 	}
 
+	querystate := newQueryState(query, rewritten.String(), numBackends)
+	querystate.priority = priority
+	querystate.experiments = experimentIds
+
 	// TODO: it’d be so much better if we would correctly handle ESPACE errors
 	// in the code below (and above), but for that we need to carefully test it.
 	ensureEnoughSpaceAvailable()
@@ -359,40 +851,139 @@ func maybeStartQuery(ctx context.Context, queryid, src, query string) (bool, err
 		return false, xerrors.Errorf("could not create %q: %w", dir, err)
 	}
 
-	for i := 0; i < len(common.SourceBackendStubs); i++ {
-		querystate.filesTotal[i] = -1
-		path := filepath.Join(dir, fmt.Sprintf("unsorted_%d.pb", i))
-		f, err := os.Create(path)
+	var replayed [][]storedReply
+	if resume != nil {
+		storage, replies, err := store.(resumableStore).Resume(queryid, numBackends)
 		if err != nil {
-			return false, xerrors.Errorf("could not create %q: %w", path, err)
+			return false, xerrors.Errorf("could not resume results storage in %q: %w", dir, err)
 		}
-		querystate.perBackend[i] = &perBackendState{
-			packagePool:    stringpool.NewStringPool(),
-			tempFile:       f,
-			tempFileWriter: bufio.NewWriterSize(f, 65536),
-			allPackages:    make(map[string]bool),
+		querystate.storage, replayed = storage, replies
+	} else {
+		storage, err := store.Create(queryid, numBackends)
+		if err != nil {
+			return false, xerrors.Errorf("could not create results storage in %q: %w", dir, err)
+		}
+		querystate.storage = storage
+		if _, ok := store.(resumableStore); ok && *resumeQueries {
+			if err := writeRunningQuery(queryid, &runningQuery{
+				Query:    query,
+				Src:      src,
+				Backends: numBackends,
+				Priority: priority,
+				Tenant:   tenantOf(queryid),
+			}); err != nil {
+				log.Printf("[%s] query cannot be resumed: %v\n", queryid, err)
+			}
 		}
 	}
 	log.Printf("querystate = %v\n", querystate)
 
-	// Rewrite the query into a query for source backends.
-	fakeUrl, err := url.Parse("?" + query)
-	if err != nil {
-		log.Fatal(err)
+	querystate.countOnly = rewritten.Query().Get("count") == "1"
+	if c, ok := tooComplex(rewritten.Query()); ok {
+		// Validated by validateQuery, so the query was started with force=1.
+		log.Printf("[%s] forced query exceeds -max_regexp_complexity: %+v (score %d)\n", queryid, c, c.score())
+		complexQueries.WithLabelValues("forced").Inc()
+		querystate.complex = true
+	}
+	if maxResults, err := strconv.Atoi(rewritten.Query().Get("max_results")); err == nil && maxResults > 0 {
+		querystate.maxResults = maxResults
+		querystate.qualifyingResults = new(int64)
+	}
+	if filter := rewritten.Query().Get("filter"); filter != "" {
+		// Validated by EventsHandler.
+		if querystate.postFilter, err = search.ParseFilter(filter); err != nil {
+			log.Printf("[%s] ignoring invalid filter: %v\n", queryid, err)
+		}
+	}
+	// Validated by search.ParseQuery.
+	if querystate.metadataFilter, err = newMetadataFilter(rewritten.Query()); err != nil {
+		log.Printf("[%s] ignoring invalid maintainer: or description: keyword: %v\n", queryid, err)
+	}
+	if sample, err := strconv.Atoi(rewritten.Query().Get("sample")); err == nil && sample > 0 {
+		querystate.sampleSize = sample
+		for _, bstate := range querystate.perBackend {
+			bstate.sampler = newSampler(sample)
+		}
 	}
-	rewritten := search.RewriteQuery(*fakeUrl)
 	searchRequest := &sourcebackendpb.SearchRequest{
 		Query:        rewritten.Query().Get("q"),
 		RewrittenUrl: rewritten.String(),
 	}
 	log.Printf("[%s] querying for %+v\n", queryid, searchRequest)
+	var cancel context.CancelFunc
+	if *queryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, querystate.priority.scaleDuration(*queryTimeout))
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	querystate.cancel = cancel
 	if err := startQuery(queryid, querystate); err != nil {
 		// Another goroutine must have raced us since we called queryExists().
+		cancel()
 		return true, nil
 	}
-	for idx, backend := range common.SourceBackendStubs {
-		go queryBackend(ctx, queryid, src, backend, idx, searchRequest)
-	}
+	recordExperimentStart(querystate.experiments)
+	go func() {
+		defer cancel()
+		queueStarted := time.Now()
+		if err := slots.acquire(queryid, priority); err != nil {
+			if err == errQueueDone {
+				if queryAbandoned(queryid) {
+					finishQuery(queryid)
+				}
+				return
+			}
+			log.Printf("[%s] not starting query: %v\n", queryid, err)
+			failQuery(queryid, err)
+			return
+		}
+		queueWait := time.Since(queueStarted)
+		if err := planQuery(ctx, queryid, backends, searchRequest); err != nil {
+			log.Printf("[%s] not starting query: %v\n", queryid, err)
+			failQuery(queryid, err)
+			return
+		}
+		for idx, replies := range replayed {
+			if replies != nil {
+				replayBackend(queryid, idx, replies)
+			}
+		}
+		var wg sync.WaitGroup
+		for idx, backend := range backends {
+			if replayed != nil && replayed[idx] != nil {
+				continue
+			}
+			wg.Add(1)
+			go func(idx int, backend sourcebackendpb.SourceBackendClient) {
+				defer wg.Done()
+				timings := &querystate.perBackend[idx].timings
+				timings.started = time.Now()
+				defer func() { timings.finished = time.Now() }()
+				queryBackend(ctx, queryid, src, backend, idx, searchRequest)
+			}(idx, backend)
+		}
+		for idx, peer := range fpeers {
+			if replayed != nil && replayed[len(backends)+idx] != nil {
+				continue
+			}
+			wg.Add(1)
+			go func(backendidx int, peer federationPeer) {
+				defer wg.Done()
+				timings := &querystate.perBackend[backendidx].timings
+				timings.started = time.Now()
+				defer func() { timings.finished = time.Now() }()
+				queryFederationPeer(ctx, queryid, peer, backendidx, query)
+			}(len(backends)+idx, peer)
+		}
+		wg.Wait()
+		stateMu.Lock()
+		s := state[queryid]
+		s.backendsReturned = true
+		state[queryid] = s
+		stateMu.Unlock()
+		attributeBackends(queryid)
+		logSlowQuery(queryid, queueWait)
+	}()
 	return false, nil
 }
 
@@ -404,87 +995,216 @@ type queryStats struct {
 	NumResultPages int
 	NumPackages    int
 	Done           bool
+	// Status is one of “running”, “finished” or “failed”, see
+	// queryStatus().
+	Status         string
+	ErrorType      string `json:",omitempty"`
+	Priority       string
 	Started        time.Time
 	Ended          time.Time
 	StartedFromNow time.Duration
 	Duration       time.Duration
 	FilesTotal     []int
 	FilesProcessed []int
+	// Backends is only set once all backends returned.
+	Backends []backendStats `json:",omitempty"`
+	// Experiments are the ids of the experiments the query is part of.
+	Experiments []string `json:",omitempty"`
+	// Resources approximates the resources the query used so far.
+	Resources ResourceUsage
+}
+
+// queryStatsLocked returns the /queryz statistics of the query. The caller
+// must hold stateMu.
+func queryStatsLocked(queryid string, s queryState) queryStats {
+	stats := queryStats{
+		Searchterm:     s.query,
+		QueryId:        queryid,
+		NumEvents:      len(s.events),
+		Done:           s.done,
+		Status:         queryStatus(s),
+		ErrorType:      s.errorType,
+		Priority:       s.priority.String(),
+		Started:        s.started,
+		Ended:          s.ended,
+		StartedFromNow: elapsed(s.started),
+		Duration:       s.duration,
+		NumResults:     s.numResults(),
+		NumResultPages: s.resultPages,
+		FilesTotal:     s.filesTotal,
+		Experiments:    s.experiments,
+		FilesProcessed: s.filesProcessed,
+		Backends:       backendStatsLocked(s),
+		Resources:      resourceUsageLocked(s),
+	}
+	if stats.NumResults == 0 && stats.Done {
+		stats.NumResults = s.numResults()
+	}
+	return stats
 }
 
+// QueryzHandler serves /queryz, which lists the queries held in memory. See
+// parseQueryzOptions for the supported parameters. With format=json, the
+// page of queries is returned as JSON for scripting.
 func QueryzHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	if cancel := r.PostFormValue("cancel"); cancel != "" {
-		addEventMarshal(cancel, &Error{
-			Type:      "error",
-			ErrorType: "cancelled",
-		})
+		addEventMarshal(cancel, newError(errorTypeCancelled, ""))
 		finishQuery(cancel)
 		http.Redirect(w, r, "/queryz", http.StatusFound)
 		return
 	}
 
+	opts, err := parseQueryzOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	stateMu.RLock()
-	stats := make([]queryStats, len(state))
-	idx := 0
+	stats := make([]queryStats, 0, len(state))
 	for queryid, s := range state {
-		stats[idx] = queryStats{
-			Searchterm:     s.query,
-			QueryId:        queryid,
-			NumEvents:      len(s.events),
-			Done:           s.done,
-			Started:        s.started,
-			Ended:          s.ended,
-			StartedFromNow: time.Since(s.started),
-			Duration:       s.ended.Sub(s.started),
-			NumResults:     s.numResults(),
-			NumResultPages: s.resultPages,
-			FilesTotal:     s.filesTotal,
-			FilesProcessed: s.filesProcessed,
-		}
-		if stats[idx].NumResults == 0 && stats[idx].Done {
-			stats[idx].NumResults = s.numResults()
+		if queryid == adminQueryId {
+			continue
 		}
-		idx++
+		stats = append(stats, queryStatsLocked(queryid, s))
 	}
+	eventsSince := state[adminQueryId].nextSequence - 1
 	stateMu.RUnlock()
 
-	sort.Slice(stats, func(i, j int) bool {
-		return stats[i].Started.After(stats[j].Started)
-	})
+	page := opts.apply(stats)
+
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(page); err != nil {
+			log.Printf("Could not write /queryz reply: %v\n", err)
+		}
+		return
+	}
 
 	if err := common.Templates.ExecuteTemplate(w, "queryz.html", map[string]interface{}{
-		"queries": stats,
+		"queries":     page.Queries,
+		"page":        page,
+		"opts":        opts,
+		"eventsSince": eventsSince,
+		"i18n":        i18n.FromRequest(r),
 	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+type Pagination struct {
+	// Set to “pagination”.
+	Type        string
+	QueryId     string
+	ResultPages int
+
+	// Number of matches the source backends returned. Only differs from the
+	// number of results on the pages if Sampled is true.
+	TotalResults int
+	Sampled      bool
+
+	// Set if the query was started with max_results=N and stopped after N
+	// results, i.e. more results may exist.
+	Truncated bool
+
+	// Preview contains the top results (see -pagination_preview_results),
+	// which clients can display while loading the first page of results.
+	Preview []PreviewResult `json:",omitempty"`
+
+	// Downloads contains signed links to the results, which expire once the
+	// results may be deleted (see -results_retention).
+	Downloads *Downloads
+}
+
+func (p *Pagination) EventType() string {
+	return p.Type
+}
+
+// Pagination events are never obsoleted, but they implement obsoletableEvent
+// so that event handlers can recognize them (see pushOrInline).
+func (p *Pagination) ObsoletedBy(newEvent *obsoletableEvent) bool {
+	return false
+}
+
 // Caller needs to hold s.clientsMu
 func sendPaginationUpdate(queryid string, s queryState) {
-	type Pagination struct {
-		// Set to “pagination”.
-		Type        string
-		QueryId     string
-		ResultPages int
-	}
-
 	if s.resultPages > 0 {
 		addEventMarshal(queryid, &Pagination{
-			Type:        "pagination",
-			QueryId:     queryid,
-			ResultPages: s.resultPages,
+			Type:         eventTypePagination,
+			QueryId:      queryid,
+			ResultPages:  s.resultPages,
+			TotalResults: s.numMatches(),
+			Sampled:      len(s.resultPointers) < s.numMatches(),
+			Truncated:    s.truncated,
+			Preview:      paginationPreview(queryid, s.resultPointers),
+			Downloads:    queryDownloads(queryid, s.started, s.resultPages),
 		})
 	}
 }
 
-func storeResult(queryid string, backendidx int, result *sourcebackendpb.Match, resultLen int) {
+// NoResults is sent instead of a pagination event once a query finished
+// without results. Its (empty) result pages are served nevertheless.
+type NoResults struct {
+	// Set to “noresults”.
+	Type    string
+	QueryId string
+
+	// Suggestions are broader variants of the query (see
+	// suggestBroadening). Variants which are estimated to require grepping
+	// no files cannot have results either and are left out.
+	Suggestions []Suggestion `json:",omitempty"`
+}
+
+func (n *NoResults) EventType() string {
+	return n.Type
+}
+
+// NoResults events are never obsoleted, but they implement obsoletableEvent so
+// that event handlers can filter them by protocol version (see eventSupported).
+func (n *NoResults) ObsoletedBy(newEvent *obsoletableEvent) bool {
+	return false
+}
+
+// sendNoResults sends the noresults event for the finished query. The caller
+// must not hold stateMu.
+func sendNoResults(queryid string, s queryState) {
+	log.Printf("[%s] no results.\n", queryid)
+	event := &NoResults{
+		Type:    eventTypeNoResults,
+		QueryId: queryid,
+	}
+	if rewritten, err := url.Parse(s.rewrittenQuery); err == nil {
+		if backends := common.SourceBackendsFor(rewritten.Query().Get("snapshot")); backends != nil {
+			// The query is only finished (see finishQuery) once this event
+			// is sent, so a source backend which does not reply must not
+			// delay it by more than -trigram_stats_timeout.
+			ctx, cancel := context.WithTimeout(context.Background(), *trigramStatsTimeout)
+			defer cancel()
+			suggestions := suggestBroadening(ctx, queryid, backends, &sourcebackendpb.SearchRequest{
+				Query:        rewritten.Query().Get("q"),
+				RewrittenUrl: s.rewrittenQuery,
+			})
+			for _, suggestion := range suggestions {
+				if suggestion.EstimatedFiles > 0 {
+					event.Suggestions = append(event.Suggestions, suggestion)
+				}
+			}
+		}
+	}
+	addEventMarshal(queryid, event)
+}
+
+// storeResult stores a pointer to the result. For sampled queries, sampleSlot
+// is the index of the pointer to replace, see sampler.offer.
+func storeResult(queryid string, backendidx int, result *sourcebackendpb.Match, offset int64, resultLen int, sampleSlot int) {
 	// Without acquiring a write lock, just check if we need to consider this result
 	// for the top 10 at all.
 	stateMu.RLock()
 	s := state[queryid]
 	stateMu.RUnlock()
+	tailBackendReply(queryid, s.started, backendidx, "match", result)
 
 	if s.FirstPathRank > 0 {
 		// Now store the combined ranking of PathRanking (pre) and Ranking (post).
@@ -516,13 +1236,10 @@ func storeResult(queryid string, backendidx int, result *sourcebackendpb.Match,
 		} else {
 			// TODO: find the first s.result[] for the same package. then check again if the result is worthy of replacing that per-package result
 			// TODO: probably change the data structure so that we can do this more easily and also keep N results per package.
-
-			combined := append(s.results[:], resultPointer{
+			insertTop10(&s.results, resultPointer{
 				ranking:  result.Ranking,
 				pathHash: h.Sum64(),
 			})
-			sort.Sort(pointerByRanking(combined))
-			copy(s.results[:], combined[:10])
 			state[queryid] = s
 			stateMu.Unlock()
 
@@ -540,33 +1257,108 @@ func storeResult(queryid string, backendidx int, result *sourcebackendpb.Match,
 	}
 
 	bstate := s.perBackend[backendidx]
-	bstate.resultPointers = append(bstate.resultPointers, resultPointer{
+	pointer := resultPointer{
 		backendidx:  backendidx,
 		ranking:     result.Ranking,
-		offset:      bstate.tempFileOffset,
+		offset:      offset,
 		length:      resultLen,
 		pathHash:    h.Sum64(),
-		packageName: bstate.packagePool.Get(result.Package)})
+		packageName: s.packagePool.Get(result.Package),
+		dir:         s.packagePool.Get(topLevelDir(result.Path))}
+	if sampleSlot > -1 && sampleSlot < len(bstate.resultPointers) {
+		bstate.resultPointers[sampleSlot] = pointer
+	} else {
+		bstate.resultPointers = append(bstate.resultPointers, pointer)
+	}
 	bstate.allPackages[result.Package] = true
+	bstate.facets.add(result)
+	resultsRate.Mark(1)
+
+	if s.maxResults > 0 && float64(result.Ranking) >= *maxResultsMinRanking &&
+		atomic.AddInt64(s.qualifyingResults, 1) == int64(s.maxResults) {
+		log.Printf("[%s] got %d results, truncating query\n", queryid, s.maxResults)
+		stateMu.Lock()
+		s = state[queryid]
+		s.truncated = true
+		state[queryid] = s
+		stateMu.Unlock()
+		// Results which are still in flight are discarded.
+		s.cancel()
+	}
+
+	if maxBytes := maxResultBytesFor(queryid); maxBytes > 0 {
+		limit := int64(float64(maxBytes) * s.priority.limitsFactor())
+		total := atomic.AddInt64(s.resultBytes, int64(resultLen))
+		if total > limit && total-int64(resultLen) <= limit {
+			log.Printf("[%s] results exceed %d bytes, truncating query\n", queryid, limit)
+			stateMu.Lock()
+			s = state[queryid]
+			s.truncated = true
+			state[queryid] = s
+			stateMu.Unlock()
+			addEventMarshal(queryid, newError(errorTypeQuotaExceeded, ""))
+			s.cancel()
+		}
+	}
+}
+
+// insertTop10 inserts p into results (sorted by ranking), replacing the
+// lowest-ranked result.
+func insertTop10(results *[10]resultPointer, p resultPointer) {
+	combined := append(results[:], p)
+	sort.Sort(pointerByRanking(combined))
+	copy(results[:], combined[:10])
+}
+
+func queryTruncated(queryid string) bool {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return state[queryid].truncated
 }
 
-func failQuery(queryid string) {
+// failQuery finishes the query after err made it fail, see errorTypeFor.
+func failQuery(queryid string, err error) {
 	failedQueries.Inc()
-	addEventMarshal(queryid, &Error{
-		Type:      "error",
-		ErrorType: "failed",
-	})
+	addEventMarshal(queryid, newError(errorTypeFor(err), ""))
 	finishQuery(queryid)
 }
 
 func finishQuery(queryid string) {
+	addEvent(queryid, []byte{}, nil)
 	stateMu.RLock()
-	started := state[queryid].started
+	duration := state[queryid].duration
 	stateMu.RUnlock()
-	log.Printf("[%s] done (in %v), closing all client channels.\n", queryid, time.Since(started))
-	addEvent(queryid, []byte{}, nil)
+	log.Printf("[%s] done (in %v), closing all client channels.\n", queryid, duration)
+	publishQueryzEvent(queryid, queryzEventFinished)
+	removeRunningQuery(queryid)
+	// The incomplete results of abandoned queries must not be reloaded.
+	if !queryAbandoned(queryid) {
+		if err := persistQuery(queryid); err != nil {
+			log.Printf("[%s] could not persist query state: %v\n", queryid, err)
+		}
+	}
 
-	queryDurations.Observe(float64(time.Since(started) / time.Millisecond))
+	queryDurations.Observe(float64(duration / time.Millisecond))
+	stateMu.RLock()
+	queryEvents.Observe(float64(len(state[queryid].events)))
+	errorType := state[queryid].errorType
+	resultBytes := state[queryid].resultBytes
+	packagePool := state[queryid].packagePool
+	experimentIds := state[queryid].experiments
+	resources := resourceUsageLocked(state[queryid])
+	stateMu.RUnlock()
+	recordExperimentFinish(experimentIds, duration, errorType)
+	recordResourceUsage(resources)
+	if packagePool != nil {
+		stats := packagePool.Stats()
+		packagePoolLookups.Add(float64(stats.Lookups))
+		packagePoolHits.Add(float64(stats.Hits))
+	}
+	recordStatz(duration, errorType)
+	recordAnalytics(queryid)
+	if tenant := tenantOf(queryid); tenant != "" && resultBytes != nil {
+		tenantResultBytes.WithLabelValues(tenant).Add(float64(atomic.LoadInt64(resultBytes)))
+	}
 }
 
 func fsBytes(path string) (available uint64, total uint64) {
@@ -586,70 +1378,44 @@ func ensureEnoughSpaceAvailable() {
 	if err := os.MkdirAll(*queryResultsPath, 0755); err != nil {
 		log.Println(err)
 	}
-	available, total := fsBytes(*queryResultsPath)
-	headroom := uint64(*headroomPercentage * float64(total))
-	log.Printf("%d bytes available, %d bytes headroom required (20%%)\n", available, headroom)
-	if available >= headroom {
+	missing := headroomMissing()
+	log.Printf("%d bytes missing to keep %.0f%% of the file system free\n", missing, *headroomPercentage*100)
+	if missing == 0 {
 		return
 	}
 
-	log.Printf("Deleting an old query...\n")
-	dir, err := os.Open(*queryResultsPath)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer dir.Close()
-	infos, err := dir.Readdir(-1)
+	candidates, err := diskGCCandidates(currentGCPolicy())
 	if err != nil {
 		log.Fatal(err)
 	}
-	sort.Slice(infos, func(i, j int) bool {
-		return infos[i].ModTime().Before(infos[j].ModTime())
-	})
-	for _, info := range infos {
-		if !info.IsDir() {
-			continue
-		}
-		log.Printf("Removing query results for %q to make enough space\n", info.Name())
-		if err := os.RemoveAll(filepath.Join(*queryResultsPath, info.Name())); err != nil {
+	for _, c := range candidates {
+		log.Printf("Removing query results for %q to make enough space (-gc_policy=%s, %d bytes, last accessed %v ago)\n", c.QueryId, *gcPolicyName, c.Bytes, time.Since(c.LastAccess))
+		if err := os.RemoveAll(filepath.Join(*queryResultsPath, c.QueryId)); err != nil {
 			log.Fatal(err)
 		}
-		available, _ = fsBytes(*queryResultsPath)
-		if available >= headroom {
+		deletedQueries.WithLabelValues(*gcPolicyName).Inc()
+		deletedQueryBytes.WithLabelValues(*gcPolicyName).Add(float64(c.Bytes))
+		if headroomMissing() == 0 {
 			break
 		}
 	}
 }
 
-func writeFromPointers(queryid string, f io.Writer, pointers []resultPointer) error {
+// forEachMatch reads the results identified by pointers from the query’s
+// results storage and calls cb for each of them, in order.
+func forEachMatch(queryid string, pointers []resultPointer, cb func(idx int, match *sourcebackendpb.Match) error) error {
 	stateMu.RLock()
 	s := state[queryid]
 	stateMu.RUnlock()
 	firstPathRank := s.FirstPathRank
 
-	s.tempFilesMu.Lock()
-	defer s.tempFilesMu.Unlock()
-
-	if _, err := f.Write([]byte("[")); err != nil {
-		return err
-	}
 	var msg sourcebackendpb.SearchReply
 	buf := proto.NewBuffer(nil)
 	for idx, pointer := range pointers {
-		src := s.perBackend[pointer.backendidx].tempFile
-		if _, err := src.Seek(pointer.offset, os.SEEK_SET); err != nil {
-			return err
-		}
-		// TODO: Avoid the allocations by using a slice and only allocate a new buffer when pointer.length > cap(rdbuf)
-		rdbuf := make([]byte, pointer.length)
-		if _, err := src.Read(rdbuf); err != nil {
+		rdbuf, err := s.storage.Read(pointer.backendidx, pointer.offset, pointer.length)
+		if err != nil {
 			return err
 		}
-		if idx > 0 {
-			if _, err := f.Write([]byte(",")); err != nil {
-				return err
-			}
-		}
 		buf.SetBuf(rdbuf)
 		msg.Reset()
 		if err := buf.Unmarshal(&msg); err != nil {
@@ -663,10 +1429,28 @@ func writeFromPointers(queryid string, f io.Writer, pointers []resultPointer) er
 		// the dcs-source-backend in queryBackend(), but then modify the
 		// ranking in storeResult().
 		match.Ranking = match.Pathrank + ((firstPathRank * 0.1) * match.Ranking)
-		if err := WriteMatchJSON(match, f); err != nil {
+		if err := cb(idx, match); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+func writeFromPointers(queryid string, f io.Writer, pointers []resultPointer) error {
+	if _, err := f.Write([]byte("[")); err != nil {
+		return err
+	}
+	err := forEachMatch(queryid, pointers, func(idx int, match *sourcebackendpb.Match) error {
+		if idx > 0 {
+			if _, err := f.Write([]byte(",")); err != nil {
+				return err
+			}
+		}
+		return WriteMatchJSON(match, f)
+	})
+	if err != nil {
+		return err
+	}
 	if _, err := f.Write([]byte("]\n")); err != nil {
 		return err
 	}
@@ -674,25 +1458,49 @@ func writeFromPointers(queryid string, f io.Writer, pointers []resultPointer) er
 }
 
 func writeToDisk(queryid string) error {
+	// Flushing may upload the results (see s3Store), so stateMu must not be
+	// held.
+	stateMu.RLock()
+	storage := state[queryid].storage
+	stateMu.RUnlock()
+	if err := storage.Flush(); err != nil {
+		return err
+	}
+
 	// Get the slice with results and unset it on the state so that processing can continue.
 	stateMu.Lock()
 	s := state[queryid]
 	pointers := make([]resultPointer, 0, s.numResults())
-	for _, bstate := range s.perBackend {
+	for idx, bstate := range s.perBackend {
 		pointers = append(pointers, bstate.resultPointers...)
-		bstate.tempFileWriter.Flush()
+		s.facets.merge(bstate.facets)
+		backendTempFileBytes.Observe(float64(s.storage.Size(idx)))
 	}
-	if len(pointers) == 0 {
-		log.Printf("[%s] not writing, no results.\n", queryid)
-		stateMu.Unlock()
-		return nil
+	allPackages := make([]map[string]bool, len(s.perBackend))
+	for idx, bstate := range s.perBackend {
+		allPackages[idx] = bstate.allPackages
 	}
-	idx := 0
+	if s.sampleSize > 0 {
+		pointers = mergeSamples(s.perBackend, s.sampleSize)
+		log.Printf("[%s] sampled %d of %d results.\n", queryid, len(pointers), s.numMatches())
+		// Packages whose results were all replaced in the reservoir must not
+		// show up.
+		sampled := make(map[string]bool)
+		for _, pointer := range pointers {
+			sampled[*pointer.packageName] = true
+		}
+		allPackages = []map[string]bool{sampled}
+	}
+	// Queries without results record an empty set of pointers like all
+	// others, so that the results endpoints serve an empty first page and
+	// packages list instead of 404, and clients and caches do not need to
+	// special-case them.
+	queryResults.Observe(float64(len(pointers)))
 
 	// For each full package (i3-wm_4.8-1), store only the newest version.
 	packageVersions := make(map[string]dpkgversion.Version)
-	for _, bstate := range s.perBackend {
-		for pkg, _ := range bstate.allPackages {
+	for _, pkgs := range allPackages {
+		for pkg, _ := range pkgs {
 			underscore := strings.Index(pkg, "_")
 			name := pkg[:underscore]
 			version, err := dpkgversion.Parse(pkg[underscore+1:])
@@ -712,6 +1520,7 @@ func writeToDisk(queryid string) error {
 	}
 
 	packages := make([]string, len(packageVersions))
+	idx := 0
 	for pkg, _ := range packageVersions {
 		packages[idx] = pkg
 		idx++
@@ -723,18 +1532,19 @@ func writeToDisk(queryid string) error {
 
 	log.Printf("[%s] sorting, %d results, %d packages.\n", queryid, len(pointers), len(packages))
 	pointerSortingStarted := time.Now()
-	sort.Sort(pointerByRanking(pointers))
+	sortPointers(pointers, *sortWorkers)
 	log.Printf("[%s] pointer sorting done (%v).\n", queryid, time.Since(pointerSortingStarted))
 
 	// TODO: it’d be so much better if we would correctly handle ESPACE errors
 	// in the code below (and above), but for that we need to carefully test it.
 	ensureEnoughSpaceAvailable()
 
-	pages := int(math.Ceil(float64(len(pointers)) / float64(resultsPerPage)))
+	pages := int(math.Ceil(float64(len(pointers)) / float64(*resultsPerPage)))
 
 	// Now save the results into their package-specific files.
 	byPkgSortingStarted := time.Now()
 	bypkg := make(map[string][]resultPointer)
+	bydir := make(dirGroups)
 	for _, pointer := range pointers {
 		pkg := *pointer.packageName
 		underscore := strings.Index(pkg, "_")
@@ -743,8 +1553,9 @@ func writeToDisk(queryid string) error {
 		if packageVersions[name].String() != pkg[underscore+1:] {
 			continue
 		}
+		bydir.add(name, pointer)
 		pkgresults := bypkg[name]
-		if len(pkgresults) >= resultsPerPackage {
+		if len(pkgresults) >= *resultsPerPackage {
 			continue
 		}
 		pkgresults = append(pkgresults, pointer)
@@ -752,15 +1563,32 @@ func writeToDisk(queryid string) error {
 	}
 	log.Printf("[%s] by-pkg sorting done (%v).\n", queryid, time.Since(byPkgSortingStarted))
 
+	// The pointers (and the temporary files they point into, which are never
+	// modified after this point) fully determine the contents of all result
+	// pages, so a hash over them is a cheap replacement for hashing each
+	// page’s contents.
+	h := fnv.New64()
+	fmt.Fprintf(h, "%s %d\n", queryid, s.started.UnixNano())
+	for _, pointer := range pointers {
+		fmt.Fprintf(h, "%d %d %d\n", pointer.backendidx, pointer.offset, pointer.length)
+	}
+
 	stateMu.Lock()
 	s = state[queryid]
 	s.resultPointers = pointers
 	s.resultPointersByPkg = bypkg
+	s.dirsByPkg = bydir.sorted()
 	s.resultPages = pages
+	s.resultsDigest = fmt.Sprintf("%x", h.Sum64())
 	state[queryid] = s
 	stateMu.Unlock()
 
-	sendPaginationUpdate(queryid, s)
+	if len(pointers) == 0 {
+		sendNoResults(queryid, s)
+	} else {
+		sendPaginationUpdate(queryid, s)
+	}
+	sendFacetsUpdate(queryid, s)
 	return nil
 }
 
@@ -768,12 +1596,13 @@ func storeProgress(queryid string, backendidx int, progress *sourcebackendpb.Pro
 	stateMu.RLock()
 	s := state[queryid]
 	stateMu.RUnlock()
+	tailBackendReply(queryid, s.started, backendidx, "progress", progress)
 	s.filesMu.Lock()
 	s.filesTotal[backendidx] = int(progress.FilesTotal)
 	s.filesProcessed[backendidx] = int(progress.FilesProcessed)
 	s.filesMu.Unlock()
 	allSet := true
-	for i := 0; i < len(common.SourceBackendStubs); i++ {
+	for i := 0; i < len(s.filesTotal); i++ {
 		if s.filesTotal[i] == -1 {
 			log.Printf("total number for backend %d missing\n", i)
 			allSet = false
@@ -792,21 +1621,29 @@ func storeProgress(queryid string, backendidx int, progress *sourcebackendpb.Pro
 
 	if allSet && filesProcessed == filesTotal {
 		log.Printf("[%s] [src:%d] query done on all backends, writing to disk.\n", queryid, backendidx)
-		if err := writeToDisk(queryid); err != nil {
+		started := time.Now()
+		err := writeToDisk(queryid)
+		atomic.AddInt64(&s.resources.writeToDiskNanos, int64(time.Since(started)))
+		if err != nil {
 			log.Printf("[%s] writeToDisk() failed: %v\n", queryid, err)
-			failQuery(queryid)
+			failQuery(queryid, err)
+		}
+		if s.countOnly {
+			sendCountsUpdate(queryid)
 		}
 	}
 
 	if allSet {
 		log.Printf("[%s] [src:%d] (sending) progress: %d of %d\n", queryid, backendidx, progress.FilesProcessed, progress.FilesTotal)
 		addEventMarshal(queryid, &ProgressUpdate{
-			Type:           "progress",
+			Type:           eventTypeProgress,
 			QueryId:        queryid,
 			FilesProcessed: filesProcessed,
 			FilesTotal:     filesTotal,
-			Results:        s.numResults(),
+			Results:        s.numMatches(),
+			Experiments:    s.experiments,
 		})
+		publishQueryzEvent(queryid, queryzEventProgress)
 		if filesProcessed == filesTotal {
 			finishQuery(queryid)
 		}
@@ -815,33 +1652,16 @@ func storeProgress(queryid string, backendidx int, progress *sourcebackendpb.Pro
 	}
 }
 
-func PerPackageResultsHandler(w http.ResponseWriter, r *http.Request) {
-	matches := perPackagePathRe.FindStringSubmatch(r.URL.Path)
-	if matches == nil || len(matches) != 3 {
-		matches = redirectPathRe.FindStringSubmatch(r.URL.Path)
-		if len(matches) < 3 {
-			http.Error(w, "Bad request", http.StatusBadRequest)
-			return
-		}
-		pageSuffix := "&page=" + matches[2]
-		if matches[2] == "0" {
-			pageSuffix = ""
-		}
-		http.Redirect(w, r, "/search?q="+matches[1]+pageSuffix+"&perpkg=1", http.StatusFound)
-		return
-	}
-
-	queryid := matches[1]
-	pagenr, err := strconv.Atoi(matches[2])
-	if err != nil {
-		log.Fatalf("Could not convert %q into a number: %v\n", matches[2], err)
-	}
+// awaitQueryDone waits (for up to a minute) until the query is finished, which
+// is required for grouped results, see writeToDisk. Returns false after
+// replying with an error if the query does not exist or is not finished.
+func awaitQueryDone(w http.ResponseWriter, queryid string) bool {
 	stateMu.RLock()
 	s, ok := state[queryid]
 	stateMu.RUnlock()
 	if !ok {
 		http.Error(w, "No such query.", http.StatusNotFound)
-		return
+		return false
 	}
 	if !s.done {
 		started := time.Now()
@@ -856,16 +1676,50 @@ func PerPackageResultsHandler(w http.ResponseWriter, r *http.Request) {
 			time.Sleep(100 * time.Millisecond)
 		}
 		if !s.done {
-			log.Printf("[%s] query not yet finished, cannot produce per-package results\n", queryid)
+			log.Printf("[%s] query not yet finished, cannot produce grouped results\n", queryid)
 			http.Error(w, "Query not finished yet.", http.StatusInternalServerError)
+			return false
+		}
+	}
+	return true
+}
+
+func PerPackageResultsHandler(w http.ResponseWriter, r *http.Request) {
+	matches := perPackagePathRe.FindStringSubmatch(r.URL.Path)
+	if matches == nil || len(matches) != 4 {
+		matches = redirectPathRe.FindStringSubmatch(r.URL.Path)
+		if len(matches) < 3 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
 			return
 		}
+		pageSuffix := "&page=" + matches[2]
+		if matches[2] == "0" {
+			pageSuffix = ""
+		}
+		http.Redirect(w, r, "/search?q="+matches[1]+pageSuffix+"&perpkg=1", http.StatusFound)
+		return
+	}
+
+	queryid := matches[1]
+	perPackage, err := strconv.Atoi(matches[2])
+	if err != nil || perPackage < 1 {
+		http.Error(w, "Invalid number of results per package.", http.StatusBadRequest)
+		return
+	}
+	pagenr, err := strconv.Atoi(matches[3])
+	if err != nil {
+		log.Fatalf("Could not convert %q into a number: %v\n", matches[3], err)
+	}
+	write, err := groupedResultsWriter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !awaitQueryDone(w, queryid) {
+		return
 	}
 
-	// For compatibility with old versions, we serve the files that are
-	// directly served by nginx as well by now.
-	// This can be removed after 2015-06-01, when all old clients should be
-	// long expired from any caches.
-	name := filepath.Join(*queryResultsPath, queryid, fmt.Sprintf("perpackage_2_page_%d.json", pagenr))
-	http.ServeFile(w, r, name)
+	if err := write(queryid, pagenr, perPackage, w, w, r); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
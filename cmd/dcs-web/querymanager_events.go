@@ -1,27 +1,47 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 // Since multiple users can perform the same query at (roughly) the same time
 // (especially if a query gets viral on twitter), all messages that should be
 // sent out to the user are stored in a slice.
 //
-// Each of the events has a sequence number, which corresponds to its position
-// in the slice.
+// Each of the events has a sequence number, which is assigned when the event
+// is added and never changes. Since obsoleted events are removed from the
+// slice (see below), the sequence number does not necessarily correspond to
+// the event’s position in the slice.
 //
 // Each client connection calls getEvent() to get the next event (blockingly).
+// Clients which support batches (see -event_batch_interval) additionally call
+// pendingEvents() to get all events which were added in the meantime.
 //
 // The three different cases (user who sends the query, user who sends the same
 // query before the query is finished, user who requests a query which is
 // already finished) are thus handled in exactly the same way.
 //
-// In order to preserve bandwidth, old events can be deleted, e.g. a new
-// ProgressUpdate event deletes older ProgressUpdates, since only the very
+// In order to preserve bandwidth and memory, old events can be deleted, e.g. a
+// new ProgressUpdate event deletes older ProgressUpdates, since only the very
 // latest progress is interesting for clients that “join” in on the query.
+// Hence, the number of events stored per query is bounded by the number of
+// results plus a small constant, no matter how many progress updates the
+// source backends send.
+
+var eventBatchInterval = flag.Duration("event_batch_interval",
+	50*time.Millisecond,
+	"For clients which request batches (batch=1), events which are added within this interval after an event are sent together with it in one message, reducing the number of messages (and re-renderings) for fast queries. 0 disables batching")
 
 type obsoletableEvent interface {
 	ObsoletedBy(newEvent *obsoletableEvent) bool
@@ -30,8 +50,12 @@ type obsoletableEvent interface {
 
 // An arbitrary event, such as a progress update, a search result or an error.
 type event struct {
+	sequence int
 	data     []byte
 	original obsoletableEvent
+
+	// obsolete is set when the event is removed from queryState.events, for
+	// the benefit of clients which are just about to send it.
 	obsolete *bool
 }
 
@@ -41,16 +65,43 @@ func addEvent(queryid string, data []byte, origdata interface{}) {
 	s := state[queryid]
 	original, _ := origdata.(obsoletableEvent)
 	s.events = append(s.events, event{
+		sequence: s.nextSequence,
 		data:     data,
 		obsolete: new(bool),
 		original: original})
+	s.nextSequence++
+	if s.resources != nil {
+		atomic.AddInt64(&s.resources.eventBytes, int64(len(data)))
+	}
+	tailEvent(queryid, &s, s.nextSequence-1, data, origdata)
+	if len(s.timeline) < maxTimelineEntries {
+		entry := timelineEntry{
+			Offset: elapsed(s.started).String(),
+			Time:   time.Now(),
+			Type:   timelineEventType(data, origdata),
+			Bytes:  len(data),
+		}
+		if p, ok := origdata.(*ProgressUpdate); ok {
+			entry.Progress = &timelineProgress{
+				FilesProcessed: p.FilesProcessed,
+				FilesTotal:     p.FilesTotal,
+				Results:        p.Results,
+			}
+		}
+		s.timeline = append(s.timeline, entry)
+	}
+	if e, ok := origdata.(*Error); ok && s.errorType == "" {
+		s.errorType = e.ErrorType
+	}
 	// An empty message marks the query as finished, but further errors can
 	// occur, so we store whether we’ve seen an empty message for use in
 	// queryCompleted().
 	if !s.done && len(data) == 0 {
 		s.done = true
 		s.ended = time.Now()
+		s.duration = s.ended.Sub(s.started)
 		activeQueries.Sub(1)
+		slots.release(queryid)
 	}
 	state[queryid] = s
 
@@ -73,36 +124,198 @@ func addEventMarshal(queryid string, data interface{}) {
 		// We cannot obsolete events once the query is done, because then all
 		// events before the done marker may get obsoleted (e.g. all progress
 		// updates, for a query with 0 files).
-		if state[queryid].done {
+		s := state[queryid]
+		if s.done {
 			return
 		}
 
 		// Consider all events before the just added event for obsoletion. At
-		// most one event will be obsoleted.
-		events := state[queryid].events
-		for i := len(events) - 2; i >= 0; i-- {
-			if events[i].original == nil {
+		// most one event will be obsoleted, since all earlier events of the
+		// same type were obsoleted when it was added.
+		for i := len(s.events) - 2; i >= 0; i-- {
+			if s.events[i].original == nil {
 				continue
 			}
-			if events[i].original.ObsoletedBy(&original) {
-				*(events[i].obsolete) = true
+			if s.events[i].original.ObsoletedBy(&original) {
+				*(s.events[i].obsolete) = true
+				tailObsoleted(queryid, &s, s.events[i].sequence)
+				s.events = append(s.events[:i], s.events[i+1:]...)
+				state[queryid] = s
 				break
 			}
 		}
 	}
 }
 
+// eventIndex returns the position in events of the first event whose sequence
+// number is larger than lastseen, or len(events).
+func eventIndex(events []event, lastseen int) int {
+	return sort.Search(len(events), func(i int) bool {
+		return events[i].sequence > lastseen
+	})
+}
+
 func getEvent(queryid string, lastseen int) (event, int) {
 	// We need to prevent new events being added, otherwise we could deadlock.
 	stateMu.Lock()
 	s := state[queryid]
-	for lastseen+1 >= len(s.events) {
+	idx := eventIndex(s.events, lastseen)
+	for idx >= len(s.events) {
 		log.Printf("[%s] lastseen=%d, waiting\n", queryid, lastseen)
 		s.newEvent.Wait()
 		s = state[queryid]
+		idx = eventIndex(s.events, lastseen)
 	}
+	// addEventMarshal compacts s.events in place, so the event must be
+	// copied before releasing the lock.
+	ev := s.events[idx]
 	stateMu.Unlock()
-	return s.events[lastseen+1], lastseen + 1
+	return ev, ev.sequence
+}
+
+// pendingEvents returns all events after lastseen which were already added,
+// without waiting for new events.
+func pendingEvents(queryid string, lastseen int) []event {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	s := state[queryid]
+	idx := eventIndex(s.events, lastseen)
+	return append([]event(nil), s.events[idx:]...)
+}
+
+// waitEvent waits until an event after lastseen was added to the query, ctx
+// is done or timeout passed, whichever happens first. Returns whether an event
+// after lastseen is available.
+func waitEvent(ctx context.Context, queryid string, lastseen int, timeout time.Duration) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s, ok := state[queryid]
+	if !ok {
+		return false
+	}
+	// Wake up the waiting loop below once the wait is over, like addEvent
+	// does when adding an event.
+	cond := s.newEvent
+	expired := false
+	wakeup := func() {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		expired = true
+		cond.Broadcast()
+	}
+	timer := time.AfterFunc(timeout, wakeup)
+	defer timer.Stop()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			wakeup()
+		case <-stop:
+		}
+	}()
+	for !expired {
+		if eventIndex(s.events, lastseen) < len(s.events) {
+			return true
+		}
+		cond.Wait()
+		if s, ok = state[queryid]; !ok {
+			return false
+		}
+	}
+	return eventIndex(s.events, lastseen) < len(s.events)
+}
+
+// encodeEventBatch returns the message for sending the specified event data to
+// a client in one message: {"Type":"batch","Events":[…]}. A single event is
+// sent as is.
+func encodeEventBatch(batch [][]byte) []byte {
+	if len(batch) == 1 {
+		return batch[0]
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`{"Type":"` + eventTypeBatch + `","Events":[`)
+	buf.Write(bytes.Join(batch, []byte(",")))
+	buf.WriteString("]}")
+	return buf.Bytes()
+}
+
+// formatEventId returns the id of the event with the specified sequence number
+// of a query run on the specified index generation (see -index_generation).
+// Clients send the id of the last event they received when reconnecting.
+func formatEventId(generation, sequence int) string {
+	return fmt.Sprintf("%d:%d", generation, sequence)
+}
+
+// parseEventId parses an event id (see formatEventId). Ids sent by older
+// versions only contain the sequence number, in which case generation is -1.
+func parseEventId(id string) (generation, sequence int, err error) {
+	generation = -1
+	if idx := strings.IndexByte(id, ':'); idx > -1 {
+		if generation, err = strconv.Atoi(id[:idx]); err != nil {
+			return 0, 0, err
+		}
+		id = id[idx+1:]
+	}
+	if sequence, err = strconv.Atoi(id); err != nil {
+		return 0, 0, err
+	}
+	return generation, sequence, nil
+}
+
+// staleEventId returns whether the event id (see formatEventId) refers to an
+// event of a query which was run on an older index generation.
+func staleEventId(id string) bool {
+	generation, _, err := parseEventId(id)
+	return err == nil && generation != -1 && generation != *indexGeneration
+}
+
+// resumeFrom returns the sequence number of the last event a reconnecting
+// client has seen, given the value of its Last-Event-ID header (or since=
+// parameter). Positions past the end of a finished query’s events are clamped,
+// so that such clients get the done marker instead of waiting forever.
+func resumeFrom(queryid string, lastEventId string) int {
+	if lastEventId == "" {
+		return -1
+	}
+	_, lastseen, err := parseEventId(lastEventId)
+	if err != nil || lastseen < -1 {
+		return -1
+	}
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	s := state[queryid]
+	if s.done && lastseen >= s.nextSequence-1 {
+		lastseen = s.nextSequence - 2
+	}
+	return lastseen
+}
+
+// supersededLater returns whether the event with the specified sequence number
+// is obsoleted by an event which was stored after it. addEventMarshal stops
+// obsoleting events once the query is done, so clients which replay events
+// use this to skip e.g. all but the most recent ProgressUpdate.
+func supersededLater(queryid string, sequence int) bool {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	events := state[queryid].events
+	idx := eventIndex(events, sequence-1)
+	if idx >= len(events) || events[idx].sequence != sequence {
+		// Already removed, i.e. obsoleted.
+		return true
+	}
+	if events[idx].original == nil {
+		return false
+	}
+	for _, later := range events[idx+1:] {
+		if later.original == nil {
+			continue
+		}
+		if events[idx].original.ObsoletedBy(&later.original) {
+			return true
+		}
+	}
+	return false
 }
 
 func queryCompleted(queryid string) bool {
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+)
+
+// newTestQuery creates an empty query and returns a function which deletes it.
+func newTestQuery(queryid string) func() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	state[queryid] = queryState{
+		newEvent: sync.NewCond(&stateMu),
+	}
+	return func() {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		delete(state, queryid)
+	}
+}
+
+func TestEventCompaction(t *testing.T) {
+	const queryid = "compaction"
+	defer newTestQuery(queryid)()
+
+	updates := 1000000
+	if testing.Short() {
+		updates = 10000
+	}
+	addEventMarshal(queryid, &Error{Type: "error", ErrorType: "backendunavailable"})
+	for i := 0; i < updates; i++ {
+		addEventMarshal(queryid, &ProgressUpdate{
+			Type:           "progress",
+			QueryId:        queryid,
+			FilesProcessed: i,
+			FilesTotal:     updates,
+		})
+		if i%1000 == 0 {
+			addEvent(queryid, []byte(`{"Type":"result"}`), nil)
+		}
+	}
+
+	stateMu.RLock()
+	s := state[queryid]
+	stateMu.RUnlock()
+	// 1 error, 1 progress update and one result per 1000 progress updates.
+	if got, want := len(s.events), 1+1+(updates/1000); got != want {
+		t.Fatalf("len(events) = %d, want %d", got, want)
+	}
+	if got, max := cap(s.events), 2*(len(s.events)+1); got > max {
+		t.Fatalf("cap(events) = %d, want at most %d", got, max)
+	}
+	if got, want := s.nextSequence, 1+updates+(updates/1000); got != want {
+		t.Fatalf("nextSequence = %d, want %d", got, want)
+	}
+
+	// Clients which start at the beginning see the compacted events in order,
+	// ending with the most recent progress update.
+	lastseen := -1
+	var received []event
+	for len(received) < len(s.events) {
+		ev, sequence := getEvent(queryid, lastseen)
+		if sequence <= lastseen {
+			t.Fatalf("getEvent(%d) returned sequence %d", lastseen, sequence)
+		}
+		lastseen = sequence
+		received = append(received, ev)
+	}
+	last := received[len(received)-1].original.(*ProgressUpdate)
+	if got, want := last.FilesProcessed, updates-1; got != want {
+		t.Fatalf("last progress update: FilesProcessed = %d, want %d", got, want)
+	}
+}
+
+func TestEventResume(t *testing.T) {
+	const queryid = "resume"
+	defer newTestQuery(queryid)()
+
+	addEventMarshal(queryid, &ProgressUpdate{Type: "progress", FilesProcessed: 1})
+	addEvent(queryid, []byte(`{"Type":"result"}`), nil) // sequence 1
+	addEventMarshal(queryid, &ProgressUpdate{Type: "progress", FilesProcessed: 2})
+	addEventMarshal(queryid, &ProgressUpdate{Type: "progress", FilesProcessed: 3}) // sequence 3
+
+	// Sequence numbers are stable: resuming after the result skips the
+	// obsoleted progress update (sequence 2).
+	ev, sequence := getEvent(queryid, resumeFrom(queryid, "1"))
+	if sequence != 3 {
+		t.Fatalf("resuming after 1: got sequence %d, want 3", sequence)
+	}
+	if got := ev.original.(*ProgressUpdate).FilesProcessed; got != 3 {
+		t.Fatalf("resuming after 1: FilesProcessed = %d, want 3", got)
+	}
+
+	if got := resumeFrom(queryid, "invalid"); got != -1 {
+		t.Fatalf("resumeFrom(invalid) = %d, want -1", got)
+	}
+
+	// Once the query is done, positions past the end are clamped so that the
+	// client receives the done marker.
+	addEvent(queryid, []byte{}, nil) // sequence 4
+	ev, sequence = getEvent(queryid, resumeFrom(queryid, "4711"))
+	if sequence != 4 || len(ev.data) != 0 {
+		t.Fatalf("resuming after 4711: got sequence %d (data %q), want done marker 4", sequence, ev.data)
+	}
+}
+
+func TestEventId(t *testing.T) {
+	defer func(generation int) { *indexGeneration = generation }(*indexGeneration)
+	*indexGeneration = 3
+
+	for _, tt := range []struct {
+		id             string
+		wantGeneration int
+		wantSequence   int
+		wantStale      bool
+	}{
+		{formatEventId(3, 42), 3, 42, false},
+		{formatEventId(2, 42), 2, 42, true},
+		{"42", -1, 42, false}, // sent by older versions
+	} {
+		generation, sequence, err := parseEventId(tt.id)
+		if err != nil {
+			t.Fatalf("parseEventId(%q): %v", tt.id, err)
+		}
+		if generation != tt.wantGeneration || sequence != tt.wantSequence {
+			t.Errorf("parseEventId(%q) = %d, %d, want %d, %d", tt.id, generation, sequence, tt.wantGeneration, tt.wantSequence)
+		}
+		if got := staleEventId(tt.id); got != tt.wantStale {
+			t.Errorf("staleEventId(%q) = %v, want %v", tt.id, got, tt.wantStale)
+		}
+	}
+
+	for _, id := range []string{"", "x:1", "1:x"} {
+		if _, _, err := parseEventId(id); err == nil {
+			t.Errorf("parseEventId(%q) unexpectedly succeeded", id)
+		}
+		if staleEventId(id) {
+			t.Errorf("staleEventId(%q) = true for an invalid id", id)
+		}
+	}
+}
+
+func TestEventBatch(t *testing.T) {
+	const queryid = "batch"
+	defer newTestQuery(queryid)()
+
+	addEventMarshal(queryid, &ProgressUpdate{Type: "progress", FilesProcessed: 1})
+	addEvent(queryid, []byte(`{"Type":"result"}`), nil)
+	addEventMarshal(queryid, &ProgressUpdate{Type: "progress", FilesProcessed: 2})
+
+	// The first progress update was obsoleted by the second one.
+	pending := pendingEvents(queryid, -1)
+	if got, want := len(pending), 2; got != want {
+		t.Fatalf("len(pendingEvents(-1)) = %d, want %d", got, want)
+	}
+	if got := pendingEvents(queryid, pending[1].sequence); len(got) != 0 {
+		t.Fatalf("pendingEvents(%d) = %v, want none", pending[1].sequence, got)
+	}
+
+	var batch [][]byte
+	for _, ev := range pending {
+		batch = append(batch, ev.data)
+	}
+	var msg struct {
+		Type   string
+		Events []struct {
+			Type           string
+			FilesProcessed int
+		}
+	}
+	if err := json.Unmarshal(encodeEventBatch(batch), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := msg.Type, "batch"; got != want {
+		t.Fatalf("Type = %q, want %q", got, want)
+	}
+	if got, want := len(msg.Events), 2; got != want {
+		t.Fatalf("len(Events) = %d, want %d", got, want)
+	}
+	if got, want := msg.Events[1].FilesProcessed, 2; got != want {
+		t.Fatalf("Events[1].FilesProcessed = %d, want %d", got, want)
+	}
+	if got, want := string(encodeEventBatch(batch[:1])), string(batch[0]); got != want {
+		t.Fatalf("single event batch = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// The benchmarks below cover the hot path of aggregating results from the
+// source backends (storeResult), and of serving them once the query is done
+// (pointer sorting in writeToDisk, writeFromPointers), using synthetic
+// results. Run e.g.:
+//
+//	go test -run=^$ -bench=. -benchmem ./cmd/dcs-web -bench_max_results=10000000
+var benchMaxResults = flag.Int("bench_max_results",
+	1000000,
+	"Largest number of synthetic results to use in benchmarks (10000 to 10000000)")
+
+// benchSizes calls f with a sub-benchmark for each number of results.
+func benchSizes(b *testing.B, f func(b *testing.B, n int)) {
+	for _, n := range []int{10000, 100000, 1000000, 10000000} {
+		if n > *benchMaxResults {
+			break
+		}
+		b.Run(fmt.Sprintf("results=%d", n), func(b *testing.B) {
+			f(b, n)
+			b.ReportMetric(float64(n), "results/op")
+		})
+	}
+}
+
+// syntheticMatch sets match to the i-th synthetic result: 100 files in each
+// of 1000 packages, with random rankings.
+func syntheticMatch(rnd *rand.Rand, i int, match *sourcebackendpb.Match) {
+	pkg := fmt.Sprintf("pkg%d_1.%d-1", i%1000, i%3)
+	*match = sourcebackendpb.Match{
+		Path:     fmt.Sprintf("%s/src/file%d.c", pkg, (i/1000)%100),
+		Line:     uint32(i),
+		Ctxp2:    "#include <stdio.h>",
+		Context:  "int main(int argc, char *argv[]) {",
+		Ctxn1:    "    return 0;",
+		Ctxn2:    "}",
+		Pathrank: rnd.Float32(),
+		Ranking:  rnd.Float32(),
+		Package:  pkg,
+	}
+}
+
+// newBenchQuery creates a query with one source backend and returns a
+// function which deletes it.
+func newBenchQuery(queryid string) func() {
+	querystate := newQueryState("q="+queryid, "q="+queryid, 1)
+	querystate.cancel = func() {}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	state[queryid] = querystate
+	return func() {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		if s := state[queryid]; s.storage != nil {
+			s.storage.Close()
+		}
+		delete(state, queryid)
+	}
+}
+
+func BenchmarkStoreResult(b *testing.B) {
+	benchSizes(b, func(b *testing.B, n int) {
+		var match sourcebackendpb.Match
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			const queryid = "bench-storeresult"
+			cleanup := newBenchQuery(queryid)
+			rnd := rand.New(rand.NewSource(1))
+			b.StartTimer()
+			for r := 0; r < n; r++ {
+				syntheticMatch(rnd, r, &match)
+				storeResult(queryid, 0, &match, int64(r)*200, 200, -1)
+			}
+			b.StopTimer()
+			cleanup()
+			b.StartTimer()
+		}
+	})
+}
+
+// randomPointers returns n result pointers with random rankings.
+func randomPointers(n int) []resultPointer {
+	rnd := rand.New(rand.NewSource(1))
+	pointers := make([]resultPointer, n)
+	for i := range pointers {
+		pointers[i] = resultPointer{
+			ranking:  rnd.Float32(),
+			pathHash: rnd.Uint64(),
+			offset:   int64(i) * 200,
+			length:   200,
+		}
+	}
+	return pointers
+}
+
+func BenchmarkInsertTop10(b *testing.B) {
+	for _, tt := range []struct {
+		name  string
+		order func(pointers []resultPointer)
+	}{
+		// Results arrive in random order: few of them enter the top 10
+		// (storeResult only calls insertTop10 for those).
+		{"random", func([]resultPointer) {}},
+		// Results arrive in ascending order of their ranking: every
+		// result enters the top 10.
+		{"ascending", func(pointers []resultPointer) {
+			sort.Sort(sort.Reverse(pointerByRanking(pointers)))
+		}},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			benchSizes(b, func(b *testing.B, n int) {
+				pointers := randomPointers(n)
+				tt.order(pointers)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var top10 [10]resultPointer
+					for _, p := range pointers {
+						if p.ranking > top10[9].ranking {
+							insertTop10(&top10, p)
+						}
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkSortPointers(b *testing.B) {
+	for _, workers := range []int{1, 0} {
+		name := "sequential"
+		if workers == 0 {
+			name = "parallel"
+		}
+		b.Run(name, func(b *testing.B) {
+			benchSizes(b, func(b *testing.B, n int) {
+				pointers := randomPointers(n)
+				sorted := make([]resultPointer, n)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					copy(sorted, pointers)
+					b.StartTimer()
+					sortPointers(sorted, workers)
+				}
+			})
+		})
+	}
+}
+
+// storeBenchResults stores n synthetic results in a query, like queryBackend
+// does, and returns their pointers.
+func storeBenchResults(b *testing.B, queryid string, n int) []resultPointer {
+	storage, err := store.Create(queryid, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	stateMu.Lock()
+	s := state[queryid]
+	s.storage = storage
+	state[queryid] = s
+	stateMu.Unlock()
+
+	sink := newReplySink(queryid, 0)
+	rnd := rand.New(rand.NewSource(1))
+	for r := 0; r < n; r++ {
+		var match sourcebackendpb.Match
+		syntheticMatch(rnd, r, &match)
+		if err := sink.store(&sourcebackendpb.SearchReply{
+			Type:  sourcebackendpb.SearchReply_MATCH,
+			Match: &match,
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := storage.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return state[queryid].perBackend[0].resultPointers
+}
+
+// withBenchResultsPath stores query results in a temporary directory.
+func withBenchResultsPath(b *testing.B) func() {
+	dir, err := ioutil.TempDir("", "dcs-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	oldPath, oldStore := *queryResultsPath, store
+	*queryResultsPath, store = dir, fileStore{}
+	return func() {
+		*queryResultsPath, store = oldPath, oldStore
+		os.RemoveAll(dir)
+	}
+}
+
+func BenchmarkWriteFromPointers(b *testing.B) {
+	defer withBenchResultsPath(b)()
+	benchSizes(b, func(b *testing.B, n int) {
+		queryid := fmt.Sprintf("bench-writefrompointers-%d", n)
+		defer newBenchQuery(queryid)()
+		if err := os.MkdirAll(filepath.Join(*queryResultsPath, queryid), 0755); err != nil {
+			b.Fatal(err)
+		}
+		pointers := storeBenchResults(b, queryid, n)
+		sort.Sort(pointerByRanking(pointers))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := writeFromPointers(queryid, ioutil.Discard, pointers); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkMarshalReply(b *testing.B) {
+	// The encoding cost which replySink.store pays for every result, for
+	// comparison with alternative encodings.
+	var match sourcebackendpb.Match
+	syntheticMatch(rand.New(rand.NewSource(1)), 1, &match)
+	reply := &sourcebackendpb.SearchReply{
+		Type:  sourcebackendpb.SearchReply_MATCH,
+		Match: &match,
+	}
+	buf := proto.NewBuffer(nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := buf.Marshal(reply); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/Debian/dcs/cmd/dcs-web/search"
+)
+
+var allowQueryCallbacks = flag.Bool("allow_query_callbacks",
+	false,
+	"Whether queries started via POST /api/v1/query may specify a Callback URL, to which dcs-web POSTs the query’s final status once it is done. Disabled by default, as dcs-web then sends requests to arbitrary URLs")
+
+// maxQueryOptionsBytes limits the size of the request body of /api/v1/query.
+const maxQueryOptionsBytes = 64 << 10
+
+// sourceContextLines is the number of lines of context source backends
+// return before and after each match.
+const sourceContextLines = 2
+
+// QueryOptions are the options of a query, as accepted (JSON-encoded) by
+// POST /api/v1/query. The legacy /events/ endpoint accepts the same options as
+// URL parameters (q, literal, count, …).
+type QueryOptions struct {
+	// Query is the search pattern, including keywords such as filetype:.
+	Query string
+
+	// Literal searches for Query literally instead of as a regular
+	// expression.
+	Literal   bool `json:",omitempty"`
+	Count     bool `json:",omitempty"`
+	Normalize bool `json:",omitempty"`
+	Fold      bool `json:",omitempty"`
+
+	// Force runs queries exceeding -max_regexp_complexity.
+	Force bool `json:",omitempty"`
+
+	// Filter is a filter expression (see search.ParseFilter) which results
+	// must match.
+	Filter string `json:",omitempty"`
+
+	// Sample, if non-zero, returns a random sample of that many results.
+	Sample int `json:",omitempty"`
+
+	// MaxResults, if non-zero, stops the query after that many results.
+	MaxResults int `json:",omitempty"`
+
+	MaxPerFile    *int `json:",omitempty"`
+	MaxLineLength *int `json:",omitempty"`
+
+	// Context is the number of lines of context before and after each
+	// match. Source backends always return sourceContextLines lines, so no
+	// other value is accepted.
+	Context *int `json:",omitempty"`
+
+	// Priority is interactive (default) or batch, see parsePriority.
+	Priority string `json:",omitempty"`
+
+	// Sort and Order select the order of the results at ResultsURL, see
+	// serveFilteredResults.
+	Sort  string `json:",omitempty"`
+	Order string `json:",omitempty"`
+
+	// Callback is a URL to which the final QueryStarted is POSTed once the
+	// query is done. Requires -allow_query_callbacks.
+	Callback string `json:",omitempty"`
+
+	// federated is set for queries sent by a dcs-web instance which
+	// federates queries to this one, see queryFederationPeer. Only accepted
+	// as URL parameter.
+	federated bool
+}
+
+// formIntPtr parses the URL parameter key of r, if present, returning an error
+// with message msg if it is not a number.
+func formIntPtr(r *http.Request, key, msg string) (*int, error) {
+	v := r.FormValue(key)
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s", msg)
+	}
+	return &n, nil
+}
+
+// queryOptionsFromForm returns the QueryOptions specified as URL parameters of
+// r (see EventsHandler).
+func queryOptionsFromForm(r *http.Request, query string) (*QueryOptions, error) {
+	opts := &QueryOptions{
+		Query:     query,
+		Literal:   r.FormValue("literal") == "1",
+		Count:     r.FormValue("count") == "1",
+		Normalize: r.FormValue("normalize") == "1",
+		Fold:      r.FormValue("fold") == "1",
+		Force:     r.FormValue("force") == "1",
+		Filter:    r.FormValue("filter"),
+		federated: r.FormValue("federated") == "1",
+	}
+	sample, err := formIntPtr(r, "sample", fmt.Sprintf("sample must be between 1 and %d", maxSampleSize))
+	if err != nil {
+		return nil, err
+	}
+	if sample != nil {
+		if *sample == 0 {
+			return nil, fmt.Errorf("sample must be between 1 and %d", maxSampleSize)
+		}
+		opts.Sample = *sample
+	}
+	maxResults, err := formIntPtr(r, "max_results", "max_results must be a positive number")
+	if err != nil {
+		return nil, err
+	}
+	if maxResults != nil {
+		if *maxResults == 0 {
+			return nil, fmt.Errorf("max_results must be a positive number")
+		}
+		opts.MaxResults = *maxResults
+	}
+	if opts.MaxPerFile, err = formIntPtr(r, "max_per_file", "max_per_file must be a non-negative number"); err != nil {
+		return nil, err
+	}
+	if opts.MaxLineLength, err = formIntPtr(r, "max_line_length", "max_line_length must be a non-negative number"); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// encode validates the options and returns the query string (without
+// leading “?”) from which the query id is derived (see queryIdentifier).
+// Options which do not change the results (Priority, Sort, Order, Callback)
+// are not part of the query string.
+func (o *QueryOptions) encode() (string, error) {
+	if o.Query == "" {
+		return "", fmt.Errorf("Query must not be empty")
+	}
+	literal := "0"
+	if o.Literal {
+		literal = "1"
+	}
+	q := "q=" + url.QueryEscape(o.Query) + "&literal=" + literal
+	if o.Count {
+		q += "&count=1"
+	}
+	if o.Normalize {
+		q += "&normalize=1"
+	}
+	if o.Fold {
+		q += "&fold=1"
+	}
+	if o.Sample != 0 {
+		if o.Sample < 1 || o.Sample > maxSampleSize {
+			return "", fmt.Errorf("sample must be between 1 and %d", maxSampleSize)
+		}
+		q += "&sample=" + strconv.Itoa(o.Sample)
+	}
+	if o.MaxResults != 0 {
+		if o.MaxResults < 1 {
+			return "", fmt.Errorf("max_results must be a positive number")
+		}
+		q += "&max_results=" + strconv.Itoa(o.MaxResults)
+	}
+	if o.MaxPerFile != nil {
+		if *o.MaxPerFile < 0 {
+			return "", fmt.Errorf("max_per_file must be a non-negative number")
+		}
+		q += "&max_per_file=" + strconv.Itoa(*o.MaxPerFile)
+	}
+	if o.MaxLineLength != nil {
+		if *o.MaxLineLength < 0 {
+			return "", fmt.Errorf("max_line_length must be a non-negative number")
+		}
+		q += "&max_line_length=" + strconv.Itoa(*o.MaxLineLength)
+	}
+	if o.Context != nil && *o.Context != sourceContextLines {
+		return "", fmt.Errorf("context must be %d", sourceContextLines)
+	}
+	if o.Force {
+		// See -max_regexp_complexity.
+		q += "&force=1"
+	}
+	if o.federated {
+		// Sent by a dcs-web instance which federates queries to this one,
+		// see queryFederationPeer.
+		q += "&federated=1"
+	}
+	if o.Filter != "" {
+		if _, err := search.ParseFilter(o.Filter); err != nil {
+			return "", err
+		}
+		q += "&filter=" + url.QueryEscape(o.Filter)
+	}
+	return q, nil
+}
+
+// resultsURL returns the URL of the results of queryid, sorted as specified
+// by Sort and Order.
+func (o *QueryOptions) resultsURL(queryid string) (string, error) {
+	switch o.Sort {
+	case "", "ranking", "package", "path", "mtime":
+	default:
+		return "", fmt.Errorf("sort must be ranking, package, path or mtime")
+	}
+	switch o.Order {
+	case "", "asc", "desc":
+	default:
+		return "", fmt.Errorf("order must be asc or desc")
+	}
+	params := url.Values{}
+	if o.Sort != "" {
+		params.Set("sort", o.Sort)
+	}
+	if o.Order != "" {
+		params.Set("order", o.Order)
+	}
+	u := "/results/" + queryid + "/query.json"
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	return u, nil
+}
+
+// checkCallback verifies the Callback URL.
+func (o *QueryOptions) checkCallback() error {
+	if o.Callback == "" {
+		return nil
+	}
+	if !*allowQueryCallbacks {
+		return fmt.Errorf("Callback is not enabled on this server (see -allow_query_callbacks)")
+	}
+	u, err := url.Parse(o.Callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Callback must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// decodeQueryOptions decodes the JSON-encoded QueryOptions in body, rejecting
+// unknown fields so that misspelled options are not silently ignored.
+func decodeQueryOptions(body []byte) (*QueryOptions, error) {
+	var opts QueryOptions
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&opts); err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
+
+// QueryStarted is the reply of POST /api/v1/query, and what is POSTed to the
+// Callback URL once the query is done.
+type QueryStarted struct {
+	QueryId string
+
+	// Cached is true if the query was not started, because the results of
+	// the same query already existed.
+	Cached bool
+
+	// Status is running, finished or failed, see queryStatus.
+	Status string
+
+	// Results is the number of results found so far.
+	Results int
+
+	// ResultsURL, MetaURL and EventsURL are the URLs of the results (see
+	// serveFilteredResults), of their QueryMeta (once the query is done)
+	// and of the events of the query (see EventsHandler).
+	ResultsURL string
+	MetaURL    string
+	EventsURL  string
+}
+
+func newQueryStarted(queryid, q, resultsURL string, cached bool) *QueryStarted {
+	stateMu.RLock()
+	s := state[queryid]
+	stateMu.RUnlock()
+	return &QueryStarted{
+		QueryId:    queryid,
+		Cached:     cached,
+		Status:     queryStatus(s),
+		Results:    s.numMatches(),
+		ResultsURL: resultsURL,
+		MetaURL:    "/api/v1/meta/" + queryid,
+		EventsURL:  "/events/?" + q,
+	}
+}
+
+// postCallback waits until queryid is done, then POSTs its QueryStarted to
+// callback.
+func postCallback(queryid, callback string, started func() *QueryStarted) {
+	deadline := time.Now().Add(*queryRetention)
+	for time.Now().Before(deadline) {
+		stateMu.RLock()
+		s, ok := state[queryid]
+		stateMu.RUnlock()
+		if !ok {
+			log.Printf("[%s] query vanished, not calling back %q\n", queryid, callback)
+			return
+		}
+		if s.done {
+			break
+		}
+		time.Sleep(1 * time.Second)
+	}
+	b, err := json.Marshal(started())
+	if err != nil {
+		log.Printf("[%s] could not marshal callback: %v\n", queryid, err)
+		return
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(callback, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Printf("[%s] could not call back %q: %v\n", queryid, callback, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("[%s] callback %q returned %v\n", queryid, callback, resp.Status)
+	}
+}
+
+// QueryHandler serves /api/v1/query: POST starts a query specified by a JSON
+// QueryOptions object and replies with a QueryStarted, GET returns the JSON
+// schema of QueryOptions.
+func QueryHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/schema+json")
+		w.Header().Set("Cache-Control", "max-age=3600, public")
+		schema := typeSchema(reflect.TypeOf(QueryOptions{}))
+		schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+		schema["title"] = "Debian Code Search query options"
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(schema); err != nil {
+			log.Printf("Could not write query options schema: %v\n", err)
+		}
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Only GET and POST are supported.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	src := requestSource(r)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxQueryOptionsBytes))
+	if err != nil {
+		http.Error(w, "Could not read request body.", http.StatusBadRequest)
+		return
+	}
+	// The body is read again when proxying to the owner of the query.
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	opts, err := decodeQueryOptions(body)
+	if err != nil {
+		http.Error(w, "Invalid query options: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	q, err := opts.encode()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	priority, err := parsePriority(opts.Priority)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := opts.checkCallback(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tenant, err := tenantFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unknown API key.", http.StatusUnauthorized)
+		return
+	}
+
+	log.Printf("[%s] (api) Received query %q\n", src, q)
+	if err := validateQuery("?" + q); err != nil {
+		log.Printf("[%s] Query %q failed validation: %v\n", src, q, err)
+		recordRefusedStatz(errorTypeInvalidQuery)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		if err := json.NewEncoder(w).Encode(invalidQueryError(err)); err != nil {
+			log.Printf("[%s] could not write response: %v\n", src, err)
+		}
+		return
+	}
+
+	identifier := tenantQueryIdentifier(tenant, q)
+	resultsURL, err := opts.resultsURL(identifier)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if proxyToOwner(w, r, identifier, func(w http.ResponseWriter, r *http.Request) {
+		// Proxying consumed the body.
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		QueryHandler(w, r)
+	}) {
+		return
+	}
+
+	if err := admitTenantQuery(tenant, identifier); err != nil {
+		log.Printf("[%s] not starting query: %v\n", src, err)
+		recordRefusedStatz(errorTypeFor(err))
+		http.Error(w, "Too many queries for this API key, please try again later.", http.StatusTooManyRequests)
+		return
+	}
+
+	cached, err := maybeStartQuery(withPriority(r.Context(), priority), identifier, src, q)
+	if err != nil {
+		log.Printf("[%s] could not start query: %+v\n", src, err)
+		recordRefusedStatz(errorTypeFor(err))
+		http.Error(w, "Could not start query", http.StatusInternalServerError)
+		return
+	}
+
+	if opts.Callback != "" {
+		go postCallback(identifier, opts.Callback, func() *QueryStarted {
+			return newQueryStarted(identifier, q, resultsURL, cached)
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	status := http.StatusAccepted
+	if cached {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(newQueryStarted(identifier, q, resultsURL, cached)); err != nil {
+		log.Printf("[%s] could not write response: %v\n", identifier, err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQueryOptionsEncode(t *testing.T) {
+	for _, tt := range []struct {
+		form string
+		json string
+		want string
+	}{
+		{
+			form: "q=foo",
+			json: `{"Query": "foo"}`,
+			want: "q=foo&literal=0",
+		},
+		{
+			form: "q=foo+bar&literal=1&count=1&fold=1&max_results=10&max_per_file=0",
+			json: `{"Query": "foo bar", "Literal": true, "Count": true, "Fold": true, "MaxResults": 10, "MaxPerFile": 0}`,
+			want: "q=foo+bar&literal=1&count=1&fold=1&max_results=10&max_per_file=0",
+		},
+		{
+			form: "q=foo&force=1&filter=package%3D%3D%22i3-wm%22",
+			json: `{"Query": "foo", "Force": true, "Filter": "package==\"i3-wm\"", "Priority": "batch", "Context": 2}`,
+			want: "q=foo&literal=0&force=1&filter=package%3D%3D%22i3-wm%22",
+		},
+	} {
+		t.Run(tt.form, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/events/?"+tt.form, nil)
+			fromForm, err := queryOptionsFromForm(r, r.FormValue("q"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := fromForm.encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("form: got %q, want %q", got, tt.want)
+			}
+
+			fromJSON, err := decodeQueryOptions([]byte(tt.json))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = fromJSON.encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("json: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryOptionsInvalid(t *testing.T) {
+	for _, body := range []string{
+		`{"Query": ""}`,
+		`{"Query": "foo", "Sample": -1}`,
+		`{"Query": "foo", "MaxLineLength": -1}`,
+		`{"Query": "foo", "Context": 5}`,
+		`{"Query": "foo", "Pattern": "bar"}`, // unknown field
+		`{"Query": "foo", "Filter": "package:i3-wm"}`,
+		`{"Query": "foo", "Sort": "size"}`,
+		`{"Query": "foo", "Order": "up"}`,
+		`{"Query": "foo", "Priority": "urgent"}`,
+		`{"Query": "foo", "Callback": "http://localhost/done"}`, // -allow_query_callbacks not set
+	} {
+		t.Run(body, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			QueryHandler(rec, httptest.NewRequest("POST", "/api/v1/query", strings.NewReader(body)))
+			if got, want := rec.Code, http.StatusBadRequest; got != want {
+				t.Errorf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestQueryHandler(t *testing.T) {
+	defer useFakeBackends(t,
+		newFakeBackend("i3-wm_4.8-1/i3bar/src/main.c", "i3-wm_4.8-1/src/main.c"))()
+
+	rec := httptest.NewRecorder()
+	QueryHandler(rec, httptest.NewRequest("POST", "/api/v1/query", strings.NewReader(`{"Query": "main", "Literal": true, "Sort": "path"}`)))
+	if got, want := rec.Code, http.StatusAccepted; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+	}
+	var started QueryStarted
+	if err := json.Unmarshal(rec.Body.Bytes(), &started); err != nil {
+		t.Fatal(err)
+	}
+	queryid := queryIdentifier("q=main&literal=1")
+	waitDone(t, queryid)
+	defer forgetQuery(queryid)
+	if got, want := started.QueryId, queryid; got != want {
+		t.Errorf("unexpected QueryId: got %q, want %q", got, want)
+	}
+	if got, want := started.ResultsURL, "/results/"+queryid+"/query.json?sort=path"; got != want {
+		t.Errorf("unexpected ResultsURL: got %q, want %q", got, want)
+	}
+
+	// Starting the same query again returns the existing query.
+	rec = httptest.NewRecorder()
+	QueryHandler(rec, httptest.NewRequest("POST", "/api/v1/query", strings.NewReader(`{"Query": "main", "Literal": true}`)))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &started); err != nil {
+		t.Fatal(err)
+	}
+	if !started.Cached || started.Status != "finished" {
+		t.Errorf("unexpected reply for finished query: %+v", started)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/Debian/dcs/internal/sourcebackend"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/xerrors"
+)
+
+var (
+	trigramStatsTimeout = flag.Duration("trigram_stats_timeout",
+		500*time.Millisecond,
+		"How long to wait for the source backends’ trigram statistics, which are used to estimate the cost of a query before starting it. Backends which do not reply in time are ignored")
+	broadQueryFiles = flag.Int("broad_query_files",
+		1000000,
+		"Queries which are estimated to require grepping more than this many files are considered broad: the user is warned and -broad_query_max_results applies. 0 disables")
+	broadQueryMaxResults = flag.Int("broad_query_max_results",
+		10000,
+		"max_results= value applied to broad queries (see -broad_query_files) which specify neither max_results=, sample= nor count=1. 0 disables")
+	maxQueryFiles = flag.Int("max_query_files",
+		0,
+		"Queries which are estimated to require grepping more than this many files fail (ErrorType “toobroad”) instead of being started. 0 disables")
+
+	estimatedFiles = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "query_estimated_files",
+			Help:    "Number of files queries were estimated to require grepping, based on trigram statistics.",
+			Buckets: prometheus.ExponentialBuckets(1, 10, 8),
+		})
+
+	broadQueries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "queries_broad",
+			Help: "Number of queries considered broad (see -broad_query_files).",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(estimatedFiles)
+	prometheus.MustRegister(broadQueries)
+}
+
+type Warning struct {
+	// This is set to “warning” to distinguish the message type on the client.
+	Type string
+
+	// “broadquery”, “broaden” for queries which are estimated to find very
+	// few results (see -broaden_query_files), or “staleindex” for clients
+	// which reconnect after the index was replaced (see -index_generation):
+	// the results they received are from the older index.
+	WarningType string
+
+	EstimatedFiles int
+	FilesTotal     int
+
+	// Suggestions are broader variants of the query. Only set for
+	// “broaden”.
+	Suggestions []Suggestion `json:",omitempty"`
+}
+
+// estimateQuery sums up the estimated number of files which the source
+// backends need to grep for the query. Returns -1 if no backend replied.
+func estimateQuery(ctx context.Context, queryid string, backends []sourcebackendpb.SourceBackendClient, searchRequest *sourcebackendpb.SearchRequest) (estimate int, filesTotal int) {
+	stateMu.RLock()
+	perBackend := state[queryid].perBackend
+	stateMu.RUnlock()
+	return estimateFiles(ctx, queryid, backends, &sourcebackendpb.TrigramStatsRequest{
+		Query:        searchRequest.Query,
+		RewrittenUrl: searchRequest.RewrittenUrl,
+	}, func(idx int, reply *sourcebackendpb.TrigramStatsReply) {
+		// Read by attributeBackends once the query’s backends returned.
+		perBackend[idx].indexFiles = int(reply.FilesTotal)
+	})
+}
+
+// estimateFiles sums up the estimated number of files which the source
+// backends need to grep for req, waiting at most -trigram_stats_timeout.
+// onReply (if non-nil) is called for each reply, never concurrently. Returns
+// -1 if no backend replied.
+func estimateFiles(ctx context.Context, queryid string, backends []sourcebackendpb.SourceBackendClient, req *sourcebackendpb.TrigramStatsRequest, onReply func(idx int, reply *sourcebackendpb.TrigramStatsReply)) (estimate int, filesTotal int) {
+	ctx, cancel := context.WithTimeout(ctx, *trigramStatsTimeout)
+	defer cancel()
+	var (
+		mu      sync.Mutex
+		replies int
+		wg      sync.WaitGroup
+	)
+	for idx, backend := range backends {
+		// Source backends which cannot estimate are left out of the
+		// estimate, like source backends which do not reply.
+		if !common.CapabilitiesOf(backend).Has(sourcebackend.CapabilityTrigramStats) {
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, backend sourcebackendpb.SourceBackendClient) {
+			defer wg.Done()
+			reply, err := backend.TrigramStats(ctx, req)
+			if err != nil {
+				log.Printf("[%s] [src:%d] TrigramStats: %v\n", queryid, idx, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			replies++
+			estimate += int(reply.EstimatedFiles)
+			filesTotal += int(reply.FilesTotal)
+			if onReply != nil {
+				onReply(idx, reply)
+			}
+		}(idx, backend)
+	}
+	wg.Wait()
+	if replies == 0 {
+		return -1, 0
+	}
+	return estimate, filesTotal
+}
+
+// planQuery estimates the cost of the query before the source backends are
+// queried. Broad queries result in a warning event and, unless the user chose
+// limits for the query, are limited to -broad_query_max_results results.
+// Queries exceeding -max_query_files result in errTooBroad.
+func planQuery(ctx context.Context, queryid string, backends []sourcebackendpb.SourceBackendClient, searchRequest *sourcebackendpb.SearchRequest) error {
+	estimate, filesTotal := estimateQuery(ctx, queryid, backends, searchRequest)
+	if estimate == -1 {
+		return nil
+	}
+	log.Printf("[%s] estimated to grep %d of %d files\n", queryid, estimate, filesTotal)
+	estimatedFiles.Observe(float64(estimate))
+	if *maxQueryFiles > 0 && estimate > *maxQueryFiles {
+		return xerrors.Errorf("estimated to grep %d files (-max_query_files=%d): %w", estimate, *maxQueryFiles, errTooBroad)
+	}
+	if *broadenQueryFiles > 0 && estimate <= *broadenQueryFiles {
+		if suggestions := suggestBroadening(ctx, queryid, backends, searchRequest); len(suggestions) > 0 {
+			addEventMarshal(queryid, &Warning{
+				Type:           eventTypeWarning,
+				WarningType:    "broaden",
+				EstimatedFiles: estimate,
+				FilesTotal:     filesTotal,
+				Suggestions:    suggestions,
+			})
+		}
+	}
+	if *broadQueryFiles == 0 || estimate <= *broadQueryFiles {
+		return nil
+	}
+	broadQueries.Inc()
+
+	addEventMarshal(queryid, &Warning{
+		Type:           eventTypeWarning,
+		WarningType:    "broadquery",
+		EstimatedFiles: estimate,
+		FilesTotal:     filesTotal,
+	})
+
+	if *broadQueryMaxResults == 0 {
+		return nil
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s := state[queryid]
+	if s.countOnly || s.sampleSize > 0 || s.maxResults > 0 {
+		return nil
+	}
+	maxResults := int(float64(*broadQueryMaxResults) * s.priority.limitsFactor())
+	log.Printf("[%s] broad query, limiting to %d results\n", queryid, maxResults)
+	s.maxResults = maxResults
+	s.qualifyingResults = new(int64)
+	state[queryid] = s
+	return nil
+}
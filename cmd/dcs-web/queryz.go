@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// queryStatus returns “running”, “finished” or “failed” (for queries which
+// encountered an error, e.g. an unavailable source backend or cancellation).
+func queryStatus(s queryState) string {
+	if s.errorType != "" {
+		return "failed"
+	}
+	if s.done {
+		return "finished"
+	}
+	return "running"
+}
+
+// queryzOptions are the filtering, sorting and pagination parameters of
+// /queryz.
+type queryzOptions struct {
+	// Status, if non-empty, restricts the list to queries of that status
+	// (running, finished or failed).
+	Status string
+	// Sort is one of started (default), duration or results.
+	Sort string
+	// Descending is the default, i.e. newest/longest/most results first.
+	Descending bool
+	Page       int
+	PerPage    int
+}
+
+// parseQueryzOptions parses the status, sort, order (asc or desc), page
+// (0-based) and per_page parameters.
+func parseQueryzOptions(r *http.Request) (queryzOptions, error) {
+	opts := queryzOptions{
+		Status:     r.FormValue("status"),
+		Sort:       r.FormValue("sort"),
+		Descending: true,
+	}
+	switch opts.Status {
+	case "", "running", "finished", "failed":
+	default:
+		return opts, fmt.Errorf("status must be running, finished or failed")
+	}
+	switch opts.Sort {
+	case "":
+		opts.Sort = "started"
+	case "started", "duration", "results":
+	default:
+		return opts, fmt.Errorf("sort must be started, duration or results")
+	}
+	switch r.FormValue("order") {
+	case "", "desc":
+	case "asc":
+		opts.Descending = false
+	default:
+		return opts, fmt.Errorf("order must be asc or desc")
+	}
+	var err error
+	if opts.Page, err = formInt(r, "page", 0); err != nil || opts.Page < 0 {
+		return opts, fmt.Errorf("Invalid page")
+	}
+	if opts.PerPage, err = formInt(r, "per_page", 50); err != nil || opts.PerPage < 1 || opts.PerPage > 1000 {
+		return opts, fmt.Errorf("Invalid per_page, must be between 1 and 1000")
+	}
+	return opts, nil
+}
+
+// URL returns the /queryz URL for opts, with key set to value (e.g. to link
+// to the next page, or to a different sort order). Changing the filter or
+// sort order resets the page.
+func (o queryzOptions) URL(key, value string) string {
+	v := url.Values{}
+	set := func(k, val, def string) {
+		if val != def {
+			v.Set(k, val)
+		}
+	}
+	if key != "page" {
+		o.Page = 0
+	}
+	order := "desc"
+	if !o.Descending {
+		order = "asc"
+	}
+	set("status", o.Status, "")
+	set("sort", o.Sort, "started")
+	set("order", order, "desc")
+	set("page", strconv.Itoa(o.Page), "0")
+	set("per_page", strconv.Itoa(o.PerPage), "50")
+	if value == "" {
+		v.Del(key)
+	} else {
+		v.Set(key, value)
+	}
+	if len(v) == 0 {
+		return "/queryz"
+	}
+	return "/queryz?" + v.Encode()
+}
+
+// queryzPage is one page of (filtered and sorted) queries.
+type queryzPage struct {
+	// Total is the number of queries matching the filter.
+	Total   int
+	Page    int
+	Pages   int
+	Queries []queryStats
+}
+
+// PrevPage returns the number of the previous page as a string for use in
+// queryzOptions.URL, or an empty string on the first page.
+func (p queryzPage) PrevPage() string {
+	if p.Page == 0 {
+		return ""
+	}
+	return strconv.Itoa(p.Page - 1)
+}
+
+// NextPage returns the number of the next page as a string for use in
+// queryzOptions.URL, or an empty string on the last page.
+func (p queryzPage) NextPage() string {
+	if p.Page+1 >= p.Pages {
+		return ""
+	}
+	return strconv.Itoa(p.Page + 1)
+}
+
+// apply filters, sorts and paginates stats.
+func (o queryzOptions) apply(stats []queryStats) queryzPage {
+	filtered := stats[:0]
+	for _, st := range stats {
+		if o.Status == "" || st.Status == o.Status {
+			filtered = append(filtered, st)
+		}
+	}
+
+	less := func(i, j int) bool {
+		switch o.Sort {
+		case "duration":
+			return queryzDuration(filtered[i]) < queryzDuration(filtered[j])
+		case "results":
+			return filtered[i].NumResults < filtered[j].NumResults
+		}
+		return filtered[i].Started.Before(filtered[j].Started)
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		if o.Descending {
+			return less(j, i)
+		}
+		return less(i, j)
+	})
+
+	page := queryzPage{
+		Total: len(filtered),
+		Page:  o.Page,
+		Pages: (len(filtered) + o.PerPage - 1) / o.PerPage,
+	}
+	start := o.Page * o.PerPage
+	if start > len(filtered) {
+		start = len(filtered)
+	}
+	end := start + o.PerPage
+	if end > len(filtered) {
+		end = len(filtered)
+	}
+	page.Queries = filtered[start:end]
+	return page
+}
+
+// queryzDuration returns how long the query ran, or is running so far.
+func queryzDuration(st queryStats) time.Duration {
+	if st.Done {
+		return st.Duration
+	}
+	return st.StartedFromNow
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// /queryz is updated live using the same event machinery as queries: events
+// about all queries are added to the reserved admin query (which is never
+// done, persisted or evicted), and /queryz/events streams them to the page.
+// A newer event of a query obsoletes the older ones, so the admin query holds
+// at most one event per query (and at most maxQueryzEvents in total).
+
+// adminQueryId is the reserved id of the admin query. Query ids are
+// hexadecimal, so it cannot clash with a real query.
+const adminQueryId = "admin"
+
+// maxQueryzEvents is the number of events kept for the admin query. The
+// events of the queries which were updated least recently are removed first.
+const maxQueryzEvents = 1000
+
+// queryzEventType is the Type of QueryzEvents. They are not sent to clients of
+// /events/ and /instantws, so they are not part of the event schema.
+const queryzEventType = "queryz"
+
+// Values of the Event field of QueryzEvent.
+const (
+	queryzEventStarted  = "started"
+	queryzEventProgress = "progress"
+	queryzEventFinished = "finished"
+	queryzEventFailed   = "failed"
+)
+
+// QueryzEvent is sent to /queryz/events clients whenever a query is started,
+// makes progress or finishes.
+type QueryzEvent struct {
+	// Set to “queryz”.
+	Type string
+
+	// One of “started”, “progress”, “finished” or “failed”.
+	Event string
+
+	Query queryStats
+}
+
+func (q *QueryzEvent) EventType() string {
+	return q.Type
+}
+
+func (q *QueryzEvent) ObsoletedBy(newEvent *obsoletableEvent) bool {
+	n, ok := (*newEvent).(*QueryzEvent)
+	return ok && n.Query.QueryId == q.Query.QueryId
+}
+
+var initAdminQueryOnce sync.Once
+
+// initAdminQuery creates the admin query. Must be called before serving
+// requests.
+func initAdminQuery() {
+	initAdminQueryOnce.Do(func() {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		state[adminQueryId] = queryState{
+			started:    time.Now(),
+			query:      adminQueryId,
+			generation: *indexGeneration,
+			newEvent:   sync.NewCond(&stateMu),
+			filesMu:    &sync.Mutex{},
+			countsMu:   &sync.Mutex{},
+		}
+	})
+}
+
+// publishQueryzEvent adds an event of the specified kind (e.g.
+// queryzEventStarted) about the query to the admin query. queryzEventFinished
+// is turned into queryzEventFailed if the query failed.
+func publishQueryzEvent(queryid, kind string) {
+	stateMu.RLock()
+	_, ok := state[adminQueryId]
+	s, exists := state[queryid]
+	if !ok || !exists {
+		stateMu.RUnlock()
+		return
+	}
+	stats := queryStatsLocked(queryid, s)
+	stateMu.RUnlock()
+	if kind == queryzEventFinished && stats.Status == "failed" {
+		kind = queryzEventFailed
+	}
+	addEventMarshal(adminQueryId, &QueryzEvent{
+		Type:  queryzEventType,
+		Event: kind,
+		Query: stats,
+	})
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	admin := state[adminQueryId]
+	if n := len(admin.events) - maxQueryzEvents; n > 0 {
+		for _, ev := range admin.events[:n] {
+			*ev.obsolete = true
+		}
+		admin.events = append([]event(nil), admin.events[n:]...)
+		state[adminQueryId] = admin
+	}
+}
+
+// QueryzEventsHandler serves /queryz/events, a stream of QueryzEvents in the
+// same format as /events/. Clients pass the sequence number of the last event
+// they know about as since= (or Last-Event-ID header), e.g. the one /queryz
+// was rendered with.
+func QueryzEventsHandler(w http.ResponseWriter, r *http.Request) {
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.FormValue("since")
+	}
+	lastseen := -1
+	if lastEventId != "" {
+		if _, seq, err := parseEventId(lastEventId); err == nil && seq >= -1 {
+			lastseen = seq
+		}
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	for r.Context().Err() == nil {
+		message, _ := getEvent(adminQueryId, lastseen)
+		lastseen = message.sequence
+		if *message.obsolete {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", lastseen, message.data); err != nil {
+			log.Printf("[%s] aborting /queryz/events, could not write: %v\n", r.RemoteAddr, err)
+			return
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
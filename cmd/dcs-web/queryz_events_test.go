@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestQueryzEvents(t *testing.T) {
+	defer newTestQuery(adminQueryId)()
+	defer newTestQuery("q1")()
+	defer newTestQuery("q2")()
+
+	publishQueryzEvent("q1", queryzEventStarted)
+	publishQueryzEvent("q2", queryzEventStarted)
+	publishQueryzEvent("q1", queryzEventProgress)
+	stateMu.Lock()
+	s := state["q1"]
+	s.done = true
+	s.errorType = errorTypeCancelled
+	state["q1"] = s
+	stateMu.Unlock()
+	publishQueryzEvent("q1", queryzEventFinished)
+
+	stateMu.RLock()
+	events := state[adminQueryId].events
+	stateMu.RUnlock()
+	// Newer events of a query obsolete older ones.
+	if got, want := len(events), 2; got != want {
+		t.Fatalf("len(events) = %d, want %d", got, want)
+	}
+	var got []string
+	for _, ev := range events {
+		var qe QueryzEvent
+		if err := json.Unmarshal(ev.data, &qe); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, qe.Query.QueryId+":"+qe.Event)
+	}
+	if got, want := fmt.Sprint(got), "[q2:started q1:failed]"; got != want {
+		t.Errorf("unexpected events: got %s, want %s", got, want)
+	}
+
+	// The number of events is bounded.
+	for i := 0; i < maxQueryzEvents+10; i++ {
+		queryid := fmt.Sprintf("bound%d", i)
+		cleanup := newTestQuery(queryid)
+		publishQueryzEvent(queryid, queryzEventStarted)
+		cleanup()
+	}
+	stateMu.RLock()
+	n := len(state[adminQueryId].events)
+	stateMu.RUnlock()
+	if n != maxQueryzEvents {
+		t.Errorf("len(events) = %d, want %d", n, maxQueryzEvents)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	maxConcurrentQueries = flag.Int("max_concurrent_queries",
+		0,
+		"Maximum number of queries which are sent to the source backends at the same time. Further queries are queued. 0 means unlimited")
+	maxQueuedQueries = flag.Int("max_queued_queries",
+		50,
+		"Maximum number of queries waiting for one of -max_concurrent_queries to become available. Further queries fail")
+	maxQueueWait = flag.Duration("max_queue_wait",
+		1*time.Minute,
+		"Maximum time a query waits in the queue before it fails")
+
+	queuedQueries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "queries_queued",
+			Help: "Number of queries waiting for a free slot (see -max_concurrent_queries).",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(queuedQueries)
+}
+
+var (
+	errQueueFull    = errors.New("query queue is full")
+	errQueueTimeout = errors.New("timeout waiting in the query queue")
+	errQueueDone    = errors.New("query finished while queued")
+)
+
+// Queued is sent to clients periodically while their query is waiting for a
+// free slot.
+type Queued struct {
+	// Set to “queued”.
+	Type    string
+	QueryId string
+
+	// 1-based position in the queue.
+	Position int
+}
+
+func (q *Queued) EventType() string {
+	return q.Type
+}
+
+func (q *Queued) ObsoletedBy(newEvent *obsoletableEvent) bool {
+	return (*newEvent).EventType() == q.Type
+}
+
+// querySlots limits the number of queries which are running at the same time.
+type querySlots struct {
+	mu      sync.Mutex
+	running map[string]queryPriority
+	queue   []queuedQuery // interactive queries first, each in FIFO order
+}
+
+type queuedQuery struct {
+	queryid  string
+	priority queryPriority
+}
+
+var slots = &querySlots{
+	running: make(map[string]queryPriority),
+}
+
+func (qs *querySlots) position(queryid string) int {
+	for idx, q := range qs.queue {
+		if q.queryid == queryid {
+			return idx + 1
+		}
+	}
+	return 0
+}
+
+func (qs *querySlots) dequeue(queryid string) {
+	if pos := qs.position(queryid); pos > 0 {
+		qs.queue = append(qs.queue[:pos-1], qs.queue[pos:]...)
+		queuedQueries.Dec()
+	}
+}
+
+// enqueue adds the query to the queue, behind all queries of the same or
+// higher priority, i.e. interactive queries overtake batch queries.
+func (qs *querySlots) enqueue(queryid string, priority queryPriority) {
+	pos := len(qs.queue)
+	for pos > 0 && qs.queue[pos-1].priority > priority {
+		pos--
+	}
+	qs.queue = append(qs.queue, queuedQuery{})
+	copy(qs.queue[pos+1:], qs.queue[pos:])
+	qs.queue[pos] = queuedQuery{queryid: queryid, priority: priority}
+	queuedQueries.Inc()
+}
+
+// available returns whether a slot is available for a query of the specified
+// priority, see -max_concurrent_batch_queries.
+func (qs *querySlots) available(priority queryPriority) bool {
+	if len(qs.running) >= *maxConcurrentQueries {
+		return false
+	}
+	if priority != priorityBatch || *maxConcurrentBatchQueries <= 0 {
+		return true
+	}
+	batch := 0
+	for _, p := range qs.running {
+		if p == priorityBatch {
+			batch++
+		}
+	}
+	return batch < *maxConcurrentBatchQueries
+}
+
+// acquire blocks until the query may be sent to the source backends. While
+// waiting, Queued events are sent to clients.
+func (qs *querySlots) acquire(queryid string, priority queryPriority) error {
+	qs.mu.Lock()
+	// Queued queries of lower priority (i.e. batch queries waiting for
+	// -max_concurrent_batch_queries) do not hold up interactive queries.
+	if *maxConcurrentQueries <= 0 ||
+		(qs.available(priority) && (len(qs.queue) == 0 || qs.queue[0].priority > priority)) {
+		qs.running[queryid] = priority
+		qs.mu.Unlock()
+		return nil
+	}
+	if len(qs.queue) >= *maxQueuedQueries {
+		qs.mu.Unlock()
+		return errQueueFull
+	}
+	qs.enqueue(queryid, priority)
+	qs.mu.Unlock()
+
+	log.Printf("[%s] queued, waiting for a free slot\n", queryid)
+	started := time.Now()
+	var lastEvent time.Time
+	lastPosition := 0
+	for {
+		// Checked before acquiring qs.mu: addEvent() calls release() while
+		// holding stateMu.
+		done := queryDone(queryid) || queryAbandoned(queryid)
+		qs.mu.Lock()
+		if qs.position(queryid) == 1 && qs.available(priority) {
+			qs.dequeue(queryid)
+			qs.running[queryid] = priority
+			qs.mu.Unlock()
+			log.Printf("[%s] got a slot after %v\n", queryid, time.Since(started))
+			return nil
+		}
+		var err error
+		if time.Since(started) > *maxQueueWait {
+			err = errQueueTimeout
+		} else if done {
+			// e.g. cancelled via /queryz, or abandoned by all clients
+			err = errQueueDone
+		}
+		if err != nil {
+			qs.dequeue(queryid)
+			qs.mu.Unlock()
+			return err
+		}
+		position := qs.position(queryid)
+		qs.mu.Unlock()
+
+		if position != lastPosition || time.Since(lastEvent) > 1*time.Second {
+			addEventMarshal(queryid, &Queued{
+				Type:     eventTypeQueued,
+				QueryId:  queryid,
+				Position: position,
+			})
+			lastPosition = position
+			lastEvent = time.Now()
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// release frees the slot held by the query, if any.
+func (qs *querySlots) release(queryid string) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	delete(qs.running, queryid)
+}
+
+func queryDone(queryid string) bool {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return state[queryid].done
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+)
+
+var readinessTimeout = flag.Duration("readiness_timeout",
+	5*time.Second,
+	"Timeout for checking the source backends when serving /readyz")
+
+// HealthzHandler serves /healthz, which succeeds as long as the process is
+// running and serving HTTP, i.e. it is suitable as a liveness check.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+}
+
+// ReadyzHandler serves /readyz, which only succeeds once dcs-web can actually
+// serve queries: all source backends must be reachable and have warmed up
+// their index (see common.CheckSourceBackends). Load balancers should only
+// send traffic to instances which are ready.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	ctx, cancel := context.WithTimeout(r.Context(), *readinessTimeout)
+	defer cancel()
+	errs := common.CheckSourceBackends(ctx)
+	if len(errs) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	addrs := make([]string, 0, len(errs))
+	for addr := range errs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, addr := range addrs {
+		fmt.Fprintf(w, "source backend %s not ready: %v\n", addr, errs[addr])
+	}
+}
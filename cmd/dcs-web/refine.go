@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Debian/dcs/cmd/dcs-web/search"
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/xerrors"
+)
+
+// refineExpression returns the filter expression (see search.ParseFilter)
+// which results must match to be included in a refinement: the context must
+// match pattern (if non-empty) and the results must match filter (if
+// non-empty).
+func refineExpression(pattern string, literal bool, filter string) string {
+	var parts []string
+	if pattern != "" {
+		if literal {
+			pattern = regexp.QuoteMeta(pattern)
+		}
+		parts = append(parts, "context~"+search.QuoteFilterString(pattern))
+	}
+	if filter != "" {
+		parts = append(parts, "("+filter+")")
+	}
+	return strings.Join(parts, " && ")
+}
+
+// refinedQueryId returns the id of the query derived from parent by
+// evaluating expr over its results. The parent id is kept as a prefix, so that
+// refined queries are owned by the same instance (see queryOwner).
+func refinedQueryId(parent, expr string) string {
+	return parent + "-" + hashString(expr)
+}
+
+// RefineHandler serves
+// /api/v1/refine?queryid=<queryid>&pattern=<regexp>&filter=<expr>, which
+// evaluates an additional pattern (matched against the matching line, literal
+// if literal=1) and/or filter= expression over the stored results of a
+// completed query, without querying the source backends again. The result is
+// a new query whose results can be retrieved like those of any other query.
+func RefineHandler(w http.ResponseWriter, r *http.Request) {
+	parentid := r.FormValue("queryid")
+	if parentid == "" || strings.Contains(parentid, "/") {
+		http.Error(w, "The queryid parameter must be specified.", http.StatusBadRequest)
+		return
+	}
+	pattern, filter := r.FormValue("pattern"), r.FormValue("filter")
+	if pattern == "" && filter == "" {
+		http.Error(w, "At least one of the pattern and filter parameters must be specified.", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("literal") != "1" {
+		if _, err := regexp.Compile(pattern); err != nil {
+			http.Error(w, "Invalid pattern: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	expr := refineExpression(pattern, r.FormValue("literal") == "1", filter)
+	f, err := search.ParseFilter(expr)
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkTenant(w, r, parentid) {
+		return
+	}
+	if proxyToOwner(w, r, parentid, RefineHandler) {
+		return
+	}
+
+	defer pinQuery(parentid)()
+	parent, msg, code := completedQuery(parentid)
+	if code != http.StatusOK {
+		http.Error(w, msg, code)
+		return
+	}
+	if parent.countOnly {
+		http.Error(w, "Count-only queries cannot be refined.", http.StatusBadRequest)
+		return
+	}
+	if parent.generation != *indexGeneration {
+		http.Error(w, staleGenerationMessage, http.StatusGone)
+		return
+	}
+
+	queryid := refinedQueryId(parentid, expr)
+	defer pinQuery(queryid)()
+	reloadQuery(queryid)
+	if !queryExists(queryid) {
+		if err := refineQuery(parentid, parent, queryid, expr, f); err != nil {
+			log.Printf("[%s] could not refine %s: %v\n", queryid, parentid, err)
+			http.Error(w, "Could not refine query.", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	stateMu.RLock()
+	s := state[queryid]
+	stateMu.RUnlock()
+	startJsonResponse(w)
+	if err := json.NewEncoder(w).Encode(struct {
+		QueryId     string
+		Parent      string
+		Done        bool
+		ResultPages int
+		Results     int
+	}{
+		QueryId:     queryid,
+		Parent:      parentid,
+		Done:        s.done,
+		ResultPages: s.resultPages,
+		Results:     s.numMatches(),
+	}); err != nil {
+		log.Printf("[%s] could not write response: %v\n", queryid, err)
+	}
+}
+
+// refineQuery creates the query queryid, which contains all results of the
+// completed query parentid which match f. The results are copied into the
+// storage of the new query, which is done once refineQuery returns.
+func refineQuery(parentid string, parent queryState, queryid, expr string, f *search.Filter) error {
+	ensureEnoughSpaceAvailable()
+
+	dir := filepath.Join(*queryResultsPath, queryid)
+	if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+		return xerrors.Errorf("could not create %q: %w", dir, err)
+	}
+	numBackends := len(parent.perBackend)
+	storage, err := store.Create(queryid, numBackends)
+	if err != nil {
+		return xerrors.Errorf("could not create results storage in %q: %w", dir, err)
+	}
+
+	querystate := newQueryState(parent.query+"&refine="+url.QueryEscape(expr), parent.rewrittenQuery, numBackends)
+	querystate.storage = storage
+	querystate.priority = priorityBatch
+	// Rankings are combined like those of the parent query, see storeResult.
+	querystate.FirstPathRank = parent.FirstPathRank
+	// There are no source backend requests to cancel.
+	querystate.cancel = func() {}
+	if err := startQuery(queryid, querystate); err != nil {
+		// Another request must have raced us since we called queryExists().
+		storage.Close()
+		return nil
+	}
+	log.Printf("[%s] refining %s with %q\n", queryid, parentid, expr)
+
+	var msg sourcebackendpb.SearchReply
+	for _, pointer := range parent.resultPointers {
+		raw, err := parent.storage.Read(pointer.backendidx, pointer.offset, pointer.length)
+		if err == nil {
+			msg.Reset()
+			err = proto.Unmarshal(raw, &msg)
+		}
+		if err != nil {
+			failQuery(queryid, err)
+			return err
+		}
+		if !f.Matches(msg.Match) {
+			continue
+		}
+		offset, err := storage.Append(pointer.backendidx, &msg, raw)
+		if err != nil {
+			failQuery(queryid, err)
+			return err
+		}
+		storeResult(queryid, pointer.backendidx, msg.Match, offset, len(raw), -1)
+	}
+
+	// Mark all backends as done, which writes the result pages and
+	// finishes the query, see storeProgress.
+	for idx := 0; idx < numBackends; idx++ {
+		files := parent.filesTotal[idx]
+		if files < 0 {
+			files = 0
+		}
+		progress := &sourcebackendpb.SearchReply{
+			Type: sourcebackendpb.SearchReply_PROGRESS_UPDATE,
+			ProgressUpdate: &sourcebackendpb.ProgressUpdate{
+				FilesProcessed: uint64(files),
+				FilesTotal:     uint64(files),
+			},
+		}
+		raw, err := proto.Marshal(progress)
+		if err == nil {
+			_, err = storage.Append(idx, progress, raw)
+		}
+		if err != nil {
+			failQuery(queryid, err)
+			return err
+		}
+		storeProgress(queryid, idx, progress.ProgressUpdate)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+func TestRefineExpression(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		literal bool
+		filter  string
+		want    string
+	}{
+		{"argc", false, "", `context~"argc"`},
+		{"a.b", true, "", `context~"a\\.b"`},
+		{"", false, `path~"i3bar"`, `(path~"i3bar")`},
+		{"argc", false, `path~"i3bar"`, `context~"argc" && (path~"i3bar")`},
+	} {
+		if got := refineExpression(tt.pattern, tt.literal, tt.filter); got != tt.want {
+			t.Errorf("refineExpression(%q, %v, %q) = %q, want %q", tt.pattern, tt.literal, tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestRefine(t *testing.T) {
+	defer useFakeBackends(t,
+		newFakeBackend("i3-wm_4.8-1/i3bar/src/main.c", "i3-wm_4.8-1/src/main.c"),
+		newFakeBackend("dcs_0.1-1/cmd/dcs-web/dcs-web.go"))()
+
+	const query = "q=main&literal=1"
+	queryid := queryIdentifier(query)
+	if _, err := maybeStartQuery(context.Background(), queryid, "test", query); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, queryid)
+
+	form := url.Values{
+		"queryid": {queryid},
+		"filter":  {`path~"i3bar"`},
+	}
+	rec := httptest.NewRecorder()
+	RefineHandler(rec, httptest.NewRequest("GET", "/api/v1/refine?"+form.Encode(), nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+	}
+	var reply struct {
+		QueryId string
+		Done    bool
+		Results int
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		for _, id := range []string{queryid, reply.QueryId} {
+			state[id].storage.Close()
+			delete(state, id)
+		}
+	}()
+	if !strings.HasPrefix(reply.QueryId, queryid+"-") {
+		t.Errorf("refined query id %q does not start with %q", reply.QueryId, queryid+"-")
+	}
+	if !reply.Done {
+		t.Errorf("refined query not done")
+	}
+	if got, want := reply.Results, 1; got != want {
+		t.Fatalf("unexpected number of results: got %d, want %d", got, want)
+	}
+
+	stateMu.RLock()
+	s := state[reply.QueryId]
+	stateMu.RUnlock()
+	var paths []string
+	if err := forEachMatch(reply.QueryId, s.resultPointers, func(idx int, match *sourcebackendpb.Match) error {
+		paths = append(paths, match.Path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != "i3-wm_4.8-1/i3bar/src/main.c" {
+		t.Errorf("unexpected refined results: %v", paths)
+	}
+}
+
+func TestRefineRequiresCompletedQuery(t *testing.T) {
+	defer useFakeBackends(t)()
+	rec := httptest.NewRecorder()
+	RefineHandler(rec, httptest.NewRequest("GET", "/api/v1/refine?queryid=doesnotexist&pattern=foo", nil))
+	if got, want := rec.Code, http.StatusNotFound; got != want {
+		t.Errorf("unexpected HTTP status: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queryBackendBytes = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "query_backend_bytes",
+			Help:    "Size of the replies received from the source backends (and federation peers) per finished query, in bytes.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+		})
+
+	queryTempFileBytes = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "query_temp_file_bytes",
+			Help:    "Bytes written to the results storage (see -results_store) per finished query.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+		})
+
+	queryEventBytes = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "query_event_bytes",
+			Help:    "Size of the events generated per finished query, in bytes.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+		})
+
+	queryProcessingTime = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "query_processing_ms",
+			Help:    "Time spent processing the replies of the source backends per finished query in milliseconds, by stage (“storeresult” or “writetodisk”).",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+		},
+		[]string{"stage"})
+)
+
+func init() {
+	prometheus.MustRegister(queryBackendBytes)
+	prometheus.MustRegister(queryTempFileBytes)
+	prometheus.MustRegister(queryEventBytes)
+	prometheus.MustRegister(queryProcessingTime)
+}
+
+// queryResources approximates the resources a query used in dcs-web, so that
+// expensive queries can be identified (on /queryz, in the query_* metrics and
+// the analytics, see -analytics_path). All fields are accessed atomically.
+type queryResources struct {
+	// backendBytes is the (encoded) size of all replies received from the
+	// source backends, including replies which were not stored, e.g. because
+	// of filter= or sample=.
+	backendBytes int64
+
+	// tempFileBytes is the number of bytes written to the results storage.
+	tempFileBytes int64
+
+	// eventBytes is the size of all events generated for clients.
+	eventBytes int64
+
+	// storeResultNanos and writeToDiskNanos are the time spent in
+	// storeResult and writeToDisk.
+	storeResultNanos int64
+	writeToDiskNanos int64
+}
+
+// ResourceUsage is a snapshot of the queryResources of a query.
+type ResourceUsage struct {
+	BackendBytes  int64
+	TempFileBytes int64
+	EventBytes    int64
+
+	// Events is the number of events generated for clients, including
+	// events which were later obsoleted.
+	Events int
+
+	StoreResultTime time.Duration
+	WriteToDiskTime time.Duration
+}
+
+// ProcessingTime is the total time spent processing the replies of the source
+// backends, an approximation of the CPU time the query used.
+func (u ResourceUsage) ProcessingTime() time.Duration {
+	return u.StoreResultTime + u.WriteToDiskTime
+}
+
+// resourceUsageLocked returns the resources the query used so far. The caller
+// must hold stateMu. Queries which were restored from disk (see reloadQuery)
+// only report their events.
+func resourceUsageLocked(s queryState) ResourceUsage {
+	usage := ResourceUsage{Events: s.nextSequence}
+	if r := s.resources; r != nil {
+		usage.BackendBytes = atomic.LoadInt64(&r.backendBytes)
+		usage.TempFileBytes = atomic.LoadInt64(&r.tempFileBytes)
+		usage.EventBytes = atomic.LoadInt64(&r.eventBytes)
+		usage.StoreResultTime = time.Duration(atomic.LoadInt64(&r.storeResultNanos))
+		usage.WriteToDiskTime = time.Duration(atomic.LoadInt64(&r.writeToDiskNanos))
+	}
+	return usage
+}
+
+// recordResourceUsage records the resources of a finished query in the
+// query_* metrics.
+func recordResourceUsage(usage ResourceUsage) {
+	queryBackendBytes.Observe(float64(usage.BackendBytes))
+	queryTempFileBytes.Observe(float64(usage.TempFileBytes))
+	queryEventBytes.Observe(float64(usage.EventBytes))
+	queryProcessingTime.WithLabelValues("storeresult").Observe(float64(usage.StoreResultTime / time.Millisecond))
+	queryProcessingTime.WithLabelValues("writetodisk").Observe(float64(usage.WriteToDiskTime / time.Millisecond))
+}
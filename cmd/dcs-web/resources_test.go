@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestResourceUsage(t *testing.T) {
+	defer useFakeBackends(t,
+		newFakeBackend("i3-wm_4.8-1/i3bar/src/main.c", "i3-wm_4.8-1/src/main.c"),
+		newFakeBackend("zsh_5.8-1/Src/main.c"),
+	)()
+
+	queryid, cleanup := runQuery(t, "q=main&literal=1")
+	defer cleanup()
+
+	s := waitDone(t, queryid)
+	stateMu.RLock()
+	usage := resourceUsageLocked(s)
+	stats := queryStatsLocked(queryid, s)
+	stateMu.RUnlock()
+
+	// Each stored reply (3 matches and 3 progress updates) is written to
+	// the results storage.
+	if usage.BackendBytes == 0 || usage.TempFileBytes == 0 {
+		t.Errorf("BackendBytes = %d, TempFileBytes = %d, want both > 0", usage.BackendBytes, usage.TempFileBytes)
+	}
+	if usage.TempFileBytes > usage.BackendBytes {
+		t.Errorf("TempFileBytes = %d exceeds BackendBytes = %d", usage.TempFileBytes, usage.BackendBytes)
+	}
+	if usage.Events != s.nextSequence || usage.EventBytes == 0 {
+		t.Errorf("Events = %d, EventBytes = %d, want %d events and > 0 bytes", usage.Events, usage.EventBytes, s.nextSequence)
+	}
+	if usage.StoreResultTime == 0 || usage.WriteToDiskTime == 0 {
+		t.Errorf("StoreResultTime = %v, WriteToDiskTime = %v, want both > 0", usage.StoreResultTime, usage.WriteToDiskTime)
+	}
+	if stats.Resources != usage {
+		t.Errorf("/queryz resources = %+v, want %+v", stats.Resources, usage)
+	}
+
+	// Queries restored from disk do not know their resources.
+	if got := resourceUsageLocked(queryState{nextSequence: 3}); got != (ResourceUsage{Events: 3}) {
+		t.Errorf("resourceUsageLocked(restored) = %+v, want only Events", got)
+	}
+}
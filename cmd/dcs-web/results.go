@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"math"
 	"net/http"
 	"strings"
@@ -21,62 +25,251 @@ func startJsonResponse(w http.ResponseWriter) {
 	w.Header().Set("Expires", cacheUntil)
 }
 
+// notModified sets the ETag header to etag and returns true (after replying
+// with 304 Not Modified) if the client already has the current version. An
+// empty etag disables conditional requests.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == etag || candidate == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// pageETag returns a strong ETag for the specified page of results, or an
+// empty string if the results are not yet final. kind distinguishes the
+// result pages from the per-package result pages.
+func pageETag(queryid, kind string, page int) string {
+	stateMu.RLock()
+	digest := state[queryid].resultsDigest
+	stateMu.RUnlock()
+	if digest == "" {
+		return ""
+	}
+	return fmt.Sprintf(`"%s-%s-%d"`, digest, kind, page)
+}
+
 func writeResults(queryid string, page int, results io.Writer, w http.ResponseWriter, r *http.Request) error {
+	stateMu.RLock()
 	pointers := state[queryid].resultPointers
-	pages := int(math.Ceil(float64(len(pointers)) / float64(resultsPerPage)))
+	stateMu.RUnlock()
+	pages := int(math.Ceil(float64(len(pointers)) / float64(*resultsPerPage)))
 	if page > pages {
 		http.Error(w, "No such page.", http.StatusNotFound)
 		return nil
 	}
-	start := page * resultsPerPage
-	end := (page + 1) * resultsPerPage
+	start := page * *resultsPerPage
+	end := (page + 1) * *resultsPerPage
 	if end > len(pointers) {
 		end = len(pointers)
 	}
 
-	if strings.HasSuffix(r.URL.Path, ".json") {
-		startJsonResponse(w)
+	isJSON := strings.HasSuffix(r.URL.Path, ".json")
+	if isJSON && notModified(w, r, pageETag(queryid, "page", page)) {
+		return nil
 	}
 
-	if err := writeFromPointers(queryid, results, pointers[start:end]); err != nil {
-		return fmt.Errorf("Could not return results: %v", err)
+	// The page is rendered completely before sending it, so that clients
+	// never receive (and cache) broken JSON when results cannot be read.
+	var buf bytes.Buffer
+	if err := writeFromPointers(queryid, &buf, pointers[start:end]); err != nil {
+		markQueryCorrupt(queryid, err)
+		return fmt.Errorf("Could not return results, please retry the query: %v", err)
 	}
-	return nil
+	if isJSON {
+		startJsonResponse(w)
+	}
+	_, err := results.Write(buf.Bytes())
+	return err
 }
 
-func writePerPkgResults(queryid string, page int, results io.Writer, w http.ResponseWriter, r *http.Request) error {
+// writePerPkgResults writes the specified page of per-package results, with
+// up to perPackage results per package. Only -results_per_package results
+// are retained per package, so larger values are capped.
+//
+// Per-package results are not stored in files of their own: writeToDisk only
+// records pointers (backend, offset and length) into the query’s results
+// storage, which holds all matches in one file per backend and is read using
+// ReadAt (see fileStore). The pointers are persisted in the query’s index.
+func writePerPkgResults(queryid string, page, perPackage int, results io.Writer, w http.ResponseWriter, r *http.Request) error {
+	stateMu.RLock()
 	bypkg := state[queryid].resultPointersByPkg
 	packages := state[queryid].allPackagesSorted
+	pages := int(math.Ceil(float64(len(packages)) / float64(*packagesPerPage)))
+	start := page * *packagesPerPage
+	if start > len(packages) {
+		start = len(packages)
+	}
+	end := (page + 1) * *packagesPerPage
+	if end > len(packages) {
+		end = len(packages)
+	}
+	totals := make([]int, end-start)
+	for idx, pkg := range packages[start:end] {
+		totals[idx] = state[queryid].facets.Packages[pkg]
+	}
+	stateMu.RUnlock()
 
-	pages := int(math.Ceil(float64(len(packages)) / float64(packagesPerPage)))
 	if page > pages {
 		http.Error(w, "No such page.", http.StatusNotFound)
 		return nil
 	}
-	start := page * packagesPerPage
-	end := (page + 1) * packagesPerPage
-	if end > len(packages) {
-		end = len(packages)
+
+	isJSON := strings.HasSuffix(r.URL.Path, ".json")
+	if isJSON && notModified(w, r, pageETag(queryid, fmt.Sprintf("perpackage%d", perPackage), page)) {
+		return nil
 	}
 
-	if strings.HasSuffix(r.URL.Path, ".json") {
+	perPkg := make([][]resultPointer, end-start)
+	var all []resultPointer
+	for idx, pkg := range packages[start:end] {
+		pointers := bypkg[pkg]
+		if len(pointers) > perPackage {
+			pointers = pointers[:perPackage]
+		}
+		perPkg[idx] = pointers
+		all = append(all, pointers...)
+	}
+	// Unlike result pages (see writeResults), per-package pages can be large,
+	// so they are streamed instead of rendered completely before sending
+	// them. Validating the pointers up front allows replying with an error
+	// in the common case of missing or truncated results storage.
+	if err := validatePointers(queryid, all); err != nil {
+		markQueryCorrupt(queryid, err)
+		return fmt.Errorf("Could not return results, please retry the query: %v", err)
+	}
+	if isJSON {
 		startJsonResponse(w)
 	}
 
-	results.Write([]byte("["))
-
+	// Each element is written as its envelope (all fields but Results,
+	// encoded with enc) followed by the streamed results of the package.
+	bw := bufio.NewWriter(results)
+	var envelope bytes.Buffer
+	enc := json.NewEncoder(&envelope)
+	// Matches are HTML-escaped by the source backends already.
+	enc.SetEscapeHTML(false)
+	bw.WriteString("[")
 	for idx, pkg := range packages[start:end] {
-		if idx == 0 {
-			fmt.Fprintf(results, `{"Package": "%s", "Results":`, pkg)
-		} else {
-			fmt.Fprintf(results, `,{"Package": "%s", "Results":`, pkg)
+		if idx > 0 {
+			bw.WriteString(",")
+		}
+		m := lookupMetadata(pkg)
+		envelope.Reset()
+		if err := enc.Encode(&PerPackageResults{
+			Package:      pkg,
+			Upstream:     m.Upstream,
+			Description:  m.Description,
+			Section:      m.Section,
+			Homepage:     m.Homepage,
+			TotalResults: totals[idx],
+			ShownResults: len(perPkg[idx]),
+			Ranking:      summarizeRankings(bypkg[pkg]),
+		}); err != nil {
+			return err
+		}
+		bw.Write(bytes.TrimSuffix(envelope.Bytes(), []byte("}\n")))
+		bw.WriteString(`,"Results":`)
+		if err := writeFromPointers(queryid, bw, perPkg[idx]); err != nil {
+			markQueryCorrupt(queryid, err)
+			if results == io.Writer(w) {
+				// Part of the page was already sent. Aborting the
+				// connection ensures that clients do not mistake
+				// (or cache) the truncated page for a complete one.
+				log.Printf("[%s] aborting per-package page %d: %v\n", queryid, page, err)
+				panic(http.ErrAbortHandler)
+			}
+			return fmt.Errorf("Could not return results, please retry the query: %v", err)
+		}
+		bw.WriteString("}")
+	}
+	bw.WriteString("]")
+	return bw.Flush()
+}
+
+// PerPackageResults is an element of the JSON array of per-package results
+// (see writePerPkgResults).
+type PerPackageResults struct {
+	// Package is the source package name, without version.
+	Package string
+
+	// Upstream is the upstream project of the package (see
+	// writePerUpstreamResults), if known.
+	Upstream string `json:",omitempty"`
+
+	// Description, Section and Homepage describe the package (see
+	// -metadata_path), if known, so that clients can render it without
+	// further lookups.
+	Description string `json:",omitempty"`
+	Section     string `json:",omitempty"`
+	Homepage    string `json:",omitempty"`
+
+	// Results are the results within the package, as on result pages. They
+	// are streamed after the other fields (see writePerPkgResults).
+	Results json.RawMessage `json:",omitempty"`
+
+	// TotalResults is the number of results within the package, of which
+	// ShownResults are included in Results.
+	TotalResults int
+	ShownResults int
+
+	Ranking RankingSummary
+}
+
+// RankingSummary summarizes the rankings of the results retained for a
+// package (see -results_per_package).
+type RankingSummary struct {
+	Best float32
+	Mean float32
+}
+
+func summarizeRankings(pointers []resultPointer) RankingSummary {
+	var summary RankingSummary
+	if len(pointers) == 0 {
+		return summary
+	}
+	var sum float64
+	for idx, p := range pointers {
+		if idx == 0 || p.ranking > summary.Best {
+			summary.Best = p.ranking
+		}
+		sum += float64(p.ranking)
+	}
+	summary.Mean = float32(sum / float64(len(pointers)))
+	return summary
+}
+
+// validatePointers returns an error if any of the pointers lies outside of the
+// query’s results storage. Only byte-addressed storage can be validated this
+// way (see byteAddressedResults), pointers into other storage are accepted.
+func validatePointers(queryid string, pointers []resultPointer) error {
+	stateMu.RLock()
+	s := state[queryid]
+	stateMu.RUnlock()
+	if s.storage == nil {
+		return fmt.Errorf("results storage not available")
+	}
+	if _, ok := s.storage.(byteAddressedResults); !ok {
+		return nil
+	}
+	sizes := make(map[int]int64)
+	for _, p := range pointers {
+		size, ok := sizes[p.backendidx]
+		if !ok {
+			size = s.storage.Size(p.backendidx)
+			sizes[p.backendidx] = size
 		}
-		if err := writeFromPointers(queryid, results, bypkg[pkg]); err != nil {
-			return fmt.Errorf("Could not return results: %v", err)
+		if p.offset+int64(p.length) > size {
+			return fmt.Errorf("result at offset %d (%d bytes) exceeds the %d bytes stored for backend %d", p.offset, p.length, size, p.backendidx)
 		}
-		results.Write([]byte("}"))
 	}
-	results.Write([]byte("]"))
 	return nil
 }
 
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Debian/dcs/cmd/dcs-web/search"
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+// globRegexp converts a glob pattern as accepted by resultsFilter.Path into
+// a regular expression. Like SQLite’s GLOB operator (see sqliteResults), *
+// also matches slashes.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				re.WriteString(`\[`)
+				continue
+			}
+			// Character classes (including negated classes, [^…]) have
+			// the same syntax in regular expressions.
+			re.WriteString("[" + glob[i+1:i+1+end] + "]")
+			i += end + 1
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// filterPointers filters, sorts and paginates the results of a completed
+// query in memory, re-using the result pointers into the stored results
+// instead of re-running the query. This works with every -results_store,
+// whereas sqliteResults.Filter only supports the resultsFilter fields.
+//
+// If post is non-nil, only results matching it are returned (see
+// search.Filter).
+func filterPointers(queryid string, s queryState, f resultsFilter, post *search.Filter) ([]resultPointer, error) {
+	// s.resultPointers are sorted by descending ranking.
+	pointers := make([]resultPointer, 0, len(s.resultPointers))
+	for _, p := range s.resultPointers {
+		if f.Package != "" {
+			name := *p.packageName
+			if idx := strings.Index(name, "_"); idx != -1 {
+				name = name[:idx]
+			}
+			if name != f.Package {
+				continue
+			}
+		}
+		pointers = append(pointers, p)
+	}
+
+	// Filtering by path, sorting by path or mtime and search.Filter require
+	// reading the matches.
+	if f.Path != "" || f.Sort == "path" || f.Sort == "mtime" || post != nil {
+		var pathRe *regexp.Regexp
+		if f.Path != "" {
+			var err error
+			if pathRe, err = globRegexp(f.Path); err != nil {
+				return nil, err
+			}
+		}
+		var (
+			matching []resultPointer
+			paths    = make(map[int]string)
+			mtimes   = make(map[int]int64)
+		)
+		err := forEachMatch(queryid, pointers, func(idx int, match *sourcebackendpb.Match) error {
+			if pathRe != nil && !pathRe.MatchString(match.Path) {
+				return nil
+			}
+			if post != nil && !post.Matches(match) {
+				return nil
+			}
+			paths[len(matching)] = match.Path
+			mtimes[len(matching)] = match.Mtime
+			matching = append(matching, pointers[idx])
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		pointers = matching
+		if f.Sort == "path" || f.Sort == "mtime" {
+			idx := make([]int, len(pointers))
+			for i := range idx {
+				idx[i] = i
+			}
+			sort.SliceStable(idx, func(i, j int) bool {
+				if f.Sort == "mtime" {
+					// Matches without file metadata (mtime 0)
+					// sort as the oldest.
+					return mtimes[idx[i]] < mtimes[idx[j]]
+				}
+				return paths[idx[i]] < paths[idx[j]]
+			})
+			sorted := make([]resultPointer, len(pointers))
+			for i, from := range idx {
+				sorted[i] = pointers[from]
+			}
+			pointers = sorted
+		}
+	}
+
+	switch f.Sort {
+	case "ranking":
+		// Already sorted by descending ranking.
+		if !f.Descending {
+			reversePointers(pointers)
+		}
+	case "package":
+		sort.SliceStable(pointers, func(i, j int) bool {
+			return *pointers[i].packageName < *pointers[j].packageName
+		})
+		if f.Descending {
+			reversePointers(pointers)
+		}
+	case "path", "mtime":
+		if f.Descending {
+			reversePointers(pointers)
+		}
+	}
+
+	if f.Offset > len(pointers) {
+		return nil, nil
+	}
+	pointers = pointers[f.Offset:]
+	if len(pointers) > f.Limit {
+		pointers = pointers[:f.Limit]
+	}
+	return pointers, nil
+}
+
+func reversePointers(pointers []resultPointer) {
+	for i, j := 0, len(pointers)-1; i < j; i, j = i+1, j-1 {
+		pointers[i], pointers[j] = pointers[j], pointers[i]
+	}
+}
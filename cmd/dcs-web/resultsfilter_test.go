@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	for _, tt := range []struct {
+		glob  string
+		path  string
+		match bool
+	}{
+		{"*/src/*.c", "i3-wm_4.16-1/src/main.c", true},
+		{"*/src/*.c", "i3-wm_4.16-1/src/sub/dir.c", true},
+		{"*/src/*.c", "i3-wm_4.16-1/src/main.h", false},
+		{"*.[ch]", "i3-wm_4.16-1/src/main.h", true},
+		{"*.[^c]", "i3-wm_4.16-1/src/main.c", false},
+		{"debian/?ules", "i3-wm_4.16-1/debian/rules", false},
+		{"*/debian/?ules", "i3-wm_4.16-1/debian/rules", true},
+		{"*(1).c", "foo/a(1).c", true},
+	} {
+		re, err := globRegexp(tt.glob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := re.MatchString(tt.path); got != tt.match {
+			t.Errorf("globRegexp(%q).MatchString(%q) = %v, want %v", tt.glob, tt.path, got, tt.match)
+		}
+	}
+}
+
+func TestFilteredResultsByMtime(t *testing.T) {
+	b := newFakeBackend(
+		"i3-wm_4.8-1/i3bar/src/main.c",
+		"i3-wm_4.8-1/src/main.c",
+		"dcs_0.1-1/cmd/dcs-web/dcs-web.go")
+	// Replies alternate between matches and progress updates.
+	b.replies[0].Match.Size, b.replies[0].Match.Mtime = 100, 1400000000
+	b.replies[2].Match.Size, b.replies[2].Match.Mtime = 200, 1500000000
+	// The third match has no file metadata.
+	defer useFakeBackends(t, b)()
+
+	queryid, cleanup := runQuery(t, "q=main&literal=1")
+	defer cleanup()
+	waitDone(t, queryid)
+
+	for _, tt := range []struct {
+		order string
+		want  []string
+	}{
+		{"", []string{"i3-wm_4.8-1/src/main.c", "i3-wm_4.8-1/i3bar/src/main.c", "dcs_0.1-1/cmd/dcs-web/dcs-web.go"}},
+		{"asc", []string{"dcs_0.1-1/cmd/dcs-web/dcs-web.go", "i3-wm_4.8-1/i3bar/src/main.c", "i3-wm_4.8-1/src/main.c"}},
+	} {
+		rec := httptest.NewRecorder()
+		ResultsHandler(rec, httptest.NewRequest("GET", "/results/"+queryid+"/query.json?sort=mtime&order="+tt.order, nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+		}
+		var results []struct {
+			Path  string `json:"path"`
+			Size  uint64 `json:"size"`
+			Mtime int64  `json:"mtime"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%v (body: %s)", err, rec.Body.String())
+		}
+		var got []string
+		for _, r := range results {
+			got = append(got, r.Path)
+			if r.Path == "i3-wm_4.8-1/src/main.c" && (r.Size != 200 || r.Mtime != 1500000000) {
+				t.Errorf("%s: size = %d, mtime = %d, want 200, 1500000000", r.Path, r.Size, r.Mtime)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("order=%q: got %v, want %v", tt.order, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/Debian/dcs/cmd/dcs-web/search"
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/renameio"
+)
+
+var (
+	resultsStoreName = flag.String("results_store",
+		"files",
+		"Where to store the results of a query: “files” (one unsorted_N.pb file per source backend in -query_results_path) or “sqlite” (one results.sqlite file per query in -query_results_path, which filters and sorts results for /results/<queryid>/query.json using SQL instead of in memory; requires building with -tags sqlite) or “s3” (like files, but uploaded to object storage once all results are in, so that any dcs-web instance can serve them, see -s3_endpoint)")
+
+	filteredResultsPathRe = regexp.MustCompile(`^/results/([^/]+)/query.json$`)
+)
+
+// resultsStore creates and opens the storage for the results of a query.
+type resultsStore interface {
+	// Create creates empty storage for a new query with the specified number
+	// of source backends, replacing any previous results of the query.
+	Create(queryid string, backends int) (resultsStorage, error)
+
+	// Open opens the storage of a finished query, e.g. when reloading an
+	// evicted query.
+	Open(queryid string, backends int) (resultsStorage, error)
+
+	// WriteIndex stores the serialized persistedQuery of a finished query.
+	// Create removes it.
+	WriteIndex(queryid string, b []byte) error
+
+	// ReadIndex returns what WriteIndex stored, or an error satisfying
+	// os.IsNotExist.
+	ReadIndex(queryid string) ([]byte, error)
+}
+
+// resultsStorage stores the messages which the source backends returned for one
+// query. Matches are addressed by (backendidx, offset, length), as stored in
+// resultPointer. Implementations must be safe for concurrent use.
+type resultsStorage interface {
+	// Append stores msg, whose serialized form is encoded. The returned
+	// offset is only meaningful for messages of type MATCH.
+	Append(backendidx int, msg *sourcebackendpb.SearchReply, encoded []byte) (offset int64, err error)
+
+	// Flush makes all appended messages available for Read.
+	Flush() error
+
+	// Read returns the serialized message at offset.
+	Read(backendidx int, offset int64, length int) ([]byte, error)
+
+	// Size returns the number of bytes stored for the specified backend.
+	Size(backendidx int) int64
+
+	Close() error
+}
+
+// checksummedResults is implemented by resultsStorage which can checksum the
+// stored messages, so that corruption (e.g. files truncated by a crash) can
+// be detected when reloading a query, see storageManifest.
+type checksummedResults interface {
+	// Checksum returns the CRC-32 (IEEE) of all messages stored for the
+	// specified backend.
+	Checksum(backendidx int) (uint32, error)
+}
+
+// byteAddressedResults is implemented by resultsStorage whose offsets are
+// byte offsets, i.e. every stored message lies within the first
+// Size(backendidx) bytes. Pointers into such storage can be validated without
+// reading them, see validatePointers.
+type byteAddressedResults interface {
+	byteAddressed()
+}
+
+var store resultsStore
+
+func newResultsStore(name string) (resultsStore, error) {
+	switch name {
+	case "files":
+		return fileStore{}, nil
+	case "sqlite":
+		return newSQLiteStore()
+	case "s3":
+		return newS3Store()
+	default:
+		return nil, fmt.Errorf("unknown -results_store %q, expected one of files, sqlite or s3", name)
+	}
+}
+
+func localIndexPath(queryid string) string {
+	return filepath.Join(*queryResultsPath, queryid, "index.gob")
+}
+
+// localIndex implements the index methods of resultsStore using
+// <query_results_path>/<queryid>/index.gob.
+type localIndex struct{}
+
+func (localIndex) WriteIndex(queryid string, b []byte) error {
+	return renameio.WriteFile(localIndexPath(queryid), b, 0644)
+}
+
+func (localIndex) ReadIndex(queryid string) ([]byte, error) {
+	return ioutil.ReadFile(localIndexPath(queryid))
+}
+
+func (localIndex) removeIndex(queryid string) error {
+	if err := os.Remove(localIndexPath(queryid)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// fileStore stores results in one file per source backend,
+// <query_results_path>/<queryid>/unsorted_<backendidx>.pb, containing
+// fileMagic followed by the serialized messages, each prefixed with its
+// length as a uvarint. The framing allows reading the messages back when
+// resuming an interrupted query, see Resume.
+type fileStore struct {
+	localIndex
+}
+
+// fileMagic identifies result files whose messages are framed, as opposed to
+// result files written by older versions, which cannot be resumed.
+const fileMagic = "dcsres1\n"
+
+type fileBackend struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer // nil when opened read-only
+	crc    hash.Hash32   // nil when opened read-only
+	offset int64
+}
+
+type fileResults []*fileBackend
+
+func (fileStore) path(queryid string, backendidx int) string {
+	return filepath.Join(*queryResultsPath, queryid, fmt.Sprintf("unsorted_%d.pb", backendidx))
+}
+
+func (fs fileStore) Create(queryid string, backends int) (resultsStorage, error) {
+	if err := fs.removeIndex(queryid); err != nil {
+		return nil, err
+	}
+	results := make(fileResults, backends)
+	for i := range results {
+		f, err := os.Create(fs.path(queryid, i))
+		if err != nil {
+			results[:i].Close()
+			return nil, err
+		}
+		results[i] = newFileBackend(f)
+	}
+	return results, nil
+}
+
+// newFileBackend returns a fileBackend appending to the empty file f.
+func newFileBackend(f *os.File) *fileBackend {
+	b := &fileBackend{
+		f:   f,
+		w:   bufio.NewWriterSize(f, 65536),
+		crc: crc32.NewIEEE(),
+	}
+	b.w.WriteString(fileMagic)
+	b.crc.Write([]byte(fileMagic))
+	b.offset = int64(len(fileMagic))
+	return b
+}
+
+func (fs fileStore) Open(queryid string, backends int) (resultsStorage, error) {
+	results := make(fileResults, backends)
+	for i := range results {
+		f, err := os.Open(fs.path(queryid, i))
+		if err != nil {
+			results[:i].Close()
+			return nil, err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			results[:i].Close()
+			return nil, err
+		}
+		results[i] = &fileBackend{
+			f:      f,
+			offset: st.Size(),
+		}
+	}
+	return results, nil
+}
+
+// Resume opens the storage of an interrupted query for appending. The
+// replies of each backend whose file ends with its final progress update are
+// returned so that they can be replayed; the files of all other backends are
+// truncated, as these backends need to be queried again.
+func (fs fileStore) Resume(queryid string, backends int) (resultsStorage, [][]storedReply, error) {
+	results := make(fileResults, backends)
+	replies := make([][]storedReply, backends)
+	for i := range results {
+		var err error
+		results[i], replies[i], err = resumeFileBackend(fs.path(queryid, i))
+		if err != nil {
+			results[:i].Close()
+			return nil, nil, err
+		}
+	}
+	return results, replies, nil
+}
+
+func resumeFileBackend(path string) (*fileBackend, []storedReply, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	replies, size, err := scanReplies(bufio.NewReader(f))
+	if err != nil || len(replies) == 0 || !backendDone(replies[len(replies)-1].msg) {
+		if err != nil {
+			log.Printf("discarding results in %q: %v\n", path, err)
+		}
+		replies, size = nil, 0
+	}
+	// Anything following the last complete message (e.g. a message which
+	// was only partially written) is discarded.
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if size == 0 {
+		return newFileBackend(f), nil, nil
+	}
+	b := &fileBackend{
+		f:      f,
+		w:      bufio.NewWriterSize(f, 65536),
+		crc:    crc32.NewIEEE(),
+		offset: size,
+	}
+	if _, err := io.Copy(b.crc, io.NewSectionReader(f, 0, size)); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return b, replies, nil
+}
+
+// scanReplies reads the messages written by fileResults.Append from r. It
+// returns the messages which could be read completely and the offset at
+// which they end.
+func scanReplies(r *bufio.Reader) ([]storedReply, int64, error) {
+	magic := make([]byte, len(fileMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != fileMagic {
+		return nil, 0, fmt.Errorf("not a resumable results file")
+	}
+	var replies []storedReply
+	offset := int64(len(fileMagic))
+	for {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			// io.EOF marks the end of the file. Anything else is
+			// a partially written message.
+			return replies, offset, nil
+		}
+		encoded := make([]byte, length)
+		if _, err := io.ReadFull(r, encoded); err != nil {
+			return replies, offset, nil
+		}
+		var msg sourcebackendpb.SearchReply
+		if err := proto.Unmarshal(encoded, &msg); err != nil {
+			return nil, 0, err
+		}
+		prefix := int64(uvarintLen(length))
+		replies = append(replies, storedReply{
+			msg:    &msg,
+			offset: offset + prefix,
+			length: int(length),
+		})
+		offset += prefix + int64(length)
+	}
+}
+
+func uvarintLen(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+func (fr fileResults) Append(backendidx int, msg *sourcebackendpb.SearchReply, encoded []byte) (int64, error) {
+	b := fr[backendidx]
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(encoded)))
+	if _, err := b.w.Write(prefix[:n]); err != nil {
+		return 0, err
+	}
+	if _, err := b.w.Write(encoded); err != nil {
+		return 0, err
+	}
+	b.crc.Write(prefix[:n])
+	b.crc.Write(encoded)
+	offset := b.offset + int64(n)
+	b.offset = offset + int64(len(encoded))
+	// The results of backends which are done must survive a restart, so
+	// that they are not queried again when resuming the query.
+	if backendDone(msg) {
+		if err := b.w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// backendDone returns whether msg is the final progress update of a source
+// backend.
+func backendDone(msg *sourcebackendpb.SearchReply) bool {
+	return msg.Type == sourcebackendpb.SearchReply_PROGRESS_UPDATE &&
+		msg.ProgressUpdate.FilesProcessed == msg.ProgressUpdate.FilesTotal
+}
+
+// Checksum returns the checksum computed while appending, or reads the file if
+// it was opened read-only.
+func (fr fileResults) Checksum(backendidx int) (uint32, error) {
+	b := fr[backendidx]
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.crc != nil {
+		return b.crc.Sum32(), nil
+	}
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, io.NewSectionReader(b.f, 0, b.offset)); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+func (fr fileResults) Flush() error {
+	for _, b := range fr {
+		b.mu.Lock()
+		var err error
+		if b.w != nil {
+			err = b.w.Flush()
+		}
+		b.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fr fileResults) Read(backendidx int, offset int64, length int) ([]byte, error) {
+	// TODO: Avoid the allocations by using a slice and only allocate a new buffer when length > cap(rdbuf)
+	rdbuf := make([]byte, length)
+	if _, err := fr[backendidx].f.ReadAt(rdbuf, offset); err != nil {
+		return nil, err
+	}
+	return rdbuf, nil
+}
+
+func (fileResults) byteAddressed() {}
+
+func (fr fileResults) Size(backendidx int) int64 {
+	b := fr[backendidx]
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.offset
+}
+
+func (fr fileResults) Close() error {
+	var firstErr error
+	for _, b := range fr {
+		if b == nil {
+			continue
+		}
+		if err := b.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// resultsFilter selects and orders the results of a query when reading them.
+type resultsFilter struct {
+	// Source package name (without version). Empty means all packages.
+	Package string
+
+	// Glob pattern (e.g. “*/src/*.c”) matched against the path of each
+	// result. Empty means all paths.
+	Path string
+
+	// One of “ranking”, “package”, “path” or “mtime” (the modification time
+	// of the file, see sourcebackendpb.Match.Mtime).
+	Sort       string
+	Descending bool
+
+	Offset int
+	Limit  int
+}
+
+// filterableResults is implemented by resultsStorage which can filter and sort
+// results at read time.
+type filterableResults interface {
+	Filter(f resultsFilter, firstPathRank float32) ([]resultPointer, error)
+}
+
+func formInt(r *http.Request, key string, def int) (int, error) {
+	v := r.FormValue(key)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// serveFilteredResults serves /results/<queryid>/query.json, which accepts the
+// parameters package, path, sort, order (asc or desc), offset and limit (see
+// resultsFilter), page (an alternative to offset, in units of limit) and
+// filter (see search.Filter). This allows re-paginating, re-sorting and
+// re-filtering the results of a completed query without re-running it, as the
+// stored results are kept until the query is cleaned up.
+func serveFilteredResults(w http.ResponseWriter, r *http.Request, queryid string) {
+	s, msg, code := completedQuery(queryid)
+	if code != http.StatusOK {
+		http.Error(w, msg, code)
+		return
+	}
+	var post *search.Filter
+	if filter := r.FormValue("filter"); filter != "" {
+		var err error
+		if post, err = search.ParseFilter(filter); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	f := resultsFilter{
+		Package: r.FormValue("package"),
+		Path:    r.FormValue("path"),
+		Sort:    r.FormValue("sort"),
+	}
+	switch f.Sort {
+	case "":
+		f.Sort = "ranking"
+	case "ranking", "package", "path", "mtime":
+	default:
+		http.Error(w, "sort must be ranking, package, path or mtime", http.StatusBadRequest)
+		return
+	}
+	switch r.FormValue("order") {
+	case "asc":
+	case "desc":
+		f.Descending = true
+	case "":
+		// Best and most recently modified results first.
+		f.Descending = f.Sort == "ranking" || f.Sort == "mtime"
+	default:
+		http.Error(w, "order must be asc or desc", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if f.Offset, err = formInt(r, "offset", 0); err != nil || f.Offset < 0 {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+	if f.Limit, err = formInt(r, "limit", *resultsPerPage); err != nil || f.Limit < 1 || f.Limit > 1000 {
+		http.Error(w, "Invalid limit, must be between 1 and 1000", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("page") != "" {
+		page, err := formInt(r, "page", 0)
+		if err != nil || page < 0 {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		f.Offset = page * f.Limit
+	}
+	var pointers []resultPointer
+	// The SQL query cannot apply filter= expressions, as they are evaluated
+	// on the decoded matches.
+	if fr, ok := s.storage.(filterableResults); ok && post == nil {
+		pointers, err = fr.Filter(f, s.FirstPathRank)
+	} else {
+		pointers, err = filterPointers(queryid, s, f, post)
+	}
+	if err != nil {
+		log.Printf("[%s] could not filter results: %v\n", queryid, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	startJsonResponse(w)
+	if err := writeFromPointers(queryid, w, pointers); err != nil {
+		log.Printf("[%s] could not write results: %v\n", queryid, err)
+	}
+}
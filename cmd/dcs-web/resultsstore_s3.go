@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+var (
+	s3Endpoint = flag.String("s3_endpoint",
+		"",
+		"For -results_store=s3: URL of the S3-compatible object storage, e.g. https://s3.eu-central-1.amazonaws.com or http://minio:9000. Credentials are read from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables")
+	s3Region = flag.String("s3_region",
+		"us-east-1",
+		"For -results_store=s3: region used for signing requests")
+	s3Bucket = flag.String("s3_bucket",
+		"",
+		"For -results_store=s3: bucket in which results are stored")
+	s3Prefix = flag.String("s3_prefix",
+		"dcs-results/",
+		"For -results_store=s3: prefix of all object names")
+)
+
+// s3Client implements the few S3 API calls we need (using path-style URLs and
+// AWS Signature Version 4), which avoids depending on an SDK.
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	now       func() time.Time
+}
+
+// awsEscape escapes s as required for the canonical request: all bytes except
+// the unreserved characters are percent-encoded.
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the x-amz-date and Authorization headers to req. All headers set
+// on req (plus Host) are signed. payloadHash is the hex-encoded SHA-256 of
+// the request body, or “UNSIGNED-PAYLOAD”.
+func (c *s3Client) sign(req *http.Request, payloadHash string) {
+	t := c.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, awsEscape(key, true)+"="+awsEscape(value, true))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.Path, false),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := t.Format("20060102") + "/" + c.region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), t.Format("20060102"))
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func (c *s3Client) objectURL(key string) *url.URL {
+	u := *c.endpoint
+	u.Path = path.Join("/", c.endpoint.Path, c.bucket, key)
+	return &u
+}
+
+func (c *s3Client) do(method, key string, body io.ReadSeeker, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		size, err := body.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+	}
+	c.sign(req, "UNSIGNED-PAYLOAD")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: method, Path: key, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: unexpected HTTP status %v: %s", method, key, resp.Status, b)
+	}
+	return resp, nil
+}
+
+func (c *s3Client) put(key string, body io.ReadSeeker) error {
+	resp, err := c.do("PUT", key, body, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *s3Client) get(key string, offset int64, length int) ([]byte, error) {
+	header := make(http.Header)
+	if length > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(length)-1))
+	}
+	resp, err := c.do("GET", key, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (c *s3Client) size(key string) (int64, error) {
+	resp, err := c.do("HEAD", key, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+func (c *s3Client) delete(key string) error {
+	resp, err := c.do("DELETE", key, nil, nil)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// s3Store writes results to local files (see fileStore) while a query is
+// running and uploads them to object storage once all results are in. Any
+// dcs-web instance using the same bucket can then serve the query’s results
+// (reading them with HTTP range requests), so that instances behind a load
+// balancer do not need to share local state.
+type s3Store struct {
+	client *s3Client
+	local  fileStore
+}
+
+func newS3Store() (resultsStore, error) {
+	if *s3Endpoint == "" || *s3Bucket == "" {
+		return nil, fmt.Errorf("-results_store=s3 requires -s3_endpoint and -s3_bucket")
+	}
+	endpoint, err := url.Parse(*s3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("-results_store=s3 requires the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables")
+	}
+	return s3Store{
+		client: &s3Client{
+			endpoint:  endpoint,
+			region:    *s3Region,
+			bucket:    *s3Bucket,
+			accessKey: accessKey,
+			secretKey: secretKey,
+			client:    &http.Client{Timeout: 1 * time.Minute},
+			now:       time.Now,
+		},
+	}, nil
+}
+
+func s3Key(queryid, name string) string {
+	return *s3Prefix + queryid + "/" + name
+}
+
+type s3Results struct {
+	client  *s3Client
+	queryid string
+
+	mu       sync.Mutex
+	local    resultsStorage // nil if the results are only in object storage
+	uploaded bool
+	sizes    []int64
+}
+
+func (ss s3Store) Create(queryid string, backends int) (resultsStorage, error) {
+	if err := ss.client.delete(s3Key(queryid, "index.gob")); err != nil {
+		return nil, err
+	}
+	local, err := ss.local.Create(queryid, backends)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Results{
+		client:  ss.client,
+		queryid: queryid,
+		local:   local,
+	}, nil
+}
+
+func (ss s3Store) Open(queryid string, backends int) (resultsStorage, error) {
+	if local, err := ss.local.Open(queryid, backends); err == nil {
+		return &s3Results{
+			client:   ss.client,
+			queryid:  queryid,
+			local:    local,
+			uploaded: true,
+		}, nil
+	}
+	sr := &s3Results{
+		client:   ss.client,
+		queryid:  queryid,
+		uploaded: true,
+		sizes:    make([]int64, backends),
+	}
+	for i := range sr.sizes {
+		size, err := ss.client.size(s3Key(queryid, fmt.Sprintf("unsorted_%d.pb", i)))
+		if err != nil {
+			return nil, err
+		}
+		sr.sizes[i] = size
+	}
+	return sr, nil
+}
+
+func (ss s3Store) WriteIndex(queryid string, b []byte) error {
+	if err := ss.local.WriteIndex(queryid, b); err != nil {
+		return err
+	}
+	return ss.client.put(s3Key(queryid, "index.gob"), bytes.NewReader(b))
+}
+
+func (ss s3Store) ReadIndex(queryid string) ([]byte, error) {
+	if b, err := ss.local.ReadIndex(queryid); err == nil {
+		return b, nil
+	}
+	return ss.client.get(s3Key(queryid, "index.gob"), 0, 0)
+}
+
+func (sr *s3Results) Append(backendidx int, msg *sourcebackendpb.SearchReply, encoded []byte) (int64, error) {
+	return sr.local.Append(backendidx, msg, encoded)
+}
+
+// Flush uploads the local files once. writeToDisk calls Flush after all
+// source backends are done.
+func (sr *s3Results) Flush() error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.local == nil || sr.uploaded {
+		return nil
+	}
+	if err := sr.local.Flush(); err != nil {
+		return err
+	}
+	for i, b := range sr.local.(fileResults) {
+		name := fmt.Sprintf("unsorted_%d.pb", i)
+		// Use a separate file handle: b.f is read concurrently using ReadAt.
+		f, err := os.Open(b.f.Name())
+		if err != nil {
+			return err
+		}
+		err = sr.client.put(s3Key(sr.queryid, name), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	sr.uploaded = true
+	return nil
+}
+
+func (sr *s3Results) Read(backendidx int, offset int64, length int) ([]byte, error) {
+	if sr.local != nil {
+		return sr.local.Read(backendidx, offset, length)
+	}
+	return sr.client.get(s3Key(sr.queryid, fmt.Sprintf("unsorted_%d.pb", backendidx)), offset, length)
+}
+
+func (*s3Results) byteAddressed() {}
+
+func (sr *s3Results) Size(backendidx int) int64 {
+	if sr.local != nil {
+		return sr.local.Size(backendidx)
+	}
+	return sr.sizes[backendidx]
+}
+
+func (sr *s3Results) Close() error {
+	if sr.local != nil {
+		return sr.local.Close()
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+// sqliteStore stores results in one SQLite database per query,
+// <query_results_path>/<queryid>/results.sqlite, which allows filtering and
+// sorting results when reading them (see resultsFilter).
+//
+// The database/sql driver is registered in resultsstore_sqlite_driver.go,
+// which is only built with -tags sqlite, so that the default build does not
+// require cgo.
+type sqliteStore struct {
+	localIndex
+}
+
+const sqliteSchema = `
+CREATE TABLE matches (
+	id INTEGER PRIMARY KEY,
+	backend INTEGER NOT NULL,
+	package TEXT NOT NULL,
+	package_name TEXT NOT NULL,
+	path TEXT NOT NULL,
+	line INTEGER NOT NULL,
+	mtime INTEGER NOT NULL DEFAULT 0,
+	pathrank REAL NOT NULL,
+	ranking REAL NOT NULL,
+	reply BLOB NOT NULL
+);
+CREATE INDEX matches_package_name ON matches (package_name);
+`
+
+// sqliteBatchSize is the number of matches which are inserted per
+// transaction.
+const sqliteBatchSize = 1000
+
+func newSQLiteStore() (resultsStore, error) {
+	for _, driver := range sql.Drivers() {
+		if driver == "sqlite3" {
+			return sqliteStore{}, nil
+		}
+	}
+	return nil, fmt.Errorf("-results_store=sqlite requires building dcs-web with -tags sqlite")
+}
+
+type sqliteRow struct {
+	id      int64
+	backend int
+	match   *sourcebackendpb.Match
+	reply   []byte
+}
+
+type sqliteResults struct {
+	db *sql.DB
+
+	mu      sync.Mutex
+	nextID  int64
+	pending []sqliteRow
+	sizes   []int64
+}
+
+func (sqliteStore) path(queryid string) string {
+	return filepath.Join(*queryResultsPath, queryid, "results.sqlite")
+}
+
+func (ss sqliteStore) open(path string, backends int) (*sqliteResults, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite does not support concurrent writers, and the pragmas below are
+	// per connection.
+	db.SetMaxOpenConns(1)
+	// The results can be re-created by running the query again, so
+	// durability is not required.
+	for _, pragma := range []string{
+		"PRAGMA journal_mode = OFF",
+		"PRAGMA synchronous = OFF",
+	} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteResults{
+		db:     db,
+		nextID: 1,
+		sizes:  make([]int64, backends),
+	}, nil
+}
+
+func (ss sqliteStore) Create(queryid string, backends int) (resultsStorage, error) {
+	if err := ss.removeIndex(queryid); err != nil {
+		return nil, err
+	}
+	path := ss.path(queryid)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sr, err := ss.open(path, backends)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sr.db.Exec(sqliteSchema); err != nil {
+		sr.db.Close()
+		return nil, err
+	}
+	return sr, nil
+}
+
+func (ss sqliteStore) Open(queryid string, backends int) (resultsStorage, error) {
+	path := ss.path(queryid)
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	sr, err := ss.open(path, backends)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := sr.db.Query("SELECT backend, SUM(LENGTH(reply)), MAX(id) FROM matches GROUP BY backend")
+	if err != nil {
+		sr.db.Close()
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var backend int
+		var size, maxID int64
+		if err := rows.Scan(&backend, &size, &maxID); err != nil {
+			sr.db.Close()
+			return nil, err
+		}
+		if backend < len(sr.sizes) {
+			sr.sizes[backend] = size
+		}
+		if maxID >= sr.nextID {
+			sr.nextID = maxID + 1
+		}
+	}
+	if err := rows.Err(); err != nil {
+		sr.db.Close()
+		return nil, err
+	}
+	return sr, nil
+}
+
+// Append stores only matches: all other messages are only relevant while the
+// query is running.
+func (sr *sqliteResults) Append(backendidx int, msg *sourcebackendpb.SearchReply, encoded []byte) (int64, error) {
+	if msg.Type != sourcebackendpb.SearchReply_MATCH {
+		return -1, nil
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	id := sr.nextID
+	sr.nextID++
+	sr.pending = append(sr.pending, sqliteRow{
+		id:      id,
+		backend: backendidx,
+		match:   msg.Match,
+		reply:   append([]byte(nil), encoded...),
+	})
+	sr.sizes[backendidx] += int64(len(encoded))
+	if len(sr.pending) >= sqliteBatchSize {
+		if err := sr.flushLocked(); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+func (sr *sqliteResults) flushLocked() error {
+	if len(sr.pending) == 0 {
+		return nil
+	}
+	tx, err := sr.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO matches (id, backend, package, package_name, path, line, mtime, pathrank, ranking, reply) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range sr.pending {
+		pkg := row.match.Package
+		name := pkg
+		if idx := strings.Index(name, "_"); idx > -1 {
+			name = name[:idx]
+		}
+		if _, err := stmt.Exec(row.id, row.backend, pkg, name, row.match.Path, row.match.Line, row.match.Mtime, row.match.Pathrank, row.match.Ranking, row.reply); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	sr.pending = sr.pending[:0]
+	return nil
+}
+
+func (sr *sqliteResults) Flush() error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return sr.flushLocked()
+}
+
+func (sr *sqliteResults) Read(backendidx int, offset int64, length int) ([]byte, error) {
+	var reply []byte
+	if err := sr.db.QueryRow("SELECT reply FROM matches WHERE id = ?", offset).Scan(&reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (sr *sqliteResults) Size(backendidx int) int64 {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return sr.sizes[backendidx]
+}
+
+func (sr *sqliteResults) Close() error {
+	sr.mu.Lock()
+	err := sr.flushLocked()
+	sr.mu.Unlock()
+	if cerr := sr.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+var sqliteSortColumns = map[string]string{
+	// See forEachMatch for how the final ranking is computed.
+	"ranking": "pathrank + (? * 0.1) * ranking",
+	"package": "package",
+	"path":    "path",
+	"mtime":   "mtime",
+}
+
+func (sr *sqliteResults) Filter(f resultsFilter, firstPathRank float32) ([]resultPointer, error) {
+	column, ok := sqliteSortColumns[f.Sort]
+	if !ok {
+		return nil, fmt.Errorf("cannot sort by %q", f.Sort)
+	}
+	var (
+		where []string
+		args  []interface{}
+	)
+	if f.Package != "" {
+		where = append(where, "package_name = ?")
+		args = append(args, f.Package)
+	}
+	if f.Path != "" {
+		where = append(where, "path GLOB ?")
+		args = append(args, f.Path)
+	}
+	query := "SELECT id, backend, LENGTH(reply) FROM matches"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if f.Sort == "ranking" {
+		args = append(args, firstPathRank)
+	}
+	query += " ORDER BY " + column
+	if f.Descending {
+		query += " DESC"
+	}
+	// Tie-breaker for stable pagination.
+	query += ", id LIMIT ? OFFSET ?"
+	args = append(args, f.Limit, f.Offset)
+
+	rows, err := sr.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pointers []resultPointer
+	for rows.Next() {
+		var p resultPointer
+		if err := rows.Scan(&p.offset, &p.backendidx, &p.length); err != nil {
+			return nil, err
+		}
+		pointers = append(pointers, p)
+	}
+	return pointers, rows.Err()
+}
@@ -0,0 +1,8 @@
+// +build sqlite
+
+package main
+
+import (
+	// Registers the “sqlite3” database/sql driver for -results_store=sqlite.
+	_ "github.com/mattn/go-sqlite3"
+)
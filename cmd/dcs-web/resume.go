@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/google/renameio"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var (
+	resumeQueries = flag.Bool("resume_queries",
+		true,
+		"Whether queries which were interrupted by a restart are resumed on startup: the results of source backends which were done are read back from -query_results_path, and only the remaining source backends are queried again. Only supported with -results_store=files")
+
+	resumedQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "resumed_queries",
+			Help: "Queries which were interrupted by a restart, by outcome (resumed or discarded).",
+		},
+		[]string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(resumedQueries)
+}
+
+// resumableStore is implemented by resultsStore whose storage can be
+// resumed after dcs-web was restarted while a query was running.
+type resumableStore interface {
+	// Resume opens the storage of an interrupted query with the specified
+	// number of backends. For each backend which returned all of its
+	// replies, the stored replies are returned. The storage of all other
+	// backends is emptied.
+	Resume(queryid string, backends int) (resultsStorage, [][]storedReply, error)
+}
+
+// storedReply is a reply of a source backend as read back from the results
+// storage, see resumableStore.
+type storedReply struct {
+	msg    *sourcebackendpb.SearchReply
+	offset int64
+	length int
+}
+
+// runningQuery is stored in <query_results_path>/<queryid>/running.gob while
+// a query is running, so that the query can be resumed after a restart.
+type runningQuery struct {
+	Query    string
+	Src      string
+	Backends int
+	Priority queryPriority
+
+	// Tenant is the tenant in whose namespace the query runs (see
+	// tenantOf), or empty.
+	Tenant string
+}
+
+func runningQueryPath(queryid string) string {
+	return filepath.Join(*queryResultsPath, queryid, "running.gob")
+}
+
+func writeRunningQuery(queryid string, rq *runningQuery) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rq); err != nil {
+		return err
+	}
+	return renameio.WriteFile(runningQueryPath(queryid), buf.Bytes(), 0644)
+}
+
+func removeRunningQuery(queryid string) {
+	if err := os.Remove(runningQueryPath(queryid)); err != nil && !os.IsNotExist(err) {
+		log.Printf("[%s] %v\n", queryid, err)
+	}
+}
+
+// replayBackend updates the state of the query with the replies which the
+// backend returned before the query was interrupted, as if it had just
+// returned them.
+func replayBackend(queryid string, backendidx int, replies []storedReply) {
+	for _, r := range replies {
+		switch r.msg.Type {
+		case sourcebackendpb.SearchReply_MATCH:
+			storeResult(queryid, backendidx, r.msg.Match, r.offset, r.length, -1)
+		case sourcebackendpb.SearchReply_PROGRESS_UPDATE:
+			storeProgress(queryid, backendidx, r.msg.ProgressUpdate)
+		case sourcebackendpb.SearchReply_COUNTS:
+			storeCounts(queryid, r.msg.PackageCounts)
+		}
+	}
+}
+
+// resumeInterruptedQueries resumes all queries in -query_results_path which
+// were still running when dcs-web was stopped. Must be called before serving
+// requests, as clients could otherwise start the same queries concurrently.
+func resumeInterruptedQueries() {
+	if _, ok := store.(resumableStore); !ok || !*resumeQueries {
+		return
+	}
+	infos, err := ioutil.ReadDir(*queryResultsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Not resuming queries: %v\n", err)
+		}
+		return
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		queryid := info.Name()
+		b, err := ioutil.ReadFile(runningQueryPath(queryid))
+		if err != nil {
+			continue // not interrupted
+		}
+		if err := resumeQuery(queryid, b); err != nil {
+			log.Printf("[%s] not resuming interrupted query: %v\n", queryid, err)
+			resumedQueries.With(prometheus.Labels{"outcome": "discarded"}).Inc()
+			removeRunningQuery(queryid)
+			continue
+		}
+		resumedQueries.With(prometheus.Labels{"outcome": "resumed"}).Inc()
+	}
+}
+
+func resumeQuery(queryid string, b []byte) error {
+	var rq runningQuery
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&rq); err != nil {
+		return err
+	}
+	t := tenantNamed(rq.Tenant)
+	if rq.Tenant != "" && t == nil {
+		return fmt.Errorf("tenant %q no longer exists", rq.Tenant)
+	}
+	if got := tenantQueryIdentifier(t, rq.Query); got != queryid {
+		return fmt.Errorf("query %q has id %s", rq.Query, got)
+	}
+	log.Printf("[%s] resuming interrupted query %q\n", queryid, rq.Query)
+	_, err := launchQuery(context.Background(), queryid, rq.Src, rq.Query, rq.Priority, &rq)
+	return err
+}
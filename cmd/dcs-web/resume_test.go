@@ -0,0 +1,171 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// appendReplies appends the specified replies of the backend to storage, like
+// replySink.store.
+func appendReplies(t *testing.T, storage resultsStorage, backendidx int, replies []*sourcebackendpb.SearchReply) {
+	for _, reply := range replies {
+		encoded, err := proto.Marshal(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.Append(backendidx, reply, encoded); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResumeInterruptedQuery(t *testing.T) {
+	// The first backend returned all of its replies before the restart, so
+	// it must not be queried again: it would now return a different match.
+	done := newFakeBackend("i3-wm_4.8-1/i3bar/src/main.c")
+	defer useFakeBackends(t,
+		newFakeBackend("i3-wm_4.8-1/src/changed.c"),
+		newFakeBackend("dcs_0.1-1/cmd/dcs-web/dcs-web.go"))()
+
+	const query = "q=main&literal=1"
+	queryid := queryIdentifier(query)
+	if err := os.MkdirAll(filepath.Join(*queryResultsPath, queryid), 0755); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := store.Create(queryid, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendReplies(t, storage, 0, done.replies)
+	// The second backend was interrupted after its first match.
+	appendReplies(t, storage, 1, newFakeBackend("dcs_0.1-1/cmd/dcs-web/dcs-web.go").replies[:1])
+	if err := storage.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+	if err := writeRunningQuery(queryid, &runningQuery{
+		Query:    query,
+		Src:      "test",
+		Backends: 2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resumeInterruptedQueries()
+	defer forgetQuery(queryid)
+	s := waitDone(t, queryid)
+	if s.errorType != "" {
+		t.Fatalf("resumed query failed: %s", s.errorType)
+	}
+
+	var paths []string
+	if err := forEachMatch(queryid, s.resultPointers, func(idx int, match *sourcebackendpb.Match) error {
+		paths = append(paths, match.Path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	want := []string{"dcs_0.1-1/cmd/dcs-web/dcs-web.go", "i3-wm_4.8-1/i3bar/src/main.c"}
+	if len(paths) != len(want) || paths[0] != want[0] || paths[1] != want[1] {
+		t.Fatalf("unexpected results of resumed query: got %v, want %v", paths, want)
+	}
+
+	if _, err := os.Stat(runningQueryPath(queryid)); !os.IsNotExist(err) {
+		t.Errorf("running.gob still exists after the query finished (err = %v)", err)
+	}
+}
+
+func TestResumeTenantQuery(t *testing.T) {
+	path := writeTenants(t, `[{"Name": "team-a", "Keys": ["secret-a"]}]`)
+	defer os.RemoveAll(filepath.Dir(path))
+	if err := loadTenants(path); err != nil {
+		t.Fatal(err)
+	}
+	defer loadTenants("")
+	defer useFakeBackends(t, newFakeBackend("i3-wm_4.8-1/i3bar/src/main.c"))()
+
+	const query = "q=main&literal=1"
+	queryid := tenantQueryIdentifier(tenantNamed("team-a"), query)
+	if err := os.MkdirAll(filepath.Join(*queryResultsPath, queryid), 0755); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := store.Create(queryid, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+	if err := writeRunningQuery(queryid, &runningQuery{
+		Query:    query,
+		Src:      "test",
+		Backends: 1,
+		Tenant:   "team-a",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resumeInterruptedQueries()
+	stateMu.RLock()
+	_, resumed := state[queryid]
+	stateMu.RUnlock()
+	if !resumed {
+		t.Fatalf("tenant query %s was not resumed", queryid)
+	}
+	defer forgetQuery(queryid)
+	if s := waitDone(t, queryid); s.errorType != "" {
+		t.Fatalf("resumed query failed: %s", s.errorType)
+	}
+}
+
+func TestScanRepliesPartial(t *testing.T) {
+	defer useFakeBackends(t)()
+	const queryid = "partial"
+	if err := os.MkdirAll(filepath.Join(*queryResultsPath, queryid), 0755); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := store.Create(queryid, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies := newFakeBackend("i3-wm_4.8-1/i3bar/src/main.c").replies
+	appendReplies(t, storage, 0, replies)
+	storage.Flush()
+	size := storage.Size(0)
+	storage.Close()
+
+	// Simulate a message which was only partially written.
+	f, err := os.OpenFile(fileStore{}.path(queryid, 0), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{42, 1, 2})
+	f.Close()
+
+	resumed, scanned, err := fileStore{}.Resume(queryid, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if got, want := len(scanned[0]), len(replies); got != want {
+		t.Fatalf("unexpected number of replies: got %d, want %d", got, want)
+	}
+	if got := resumed.Size(0); got != size {
+		t.Errorf("partial message not discarded: got size %d, want %d", got, size)
+	}
+	b, err := resumed.Read(0, scanned[0][0].offset, scanned[0][0].length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg sourcebackendpb.SearchReply
+	if err := proto.Unmarshal(b, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := msg.GetMatch().GetPath(), "i3-wm_4.8-1/i3bar/src/main.c"; got != want {
+		t.Errorf("unexpected match read back: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// maxSampleSize limits the sample= parameter.
+const maxSampleSize = 1000000
+
+// sampler implements reservoir sampling (Algorithm R) of the matches of one
+// source backend, so that queries started with sample=N store at most N
+// matches per backend instead of potentially millions. Matches which are not
+// (or no longer) part of the sample are never written to (or are left
+// unreferenced in) the query’s results storage.
+type sampler struct {
+	size int
+	seen int
+	rng  *rand.Rand
+}
+
+func newSampler(size int) *sampler {
+	return &sampler{
+		size: size,
+		rng:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// offer accounts for one more match and returns the index in the reservoir
+// which the match replaces (len(reservoir) means append), or -1 if the match
+// is not sampled.
+func (s *sampler) offer() int {
+	s.seen++
+	if s.seen <= s.size {
+		return s.seen - 1
+	}
+	if j := s.rng.Intn(s.seen); j < s.size {
+		return j
+	}
+	return -1
+}
+
+// mergeSamples combines the per-backend reservoirs into one sample of at most
+// size results. Each backend contributes proportionally to the number of
+// matches it returned (largest remainder method), so that the result is a
+// uniform sample of all matches.
+func mergeSamples(perBackend []*perBackendState, size int) []resultPointer {
+	total := 0
+	for _, bstate := range perBackend {
+		total += bstate.sampler.seen
+	}
+	if total <= size {
+		var pointers []resultPointer
+		for _, bstate := range perBackend {
+			pointers = append(pointers, bstate.resultPointers...)
+		}
+		return pointers
+	}
+
+	quotas := make([]int, len(perBackend))
+	remainders := make([]int, len(perBackend))
+	assigned := 0
+	for idx, bstate := range perBackend {
+		quotas[idx] = size * bstate.sampler.seen / total
+		remainders[idx] = size * bstate.sampler.seen % total
+		assigned += quotas[idx]
+	}
+	order := make([]int, len(perBackend))
+	for idx := range order {
+		order[idx] = idx
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return remainders[order[i]] > remainders[order[j]]
+	})
+	for _, idx := range order[:size-assigned] {
+		quotas[idx]++
+	}
+
+	pointers := make([]resultPointer, 0, size)
+	for idx, bstate := range perBackend {
+		reservoir := bstate.resultPointers
+		if quotas[idx] >= len(reservoir) {
+			pointers = append(pointers, reservoir...)
+			continue
+		}
+		for _, i := range bstate.sampler.rng.Perm(len(reservoir))[:quotas[idx]] {
+			pointers = append(pointers, reservoir[i])
+		}
+	}
+	return pointers
+}
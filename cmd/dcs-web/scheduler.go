@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var (
+	maxConcurrentProcessing = flag.Int("max_concurrent_processing",
+		0,
+		"Maximum number of source backend replies and event batches which are processed at the same time, across all queries. Further work waits for a turn, and queries take turns fairly (see -interactive_weight), so that a huge query cannot starve interactive ones. 0 means unlimited")
+
+	interactiveWeight = flag.Int("interactive_weight",
+		4,
+		"Number of turns (see -max_concurrent_processing) an interactive query gets for each turn of a batch query (see the priority= parameter)")
+
+	schedulerWaiting = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "scheduler_waiting_turns",
+			Help: "Number of source backend replies and event batches waiting for a turn (see -max_concurrent_processing).",
+		})
+
+	schedulerWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "scheduler_wait_ms",
+			Help:    "Time source backend replies and event batches waited for a turn (see -max_concurrent_processing) in milliseconds, by query priority.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+		},
+		[]string{"priority"})
+)
+
+func init() {
+	prometheus.MustRegister(schedulerWaiting)
+	prometheus.MustRegister(schedulerWait)
+}
+
+// strideBase is divided by the weight of a query to get its stride, see
+// fairScheduler.
+const strideBase = 1 << 20
+
+// fairScheduler interleaves the work of all running queries: each source
+// backend reply (see queryBackend) and each batch of events sent to a client
+// (see EventsHandler) is one turn. While -max_concurrent_processing turns are
+// in progress, further turns wait and are granted using stride scheduling:
+// each query has a pass, which advances by its stride (inversely proportional
+// to its weight, see queryPriority.schedulingWeight) with every turn, and the
+// waiting query with the lowest pass is served first. Writes to clients are
+// not part of turns, as they block on the client’s connection.
+type fairScheduler struct {
+	mu      sync.Mutex
+	running int
+
+	// vtime is the pass at which the most recent turn was granted. Queries
+	// start at vtime, so that they neither wait for queries which were
+	// served a lot already nor overtake waiting queries.
+	vtime   uint64
+	queries map[string]*scheduledQuery
+}
+
+type scheduledQuery struct {
+	pass   uint64
+	stride uint64
+
+	// turns is the number of waiting and running turns. The query is
+	// forgotten when it reaches 0.
+	turns   int
+	waiting []chan struct{} // FIFO
+}
+
+func newFairScheduler() *fairScheduler {
+	return &fairScheduler{
+		queries: make(map[string]*scheduledQuery),
+	}
+}
+
+var scheduler = newFairScheduler()
+
+func (fs *fairScheduler) availableLocked() bool {
+	return *maxConcurrentProcessing <= 0 || fs.running < *maxConcurrentProcessing
+}
+
+func (fs *fairScheduler) grantLocked(q *scheduledQuery) {
+	fs.running++
+	fs.vtime = q.pass
+	q.pass += q.stride
+}
+
+// dispatchLocked grants turns to waiting queries while slots are available.
+func (fs *fairScheduler) dispatchLocked() {
+	for fs.availableLocked() {
+		var next *scheduledQuery
+		for _, q := range fs.queries {
+			if len(q.waiting) > 0 && (next == nil || q.pass < next.pass) {
+				next = q
+			}
+		}
+		if next == nil {
+			return
+		}
+		ch := next.waiting[0]
+		next.waiting = next.waiting[1:]
+		schedulerWaiting.Dec()
+		fs.grantLocked(next)
+		close(ch)
+	}
+}
+
+func (fs *fairScheduler) forgetLocked(queryid string, q *scheduledQuery) {
+	if q.turns--; q.turns == 0 {
+		delete(fs.queries, queryid)
+	}
+}
+
+// turn blocks until the query may process one unit of work, or until ctx is
+// done. The returned function must be called when the work is done.
+func (fs *fairScheduler) turn(ctx context.Context, queryid string, priority queryPriority) (func(), error) {
+	if *maxConcurrentProcessing <= 0 {
+		return func() {}, nil
+	}
+	release := func() { fs.release(queryid) }
+	fs.mu.Lock()
+	q, ok := fs.queries[queryid]
+	if !ok {
+		q = &scheduledQuery{
+			pass:   fs.vtime,
+			stride: strideBase / uint64(priority.schedulingWeight()),
+		}
+		fs.queries[queryid] = q
+	}
+	q.turns++
+	fs.dispatchLocked()
+	if fs.availableLocked() {
+		// Nobody is waiting (otherwise dispatchLocked would have used the
+		// slot), so the turn can be granted right away.
+		fs.grantLocked(q)
+		fs.mu.Unlock()
+		return release, nil
+	}
+	ch := make(chan struct{})
+	q.waiting = append(q.waiting, ch)
+	schedulerWaiting.Inc()
+	fs.mu.Unlock()
+
+	started := time.Now()
+	defer func() {
+		schedulerWait.WithLabelValues(priority.String()).Observe(float64(time.Since(started) / time.Millisecond))
+	}()
+	select {
+	case <-ch:
+		return release, nil
+	case <-ctx.Done():
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for idx, waiting := range q.waiting {
+		if waiting == ch {
+			q.waiting = append(q.waiting[:idx], q.waiting[idx+1:]...)
+			schedulerWaiting.Dec()
+			fs.forgetLocked(queryid, q)
+			return nil, ctx.Err()
+		}
+	}
+	// The turn was granted in the meantime, so pass it on.
+	fs.running--
+	fs.forgetLocked(queryid, q)
+	fs.dispatchLocked()
+	return nil, ctx.Err()
+}
+
+func (fs *fairScheduler) release(queryid string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.running--
+	fs.forgetLocked(queryid, fs.queries[queryid])
+	fs.dispatchLocked()
+}
+
+// queryTurn waits for a turn of the query (see fairScheduler), scheduled
+// according to the priority the query was started with.
+func queryTurn(ctx context.Context, queryid string) (func(), error) {
+	stateMu.RLock()
+	priority := state[queryid].priority
+	stateMu.RUnlock()
+	return scheduler.turn(ctx, queryid, priority)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// waitForWaiting waits until n turns are waiting in fs.
+func waitForWaiting(t *testing.T, fs *fairScheduler, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		fs.mu.Lock()
+		waiting := 0
+		for _, q := range fs.queries {
+			waiting += len(q.waiting)
+		}
+		fs.mu.Unlock()
+		if waiting == n {
+			return
+		}
+	}
+	t.Fatalf("timeout waiting for %d waiting turns", n)
+}
+
+func TestFairSchedulerWeights(t *testing.T) {
+	oldMax, oldWeight := *maxConcurrentProcessing, *interactiveWeight
+	defer func() { *maxConcurrentProcessing, *interactiveWeight = oldMax, oldWeight }()
+	*maxConcurrentProcessing, *interactiveWeight = 1, 4
+
+	ctx := context.Background()
+	fs := newFairScheduler()
+	release, err := fs.turn(ctx, "huge", priorityBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan string)
+	waiter := func(queryid string, priority queryPriority) {
+		release, err := fs.turn(ctx, queryid, priority)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		order <- queryid
+		release()
+	}
+	for i := 0; i < 8; i++ {
+		go waiter("batch", priorityBatch)
+		go waiter("interactive", priorityInteractive)
+	}
+	waitForWaiting(t, fs, 16)
+	release()
+
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[<-order]++
+	}
+	// The interactive query gets 4 turns for each turn of the batch query.
+	if got, want := counts["interactive"], 8; got != want {
+		t.Errorf("interactive query got %d of the first 10 turns, want %d", got, want)
+	}
+	for i := 0; i < 6; i++ {
+		<-order
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.running != 0 || len(fs.queries) != 0 {
+		t.Errorf("scheduler not idle after all turns: %d running, %d queries", fs.running, len(fs.queries))
+	}
+}
+
+func TestFairSchedulerCancel(t *testing.T) {
+	oldMax := *maxConcurrentProcessing
+	defer func() { *maxConcurrentProcessing = oldMax }()
+	*maxConcurrentProcessing = 1
+
+	fs := newFairScheduler()
+	release, err := fs.turn(context.Background(), "first", priorityInteractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := fs.turn(ctx, "second", priorityInteractive)
+		errc <- err
+	}()
+	waitForWaiting(t, fs, 1)
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("turn() = %v, want %v", err, context.Canceled)
+	}
+	release()
+
+	// The cancelled turn did not take the slot.
+	release, err = fs.turn(context.Background(), "third", priorityInteractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
@@ -0,0 +1,264 @@
+// vim:ts=4:sw=4:noexpandtab
+package search
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+// FilterSyntaxError is returned by ParseFilter for invalid filter expressions.
+type FilterSyntaxError struct {
+	// Offset is the byte offset within the filter expression at which the
+	// error was detected.
+	Offset int
+	Reason string
+}
+
+func (e *FilterSyntaxError) Error() string {
+	return fmt.Sprintf("invalid filter at offset %d: %s", e.Offset, e.Reason)
+}
+
+// Filter is a parsed filter= expression, which dcs-web evaluates for each
+// result (post-filtering) instead of sending it to the source backends.
+//
+// The grammar is:
+//
+//	expr       = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" expr ")" | comparison
+//	comparison = field ( "==" | "!=" | "~" | "!~" ) string
+//	field      = "path" | "pkg" | "package" | "context" | "license"
+//
+// Strings are enclosed in double quotes. Within strings, \" and \\ are
+// escapes for " and \, all other backslashes are taken literally so that
+// regular expressions can be written naturally, e.g. path~"\.h$". The “~”
+// and “!~” operators match (do not match) the field against a regular
+// expression (RE2 syntax).
+type Filter struct {
+	expr filterExpr
+}
+
+// Matches reports whether the result satisfies the filter.
+func (f *Filter) Matches(m *sourcebackendpb.Match) bool {
+	return f.expr.eval(m)
+}
+
+type filterExpr interface {
+	eval(m *sourcebackendpb.Match) bool
+}
+
+type filterOr struct{ left, right filterExpr }
+
+func (e filterOr) eval(m *sourcebackendpb.Match) bool { return e.left.eval(m) || e.right.eval(m) }
+
+type filterAnd struct{ left, right filterExpr }
+
+func (e filterAnd) eval(m *sourcebackendpb.Match) bool { return e.left.eval(m) && e.right.eval(m) }
+
+type filterNot struct{ expr filterExpr }
+
+func (e filterNot) eval(m *sourcebackendpb.Match) bool { return !e.expr.eval(m) }
+
+type filterComparison struct {
+	field  string
+	op     string
+	value  string
+	regexp *regexp.Regexp
+}
+
+func (e filterComparison) eval(m *sourcebackendpb.Match) bool {
+	var val string
+	switch e.field {
+	case "path":
+		val = m.Path
+	case "package":
+		val = m.Package
+	case "context":
+		// Matches contain HTML-escaped lines.
+		val = html.UnescapeString(m.Context)
+	case "license":
+		val = m.License
+	}
+	switch e.op {
+	case "==":
+		return val == e.value
+	case "!=":
+		return val != e.value
+	case "~":
+		return e.regexp.MatchString(val)
+	default: // "!~"
+		return !e.regexp.MatchString(val)
+	}
+}
+
+type filterParser struct {
+	s   string
+	pos int
+}
+
+func (p *filterParser) errorf(offset int, format string, args ...interface{}) error {
+	return &FilterSyntaxError{
+		Offset: offset,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+func (p *filterParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// consume skips whitespace and then tok, if present.
+func (p *filterParser) consume(tok string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.s[p.pos:], tok) {
+		p.pos += len(tok)
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expr() (filterExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.consume("||") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) and() (filterExpr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.consume("&&") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) unary() (filterExpr, error) {
+	if p.consume("!") {
+		expr, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{expr}, nil
+	}
+	if p.consume("(") {
+		start := p.pos - 1
+		expr, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(")") {
+			return nil, p.errorf(start, "unbalanced parenthesis")
+		}
+		return expr, nil
+	}
+	return p.comparison()
+}
+
+func (p *filterParser) comparison() (filterExpr, error) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) && (p.s[p.pos] >= 'a' && p.s[p.pos] <= 'z') {
+		p.pos++
+	}
+	field := p.s[start:p.pos]
+	switch field {
+	case "path", "package", "context", "license":
+	case "pkg":
+		field = "package"
+	case "":
+		return nil, p.errorf(start, "expected field name")
+	default:
+		return nil, p.errorf(start, "unknown field %q (expected path, pkg, context or license)", field)
+	}
+
+	var cmp filterComparison
+	cmp.field = field
+	p.skipSpace()
+	for _, op := range []string{"==", "!=", "!~", "~"} {
+		if strings.HasPrefix(p.s[p.pos:], op) {
+			cmp.op = op
+			p.pos += len(op)
+			break
+		}
+	}
+	if cmp.op == "" {
+		return nil, p.errorf(p.pos, "expected one of ==, !=, ~ or !~")
+	}
+
+	p.skipSpace()
+	if p.pos >= len(p.s) || p.s[p.pos] != '"' {
+		return nil, p.errorf(p.pos, "expected string")
+	}
+	valueStart := p.pos
+	p.pos++
+	var value strings.Builder
+	for {
+		if p.pos >= len(p.s) {
+			return nil, p.errorf(valueStart, "unterminated string")
+		}
+		c := p.s[p.pos]
+		if c == '"' {
+			p.pos++
+			break
+		}
+		if c == '\\' && p.pos+1 < len(p.s) && (p.s[p.pos+1] == '"' || p.s[p.pos+1] == '\\') {
+			p.pos++
+			c = p.s[p.pos]
+		}
+		value.WriteByte(c)
+		p.pos++
+	}
+	cmp.value = value.String()
+
+	if cmp.op == "~" || cmp.op == "!~" {
+		re, err := regexp.Compile(cmp.value)
+		if err != nil {
+			return nil, p.errorf(valueStart, "%v", err)
+		}
+		cmp.regexp = re
+	}
+	return cmp, nil
+}
+
+var filterStringQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// QuoteFilterString returns s as a string of a filter= expression, e.g. for
+// constructing filter expressions from user input.
+func QuoteFilterString(s string) string {
+	return `"` + filterStringQuoter.Replace(s) + `"`
+}
+
+// ParseFilter parses a filter= expression, see Filter.
+func ParseFilter(s string) (*Filter, error) {
+	p := filterParser{s: s}
+	expr, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return nil, p.errorf(p.pos, "unexpected %q", p.s[p.pos:])
+	}
+	return &Filter{expr: expr}, nil
+}
@@ -0,0 +1,87 @@
+// vim:ts=4:sw=4:noexpandtab
+package search
+
+import (
+	"testing"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+func TestFilter(t *testing.T) {
+	header := &sourcebackendpb.Match{
+		Path:    "linux_4.19.20/include/linux/kernel.h",
+		Package: "linux",
+		Context: "#define min(x, y) (x &lt; y ? x : y)",
+	}
+	source := &sourcebackendpb.Match{
+		Path:    "i3-wm_4.16/src/main.c",
+		Package: "i3-wm",
+		Context: "int main(int argc, char *argv[]) {",
+	}
+	for _, tt := range []struct {
+		filter         string
+		header, source bool
+	}{
+		{`path~"\.h$"`, true, false},
+		{`path~"\.h$" && pkg!="linux"`, false, false},
+		{`pkg=="linux" || pkg == "i3-wm"`, true, true},
+		{`!(package == "linux")`, false, true},
+		{`path !~ "^linux_"`, false, true},
+		{`context~"x < y"`, true, false},
+		{`context~"\"" || pkg=="i3-wm" && path~"\\.c$"`, false, true},
+	} {
+		t.Run(tt.filter, func(t *testing.T) {
+			f, err := ParseFilter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Matches(header); got != tt.header {
+				t.Errorf("Matches(header) = %v, want %v", got, tt.header)
+			}
+			if got := f.Matches(source); got != tt.source {
+				t.Errorf("Matches(source) = %v, want %v", got, tt.source)
+			}
+		})
+	}
+}
+
+func TestFilterSyntaxError(t *testing.T) {
+	for _, tt := range []struct {
+		filter string
+		offset int
+	}{
+		{``, 0},
+		{`file=="foo"`, 0},
+		{`path="foo"`, 4},
+		{`path==foo`, 6},
+		{`path=="foo`, 6},
+		{`(path=="foo"`, 0},
+		{`path~"("`, 5},
+		{`path=="foo" pkg=="bar"`, 12},
+	} {
+		t.Run(tt.filter, func(t *testing.T) {
+			_, err := ParseFilter(tt.filter)
+			serr, ok := err.(*FilterSyntaxError)
+			if !ok {
+				t.Fatalf("ParseFilter(%q) = %v, want *FilterSyntaxError", tt.filter, err)
+			}
+			if serr.Offset != tt.offset {
+				t.Fatalf("ParseFilter(%q) = %v, want offset %d", tt.filter, err, tt.offset)
+			}
+		})
+	}
+}
+
+func TestQuoteFilterString(t *testing.T) {
+	for _, s := range []string{`foo`, `a"b`, `\.h$`, `\\`, `x\"y`, `trailing\`} {
+		t.Run(s, func(t *testing.T) {
+			f, err := ParseFilter(`path==` + QuoteFilterString(s))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !f.Matches(&sourcebackendpb.Match{Path: s}) {
+				t.Errorf("filter for %q does not match %q", s, s)
+			}
+		})
+	}
+}
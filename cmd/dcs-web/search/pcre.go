@@ -0,0 +1,484 @@
+// vim:ts=4:sw=4:noexpandtab
+package search
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// UnsupportedSyntaxError is returned by RewritePCRE for PCRE constructs (as
+// commonly pasted from grep -P) which our regular expression engine does not
+// support and which cannot be rewritten into an equivalent query.
+type UnsupportedSyntaxError struct {
+	// Construct is the offending part of the query, e.g. “(?>” or “\1”.
+	Construct string
+	// Offset is the byte offset of Construct within the query.
+	Offset int
+	// Reason explains why Construct is not supported.
+	Reason string
+}
+
+func (e *UnsupportedSyntaxError) Error() string {
+	return fmt.Sprintf("unsupported regular expression syntax %q at offset %d: %s", e.Construct, e.Offset, e.Reason)
+}
+
+// PCRERewrite is the result of RewritePCRE.
+type PCRERewrite struct {
+	// Pattern is the regular expression which is searched for.
+	Pattern string
+
+	// LineMatch contains regular expressions which every matching line must
+	// also match (lookahead= parameter).
+	LineMatch []string
+
+	// NLineMatch contains regular expressions which no matching line may
+	// match (nlookahead= parameter).
+	NLineMatch []string
+}
+
+const (
+	lookahead          = "(?="
+	negativeLookahead  = "(?!"
+	lookbehind         = "(?<="
+	negativeLookbehind = "(?<!"
+)
+
+type pcreToken struct {
+	text   string
+	offset int
+
+	// lookaround is set to one of the constants above for lookaround
+	// groups, whose contents are stored in body.
+	lookaround string
+	body       string
+}
+
+var repetitionRe = regexp.MustCompile(`^\{\d+(?:,\d*)?\}`)
+
+type pcreScanner struct {
+	p       string
+	pos     int
+	changed bool
+}
+
+func (s *pcreScanner) unsupported(construct string, offset int, reason string) error {
+	return &UnsupportedSyntaxError{
+		Construct: construct,
+		Offset:    offset,
+		Reason:    reason,
+	}
+}
+
+// escape scans the escape sequence at s.pos, returning its (possibly
+// rewritten) text.
+func (s *pcreScanner) escape(inClass bool) (string, error) {
+	start := s.pos
+	if s.pos+1 >= len(s.p) {
+		s.pos = len(s.p)
+		return s.p[start:], nil
+	}
+	c := s.p[s.pos+1]
+	switch {
+	case c == 'Q':
+		end := strings.Index(s.p[s.pos:], `\E`)
+		if end == -1 {
+			s.pos = len(s.p)
+		} else {
+			s.pos += end + 2
+		}
+		return s.p[start:s.pos], nil
+
+	case c == 'x' || c == 'p' || c == 'P':
+		s.pos += 2
+		if s.pos < len(s.p) && s.p[s.pos] == '{' {
+			if end := strings.IndexByte(s.p[s.pos:], '}'); end != -1 {
+				s.pos += end + 1
+			}
+		} else if c == 'x' {
+			for i := 0; i < 2 && s.pos < len(s.p); i++ {
+				s.pos++
+			}
+		} else if s.pos < len(s.p) {
+			s.pos++
+		}
+		return s.p[start:s.pos], nil
+
+	case c >= '1' && c <= '9' && (s.pos+2 >= len(s.p) || s.p[s.pos+2] < '0' || s.p[s.pos+2] > '9'),
+		c == 'k', c == 'g':
+		s.pos += 2
+		return "", s.unsupported(s.p[start:s.pos], start, "backreferences cannot be matched using finite automata")
+
+	case c == 'K', c == 'G', c == 'R', c == 'X':
+		s.pos += 2
+		return "", s.unsupported(s.p[start:s.pos], start, "this escape sequence is specific to PCRE")
+
+	case c == 'h' || c == 'H':
+		s.pos += 2
+		s.changed = true
+		if inClass {
+			if c == 'H' {
+				return "", s.unsupported(s.p[start:s.pos], start, `\H cannot be used in a character class`)
+			}
+			return `\t `, nil
+		}
+		if c == 'H' {
+			return `[^\t ]`, nil
+		}
+		return `[\t ]`, nil
+
+	case c == 'e':
+		s.pos += 2
+		s.changed = true
+		return `\x1b`, nil
+
+	case c == 'Z' && !inClass:
+		// Lines never contain a newline, so \Z is equivalent to \z.
+		s.pos += 2
+		s.changed = true
+		return `\z`, nil
+	}
+	_, size := utf8.DecodeRuneInString(s.p[s.pos+1:])
+	s.pos += 1 + size
+	return s.p[start:s.pos], nil
+}
+
+// class scans the character class starting at s.pos.
+func (s *pcreScanner) class() (string, error) {
+	var b strings.Builder
+	b.WriteByte('[')
+	s.pos++
+	if s.pos < len(s.p) && s.p[s.pos] == '^' {
+		b.WriteByte('^')
+		s.pos++
+	}
+	// A ] right at the beginning is a literal.
+	if s.pos < len(s.p) && s.p[s.pos] == ']' {
+		b.WriteByte(']')
+		s.pos++
+	}
+	for s.pos < len(s.p) {
+		switch {
+		case s.p[s.pos] == ']':
+			s.pos++
+			b.WriteByte(']')
+			return b.String(), nil
+		case s.p[s.pos] == '\\':
+			text, err := s.escape(true)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(text)
+		case strings.HasPrefix(s.p[s.pos:], "[:"):
+			end := strings.Index(s.p[s.pos:], ":]")
+			if end == -1 {
+				end = 0
+			}
+			b.WriteString(s.p[s.pos : s.pos+end+2])
+			s.pos += end + 2
+		default:
+			b.WriteByte(s.p[s.pos])
+			s.pos++
+		}
+	}
+	return b.String(), nil
+}
+
+// group scans the group starting at s.pos.
+func (s *pcreScanner) group() (pcreToken, error) {
+	start := s.pos
+	rest := s.p[s.pos:]
+	tok := pcreToken{offset: start}
+	var prefix string
+	switch {
+	case strings.HasPrefix(rest, lookahead), strings.HasPrefix(rest, negativeLookahead),
+		strings.HasPrefix(rest, lookbehind), strings.HasPrefix(rest, negativeLookbehind):
+		tok.lookaround = rest[:3]
+		if rest[2] == '<' {
+			tok.lookaround = rest[:4]
+		}
+		prefix = tok.lookaround
+
+	case strings.HasPrefix(rest, "(?#"):
+		end := strings.IndexByte(rest, ')')
+		if end == -1 {
+			return tok, s.unsupported(rest, start, "unterminated comment")
+		}
+		s.pos += end + 1
+		s.changed = true
+		return tok, nil
+
+	case strings.HasPrefix(rest, "(?>"):
+		return tok, s.unsupported("(?>", start, "atomic groups are specific to PCRE")
+
+	case strings.HasPrefix(rest, "(?|"):
+		return tok, s.unsupported("(?|", start, "branch reset groups are specific to PCRE")
+
+	case strings.HasPrefix(rest, "(?("):
+		return tok, s.unsupported("(?(", start, "conditional groups are specific to PCRE")
+
+	case strings.HasPrefix(rest, "(?P=") || strings.HasPrefix(rest, "(?P>") ||
+		strings.HasPrefix(rest, "(?&") || strings.HasPrefix(rest, "(?R") ||
+		(len(rest) > 2 && strings.HasPrefix(rest, "(?") && (rest[2] >= '0' && rest[2] <= '9' || rest[2] == '+' || rest[2] == '-' && len(rest) > 3 && rest[3] >= '0' && rest[3] <= '9')):
+		return tok, s.unsupported(rest[:3], start, "backreferences and recursion cannot be matched using finite automata")
+
+	case strings.HasPrefix(rest, "(?<") || strings.HasPrefix(rest, "(?'"):
+		// Named group: (?<name>…) or (?'name'…) → (?P<name>…)
+		term := byte('>')
+		if rest[2] == '\'' {
+			term = '\''
+		}
+		end := strings.IndexByte(rest[3:], term)
+		if end == -1 {
+			return tok, s.unsupported(rest[:3], start, "unterminated group name")
+		}
+		prefix = "(?P<" + rest[3:3+end] + ">"
+		s.pos += 3 + end + 1
+		s.changed = true
+
+	case strings.HasPrefix(rest, "(?"):
+		// (?:…), (?P<name>…), (?flags) or (?flags:…), all supported.
+		end := strings.IndexAny(rest[2:], ":)>")
+		if end == -1 {
+			return tok, s.unsupported(rest, start, "unterminated group")
+		}
+		prefix = rest[:2+end+1]
+		if rest[2+end] == ')' {
+			s.pos += len(prefix)
+			tok.text = prefix
+			return tok, nil
+		}
+
+	default:
+		prefix = "("
+	}
+	if s.pos == start {
+		s.pos += len(prefix)
+	}
+
+	var body strings.Builder
+	for {
+		if s.pos >= len(s.p) {
+			return tok, s.unsupported(s.p[start:], start, "missing closing )")
+		}
+		if s.p[s.pos] == ')' {
+			s.pos++
+			break
+		}
+		inner, err := s.token()
+		if err != nil {
+			return tok, err
+		}
+		if inner.lookaround != "" {
+			return tok, s.unsupported(inner.lookaround, inner.offset, "lookarounds can only be rewritten at the beginning or end of the query, not within a group")
+		}
+		body.WriteString(inner.text)
+	}
+	tok.body = body.String()
+	tok.text = prefix + tok.body + ")"
+	return tok, nil
+}
+
+func (s *pcreScanner) token() (pcreToken, error) {
+	start := s.pos
+	switch c := s.p[s.pos]; c {
+	case '\\':
+		text, err := s.escape(false)
+		return pcreToken{text: text, offset: start}, err
+	case '[':
+		text, err := s.class()
+		return pcreToken{text: text, offset: start}, err
+	case '(':
+		return s.group()
+	case '*', '+', '?':
+		s.pos++
+	case '{':
+		if m := repetitionRe.FindString(s.p[s.pos:]); m != "" {
+			s.pos += len(m)
+		} else {
+			s.pos++
+			return pcreToken{text: "{", offset: start}, nil
+		}
+	default:
+		_, size := utf8.DecodeRuneInString(s.p[s.pos:])
+		s.pos += size
+		return pcreToken{text: s.p[start:s.pos], offset: start}, nil
+	}
+	// Quantifiers: a ? suffix makes them lazy (supported), a + suffix
+	// possessive (not supported).
+	if s.pos < len(s.p) {
+		switch s.p[s.pos] {
+		case '?':
+			s.pos++
+		case '+':
+			return pcreToken{}, s.unsupported(s.p[start:s.pos+1], start, "possessive quantifiers are specific to PCRE")
+		}
+	}
+	return pcreToken{text: s.p[start:s.pos], offset: start}, nil
+}
+
+// negateAtom returns a character class matching every character which the
+// single-character pattern atom does not match, or false if atom is not a
+// single character, escape sequence or character class.
+func negateAtom(atom string) (string, bool) {
+	switch {
+	case strings.HasPrefix(atom, "[^") && strings.HasSuffix(atom, "]"):
+		return "[" + atom[2:], true
+	case strings.HasPrefix(atom, "[") && strings.HasSuffix(atom, "]"):
+		return "[^" + atom[1:], true
+	case len(atom) == 2 && atom[0] == '\\':
+		switch c := atom[1]; c {
+		case 'd', 'D', 'w', 'W', 's', 'S':
+			return `\` + string(c^0x20), true
+		}
+		if (atom[1] < 'a' || atom[1] > 'z') && (atom[1] < 'A' || atom[1] > 'Z') && (atom[1] < '0' || atom[1] > '9') {
+			return `[^` + atom + `]`, true
+		}
+	case utf8.RuneCountInString(atom) == 1 && !strings.ContainsAny(atom, `.^$|()[]{}*+?\`):
+		return `[^` + atom + `]`, true
+	}
+	return "", false
+}
+
+func concat(toks []pcreToken) string {
+	var b strings.Builder
+	for _, tok := range toks {
+		b.WriteString(tok.text)
+	}
+	return b.String()
+}
+
+// RewritePCRE rewrites PCRE-specific syntax in the query pattern q into
+// syntax which our regular expression engine supports:
+//
+//   - named groups (?<name>…) and (?'name'…) become (?P<name>…)
+//   - comments (?#…) are removed
+//   - \h, \H, \e and \Z are replaced with equivalents
+//   - lookaheads at the beginning of the pattern, e.g. ^(?=.*foo)(?!.*bar)baz,
+//     become additional patterns which matching lines must (LineMatch) or must
+//     not (NLineMatch) match
+//   - a positive lookahead at the end of the pattern and a positive lookbehind
+//     at its beginning are matched as part of the pattern, negative ones are
+//     rewritten if they consist of a single character (class)
+//
+// All other PCRE-specific constructs (e.g. backreferences or atomic groups)
+// result in an *UnsupportedSyntaxError.
+func RewritePCRE(q string) (PCRERewrite, error) {
+	s := &pcreScanner{p: q}
+	var toks []pcreToken
+	hasLookaround := false
+	for s.pos < len(s.p) {
+		tok, err := s.token()
+		if err != nil {
+			return PCRERewrite{}, err
+		}
+		if tok.text == "" {
+			continue // removed comment
+		}
+		if tok.lookaround != "" {
+			hasLookaround = true
+		}
+		toks = append(toks, tok)
+	}
+	if !hasLookaround {
+		if !s.changed {
+			return PCRERewrite{Pattern: q}, nil
+		}
+		return PCRERewrite{Pattern: concat(toks)}, nil
+	}
+
+	for _, tok := range toks {
+		if tok.text == "|" {
+			return PCRERewrite{}, s.unsupported("|", tok.offset, "lookarounds cannot be rewritten in queries containing top-level alternatives")
+		}
+	}
+
+	var rewrite PCRERewrite
+
+	// Leading lookbehind: “preceded by” at the start of the match is the same
+	// as matching the preceding text, too.
+	if first := toks[0]; first.lookaround == lookbehind || first.lookaround == negativeLookbehind {
+		if first.lookaround == lookbehind {
+			toks[0].text = "(?:" + first.body + ")"
+		} else if negated, ok := negateAtom(first.body); ok {
+			toks[0].text = "(?:^|" + negated + ")"
+		} else {
+			return PCRERewrite{}, s.unsupported(first.lookaround, first.offset, "negative lookbehinds can only be rewritten if they consist of a single character or character class")
+		}
+		toks[0].lookaround = ""
+	}
+
+	// Trailing lookahead: “followed by” at the end of the match is the same
+	// as matching the following text, too.
+	if last := toks[len(toks)-1]; len(toks) > 1 && (last.lookaround == lookahead || last.lookaround == negativeLookahead) {
+		prev := toks[len(toks)-2]
+		if prev.lookaround == "" && prev.text != "^" {
+			if last.lookaround == lookahead {
+				toks[len(toks)-1].text = "(?:" + last.body + ")"
+			} else if negated, ok := negateAtom(last.body); ok {
+				toks[len(toks)-1].text = "(?:" + negated + "|$)"
+			} else {
+				return PCRERewrite{}, s.unsupported(last.lookaround, last.offset, "negative lookaheads at the end of the query can only be rewritten if they consist of a single character or character class")
+			}
+			toks[len(toks)-1].lookaround = ""
+		}
+	}
+
+	// Leading lookaheads, optionally anchored using ^.
+	idx := 0
+	anchored := toks[0].text == "^"
+	if anchored {
+		idx++
+	}
+	var leading []pcreToken
+	for idx < len(toks) && (toks[idx].lookaround == lookahead || toks[idx].lookaround == negativeLookahead) {
+		leading = append(leading, toks[idx])
+		idx++
+	}
+	rest := toks[idx:]
+	for _, tok := range rest {
+		if tok.lookaround != "" {
+			return PCRERewrite{}, s.unsupported(tok.lookaround, tok.offset, "lookarounds can only be rewritten at the beginning or end of the query")
+		}
+	}
+	restPattern := concat(rest)
+	if len(leading) > 0 && !anchored {
+		// Without ^, the lookaheads apply at the position where the rest of
+		// the pattern matches. That is equivalent to applying them at the
+		// beginning of the line only if they all start with .* (as does the
+		// rest of the pattern, if any).
+		anchored = restPattern == "" || strings.HasPrefix(restPattern, ".*")
+		for _, tok := range leading {
+			if !strings.HasPrefix(tok.body, ".*") {
+				anchored = false
+			}
+		}
+		if !anchored {
+			return PCRERewrite{}, s.unsupported(leading[0].lookaround, leading[0].offset, "lookaheads at the beginning of the query can only be rewritten if the query starts with ^ or all lookaheads start with .*")
+		}
+		restPattern = strings.TrimPrefix(strings.TrimPrefix(restPattern, ".*"), "?")
+	} else if anchored && restPattern != "" {
+		restPattern = "^" + restPattern
+	}
+	for _, tok := range leading {
+		pattern := "^(?:" + tok.body + ")"
+		if strings.HasPrefix(tok.body, ".*") {
+			pattern = strings.TrimPrefix(strings.TrimPrefix(tok.body, ".*"), "?")
+		}
+		if tok.lookaround == lookahead {
+			rewrite.LineMatch = append(rewrite.LineMatch, pattern)
+		} else {
+			rewrite.NLineMatch = append(rewrite.NLineMatch, pattern)
+		}
+	}
+	rewrite.Pattern = restPattern
+	if rewrite.Pattern == "" || rewrite.Pattern == "^" {
+		if len(rewrite.LineMatch) == 0 {
+			return PCRERewrite{}, s.unsupported(leading[0].lookaround, leading[0].offset, "queries consisting only of negative lookaheads cannot be searched for")
+		}
+		rewrite.Pattern = rewrite.LineMatch[0]
+		rewrite.LineMatch = rewrite.LineMatch[1:]
+	}
+	return rewrite, nil
+}
@@ -0,0 +1,78 @@
+// vim:ts=4:sw=4:noexpandtab
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRewritePCRE(t *testing.T) {
+	for _, tt := range []struct {
+		query string
+		want  PCRERewrite
+	}{
+		{`searchterm`, PCRERewrite{Pattern: `searchterm`}},
+		{`fo[o\]]+(?:bar)?\Qa(?=b\E`, PCRERewrite{Pattern: `fo[o\]]+(?:bar)?\Qa(?=b\E`}},
+		{`(?<year>\d{4})-(?'month'\d\d)`, PCRERewrite{Pattern: `(?P<year>\d{4})-(?P<month>\d\d)`}},
+		{`foo(?# comment )\hbar\Z`, PCRERewrite{Pattern: `foo[\t ]bar\z`}},
+		{`^(?=.*foo)(?=.*bar)`, PCRERewrite{
+			Pattern:   `foo`,
+			LineMatch: []string{`bar`},
+		}},
+		{`^(?!.*test).*TODO`, PCRERewrite{
+			Pattern:    `^.*TODO`,
+			NLineMatch: []string{`test`},
+		}},
+		{`(?=.*foo)(?!.*bar).*baz`, PCRERewrite{
+			Pattern:    `baz`,
+			LineMatch:  []string{`foo`},
+			NLineMatch: []string{`bar`},
+		}},
+		{`^(?!#)include`, PCRERewrite{
+			Pattern:    `^include`,
+			NLineMatch: []string{`^(?:#)`},
+		}},
+		{`malloc(?=\()`, PCRERewrite{Pattern: `malloc(?:\()`}},
+		{`foo(?![a-z_])`, PCRERewrite{Pattern: `foo(?:[^a-z_]|$)`}},
+		{`(?<=struct )foo`, PCRERewrite{Pattern: `(?:struct )foo`}},
+		{`(?<!\w)foo`, PCRERewrite{Pattern: `(?:^|\W)foo`}},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := RewritePCRE(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("RewritePCRE(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewritePCREUnsupported(t *testing.T) {
+	for _, tt := range []struct {
+		query     string
+		construct string
+		offset    int
+	}{
+		{`(foo)\1`, `\1`, 5},
+		{`a(?>bc|b)c`, `(?>`, 1},
+		{`a++`, `++`, 1},
+		{`foo(?!bar)`, `(?!`, 3},
+		{`foo(?=bar)baz`, `(?=`, 3},
+		{`(a(?=b))`, `(?=`, 2},
+		{`^(?!.*foo)`, `(?!`, 1},
+		{`foo|(?=bar)`, `|`, 3},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := RewritePCRE(tt.query)
+			uerr, ok := err.(*UnsupportedSyntaxError)
+			if !ok {
+				t.Fatalf("RewritePCRE(%q) = %v, want *UnsupportedSyntaxError", tt.query, err)
+			}
+			if uerr.Construct != tt.construct || uerr.Offset != tt.offset {
+				t.Fatalf("RewritePCRE(%q) = %q at %d, want %q at %d", tt.query, uerr.Construct, uerr.Offset, tt.construct, tt.offset)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+// vim:ts=4:sw=4:noexpandtab
+package search
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"strings"
+	"time"
+
+	"github.com/Debian/dcs/internal/ident"
+	"github.com/Debian/dcs/internal/sizefilter"
+)
+
+// QuerySyntaxError is returned by ParseQuery for invalid queries.
+type QuerySyntaxError struct {
+	// Offset is the byte offset within the query at which the error was
+	// detected.
+	Offset int
+	// Length is the length in bytes of the offending part of the query, if
+	// known.
+	Length int `json:",omitempty"`
+	Reason string
+}
+
+func (e *QuerySyntaxError) Error() string {
+	return fmt.Sprintf("invalid query at offset %d: %s", e.Offset, e.Reason)
+}
+
+// A keyword describes a filter atom such as “filetype:c”. The filter is
+// passed to the source backends as URL parameter name (or "n"+name for
+// negated atoms, e.g. “-filetype:c”).
+type keyword struct {
+	name    string
+	aliases []string
+
+	// negatable is set if the keyword can be prefixed with “-”.
+	negatable bool
+
+	// lowercase is set if values are case-insensitive.
+	lowercase bool
+
+	// validate, if non-nil, returns an error describing why value is
+	// invalid.
+	validate func(value string) error
+}
+
+// validateRegexp checks values which the source backends use as regular
+// expressions.
+func validateRegexp(value string) error {
+	_, err := syntax.Parse(value, syntax.Perl)
+	return err
+}
+
+// keywords lists all filter atoms. To add a filter atom, add an entry here
+// and handle its URL parameter in the source backends (or, for keywords which
+// only need package metadata, in dcs-web’s metadataFilter).
+var keywords = []keyword{
+	{name: "filetype", negatable: true, lowercase: true},
+	{name: "package", aliases: []string{"pkg"}, negatable: true, validate: validateRegexp},
+	{name: "path", aliases: []string{"file"}, negatable: true, validate: validateRegexp},
+	{name: "license", negatable: true, validate: validateRegexp},
+	{name: "binpkg", negatable: true, validate: validateRegexp},
+	{name: "maintainer", negatable: true, validate: validateRegexp},
+	{name: "description", negatable: true, validate: validateRegexp},
+	{
+		// ident: searches for an identifier instead of a pattern, see
+		// RewriteQuery.
+		name: "ident",
+		validate: func(value string) error {
+			if !ident.Valid(value) {
+				return fmt.Errorf("%q is not an identifier (letters, digits and underscores, not starting with a digit)", value)
+			}
+			return nil
+		},
+	},
+	{
+		name: "include",
+		validate: func(value string) error {
+			if value != "generated" {
+				return fmt.Errorf("unknown value %q (expected generated)", value)
+			}
+			return nil
+		},
+	},
+	{
+		// encoding: restricts the search to files which are UTF-8 or not
+		// (latin1), or matches files which are not UTF-8 without
+		// converting them (raw).
+		name:      "encoding",
+		lowercase: true,
+		validate: func(value string) error {
+			switch value {
+			case "utf8", "latin1", "raw":
+				return nil
+			}
+			return fmt.Errorf("unknown value %q (expected utf8, latin1 or raw)", value)
+		},
+	},
+	{
+		// size: restricts the search to files of the given size, e.g.
+		// size:<10k (see sizefilter.Filter).
+		name: "size",
+		validate: func(value string) error {
+			_, err := sizefilter.Parse(value)
+			return err
+		},
+	},
+	{
+		name: "snapshot",
+		validate: func(value string) error {
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				return fmt.Errorf("invalid date %q (expected e.g. 2015-06-01)", value)
+			}
+			return nil
+		},
+	},
+}
+
+func lookupKeyword(name string) *keyword {
+	name = strings.ToLower(name)
+	for idx, kw := range keywords {
+		if kw.name == name {
+			return &keywords[idx]
+		}
+		for _, alias := range kw.aliases {
+			if alias == name {
+				return &keywords[idx]
+			}
+		}
+	}
+	return nil
+}
+
+// FilterAtom is a filter such as “filetype:c” or “-pkg:linux”.
+type FilterAtom struct {
+	// Keyword is the canonical keyword name, e.g. “package” for “pkg:”.
+	Keyword string
+	Negated bool
+	Value   string
+	// Offset is the byte offset of the atom within the query.
+	Offset int
+}
+
+// Param returns the URL parameter name which the source backends use for the
+// atom, e.g. “npackage” for “-pkg:linux”.
+func (a *FilterAtom) Param() string {
+	if a.Negated {
+		return "n" + a.Keyword
+	}
+	return a.Keyword
+}
+
+// Query is the syntax tree of a query (q= parameter): filter atoms at the
+// beginning and end of the query, and the search pattern in between. Filter
+// atoms within the pattern are part of the pattern, so that e.g. “foo
+// path:bar” can be searched for by adding a search term after it.
+type Query struct {
+	// Pattern is the search pattern, with the whitespace within it
+	// preserved.
+	Pattern string
+	// PatternOffset is the byte offset of Pattern within the query.
+	PatternOffset int
+
+	Filters []FilterAtom
+}
+
+type queryWord struct {
+	text       string
+	start, end int
+}
+
+func isQuerySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func splitQueryWords(q string) []queryWord {
+	var words []queryWord
+	for i := 0; i < len(q); {
+		if isQuerySpace(q[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(q) && !isQuerySpace(q[i]) {
+			i++
+		}
+		words = append(words, queryWord{q[start:i], start, i})
+	}
+	return words
+}
+
+// parseAtom parses w as a filter atom. It returns nil (and no error) if w is
+// not a filter atom, in which case it is part of the pattern.
+func parseAtom(w queryWord) (*FilterAtom, error) {
+	idx := strings.Index(w.text, ":")
+	if idx == -1 {
+		return nil, nil
+	}
+	name := w.text[:idx]
+	negated := strings.HasPrefix(name, "-")
+	if negated {
+		name = name[1:]
+	}
+	kw := lookupKeyword(name)
+	if kw == nil {
+		return nil, nil
+	}
+	value := w.text[idx+1:]
+	valueOffset := w.start + idx + 1
+	if value == "" {
+		return nil, &QuerySyntaxError{
+			Offset: w.start,
+			Length: len(w.text),
+			Reason: fmt.Sprintf("missing value for %s:", name),
+		}
+	}
+	if negated && !kw.negatable {
+		return nil, &QuerySyntaxError{
+			Offset: w.start,
+			Length: len(w.text),
+			Reason: fmt.Sprintf("%s: cannot be negated", name),
+		}
+	}
+	if kw.lowercase {
+		value = strings.ToLower(value)
+	}
+	if kw.validate != nil {
+		if err := kw.validate(value); err != nil {
+			return nil, &QuerySyntaxError{
+				Offset: valueOffset,
+				Length: len(value),
+				Reason: fmt.Sprintf("%s: %v", name, err),
+			}
+		}
+	}
+	return &FilterAtom{
+		Keyword: kw.name,
+		Negated: negated,
+		Value:   value,
+		Offset:  w.start,
+	}, nil
+}
+
+// ParseQuery parses the query (q= parameter) into filter atoms and the search
+// pattern. Filter atoms are recognized at the beginning and end of the query
+// only.
+func ParseQuery(q string) (*Query, error) {
+	words := splitQueryWords(q)
+	var leading, trailing []FilterAtom
+	lo, hi := 0, len(words)
+	for lo < hi {
+		atom, err := parseAtom(words[lo])
+		if err != nil {
+			return nil, err
+		}
+		if atom == nil {
+			break
+		}
+		leading = append(leading, *atom)
+		lo++
+	}
+	for hi > lo {
+		atom, err := parseAtom(words[hi-1])
+		if err != nil {
+			return nil, err
+		}
+		if atom == nil {
+			break
+		}
+		trailing = append([]FilterAtom{*atom}, trailing...)
+		hi--
+	}
+	filters := append(leading, trailing...)
+	var identAtom *FilterAtom
+	for idx, atom := range filters {
+		if atom.Keyword != "ident" {
+			continue
+		}
+		if identAtom != nil {
+			return nil, &QuerySyntaxError{
+				Offset: atom.Offset,
+				Length: len("ident:") + len(atom.Value),
+				Reason: "only one ident: can be specified",
+			}
+		}
+		identAtom = &filters[idx]
+	}
+	if identAtom != nil {
+		// The identifier is the search term.
+		if lo < hi {
+			return nil, &QuerySyntaxError{
+				Offset: words[lo].start,
+				Length: words[hi-1].end - words[lo].start,
+				Reason: "ident: cannot be combined with a search pattern",
+			}
+		}
+		return &Query{
+			PatternOffset: len(q),
+			Filters:       filters,
+		}, nil
+	}
+	if lo == hi {
+		return nil, &QuerySyntaxError{
+			Offset: len(q),
+			Reason: "no search term (the query only contains filters)",
+		}
+	}
+
+	// Whitespace is only removed where filter atoms were removed, as it
+	// might be significant otherwise (e.g. “foo ” for words ending in foo).
+	start, end := 0, len(q)
+	if lo > 0 {
+		start = words[lo].start
+	}
+	if hi < len(words) {
+		end = words[hi-1].end
+	}
+	return &Query{
+		Pattern:       q[start:end],
+		PatternOffset: start,
+		Filters:       filters,
+	}, nil
+}
+
+// Ident returns the identifier of the ident: keyword, if any.
+func (q *Query) Ident() string {
+	for _, atom := range q.Filters {
+		if atom.Keyword == "ident" {
+			return atom.Value
+		}
+	}
+	return ""
+}
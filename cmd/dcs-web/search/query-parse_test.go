@@ -0,0 +1,107 @@
+// vim:ts=4:sw=4:noexpandtab
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	for _, tt := range []struct {
+		query   string
+		pattern string
+		filters []FilterAtom
+	}{
+		{
+			query:   "searchterm ",
+			pattern: "searchterm ",
+		},
+		{
+			query:   "Package:i3-WM  search  term FILETYPE:C",
+			pattern: "search  term",
+			filters: []FilterAtom{
+				{Keyword: "package", Value: "i3-WM", Offset: 0},
+				{Keyword: "filetype", Value: "c", Offset: 28},
+			},
+		},
+		{
+			query:   "-pkg:foo -file:bar foo path:bar baz",
+			pattern: "foo path:bar baz",
+			filters: []FilterAtom{
+				{Keyword: "package", Negated: true, Value: "foo", Offset: 0},
+				{Keyword: "path", Negated: true, Value: "bar", Offset: 9},
+			},
+		},
+		{
+			query:   "std::vector snapshot:2015-06-01",
+			pattern: "std::vector",
+			filters: []FilterAtom{
+				{Keyword: "snapshot", Value: "2015-06-01", Offset: 12},
+			},
+		},
+		{
+			query:   "EVP_EncryptInit maintainer:pkg-go -description:library",
+			pattern: "EVP_EncryptInit",
+			filters: []FilterAtom{
+				{Keyword: "maintainer", Value: "pkg-go", Offset: 16},
+				{Keyword: "description", Negated: true, Value: "library", Offset: 34},
+			},
+		},
+		{
+			query:   "ident:parseRequest filetype:go",
+			pattern: "",
+			filters: []FilterAtom{
+				{Keyword: "ident", Value: "parseRequest", Offset: 0},
+				{Keyword: "filetype", Value: "go", Offset: 19},
+			},
+		},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q.Pattern != tt.pattern {
+				t.Errorf("Pattern = %q, want %q", q.Pattern, tt.pattern)
+			}
+			if got := tt.query[q.PatternOffset : q.PatternOffset+len(q.Pattern)]; got != q.Pattern {
+				t.Errorf("PatternOffset %d does not point to the pattern (%q)", q.PatternOffset, got)
+			}
+			if !reflect.DeepEqual(q.Filters, tt.filters) {
+				t.Errorf("Filters = %+v, want %+v", q.Filters, tt.filters)
+			}
+		})
+	}
+}
+
+func TestParseQuerySyntaxError(t *testing.T) {
+	for _, tt := range []struct {
+		query  string
+		offset int
+	}{
+		{"", 0},
+		{"package:debian", 14},
+		{"foo path:", 4},
+		{"foo path:(", 9},
+		{"-snapshot:2015-06-01 foo", 0},
+		{"foo snapshot:yesterday", 13},
+		{"include:everything foo", 8},
+		{"encoding:utf16 foo", 9},
+		{"size:10k foo", 5},
+		{"size:<10x foo", 5},
+		{"ident:2fast", 6},
+		{"ident:foo bar", 10},
+		{"ident:foo ident:bar", 10},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := ParseQuery(tt.query)
+			serr, ok := err.(*QuerySyntaxError)
+			if !ok {
+				t.Fatalf("ParseQuery(%q) = %v, want *QuerySyntaxError", tt.query, err)
+			}
+			if serr.Offset != tt.offset {
+				t.Fatalf("ParseQuery(%q) = %v, want offset %d", tt.query, err, tt.offset)
+			}
+		})
+	}
+}
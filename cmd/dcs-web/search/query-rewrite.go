@@ -1,61 +1,40 @@
 // vim:ts=4:sw=4:noexpandtab
 package search
 
-import (
-	"net/url"
-	"regexp"
-	"strings"
-)
+import "net/url"
 
-var (
-	start = regexp.MustCompile(`(?i)^\s*(-?(?:filetype|package|pkg|path|file)):(\S+)\s+`)
-	end   = regexp.MustCompile(`(?i)\s+(-?(?:filetype|package|pkg|path|file)):(\S+)\s*$`)
-)
-
-func rewriteFilters(query url.Values, filtersRe *regexp.Regexp) url.Values {
-	qstr := query.Get("q")
-	// Using a regexp so the start/end indices of each match are easily
-	// available for subsequent slicing of the query string.  The performance
-	// (regexp @ 0.011 ms vs. string @ 0.004 ms) is minimal enough that the
-	// extra hit for regexp is acceptable, given the simpler code.
-	matches := filtersRe.FindStringSubmatch(qstr)
-	for matches != nil {
-		// matches is [entire_match, filter_name, filter_value]
-		filter := strings.ToLower(matches[1])
-		value := matches[2]
-
-		filter = strings.Replace(filter, "pkg", "package", 1)
-		if filter == "-file" {
-			filter = "npath"
-		} else if strings.HasPrefix(filter, "-") {
-			filter = "n" + filter[1:]
-		}
-		if strings.HasSuffix(filter, "filetype") {
-			value = strings.ToLower(value)
-		}
-		query.Add(filter, value)
-
-		if filtersRe == start {
-			qstr = strings.TrimPrefix(qstr, matches[0])
-		} else {
-			qstr = strings.TrimSuffix(qstr, matches[0])
-		}
-		matches = filtersRe.FindStringSubmatch(qstr)
-	}
-
-	query.Set("q", qstr)
-	return query
-}
-
-// Parses the querystring (q= parameter) and moves special tokens such as
-// "lang:c" from the querystring into separate arguments.
+// Parses the querystring (q= parameter) and moves filter atoms such as
+// "filetype:c" from the querystring into separate arguments (see ParseQuery).
 func RewriteQuery(u url.URL) url.URL {
 	// query is a copy which we will modify using Set() and use in the result
-	query := rewriteFilters(u.Query(), start)
-	query = rewriteFilters(query, end)
+	query := u.Query()
+	// Queries which cannot be parsed are left as-is: validation reports the
+	// error to the user.
+	var identifier string
+	if parsed, err := ParseQuery(query.Get("q")); err == nil {
+		for _, atom := range parsed.Filters {
+			query.Add(atom.Param(), atom.Value)
+		}
+		query.Set("q", parsed.Pattern)
+		identifier = parsed.Ident()
+	}
 
-	if query.Get("literal") == "1" {
+	if identifier != "" {
+		// Source backends with an identifier index use the ident parameter
+		// to find the candidate files, all others the trigram index.
+		query.Set("q", `\b`+identifier+`\b`)
+	} else if query.Get("literal") == "1" {
 		query.Set("q", `\Q`+query.Get("q")+`\E`)
+	} else if rewrite, err := RewritePCRE(query.Get("q")); err == nil {
+		// Queries which cannot be rewritten are left as-is: validation
+		// reports the error to the user.
+		query.Set("q", rewrite.Pattern)
+		for _, pattern := range rewrite.LineMatch {
+			query.Add("lookahead", pattern)
+		}
+		for _, pattern := range rewrite.NLineMatch {
+			query.Add("nlookahead", pattern)
+		}
 	}
 	u.RawQuery = query.Encode()
 
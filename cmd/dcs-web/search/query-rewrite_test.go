@@ -123,6 +123,46 @@ func TestRewriteQuery(t *testing.T) {
 		t.Fatalf("Expected npath %q, got %q", "foo", file)
 	}
 
+	// Verify that the include: keyword is recognized
+	rewritten = rewrite(t, "/search?q=searchterm+include:generated")
+	querystr = rewritten.Query().Get("q")
+	if querystr != "searchterm" {
+		t.Fatalf("Expected search query %q, got %q", "searchterm", querystr)
+	}
+	if include := rewritten.Query().Get("include"); include != "generated" {
+		t.Fatalf("Expected include %q, got %q", "generated", include)
+	}
+
+	// Verify that the snapshot: keyword is recognized
+	rewritten = rewrite(t, "/search?q=searchterm+snapshot:2015-06-01")
+	querystr = rewritten.Query().Get("q")
+	if querystr != "searchterm" {
+		t.Fatalf("Expected search query %q, got %q", "searchterm", querystr)
+	}
+	if snapshot := rewritten.Query().Get("snapshot"); snapshot != "2015-06-01" {
+		t.Fatalf("Expected snapshot %q, got %q", "2015-06-01", snapshot)
+	}
+
+	// Verify that the -license: (negative) keyword is recognized
+	rewritten = rewrite(t, "/search?q=searchterm+-license:GPL")
+	querystr = rewritten.Query().Get("q")
+	if querystr != "searchterm" {
+		t.Fatalf("Expected search query %q, got %q", "searchterm", querystr)
+	}
+	if license := rewritten.Query().Get("nlicense"); license != "GPL" {
+		t.Fatalf("Expected nlicense %q, got %q", "GPL", license)
+	}
+
+	// Verify that the binpkg: keyword is recognized
+	rewritten = rewrite(t, "/search?q=searchterm+binpkg:i3-wm-dbg")
+	querystr = rewritten.Query().Get("q")
+	if querystr != "searchterm" {
+		t.Fatalf("Expected search query %q, got %q", "searchterm", querystr)
+	}
+	if binpkg := rewritten.Query().Get("binpkg"); binpkg != "i3-wm-dbg" {
+		t.Fatalf("Expected binpkg %q, got %q", "i3-wm-dbg", binpkg)
+	}
+
 	// Verify that the multiple keywords work as expected
 	rewritten = rewrite(t, "/search?q=searchterm+package%3Ai3-WM+filetype%3Ac")
 	querystr = rewritten.Query().Get("q")
@@ -162,3 +202,16 @@ func TestRewriteQuery(t *testing.T) {
 		t.Fatalf("Expected two elements in the hash of the -package keyword, saw %d", seen)
 	}
 }
+
+func TestRewriteIdentQuery(t *testing.T) {
+	rewritten := rewrite(t, "/search?q=ident%3AparseRequest+filetype%3Ago&literal=1")
+	if got, want := rewritten.Query().Get("q"), `\bparseRequest\b`; got != want {
+		t.Errorf("Expected search query %q, got %q", want, got)
+	}
+	if got, want := rewritten.Query().Get("ident"), "parseRequest"; got != want {
+		t.Errorf("Expected ident %q, got %q", want, got)
+	}
+	if got, want := rewritten.Query().Get("filetype"), "go"; got != want {
+		t.Errorf("Expected filetype %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	searchLogPath = flag.String("search_log_path",
+		"",
+		"Where to write the structured search log (one JSON object per finished search request: query, latency, result count, client). Disabled if empty. Unlike -access_log_path, it supports -search_log_privacy")
+
+	searchLogPrivacy = flag.Bool("search_log_privacy",
+		false,
+		"Log a keyed hash of the query (see -search_log_hash_key) instead of the query, and the client’s autonomous system (see -asn_db_path) instead of its IP address")
+
+	searchLogQueryLength = flag.Int("search_log_query_length",
+		0,
+		"If non-zero, queries are truncated to this many bytes in the search log. In privacy mode, a truncated query is logged in addition to the hash")
+
+	searchLogHashKey = flag.String("search_log_hash_key",
+		"",
+		"Key for hashing queries in privacy mode. If empty, a random key is generated at startup, i.e. hashes can only be compared within the same process")
+
+	searchLogMaxBytes = flag.Int64("search_log_max_bytes",
+		100*1024*1024,
+		"Size at which the search log is rotated (renamed to <path>.1, <path>.1 to <path>.2 etc.)")
+
+	searchLogKeep = flag.Int("search_log_keep",
+		7,
+		"Number of rotated search logs to keep")
+
+	asnDBPath = flag.String("asn_db_path",
+		"",
+		"Path to an IP-to-ASN database in the tab-separated ip2asn format (range_start, range_end, AS number, …, e.g. ip2asn-combined.tsv from https://iptoasn.com/), used for -search_log_privacy")
+)
+
+var searchLog struct {
+	f       *rotatingFile
+	hashKey []byte
+	asns    asnDB
+}
+
+// initSearchLog opens -search_log_path. Must be called after flag.Parse().
+func initSearchLog() {
+	if *searchLogPath == "" {
+		return
+	}
+	f, err := openRotatingFile(*searchLogPath, *searchLogMaxBytes, *searchLogKeep, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	searchLog.f = f
+	if !*searchLogPrivacy {
+		return
+	}
+	searchLog.hashKey = []byte(*searchLogHashKey)
+	if len(searchLog.hashKey) == 0 {
+		searchLog.hashKey = make([]byte, 32)
+		if _, err := rand.Read(searchLog.hashKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *asnDBPath != "" {
+		if searchLog.asns, err = readASNDB(*asnDBPath); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded %d IP ranges from %q\n", len(searchLog.asns), *asnDBPath)
+	}
+}
+
+type searchLogEntry struct {
+	Time time.Time
+	// Transport is one of events, instantws or grpc.
+	Transport string
+	Query     string `json:",omitempty"`
+	QueryHash string `json:",omitempty"`
+	Cached    bool
+	LatencyMs int64
+	Results   int
+	// Client is the IP address or, in privacy mode, the autonomous system
+	// (e.g. “AS3320”) of the client. Empty if unknown.
+	Client string `json:",omitempty"`
+}
+
+// logSearch writes an entry for a search request which started at started
+// and is done (i.e. all events were sent to the client) to the search log.
+// src is the client address as used in log messages (host:port).
+func logSearch(transport, src, query, queryid string, cached bool, started time.Time) {
+	if searchLog.f == nil {
+		return
+	}
+	stateMu.RLock()
+	s := state[queryid]
+	results := s.numResults()
+	stateMu.RUnlock()
+	entry := searchLogEntry{
+		Time:      started,
+		Transport: transport,
+		Cached:    cached,
+		LatencyMs: int64(time.Since(started) / time.Millisecond),
+		Results:   results,
+	}
+
+	truncated := query
+	if n := *searchLogQueryLength; n > 0 && len(truncated) > n {
+		truncated = truncated[:n]
+	}
+	host := src
+	if idx := strings.LastIndex(host, ":"); idx > -1 {
+		host = host[:idx]
+	}
+	// X-Forwarded-For may contain a list of proxies.
+	if idx := strings.Index(host, ","); idx > -1 {
+		host = host[:idx]
+	}
+	host = strings.Trim(strings.TrimSpace(host), "[]")
+
+	if *searchLogPrivacy {
+		mac := hmac.New(sha256.New, searchLog.hashKey)
+		mac.Write([]byte(query))
+		entry.QueryHash = fmt.Sprintf("%x", mac.Sum(nil))
+		if *searchLogQueryLength > 0 {
+			entry.Query = truncated
+		}
+		if asn := searchLog.asns.lookup(net.ParseIP(host)); asn != 0 {
+			entry.Client = "AS" + strconv.FormatUint(uint64(asn), 10)
+		}
+	} else {
+		entry.Query = truncated
+		entry.Client = host
+	}
+
+	b, err := json.Marshal(&entry)
+	if err != nil {
+		log.Printf("[%s] could not encode search log entry: %v\n", queryid, err)
+		return
+	}
+	if _, err := searchLog.f.Write(append(b, '\n')); err != nil {
+		log.Printf("[%s] could not write search log entry: %v\n", queryid, err)
+	}
+}
+
+// rotatingFile is an append-only file which is rotated once it exceeds
+// maxBytes: path is renamed to path.1 (path.1 to path.2, etc.), keeping keep
+// rotated files. If non-empty, header is written at the beginning of each
+// file.
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	keep     int
+	header   []byte
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxBytes int64, keep int, header []byte) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:     path,
+		maxBytes: maxBytes,
+		keep:     keep,
+		header:   header,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = st.Size()
+	if rf.size == 0 && len(rf.header) > 0 {
+		n, err := f.Write(rf.header)
+		rf.size += int64(n)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	if rf.keep < 1 {
+		if err := os.Remove(rf.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return rf.open()
+	}
+	for i := rf.keep - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+// Write writes b (one complete entry) to the file, rotating it first if b
+// would make it exceed maxBytes.
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxBytes > 0 && rf.size > 0 && rf.size+int64(len(b)) > rf.maxBytes {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+type asnRange struct {
+	start, end net.IP // 16-byte form
+	asn        uint32
+}
+
+// asnDB maps IP address ranges to autonomous system numbers. Sorted by start.
+type asnDB []asnRange
+
+// readASNDB reads an ip2asn TSV file, skipping ranges which are not
+// announced (AS number 0).
+func readASNDB(path string) (asnDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var db asnDB
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected at least 3 tab-separated fields", path, lineno)
+		}
+		start, end := net.ParseIP(fields[0]), net.ParseIP(fields[1])
+		if start == nil || end == nil {
+			return nil, fmt.Errorf("%s:%d: invalid IP address range %s-%s", path, lineno, fields[0], fields[1])
+		}
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid AS number: %v", path, lineno, err)
+		}
+		if asn == 0 {
+			continue
+		}
+		db = append(db, asnRange{start.To16(), end.To16(), uint32(asn)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(db, func(i, j int) bool {
+		return bytes.Compare(db[i].start, db[j].start) < 0
+	})
+	return db, nil
+}
+
+// lookup returns the AS number announcing ip, or 0 if unknown.
+func (db asnDB) lookup(ip net.IP) uint32 {
+	if ip == nil {
+		return 0
+	}
+	ip = ip.To16()
+	// The first range starting after ip.
+	idx := sort.Search(len(db), func(i int) bool {
+		return bytes.Compare(db[i].start, ip) > 0
+	})
+	if idx == 0 {
+		return 0
+	}
+	if r := db[idx-1]; bytes.Compare(ip, r.end) <= 0 {
+		return r.asn
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestASNLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcs-searchlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ip2asn.tsv")
+	const db = "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+		"1.0.1.0\t1.0.3.255\t0\tNone\tNot routed\n" +
+		"2001:db8::\t2001:db8::ffff\t64496\tZZ\tDOCUMENTATION\n" +
+		"192.0.2.0\t192.0.2.255\t64497\tZZ\tTEST-NET-1\n"
+	if err := ioutil.WriteFile(path, []byte(db), 0644); err != nil {
+		t.Fatal(err)
+	}
+	asns, err := readASNDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		ip   string
+		want uint32
+	}{
+		{"1.0.0.0", 13335},
+		{"1.0.0.42", 13335},
+		{"1.0.0.255", 13335},
+		{"1.0.1.1", 0}, // not routed
+		{"0.255.255.255", 0},
+		{"192.0.2.1", 64497},
+		{"192.0.3.1", 0},
+		{"2001:db8::1", 64496},
+		{"2001:db8::1:0", 0},
+	} {
+		if got := asns.lookup(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("lookup(%s) = %d, want %d", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcs-searchlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "search.log")
+	rf, err := openRotatingFile(path, 10, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(entry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{path, "fourth\n"},
+		{path + ".1", "third\n"},
+		{path + ".2", "second\n"},
+	} {
+		b, err := ioutil.ReadFile(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.path, got, tt.want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 unexpectedly exists (keep = 2)", path)
+	}
+}
@@ -9,9 +9,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"hash/fnv"
 	"html/template"
-	"io"
 	"log"
 	"math"
 	"net/http"
@@ -20,6 +18,7 @@ import (
 	"strings"
 
 	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/cmd/dcs-web/i18n"
 	dcsregexp "github.com/Debian/dcs/regexp"
 	opentracing "github.com/opentracing/opentracing-go"
 )
@@ -35,6 +34,7 @@ type halfRenderedResult struct {
 	SourcePackage string
 	RelativePath  string
 	Context       template.HTML
+	Compression   string
 }
 
 func maybeAppendContext(context []string, line string) []string {
@@ -49,6 +49,26 @@ func maybeAppendContext(context []string, line string) []string {
 	}
 }
 
+// highlightContext wraps the ranges (see Match.HighlightRanges) of the
+// HTML-escaped line context in <mark> elements. Invalid ranges (e.g. from
+// outdated federation peers) leave context unchanged.
+func highlightContext(context string, ranges []dcsregexp.Range) string {
+	var b strings.Builder
+	pos := 0
+	for _, r := range ranges {
+		if r.Start < pos || r.End <= r.Start || r.End > len(context) {
+			return context
+		}
+		b.WriteString(context[pos:r.Start])
+		b.WriteString("<mark>")
+		b.WriteString(context[r.Start:r.End])
+		b.WriteString("</mark>")
+		pos = r.End
+	}
+	b.WriteString(context[pos:])
+	return b.String()
+}
+
 func splitPath(path string) (sourcePackage string, relativePath string) {
 	for i := 0; i < len(path); i++ {
 		if path[i] == '_' {
@@ -121,7 +141,7 @@ func readPackagesFile(queryid string) []string {
 
 func renderPerPackage(w http.ResponseWriter, r *http.Request, queryid string, page int) {
 	var buffer bytes.Buffer
-	if err := writePerPkgResults(queryid, page, &buffer, w, r); err != nil {
+	if err := writePerPkgResults(queryid, page, *resultsPerPackage, &buffer, w, r); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -146,7 +166,7 @@ func renderPerPackage(w http.ResponseWriter, r *http.Request, queryid string, pa
 			var context []string
 			context = maybeAppendContext(context, result.Ctxp2)
 			context = maybeAppendContext(context, result.Ctxp1)
-			context = append(context, "<strong>"+result.Context+"</strong>")
+			context = append(context, "<strong>"+highlightContext(result.Context, result.HighlightRanges)+"</strong>")
 			context = maybeAppendContext(context, result.Ctxn1)
 			context = maybeAppendContext(context, result.Ctxn2)
 
@@ -160,6 +180,7 @@ func renderPerPackage(w http.ResponseWriter, r *http.Request, queryid string, pa
 				SourcePackage: sourcePackage,
 				RelativePath:  relativePath,
 				Context:       template.HTML(strings.Join(context, "<br>")),
+				Compression:   result.Compression,
 			}
 		}
 		results[idx] = perPackageResults{
@@ -174,7 +195,7 @@ func renderPerPackage(w http.ResponseWriter, r *http.Request, queryid string, pa
 	basequery.Del("page")
 	baseurl := r.URL
 	baseurl.RawQuery = basequery.Encode()
-	pages := int(math.Ceil(float64(len(state[queryid].allPackagesSorted)) / float64(packagesPerPage)))
+	pages := int(math.Ceil(float64(len(state[queryid].allPackagesSorted)) / float64(*packagesPerPage)))
 	pagination := updatePagination(page, pages, baseurl.String())
 
 	basequery.Del("perpkg")
@@ -192,6 +213,8 @@ func renderPerPackage(w http.ResponseWriter, r *http.Request, queryid string, pa
 		"literal":     r.Form.Get("literal") == "1",
 		"page":        page,
 		"host":        r.Host,
+		"uiconfig":    currentUIConfig(),
+		"i18n":        i18n.FromRequest(r),
 		"version":     common.Version,
 	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -237,23 +260,36 @@ func Search(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Uniquely (well, good enough) identify this query for a couple of minutes
-	// (as long as we want to cache results). We could try to normalize the
-	// query before hashing it, but that seems hardly worth the complexity.
-	h := fnv.New64()
-	io.WriteString(h, q)
-	queryid := fmt.Sprintf("%x", h.Sum64())
+	tenant, err := tenantFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unknown API key.", http.StatusUnauthorized)
+		return
+	}
+	queryid := tenantQueryIdentifier(tenant, q)
 
 	log.Printf("server-render(%q, %q, %q)\n", queryid, src, q)
 
 	if err := validateQuery("?" + q); err != nil {
 		log.Printf("[%s] Query %q failed validation: %v\n", src, q, err)
+		recordRefusedStatz(errorTypeInvalidQuery)
 		http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
 		return
 	}
 
+	if proxyToOwner(w, r, queryid, Search) {
+		return
+	}
+
+	if err := admitTenantQuery(tenant, queryid); err != nil {
+		log.Printf("[%s] not starting query: %v\n", src, err)
+		recordRefusedStatz(errorTypeFor(err))
+		http.Error(w, "Too many queries for this API key, please try again later.", http.StatusTooManyRequests)
+		return
+	}
+
 	if _, err := maybeStartQuery(ctx, queryid, src, q); err != nil {
 		log.Printf("[%s] could not start query: %v\n", src, err)
+		recordRefusedStatz(errorTypeFor(err))
 		http.Error(w, fmt.Sprintf("Could not start query: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -267,6 +303,8 @@ func Search(w http.ResponseWriter, r *http.Request) {
 			"q":           r.Form.Get("q"),
 			"literal":     literal == "1",
 			"host":        r.Host,
+			"uiconfig":    currentUIConfig(),
+			"i18n":        i18n.FromRequest(r),
 			"version":     common.Version,
 		}); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -301,7 +339,7 @@ func Search(w http.ResponseWriter, r *http.Request) {
 		var context []string
 		context = maybeAppendContext(context, result.Ctxp2)
 		context = maybeAppendContext(context, result.Ctxp1)
-		context = append(context, "<strong>"+result.Context+"</strong>")
+		context = append(context, "<strong>"+highlightContext(result.Context, result.HighlightRanges)+"</strong>")
 		context = maybeAppendContext(context, result.Ctxn1)
 		context = maybeAppendContext(context, result.Ctxn2)
 
@@ -315,6 +353,7 @@ func Search(w http.ResponseWriter, r *http.Request) {
 			SourcePackage: sourcePackage,
 			RelativePath:  relativePath,
 			Context:       template.HTML(strings.Join(context, "<br>")),
+			Compression:   result.Compression,
 		}
 	}
 
@@ -341,11 +380,14 @@ func Search(w http.ResponseWriter, r *http.Request) {
 		"filterurl":   filterurl,
 		"results":     halfrendered,
 		"packages":    packages,
+		"numresults":  len(state[queryid].resultPointers),
 		"pagination":  template.HTML(pagination),
 		"q":           r.Form.Get("q"),
 		"literal":     literal == "1",
 		"page":        page,
 		"host":        r.Host,
+		"uiconfig":    currentUIConfig(),
+		"i18n":        i18n.FromRequest(r),
 		"version":     common.Version,
 	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
 
@@ -25,16 +24,13 @@ func Show(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	line := int(line64)
+	// compression is set for matches in compressed files (see
+	// sourcebackendpb.Match), which sources.debian.org does not decompress.
+	compression := query.Query().Get("compression")
 	log.Printf("Showing file %s, line %d\n", filename, line)
 
-	if *common.UseSourcesDebianNet && health.IsHealthy("sources.debian.org") {
-		u, _ := url.Parse("https://sources.debian.org/")
-		u.Path = "/src/" + strings.Replace(filename, "_", "/", 1)
-		q := u.Query()
-		q.Set("hl", strconv.Itoa(line))
-		u.RawQuery = q.Encode()
-		u.Fragment = "L" + strconv.Itoa(line)
-		destination := u.String()
+	if *common.UseSourcesDebianNet && compression == "" && health.IsHealthy("sources.debian.org") {
+		destination := common.SourcesURL(filename, query.Query().Get("version"), line)
 		log.Printf("SDN is healthy. Redirecting to %s\n", destination)
 		http.Redirect(w, r, destination, 302)
 		return
@@ -46,9 +42,15 @@ func Show(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	pkg := filename[:idx]
-	shard := common.SourceBackendStubs[shardmapping.TaskIdxForPackage(pkg, len(common.SourceBackendStubs))]
+	backends := common.SourceBackendsFor(r.FormValue("snapshot"))
+	if backends == nil {
+		http.Error(w, "Unknown snapshot", http.StatusNotFound)
+		return
+	}
+	shard := backends[shardmapping.TaskIdxForPackage(pkg, len(backends))]
 	resp, err := shard.File(context.Background(), &sourcebackendpb.FileRequest{
-		Path: filename,
+		Path:        filename,
+		Compression: compression,
 	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
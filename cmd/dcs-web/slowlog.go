@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/renameio"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	slowQueryThreshold = flag.Duration("slow_query_threshold",
+		0,
+		"Queries taking at least this long (including time spent in the queue) are logged as slow queries, see -slow_query_log_path. 0 disables the slow query log")
+
+	slowQueryLogPath = flag.String("slow_query_log_path",
+		"",
+		"Directory in which a JSON report (event timeline, per-backend timings, rewritten query) is stored for each slow query. If empty, slow queries are only counted in the slow_queries metrics")
+
+	slowQueries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "slow_queries",
+			Help: "Number of queries which took at least -slow_query_threshold.",
+		})
+
+	slowQueryBackendDurations = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "slow_query_backend_duration_ms",
+			Help:    "Time the source backends (and federation peers) took to reply to slow queries, in milliseconds.",
+			Buckets: prometheus.ExponentialBuckets(100, 2, 12),
+		},
+		[]string{"backend"})
+)
+
+func init() {
+	prometheus.MustRegister(slowQueries)
+	prometheus.MustRegister(slowQueryBackendDurations)
+}
+
+// backendTimings records when one source backend (or federation peer) of a
+// query was queried and replied. Only written by the goroutine querying the
+// backend, and read once all of those goroutines returned.
+type backendTimings struct {
+	started    time.Time
+	firstReply time.Time
+	finished   time.Time
+	replies    int
+}
+
+// maxTimelineEntries limits the memory used by the timeline of queries with
+// many events.
+const maxTimelineEntries = 10000
+
+// timelineEntry is one event of a query (see addEvent), as recorded for the
+// slow query log and debug bundles. Only the event type and size are recorded,
+// as results events would otherwise make the timeline too large.
+type timelineEntry struct {
+	// Offset is the time since the query was started, measured using the
+	// monotonic clock. Time is the wall clock time of the event, which is
+	// affected by clock jumps (see clock.go).
+	Offset string
+	Time   time.Time
+	Type   string
+	Bytes  int
+
+	// Progress is only set for progress updates, as they are obsoleted by
+	// later progress updates and hence not retained as events.
+	Progress *timelineProgress `json:",omitempty"`
+}
+
+type timelineProgress struct {
+	FilesProcessed int
+	FilesTotal     int
+	Results        int
+}
+
+// timelineEventType returns a description of an event passed to addEvent.
+func timelineEventType(data []byte, origdata interface{}) string {
+	switch ev := origdata.(type) {
+	case *Error:
+		return "error: " + ev.ErrorType
+	case obsoletableEvent:
+		return ev.EventType()
+	case nil:
+		if len(data) == 0 {
+			return "done"
+		}
+	}
+	return fmt.Sprintf("%T", origdata)
+}
+
+type slowQueryBackend struct {
+	Index int
+	// Started, FirstReply and Finished are relative to the start of the
+	// query. FirstReply is empty if the backend did not reply. All timings
+	// are empty for queries which were reloaded from disk.
+	Started        string `json:",omitempty"`
+	FirstReply     string `json:",omitempty"`
+	Finished       string `json:",omitempty"`
+	Duration       string `json:",omitempty"`
+	Replies        int
+	Results        int
+	FilesProcessed int
+	FilesTotal     int
+}
+
+// slowQueryReport is written to -slow_query_log_path for each slow query.
+type slowQueryReport struct {
+	QueryId        string
+	Query          string
+	RewrittenQuery string
+	Started        time.Time
+	Duration       string
+	QueueWait      string
+	ErrorType      string `json:",omitempty"`
+	NumResults     int
+	Truncated      bool
+	Backends       []slowQueryBackend
+	Events         []timelineEntry
+}
+
+// logSlowQuery reports the query if it took at least -slow_query_threshold.
+// Must be called once all backends of the query returned.
+func logSlowQuery(queryid string, queueWait time.Duration) {
+	if *slowQueryThreshold == 0 {
+		return
+	}
+	stateMu.RLock()
+	s := state[queryid]
+	duration := s.runningFor()
+	if duration < *slowQueryThreshold {
+		stateMu.RUnlock()
+		return
+	}
+	report := slowQueryReport{
+		QueryId:        queryid,
+		Query:          s.query,
+		RewrittenQuery: s.rewrittenQuery,
+		Started:        s.started,
+		Duration:       duration.String(),
+		QueueWait:      queueWait.String(),
+		ErrorType:      s.errorType,
+		NumResults:     s.numResults(),
+		Truncated:      s.truncated,
+		Backends:       backendReports(&s),
+		Events:         append([]timelineEntry(nil), s.timeline...),
+	}
+	for idx, bstate := range s.perBackend {
+		t := bstate.timings
+		slowQueryBackendDurations.WithLabelValues(strconv.Itoa(idx)).Observe(
+			float64(t.finished.Sub(t.started) / time.Millisecond))
+	}
+	stateMu.RUnlock()
+
+	slowQueries.Inc()
+	log.Printf("[%s] slow query (%v): %q\n", queryid, duration, report.Query)
+	if *slowQueryLogPath == "" {
+		return
+	}
+	if err := writeSlowQueryReport(&report); err != nil {
+		log.Printf("[%s] could not write slow query report: %v\n", queryid, err)
+	}
+}
+
+// backendReports returns the progress of each backend of the query and, once
+// all backends returned, their timings. Must be called with stateMu held.
+func backendReports(s *queryState) []slowQueryBackend {
+	reports := make([]slowQueryBackend, len(s.perBackend))
+	s.filesMu.Lock()
+	defer s.filesMu.Unlock()
+	for idx, bstate := range s.perBackend {
+		b := slowQueryBackend{
+			Index:          idx,
+			FilesProcessed: s.filesProcessed[idx],
+			FilesTotal:     s.filesTotal[idx],
+		}
+		if !s.backendsReturned {
+			reports[idx] = b
+			continue
+		}
+		t := bstate.timings
+		b.Replies = t.replies
+		b.Results = len(bstate.resultPointers)
+		if !t.started.IsZero() {
+			b.Started = t.started.Sub(s.started).String()
+			b.Finished = t.finished.Sub(s.started).String()
+			b.Duration = t.finished.Sub(t.started).String()
+		}
+		if !t.firstReply.IsZero() {
+			b.FirstReply = t.firstReply.Sub(s.started).String()
+		}
+		reports[idx] = b
+	}
+	return reports
+}
+
+func writeSlowQueryReport(report *slowQueryReport) error {
+	if err := os.MkdirAll(*slowQueryLogPath, 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Reports sort by time when listing the directory.
+	name := report.Started.UTC().Format("20060102T150405Z") + "-" + report.QueryId + ".json"
+	return renameio.WriteFile(filepath.Join(*slowQueryLogPath, name), b, 0644)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+var sortWorkers = flag.Int("sort_workers",
+	0,
+	"Number of goroutines sorting the results of a query once all source backends are done, which delays pagination for queries with many results. 0 uses GOMAXPROCS, 1 disables parallel sorting")
+
+// minSortChunk is the minimum number of pointers sorted by each worker:
+// below, the overhead of merging exceeds the gains of sorting in parallel.
+const minSortChunk = 16384
+
+// rankedBefore is the order of pointerByRanking.
+func rankedBefore(a, b resultPointer) bool {
+	if a.ranking == b.ranking {
+		return a.pathHash > b.pathHash
+	}
+	return a.ranking > b.ranking
+}
+
+// sortPointers sorts pointers like sort.Sort(pointerByRanking(pointers)), but
+// uses up to workers goroutines (0 means GOMAXPROCS): chunks of pointers are
+// sorted in parallel, then merged pairwise (also in parallel).
+func sortPointers(pointers []resultPointer, workers int) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if max := len(pointers) / minSortChunk; workers > max {
+		workers = max
+	}
+	if workers <= 1 {
+		sort.Sort(pointerByRanking(pointers))
+		return
+	}
+
+	// bounds[i] is the start of chunk i, the last element is the end of the
+	// last chunk.
+	bounds := make([]int, workers+1)
+	for i := range bounds {
+		bounds[i] = i * len(pointers) / workers
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(chunk []resultPointer) {
+			defer wg.Done()
+			sort.Sort(pointerByRanking(chunk))
+		}(pointers[bounds[i]:bounds[i+1]])
+	}
+	wg.Wait()
+
+	src, dst := pointers, make([]resultPointer, len(pointers))
+	for len(bounds) > 2 {
+		chunks := len(bounds) - 1
+		merged := make([]int, 0, chunks/2+2)
+		for i := 0; i < chunks; i += 2 {
+			merged = append(merged, bounds[i])
+			if i+1 == chunks {
+				// Odd number of chunks: the last one is merged in the
+				// next round.
+				copy(dst[bounds[i]:bounds[i+1]], src[bounds[i]:bounds[i+1]])
+				continue
+			}
+			wg.Add(1)
+			go func(lo, mid, hi int) {
+				defer wg.Done()
+				mergePointers(dst[lo:hi], src[lo:mid], src[mid:hi])
+			}(bounds[i], bounds[i+1], bounds[i+2])
+		}
+		wg.Wait()
+		bounds = append(merged, len(pointers))
+		src, dst = dst, src
+	}
+	if &src[0] != &pointers[0] {
+		copy(pointers, src)
+	}
+}
+
+// mergePointers merges the sorted a and b into dst, which must have room for
+// len(a)+len(b) pointers.
+func mergePointers(dst, a, b []resultPointer) {
+	i, j, k := 0, 0, 0
+	for i < len(a) && j < len(b) {
+		if rankedBefore(b[j], a[i]) {
+			dst[k] = b[j]
+			j++
+		} else {
+			dst[k] = a[i]
+			i++
+		}
+		k++
+	}
+	k += copy(dst[k:], a[i:])
+	copy(dst[k:], b[j:])
+}
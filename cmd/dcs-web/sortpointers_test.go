@@ -0,0 +1,26 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSortPointers(t *testing.T) {
+	for _, n := range []int{0, 1, 100, minSortChunk, 3*minSortChunk + 7, 10*minSortChunk + 1} {
+		for _, workers := range []int{0, 2, 3, 8} {
+			pointers := randomPointers(n)
+			// Duplicate rankings exercise the tie-breaker.
+			for i := 0; i < n; i += 3 {
+				pointers[i].ranking = 0.5
+			}
+			want := make([]resultPointer, n)
+			copy(want, pointers)
+			sort.Sort(pointerByRanking(want))
+			sortPointers(pointers, workers)
+			if !reflect.DeepEqual(pointers, want) {
+				t.Errorf("sortPointers(%d pointers, %d workers): result differs from sort.Sort", n, workers)
+			}
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/cmd/dcs-web/i18n"
+)
+
+var (
+	statzInterval = flag.Duration("statz_interval",
+		1*time.Minute,
+		"How often the public query statistics served on /statz are updated")
+
+	statzWindow = flag.Duration("statz_window",
+		24*time.Hour,
+		"Time span covered by the public query statistics served on /statz")
+)
+
+// statzTopErrors is the number of error types listed on /statz.
+const statzTopErrors = 5
+
+// statzSample is all that /statz retains about a query. Neither the query nor
+// anything identifying the client is retained, so that the statistics can be
+// published.
+type statzSample struct {
+	finished  time.Time
+	duration  time.Duration
+	errorType string
+
+	// refused is set for queries which were never started (e.g. invalid
+	// queries), whose duration is not meaningful.
+	refused bool
+}
+
+var statz struct {
+	mu       sync.Mutex
+	samples  []statzSample
+	snapshot *statzSnapshot
+}
+
+// recordStatz records a query which finished (or failed) after running for
+// duration.
+func recordStatz(duration time.Duration, errorType string) {
+	statz.mu.Lock()
+	defer statz.mu.Unlock()
+	statz.samples = append(statz.samples, statzSample{
+		finished:  time.Now(),
+		duration:  duration,
+		errorType: errorType,
+	})
+}
+
+// recordRefusedStatz records a query which was refused before it started.
+func recordRefusedStatz(errorType string) {
+	statz.mu.Lock()
+	defer statz.mu.Unlock()
+	statz.samples = append(statz.samples, statzSample{
+		finished:  time.Now(),
+		errorType: errorType,
+		refused:   true,
+	})
+}
+
+// statzHour are the number of queries which finished within the hour starting
+// at Hour.
+type statzHour struct {
+	Hour    time.Time
+	Queries int
+	Failed  int
+}
+
+type statzErrorCount struct {
+	ErrorType string
+	Count     int
+}
+
+// statzCoverage describes which part of the index can currently be searched,
+// i.e. how many source backends (each serving an index shard) are ready.
+type statzCoverage struct {
+	SourceBackends int
+	Ready          int
+	Percent        float64
+}
+
+// statzSnapshot are the statistics served on /statz, as computed by the
+// aggregator every -statz_interval.
+type statzSnapshot struct {
+	Updated time.Time
+	// Window is the time span covered by Queries, Hours, MedianLatency
+	// and TopErrors, see -statz_window.
+	Window time.Duration
+	// Queries is the number of queries, including refused queries.
+	Queries int
+	// Hours contains one entry per hour of the window, oldest first.
+	Hours []statzHour
+	// MedianLatency is the median duration of all queries which were
+	// started.
+	MedianLatency time.Duration
+	// TopErrors are the most common error types (see Error) of queries
+	// which did not succeed, most common first.
+	TopErrors []statzErrorCount
+	Coverage  statzCoverage
+}
+
+// aggregateStatz computes the statistics of the samples which finished within
+// window before now.
+func aggregateStatz(now time.Time, window time.Duration, samples []statzSample, coverage statzCoverage) *statzSnapshot {
+	snap := &statzSnapshot{
+		Updated:  now,
+		Window:   window,
+		Coverage: coverage,
+	}
+	first := now.Truncate(time.Hour).Add(-window).Add(time.Hour)
+	for hour := first; !hour.After(now); hour = hour.Add(time.Hour) {
+		snap.Hours = append(snap.Hours, statzHour{Hour: hour})
+	}
+	var durations []time.Duration
+	errorCounts := make(map[string]int)
+	for _, s := range samples {
+		if s.finished.Before(first) || s.finished.After(now) {
+			continue
+		}
+		snap.Queries++
+		h := &snap.Hours[int(s.finished.Sub(first)/time.Hour)]
+		h.Queries++
+		if s.errorType != "" {
+			h.Failed++
+			errorCounts[s.errorType]++
+		}
+		if !s.refused {
+			durations = append(durations, s.duration)
+		}
+	}
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		snap.MedianLatency = durations[len(durations)/2]
+	}
+	for errorType, count := range errorCounts {
+		snap.TopErrors = append(snap.TopErrors, statzErrorCount{errorType, count})
+	}
+	sort.Slice(snap.TopErrors, func(i, j int) bool {
+		if snap.TopErrors[i].Count != snap.TopErrors[j].Count {
+			return snap.TopErrors[i].Count > snap.TopErrors[j].Count
+		}
+		return snap.TopErrors[i].ErrorType < snap.TopErrors[j].ErrorType
+	})
+	if len(snap.TopErrors) > statzTopErrors {
+		snap.TopErrors = snap.TopErrors[:statzTopErrors]
+	}
+	return snap
+}
+
+// checkCoverage determines how many source backends are ready, see
+// ReadyzHandler.
+func checkCoverage() statzCoverage {
+	ctx, cancel := context.WithTimeout(context.Background(), *readinessTimeout)
+	defer cancel()
+	errs := common.CheckSourceBackends(ctx)
+	coverage := statzCoverage{SourceBackends: common.NumSourceBackends()}
+	coverage.Ready = coverage.SourceBackends - len(errs)
+	if coverage.SourceBackends > 0 {
+		coverage.Percent = 100 * float64(coverage.Ready) / float64(coverage.SourceBackends)
+	}
+	return coverage
+}
+
+// updateStatz discards samples older than -statz_window and updates the
+// statistics served on /statz.
+func updateStatz() {
+	coverage := checkCoverage()
+	now := time.Now()
+	statz.mu.Lock()
+	defer statz.mu.Unlock()
+	cutoff := now.Add(-*statzWindow - time.Hour)
+	kept := statz.samples[:0]
+	for _, s := range statz.samples {
+		if s.finished.After(cutoff) {
+			kept = append(kept, s)
+		}
+	}
+	statz.samples = kept
+	statz.snapshot = aggregateStatz(now, *statzWindow, statz.samples, coverage)
+}
+
+// startStatzAggregator updates the statistics served on /statz every
+// -statz_interval in the background.
+func startStatzAggregator() {
+	go func() {
+		updateStatz()
+		for range time.Tick(*statzInterval) {
+			updateStatz()
+		}
+	}()
+}
+
+// StatzHandler serves /statz, which shows public statistics about the queries
+// of the last -statz_window (as HTML, or as JSON with format=json). Unlike
+// /queryz, it does not show individual queries.
+func StatzHandler(w http.ResponseWriter, r *http.Request) {
+	statz.mu.Lock()
+	snap := statz.snapshot
+	statz.mu.Unlock()
+	if snap == nil {
+		http.Error(w, "Statistics are not yet available.", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(snap); err != nil {
+			log.Printf("Could not write /statz reply: %v\n", err)
+		}
+		return
+	}
+
+	if err := common.Templates.ExecuteTemplate(w, "statz.html", map[string]interface{}{
+		"statz": snap,
+		"i18n":  i18n.FromRequest(r),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAggregateStatz(t *testing.T) {
+	now := time.Date(2019, 3, 1, 12, 30, 0, 0, time.UTC)
+	samples := []statzSample{
+		// Outside of the window.
+		{finished: now.Add(-5 * time.Hour), duration: time.Hour},
+		{finished: now.Add(-2 * time.Hour), duration: 100 * time.Millisecond},
+		{finished: now.Add(-2 * time.Hour), duration: 3 * time.Second, errorType: errorTypeDeadline},
+		{finished: now.Add(-10 * time.Minute), duration: 200 * time.Millisecond, errorType: errorTypePartialResults},
+		{finished: now.Add(-10 * time.Minute), errorType: errorTypeInvalidQuery, refused: true},
+		{finished: now.Add(-5 * time.Minute), errorType: errorTypeInvalidQuery, refused: true},
+	}
+	coverage := statzCoverage{SourceBackends: 6, Ready: 6, Percent: 100}
+	snap := aggregateStatz(now, 3*time.Hour, samples, coverage)
+
+	if got, want := snap.Queries, 5; got != want {
+		t.Errorf("Queries = %d, want %d", got, want)
+	}
+	wantHours := []statzHour{
+		{Hour: time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC), Queries: 2, Failed: 1},
+		{Hour: time.Date(2019, 3, 1, 11, 0, 0, 0, time.UTC)},
+		{Hour: time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC), Queries: 3, Failed: 3},
+	}
+	if !reflect.DeepEqual(snap.Hours, wantHours) {
+		t.Errorf("Hours = %+v, want %+v", snap.Hours, wantHours)
+	}
+	// Refused queries do not count towards the latency.
+	if got, want := snap.MedianLatency, 200*time.Millisecond; got != want {
+		t.Errorf("MedianLatency = %v, want %v", got, want)
+	}
+	wantErrors := []statzErrorCount{
+		{errorTypeInvalidQuery, 2},
+		{errorTypeDeadline, 1},
+		{errorTypePartialResults, 1},
+	}
+	if !reflect.DeepEqual(snap.TopErrors, wantErrors) {
+		t.Errorf("TopErrors = %+v, want %+v", snap.TopErrors, wantErrors)
+	}
+	if snap.Coverage != coverage {
+		t.Errorf("Coverage = %+v, want %+v", snap.Coverage, coverage)
+	}
+}
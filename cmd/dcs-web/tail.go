@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+// /api/v1/tail/<queryid> streams the raw event log of a query for debugging
+// production queries: unlike /events/, it includes events which are obsoleted
+// before clients get to see them (e.g. all progress updates) and the replies
+// of each source backend, attributed to the backend.
+//
+// Nothing is recorded unless a tail is subscribed to the query, so tailing a
+// query only shows the events which are still stored when the tail starts
+// (Kind “replay”), followed by everything that happens afterwards.
+
+// tailBuffer is the number of entries buffered per tail. Entries are dropped
+// when a tail falls behind (e.g. on a slow connection), so that the query is
+// never slowed down.
+const tailBuffer = 1000
+
+// Values of the Kind field of TailEntry.
+const (
+	tailKindReplay    = "replay"
+	tailKindEvent     = "event"
+	tailKindObsoleted = "obsoleted"
+	tailKindBackend   = "backend"
+	tailKindDropped   = "dropped"
+)
+
+// TailEntry is one line of the NDJSON stream served by TailHandler.
+type TailEntry struct {
+	// Offset is the time since the query was started, measured using the
+	// monotonic clock. Time is the wall clock time of the entry.
+	Offset string
+	Time   time.Time
+
+	// Kind is “replay” for events stored before the tail started, “event”
+	// for events added afterwards, “obsoleted” when the event Sequence is
+	// removed (i.e. no longer sent to clients joining the query), “backend”
+	// for replies of source backend Backend and “dropped” when Dropped
+	// entries were dropped because the tail fell behind.
+	Kind string
+
+	// Sequence is the sequence number of the event (see addEvent).
+	Sequence *int `json:",omitempty"`
+
+	// Backend is the index of the source backend which sent the reply.
+	Backend *int `json:",omitempty"`
+
+	// Type is the type of the event (see timelineEventType) or of the
+	// backend reply (“match” or “progress”).
+	Type string `json:",omitempty"`
+
+	Dropped int `json:",omitempty"`
+
+	// Data is the event as sent to clients (empty for the done marker) or
+	// the backend reply.
+	Data json.RawMessage `json:",omitempty"`
+}
+
+type tailSubscriber struct {
+	entries chan TailEntry
+
+	// dropped is the number of entries dropped since the last dropped
+	// entry was sent. Guarded by tails.mu.
+	dropped int
+}
+
+var tails struct {
+	mu   sync.Mutex
+	subs map[string]map[*tailSubscriber]bool
+}
+
+func subscribeTail(queryid string) (*tailSubscriber, func()) {
+	sub := &tailSubscriber{entries: make(chan TailEntry, tailBuffer)}
+	tails.mu.Lock()
+	defer tails.mu.Unlock()
+	if tails.subs == nil {
+		tails.subs = make(map[string]map[*tailSubscriber]bool)
+	}
+	if tails.subs[queryid] == nil {
+		tails.subs[queryid] = make(map[*tailSubscriber]bool)
+	}
+	tails.subs[queryid][sub] = true
+	return sub, func() {
+		tails.mu.Lock()
+		defer tails.mu.Unlock()
+		delete(tails.subs[queryid], sub)
+		if len(tails.subs[queryid]) == 0 {
+			delete(tails.subs, queryid)
+		}
+	}
+}
+
+// publishTail sends the entry returned by entry to all tails of the query.
+// entry is only called if the query is tailed, so that queries which are not
+// tailed do not pay for encoding entries.
+func publishTail(queryid string, started time.Time, entry func() TailEntry) {
+	tails.mu.Lock()
+	defer tails.mu.Unlock()
+	subs := tails.subs[queryid]
+	if len(subs) == 0 {
+		return
+	}
+	e := entry()
+	e.Offset = elapsed(started).String()
+	e.Time = time.Now()
+	for sub := range subs {
+		if sub.dropped > 0 {
+			select {
+			case sub.entries <- TailEntry{Offset: e.Offset, Time: e.Time, Kind: tailKindDropped, Dropped: sub.dropped}:
+				sub.dropped = 0
+			default:
+				sub.dropped++
+				continue
+			}
+		}
+		select {
+		case sub.entries <- e:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// tailEvent publishes an event which was just added by addEvent. Must be
+// called with stateMu held.
+func tailEvent(queryid string, s *queryState, sequence int, data []byte, origdata interface{}) {
+	publishTail(queryid, s.started, func() TailEntry {
+		return TailEntry{
+			Kind:     tailKindEvent,
+			Sequence: &sequence,
+			Type:     timelineEventType(data, origdata),
+			Data:     data,
+		}
+	})
+}
+
+// tailObsoleted publishes that the event sequence was obsoleted. Must be
+// called with stateMu held.
+func tailObsoleted(queryid string, s *queryState, sequence int) {
+	publishTail(queryid, s.started, func() TailEntry {
+		return TailEntry{
+			Kind:     tailKindObsoleted,
+			Sequence: &sequence,
+		}
+	})
+}
+
+// tailBackendReply publishes a reply (a match or progress update) of the
+// source backend backendidx.
+func tailBackendReply(queryid string, started time.Time, backendidx int, typ string, reply interface{}) {
+	publishTail(queryid, started, func() TailEntry {
+		var buf bytes.Buffer
+		var err error
+		if match, ok := reply.(*sourcebackendpb.Match); ok {
+			err = WriteMatchJSON(match, &buf)
+		} else {
+			err = json.NewEncoder(&buf).Encode(reply)
+		}
+		if err != nil {
+			log.Printf("[%s] could not encode reply of backend %d for tail: %v\n", queryid, backendidx, err)
+		}
+		return TailEntry{
+			Kind:    tailKindBackend,
+			Backend: &backendidx,
+			Type:    typ,
+			Data:    bytes.TrimSpace(buf.Bytes()),
+		}
+	})
+}
+
+// TailHandler serves /api/v1/tail/<queryid>, the raw event log of a query as
+// newline-delimited TailEntry JSON objects (one per line), which are streamed
+// until the query is done, e.g. curl -N https://codesearch.debian.net/api/v1/tail/<queryid>.
+func TailHandler(w http.ResponseWriter, r *http.Request) {
+	queryid := strings.TrimPrefix(r.URL.Path, "/api/v1/tail/")
+	if queryid == "" || strings.Contains(queryid, "/") || queryid == adminQueryId {
+		http.Error(w, "Invalid query id.", http.StatusBadRequest)
+		return
+	}
+	if !checkTenant(w, r, queryid) {
+		return
+	}
+	if proxyToOwner(w, r, queryid, TailHandler) {
+		return
+	}
+
+	// Subscribe before taking the snapshot of stored events: events are
+	// published with stateMu held, so every event is either part of the
+	// snapshot or published to the tail.
+	sub, unsubscribe := subscribeTail(queryid)
+	defer unsubscribe()
+
+	stateMu.RLock()
+	s, ok := state[queryid]
+	if !ok {
+		stateMu.RUnlock()
+		http.Error(w, "No such query.", http.StatusNotFound)
+		return
+	}
+	done := s.done
+	replay := make([]TailEntry, 0, len(s.events))
+	lastseen := -1
+	for _, ev := range s.events {
+		sequence := ev.sequence
+		var origdata interface{}
+		if ev.original != nil {
+			origdata = ev.original
+		}
+		replay = append(replay, TailEntry{
+			Kind:     tailKindReplay,
+			Sequence: &sequence,
+			Type:     timelineEventType(ev.data, origdata),
+			Data:     ev.data,
+		})
+		lastseen = sequence
+	}
+	started := s.started
+	stateMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-store")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	write := func(e TailEntry) bool {
+		if e.Offset == "" {
+			e.Offset = elapsed(started).String()
+			e.Time = time.Now()
+		}
+		if err := enc.Encode(&e); err != nil {
+			log.Printf("[%s] aborting tail, could not write: %v\n", queryid, err)
+			return false
+		}
+		return true
+	}
+	for _, e := range replay {
+		if !write(e) {
+			return
+		}
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	if done {
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-sub.entries:
+			if e.Kind == tailKindEvent && *e.Sequence <= lastseen {
+				continue
+			}
+			if !write(e) {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			if e.Kind == tailKindEvent && len(e.Data) == 0 {
+				// The done marker.
+				return
+			}
+		}
+	}
+}
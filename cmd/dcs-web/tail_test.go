@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+func TestTail(t *testing.T) {
+	const queryid = "tail"
+	defer newTestQuery(queryid)()
+
+	progress := func(processed int) *ProgressUpdate {
+		return &ProgressUpdate{
+			Type:           "progress",
+			QueryId:        queryid,
+			FilesProcessed: processed,
+			FilesTotal:     10,
+		}
+	}
+	addEventMarshal(queryid, progress(1)) // sequence 0, obsoleted by 1
+	addEventMarshal(queryid, progress(2)) // sequence 1
+
+	ts := httptest.NewServer(http.HandlerFunc(TailHandler))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/api/v1/tail/" + queryid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "application/x-ndjson"; got != want {
+		t.Errorf("unexpected Content-Type: got %q, want %q", got, want)
+	}
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	var got []string
+	next := func() {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("stream ended prematurely, got %q", got)
+			}
+			var e TailEntry
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("%v (line: %s)", err, line)
+			}
+			desc := e.Kind
+			if e.Sequence != nil {
+				desc += fmt.Sprintf(":%d", *e.Sequence)
+			}
+			if e.Backend != nil {
+				desc += fmt.Sprintf(":src%d", *e.Backend)
+			}
+			if e.Type != "" {
+				desc += ":" + e.Type
+			}
+			got = append(got, desc)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for tail entry, got %q", got)
+		}
+	}
+
+	// Only the events which are still stored are replayed.
+	next()
+
+	// Once the replay was received, the tail is subscribed.
+	tailBackendReply(queryid, time.Now(), 1, "progress", &sourcebackendpb.ProgressUpdate{FilesProcessed: 3, FilesTotal: 5})
+	addEventMarshal(queryid, progress(3)) // sequence 2, obsoletes 1
+	addEvent(queryid, []byte{}, nil)      // sequence 3
+	for i := 0; i < 4; i++ {
+		next()
+	}
+	if _, ok := <-lines; ok {
+		t.Errorf("stream did not end after the done marker")
+	}
+
+	want := []string{
+		"replay:1:progress",
+		"backend:src1:progress",
+		"event:2:progress",
+		"obsoleted:1",
+		"event:3:done",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("unexpected tail entries: got %q, want %q", got, want)
+	}
+
+	// Finished queries are replayed without waiting.
+	rec := httptest.NewRecorder()
+	TailHandler(rec, httptest.NewRequest("GET", "/api/v1/tail/"+queryid, nil))
+	if got, want := strings.Count(rec.Body.String(), "\n"), 2; got != want {
+		t.Errorf("finished query: got %d entries, want %d (body: %s)", got, want, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	TailHandler(rec, httptest.NewRequest("GET", "/api/v1/tail/nonexistent", nil))
+	if got, want := rec.Code, http.StatusNotFound; got != want {
+		t.Errorf("nonexistent query: unexpected HTTP status: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	tenantsPath = flag.String("tenants_path",
+		"",
+		"Path to a JSON file defining tenants (a list of objects with Name, Keys, MaxConcurrentQueries, QueriesPerMinute and MaxQueryResultBytes). Queries sent with one of a tenant’s API keys (X-Dcs-Api-Key header) run in the tenant’s namespace: their query ids and result directories are prefixed with the tenant name, their results are only served to requests with one of the tenant’s keys, and the tenant’s limits apply. Queries without an API key are not affected")
+
+	tenantQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tenant_queries",
+			Help: "Number of queries sent with the API key of a tenant (see -tenants_path), by tenant and outcome (started, ratelimited or concurrency).",
+		},
+		[]string{"tenant", "outcome"})
+
+	tenantResultBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tenant_result_bytes",
+			Help: "Size of the (serialized) results of finished queries of a tenant (see -tenants_path), by tenant.",
+		},
+		[]string{"tenant"})
+)
+
+func init() {
+	prometheus.MustRegister(tenantQueries)
+	prometheus.MustRegister(tenantResultBytes)
+}
+
+// apiKeyHeader is the header in which clients send their API key.
+const apiKeyHeader = "X-Dcs-Api-Key"
+
+// tenantSeparator separates the tenant name from the query id proper. Query
+// ids are hexadecimal (see queryIdentifier), optionally followed by “-” and
+// more hexadecimal digits (see refinedQueryId), so the separator cannot occur
+// in query ids of queries without a tenant.
+const tenantSeparator = "."
+
+var tenantNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+var (
+	errUnknownAPIKey         = errors.New("unknown API key")
+	errTenantRateLimited     = errors.New("tenant exceeds its QueriesPerMinute")
+	errTenantConcurrentLimit = errors.New("tenant exceeds its MaxConcurrentQueries")
+)
+
+// A tenant is a namespace for the queries of a group of API clients (e.g. a
+// team), with its own limits. Zero limits mean that the global limits apply.
+type tenant struct {
+	Name string
+
+	// Keys are the API keys of the tenant.
+	Keys []string
+
+	// MaxConcurrentQueries is the maximum number of running queries of the
+	// tenant. Further queries are refused.
+	MaxConcurrentQueries int
+
+	// QueriesPerMinute is the maximum number of queries the tenant can
+	// start per minute. Further queries are refused.
+	QueriesPerMinute int
+
+	// MaxQueryResultBytes replaces -max_query_result_bytes for queries of
+	// the tenant.
+	MaxQueryResultBytes int64
+
+	// rateMu protects windowStart and windowQueries, which implement
+	// QueriesPerMinute.
+	rateMu        sync.Mutex
+	windowStart   time.Time
+	windowQueries int
+}
+
+var (
+	tenantsMu sync.RWMutex
+	// tenantsByKey and tenantsByName are set by loadTenants.
+	tenantsByKey  map[string]*tenant
+	tenantsByName map[string]*tenant
+)
+
+// loadTenants loads the tenants from the JSON file at path, if non-empty.
+func loadTenants(path string) error {
+	byKey := make(map[string]*tenant)
+	byName := make(map[string]*tenant)
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var loaded []*tenant
+		if err := json.NewDecoder(f).Decode(&loaded); err != nil {
+			return fmt.Errorf("could not decode %q: %v", path, err)
+		}
+		for _, t := range loaded {
+			if !tenantNameRe.MatchString(t.Name) {
+				return fmt.Errorf("%q: tenant name %q must consist of lower-case letters, digits and dashes", path, t.Name)
+			}
+			if _, ok := byName[t.Name]; ok {
+				return fmt.Errorf("%q: duplicate tenant %q", path, t.Name)
+			}
+			if len(t.Keys) == 0 {
+				return fmt.Errorf("%q: tenant %q has no Keys", path, t.Name)
+			}
+			for _, key := range t.Keys {
+				if other, ok := byKey[key]; ok {
+					return fmt.Errorf("%q: tenants %q and %q share an API key", path, other.Name, t.Name)
+				}
+				byKey[key] = t
+			}
+			byName[t.Name] = t
+		}
+	}
+	tenantsMu.Lock()
+	defer tenantsMu.Unlock()
+	tenantsByKey = byKey
+	tenantsByName = byName
+	return nil
+}
+
+// tenantFromRequest returns the tenant whose API key r carries, or nil if r
+// does not carry an API key.
+func tenantFromRequest(r *http.Request) (*tenant, error) {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return nil, nil
+	}
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	t, ok := tenantsByKey[key]
+	if !ok {
+		return nil, errUnknownAPIKey
+	}
+	return t, nil
+}
+
+// tenantNamed returns the tenant called name, or nil.
+func tenantNamed(name string) *tenant {
+	if name == "" {
+		return nil
+	}
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	return tenantsByName[name]
+}
+
+// tenantQueryIdentifier is like queryIdentifier, but places queries of
+// tenant t (if non-nil) in the tenant’s namespace.
+func tenantQueryIdentifier(t *tenant, q string) string {
+	if t == nil {
+		return queryIdentifier(q)
+	}
+	return t.Name + tenantSeparator + queryIdentifier(q)
+}
+
+// tenantOf returns the name of the tenant in whose namespace queryid is, or
+// the empty string.
+func tenantOf(queryid string) string {
+	if idx := strings.Index(queryid, tenantSeparator); idx > -1 {
+		return queryid[:idx]
+	}
+	return ""
+}
+
+// admitTenantQuery returns an error if tenant t (if non-nil) must not start
+// the query queryid right now. Queries which already exist (e.g. are still
+// running, or were cached) are always admitted.
+func admitTenantQuery(t *tenant, queryid string) error {
+	if t == nil || queryExists(queryid) {
+		return nil
+	}
+	if t.MaxConcurrentQueries > 0 {
+		running := 0
+		stateMu.RLock()
+		for id, s := range state {
+			if !s.done && tenantOf(id) == t.Name {
+				running++
+			}
+		}
+		stateMu.RUnlock()
+		if running >= t.MaxConcurrentQueries {
+			tenantQueries.WithLabelValues(t.Name, "concurrency").Inc()
+			return errTenantConcurrentLimit
+		}
+	}
+	if t.QueriesPerMinute > 0 {
+		t.rateMu.Lock()
+		defer t.rateMu.Unlock()
+		if time.Since(t.windowStart) >= time.Minute {
+			t.windowStart = time.Now()
+			t.windowQueries = 0
+		}
+		if t.windowQueries >= t.QueriesPerMinute {
+			tenantQueries.WithLabelValues(t.Name, "ratelimited").Inc()
+			return errTenantRateLimited
+		}
+		t.windowQueries++
+	}
+	tenantQueries.WithLabelValues(t.Name, "started").Inc()
+	return nil
+}
+
+// maxResultBytesFor returns the limit on the size of the results of queryid,
+// see -max_query_result_bytes and tenant.MaxQueryResultBytes.
+func maxResultBytesFor(queryid string) int64 {
+	if t := tenantNamed(tenantOf(queryid)); t != nil && t.MaxQueryResultBytes > 0 {
+		return t.MaxQueryResultBytes
+	}
+	return *maxQueryResultBytes
+}
+
+// checkTenant replies with an error (returning false) unless the request may
+// access the results of queryid, i.e. carries an API key of the tenant in
+// whose namespace queryid is (or none, for queries without a tenant).
+func checkTenant(w http.ResponseWriter, r *http.Request, queryid string) bool {
+	t, err := tenantFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unknown API key.", http.StatusUnauthorized)
+		return false
+	}
+	name := ""
+	if t != nil {
+		name = t.Name
+	}
+	if tenantOf(queryid) != "" {
+		// Results are cacheable (see startJsonResponse), but must not be
+		// served from caches to other tenants.
+		w.Header().Add("Vary", apiKeyHeader)
+	}
+	if tenantOf(queryid) != name {
+		// Queries of other tenants are indistinguishable from queries
+		// which do not exist.
+		http.Error(w, "No such query.", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// rejectAPIKey replies with an error (returning true) if the request carries
+// an API key. Endpoints which only run queries without a tenant, e.g. presets
+// (which are shared by all clients), use it so that tenants do not
+// unknowingly bypass their namespace and limits.
+func rejectAPIKey(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get(apiKeyHeader) == "" {
+		return false
+	}
+	http.Error(w, "API keys are not supported by this endpoint.", http.StatusBadRequest)
+	return true
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Debian/dcs/internal/proto/dcspb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func writeTenants(t *testing.T, contents string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dcs-tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "tenants.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTenantsInvalid(t *testing.T) {
+	for _, contents := range []string{
+		`[{"Name": "Team A", "Keys": ["a"]}]`,
+		`[{"Name": "team.a", "Keys": ["a"]}]`,
+		`[{"Name": "team-a"}]`,
+		`[{"Name": "team-a", "Keys": ["a"]}, {"Name": "team-a", "Keys": ["b"]}]`,
+		`[{"Name": "team-a", "Keys": ["a"]}, {"Name": "team-b", "Keys": ["a"]}]`,
+	} {
+		path := writeTenants(t, contents)
+		defer os.RemoveAll(filepath.Dir(path))
+		if err := loadTenants(path); err == nil {
+			t.Errorf("loadTenants(%s) unexpectedly succeeded", contents)
+		}
+	}
+}
+
+func TestTenants(t *testing.T) {
+	path := writeTenants(t, `[{"Name": "team-a", "Keys": ["secret-a"], "QueriesPerMinute": 2}]`)
+	defer os.RemoveAll(filepath.Dir(path))
+	if err := loadTenants(path); err != nil {
+		t.Fatal(err)
+	}
+	defer loadTenants("")
+
+	req := httptest.NewRequest("GET", "/events/", nil)
+	if tenant, err := tenantFromRequest(req); tenant != nil || err != nil {
+		t.Fatalf("tenantFromRequest(no key) = %v, %v, want nil, nil", tenant, err)
+	}
+	req.Header.Set(apiKeyHeader, "wrong")
+	if _, err := tenantFromRequest(req); err != errUnknownAPIKey {
+		t.Fatalf("tenantFromRequest(wrong key) = %v, want %v", err, errUnknownAPIKey)
+	}
+	req.Header.Set(apiKeyHeader, "secret-a")
+	tenant, err := tenantFromRequest(req)
+	if err != nil || tenant == nil || tenant.Name != "team-a" {
+		t.Fatalf("tenantFromRequest(secret-a) = %v, %v, want team-a", tenant, err)
+	}
+
+	queryid := tenantQueryIdentifier(tenant, "q=main&literal=0")
+	if got, want := queryid, "team-a."+queryIdentifier("q=main&literal=0"); got != want {
+		t.Errorf("tenantQueryIdentifier = %q, want %q", got, want)
+	}
+	if got, want := tenantOf(queryid), "team-a"; got != want {
+		t.Errorf("tenantOf(%q) = %q, want %q", queryid, got, want)
+	}
+	if got := tenantOf(queryIdentifier("q=main&literal=0")); got != "" {
+		t.Errorf("tenantOf(query without tenant) = %q, want empty", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := admitTenantQuery(tenant, queryid); err != nil {
+			t.Fatalf("admitTenantQuery #%d: %v", i, err)
+		}
+	}
+	if err := admitTenantQuery(tenant, queryid); err != errTenantRateLimited {
+		t.Fatalf("admitTenantQuery = %v, want %v", err, errTenantRateLimited)
+	}
+	if got, want := errorTypeFor(errTenantRateLimited), errorTypeTenantLimit; got != want {
+		t.Errorf("errorTypeFor = %q, want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		key     string
+		queryid string
+		want    bool
+		code    int
+	}{
+		{"secret-a", queryid, true, http.StatusOK},
+		{"", queryid, false, http.StatusNotFound},
+		{"secret-a", "0123abcd", false, http.StatusNotFound},
+		{"", "0123abcd", true, http.StatusOK},
+		{"wrong", "0123abcd", false, http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/results/"+tt.queryid+"/page_0.json", nil)
+		if tt.key != "" {
+			req.Header.Set(apiKeyHeader, tt.key)
+		}
+		rec := httptest.NewRecorder()
+		if got := checkTenant(rec, req, tt.queryid); got != tt.want || rec.Code != tt.code {
+			t.Errorf("checkTenant(key %q, %q) = %v (HTTP %d), want %v (HTTP %d)", tt.key, tt.queryid, got, rec.Code, tt.want, tt.code)
+		}
+	}
+
+	// Debug bundles contain the rewritten query, the event log and the
+	// result pointers, so they must not be served to other tenants either.
+	for _, tt := range []struct {
+		key  string
+		code int
+	}{
+		{"", http.StatusNotFound},
+		{"wrong", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/api/v1/debug/"+queryid, nil)
+		if tt.key != "" {
+			req.Header.Set(apiKeyHeader, tt.key)
+		}
+		rec := httptest.NewRecorder()
+		DebugBundleHandler(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("DebugBundleHandler(key %q, %q) = HTTP %d, want HTTP %d", tt.key, queryid, rec.Code, tt.code)
+		}
+	}
+
+	// Bookmarks contain the query, so other tenants must not bookmark it.
+	form := "token=0123456789abcdef&queryid=" + queryid + "&fingerprint=x"
+	req = httptest.NewRequest("POST", "/api/v1/bookmarks", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	BookmarksHandler(rec, req)
+	if got, want := rec.Code, http.StatusNotFound; got != want {
+		t.Errorf("BookmarksHandler(POST without key, %q) = HTTP %d, want HTTP %d", queryid, got, want)
+	}
+}
+
+func TestTenantlessEndpoints(t *testing.T) {
+	path := writeTenants(t, `[{"Name": "team-a", "Keys": ["secret-a"]}]`)
+	defer os.RemoveAll(filepath.Dir(path))
+	if err := loadTenants(path); err != nil {
+		t.Fatal(err)
+	}
+	defer loadTenants("")
+
+	for _, tt := range []struct {
+		handler http.HandlerFunc
+		path    string
+		key     string
+		code    int
+	}{
+		// Presets are shared, so they refuse API keys.
+		{PresetsHandler, "/api/v1/presets/example", "secret-a", http.StatusBadRequest},
+		{PresetsHandler, "/api/v1/presets/example/feed", "secret-a", http.StatusBadRequest},
+		// OpenSearch and server-rendered searches are tenant-scoped.
+		{OpenSearchHandler, "/opensearch?q=main", "wrong", http.StatusUnauthorized},
+		{Search, "/search?q=main", "wrong", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set(apiKeyHeader, tt.key)
+		rec := httptest.NewRecorder()
+		tt.handler(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s with key %q: HTTP %d, want HTTP %d", tt.path, tt.key, rec.Code, tt.code)
+		}
+	}
+
+	// gRPC clients cannot authenticate, so API keys are refused, too.
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(apiKeyHeader, "secret-a"))
+	err := (&server{}).Search(&dcspb.SearchRequest{Query: "main"}, &fakeSearchServer{ctx: ctx})
+	if got, want := status.Code(err), codes.InvalidArgument; got != want {
+		t.Errorf("gRPC Search with API key = %v, want code %v", err, want)
+	}
+}
+
+// fakeSearchServer is a dcspb.DCS_SearchServer whose stream has the specified
+// context. Sending events is not implemented.
+type fakeSearchServer struct {
+	dcspb.DCS_SearchServer
+	ctx context.Context
+}
+
+func (f *fakeSearchServer) Context() context.Context { return f.ctx }
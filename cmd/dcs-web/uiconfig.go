@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// uiConfig contains the server-side settings which static/instant.js needs to
+// paginate results. It is served at /api/v1/uiconfig and injected into the
+// HTML templates as uiconfig, so that changing e.g. -results_per_package does
+// not require changing the JavaScript.
+type uiConfig struct {
+	PackagesPerPage   int
+	ResultsPerPackage int
+	ResultsPerPage    int
+}
+
+func currentUIConfig() uiConfig {
+	return uiConfig{
+		PackagesPerPage:   *packagesPerPage,
+		ResultsPerPackage: *resultsPerPackage,
+		ResultsPerPage:    *resultsPerPage,
+	}
+}
+
+// UIConfigHandler serves /api/v1/uiconfig.
+func UIConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// The values only change when dcs-web is reconfigured, but clients
+	// should pick up changes quickly when that happens.
+	w.Header().Set("Cache-Control", "max-age=60, public")
+	if err := json.NewEncoder(w).Encode(currentUIConfig()); err != nil {
+		log.Printf("Could not write uiconfig reply: %v\n", err)
+	}
+}
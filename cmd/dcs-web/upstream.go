@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// packageUpstream returns the upstream project of the source package pkg
+// (e.g. “github.com/i3/i3”), as determined by dcs-compute-ranking, or the
+// empty string if unknown.
+func packageUpstream(pkg string) string {
+	return lookupMetadata(pkg).Upstream
+}
+
+// upstreamGroup is a set of source packages which share an upstream project.
+type upstreamGroup struct {
+	// upstream is empty for packages whose upstream is unknown, which form
+	// a group of their own.
+	upstream string
+	packages []string
+}
+
+// groupByUpstream groups packages (sorted by ranking) by their upstream
+// project. Groups are sorted by their highest-ranked package.
+func groupByUpstream(packages []string) []upstreamGroup {
+	var groups []upstreamGroup
+	byUpstream := make(map[string]int)
+	for _, pkg := range packages {
+		upstream := packageUpstream(pkg)
+		if upstream == "" {
+			groups = append(groups, upstreamGroup{packages: []string{pkg}})
+			continue
+		}
+		idx, ok := byUpstream[upstream]
+		if !ok {
+			idx = len(groups)
+			byUpstream[upstream] = idx
+			groups = append(groups, upstreamGroup{upstream: upstream})
+		}
+		groups[idx].packages = append(groups[idx].packages, pkg)
+	}
+	return groups
+}
+
+// PerUpstreamResults is an element of the JSON array of per-upstream results
+// (see writePerUpstreamResults).
+type PerUpstreamResults struct {
+	// Upstream is the upstream project, e.g. “github.com/i3/i3”, or empty
+	// if the upstream of the (single) package is unknown.
+	Upstream string
+
+	// Packages are the source packages of the upstream project which
+	// contain results, highest-ranked first.
+	Packages []string
+
+	// Results are the highest-ranked results within all Packages, as on
+	// result pages.
+	Results json.RawMessage
+
+	// TotalResults is the number of results within all Packages, of which
+	// ShownResults are included in Results.
+	TotalResults int
+	ShownResults int
+
+	Ranking RankingSummary
+}
+
+// writePerUpstreamResults is like writePerPkgResults, but rolls up the
+// results of source packages which share an upstream project (groupby=upstream
+// parameter): each element contains up to perPackage results of all packages
+// of an upstream project. Pages contain -packages_per_page upstream projects.
+func writePerUpstreamResults(queryid string, page, perPackage int, results io.Writer, w http.ResponseWriter, r *http.Request) error {
+	s := state[queryid]
+	groups := groupByUpstream(s.allPackagesSorted)
+
+	pages := int(math.Ceil(float64(len(groups)) / float64(*packagesPerPage)))
+	if page > pages {
+		http.Error(w, "No such page.", http.StatusNotFound)
+		return nil
+	}
+	start := page * *packagesPerPage
+	end := (page + 1) * *packagesPerPage
+	if end > len(groups) {
+		end = len(groups)
+	}
+
+	// Unlike per-package pages, there is no ETag: the grouping depends on
+	// the metadata (see -metadata_path), not only on the results.
+	isJSON := strings.HasSuffix(r.URL.Path, ".json")
+	elements := make([]PerUpstreamResults, end-start)
+	perGroup := make([][]resultPointer, end-start)
+	var all []resultPointer
+	for idx, g := range groups[start:end] {
+		var retained []resultPointer
+		total := 0
+		for _, pkg := range g.packages {
+			retained = append(retained, s.resultPointersByPkg[pkg]...)
+			total += s.facets.Packages[pkg]
+		}
+		sort.Stable(pointerByRanking(retained))
+		pointers := retained
+		if len(pointers) > perPackage {
+			pointers = pointers[:perPackage]
+		}
+		perGroup[idx] = pointers
+		all = append(all, pointers...)
+		elements[idx] = PerUpstreamResults{
+			Upstream:     g.upstream,
+			Packages:     g.packages,
+			TotalResults: total,
+			ShownResults: len(pointers),
+			Ranking:      summarizeRankings(retained),
+		}
+	}
+	if err := validatePointers(queryid, all); err != nil {
+		markQueryCorrupt(queryid, err)
+		return fmt.Errorf("Could not return results, please retry the query: %v", err)
+	}
+	if isJSON {
+		startJsonResponse(w)
+	}
+
+	bw := bufio.NewWriter(results)
+	enc := json.NewEncoder(bw)
+	// Matches are HTML-escaped by the source backends already.
+	enc.SetEscapeHTML(false)
+	bw.WriteString("[")
+	for idx := range elements {
+		if idx > 0 {
+			bw.WriteString(",")
+		}
+		var buf bytes.Buffer
+		if err := writeFromPointers(queryid, &buf, perGroup[idx]); err != nil {
+			markQueryCorrupt(queryid, err)
+			if results == io.Writer(w) && idx > 0 {
+				// See writePerPkgResults.
+				log.Printf("[%s] aborting per-upstream page %d: %v\n", queryid, page, err)
+				panic(http.ErrAbortHandler)
+			}
+			return fmt.Errorf("Could not return results, please retry the query: %v", err)
+		}
+		elements[idx].Results = buf.Bytes()
+		if err := enc.Encode(&elements[idx]); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("]")
+	return bw.Flush()
+}
+
+// groupedResultsWriter returns the function writing per-package results
+// grouped as specified by the groupby parameter (package or upstream).
+func groupedResultsWriter(r *http.Request) (func(queryid string, page, perPackage int, results io.Writer, w http.ResponseWriter, r *http.Request) error, error) {
+	switch r.FormValue("groupby") {
+	case "", "package":
+		return writePerPkgResults, nil
+	case "upstream":
+		return writePerUpstreamResults, nil
+	default:
+		return nil, fmt.Errorf("groupby must be package or upstream")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func useUpstreamMetadata(t *testing.T) func() {
+	tmp, err := ioutil.TempDir("", "dcs-upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tmp, "metadata.json")
+	const contents = `{
+  "i3-wm": {"Upstream": "github.com/i3/i3", "Description": "improved dynamic tiling window manager", "Section": "x11", "Homepage": "https://i3wm.org/"},
+  "i3-wm-legacy": {"Upstream": "github.com/i3/i3"},
+  "zsh": {"Maintainers": ["Debian Zsh Maintainers <pkg-zsh-devel@lists.alioth.debian.org>"]}
+}`
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadMetadata(path); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		loadMetadata(filepath.Join(tmp, "nonexistent.json"))
+		os.RemoveAll(tmp)
+	}
+}
+
+func TestGroupByUpstream(t *testing.T) {
+	defer useUpstreamMetadata(t)()
+
+	got := groupByUpstream([]string{"i3-wm", "zsh", "unknown", "i3-wm-legacy"})
+	want := []upstreamGroup{
+		{upstream: "github.com/i3/i3", packages: []string{"i3-wm", "i3-wm-legacy"}},
+		{packages: []string{"zsh"}},
+		{packages: []string{"unknown"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("groupByUpstream = %+v, want %+v", got, want)
+	}
+}
+
+func TestPerUpstreamResults(t *testing.T) {
+	defer useUpstreamMetadata(t)()
+	defer useFakeBackends(t,
+		newFakeBackend(
+			"i3-wm_4.8-1/i3bar/src/main.c",
+			"zsh_5.8-1/Src/main.c",
+			"i3-wm-legacy_3.0-1/src/main.c"),
+	)()
+
+	queryid, cleanup := runQuery(t, "q=main&literal=1")
+	defer cleanup()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/perpackage-results/"+queryid+"/2/page_0.json?groupby=upstream", nil)
+	PerPackageResultsHandler(rec, req)
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("unexpected HTTP status: got %d, want %d (body: %s)", got, want, rec.Body.String())
+	}
+	var results []struct {
+		Upstream     string
+		Packages     []string
+		ShownResults int
+		Results      []struct {
+			Path string `json:"path"`
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("%v (body: %s)", err, rec.Body.String())
+	}
+	if got, want := len(results), 2; got != want {
+		t.Fatalf("got %d groups, want %d (body: %s)", got, want, rec.Body.String())
+	}
+	i3 := results[0]
+	if got, want := i3.Upstream, "github.com/i3/i3"; got != want {
+		t.Errorf("Upstream = %q, want %q", got, want)
+	}
+	if got, want := i3.Packages, []string{"i3-wm", "i3-wm-legacy"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Packages = %q, want %q", got, want)
+	}
+	if got, want := i3.ShownResults, 2; got != want {
+		t.Errorf("ShownResults = %d, want %d", got, want)
+	}
+	if got, want := results[1].Packages, []string{"zsh"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Packages = %q, want %q", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	PerPackageResultsHandler(rec, httptest.NewRequest("GET", "/perpackage-results/"+queryid+"/2/page_0.json?groupby=maintainer", nil))
+	if got, want := rec.Code, http.StatusBadRequest; got != want {
+		t.Errorf("groupby=maintainer: unexpected HTTP status: got %d, want %d", got, want)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"io"
 
+	"github.com/Debian/dcs/cmd/dcs-web/common"
 	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
 )
 
@@ -206,6 +207,188 @@ func WriteMatchJSON(match *sourcebackendpb.Match, w io.Writer) error {
 			return err
 		}
 	}
+	if match.Origin != "" {
+		_, err = b.WriteString(",\"origin\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(match.Origin)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	if match.Version != "" {
+		_, err = b.WriteString(",\"version\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(match.Version)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(",\"sources_url\":")
+	if err != nil {
+		return err
+	}
+	buf, err = json.Marshal(common.SourcesURL(match.Path, match.Version, int(match.Line)))
+	if err != nil {
+		return err
+	}
+	_, err = b.Write(buf)
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString(",\"fingerprint\":")
+	if err != nil {
+		return err
+	}
+	buf, err = json.Marshal(matchFingerprint(match))
+	if err != nil {
+		return err
+	}
+	_, err = b.Write(buf)
+	if err != nil {
+		return err
+	}
+	if match.License != "" {
+		_, err = b.WriteString(",\"license\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(match.License)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	if len(match.BinaryPackages) > 0 {
+		_, err = b.WriteString(",\"binary_packages\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(match.BinaryPackages)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	if match.FileMatchesOmitted > 0 {
+		_, err = b.WriteString(",\"file_matches_omitted\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(match.FileMatchesOmitted)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	if match.Encoding != "" {
+		_, err = b.WriteString(",\"encoding\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(match.Encoding)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	if match.Compression != "" {
+		_, err = b.WriteString(",\"compression\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(match.Compression)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	// Size and Mtime are 0 if the index contains no file metadata.
+	if match.Size > 0 {
+		_, err = b.WriteString(",\"size\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(match.Size)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+		_, err = b.WriteString(",\"mtime\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(match.Mtime)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	if match.ContextLength > 0 {
+		_, err = b.WriteString(",\"context_length\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(match.ContextLength)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	if len(match.HighlightRanges) > 0 {
+		_, err = b.WriteString(",\"highlight_ranges\":")
+		if err != nil {
+			return err
+		}
+		// Encoded as [[start, end], …] for compactness, see dcsregexp.Range.
+		ranges := make([][2]uint32, len(match.HighlightRanges))
+		for idx, r := range match.HighlightRanges {
+			ranges[idx] = [2]uint32{r.Start, r.End}
+		}
+		buf, err = json.Marshal(ranges)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
 	err = b.WriteByte('}')
 	if err != nil {
 		return err
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/Debian/dcs/internal/sourcebackend"
+)
+
+var xrefTimeout = flag.Duration("xref_timeout",
+	10*time.Second,
+	"How long to wait for the source backends’ replies to /api/v1/xref requests")
+
+// XrefHandler serves /api/v1/xref?include=<include>[&snapshot=…], which
+// returns the packages and files that include or import the specified header
+// or module (e.g. “stdio.h” or “os/exec”), as recorded at import time. In
+// contrast to searching for #include lines, commented out includes are not
+// returned, and no regular expression needs to be crafted per language.
+func XrefHandler(w http.ResponseWriter, r *http.Request) {
+	include := r.FormValue("include")
+	if include == "" {
+		http.Error(w, "The include parameter must be specified.", http.StatusBadRequest)
+		return
+	}
+	backends := common.SourceBackendsFor(r.FormValue("snapshot"))
+	if backends == nil {
+		http.Error(w, "Unknown snapshot", http.StatusNotFound)
+		return
+	}
+
+	for idx, backend := range backends {
+		if !common.CapabilitiesOf(backend).Has(sourcebackend.CapabilityXref) {
+			http.Error(w, fmt.Sprintf("Source backend %d does not support cross-references.", idx), http.StatusNotImplemented)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), *xrefTimeout)
+	defer cancel()
+	req := &sourcebackendpb.XrefRequest{Include: include}
+	var (
+		mu       sync.Mutex
+		files    []string
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for idx, backend := range backends {
+		wg.Add(1)
+		go func(idx int, backend sourcebackendpb.SourceBackendClient) {
+			defer wg.Done()
+			reply, err := backend.Xref(ctx, req)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("[src:%d] Xref(%q): %v\n", idx, include, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			files = append(files, reply.Path...)
+		}(idx, backend)
+	}
+	wg.Wait()
+	// Incomplete results would be indistinguishable from complete ones.
+	if firstErr != nil {
+		http.Error(w, fmt.Sprintf("Could not query all source backends: %v", firstErr), http.StatusInternalServerError)
+		return
+	}
+
+	sort.Strings(files)
+	packages := []string{}
+	for _, file := range files {
+		pkg := file
+		if idx := strings.Index(file, "/"); idx > -1 {
+			pkg = file[:idx]
+		}
+		if len(packages) == 0 || packages[len(packages)-1] != pkg {
+			packages = append(packages, pkg)
+		}
+	}
+	if files == nil {
+		files = []string{}
+	}
+
+	startJsonResponse(w)
+	if err := json.NewEncoder(w).Encode(struct {
+		Include  string
+		Packages []string
+		Files    []string
+	}{include, packages, files}); err != nil {
+		log.Printf("Could not write xref reply: %v\n", err)
+	}
+}
@@ -7,11 +7,11 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"strings"
 
 	"github.com/Debian/dcs/internal/addrfd"
+	"github.com/Debian/dcs/internal/socketactivation"
 	"github.com/grpc-ecosystem/go-grpc-middleware/tracing/opentracing"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/trace"
@@ -24,8 +24,30 @@ var (
 	requireClientAuth = flag.Bool("tls_require_client_auth",
 		true,
 		"Require TLS Client Authentication")
+
+	caPath = flag.String("tls_ca_path",
+		"",
+		"Path to a .pem file containing the CA certificates which sign the certificates of all peers, i.e. the server certificates (when dialing) and the client certificates (when serving, see -tls_require_client_auth). Empty means that all peers share the certificate of -tls_cert_path")
 )
 
+// certPool returns the certificates which the certificates of peers must be
+// signed by: those of -tls_ca_path, or the (self-signed) certFile.
+func certPool(certFile string) (*x509.CertPool, error) {
+	path := certFile
+	if *caPath != "" {
+		path = *caPath
+	}
+	roots := x509.NewCertPool()
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !roots.AppendCertsFromPEM(contents) {
+		return nil, fmt.Errorf("Could not parse %q as PEM file (contents: %q)", path, contents)
+	}
+	return roots, nil
+}
+
 func init() {
 	// Disable grpc tracing until
 	// https://github.com/grpc/grpc-go/issues/695 is fixed.
@@ -51,14 +73,10 @@ func DialTLS(addr, certFile, keyFile string, opts ...grpc.DialOption) (*grpc.Cli
 	if err != nil {
 		return nil, err
 	}
-	roots := x509.NewCertPool()
-	contents, err := ioutil.ReadFile(certFile)
+	roots, err := certPool(certFile)
 	if err != nil {
 		return nil, err
 	}
-	if !roots.AppendCertsFromPEM(contents) {
-		return nil, fmt.Errorf("Could not parse %q as PEM file (contents: %q)", certFile, contents)
-	}
 	auth := credentials.NewTLS(&tls.Config{
 		RootCAs:      roots,
 		Certificates: []tls.Certificate{cert}})
@@ -72,7 +90,7 @@ func DialTLS(addr, certFile, keyFile string, opts ...grpc.DialOption) (*grpc.Cli
 }
 
 func ListenAndServeTLS(addr, certFile, keyFile string, register func(s *grpc.Server)) error {
-	ln, err := net.Listen("tcp", addr)
+	ln, err := socketactivation.Listen(addr)
 	if err != nil {
 		return err
 	}
@@ -97,14 +115,10 @@ func ListenAndServeTLS(addr, certFile, keyFile string, register func(s *grpc.Ser
 	if err := http2.ConfigureServer(&srv, nil); err != nil {
 		return err
 	}
-	roots := x509.NewCertPool()
-	contents, err := ioutil.ReadFile(certFile)
+	roots, err := certPool(certFile)
 	if err != nil {
 		return err
 	}
-	if !roots.AppendCertsFromPEM(contents) {
-		return fmt.Errorf("Could not parse %q as PEM file (contents: %q)", certFile, contents)
-	}
 
 	if *requireClientAuth {
 		srv.TLSConfig.ClientCAs = roots
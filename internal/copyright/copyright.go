@@ -0,0 +1,180 @@
+// Package copyright parses machine-readable debian/copyright files (see
+// https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/) to
+// determine the license of the files of a source package.
+package copyright
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrNotMachineReadable is returned by Parse for debian/copyright files which
+// do not use the machine-readable format.
+var ErrNotMachineReadable = errors.New("debian/copyright is not machine-readable (no Format field)")
+
+// Files is a Files paragraph of a debian/copyright file.
+type Files struct {
+	// Patterns are the (space-separated) patterns of the Files field.
+	Patterns []string
+
+	// License is the short name (first line) of the License field, e.g.
+	// “GPL-2+” or “BSD-3-clause or Expat”.
+	License string
+}
+
+// Copyright is a parsed debian/copyright file.
+type Copyright struct {
+	Files []Files
+}
+
+// Parse parses a machine-readable debian/copyright file.
+func Parse(r io.Reader) (*Copyright, error) {
+	var (
+		c          Copyright
+		header     = true
+		formatSeen bool
+		field      string
+		para       map[string]string
+	)
+	flush := func() {
+		if para == nil {
+			return
+		}
+		if header {
+			_, formatSeen = para["format"]
+			header = false
+		} else if files, ok := para["files"]; ok {
+			c.Files = append(c.Files, Files{
+				Patterns: strings.Fields(files),
+				License:  para["license"],
+			})
+		}
+		para = nil
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		if para == nil {
+			para = make(map[string]string)
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// Continuation line. Only the Files field is continued, the
+			// License field’s short name is on its first line.
+			if field == "files" {
+				para[field] += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+		if line[0] == '#' {
+			continue
+		}
+		idx := strings.Index(line, ":")
+		if idx == -1 {
+			continue
+		}
+		field = strings.ToLower(line[:idx])
+		if _, ok := para[field]; !ok {
+			para[field] = strings.TrimSpace(line[idx+1:])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	if !formatSeen {
+		return nil, ErrNotMachineReadable
+	}
+	return &c, nil
+}
+
+// License returns the license of the file at path (relative to the source
+// package root), or "" if no Files paragraph matches. As per the format
+// specification, the last matching paragraph wins.
+func (c *Copyright) License(path string) string {
+	for i := len(c.Files) - 1; i >= 0; i-- {
+		for _, pattern := range c.Files[i].Patterns {
+			if match(pattern, path) {
+				return c.Files[i].License
+			}
+		}
+	}
+	return ""
+}
+
+// match reports whether path matches pattern, in which “*” matches any
+// string (including slashes), “?” matches any single character and “\”
+// escapes the following character.
+func match(pattern, path string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(path); i >= 0; i-- {
+				if match(pattern[1:], path[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(path) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(path) == 0 || path[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		path = path[1:]
+	}
+	return len(path) == 0
+}
+
+// Licenses maps source packages (e.g. “i3-wm_4.16-1”) to their parsed
+// debian/copyright file.
+type Licenses map[string]*Copyright
+
+// License returns the license of the file at path, which starts with the
+// source package, e.g. “i3-wm_4.16-1/src/main.c”.
+func (l Licenses) License(path string) string {
+	idx := strings.Index(path, "/")
+	if idx == -1 {
+		return ""
+	}
+	c, ok := l[path[:idx]]
+	if !ok {
+		return ""
+	}
+	return c.License(path[idx+1:])
+}
+
+// ReadLicenses reads the licenses of an index shard, as written by the
+// importer. A missing file results in empty Licenses.
+func ReadLicenses(path string) (Licenses, error) {
+	l := make(Licenses)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return l, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
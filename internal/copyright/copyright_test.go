@@ -0,0 +1,66 @@
+package copyright
+
+import (
+	"strings"
+	"testing"
+)
+
+const example = `Format: https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/
+Upstream-Name: i3
+Source: https://i3wm.org/
+
+Files: *
+Copyright: 2009 Michael Stapelberg
+License: BSD-3-clause
+
+Files: libi3/safewrappers.c
+ include/queue.h
+Copyright: 1991, 1993 The Regents of the University of California
+License: BSD-4-clause
+ Redistribution and use in source and binary forms, with or without
+ modification, are permitted provided that the following conditions are met:
+
+Files: debian/*
+Copyright: 2009 Michael Stapelberg
+License: GPL-2+
+
+License: BSD-3-clause
+ Redistribution and use in source and binary forms, with or without
+ modification, are permitted provided that the following conditions are met:
+`
+
+func TestLicense(t *testing.T) {
+	c, err := Parse(strings.NewReader(example))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"src/main.c", "BSD-3-clause"},
+		{"libi3/safewrappers.c", "BSD-4-clause"},
+		{"include/queue.h", "BSD-4-clause"},
+		{"debian/rules", "GPL-2+"},
+		{"debian/patches/fix.patch", "GPL-2+"},
+	} {
+		if got := c.License(tt.path); got != tt.want {
+			t.Errorf("License(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	l := Licenses{"i3-wm_4.16-1": c}
+	if got, want := l.License("i3-wm_4.16-1/debian/control"), "GPL-2+"; got != want {
+		t.Errorf("Licenses.License() = %q, want %q", got, want)
+	}
+	if got := l.License("unknown_1.0/debian/control"); got != "" {
+		t.Errorf("Licenses.License() = %q, want %q", got, "")
+	}
+}
+
+func TestParseNotMachineReadable(t *testing.T) {
+	_, err := Parse(strings.NewReader("This package was debianized by Jane Doe.\n\nCopyright: 2001 Jane Doe\n"))
+	if err != ErrNotMachineReadable {
+		t.Fatalf("Parse() = %v, want %v", err, ErrNotMachineReadable)
+	}
+}
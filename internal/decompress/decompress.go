@@ -0,0 +1,110 @@
+// Package decompress transparently decompresses source files which are
+// shipped compressed (e.g. gzip-compressed patches or man pages), so that they
+// can be indexed, searched and displayed like any other file.
+package decompress
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+var extensionsList = flag.String("decompress_extensions",
+	".gz",
+	"(comma-separated list of) file name extensions of compressed files which are decompressed before indexing, searching and displaying them. Supported extensions: .gz. Empty disables decompression. Must be the same for dcs-package-importer and dcs-source-backend")
+
+// Compressions of the supported file name extensions.
+var compressions = map[string]string{
+	".gz": "gzip",
+}
+
+var (
+	extensionsOnce sync.Once
+	extensions     map[string]string
+)
+
+func enabled() map[string]string {
+	extensionsOnce.Do(func() {
+		extensions = make(map[string]string)
+		for _, ext := range strings.Split(*extensionsList, ",") {
+			if ext == "" {
+				continue
+			}
+			compression, ok := compressions[ext]
+			if !ok {
+				log.Fatalf("-decompress_extensions: unsupported extension %q", ext)
+			}
+			extensions[ext] = compression
+		}
+	})
+	return extensions
+}
+
+// Compression returns the compression of the file at path (e.g. “gzip”) as
+// per its extension, or "" if the file is not decompressed.
+func Compression(path string) string {
+	idx := strings.LastIndex(path, ".")
+	if idx == -1 || strings.Contains(path[idx:], "/") {
+		return ""
+	}
+	return enabled()[path[idx:]]
+}
+
+// TrimExtension returns filename without its extension if the file is
+// decompressed, e.g. “foo.1” for “foo.1.gz”, so that filename based checks
+// apply to the decompressed contents.
+func TrimExtension(filename string) string {
+	if Compression(filename) == "" {
+		return filename
+	}
+	return filename[:strings.LastIndex(filename, ".")]
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (rc *readCloser) Close() error {
+	var err error
+	for _, c := range rc.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// NewReader returns a reader which decompresses r according to compression
+// (see Compression).
+func NewReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "gzip":
+		return gzip.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+// Open opens the file at path for reading, decompressing it according to
+// compression (see Compression). Files are read as-is if compression is "".
+func Open(path, compression string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if compression == "" {
+		return f, nil
+	}
+	zr, err := NewReader(f, compression)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &readCloser{Reader: zr, closers: []io.Closer{zr, f}}, nil
+}
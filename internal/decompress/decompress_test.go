@@ -0,0 +1,80 @@
+package decompress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	for _, tt := range []struct {
+		path        string
+		compression string
+		trimmed     string
+	}{
+		{"i3-wm_4.8-1/man/i3.1.gz", "gzip", "i3-wm_4.8-1/man/i3.1"},
+		{"i3-wm_4.8-1/src/main.c", "", "i3-wm_4.8-1/src/main.c"},
+		{"i3-wm_4.8-1/debian/patches.gz/series", "", "i3-wm_4.8-1/debian/patches.gz/series"},
+		{"i3-wm_4.8-1/Makefile", "", "i3-wm_4.8-1/Makefile"},
+		{"i3-wm_4.8-1/debian/patches.tar.bz2", "", "i3-wm_4.8-1/debian/patches.tar.bz2"},
+	} {
+		if got, want := Compression(tt.path), tt.compression; got != want {
+			t.Errorf("Compression(%q) = %q, want %q", tt.path, got, want)
+		}
+		if got, want := TrimExtension(tt.path), tt.trimmed; got != want {
+			t.Errorf("TrimExtension(%q) = %q, want %q", tt.path, got, want)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dcs-decompress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const contents = "int main(int argc, char *argv[]) {\n"
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(tmp, "main.c.gz")
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		compression string
+		want        []byte
+	}{
+		{"gzip", []byte(contents)},
+		{"", buf.Bytes()},
+	} {
+		r, err := Open(fn, tt.compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("Open(%q, %q): got %q, want %q", fn, tt.compression, got, tt.want)
+		}
+	}
+
+	if _, err := Open(fn, "xz"); err == nil {
+		t.Errorf("Open(%q, %q) unexpectedly succeeded", fn, "xz")
+	}
+}
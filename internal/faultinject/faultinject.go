@@ -0,0 +1,176 @@
+// Package faultinject wraps network connections to simulate failures of
+// remote peers (delays, connection resets, truncated replies, slow trickle),
+// so that failure handling can be tested without real network failures.
+//
+// Faults are described by a comma-separated list of key=value pairs, e.g.:
+//
+//	delay=2s,trickle=16/10ms,truncate_after=4096
+//
+// Only the data received from the peer is affected: writes are passed
+// through unmodified.
+package faultinject
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Faults describes the faults to inject into a connection. The zero value
+// injects no faults.
+type Faults struct {
+	// Delay is waited for before the first read returns, e.g. to simulate
+	// an overloaded peer.
+	Delay time.Duration
+
+	// ResetAfter, if non-zero, makes reads fail with ECONNRESET once this
+	// many bytes were read.
+	ResetAfter int64
+
+	// TruncateAfter, if non-zero, makes reads return io.EOF once this many
+	// bytes were read, i.e. the peer appears to close the connection in the
+	// middle of a reply (e.g. after half a JSON object).
+	TruncateAfter int64
+
+	// TrickleBytes, if non-zero, limits each read to at most this many
+	// bytes, each of which waits for TrickleDelay first.
+	TrickleBytes int
+	TrickleDelay time.Duration
+}
+
+// Parse parses a fault description:
+//
+//	delay=<duration>          see Faults.Delay
+//	reset_after=<bytes>       see Faults.ResetAfter
+//	truncate_after=<bytes>    see Faults.TruncateAfter
+//	trickle=<bytes>/<delay>   see Faults.TrickleBytes and Faults.TrickleDelay
+func Parse(spec string) (Faults, error) {
+	var f Faults
+	for _, kv := range strings.Split(spec, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		idx := strings.Index(kv, "=")
+		if idx == -1 {
+			return f, fmt.Errorf("invalid fault %q: expected key=value", kv)
+		}
+		key, value := kv[:idx], kv[idx+1:]
+		var err error
+		switch key {
+		case "delay":
+			f.Delay, err = time.ParseDuration(value)
+		case "reset_after":
+			f.ResetAfter, err = strconv.ParseInt(value, 10, 64)
+		case "truncate_after":
+			f.TruncateAfter, err = strconv.ParseInt(value, 10, 64)
+		case "trickle":
+			parts := strings.SplitN(value, "/", 2)
+			if len(parts) != 2 {
+				return f, fmt.Errorf("invalid fault %q: expected trickle=<bytes>/<delay>", kv)
+			}
+			if f.TrickleBytes, err = strconv.Atoi(parts[0]); err == nil {
+				f.TrickleDelay, err = time.ParseDuration(parts[1])
+			}
+		default:
+			return f, fmt.Errorf("unknown fault %q", key)
+		}
+		if err != nil {
+			return f, fmt.Errorf("invalid fault %q: %v", kv, err)
+		}
+	}
+	if f.TrickleBytes < 0 || f.ResetAfter < 0 || f.TruncateAfter < 0 {
+		return f, fmt.Errorf("invalid faults %q: byte counts must not be negative", spec)
+	}
+	return f, nil
+}
+
+// String returns the fault description, as accepted by Parse.
+func (f Faults) String() string {
+	var parts []string
+	if f.Delay > 0 {
+		parts = append(parts, "delay="+f.Delay.String())
+	}
+	if f.ResetAfter > 0 {
+		parts = append(parts, "reset_after="+strconv.FormatInt(f.ResetAfter, 10))
+	}
+	if f.TruncateAfter > 0 {
+		parts = append(parts, "truncate_after="+strconv.FormatInt(f.TruncateAfter, 10))
+	}
+	if f.TrickleBytes > 0 {
+		parts = append(parts, "trickle="+strconv.Itoa(f.TrickleBytes)+"/"+f.TrickleDelay.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// Conn returns a connection which reads from c, injecting f.
+func (f Faults) Conn(c net.Conn) net.Conn {
+	return &conn{Conn: c, faults: f}
+}
+
+// DialContext wraps dial (e.g. (*net.Dialer).DialContext, or the
+// DialContext field of http.Transport) so that all its connections inject f.
+func (f Faults) DialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return f.Conn(c), nil
+	}
+}
+
+type conn struct {
+	net.Conn
+	faults Faults
+
+	mu      sync.Mutex
+	delayed bool
+	read    int64
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.faults
+	if !c.delayed {
+		c.delayed = true
+		time.Sleep(f.Delay)
+	}
+	// Whichever of reset and truncation comes first takes effect.
+	limit, limitErr := int64(-1), error(nil)
+	if f.ResetAfter > 0 {
+		limit, limitErr = f.ResetAfter, &net.OpError{
+			Op:   "read",
+			Net:  "tcp",
+			Addr: c.RemoteAddr(),
+			Err:  syscall.ECONNRESET,
+		}
+	}
+	if f.TruncateAfter > 0 && (limit == -1 || f.TruncateAfter < limit) {
+		limit, limitErr = f.TruncateAfter, io.EOF
+	}
+	if limit != -1 {
+		if c.read >= limit {
+			return 0, limitErr
+		}
+		if remaining := limit - c.read; int64(len(b)) > remaining {
+			b = b[:remaining]
+		}
+	}
+	if f.TrickleBytes > 0 {
+		time.Sleep(f.TrickleDelay)
+		if len(b) > f.TrickleBytes {
+			b = b[:f.TrickleBytes]
+		}
+	}
+	n, err := c.Conn.Read(b)
+	c.read += int64(n)
+	return n, err
+}
@@ -0,0 +1,107 @@
+package faultinject
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		spec string
+		want Faults
+	}{
+		{"", Faults{}},
+		{"delay=2s", Faults{Delay: 2 * time.Second}},
+		{"reset_after=100, truncate_after=50", Faults{ResetAfter: 100, TruncateAfter: 50}},
+		{"trickle=16/10ms", Faults{TrickleBytes: 16, TrickleDelay: 10 * time.Millisecond}},
+	} {
+		got, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.spec, err)
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+		if reparsed, err := Parse(got.String()); err != nil || reparsed != got {
+			t.Errorf("Parse(%q) = %+v, %v, want %+v", got.String(), reparsed, err, got)
+		}
+	}
+
+	for _, spec := range []string{"delay", "delay=often", "flaky=1", "trickle=16", "reset_after=-1"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) unexpectedly succeeded", spec)
+		}
+	}
+}
+
+// serve returns a connection from which the contents of reply can be read.
+func serve(reply string, f Faults) net.Conn {
+	server, client := net.Pipe()
+	go func() {
+		defer server.Close()
+		io.WriteString(server, reply)
+	}()
+	return f.Conn(client)
+}
+
+func TestTruncate(t *testing.T) {
+	c := serve(`{"Type":"progress","FilesProcessed":5}`, Faults{TruncateAfter: 10})
+	defer c.Close()
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"Type":"p`; got != want {
+		t.Fatalf("read %q, want %q", got, want)
+	}
+}
+
+func TestReset(t *testing.T) {
+	c := serve(strings.Repeat("x", 100), Faults{ResetAfter: 10, TruncateAfter: 20})
+	defer c.Close()
+	b, err := ioutil.ReadAll(c)
+	if opErr, ok := err.(*net.OpError); !ok || opErr.Err != syscall.ECONNRESET {
+		t.Fatalf("read error = %v, want ECONNRESET", err)
+	}
+	if got, want := len(b), 10; got != want {
+		t.Fatalf("read %d bytes, want %d", got, want)
+	}
+}
+
+func TestTrickle(t *testing.T) {
+	const delay = 5 * time.Millisecond
+	c := serve(strings.Repeat("x", 20), Faults{
+		Delay:        delay,
+		TrickleBytes: 4,
+		TrickleDelay: delay,
+	})
+	defer c.Close()
+	started := time.Now()
+	buf := make([]byte, 100)
+	var reads int
+	for {
+		n, err := c.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 4 {
+			t.Fatalf("read %d bytes, want at most 4", n)
+		}
+		reads++
+	}
+	if reads < 5 {
+		t.Fatalf("%d reads, want at least 5", reads)
+	}
+	// The initial delay plus one trickle delay per read.
+	if got, min := time.Since(started), delay+time.Duration(reads)*delay; got < min {
+		t.Fatalf("reading took %v, want at least %v", got, min)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"path/filepath"
 	"strings"
 	"unicode/utf8"
+
+	"github.com/Debian/dcs/internal/decompress"
 )
 
 // TODO: filter /debian/api/ (in every linux package), e.g.
@@ -86,6 +88,9 @@ func Ignored(info os.FileInfo, dir, filename string) error {
 		}
 		return nil
 	}
+	// Compressed files are filtered like their decompressed contents, e.g.
+	// foo.1.gz like the man page foo.1.
+	filename = decompress.TrimExtension(filename)
 	size := info.Size()
 	// index/write.go will skip the file if it’s too big, so we might as
 	// well skip it here and save the disk space.
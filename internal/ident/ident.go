@@ -0,0 +1,235 @@
+// Package ident indexes the identifiers of source files, split into their
+// components on camelCase and snake_case boundaries, so that the files
+// containing an identifier (see the ident: keyword) can be looked up directly
+// instead of matching a \b-anchored regular expression, for which the trigram
+// index yields many candidate files.
+package ident
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+)
+
+// MaxLen is the length of the longest identifier which is indexed. Longer
+// identifiers (e.g. in minified or encoded data) are skipped.
+const MaxLen = 128
+
+func isLower(c byte) bool { return 'a' <= c && c <= 'z' }
+func isUpper(c byte) bool { return 'A' <= c && c <= 'Z' }
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+// isWordByte matches the definition of \b in the regexp package: identifiers
+// are delimited like words.
+func isWordByte(c byte) bool { return isLower(c) || isUpper(c) || isDigit(c) || c == '_' }
+
+// Valid reports whether s is an identifier: ASCII letters, digits and
+// underscores, not starting with a digit.
+func Valid(s string) bool {
+	if s == "" || isDigit(s[0]) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isWordByte(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Split returns the lowercased components of identifier, split on
+// underscores and camelCase boundaries, e.g. both “parseHTTPRequest” and
+// “parse_http_request” result in [parse http request].
+func Split(identifier string) []string {
+	var components []string
+	start := 0
+	flush := func(end int) {
+		if end > start {
+			components = append(components, strings.ToLower(identifier[start:end]))
+		}
+		start = end
+	}
+	for i := 0; i < len(identifier); i++ {
+		c := identifier[i]
+		if c == '_' {
+			flush(i)
+			start = i + 1
+			continue
+		}
+		if i == start || !isUpper(c) {
+			continue
+		}
+		prev := identifier[i-1]
+		// “fooBar” and “foo2Bar” start a component at “B”, acronyms such as
+		// “HTTPRequest” at the last upper-case letter (“R”).
+		if isLower(prev) || isDigit(prev) ||
+			(isUpper(prev) && i+1 < len(identifier) && isLower(identifier[i+1])) {
+			flush(i)
+		}
+	}
+	flush(len(identifier))
+	return components
+}
+
+// Collector is an io.Writer which collects the components of all identifiers
+// in the data written to it.
+type Collector struct {
+	word       []byte
+	components map[string]bool
+}
+
+// Write implements io.Writer. Identifiers can span multiple writes.
+func (c *Collector) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if isWordByte(b) {
+			if len(c.word) <= MaxLen {
+				c.word = append(c.word, b)
+			}
+			continue
+		}
+		c.flush()
+	}
+	return len(p), nil
+}
+
+func (c *Collector) flush() {
+	if len(c.word) == 0 {
+		return
+	}
+	word := string(c.word)
+	c.word = c.word[:0]
+	// Words starting with a digit (e.g. “0x1f”) are not identifiers.
+	if len(word) > MaxLen || isDigit(word[0]) {
+		return
+	}
+	if c.components == nil {
+		c.components = make(map[string]bool)
+	}
+	for _, component := range Split(word) {
+		c.components[component] = true
+	}
+}
+
+// Components returns the (sorted) components of all identifiers written so
+// far.
+func (c *Collector) Components() []string {
+	c.flush()
+	components := make([]string, 0, len(c.components))
+	for component := range c.components {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	return components
+}
+
+// Index maps identifier components to the files containing identifiers with
+// these components.
+type Index struct {
+	// Files (e.g. “i3-wm_4.16-1/src/main.c”), in the order they were added.
+	Files []string
+	// Components maps each component to the (ascending) indexes of the
+	// files containing it in Files.
+	Components map[string][]uint32
+}
+
+// NewIndex returns an empty Index.
+func NewIndex() *Index {
+	return &Index{Components: make(map[string][]uint32)}
+}
+
+// Add records that the file at path contains identifiers with components
+// (see Collector.Components).
+func (x *Index) Add(path string, components []string) {
+	if len(components) == 0 {
+		return
+	}
+	idx := uint32(len(x.Files))
+	x.Files = append(x.Files, path)
+	for _, component := range components {
+		x.Components[component] = append(x.Components[component], idx)
+	}
+}
+
+// Merge adds all entries of other to x.
+func (x *Index) Merge(other *Index) {
+	offset := uint32(len(x.Files))
+	x.Files = append(x.Files, other.Files...)
+	for component, files := range other.Components {
+		for _, idx := range files {
+			x.Components[component] = append(x.Components[component], offset+idx)
+		}
+	}
+}
+
+// Lookup returns the (sorted) files which may contain identifier, i.e. which
+// contain all of its components. Files containing identifier are always
+// returned, as Collector splits identifiers the same way. ok is false if the
+// index cannot be used for identifier (e.g. because it is too long), in which
+// case the caller needs to consider all files.
+func (x *Index) Lookup(identifier string) (files []string, ok bool) {
+	if !Valid(identifier) || len(identifier) > MaxLen {
+		return nil, false
+	}
+	components := Split(identifier)
+	if len(components) == 0 {
+		return nil, false // e.g. “__”
+	}
+	var lists [][]uint32
+	for _, component := range components {
+		list := x.Components[component]
+		if len(list) == 0 {
+			return nil, true
+		}
+		lists = append(lists, list)
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	result := lists[0]
+	for _, list := range lists[1:] {
+		result = intersect(result, list)
+	}
+	files = make([]string, len(result))
+	for i, idx := range result {
+		files[i] = x.Files[idx]
+	}
+	sort.Strings(files)
+	return files, true
+}
+
+// intersect returns the elements contained in both a and b, which must be
+// sorted.
+func intersect(a, b []uint32) []uint32 {
+	var result []uint32
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// ReadIndex reads the identifier index of an index shard, as written by the
+// importer. A missing file (the importer was not run with -ident_index)
+// results in a nil Index.
+func ReadIndex(path string) (*Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	x := NewIndex()
+	if err := json.NewDecoder(f).Decode(x); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
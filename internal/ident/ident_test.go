@@ -0,0 +1,89 @@
+package ident
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	for _, tt := range []struct {
+		identifier string
+		want       []string
+	}{
+		{"foo", []string{"foo"}},
+		{"parseHTTPRequest", []string{"parse", "http", "request"}},
+		{"parse_http_request", []string{"parse", "http", "request"}},
+		{"ParseRequest", []string{"parse", "request"}},
+		{"MAX_CONCURRENT", []string{"max", "concurrent"}},
+		{"utf8Decode", []string{"utf8", "decode"}},
+		{"__init__", []string{"init"}},
+		{"_", nil},
+	} {
+		if got := Split(tt.identifier); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Split(%q) = %q, want %q", tt.identifier, got, tt.want)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want bool
+	}{
+		{"foo_bar2", true},
+		{"_", true},
+		{"2fast", false},
+		{"foo-bar", false},
+		{"", false},
+	} {
+		if got := Valid(tt.s); got != tt.want {
+			t.Errorf("Valid(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+	var c Collector
+	// The identifier “readFile” spans two writes.
+	c.Write([]byte("int x = read"))
+	c.Write([]byte("File(0x1f, MAX_SIZE);"))
+	want := []string{"file", "int", "max", "read", "size", "x"}
+	if got := c.Components(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Components() = %q, want %q", got, want)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	x := NewIndex()
+	x.Add("a/main.c", []string{"file", "read"})
+	x.Add("a/util.c", []string{"read", "size"})
+	other := NewIndex()
+	other.Add("b/file.go", []string{"file", "read", "write"})
+	x.Merge(other)
+
+	for _, tt := range []struct {
+		identifier string
+		want       []string
+		wantOk     bool
+	}{
+		{"readFile", []string{"a/main.c", "b/file.go"}, true},
+		{"read_file", []string{"a/main.c", "b/file.go"}, true},
+		{"read", []string{"a/main.c", "a/util.c", "b/file.go"}, true},
+		{"writeSize", nil, true},
+		{"unknown", nil, true},
+		{"__", nil, false},
+		{"not-an-identifier", nil, false},
+	} {
+		got, ok := x.Lookup(tt.identifier)
+		if ok != tt.wantOk {
+			t.Errorf("Lookup(%q): ok = %v, want %v", tt.identifier, ok, tt.wantOk)
+			continue
+		}
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lookup(%q) = %q, want %q", tt.identifier, got, tt.want)
+		}
+	}
+}
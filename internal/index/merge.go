@@ -3,6 +3,7 @@ package index
 import (
 	"bufio"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -80,6 +81,44 @@ func readPosrelMeta(dir string, idx map[Trigram][]posrelMetaEntry, idxid uint32)
 	return nil
 }
 
+// concatDocMeta writes the docid.meta file of the merged index, which is the
+// concatenation of the docid.meta files of srcdirs. Indexes without docid.meta
+// contribute unknownDocMeta entries for their counts[idx] docids.
+func concatDocMeta(destdir string, srcdirs []string, counts []uint32) error {
+	f, err := os.Create(filepath.Join(destdir, "docid.meta"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cw := newCountingWriter(f)
+	for idx, dir := range srcdirs {
+		want := int64(counts[idx]) * docMetaSize
+		src, err := os.Open(filepath.Join(dir, "docid.meta"))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			var buf [docMetaSize]byte
+			unknownDocMeta.Marshal(buf[:])
+			for i := uint32(0); i < counts[idx]; i++ {
+				if _, err := cw.Write(buf[:]); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		n, err := io.Copy(&cw, src)
+		src.Close()
+		if err != nil {
+			return err
+		}
+		if n != want {
+			return fmt.Errorf("%s: docid.meta contains %d bytes, expected %d (%d docids)", dir, n, want, counts[idx])
+		}
+	}
+	return cw.Close()
+}
+
 func ConcatN(destdir string, srcdirs []string) error {
 	fDocidMap, err := os.Create(filepath.Join(destdir, "docid.map"))
 	if err != nil {
@@ -149,6 +188,18 @@ func ConcatN(destdir string, srcdirs []string) error {
 		return err
 	}
 
+	counts := make([]uint32, len(srcdirs))
+	for idx := range srcdirs {
+		next := base
+		if idx < len(srcdirs)-1 {
+			next = bases[idx+1]
+		}
+		counts[idx] = next - bases[idx]
+	}
+	if err := concatDocMeta(destdir, srcdirs, counts); err != nil {
+		return err
+	}
+
 	log.Printf("reading fileMetaEntries")
 
 	idxMetaDocid := make([]indexMeta, len(srcdirs))
@@ -64,6 +64,24 @@ func (ix *Index) postingQuery(qry *Query, restrict []uint32) (ret []uint32) {
 			//q.pfdocid.growBuffer(withCount[len(withCount)-1].count)
 		}
 
+		// Push the intersection down: subqueries (e.g. the other
+		// literals of foo.*bar(baz|qux), or lookaheads) which are more
+		// selective than the trigrams are evaluated first, and each
+		// result restricts all following posting list reads. Otherwise,
+		// the posting lists of the broadest part of the query would be
+		// decoded in full, only to be intersected afterwards.
+		subs := ix.bySelectivity(qry.Sub)
+		for len(subs) > 0 && (len(withCount) == 0 || subs[0].estimate < withCount[0].count) {
+			restrict = ix.postingQuery(subs[0].query, restrict)
+			if len(restrict) == 0 {
+				return nil
+			}
+			subs = subs[1:]
+		}
+		if len(withCount) == 0 && len(subs) == 0 && len(qry.Sub) > 0 {
+			return restrict
+		}
+
 		stoppedAt := 0
 		for idx, t := range withCount {
 			previous := len(list)
@@ -89,11 +107,11 @@ func (ix *Index) postingQuery(qry *Query, restrict []uint32) (ret []uint32) {
 			}
 		}
 
-		for _, sub := range qry.Sub {
+		for _, sub := range subs {
 			if list == nil {
 				list = restrict
 			}
-			list = ix.postingQuery(sub, list)
+			list = ix.postingQuery(sub.query, list)
 			if len(list) == 0 {
 				return nil
 			}
@@ -115,6 +133,25 @@ func (ix *Index) postingQuery(qry *Query, restrict []uint32) (ret []uint32) {
 	return list
 }
 
+type subquerySelectivity struct {
+	query    *Query
+	estimate int // see PostingQueryEstimate
+}
+
+// bySelectivity returns subs ordered by their estimated number of documents,
+// most selective first. The estimates only use the posting list lengths from
+// the meta data, so they are cheap compared to reading the posting lists.
+func (ix *Index) bySelectivity(subs []*Query) []subquerySelectivity {
+	sorted := make([]subquerySelectivity, len(subs))
+	for idx, sub := range subs {
+		sorted[idx] = subquerySelectivity{sub, ix.PostingQueryEstimate(sub, nil)}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].estimate < sorted[j].estimate
+	})
+	return sorted
+}
+
 func mergeOr(l1, l2 []uint32) []uint32 {
 	var l []uint32
 	i := 0
@@ -157,7 +194,10 @@ func (ix *Index) readDocids(t Trigram, restrict []uint32) ([]uint32, error) {
 				i++
 			}
 			restrict = restrict[i:]
-			if len(restrict) == 0 || restrict[0] != docid {
+			if len(restrict) == 0 {
+				break // no further docid can be in restrict
+			}
+			if restrict[0] != docid {
 				continue
 			}
 		}
@@ -225,3 +265,56 @@ func (ix *Index) postingOr(list []uint32, tri uint32, restrict []uint32) []uint3
 	//log.Printf("len(postingOr(%d, retrict %d)) = %d", tri, len(restrict), len(x))
 	return x[:xn]
 }
+
+// PostingQueryEstimate estimates the number of documents PostingQuery would
+// return for q, using only the posting list lengths stored in the meta data
+// (i.e. without reading any posting lists). The estimate is an upper bound:
+// for QAnd, it is the length of the shortest posting list, for QOr, the sum of
+// all posting list lengths (capped at the number of documents).
+//
+// The number of documents per trigram is stored in counts (if non-nil).
+func (ix *Index) PostingQueryEstimate(q *Query, counts map[string]int) int {
+	total := ix.DocidMap.Count
+	var estimate int
+	switch q.Op {
+	case QNone:
+		return 0
+	case QAll:
+		return total
+	case QAnd:
+		estimate = total
+		for _, t := range q.Trigram {
+			if n := ix.trigramEntries(t, counts); n < estimate {
+				estimate = n
+			}
+		}
+		for _, sub := range q.Sub {
+			if n := ix.PostingQueryEstimate(sub, counts); n < estimate {
+				estimate = n
+			}
+		}
+	case QOr:
+		for _, t := range q.Trigram {
+			estimate += ix.trigramEntries(t, counts)
+		}
+		for _, sub := range q.Sub {
+			estimate += ix.PostingQueryEstimate(sub, counts)
+		}
+		if estimate > total {
+			estimate = total
+		}
+	}
+	return estimate
+}
+
+func (ix *Index) trigramEntries(t string, counts map[string]int) int {
+	tri := uint32(t[0])<<16 | uint32(t[1])<<8 | uint32(t[2])
+	var entries int
+	if meta, err := ix.Docid.metaEntry1(Trigram(tri)); err == nil {
+		entries = int(meta.Entries)
+	}
+	if counts != nil {
+		counts[t] = entries
+	}
+	return entries
+}
@@ -0,0 +1,103 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp/syntax"
+	"strings"
+	"testing"
+)
+
+func TestPostingQueryPushdown(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dcs-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// Most files contain “common”, only few contain “rare” or “other”.
+	contents := []string{
+		"common rare other",
+		"common",
+		"common rare",
+		"common other",
+		"common",
+		"rare other",
+		"common",
+		"common rare other common",
+	}
+	w, err := Create(filepath.Join(tmp, "idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, content := range contents {
+		fn := filepath.Join(tmp, strings.Repeat("f", idx+1))
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddFile(fn, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ix, err := Open(filepath.Join(tmp, "idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	regexpQuery := func(re string) *Query {
+		parsed, err := syntax.Parse(re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return RegexpQuery(parsed)
+	}
+	// PostingQuery may return a superset of the matching documents (it stops
+	// intersecting once the intersection barely shrinks), so the test
+	// verifies that all documents containing the literals are returned, and
+	// that documents which lack the most selective literal are not.
+	for _, tt := range []struct {
+		query   *Query
+		want    []uint32
+		exclude []uint32
+	}{
+		{regexpQuery(`common.*rare`), []uint32{0, 2, 7}, []uint32{1, 3, 4, 6}},
+		{regexpQuery(`rare.*(other|common)`), []uint32{0, 2, 5, 7}, []uint32{1, 3, 4, 6}},
+		{
+			// As generated by lineFilter.indexQuery for lookaheads.
+			&Query{Op: QAnd, Sub: []*Query{
+				regexpQuery(`common`),
+				regexpQuery(`other`),
+				regexpQuery(`rare`),
+			}},
+			[]uint32{0, 7},
+			[]uint32{1, 2, 3, 4, 6},
+		},
+		{
+			&Query{Op: QAnd, Sub: []*Query{
+				regexpQuery(`common`),
+				regexpQuery(`nonexistent`),
+			}},
+			nil,
+			[]uint32{0, 1, 2, 3, 4, 5, 6, 7},
+		},
+	} {
+		got := make(map[uint32]bool)
+		for _, docid := range ix.PostingQuery(tt.query) {
+			got[docid] = true
+		}
+		for _, docid := range tt.want {
+			if !got[docid] {
+				t.Errorf("PostingQuery(%v) does not contain document %d", tt.query, docid)
+			}
+		}
+		for _, docid := range tt.exclude {
+			if got[docid] {
+				t.Errorf("PostingQuery(%v) unexpectedly contains document %d", tt.query, docid)
+			}
+		}
+	}
+}
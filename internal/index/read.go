@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"math/bits"
+	"os"
 	"path/filepath"
 	"sort"
 	"sync"
@@ -327,11 +328,48 @@ func (pr *PosrelReader) Close() error {
 	return nil
 }
 
+// DocMetaReader reads the docid.meta file (see DocMeta).
+type DocMetaReader struct {
+	f     *mmap.File
+	Count int
+}
+
+func newDocMetaReader(dir string) (*DocMetaReader, error) {
+	f, err := mmap.Open(filepath.Join(dir, "docid.meta"))
+	if err != nil {
+		return nil, err
+	}
+	return &DocMetaReader{
+		f:     f,
+		Count: len(f.Data) / docMetaSize,
+	}, nil
+}
+
+func (dr *DocMetaReader) Close() error {
+	return dr.f.Close()
+}
+
+// Lookup returns the metadata of docid. For indexes which were created without
+// metadata (dr == nil), unknownDocMeta is returned.
+func (dr *DocMetaReader) Lookup(docid uint32) (DocMeta, error) {
+	var dm DocMeta
+	if dr == nil {
+		return unknownDocMeta, nil
+	}
+	if int64(docid) >= int64(dr.Count) {
+		return dm, fmt.Errorf("docid %d outside of docid meta [0, %d)", docid, dr.Count)
+	}
+	offset := int(docid) * docMetaSize
+	dm.Unmarshal(dr.f.Data[offset : offset+docMetaSize])
+	return dm, nil
+}
+
 type Index struct {
-	DocidMap *DocidReader  // docid → filename mapping
-	Docid    *PForReader   // docids for all trigrams
-	Pos      *PForReader   // positions for all trigrams
-	Posrel   *PosrelReader // position relationships for all trigrams
+	DocidMap *DocidReader   // docid → filename mapping
+	DocMeta  *DocMetaReader // docid → file metadata, nil for older indexes
+	Docid    *PForReader    // docids for all trigrams
+	Pos      *PForReader    // positions for all trigrams
+	Posrel   *PosrelReader  // position relationships for all trigrams
 
 	// buffers for both i.Matches() calls
 	firstBuffer *bufferPair
@@ -347,6 +385,12 @@ func Open(dir string) (*Index, error) {
 		return nil, err
 	}
 
+	// Indexes created before docid.meta was introduced remain usable, just
+	// without file metadata.
+	if i.DocMeta, err = newDocMetaReader(dir); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
 	// posrel reduces the index size by about ≈ 1/4!
 	if i.Posrel, err = newPosrelReader(dir); err != nil {
 		return nil, err
@@ -626,6 +670,11 @@ func (i *Index) QueryPositional(query string) ([]Match, error) {
 }
 
 func (i *Index) Close() error {
+	if i.DocMeta != nil {
+		if err := i.DocMeta.Close(); err != nil {
+			return err
+		}
+	}
 	if i.Docid != nil {
 		if err := i.Docid.Close(); err != nil {
 			return err
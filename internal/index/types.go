@@ -1,6 +1,10 @@
 package index
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+
+	"github.com/Debian/dcs/internal/sizefilter"
+)
 
 var encoding = binary.LittleEndian
 
@@ -29,3 +33,28 @@ func (me *MetaEntry) Marshal(b []byte) {
 	encoding.PutUint32(b[4:], me.Entries)
 	encoding.PutUint64(b[8:], uint64(me.OffsetData))
 }
+
+// A DocMeta is the metadata of an indexed file. The docid.meta file contains
+// one DocMeta per docid, so that files can be filtered and sorted by their
+// metadata without stat(2) calls at query time.
+type DocMeta struct {
+	Size  uint64 // in bytes, of the decompressed contents for compressed files
+	Mtime int64  // modification time in seconds since the UNIX epoch
+}
+
+// unknownDocMeta is the metadata of files in indexes created without
+// docid.meta.
+var unknownDocMeta = DocMeta{Size: sizefilter.UnknownSize}
+
+// docMetaSize is (encoding/binary).Size(&DocMeta{}).
+const docMetaSize = 16
+
+func (dm *DocMeta) Unmarshal(b []byte) {
+	dm.Size = encoding.Uint64(b)
+	dm.Mtime = int64(encoding.Uint64(b[8:]))
+}
+
+func (dm *DocMeta) Marshal(b []byte) {
+	encoding.PutUint64(b, dm.Size)
+	encoding.PutUint64(b[8:], uint64(dm.Mtime))
+}
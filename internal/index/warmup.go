@@ -0,0 +1,23 @@
+package index
+
+import "github.com/Debian/dcs/internal/mmap"
+
+// WarmUp reads the parts of the index which every query accesses (the docid
+// map, the meta data of all sections and the docid posting lists), so that the
+// first queries after opening the index do not wait for disk reads. The
+// positional posting lists are not read, as they are usually too large to
+// keep in memory. Returns the number of bytes read.
+func (i *Index) WarmUp() int64 {
+	files := []*mmap.File{i.DocidMap.f, i.Posrel.meta}
+	if i.Docid != nil {
+		files = append(files, i.Docid.meta, i.Docid.data)
+	}
+	if i.Pos != nil {
+		files = append(files, i.Pos.meta)
+	}
+	var n int64
+	for _, f := range files {
+		n += int64(f.Touch())
+	}
+	return n
+}
@@ -12,6 +12,7 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/Debian/dcs/internal/decompress"
 	"github.com/google/codesearch/sparse"
 )
 
@@ -53,6 +54,7 @@ type Writer struct {
 	dir   string
 	index map[Trigram][]entry
 	docs  []string
+	meta  []DocMeta   // indexed by docid, like docs
 	set   *sparse.Set // efficiently reset across AddFile calls
 	inbuf []byte
 }
@@ -150,6 +152,7 @@ func (w *Writer) AddFile(fn, name string) error {
 	w.set.Reset()
 	docid := uint32(len(w.docs))
 	w.docs = append(w.docs, name)
+	w.meta = append(w.meta, DocMeta{})
 	f, err := os.Open(fn)
 	if err != nil {
 		return err
@@ -166,6 +169,24 @@ func (w *Writer) AddFile(fn, name string) error {
 	if st.Size() < 3 {
 		return errors.New("too short, ignoring")
 	}
+	w.meta[docid] = DocMeta{
+		Size:  uint64(st.Size()),
+		Mtime: st.ModTime().Unix(),
+	}
+
+	// Compressed files are indexed by their decompressed contents, whose
+	// size is only known after reading them.
+	var r io.Reader = f
+	size := st.Size()
+	if compression := decompress.Compression(fn); compression != "" {
+		zr, err := decompress.NewReader(f, compression)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+		size = 0
+	}
 
 	var (
 		c       byte
@@ -174,12 +195,15 @@ func (w *Writer) AddFile(fn, name string) error {
 		n       = 0
 		linelen = 0
 		buf     = w.inbuf[:0]
-		entries = make([]uint64, st.Size()-2)
+		entries []uint64
 	)
+	if size > 2 {
+		entries = make([]uint64, 0, size-2)
+	}
 	for {
 		tv = (tv << 8) & (1<<24 - 1)
 		if i >= len(buf) {
-			n, err := f.Read(buf[:cap(buf)])
+			n, err := r.Read(buf[:cap(buf)])
 			if n == 0 {
 				if err != nil {
 					if err == io.EOF {
@@ -204,14 +228,23 @@ func (w *Writer) AddFile(fn, name string) error {
 		if !validUTF8((tv>>8)&0xFF, tv&0xFF) {
 			return errors.New("invalid UTF-8, ignoring")
 		}
-		if n++; n >= 3 {
+		if n++; n > maxFileLen {
+			return errors.New("too long, ignoring")
+		}
+		if n >= 3 {
 			w.set.Add(tv)
-			entries[n-3] = uint64(tv)<<32 | uint64(n-3)
+			entries = append(entries, uint64(tv)<<32|uint64(n-3))
 		}
 	}
+	if n < 3 {
+		return errors.New("too short, ignoring")
+	}
 	if w.set.Len() > maxTextTrigrams {
 		return errors.New("too many trigrams, probably not text, ignoring")
 	}
+	if size == 0 {
+		w.meta[docid].Size = uint64(n) // decompressed size
+	}
 	for _, e := range entries {
 		t := Trigram(e >> 32)
 		w.index[t] = append(w.index[t], entry{docid: docid, position: uint32(e)})
@@ -224,6 +257,10 @@ func (w *Writer) Flush() error {
 		return err
 	}
 
+	if err := w.writeDocMeta(w.meta); err != nil {
+		return err
+	}
+
 	// Sort the trigrams by value to create a deterministic index:
 	trigrams := make([]Trigram, 0, len(w.index))
 	for t := range w.index {
@@ -272,6 +309,25 @@ func (w *Writer) writeDocidMap(filenames []string) error {
 	return cw.Close()
 }
 
+// writeDocMeta creates the index’s docid.meta file, which contains a DocMeta
+// for each docid.
+func (w *Writer) writeDocMeta(meta []DocMeta) error {
+	f, err := os.Create(filepath.Join(w.dir, "docid.meta"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cw := newCountingWriter(f)
+	var buf [docMetaSize]byte
+	for _, dm := range meta {
+		dm.Marshal(buf[:])
+		if _, err := cw.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+	return cw.Close()
+}
+
 func (w *Writer) writeDocid(trigrams []Trigram) error {
 	f, err := os.Create(filepath.Join(w.dir, "posting.docid.meta"))
 	if err != nil {
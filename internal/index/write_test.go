@@ -0,0 +1,183 @@
+package index
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp/syntax"
+	"testing"
+	"time"
+)
+
+func TestAddFileCompressed(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dcs-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	gz := func(contents string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	w, err := Create(filepath.Join(tmp, "idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []struct {
+		name     string
+		contents []byte
+	}{
+		{"fix-build.patch.gz", gz("--- a/configure\n+++ b/configure\n-rare\n")},
+		{"main.c", []byte("common\n")},
+	} {
+		fn := filepath.Join(tmp, file.name)
+		if err := ioutil.WriteFile(fn, file.contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddFile(fn, file.name); err != nil {
+			t.Fatalf("AddFile(%q): %v", file.name, err)
+		}
+	}
+
+	// The decompressed contents are checked like any other file.
+	binary := filepath.Join(tmp, "binary.gz")
+	if err := ioutil.WriteFile(binary, gz("\xff\xfe\xfd\xfc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddFile(binary, "binary.gz"); err == nil {
+		t.Errorf("AddFile(%q) unexpectedly succeeded", binary)
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ix, err := Open(filepath.Join(tmp, "idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := syntax.Parse(`rare`, syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := ix.PostingQuery(RegexpQuery(parsed))
+	if len(got) != 1 || got[0] != 0 {
+		t.Errorf("PostingQuery(rare) = %v, want [0]", got)
+	}
+}
+
+func TestDocMeta(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dcs-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte("decompressed contents\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	files := []struct {
+		name     string
+		contents []byte
+	}{
+		{"main.c", []byte("int main() {}\n")},
+		{"short", []byte("a")}, // not indexed, but has a docid
+		{"changelog.gz", buf.Bytes()},
+	}
+	w, err := Create(filepath.Join(tmp, "idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		fn := filepath.Join(tmp, file.name)
+		if err := ioutil.WriteFile(fn, file.contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		w.AddFile(fn, file.name)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []DocMeta{
+		{Size: 14, Mtime: mtime.Unix()},
+		{},
+		{Size: 22, Mtime: mtime.Unix()},
+	}
+	check := func(dir string, want []DocMeta) {
+		t.Helper()
+		ix, err := Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ix.Close()
+		for docid, w := range want {
+			got, err := ix.DocMeta.Lookup(uint32(docid))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != w {
+				t.Errorf("DocMeta.Lookup(%d) = %+v, want %+v", docid, got, w)
+			}
+		}
+		if _, err := ix.DocMeta.Lookup(uint32(len(want))); err == nil {
+			t.Errorf("DocMeta.Lookup(%d) unexpectedly succeeded", len(want))
+		}
+	}
+	check(filepath.Join(tmp, "idx"), want)
+
+	// Indexes created without docid.meta can be opened and merged.
+	if err := os.MkdirAll(filepath.Join(tmp, "old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err = Create(filepath.Join(tmp, "old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddFile(filepath.Join(tmp, "main.c"), "old.c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(tmp, "old", "docid.meta")); err != nil {
+		t.Fatal(err)
+	}
+	old, err := Open(filepath.Join(tmp, "old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := old.DocMeta.Lookup(0); err != nil || got != unknownDocMeta {
+		t.Errorf("DocMeta.Lookup(0) = %+v, %v, want %+v", got, err, unknownDocMeta)
+	}
+	old.Close()
+
+	merged := filepath.Join(tmp, "merged")
+	if err := os.MkdirAll(merged, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConcatN(merged, []string{filepath.Join(tmp, "old"), filepath.Join(tmp, "idx")}); err != nil {
+		t.Fatal(err)
+	}
+	check(merged, append([]DocMeta{unknownDocMeta}, want...))
+}
@@ -46,7 +46,7 @@ var (
 )
 
 func installBinaries() error {
-	cmd := exec.Command("go", "install", "-ldflags", "-X github.com/Debian/dcs/cmd/dcs-web/common.Version=git", "github.com/Debian/dcs/cmd/...")
+	cmd := exec.Command("go", "install", "-ldflags", "-X github.com/Debian/dcs/cmd/dcs-web/common.Version=git -X github.com/Debian/dcs/internal/sourcebackend.Version=git", "github.com/Debian/dcs/cmd/...")
 	cmd.Stderr = os.Stderr
 	log.Printf("Compiling and installing binaries: %v\n", cmd.Args)
 	return cmd.Run()
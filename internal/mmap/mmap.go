@@ -44,3 +44,17 @@ func Open(path string) (*File, error) {
 func (f *File) Close() error {
 	return unix.Munmap(f.orig)
 }
+
+// touchSink prevents the compiler from optimizing away the reads in Touch.
+var touchSink byte
+
+// Touch reads one byte of every page of f, so that all pages are in the page
+// cache (and mapped) before they are accessed. Returns the size of f.
+func (f *File) Touch() int {
+	var x byte
+	for off := 0; off < len(f.Data); off += 4096 {
+		x ^= f.Data[off]
+	}
+	touchSink = x
+	return len(f.Data)
+}
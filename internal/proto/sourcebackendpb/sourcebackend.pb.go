@@ -28,15 +28,18 @@ type SearchReply_Type int32
 const (
 	SearchReply_MATCH           SearchReply_Type = 0
 	SearchReply_PROGRESS_UPDATE SearchReply_Type = 1
+	SearchReply_COUNTS          SearchReply_Type = 2
 )
 
 var SearchReply_Type_name = map[int32]string{
 	0: "MATCH",
 	1: "PROGRESS_UPDATE",
+	2: "COUNTS",
 }
 var SearchReply_Type_value = map[string]int32{
 	"MATCH":           0,
 	"PROGRESS_UPDATE": 1,
+	"COUNTS":          2,
 }
 
 func (x SearchReply_Type) String() string {
@@ -47,7 +50,10 @@ func (SearchReply_Type) EnumDescriptor() ([]byte, []int) {
 }
 
 type FileRequest struct {
-	Path                 string   `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	Path string `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	// Compression of the file (see Match.compression), if the file should be
+	// decompressed before sending its contents, e.g. “gzip”.
+	Compression          string   `protobuf:"bytes,2,opt,name=compression,proto3" json:"compression,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -84,6 +90,13 @@ func (m *FileRequest) GetPath() string {
 	return ""
 }
 
+func (m *FileRequest) GetCompression() string {
+	if m != nil {
+		return m.Compression
+	}
+	return ""
+}
+
 type FileReply struct {
 	Contents             []byte   `protobuf:"bytes,1,opt,name=contents,proto3" json:"contents,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -182,10 +195,50 @@ type Match struct {
 	// Contents of line+1.
 	Ctxn1 string `protobuf:"bytes,6,opt,name=ctxn1,proto3" json:"ctxn1,omitempty"`
 	// Contents of line+2.
-	Ctxn2                string   `protobuf:"bytes,7,opt,name=ctxn2,proto3" json:"ctxn2,omitempty"`
-	Pathrank             float32  `protobuf:"fixed32,8,opt,name=pathrank,proto3" json:"pathrank,omitempty"`
-	Ranking              float32  `protobuf:"fixed32,9,opt,name=ranking,proto3" json:"ranking,omitempty"`
-	Package              string   `protobuf:"bytes,10,opt,name=package,proto3" json:"package,omitempty"`
+	Ctxn2    string  `protobuf:"bytes,7,opt,name=ctxn2,proto3" json:"ctxn2,omitempty"`
+	Pathrank float32 `protobuf:"fixed32,8,opt,name=pathrank,proto3" json:"pathrank,omitempty"`
+	Ranking  float32 `protobuf:"fixed32,9,opt,name=ranking,proto3" json:"ranking,omitempty"`
+	Package  string  `protobuf:"bytes,10,opt,name=package,proto3" json:"package,omitempty"`
+	// Set on the last match sent for a file whose matches exceeded the per-file
+	// match limit: the number of matches in that file which were not sent.
+	FileMatchesOmitted uint32 `protobuf:"varint,11,opt,name=file_matches_omitted,json=fileMatchesOmitted,proto3" json:"file_matches_omitted,omitempty"`
+	// Name of the dcs cluster the match was found in. Only set by dcs-web when
+	// federation is enabled (see its -federation_peers flag).
+	Origin string `protobuf:"bytes,12,opt,name=origin,proto3" json:"origin,omitempty"`
+	// License of the file, as per the package’s (machine-readable)
+	// debian/copyright file, e.g. “GPL-2+”.
+	License string `protobuf:"bytes,13,opt,name=license,proto3" json:"license,omitempty"`
+	// Binary packages built from the match’s source package, as per the
+	// archive’s Sources index (see dcs-compute-ranking).
+	BinaryPackages []string `protobuf:"bytes,14,rep,name=binary_packages,json=binaryPackages,proto3" json:"binary_packages,omitempty"`
+	// Version of the match’s source package as declared in its .dsc file,
+	// including the epoch (if any), e.g. “2:8.1.0875-5”.
+	Version string `protobuf:"bytes,15,opt,name=version,proto3" json:"version,omitempty"`
+	// Byte ranges of context (i.e. of the HTML-escaped line, never starting or
+	// ending within an escape sequence) which the query matched, in ascending
+	// order, so that clients can highlight them without evaluating the query.
+	HighlightRanges []*Range `protobuf:"bytes,16,rep,name=highlight_ranges,json=highlightRanges,proto3" json:"highlight_ranges,omitempty"`
+	// Encoding of the file, if it is not UTF-8: “latin1” for files which are
+	// not valid UTF-8. Unless the query contains encoding:raw, such files are
+	// converted from ISO-8859-1 to UTF-8 before searching, so that context is
+	// not garbled.
+	Encoding string `protobuf:"bytes,17,opt,name=encoding,proto3" json:"encoding,omitempty"`
+	// Length in bytes of the (HTML-escaped) line containing the match, if
+	// the source backend truncated context to its line length limit (see its
+	// -max_line_length flag): “…” marks where context lines were truncated.
+	// 0 if context was not truncated.
+	ContextLength uint32 `protobuf:"varint,18,opt,name=context_length,json=contextLength,proto3" json:"context_length,omitempty"`
+	// Compression of the file, if the source backend decompressed it before
+	// searching (see its -decompress_extensions flag): “gzip”. Line and
+	// context refer to the decompressed contents, so clients need to request
+	// the decompressed file when displaying the match.
+	Compression string `protobuf:"bytes,19,opt,name=compression,proto3" json:"compression,omitempty"`
+	// Size in bytes (of the decompressed contents, for compressed files) and
+	// modification time (in seconds since the UNIX epoch) of the file, as
+	// recorded in the index. Both are 0 if the index contains no file metadata
+	// (files shorter than 3 bytes are never indexed, so 0 is not a valid size).
+	Size                 uint64   `protobuf:"varint,20,opt,name=size,proto3" json:"size,omitempty"`
+	Mtime                int64    `protobuf:"varint,21,opt,name=mtime,proto3" json:"mtime,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -285,6 +338,83 @@ func (m *Match) GetPackage() string {
 	return ""
 }
 
+func (m *Match) GetFileMatchesOmitted() uint32 {
+	if m != nil {
+		return m.FileMatchesOmitted
+	}
+	return 0
+}
+
+func (m *Match) GetOrigin() string {
+	if m != nil {
+		return m.Origin
+	}
+	return ""
+}
+
+func (m *Match) GetLicense() string {
+	if m != nil {
+		return m.License
+	}
+	return ""
+}
+
+func (m *Match) GetBinaryPackages() []string {
+	if m != nil {
+		return m.BinaryPackages
+	}
+	return nil
+}
+
+func (m *Match) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+func (m *Match) GetHighlightRanges() []*Range {
+	if m != nil {
+		return m.HighlightRanges
+	}
+	return nil
+}
+
+func (m *Match) GetEncoding() string {
+	if m != nil {
+		return m.Encoding
+	}
+	return ""
+}
+
+func (m *Match) GetContextLength() uint32 {
+	if m != nil {
+		return m.ContextLength
+	}
+	return 0
+}
+
+func (m *Match) GetCompression() string {
+	if m != nil {
+		return m.Compression
+	}
+	return ""
+}
+
+func (m *Match) GetSize() uint64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
+func (m *Match) GetMtime() int64 {
+	if m != nil {
+		return m.Mtime
+	}
+	return 0
+}
+
 type ProgressUpdate struct {
 	FilesProcessed       uint64   `protobuf:"varint,1,opt,name=files_processed,json=filesProcessed,proto3" json:"files_processed,omitempty"`
 	FilesTotal           uint64   `protobuf:"varint,2,opt,name=files_total,json=filesTotal,proto3" json:"files_total,omitempty"`
@@ -332,12 +462,15 @@ func (m *ProgressUpdate) GetFilesTotal() uint64 {
 }
 
 type SearchReply struct {
-	Type                 SearchReply_Type `protobuf:"varint,1,opt,name=type,proto3,enum=sourcebackendpb.SearchReply_Type" json:"type,omitempty"`
-	Match                *Match           `protobuf:"bytes,2,opt,name=match,proto3" json:"match,omitempty"`
-	ProgressUpdate       *ProgressUpdate  `protobuf:"bytes,3,opt,name=progress_update,json=progressUpdate,proto3" json:"progress_update,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
-	XXX_unrecognized     []byte           `json:"-"`
-	XXX_sizecache        int32            `json:"-"`
+	Type           SearchReply_Type `protobuf:"varint,1,opt,name=type,proto3,enum=sourcebackendpb.SearchReply_Type" json:"type,omitempty"`
+	Match          *Match           `protobuf:"bytes,2,opt,name=match,proto3" json:"match,omitempty"`
+	ProgressUpdate *ProgressUpdate  `protobuf:"bytes,3,opt,name=progress_update,json=progressUpdate,proto3" json:"progress_update,omitempty"`
+	// Only set for type == COUNTS, i.e. when the query was started with
+	// count=1: the number of matches per package.
+	PackageCounts        []*SearchReply_PackageCount `protobuf:"bytes,4,rep,name=package_counts,json=packageCounts,proto3" json:"package_counts,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}                    `json:"-"`
+	XXX_unrecognized     []byte                      `json:"-"`
+	XXX_sizecache        int32                       `json:"-"`
 }
 
 func (m *SearchReply) Reset()         { *m = SearchReply{} }
@@ -385,6 +518,59 @@ func (m *SearchReply) GetProgressUpdate() *ProgressUpdate {
 	return nil
 }
 
+func (m *SearchReply) GetPackageCounts() []*SearchReply_PackageCount {
+	if m != nil {
+		return m.PackageCounts
+	}
+	return nil
+}
+
+type SearchReply_PackageCount struct {
+	Package              string   `protobuf:"bytes,1,opt,name=package,proto3" json:"package,omitempty"`
+	Count                uint64   `protobuf:"varint,2,opt,name=count,proto3" json:"count,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SearchReply_PackageCount) Reset()         { *m = SearchReply_PackageCount{} }
+func (m *SearchReply_PackageCount) String() string { return proto.CompactTextString(m) }
+func (*SearchReply_PackageCount) ProtoMessage()    {}
+func (*SearchReply_PackageCount) Descriptor() ([]byte, []int) {
+	return fileDescriptor_sourcebackend_1a3dc62c025055f3, []int{5, 0}
+}
+func (m *SearchReply_PackageCount) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SearchReply_PackageCount.Unmarshal(m, b)
+}
+func (m *SearchReply_PackageCount) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SearchReply_PackageCount.Marshal(b, m, deterministic)
+}
+func (dst *SearchReply_PackageCount) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SearchReply_PackageCount.Merge(dst, src)
+}
+func (m *SearchReply_PackageCount) XXX_Size() int {
+	return xxx_messageInfo_SearchReply_PackageCount.Size(m)
+}
+func (m *SearchReply_PackageCount) XXX_DiscardUnknown() {
+	xxx_messageInfo_SearchReply_PackageCount.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SearchReply_PackageCount proto.InternalMessageInfo
+
+func (m *SearchReply_PackageCount) GetPackage() string {
+	if m != nil {
+		return m.Package
+	}
+	return ""
+}
+
+func (m *SearchReply_PackageCount) GetCount() uint64 {
+	if m != nil {
+		return m.Count
+	}
+	return 0
+}
+
 type ReplaceIndexRequest struct {
 	ReplacementPath      string   `protobuf:"bytes,1,opt,name=replacement_path,json=replacementPath,proto3" json:"replacement_path,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -453,6 +639,367 @@ func (m *ReplaceIndexReply) XXX_DiscardUnknown() {
 
 var xxx_messageInfo_ReplaceIndexReply proto.InternalMessageInfo
 
+type TrigramStatsRequest struct {
+	Query string `protobuf:"bytes,1,opt,name=query,proto3" json:"query,omitempty"`
+	// Rewritten URL (after RewriteQuery()), see SearchRequest.
+	RewrittenUrl         string   `protobuf:"bytes,2,opt,name=rewritten_url,json=rewrittenUrl,proto3" json:"rewritten_url,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *TrigramStatsRequest) Reset()         { *m = TrigramStatsRequest{} }
+func (m *TrigramStatsRequest) String() string { return proto.CompactTextString(m) }
+func (*TrigramStatsRequest) ProtoMessage()    {}
+func (*TrigramStatsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_sourcebackend_1a3dc62c025055f3, []int{8}
+}
+func (m *TrigramStatsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_TrigramStatsRequest.Unmarshal(m, b)
+}
+func (m *TrigramStatsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_TrigramStatsRequest.Marshal(b, m, deterministic)
+}
+func (dst *TrigramStatsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TrigramStatsRequest.Merge(dst, src)
+}
+func (m *TrigramStatsRequest) XXX_Size() int {
+	return xxx_messageInfo_TrigramStatsRequest.Size(m)
+}
+func (m *TrigramStatsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_TrigramStatsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_TrigramStatsRequest proto.InternalMessageInfo
+
+func (m *TrigramStatsRequest) GetQuery() string {
+	if m != nil {
+		return m.Query
+	}
+	return ""
+}
+
+func (m *TrigramStatsRequest) GetRewrittenUrl() string {
+	if m != nil {
+		return m.RewrittenUrl
+	}
+	return ""
+}
+
+type TrigramStatsReply struct {
+	// All trigrams which the index query for the regular expression consists
+	// of, in no particular order.
+	Trigrams []*TrigramStatsReply_Trigram `protobuf:"bytes,1,rep,name=trigrams,proto3" json:"trigrams,omitempty"`
+	// Estimated number of files which Search would need to grep (before
+	// filtering by keywords such as package: or path:). This is an upper bound
+	// derived from the posting list sizes alone.
+	EstimatedFiles uint64 `protobuf:"varint,2,opt,name=estimated_files,json=estimatedFiles,proto3" json:"estimated_files,omitempty"`
+	// Total number of files in the index.
+	FilesTotal           uint64   `protobuf:"varint,3,opt,name=files_total,json=filesTotal,proto3" json:"files_total,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *TrigramStatsReply) Reset()         { *m = TrigramStatsReply{} }
+func (m *TrigramStatsReply) String() string { return proto.CompactTextString(m) }
+func (*TrigramStatsReply) ProtoMessage()    {}
+func (*TrigramStatsReply) Descriptor() ([]byte, []int) {
+	return fileDescriptor_sourcebackend_1a3dc62c025055f3, []int{9}
+}
+func (m *TrigramStatsReply) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_TrigramStatsReply.Unmarshal(m, b)
+}
+func (m *TrigramStatsReply) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_TrigramStatsReply.Marshal(b, m, deterministic)
+}
+func (dst *TrigramStatsReply) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TrigramStatsReply.Merge(dst, src)
+}
+func (m *TrigramStatsReply) XXX_Size() int {
+	return xxx_messageInfo_TrigramStatsReply.Size(m)
+}
+func (m *TrigramStatsReply) XXX_DiscardUnknown() {
+	xxx_messageInfo_TrigramStatsReply.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_TrigramStatsReply proto.InternalMessageInfo
+
+func (m *TrigramStatsReply) GetTrigrams() []*TrigramStatsReply_Trigram {
+	if m != nil {
+		return m.Trigrams
+	}
+	return nil
+}
+
+func (m *TrigramStatsReply) GetEstimatedFiles() uint64 {
+	if m != nil {
+		return m.EstimatedFiles
+	}
+	return 0
+}
+
+func (m *TrigramStatsReply) GetFilesTotal() uint64 {
+	if m != nil {
+		return m.FilesTotal
+	}
+	return 0
+}
+
+type TrigramStatsReply_Trigram struct {
+	Trigram string `protobuf:"bytes,1,opt,name=trigram,proto3" json:"trigram,omitempty"`
+	// Number of files containing the trigram, i.e. the length of its
+	// posting list.
+	Files                uint64   `protobuf:"varint,2,opt,name=files,proto3" json:"files,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *TrigramStatsReply_Trigram) Reset()         { *m = TrigramStatsReply_Trigram{} }
+func (m *TrigramStatsReply_Trigram) String() string { return proto.CompactTextString(m) }
+func (*TrigramStatsReply_Trigram) ProtoMessage()    {}
+func (*TrigramStatsReply_Trigram) Descriptor() ([]byte, []int) {
+	return fileDescriptor_sourcebackend_1a3dc62c025055f3, []int{9, 0}
+}
+func (m *TrigramStatsReply_Trigram) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_TrigramStatsReply_Trigram.Unmarshal(m, b)
+}
+func (m *TrigramStatsReply_Trigram) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_TrigramStatsReply_Trigram.Marshal(b, m, deterministic)
+}
+func (dst *TrigramStatsReply_Trigram) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TrigramStatsReply_Trigram.Merge(dst, src)
+}
+func (m *TrigramStatsReply_Trigram) XXX_Size() int {
+	return xxx_messageInfo_TrigramStatsReply_Trigram.Size(m)
+}
+func (m *TrigramStatsReply_Trigram) XXX_DiscardUnknown() {
+	xxx_messageInfo_TrigramStatsReply_Trigram.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_TrigramStatsReply_Trigram proto.InternalMessageInfo
+
+func (m *TrigramStatsReply_Trigram) GetTrigram() string {
+	if m != nil {
+		return m.Trigram
+	}
+	return ""
+}
+
+func (m *TrigramStatsReply_Trigram) GetFiles() uint64 {
+	if m != nil {
+		return m.Files
+	}
+	return 0
+}
+
+type XrefRequest struct {
+	// Include or import to look up, e.g. “stdio.h” or “os/exec”.
+	Include              string   `protobuf:"bytes,1,opt,name=include,proto3" json:"include,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *XrefRequest) Reset()         { *m = XrefRequest{} }
+func (m *XrefRequest) String() string { return proto.CompactTextString(m) }
+func (*XrefRequest) ProtoMessage()    {}
+func (*XrefRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_sourcebackend_1a3dc62c025055f3, []int{10}
+}
+func (m *XrefRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_XrefRequest.Unmarshal(m, b)
+}
+func (m *XrefRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_XrefRequest.Marshal(b, m, deterministic)
+}
+func (dst *XrefRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_XrefRequest.Merge(dst, src)
+}
+func (m *XrefRequest) XXX_Size() int {
+	return xxx_messageInfo_XrefRequest.Size(m)
+}
+func (m *XrefRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_XrefRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_XrefRequest proto.InternalMessageInfo
+
+func (m *XrefRequest) GetInclude() string {
+	if m != nil {
+		return m.Include
+	}
+	return ""
+}
+
+type XrefReply struct {
+	// Files (e.g. “i3-wm_4.16-1/src/main.c”) containing the include or
+	// import, sorted.
+	Path                 []string `protobuf:"bytes,1,rep,name=path,proto3" json:"path,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *XrefReply) Reset()         { *m = XrefReply{} }
+func (m *XrefReply) String() string { return proto.CompactTextString(m) }
+func (*XrefReply) ProtoMessage()    {}
+func (*XrefReply) Descriptor() ([]byte, []int) {
+	return fileDescriptor_sourcebackend_1a3dc62c025055f3, []int{11}
+}
+func (m *XrefReply) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_XrefReply.Unmarshal(m, b)
+}
+func (m *XrefReply) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_XrefReply.Marshal(b, m, deterministic)
+}
+func (dst *XrefReply) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_XrefReply.Merge(dst, src)
+}
+func (m *XrefReply) XXX_Size() int {
+	return xxx_messageInfo_XrefReply.Size(m)
+}
+func (m *XrefReply) XXX_DiscardUnknown() {
+	xxx_messageInfo_XrefReply.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_XrefReply proto.InternalMessageInfo
+
+func (m *XrefReply) GetPath() []string {
+	if m != nil {
+		return m.Path
+	}
+	return nil
+}
+
+// Range is the byte range [start, end) of a line.
+type Range struct {
+	Start                uint32   `protobuf:"varint,1,opt,name=start,proto3" json:"start,omitempty"`
+	End                  uint32   `protobuf:"varint,2,opt,name=end,proto3" json:"end,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Range) Reset()         { *m = Range{} }
+func (m *Range) String() string { return proto.CompactTextString(m) }
+func (*Range) ProtoMessage()    {}
+func (*Range) Descriptor() ([]byte, []int) {
+	return fileDescriptor_sourcebackend_1a3dc62c025055f3, []int{12}
+}
+func (m *Range) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Range.Unmarshal(m, b)
+}
+func (m *Range) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Range.Marshal(b, m, deterministic)
+}
+func (dst *Range) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Range.Merge(dst, src)
+}
+func (m *Range) XXX_Size() int {
+	return xxx_messageInfo_Range.Size(m)
+}
+func (m *Range) XXX_DiscardUnknown() {
+	xxx_messageInfo_Range.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Range proto.InternalMessageInfo
+
+func (m *Range) GetStart() uint32 {
+	if m != nil {
+		return m.Start
+	}
+	return 0
+}
+
+func (m *Range) GetEnd() uint32 {
+	if m != nil {
+		return m.End
+	}
+	return 0
+}
+
+type CapabilitiesRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CapabilitiesRequest) Reset()         { *m = CapabilitiesRequest{} }
+func (m *CapabilitiesRequest) String() string { return proto.CompactTextString(m) }
+func (*CapabilitiesRequest) ProtoMessage()    {}
+func (*CapabilitiesRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_sourcebackend_1a3dc62c025055f3, []int{13}
+}
+func (m *CapabilitiesRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CapabilitiesRequest.Unmarshal(m, b)
+}
+func (m *CapabilitiesRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CapabilitiesRequest.Marshal(b, m, deterministic)
+}
+func (dst *CapabilitiesRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CapabilitiesRequest.Merge(dst, src)
+}
+func (m *CapabilitiesRequest) XXX_Size() int {
+	return xxx_messageInfo_CapabilitiesRequest.Size(m)
+}
+func (m *CapabilitiesRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_CapabilitiesRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CapabilitiesRequest proto.InternalMessageInfo
+
+type CapabilitiesReply struct {
+	// Version of the source backend, e.g. its build date. Only used for
+	// reporting, see Capabilities for feature detection.
+	Version string `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	// Capabilities which the source backend understands, e.g. “count” (see
+	// the sourcebackend package). Unknown capabilities are ignored.
+	Capabilities         []string `protobuf:"bytes,2,rep,name=capabilities,proto3" json:"capabilities,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CapabilitiesReply) Reset()         { *m = CapabilitiesReply{} }
+func (m *CapabilitiesReply) String() string { return proto.CompactTextString(m) }
+func (*CapabilitiesReply) ProtoMessage()    {}
+func (*CapabilitiesReply) Descriptor() ([]byte, []int) {
+	return fileDescriptor_sourcebackend_1a3dc62c025055f3, []int{14}
+}
+func (m *CapabilitiesReply) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CapabilitiesReply.Unmarshal(m, b)
+}
+func (m *CapabilitiesReply) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CapabilitiesReply.Marshal(b, m, deterministic)
+}
+func (dst *CapabilitiesReply) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CapabilitiesReply.Merge(dst, src)
+}
+func (m *CapabilitiesReply) XXX_Size() int {
+	return xxx_messageInfo_CapabilitiesReply.Size(m)
+}
+func (m *CapabilitiesReply) XXX_DiscardUnknown() {
+	xxx_messageInfo_CapabilitiesReply.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CapabilitiesReply proto.InternalMessageInfo
+
+func (m *CapabilitiesReply) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+func (m *CapabilitiesReply) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*FileRequest)(nil), "sourcebackendpb.FileRequest")
 	proto.RegisterType((*FileReply)(nil), "sourcebackendpb.FileReply")
@@ -460,8 +1007,17 @@ func init() {
 	proto.RegisterType((*Match)(nil), "sourcebackendpb.Match")
 	proto.RegisterType((*ProgressUpdate)(nil), "sourcebackendpb.ProgressUpdate")
 	proto.RegisterType((*SearchReply)(nil), "sourcebackendpb.SearchReply")
+	proto.RegisterType((*SearchReply_PackageCount)(nil), "sourcebackendpb.SearchReply.PackageCount")
 	proto.RegisterType((*ReplaceIndexRequest)(nil), "sourcebackendpb.ReplaceIndexRequest")
 	proto.RegisterType((*ReplaceIndexReply)(nil), "sourcebackendpb.ReplaceIndexReply")
+	proto.RegisterType((*TrigramStatsRequest)(nil), "sourcebackendpb.TrigramStatsRequest")
+	proto.RegisterType((*TrigramStatsReply)(nil), "sourcebackendpb.TrigramStatsReply")
+	proto.RegisterType((*TrigramStatsReply_Trigram)(nil), "sourcebackendpb.TrigramStatsReply.Trigram")
+	proto.RegisterType((*XrefRequest)(nil), "sourcebackendpb.XrefRequest")
+	proto.RegisterType((*XrefReply)(nil), "sourcebackendpb.XrefReply")
+	proto.RegisterType((*Range)(nil), "sourcebackendpb.Range")
+	proto.RegisterType((*CapabilitiesRequest)(nil), "sourcebackendpb.CapabilitiesRequest")
+	proto.RegisterType((*CapabilitiesReply)(nil), "sourcebackendpb.CapabilitiesReply")
 	proto.RegisterEnum("sourcebackendpb.SearchReply_Type", SearchReply_Type_name, SearchReply_Type_value)
 }
 
@@ -485,6 +1041,16 @@ type SourceBackendClient interface {
 	// system level, the specified file is mv'ed to the file specified by
 	// -index_path.
 	ReplaceIndex(ctx context.Context, in *ReplaceIndexRequest, opts ...grpc.CallOption) (*ReplaceIndexReply, error)
+	// TrigramStats returns posting list sizes for the trigrams of the given
+	// query without searching, for estimating the cost of the query.
+	TrigramStats(ctx context.Context, in *TrigramStatsRequest, opts ...grpc.CallOption) (*TrigramStatsReply, error)
+	// Xref returns the files which include or import the given header or
+	// module, as recorded by dcs-package-importer.
+	Xref(ctx context.Context, in *XrefRequest, opts ...grpc.CallOption) (*XrefReply, error)
+	// Capabilities returns the features which the source backend understands,
+	// so that clients can degrade gracefully when talking to older source
+	// backends. Called by dcs-web when connecting.
+	Capabilities(ctx context.Context, in *CapabilitiesRequest, opts ...grpc.CallOption) (*CapabilitiesReply, error)
 }
 
 type sourceBackendClient struct {
@@ -545,6 +1111,33 @@ func (c *sourceBackendClient) ReplaceIndex(ctx context.Context, in *ReplaceIndex
 	return out, nil
 }
 
+func (c *sourceBackendClient) TrigramStats(ctx context.Context, in *TrigramStatsRequest, opts ...grpc.CallOption) (*TrigramStatsReply, error) {
+	out := new(TrigramStatsReply)
+	err := c.cc.Invoke(ctx, "/sourcebackendpb.SourceBackend/TrigramStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sourceBackendClient) Xref(ctx context.Context, in *XrefRequest, opts ...grpc.CallOption) (*XrefReply, error) {
+	out := new(XrefReply)
+	err := c.cc.Invoke(ctx, "/sourcebackendpb.SourceBackend/Xref", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sourceBackendClient) Capabilities(ctx context.Context, in *CapabilitiesRequest, opts ...grpc.CallOption) (*CapabilitiesReply, error) {
+	out := new(CapabilitiesReply)
+	err := c.cc.Invoke(ctx, "/sourcebackendpb.SourceBackend/Capabilities", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // SourceBackendServer is the server API for SourceBackend service.
 type SourceBackendServer interface {
 	// File reads the file and returns its contents.
@@ -555,6 +1148,16 @@ type SourceBackendServer interface {
 	// system level, the specified file is mv'ed to the file specified by
 	// -index_path.
 	ReplaceIndex(context.Context, *ReplaceIndexRequest) (*ReplaceIndexReply, error)
+	// TrigramStats returns posting list sizes for the trigrams of the given
+	// query without searching, for estimating the cost of the query.
+	TrigramStats(context.Context, *TrigramStatsRequest) (*TrigramStatsReply, error)
+	// Xref returns the files which include or import the given header or
+	// module, as recorded by dcs-package-importer.
+	Xref(context.Context, *XrefRequest) (*XrefReply, error)
+	// Capabilities returns the features which the source backend understands,
+	// so that clients can degrade gracefully when talking to older source
+	// backends. Called by dcs-web when connecting.
+	Capabilities(context.Context, *CapabilitiesRequest) (*CapabilitiesReply, error)
 }
 
 func RegisterSourceBackendServer(s *grpc.Server, srv SourceBackendServer) {
@@ -618,6 +1221,60 @@ func _SourceBackend_ReplaceIndex_Handler(srv interface{}, ctx context.Context, d
 	return interceptor(ctx, in, info, handler)
 }
 
+func _SourceBackend_TrigramStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TrigramStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SourceBackendServer).TrigramStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sourcebackendpb.SourceBackend/TrigramStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SourceBackendServer).TrigramStats(ctx, req.(*TrigramStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SourceBackend_Xref_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(XrefRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SourceBackendServer).Xref(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sourcebackendpb.SourceBackend/Xref",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SourceBackendServer).Xref(ctx, req.(*XrefRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SourceBackend_Capabilities_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CapabilitiesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SourceBackendServer).Capabilities(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sourcebackendpb.SourceBackend/Capabilities",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SourceBackendServer).Capabilities(ctx, req.(*CapabilitiesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _SourceBackend_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "sourcebackendpb.SourceBackend",
 	HandlerType: (*SourceBackendServer)(nil),
@@ -630,6 +1287,18 @@ var _SourceBackend_serviceDesc = grpc.ServiceDesc{
 			MethodName: "ReplaceIndex",
 			Handler:    _SourceBackend_ReplaceIndex_Handler,
 		},
+		{
+			MethodName: "TrigramStats",
+			Handler:    _SourceBackend_TrigramStats_Handler,
+		},
+		{
+			MethodName: "Xref",
+			Handler:    _SourceBackend_Xref_Handler,
+		},
+		{
+			MethodName: "Capabilities",
+			Handler:    _SourceBackend_Capabilities_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -644,42 +1313,71 @@ var _SourceBackend_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("sourcebackend.proto", fileDescriptor_sourcebackend_1a3dc62c025055f3) }
 
 var fileDescriptor_sourcebackend_1a3dc62c025055f3 = []byte{
-	// 582 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x54, 0x5f, 0x6f, 0xda, 0x3e,
-	0x14, 0x6d, 0xfa, 0x0b, 0x6d, 0xb9, 0x14, 0xe8, 0xcf, 0x4c, 0x53, 0x84, 0xaa, 0xb5, 0xcd, 0xa6,
-	0xb5, 0x93, 0x26, 0x18, 0xd9, 0x9f, 0xe7, 0xb5, 0x6b, 0xb7, 0xae, 0x52, 0x35, 0x64, 0xe8, 0x0b,
-	0x2f, 0xc8, 0x84, 0x3b, 0x88, 0x08, 0x8e, 0xeb, 0x38, 0x1a, 0xf9, 0xbe, 0xfb, 0x02, 0x7b, 0xde,
-	0xcb, 0x64, 0x87, 0x50, 0x28, 0xed, 0xf6, 0x44, 0xce, 0xf1, 0xf1, 0xbd, 0xe7, 0xfe, 0x31, 0x50,
-	0x8b, 0xa3, 0x44, 0xfa, 0x38, 0x60, 0xfe, 0x04, 0xf9, 0xb0, 0x21, 0x64, 0xa4, 0x22, 0x52, 0x5d,
-	0x21, 0xc5, 0xc0, 0x3d, 0x82, 0xd2, 0xe7, 0x20, 0x44, 0x8a, 0xb7, 0x09, 0xc6, 0x8a, 0x10, 0xb0,
-	0x05, 0x53, 0x63, 0xc7, 0x3a, 0xb4, 0x4e, 0x8a, 0xd4, 0x7c, 0xbb, 0xc7, 0x50, 0xcc, 0x24, 0x22,
-	0x4c, 0x49, 0x1d, 0x76, 0xfc, 0x88, 0x2b, 0xe4, 0x2a, 0x36, 0xa2, 0x5d, 0xba, 0xc0, 0xee, 0x15,
-	0x94, 0x3b, 0xc8, 0xa4, 0x3f, 0xce, 0xa3, 0x3d, 0x81, 0xc2, 0x6d, 0x82, 0x32, 0x9d, 0x87, 0xcb,
-	0x00, 0x79, 0x0e, 0x65, 0x89, 0x3f, 0x64, 0xa0, 0x14, 0xf2, 0x7e, 0x22, 0x43, 0x67, 0xd3, 0x9c,
-	0xee, 0x2e, 0xc8, 0x1b, 0x19, 0xba, 0xbf, 0x2c, 0x28, 0x5c, 0x33, 0xe5, 0x8f, 0x1f, 0xb2, 0xa4,
-	0xb9, 0x30, 0xe0, 0x68, 0x6e, 0x96, 0xa9, 0xf9, 0xd6, 0xc9, 0x7c, 0x35, 0x13, 0x9e, 0xf3, 0x5f,
-	0x96, 0xcc, 0x80, 0x9c, 0x6d, 0x39, 0xf6, 0x1d, 0xdb, 0x22, 0x0e, 0x6c, 0x1b, 0xd7, 0x33, 0xe5,
-	0x14, 0x0c, 0x9f, 0xc3, 0xb9, 0x9e, 0xb7, 0x9c, 0xad, 0x85, 0x9e, 0xb7, 0x72, 0xd6, 0x73, 0xb6,
-	0xef, 0x58, 0x4f, 0xf7, 0x42, 0xbb, 0x91, 0x8c, 0x4f, 0x9c, 0x9d, 0x43, 0xeb, 0x64, 0x93, 0x2e,
-	0xb0, 0xce, 0xa0, 0x7f, 0x03, 0x3e, 0x72, 0x8a, 0xe6, 0x28, 0x87, 0xfa, 0x44, 0x30, 0x7f, 0xc2,
-	0x46, 0xe8, 0x40, 0x96, 0x7b, 0x0e, 0xdd, 0x1e, 0x54, 0xda, 0x32, 0x1a, 0x49, 0x8c, 0xe3, 0x1b,
-	0x31, 0x64, 0x0a, 0xc9, 0x31, 0x54, 0xbf, 0x07, 0x21, 0xc6, 0x7d, 0x21, 0x23, 0x1f, 0xe3, 0x18,
-	0x87, 0xa6, 0x0d, 0x36, 0xad, 0x18, 0xba, 0x9d, 0xb3, 0xe4, 0x00, 0x4a, 0x99, 0x50, 0x45, 0x8a,
-	0x65, 0x1d, 0xb5, 0x29, 0x18, 0xaa, 0xab, 0x19, 0xf7, 0xa7, 0x05, 0xa5, 0x7c, 0x38, 0x7a, 0x8e,
-	0xef, 0xc1, 0x56, 0xa9, 0x40, 0x13, 0xae, 0xe2, 0x1d, 0x35, 0xee, 0xed, 0x45, 0x63, 0x49, 0xdb,
-	0xe8, 0xa6, 0x02, 0xa9, 0x91, 0x93, 0xd7, 0x50, 0x98, 0xea, 0xa9, 0x98, 0x0c, 0x25, 0xef, 0xe9,
-	0xda, 0x3d, 0x33, 0x33, 0x9a, 0x89, 0xc8, 0x25, 0x54, 0xc5, 0xbc, 0xa0, 0x7e, 0x62, 0x2a, 0x32,
-	0xc3, 0x29, 0x79, 0x07, 0x6b, 0xf7, 0x56, 0x0b, 0xa7, 0x15, 0xb1, 0x82, 0xdd, 0x97, 0x60, 0x6b,
-	0x17, 0xa4, 0x08, 0x85, 0xeb, 0xd3, 0xee, 0xa7, 0xcb, 0xbd, 0x0d, 0x52, 0x83, 0x6a, 0x9b, 0x7e,
-	0xfb, 0x42, 0x2f, 0x3a, 0x9d, 0xfe, 0x4d, 0xfb, 0xfc, 0xb4, 0x7b, 0xb1, 0x67, 0xb9, 0x1f, 0xa1,
-	0xa6, 0x3d, 0x33, 0x1f, 0xbf, 0xf2, 0x21, 0xce, 0xf2, 0x45, 0x7c, 0x05, 0x7b, 0x32, 0xa3, 0xa7,
-	0xc8, 0x55, 0x7f, 0x69, 0x9f, 0xaa, 0x4b, 0x7c, 0x5b, 0x6f, 0x7b, 0x0d, 0xfe, 0x5f, 0x8d, 0x20,
-	0xc2, 0xd4, 0xfb, 0x6d, 0x41, 0xb9, 0x63, 0x1c, 0x9f, 0x65, 0x8e, 0xc9, 0x19, 0xd8, 0xfa, 0x51,
-	0x90, 0xfd, 0xb5, 0x4a, 0x96, 0x9e, 0x53, 0xbd, 0xfe, 0xc8, 0xa9, 0x08, 0x53, 0x77, 0x83, 0x5c,
-	0xc1, 0x56, 0xd6, 0x66, 0xf2, 0xec, 0xd1, 0xfe, 0x67, 0x71, 0xf6, 0xff, 0x36, 0x1f, 0x77, 0xe3,
-	0x8d, 0x45, 0x7a, 0xb0, 0xbb, 0x6c, 0x9b, 0xbc, 0x58, 0xbb, 0xf1, 0x40, 0x5f, 0xea, 0xee, 0x3f,
-	0x54, 0x26, 0xfa, 0xd9, 0x87, 0xde, 0xbb, 0x51, 0xa0, 0xc6, 0xc9, 0xa0, 0xe1, 0x47, 0xd3, 0xe6,
-	0x39, 0x0e, 0x02, 0xc6, 0x9b, 0x43, 0x3f, 0x6e, 0x06, 0x5c, 0xa1, 0xe4, 0x2c, 0x6c, 0x9a, 0x3f,
-	0x97, 0xe6, 0xbd, 0x58, 0x83, 0x2d, 0x43, 0xbf, 0xfd, 0x13, 0x00, 0x00, 0xff, 0xff, 0x4b, 0x0a,
-	0x96, 0x6b, 0x8a, 0x04, 0x00, 0x00,
+	// 1053 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x56, 0xdf, 0x6f, 0xdb, 0x36,
+	0x10, 0x8e, 0x63, 0x39, 0x89, 0xcf, 0x3f, 0x43, 0xa7, 0x85, 0x60, 0x14, 0x8b, 0xa7, 0x6d, 0x88,
+	0x3b, 0x0c, 0x71, 0xe3, 0xfd, 0x00, 0xf6, 0x32, 0x2c, 0x49, 0xdb, 0x75, 0xc5, 0xb2, 0x78, 0xb2,
+	0x03, 0x0c, 0x79, 0x11, 0x64, 0x99, 0xb5, 0x89, 0xc8, 0x94, 0x4a, 0xd1, 0x5b, 0xbc, 0xc7, 0xfd,
+	0xa5, 0x7b, 0xde, 0x3f, 0xb0, 0xd7, 0xe1, 0x48, 0x4a, 0x91, 0x63, 0xa7, 0x79, 0xe9, 0x93, 0x75,
+	0xdf, 0x1d, 0xef, 0xc8, 0xef, 0xbe, 0x23, 0x0d, 0xad, 0x24, 0x5a, 0x88, 0x80, 0x8e, 0xfd, 0xe0,
+	0x86, 0xf2, 0xc9, 0x71, 0x2c, 0x22, 0x19, 0x91, 0xc6, 0x0a, 0x18, 0x8f, 0x9d, 0x73, 0xa8, 0xbc,
+	0x66, 0x21, 0x75, 0xe9, 0xfb, 0x05, 0x4d, 0x24, 0x21, 0x60, 0xc5, 0xbe, 0x9c, 0xd9, 0x85, 0x4e,
+	0xa1, 0x5b, 0x76, 0xd5, 0x37, 0xe9, 0x40, 0x25, 0x88, 0xe6, 0xb1, 0xa0, 0x49, 0xc2, 0x22, 0x6e,
+	0x6f, 0x2b, 0x57, 0x1e, 0x72, 0x8e, 0xa0, 0xac, 0x93, 0xc4, 0xe1, 0x92, 0xb4, 0x61, 0x2f, 0x88,
+	0xb8, 0xa4, 0x5c, 0x26, 0x2a, 0x4d, 0xd5, 0xcd, 0x6c, 0xe7, 0x2d, 0xd4, 0x86, 0xd4, 0x17, 0xc1,
+	0x2c, 0xad, 0x77, 0x00, 0xa5, 0xf7, 0x0b, 0x2a, 0x96, 0xa6, 0xa0, 0x36, 0xc8, 0x67, 0x50, 0x13,
+	0xf4, 0x4f, 0xc1, 0xa4, 0xa4, 0xdc, 0x5b, 0x88, 0xd0, 0xd4, 0xac, 0x66, 0xe0, 0x95, 0x08, 0x9d,
+	0x7f, 0x2d, 0x28, 0x5d, 0xf8, 0x32, 0x98, 0x6d, 0xdc, 0x34, 0x01, 0x2b, 0x64, 0x9c, 0xaa, 0x95,
+	0x35, 0x57, 0x7d, 0x63, 0xb1, 0x40, 0xde, 0xc6, 0x7d, 0xbb, 0xa8, 0x8b, 0x29, 0x23, 0x45, 0x4f,
+	0x6c, 0xeb, 0x0e, 0x3d, 0x21, 0x36, 0xec, 0xaa, 0x5d, 0xdf, 0x4a, 0xbb, 0xa4, 0xf0, 0xd4, 0x34,
+	0xf1, 0xfc, 0xc4, 0xde, 0xc9, 0xe2, 0xf9, 0x49, 0x8a, 0xf6, 0xed, 0xdd, 0x3b, 0xb4, 0x8f, 0x5c,
+	0xe0, 0x6e, 0x84, 0xcf, 0x6f, 0xec, 0xbd, 0x4e, 0xa1, 0xbb, 0xed, 0x66, 0x36, 0x56, 0xc0, 0x5f,
+	0xc6, 0xa7, 0x76, 0x59, 0xb9, 0x52, 0x13, 0x3d, 0xb1, 0x1f, 0xdc, 0xf8, 0x53, 0x6a, 0x83, 0xae,
+	0x6d, 0x4c, 0xf2, 0x02, 0x0e, 0xde, 0xb1, 0x90, 0x7a, 0x73, 0x3c, 0x37, 0x4d, 0xbc, 0x68, 0x8e,
+	0x74, 0x4c, 0xec, 0x8a, 0x3a, 0x25, 0x41, 0xdf, 0x85, 0x76, 0x5d, 0x6a, 0x0f, 0x79, 0x0a, 0x3b,
+	0x91, 0x60, 0x53, 0xc6, 0xed, 0xaa, 0x4a, 0x65, 0x2c, 0xac, 0x11, 0xb2, 0x80, 0xf2, 0x84, 0xda,
+	0x35, 0x5d, 0xc3, 0x98, 0xe4, 0x08, 0x1a, 0x63, 0xc6, 0x7d, 0xb1, 0xf4, 0x4c, 0xd5, 0xc4, 0xae,
+	0x77, 0x8a, 0xdd, 0xb2, 0x5b, 0xd7, 0xf0, 0xc0, 0xa0, 0x98, 0xe2, 0x0f, 0x2a, 0x94, 0x26, 0x1a,
+	0x3a, 0x85, 0x31, 0xc9, 0x29, 0x34, 0x67, 0x6c, 0x3a, 0x0b, 0xd9, 0x74, 0x26, 0x3d, 0xe1, 0x73,
+	0xcc, 0xd1, 0xec, 0x14, 0xbb, 0x95, 0xfe, 0xd3, 0xe3, 0x7b, 0x02, 0x3c, 0x76, 0xd1, 0xed, 0x36,
+	0xb2, 0x78, 0x65, 0x27, 0xc8, 0x1c, 0xe5, 0x41, 0x34, 0x41, 0x7a, 0xf6, 0x55, 0xf6, 0xcc, 0x26,
+	0x5f, 0x40, 0xdd, 0x34, 0xc3, 0x0b, 0x29, 0x9f, 0xca, 0x99, 0x4d, 0xd4, 0xf9, 0x6b, 0x06, 0xfd,
+	0x45, 0x81, 0xf7, 0x75, 0xdb, 0x5a, 0xd3, 0x2d, 0x8a, 0x24, 0x61, 0x7f, 0x51, 0xfb, 0xa0, 0x53,
+	0xe8, 0x5a, 0xae, 0xfa, 0xc6, 0x46, 0xce, 0x25, 0x9b, 0x53, 0xfb, 0x49, 0xa7, 0xd0, 0x2d, 0xba,
+	0xda, 0x70, 0xae, 0xa1, 0x3e, 0x10, 0xd1, 0x14, 0x17, 0x5e, 0xc5, 0x13, 0x5f, 0x2a, 0x9a, 0x90,
+	0xee, 0xc4, 0x8b, 0x45, 0x14, 0xd0, 0x24, 0xa1, 0x13, 0xa5, 0x3f, 0xcb, 0xad, 0x2b, 0x78, 0x90,
+	0xa2, 0xe4, 0x10, 0x2a, 0x3a, 0x50, 0x46, 0xd2, 0xd7, 0x52, 0xb6, 0x5c, 0x50, 0xd0, 0x08, 0x11,
+	0xe7, 0xef, 0x22, 0x54, 0xd2, 0xa9, 0xc0, 0x01, 0xfa, 0x16, 0x2c, 0xb9, 0x8c, 0xa9, 0x4a, 0x57,
+	0xef, 0x7f, 0xba, 0xc6, 0x58, 0x2e, 0xf6, 0x78, 0xb4, 0x8c, 0xa9, 0xab, 0xc2, 0xc9, 0x57, 0x50,
+	0x52, 0xb2, 0x50, 0x15, 0x36, 0x31, 0xad, 0x94, 0xe1, 0xea, 0x20, 0xf2, 0x06, 0x1a, 0xb1, 0x39,
+	0x90, 0xb7, 0x50, 0x27, 0x52, 0x53, 0x51, 0xe9, 0x1f, 0xae, 0xad, 0x5b, 0x3d, 0xb8, 0x5b, 0x8f,
+	0x57, 0x89, 0x18, 0x40, 0xdd, 0x08, 0xc5, 0x0b, 0xa2, 0x05, 0x4e, 0xbd, 0xa5, 0x5a, 0xfd, 0xfc,
+	0x83, 0x1b, 0x37, 0x2a, 0x3a, 0xc7, 0x15, 0x6e, 0x2d, 0xce, 0x59, 0x49, 0xfb, 0x07, 0xa8, 0xe6,
+	0xdd, 0xf9, 0x79, 0x28, 0xac, 0xce, 0x03, 0x4e, 0x1d, 0x86, 0x18, 0x56, 0xb5, 0xe1, 0xf4, 0xc1,
+	0x42, 0x5e, 0x48, 0x19, 0x4a, 0x17, 0xa7, 0xa3, 0xf3, 0x37, 0xcd, 0x2d, 0xd2, 0x82, 0xc6, 0xc0,
+	0xbd, 0xfc, 0xc9, 0x7d, 0x35, 0x1c, 0x7a, 0x57, 0x83, 0x97, 0xa7, 0xa3, 0x57, 0xcd, 0x02, 0x01,
+	0xd8, 0x39, 0xbf, 0xbc, 0xfa, 0x75, 0x34, 0x6c, 0x6e, 0x3b, 0x3f, 0x42, 0x0b, 0x37, 0xe6, 0x07,
+	0xf4, 0x67, 0x3e, 0xa1, 0xb7, 0xe9, 0xfd, 0xf4, 0x1c, 0x9a, 0x42, 0xc3, 0x73, 0xca, 0xa5, 0x97,
+	0xbb, 0x66, 0x1a, 0x39, 0x7c, 0xe0, 0xcb, 0x99, 0xd3, 0x82, 0xfd, 0xd5, 0x0c, 0x71, 0xb8, 0x74,
+	0x06, 0xd0, 0x1a, 0x09, 0x36, 0x15, 0xfe, 0x7c, 0x28, 0x7d, 0x99, 0x7c, 0x84, 0x6b, 0xef, 0x9f,
+	0x02, 0xec, 0xaf, 0xa6, 0x44, 0xcd, 0xbc, 0x86, 0x3d, 0xa9, 0x41, 0xbc, 0x74, 0x91, 0xfe, 0x2f,
+	0xd7, 0xe8, 0x5f, 0x5b, 0x95, 0x22, 0x6e, 0xb6, 0x16, 0x55, 0x4d, 0x13, 0xc9, 0xe6, 0xbe, 0xa4,
+	0x13, 0x4f, 0x69, 0xd4, 0x50, 0x5b, 0xcf, 0x60, 0xbc, 0xe9, 0x93, 0xfb, 0xaa, 0x2e, 0xde, 0x57,
+	0x75, 0xfb, 0x7b, 0xd8, 0x35, 0xe9, 0xb1, 0x7f, 0xa6, 0x40, 0xda, 0x3f, 0x63, 0x22, 0x0f, 0xf9,
+	0x22, 0xda, 0x70, 0x8e, 0xa0, 0xf2, 0xbb, 0xa0, 0xef, 0x52, 0xb2, 0x6c, 0xd8, 0x65, 0x3c, 0x08,
+	0x17, 0x93, 0xac, 0xfd, 0xc6, 0x74, 0x0e, 0xa1, 0xac, 0x03, 0x91, 0x82, 0xbb, 0x57, 0xa0, 0x98,
+	0xbe, 0x02, 0x4e, 0x0f, 0x4a, 0xea, 0x3e, 0xc1, 0x42, 0x89, 0xf4, 0x85, 0x54, 0x19, 0x6a, 0xae,
+	0x36, 0x48, 0x13, 0x8a, 0x94, 0x4f, 0xcc, 0x1b, 0x81, 0x9f, 0xce, 0x13, 0x68, 0x9d, 0xfb, 0xb1,
+	0x3f, 0x66, 0x21, 0x93, 0x8c, 0xa6, 0xfd, 0x72, 0x7e, 0x83, 0xfd, 0x55, 0x18, 0x0b, 0xe6, 0xee,
+	0xbf, 0xc2, 0xea, 0xfd, 0xe7, 0x40, 0x35, 0xc8, 0x85, 0xdb, 0xdb, 0x6a, 0x4b, 0x2b, 0x58, 0xff,
+	0xbf, 0x22, 0xd4, 0x86, 0xaa, 0x43, 0x67, 0xba, 0x43, 0xe4, 0x0c, 0x2c, 0xe4, 0x96, 0x3c, 0x5b,
+	0xeb, 0x5c, 0xee, 0x85, 0x6e, 0xb7, 0x1f, 0xf0, 0xa2, 0xda, 0xb6, 0xc8, 0x5b, 0xd8, 0xd1, 0x53,
+	0x46, 0x3e, 0x79, 0x70, 0xfc, 0x74, 0x9e, 0x67, 0x1f, 0x1a, 0x4f, 0x67, 0xeb, 0x45, 0x81, 0x5c,
+	0x43, 0x35, 0x2f, 0x68, 0xf2, 0xf9, 0xda, 0x8a, 0x0d, 0x13, 0xd3, 0x76, 0x1e, 0x89, 0xd2, 0xfb,
+	0xbc, 0x86, 0x6a, 0x5e, 0x8e, 0x1b, 0x72, 0x6f, 0x18, 0x9b, 0xb6, 0xf3, 0x48, 0x94, 0xce, 0x7d,
+	0x06, 0x16, 0xaa, 0x62, 0x03, 0x8f, 0x39, 0x55, 0xb5, 0xdb, 0x0f, 0x78, 0xb3, 0xfd, 0xe5, 0x1b,
+	0xbe, 0x61, 0x7f, 0x1b, 0x64, 0xd2, 0x76, 0x1e, 0x89, 0x52, 0xb9, 0xcf, 0xbe, 0xbb, 0xfe, 0x66,
+	0xca, 0xe4, 0x6c, 0x31, 0x3e, 0x0e, 0xa2, 0x79, 0xef, 0x25, 0x1d, 0x33, 0x9f, 0xf7, 0x26, 0x41,
+	0xd2, 0x63, 0x5c, 0x52, 0xc1, 0xfd, 0xb0, 0xa7, 0xfe, 0xab, 0xf5, 0xee, 0xe5, 0x1a, 0xef, 0x28,
+	0xf8, 0xeb, 0xff, 0x07, 0x00, 0xe7, 0x7c, 0x59, 0x85, 0xd9, 0x09, 0x00, 0x00,
 }
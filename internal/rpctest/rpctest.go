@@ -14,6 +14,12 @@ import (
 // Loopback calls register to register services on a loopback gRPC server and
 // returns a connection to it. No sockets are involved.
 func Loopback(register func(s *grpc.Server)) (*grpc.ClientConn, func()) {
+	return LoopbackConn(register, func(c net.Conn) net.Conn { return c })
+}
+
+// LoopbackConn is like Loopback, but passes the client side of each
+// connection through wrap, e.g. to inject faults (see faultinject).
+func LoopbackConn(register func(s *grpc.Server), wrap func(net.Conn) net.Conn) (*grpc.ClientConn, func()) {
 	ln := bufconn.Listen(4096 /* initial pipe buffer capacity */)
 	s := grpc.NewServer()
 	register(s)
@@ -25,7 +31,11 @@ func Loopback(register func(s *grpc.Server)) (*grpc.ClientConn, func()) {
 	conn, err := grpc.Dial(ln.Addr().String(),
 		grpc.WithInsecure(),
 		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
-			return ln.Dial()
+			c, err := ln.Dial()
+			if err != nil {
+				return nil, err
+			}
+			return wrap(c), nil
 		}))
 	if err != nil {
 		panic(fmt.Sprintf("BUG: loopback gRPC: %v", err))
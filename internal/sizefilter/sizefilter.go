@@ -0,0 +1,78 @@
+// Package sizefilter implements the size: keyword (e.g. “size:<10k”), which
+// restricts the files searched by their size as recorded in the index (see
+// index.DocMeta). It has no dependencies, so that both the source backend and
+// dcs-web’s query parser can use it.
+package sizefilter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UnknownSize is the size of files whose size is not recorded in the index,
+// e.g. because the index was created without file metadata. Files of unknown
+// size are never filtered.
+const UnknownSize = ^uint64(0)
+
+// A Filter restricts the files searched by their size, e.g. “<10k” or
+// “>=1M”.
+type Filter struct {
+	Op    string // <, <=, > or >=
+	Bytes uint64
+}
+
+// Parse parses the value of a size: keyword: a comparison operator followed
+// by a number of bytes with an optional (binary) k, M or G suffix.
+func Parse(value string) (Filter, error) {
+	var f Filter
+	for _, op := range []string{"<=", ">=", "<", ">"} {
+		if strings.HasPrefix(value, op) {
+			f.Op = op
+			break
+		}
+	}
+	if f.Op == "" {
+		return f, fmt.Errorf("invalid size %q (expected e.g. <10k or >=1M)", value)
+	}
+	num := value[len(f.Op):]
+	multiplier := uint64(1)
+	if num != "" {
+		switch num[len(num)-1] {
+		case 'k', 'K':
+			multiplier = 1 << 10
+		case 'm', 'M':
+			multiplier = 1 << 20
+		case 'g', 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseUint(num, 10, 32)
+	if err != nil {
+		return f, fmt.Errorf("invalid size %q (expected e.g. <10k or >=1M)", value)
+	}
+	f.Bytes = n * multiplier
+	return f, nil
+}
+
+// Matches returns whether a file of the specified size satisfies the filter.
+// Files of UnknownSize always do.
+func (f Filter) Matches(size uint64) bool {
+	if size == UnknownSize {
+		return true
+	}
+	switch f.Op {
+	case "<":
+		return size < f.Bytes
+	case "<=":
+		return size <= f.Bytes
+	case ">":
+		return size > f.Bytes
+	case ">=":
+		return size >= f.Bytes
+	}
+	return true
+}
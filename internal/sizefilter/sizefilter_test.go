@@ -0,0 +1,47 @@
+package sizefilter
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  Filter
+	}{
+		{"<10k", Filter{Op: "<", Bytes: 10 * 1024}},
+		{">=1M", Filter{Op: ">=", Bytes: 1 << 20}},
+		{"<=512", Filter{Op: "<=", Bytes: 512}},
+		{">2g", Filter{Op: ">", Bytes: 2 << 30}},
+	} {
+		got, err := Parse(tt.value)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "10k", "<", "<k", "<10x", "<-1", "=10"} {
+		if _, err := Parse(value); err == nil {
+			t.Errorf("Parse(%q) unexpectedly succeeded", value)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	f := Filter{Op: "<", Bytes: 1024}
+	for _, tt := range []struct {
+		size uint64
+		want bool
+	}{
+		{0, true}, // empty files have a known size
+		{1023, true},
+		{1024, false},
+		{UnknownSize, true},
+	} {
+		if got := f.Matches(tt.size); got != tt.want {
+			t.Errorf("Matches(%d) = %v, want %v", tt.size, got, tt.want)
+		}
+	}
+}
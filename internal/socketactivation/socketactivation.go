@@ -0,0 +1,119 @@
+// Package socketactivation implements the listening side of systemd socket
+// activation (see sd_listen_fds(3)): listening sockets are inherited from the
+// service manager instead of being created by the process. As systemd keeps the
+// sockets open while the process is restarted (e.g. for an index rollover), no
+// connections are refused in the meantime: they are queued until the new
+// process accepts them.
+package socketactivation
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+type inheritedListener struct {
+	name string // from LISTEN_FDNAMES, e.g. set via FileDescriptorName=
+	ln   net.Listener
+}
+
+var (
+	inheritOnce sync.Once
+	inheritMu   sync.Mutex
+	inherited   []inheritedListener
+)
+
+// inherit returns the listeners passed via the LISTEN_PID, LISTEN_FDS and
+// LISTEN_FDNAMES environment variables (as read by getenv), starting at file
+// descriptor first.
+func inherit(getenv func(string) string, first int) ([]inheritedListener, error) {
+	if pid, err := strconv.Atoi(getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil // not meant for this process
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	var names []string
+	if v := getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+	result := make([]inheritedListener, 0, n)
+	for fd := first; fd < first+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		ln, err := net.FileListener(f)
+		f.Close() // net.FileListener dups the file descriptor
+		if err != nil {
+			return nil, fmt.Errorf("file descriptor %d: %v", fd, err)
+		}
+		var name string
+		if idx := fd - first; idx < len(names) {
+			name = names[idx]
+		}
+		result = append(result, inheritedListener{name: name, ln: ln})
+	}
+	return result, nil
+}
+
+// sameAddr returns whether the listener address a is the address addr (e.g.
+// “:28082” or “172.17.0.1:28082”) which the process was configured to listen
+// on.
+func sameAddr(a net.Addr, addr string) bool {
+	if a.String() == addr {
+		return true
+	}
+	got, ok := a.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil || got.Port != want.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return got.IP == nil || got.IP.IsUnspecified()
+	}
+	return got.IP.Equal(want.IP)
+}
+
+// Listen returns the inherited listener named addr (see FileDescriptorName= in
+// systemd.socket(5)) or listening on addr, if any. Otherwise, it listens on
+// addr itself. Each inherited listener is returned at most once.
+func Listen(addr string) (net.Listener, error) {
+	inheritOnce.Do(func() {
+		var err error
+		inherited, err = inherit(os.Getenv, listenFdsStart)
+		if err != nil {
+			log.Fatalf("socket activation: %v", err)
+		}
+		// Do not pass the sockets on to child processes.
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+	for _, match := range []func(il inheritedListener) bool{
+		func(il inheritedListener) bool { return il.name != "" && il.name == addr },
+		func(il inheritedListener) bool { return sameAddr(il.ln.Addr(), addr) },
+	} {
+		for idx, il := range inherited {
+			if !match(il) {
+				continue
+			}
+			inherited = append(inherited[:idx], inherited[idx+1:]...)
+			log.Printf("Using inherited listener %v for %s", il.ln.Addr(), addr)
+			return il.ln, nil
+		}
+	}
+	return net.Listen("tcp", addr)
+}
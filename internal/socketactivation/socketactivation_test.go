@@ -0,0 +1,62 @@
+package socketactivation
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestInherit(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"LISTEN_PID":     strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS":     "1",
+		"LISTEN_FDNAMES": "web",
+	}
+	inherited, err := inherit(func(key string) string { return env[key] }, int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(inherited), 1; got != want {
+		t.Fatalf("inherited %d listeners, want %d", got, want)
+	}
+	defer inherited[0].ln.Close()
+	if got, want := inherited[0].name, "web"; got != want {
+		t.Errorf("name = %q, want %q", got, want)
+	}
+	if got, want := inherited[0].ln.Addr().String(), ln.Addr().String(); got != want {
+		t.Errorf("address = %q, want %q", got, want)
+	}
+
+	env["LISTEN_PID"] = "1"
+	if inherited, err := inherit(func(key string) string { return env[key] }, 3); err != nil || len(inherited) > 0 {
+		t.Errorf("inherit(LISTEN_PID of another process) = %v, %v, want none", inherited, err)
+	}
+}
+
+func TestSameAddr(t *testing.T) {
+	for _, tt := range []struct {
+		addr net.Addr
+		flag string
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("172.17.0.1"), Port: 28082}, "172.17.0.1:28082", true},
+		{&net.TCPAddr{IP: net.ParseIP("172.17.0.1"), Port: 28082}, "172.17.0.1:28083", false},
+		{&net.TCPAddr{IP: net.IPv6unspecified, Port: 28082}, ":28082", true},
+		{&net.TCPAddr{IP: net.IPv4zero, Port: 28082}, "0.0.0.0:28082", true},
+		{&net.TCPAddr{IP: net.ParseIP("172.17.0.1"), Port: 28082}, ":28082", false},
+	} {
+		if got := sameAddr(tt.addr, tt.flag); got != tt.want {
+			t.Errorf("sameAddr(%v, %q) = %v, want %v", tt.addr, tt.flag, got, tt.want)
+		}
+	}
+}
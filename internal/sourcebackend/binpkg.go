@@ -0,0 +1,84 @@
+package sourcebackend
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Debian/dcs/ranking"
+	"github.com/Debian/dcs/regexp"
+)
+
+// BinaryPackages maps source package names (e.g. “i3-wm”) to the binary
+// packages built from them (e.g. “i3-wm”, “i3-wm-dbg”), as written by
+// dcs-compute-ranking.
+type BinaryPackages map[string][]string
+
+// ReadBinaryPackages reads the binary package mapping from path. A missing
+// file results in an empty mapping.
+func ReadBinaryPackages(path string) (BinaryPackages, error) {
+	b := make(BinaryPackages)
+	if err := readJSON(path, &b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// readJSON decodes the JSON file at path into v. A missing file is not an
+// error and leaves v untouched.
+func readJSON(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+// For returns the binary packages built from the source package of the file
+// at path, e.g. “i3-wm_4.16-1/src/main.c”.
+func (b BinaryPackages) For(path string) []string {
+	idx := strings.Index(path, "_")
+	if idx == -1 {
+		return nil
+	}
+	return b[path[:idx]]
+}
+
+// FilterByBinaryPackage filters files according to the "binpkg:" and
+// "-binpkg:" keywords, which are regular expressions matched against the
+// binary packages built from the source package of each file.
+func FilterByBinaryPackage(rewritten *url.URL, binaries BinaryPackages, files []ranking.ResultPath) []ranking.ResultPath {
+	for _, key := range []string{"binpkg", "nbinpkg"} {
+		for _, binpkg := range rewritten.Query()[key] {
+			binpkgRegexp, err := regexp.Compile(binpkg)
+			if err != nil {
+				return files
+			}
+
+			filtered := make(ranking.ResultPaths, 0, len(files))
+			for _, file := range files {
+				matches := false
+				for _, name := range binaries[file.Path[file.SourcePkgIdx[0]:file.SourcePkgIdx[1]]] {
+					if binpkgRegexp.MatchString(name, true, true) != -1 {
+						matches = true
+						break
+					}
+				}
+				if matches != (key == "binpkg") {
+					continue
+				}
+
+				filtered = append(filtered, file)
+			}
+
+			files = filtered
+		}
+	}
+
+	return files
+}
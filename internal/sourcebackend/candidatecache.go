@@ -0,0 +1,143 @@
+package sourcebackend
+
+import (
+	"container/list"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/Debian/dcs/ranking"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	candidateCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "candidate_cache_lookups",
+			Help: "Lookups of candidate files in the candidate cache, by outcome (hit or miss).",
+		},
+		[]string{"outcome"})
+
+	candidateCacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "candidate_cache_bytes",
+			Help: "Approximate size of the candidate files held in the candidate cache.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(candidateCacheLookups)
+	prometheus.MustRegister(candidateCacheBytes)
+}
+
+// CandidateCache caches the candidate files of recent index queries (see
+// Server.query), keyed by the normalized trigram query (index.Query.String).
+// Queries which only differ in what is applied after the index lookup (e.g.
+// filters like package: or the regexp itself, as long as it has the same
+// trigrams) skip the posting list work.
+//
+// Entries are only valid for the index they were computed with: Purge is
+// called whenever the index is replaced (see Server.ReplaceIndex). Entries
+// older than the TTL are treated as missing.
+type CandidateCache struct {
+	maxBytes int
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	bytes   int
+	lru     *list.List // of *candidateEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type candidateEntry struct {
+	key   string
+	files []ranking.ResultPath
+	added time.Time
+	size  int
+}
+
+// NewCandidateCache returns a cache holding up to approximately maxBytes of
+// candidate files, each for up to ttl (0 means no limit).
+func NewCandidateCache(maxBytes int, ttl time.Duration) *CandidateCache {
+	return &CandidateCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// candidatesSize approximates the memory used by files.
+func candidatesSize(files []ranking.ResultPath) int {
+	size := 0
+	for _, f := range files {
+		size += len(f.Path) + int(unsafe.Sizeof(f))
+	}
+	return size
+}
+
+// Get returns the cached candidate files of key. The returned slice must not
+// be modified.
+func (c *CandidateCache) Get(key string) ([]ranking.ResultPath, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if ok {
+		e := elem.Value.(*candidateEntry)
+		if c.ttl > 0 && time.Since(e.added) > c.ttl {
+			c.removeLocked(elem)
+			ok = false
+		}
+	}
+	if !ok {
+		candidateCacheLookups.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	candidateCacheLookups.WithLabelValues("hit").Inc()
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*candidateEntry).files, true
+}
+
+// Add stores the candidate files of key, evicting the least recently used
+// entries if necessary. Candidate lists which would take up more than a
+// quarter of the cache are not stored, so that a single broad query cannot
+// flush the cache. files must not be modified afterwards.
+func (c *CandidateCache) Add(key string, files []ranking.ResultPath) {
+	size := candidatesSize(files) + len(key)
+	if size > c.maxBytes/4 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.removeLocked(elem)
+	}
+	for c.bytes+size > c.maxBytes {
+		c.removeLocked(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&candidateEntry{
+		key:   key,
+		files: files,
+		added: time.Now(),
+		size:  size,
+	})
+	c.bytes += size
+	candidateCacheBytes.Set(float64(c.bytes))
+}
+
+// Purge removes all entries, e.g. because the index was replaced.
+func (c *CandidateCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.bytes = 0
+	candidateCacheBytes.Set(0)
+}
+
+func (c *CandidateCache) removeLocked(elem *list.Element) {
+	e := c.lru.Remove(elem).(*candidateEntry)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+	candidateCacheBytes.Set(float64(c.bytes))
+}
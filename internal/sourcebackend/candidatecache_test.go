@@ -0,0 +1,56 @@
+package sourcebackend
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Debian/dcs/ranking"
+)
+
+func TestCandidateCache(t *testing.T) {
+	files := []ranking.ResultPath{{Path: "i3-wm_4.8-1/i3bar/src/main.c"}}
+	size := candidatesSize(files) + len("key0")
+	c := NewCandidateCache(4*size, 0)
+
+	if _, ok := c.Get("key0"); ok {
+		t.Fatalf("Get on empty cache unexpectedly succeeded")
+	}
+	for i := 0; i < 4; i++ {
+		c.Add(fmt.Sprintf("key%d", i), files)
+	}
+	// key0 is now the most recently used entry, so key1 gets evicted.
+	if _, ok := c.Get("key0"); !ok {
+		t.Fatalf("key0 unexpectedly not cached")
+	}
+	c.Add("key4", files)
+	if _, ok := c.Get("key1"); ok {
+		t.Errorf("least recently used key1 unexpectedly still cached")
+	}
+	for _, key := range []string{"key0", "key2", "key3", "key4"} {
+		if got, ok := c.Get(key); !ok || len(got) != 1 || got[0].Path != files[0].Path {
+			t.Errorf("Get(%q) = %v, %v, want %v, true", key, got, ok, files)
+		}
+	}
+	if c.bytes > c.maxBytes {
+		t.Errorf("cache holds %d bytes, exceeding its limit of %d bytes", c.bytes, c.maxBytes)
+	}
+
+	// Candidate lists exceeding a quarter of the cache are not stored.
+	c.Add("broad", append(files, files[0]))
+	if _, ok := c.Get("broad"); ok {
+		t.Errorf("oversized entry unexpectedly cached")
+	}
+
+	c.Purge()
+	if _, ok := c.Get("key0"); ok {
+		t.Errorf("key0 unexpectedly cached after Purge")
+	}
+
+	c = NewCandidateCache(4*size, time.Nanosecond)
+	c.Add("key0", files)
+	time.Sleep(time.Millisecond)
+	if _, ok := c.Get("key0"); ok {
+		t.Errorf("expired key0 unexpectedly cached")
+	}
+}
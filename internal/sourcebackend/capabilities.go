@@ -0,0 +1,69 @@
+package sourcebackend
+
+import (
+	"context"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+// Version is the version of the source backend, reported to dcs-web (see
+// Server.Capabilities). Set at build time using -ldflags -X.
+var Version = "unknown"
+
+// Capabilities are features of the source backend protocol which a source
+// backend may or may not understand. dcs-web negotiates them when connecting
+// (see Server.Capabilities) and degrades gracefully for source backends which
+// lack a capability, so that dcs-web and the source backends can be upgraded
+// independently.
+const (
+	// CapabilityCount is set if Search understands count=1, i.e. replies
+	// with the number of matches per package instead of the matches.
+	CapabilityCount = "count"
+
+	// CapabilityMaxPerFile is set if Search understands max_per_file=.
+	CapabilityMaxPerFile = "max_per_file"
+
+	// CapabilityMaxLineLength is set if Search understands
+	// max_line_length=.
+	CapabilityMaxLineLength = "max_line_length"
+
+	// CapabilityTrigramStats is set if the TrigramStats RPC is implemented.
+	CapabilityTrigramStats = "trigram_stats"
+
+	// CapabilityXref is set if the Xref RPC is implemented.
+	CapabilityXref = "xref"
+
+	// CapabilityFileMeta is set if Search understands size= and sets the
+	// Size and Mtime fields of matches (for indexes with file metadata).
+	CapabilityFileMeta = "file_meta"
+)
+
+// AllCapabilities are the capabilities of this source backend. New
+// capabilities must be added here.
+var AllCapabilities = []string{
+	CapabilityCount,
+	CapabilityMaxPerFile,
+	CapabilityMaxLineLength,
+	CapabilityTrigramStats,
+	CapabilityXref,
+	CapabilityFileMeta,
+}
+
+// LegacyCapabilities are the capabilities of source backends which predate
+// capability negotiation, i.e. which do not implement the Capabilities RPC.
+// New capabilities must not be added here.
+var LegacyCapabilities = []string{
+	CapabilityCount,
+	CapabilityMaxPerFile,
+	CapabilityMaxLineLength,
+	CapabilityTrigramStats,
+	CapabilityXref,
+}
+
+// Capabilities returns the version and capabilities of the source backend.
+func (s *Server) Capabilities(ctx context.Context, in *sourcebackendpb.CapabilitiesRequest) (*sourcebackendpb.CapabilitiesReply, error) {
+	return &sourcebackendpb.CapabilitiesReply{
+		Version:      Version,
+		Capabilities: AllCapabilities,
+	}, nil
+}
@@ -0,0 +1,26 @@
+package sourcebackend
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Debian/dcs/ranking"
+)
+
+// ReadFileRanks reads the precomputed static ranking components of an index
+// shard with the specified number of documents, as written by
+// dcs-package-importer (see ranking.WriteFileRanks). A missing file results in
+// nil FileRanks, i.e. the components are computed for each query.
+func ReadFileRanks(path string, docs int) (ranking.FileRanks, error) {
+	ranks, err := ranking.ReadFileRanks(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(ranks) != docs {
+		return nil, fmt.Errorf("%s: contains %d entries, but the index contains %d documents", path, len(ranks), docs)
+	}
+	return ranks, nil
+}
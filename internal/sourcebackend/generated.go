@@ -0,0 +1,73 @@
+package sourcebackend
+
+import (
+	"bytes"
+	"math"
+)
+
+const (
+	// sniffLen is the number of bytes at the beginning of a file which
+	// isGenerated looks at.
+	sniffLen = 8192
+
+	// Human-written source code rarely exceeds these line lengths, whereas
+	// minified JavaScript/CSS typically consists of a handful of very long
+	// lines.
+	maxLineLen     = 4096
+	maxAvgLineLen  = 300
+	minEntropySize = 4096
+
+	// Source code has an entropy of about 4.5 to 5.5 bits per byte. Embedded
+	// data (e.g. base64-encoded images or compressed data) is higher.
+	maxEntropy = 5.9
+)
+
+// isGenerated reports whether b, the beginning of a file, looks like a binary
+// blob (contains NUL bytes), a minified file (very long lines) or embedded
+// data (high entropy). Such files are skipped unless the query contains
+// include:generated, as their matches are rarely useful but expensive to find.
+func isGenerated(b []byte) bool {
+	if len(b) > sniffLen {
+		b = b[:sniffLen]
+	}
+	if bytes.IndexByte(b, 0) != -1 {
+		return true
+	}
+
+	lines := 0
+	for rest := b; len(rest) > 0; lines++ {
+		idx := bytes.IndexByte(rest, '\n')
+		if idx == -1 {
+			idx = len(rest)
+		}
+		if idx > maxLineLen {
+			return true
+		}
+		if idx < len(rest) {
+			idx++
+		}
+		rest = rest[idx:]
+	}
+	if lines > 0 && len(b)/lines > maxAvgLineLen {
+		return true
+	}
+
+	return len(b) >= minEntropySize && entropy(b) > maxEntropy
+}
+
+// entropy returns the Shannon entropy of b in bits per byte.
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var e float64
+	for _, cnt := range counts {
+		if cnt == 0 {
+			continue
+		}
+		p := float64(cnt) / float64(len(b))
+		e -= p * math.Log2(p)
+	}
+	return e
+}
@@ -0,0 +1,37 @@
+package sourcebackend
+
+import (
+	"encoding/base64"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestIsGenerated(t *testing.T) {
+	data := make([]byte, 8000)
+	rand.New(rand.NewSource(1)).Read(data)
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var wrapped []string
+	for len(encoded) > 76 {
+		wrapped = append(wrapped, encoded[:76])
+		encoded = encoded[76:]
+	}
+
+	for _, tt := range []struct {
+		desc    string
+		content string
+		want    bool
+	}{
+		{"source", strings.Repeat("int main(int argc, char **argv) {\n\treturn 0;\n}\n", 300), false},
+		{"empty", "", false},
+		{"binary", "ELF\x00\x01\x02", true},
+		{"minified", "/*! v1.0 */\n" + strings.Repeat("var a=function(b){return b};", 400), true},
+		{"base64", strings.Join(wrapped, "\n"), true},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got := isGenerated([]byte(tt.content)); got != tt.want {
+				t.Fatalf("isGenerated(%s) = %v, want %v", tt.desc, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package sourcebackend
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// WarmUp reads the index into the page cache (see index.Index.WarmUp) and then
+// marks the server as ready (see Ready).
+func (s *Server) WarmUp() {
+	start := time.Now()
+	s.mu.Lock()
+	n := s.Index.WarmUp()
+	s.mu.Unlock()
+	log.Printf("Warmed up index (%d bytes) in %v\n", n, time.Since(start))
+	atomic.StoreUint32(&s.ready, 1)
+}
+
+// Ready returns whether the server can answer queries without waiting for the
+// index to be read from disk, i.e. whether WarmUp has completed.
+func (s *Server) Ready() bool {
+	return atomic.LoadUint32(&s.ready) == 1
+}
+
+// HealthzHandler serves /healthz, which succeeds as long as the process is
+// running.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// ReadyzHandler serves /readyz, which succeeds once the server is ready, see
+// Ready.
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.Ready() {
+		http.Error(w, "The index is being warmed up.", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,33 @@
+package sourcebackend
+
+import (
+	"net/url"
+
+	"github.com/Debian/dcs/internal/sizefilter"
+	"github.com/Debian/dcs/ranking"
+)
+
+// FilterBySize filters files according to the "size:" keywords (see
+// sizefilter.Filter). Files of unknown size (sizefilter.UnknownSize), e.g.
+// because the index contains no file metadata, are not filtered.
+func FilterBySize(rewritten *url.URL, files []ranking.ResultPath) []ranking.ResultPath {
+	for _, value := range rewritten.Query()["size"] {
+		sf, err := sizefilter.Parse(value)
+		if err != nil {
+			return files
+		}
+
+		filtered := make(ranking.ResultPaths, 0, len(files))
+		for _, file := range files {
+			if !sf.Matches(file.Size) {
+				continue
+			}
+
+			filtered = append(filtered, file)
+		}
+
+		files = filtered
+	}
+
+	return files
+}
@@ -0,0 +1,30 @@
+package sourcebackend
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/Debian/dcs/internal/sizefilter"
+	"github.com/Debian/dcs/ranking"
+)
+
+func TestFilterBySize(t *testing.T) {
+	files := []ranking.ResultPath{
+		{Path: "small", Size: 100},
+		{Path: "large", Size: 100 * 1024},
+		{Path: "empty", Size: 0},
+		{Path: "unknown", Size: sizefilter.UnknownSize},
+	}
+	rewritten, err := url.Parse("/search?q=foo&size=%3E1k&size=%3C1M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, file := range FilterBySize(rewritten, files) {
+		got = append(got, file.Path)
+	}
+	if want := []string{"large", "unknown"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterBySize() = %v, want %v", got, want)
+	}
+}
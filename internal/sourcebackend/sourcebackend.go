@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"html"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
@@ -14,12 +15,19 @@ import (
 	"path/filepath"
 	"regexp/syntax"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Debian/dcs/internal/copyright"
+	"github.com/Debian/dcs/internal/decompress"
+	"github.com/Debian/dcs/internal/ident"
 	"github.com/Debian/dcs/internal/index"
 	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+	"github.com/Debian/dcs/internal/sizefilter"
+	"github.com/Debian/dcs/internal/xref"
 	"github.com/Debian/dcs/ranking"
 	"github.com/Debian/dcs/regexp"
 	"github.com/google/renameio"
@@ -130,6 +138,89 @@ func FilterByKeywords(rewritten *url.URL, files []ranking.ResultPath) []ranking.
 	return files
 }
 
+// FilterByLicense filters files according to the "license:" and "-license:"
+// keywords, which are regular expressions matched against the license of each
+// file (see copyright.Licenses).
+func FilterByLicense(rewritten *url.URL, licenses copyright.Licenses, files []ranking.ResultPath) []ranking.ResultPath {
+	for _, key := range []string{"license", "nlicense"} {
+		for _, license := range rewritten.Query()[key] {
+			licenseRegexp, err := regexp.Compile(license)
+			if err != nil {
+				return files
+			}
+
+			filtered := make(ranking.ResultPaths, 0, len(files))
+			for _, file := range files {
+				matches := licenseRegexp.MatchString(licenses.License(file.Path), true, true) != -1
+				if matches != (key == "license") {
+					continue
+				}
+
+				filtered = append(filtered, file)
+			}
+
+			files = filtered
+		}
+	}
+
+	return files
+}
+
+// lineFilter implements the lookahead= and nlookahead= parameters, which
+// dcs-web uses for lookaheads in PCRE queries (see search.RewritePCRE): a line
+// is only a match if it matches all lookahead and none of the nlookahead
+// patterns.
+type lineFilter struct {
+	match  []*regexp.Regexp
+	nmatch []*regexp.Regexp
+}
+
+func newLineFilter(rewritten *url.URL) (*lineFilter, error) {
+	var lf lineFilter
+	opts := regexp.OptionsFromQuery(rewritten.Query())
+	for _, pattern := range rewritten.Query()["lookahead"] {
+		re, err := regexp.CompileOptions(pattern, opts)
+		if err != nil {
+			return nil, err
+		}
+		lf.match = append(lf.match, re)
+	}
+	for _, pattern := range rewritten.Query()["nlookahead"] {
+		re, err := regexp.CompileOptions(pattern, opts)
+		if err != nil {
+			return nil, err
+		}
+		lf.nmatch = append(lf.nmatch, re)
+	}
+	return &lf, nil
+}
+
+// indexQuery restricts q to files which contain the lookahead patterns.
+func (lf *lineFilter) indexQuery(q *index.Query) *index.Query {
+	if len(lf.match) == 0 {
+		return q
+	}
+	sub := []*index.Query{q}
+	for _, re := range lf.match {
+		sub = append(sub, index.RegexpQuery(re.Syntax))
+	}
+	return &index.Query{Op: index.QAnd, Sub: sub}
+}
+
+func (lf *lineFilter) Matches(line string) bool {
+	for _, re := range lf.match {
+		if re.MatchString(line, true, true) == -1 {
+			return false
+		}
+	}
+	for _, re := range lf.nmatch {
+		if re.MatchString(line, true, true) != -1 {
+			return false
+		}
+	}
+	return true
+}
+
 type SourceReply struct {
 	// The number of the last used filename, needed for pagination
 	LastUsedFilename int
@@ -143,6 +234,152 @@ type Server struct {
 	UnpackedPath       string
 	IndexPath          string
 	UsePositionalIndex bool
+
+	// MaxMatchesPerFile limits the number of matches sent per file (0 means
+	// unlimited), unless the query specifies max_per_file=.
+	MaxMatchesPerFile int
+
+	// MaxLineLength limits the length of context lines in bytes (0 means
+	// unlimited), unless the query specifies max_line_length=, see
+	// truncateMatch.
+	MaxLineLength int
+
+	// Licenses contains the license information of the index shard, see
+	// copyright.ReadLicenses. Protected by mu, like Index.
+	Licenses copyright.Licenses
+
+	// Versions contains the versions of the packages in the index shard, see
+	// ReadVersions. Protected by mu, like Index.
+	Versions Versions
+
+	// Includes contains the includes/imports of the files in the index
+	// shard, see xref.ReadIndex. Protected by mu, like Index.
+	Includes xref.Index
+
+	// Identifiers is the identifier index of the index shard (nil if the
+	// shard has none), see ident.ReadIndex. Protected by mu, like Index.
+	Identifiers *ident.Index
+
+	// FileRanks contains the precomputed static ranking components of the
+	// files in the index shard (see ReadFileRanks), or nil for shards
+	// which were created without them. Protected by mu, like Index.
+	FileRanks ranking.FileRanks
+
+	// BinaryPackages maps source packages to the binary packages built from
+	// them, see ReadBinaryPackages.
+	BinaryPackages BinaryPackages
+
+	// Snapshot is the archive snapshot date (e.g. 2015-06-01) of the index
+	// shard, or empty for the current archive. Queries are only answered if
+	// their snapshot= parameter matches, which catches misconfigured routing
+	// in dcs-web.
+	Snapshot string
+
+	// CandidateCache, if non-nil, caches the candidate files of index
+	// queries. It is purged when the index is replaced.
+	CandidateCache *CandidateCache
+
+	// ready is set to 1 by WarmUp, see Ready.
+	ready uint32
+}
+
+func (s *Server) checkSnapshot(rewritten *url.URL) error {
+	if snapshot := rewritten.Query().Get("snapshot"); snapshot != s.Snapshot {
+		return fmt.Errorf("query is for snapshot %q, but this shard serves snapshot %q", snapshot, s.Snapshot)
+	}
+	return nil
+}
+
+// maxMatchesPerFile returns the per-file match limit for the query: the
+// max_per_file= parameter if present (0 meaning unlimited), the server default
+// otherwise.
+func (s *Server) maxMatchesPerFile(rewritten *url.URL) int {
+	if v := rewritten.Query().Get("max_per_file"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return s.MaxMatchesPerFile
+}
+
+// encodingOptions returns the options of the encoding: keyword: raw is set if
+// files which are not UTF-8 should be searched without converting them (see
+// regexp.DetectEncoding), and include reports whether matches in files of the
+// specified encoding are sent.
+func encodingOptions(rewritten *url.URL) (raw bool, include func(encoding string) bool) {
+	wanted := make(map[string]bool)
+	for _, value := range rewritten.Query()["encoding"] {
+		switch value {
+		case "raw":
+			raw = true
+		case "utf8":
+			wanted[""] = true
+		default:
+			wanted[value] = true
+		}
+	}
+	return raw, func(encoding string) bool {
+		return len(wanted) == 0 || wanted[encoding]
+	}
+}
+
+// grepFile is like grep.File, but decompresses the file according to
+// compression (see decompress.Compression).
+func grepFile(grep *regexp.Grep, name, compression string) []regexp.Match {
+	if compression == "" {
+		return grep.File(name)
+	}
+	r, err := decompress.Open(name, compression)
+	if err != nil {
+		fmt.Fprintf(grep.Stderr, "%s\n", err)
+		return nil
+	}
+	defer r.Close()
+	return grep.Reader(r, name)
+}
+
+// latin1Lines converts the specified (ISO-8859-1 encoded) lines to UTF-8.
+func latin1Lines(lines []string) {
+	for idx, line := range lines {
+		lines[idx] = string(regexp.Latin1ToUTF8(nil, []byte(line)))
+	}
+}
+
+// capMatches truncates the matches of a single file to max (0 means
+// unlimited), recording the number of omitted matches in the last remaining
+// match so that clients can indicate that the file has more matches.
+func capMatches(matches []*sourcebackendpb.Match, max int) []*sourcebackendpb.Match {
+	if max == 0 || len(matches) <= max {
+		return matches
+	}
+	matches[max-1].FileMatchesOmitted = uint32(len(matches) - max)
+	return matches[:max]
+}
+
+// matchSize converts size into Match.Size, which is 0 for files of unknown
+// size: source backends predating file metadata do not set it, and files
+// shorter than 3 bytes are never indexed, so 0 is not a valid size.
+func matchSize(size uint64) uint64 {
+	if size == sizefilter.UnknownSize {
+		return 0
+	}
+	return size
+}
+
+// highlightRanges converts ranges (of the HTML-escaped line, see
+// regexp.EscapeRanges) into Match.HighlightRanges.
+func highlightRanges(ranges []regexp.Range) []*sourcebackendpb.Range {
+	if len(ranges) == 0 {
+		return nil
+	}
+	result := make([]*sourcebackendpb.Range, len(ranges))
+	for idx, r := range ranges {
+		result[idx] = &sourcebackendpb.Range{
+			Start: uint32(r.Start),
+			End:   uint32(r.End),
+		}
+	}
+	return result
 }
 
 // Serves a single file for displaying it in /show
@@ -155,9 +392,21 @@ func (s *Server) File(ctx context.Context, in *sourcebackendpb.FileRequest) (*so
 		return nil, fmt.Errorf("Path traversal is bad, mhkay?")
 	}
 
-	contents, err := ioutil.ReadFile(absPath)
-	if err != nil {
-		return nil, err
+	var contents []byte
+	if in.Compression != "" {
+		r, err := decompress.Open(absPath, in.Compression)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		if contents, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if contents, err = ioutil.ReadFile(absPath); err != nil {
+			return nil, err
+		}
 	}
 	return &sourcebackendpb.FileReply{
 		Contents: contents,
@@ -176,9 +425,29 @@ func sendProgressUpdate(stream sourcebackendpb.SourceBackend_SearchServer, connM
 	})
 }
 
+func sendCounts(stream sourcebackendpb.SourceBackend_SearchServer, connMu *sync.Mutex, counts map[string]uint64, countsMu *sync.Mutex) error {
+	countsMu.Lock()
+	packageCounts := make([]*sourcebackendpb.SearchReply_PackageCount, 0, len(counts))
+	for pkg, count := range counts {
+		packageCounts = append(packageCounts, &sourcebackendpb.SearchReply_PackageCount{
+			Package: pkg,
+			Count:   count,
+		})
+	}
+	countsMu.Unlock()
+	connMu.Lock()
+	defer connMu.Unlock()
+	return stream.Send(&sourcebackendpb.SearchReply{
+		Type:          sourcebackendpb.SearchReply_COUNTS,
+		PackageCounts: packageCounts,
+	})
+}
+
 type entry struct {
-	fn  string
-	pos uint32
+	fn     string
+	pos    uint32
+	static *ranking.FileRank
+	meta   index.DocMeta
 }
 
 func countNL(b []byte) int {
@@ -218,8 +487,46 @@ func (s *Server) ReplaceIndex(ctx context.Context, in *sourcebackendpb.ReplaceIn
 			if err != nil {
 				return nil, err
 			}
+			licenses, err := copyright.ReadLicenses(filepath.Join(newShard, "licenses.json"))
+			if err != nil {
+				newIndex.Close()
+				return nil, err
+			}
+			versions, err := ReadVersions(filepath.Join(newShard, "versions.json"))
+			if err != nil {
+				newIndex.Close()
+				return nil, err
+			}
+			x, err := xref.ReadIndex(filepath.Join(newShard, "xref.json"))
+			if err != nil {
+				newIndex.Close()
+				return nil, err
+			}
+			identifiers, err := ident.ReadIndex(filepath.Join(newShard, "ident.json"))
+			if err != nil {
+				newIndex.Close()
+				return nil, err
+			}
+			ranks, err := ReadFileRanks(filepath.Join(newShard, "ranks.bin"), newIndex.DocidMap.Count)
+			if err != nil {
+				newIndex.Close()
+				return nil, err
+			}
+			// Warm up the new index before swapping it in, so that
+			// queries do not slow down after the rollover.
+			start := time.Now()
+			n := newIndex.WarmUp()
+			log.Printf("Warmed up %q (%d bytes) in %v\n", newShard, n, time.Since(start))
 			s.mu.Lock()
 			s.Index = newIndex
+			s.Licenses = licenses
+			s.Versions = versions
+			s.Includes = x
+			s.Identifiers = identifiers
+			s.FileRanks = ranks
+			if s.CandidateCache != nil {
+				s.CandidateCache.Purge()
+			}
 			s.mu.Unlock()
 			defer oldIndex.Close()
 
@@ -263,30 +570,134 @@ func (s *Server) queryPositional(literal string) ([]entry, error) {
 		if err != nil {
 			return nil, fmt.Errorf("DocidMap.Lookup(%v): %v", match.Docid, err)
 		}
+		meta, err := s.Index.DocMeta.Lookup(match.Docid)
+		if err != nil {
+			return nil, fmt.Errorf("DocMeta.Lookup(%v): %v", match.Docid, err)
+		}
 		possible[idx] = entry{
-			fn:  fn,
-			pos: match.Position,
+			fn:     fn,
+			pos:    match.Position,
+			static: s.FileRanks.Lookup(match.Docid),
+			meta:   meta,
 		}
 	}
 
 	return possible, nil
 }
 
-func (s *Server) query(query *index.Query) ([]string, error) {
+// query returns the files which possibly match query, with their static
+// ranking components (if available). The returned slice must not be modified,
+// as it might be shared via s.CandidateCache.
+func (s *Server) query(query *index.Query) ([]ranking.ResultPath, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	var key string
+	if s.CandidateCache != nil {
+		key = query.String()
+		if possible, ok := s.CandidateCache.Get(key); ok {
+			return possible, nil
+		}
+	}
 	post := s.Index.PostingQuery(query)
-	possible := make([]string, len(post))
-	var err error
+	possible := make([]ranking.ResultPath, len(post))
 	for idx, docid := range post {
-		possible[idx], err = s.Index.DocidMap.Lookup(docid)
+		fn, err := s.Index.DocidMap.Lookup(docid)
 		if err != nil {
 			return nil, err
 		}
+		meta, err := s.Index.DocMeta.Lookup(docid)
+		if err != nil {
+			return nil, err
+		}
+		possible[idx] = ranking.ResultPath{
+			Path:   fn,
+			Static: s.FileRanks.Lookup(docid),
+			Size:   meta.Size,
+			Mtime:  meta.Mtime,
+		}
+	}
+	if s.CandidateCache != nil {
+		s.CandidateCache.Add(key, possible)
 	}
 	return possible, nil
 }
 
+// queryIdent returns the files which may contain the identifier of an ident:
+// query (see ident.Index.Lookup). ok is false if the query has no ident:
+// keyword or the identifier index cannot be used, in which case the trigram
+// index needs to be queried.
+func (s *Server) queryIdent(rewritten *url.URL, reopts regexp.Options) (possible []ranking.ResultPath, ok bool) {
+	identifier := rewritten.Query().Get("ident")
+	// Lookups are case-sensitive, as components are split on case changes.
+	if identifier == "" || reopts.FoldCase {
+		return nil, false
+	}
+	s.mu.Lock()
+	x := s.Identifiers
+	s.mu.Unlock()
+	if x == nil {
+		return nil, false
+	}
+	paths, ok := x.Lookup(identifier)
+	if !ok {
+		return nil, false
+	}
+	possible = make([]ranking.ResultPath, len(paths))
+	// The identifier index contains no file metadata, so size: keywords do
+	// not apply to these files.
+	for idx, path := range paths {
+		possible[idx] = ranking.ResultPath{
+			Path: path,
+			Size: sizefilter.UnknownSize,
+		}
+	}
+	return possible, true
+}
+
+// TrigramStats looks up the posting list sizes of the query’s trigrams, which
+// dcs-web uses to estimate the cost of a query before starting it.
+func (s *Server) TrigramStats(ctx context.Context, in *sourcebackendpb.TrigramStatsRequest) (*sourcebackendpb.TrigramStatsReply, error) {
+	rewritten, err := url.Parse(in.RewrittenUrl)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkSnapshot(rewritten); err != nil {
+		return nil, err
+	}
+	re, err := regexp.CompileOptions(in.Query, regexp.OptionsFromQuery(rewritten.Query()))
+	if err != nil {
+		return nil, fmt.Errorf("Could not compile regexp: %v", err)
+	}
+	counts := make(map[string]int)
+	s.mu.Lock()
+	estimate := s.Index.PostingQueryEstimate(index.RegexpQuery(re.Syntax), counts)
+	total := s.Index.DocidMap.Count
+	s.mu.Unlock()
+
+	reply := &sourcebackendpb.TrigramStatsReply{
+		Trigrams:       make([]*sourcebackendpb.TrigramStatsReply_Trigram, 0, len(counts)),
+		EstimatedFiles: uint64(estimate),
+		FilesTotal:     uint64(total),
+	}
+	for trigram, files := range counts {
+		reply.Trigrams = append(reply.Trigrams, &sourcebackendpb.TrigramStatsReply_Trigram{
+			Trigram: trigram,
+			Files:   uint64(files),
+		})
+	}
+	return reply, nil
+}
+
+// Xref looks up the files which include or import in.Include.
+func (s *Server) Xref(ctx context.Context, in *sourcebackendpb.XrefRequest) (*sourcebackendpb.XrefReply, error) {
+	s.mu.Lock()
+	x := s.Includes
+	s.mu.Unlock()
+	return &sourcebackendpb.XrefReply{
+		Path: x.Lookup(in.Include),
+	}, nil
+}
+
 // Reads a single JSON request from the TCP connection, performs the search and
 // sends results back over the TCP connection as they appear.
 func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendpb.SourceBackend_SearchServer) error {
@@ -298,23 +709,62 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 		span = (&opentracing.NoopTracer{}).StartSpan("Search")
 	}
 
-	re, err := regexp.Compile(in.Query)
-	if err != nil {
-		return fmt.Errorf("%s Could not compile regexp: %v\n", logprefix, err)
-	}
-
 	// Parse the (rewritten) URL to extract all ranking options/keywords.
 	rewritten, err := url.Parse(in.RewrittenUrl)
 	if err != nil {
 		return err
 	}
+	if err := s.checkSnapshot(rewritten); err != nil {
+		return fmt.Errorf("%s %v\n", logprefix, err)
+	}
+	reopts := regexp.OptionsFromQuery(rewritten.Query())
+	re, err := regexp.CompileOptions(in.Query, reopts)
+	if err != nil {
+		return fmt.Errorf("%s Could not compile regexp: %v\n", logprefix, err)
+	}
+	lf, err := newLineFilter(rewritten)
+	if err != nil {
+		return fmt.Errorf("%s Could not compile line filter: %v\n", logprefix, err)
+	}
 	rankingopts := ranking.RankingOptsFromQuery(rewritten.Query())
 	span.LogFields(olog.String("rankingopts", fmt.Sprintf("%+v", rankingopts)))
+	if deadline, ok := ctx.Deadline(); ok {
+		span.LogFields(olog.String("budget", time.Until(deadline).String()))
+	}
+
+	// In count mode, only the number of matches per package is sent (in a
+	// single COUNTS reply before the final progress update) instead of the
+	// matches themselves.
+	countOnly := rewritten.Query().Get("count") == "1"
+	counts := make(map[string]uint64)
+	var countsMu sync.Mutex
+
+	// Generated files (e.g. configure scripts) can contain thousands of
+	// matches, so the number of matches sent per file is limited. Counts are
+	// not affected.
+	maxPerFile := s.maxMatchesPerFile(rewritten)
+	maxLineLength := s.maxLineLength(rewritten)
+
+	// Binary and minified files are skipped (see isGenerated) unless the
+	// query contains include:generated.
+	includeGenerated := false
+	for _, include := range rewritten.Query()["include"] {
+		if include == "generated" {
+			includeGenerated = true
+		}
+	}
+	var skippedGenerated int64
+
+	// Files which are not UTF-8 are converted before searching, unless the
+	// query contains encoding:raw.
+	rawEncoding, includeEncoding := encodingOptions(rewritten)
 
 	// TODO: analyze the query to see if fast path can be taken
 	// maybe by using a different worker?
 	simplified := re.Syntax.Simplify()
-	queryPos := s.UsePositionalIndex && simplified.Op == syntax.OpLiteral
+	// The positional index only supports case-sensitive literals.
+	queryPos := s.UsePositionalIndex && simplified.Op == syntax.OpLiteral &&
+		simplified.Flags&syntax.FoldCase == 0
 	var files ranking.ResultPaths
 	if queryPos {
 		possible, err := s.queryPositional(string(simplified.Rune))
@@ -326,6 +776,9 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 			result := ranking.ResultPath{
 				Path:     entry.fn,
 				Position: int(entry.pos),
+				Static:   entry.static,
+				Size:     entry.meta.Size,
+				Mtime:    entry.meta.Mtime,
 			}
 			result.Rank(&rankingopts)
 			if result.Ranking > -1 {
@@ -333,9 +786,12 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 			}
 		}
 	} else {
-		possible, err := s.query(index.RegexpQuery(re.Syntax))
-		if err != nil {
-			return err
+		possible, ok := s.queryIdent(rewritten, reopts)
+		if !ok {
+			possible, err = s.query(lf.indexQuery(index.RegexpQuery(re.Syntax)))
+			if err != nil {
+				return err
+			}
 		}
 
 		span.LogFields(olog.Int("files.possible", len(possible)))
@@ -343,8 +799,7 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 		// Rank all the paths.
 		rankspan, _ := opentracing.StartSpanFromContext(ctx, "Rank")
 		files = make(ranking.ResultPaths, 0, len(possible))
-		for _, filename := range possible {
-			result := ranking.ResultPath{Path: filename}
+		for _, result := range possible {
 			result.Rank(&rankingopts)
 			if result.Ranking > -1 {
 				files = append(files, result)
@@ -353,9 +808,17 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 		rankspan.Finish()
 	}
 
+	s.mu.Lock()
+	licenses := s.Licenses
+	versions := s.Versions
+	s.mu.Unlock()
+
 	// Filter all files that should be excluded.
 	filterspan, _ := opentracing.StartSpanFromContext(ctx, "Filter")
 	files = FilterByKeywords(rewritten, files)
+	files = FilterByLicense(rewritten, licenses, files)
+	files = FilterByBinaryPackage(rewritten, s.BinaryPackages, files)
+	files = FilterBySize(rewritten, files)
 	filterspan.Finish()
 
 	span.LogFields(olog.Int("files.filtered", len(files)))
@@ -412,8 +875,12 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 			}
 		}
 
-		if err := sendProgressUpdate(stream, connMu, len(files), len(files)); err != nil {
-			log.Printf("%s %v\n", logprefix, err)
+		// In count mode, the final progress update is sent after the counts,
+		// once all workers are done.
+		if !countOnly {
+			if err := sendProgressUpdate(stream, connMu, len(files), len(files)); err != nil {
+				log.Printf("%s %v\n", logprefix, err)
+			}
 		}
 		close(progress)
 
@@ -459,13 +926,22 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 			rqb := []byte(string(simplified.Rune))
 
 			for bundle := range work {
+				// The client is no longer interested in results (e.g. because
+				// its deadline passed), so skip the remaining work.
+				if ctx.Err() != nil {
+					for range bundle {
+						progress <- 1
+					}
+					continue
+				}
 
 				// TODO: figure out how to safely clone a dcs/regexp
 				// Turns out open+read+close is significantly faster than
 				// mmap'ing a whole bunch of small files (most of our files are
 				// << 64 KB).
 				// https://eklausmeier.wordpress.com/2016/02/03/performance-comparison-mmap-versus-read-versus-fread/
-				f, err := os.Open(filepath.Join(s.UnpackedPath, bundle[0].Path))
+				compression := decompress.Compression(bundle[0].Path)
+				f, err := decompress.Open(filepath.Join(s.UnpackedPath, bundle[0].Path), compression)
 				if err != nil {
 					log.Printf("%s %v", logprefix, err)
 					for range bundle {
@@ -480,8 +956,13 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 				if max > cap(buf) {
 					buf = make([]byte, 0, max)
 				}
-				n, err := f.Read(buf[:max])
+				// Decompressing readers return fewer bytes per Read call.
+				n, err := io.ReadFull(f, buf[:max])
+				if err == io.ErrUnexpectedEOF {
+					err = nil
+				}
 				if err != nil {
+					f.Close()
 					log.Printf("%s %v", logprefix, err)
 					for range bundle {
 						progress <- 1
@@ -490,8 +971,23 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 				}
 				f.Close()
 				b := buf[:n]
+				if !includeGenerated && isGenerated(b) {
+					atomic.AddInt64(&skippedGenerated, 1)
+					for range bundle {
+						progress <- 1
+					}
+					continue
+				}
+				encoding := regexp.DetectEncoding(b)
+				if !includeEncoding(encoding) {
+					for range bundle {
+						progress <- 1
+					}
+					continue
+				}
 
 				lastPos := -1
+				var matches []*sourcebackendpb.Match
 				for _, fn := range bundle {
 					progress <- 1
 					sourcePkgName := fn.Path[fn.SourcePkgIdx[0]:fn.SourcePkgIdx[1]]
@@ -515,6 +1011,13 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 					//fmt.Printf("%s:%d\n", fn.Path, fn.Position)
 					lastPos = fn.Position
 
+					five := index.FiveLines(b, fn.Position)
+					if encoding == regexp.EncodingLatin1 && !rawEncoding {
+						latin1Lines(five[:])
+					}
+					if !lf.Matches(five[2]) {
+						continue
+					}
 					line := countNL(b[:fn.Position]) + 1
 					match := regexp.Match{
 						Path: fn.Path,
@@ -522,22 +1025,40 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 						//Context: string(line),
 					}
 					match.PathRank = ranking.PostRank(rankingopts, &match, &querystr)
-					five := index.FiveLines(b, fn.Position)
+					if countOnly {
+						countsMu.Lock()
+						counts[fn.Path[:strings.Index(fn.Path, "/")]]++
+						countsMu.Unlock()
+						continue
+					}
+					ranges := regexp.LiteralRanges(five[2], string(rqb))
+					matches = append(matches, &sourcebackendpb.Match{
+						Path:            fn.Path,
+						Line:            uint32(line),
+						Package:         fn.Path[:strings.Index(fn.Path, "/")],
+						Ctxp2:           html.EscapeString(five[0]),
+						Ctxp1:           html.EscapeString(five[1]),
+						Context:         html.EscapeString(five[2]),
+						Ctxn1:           html.EscapeString(five[3]),
+						Ctxn2:           html.EscapeString(five[4]),
+						Pathrank:        match.PathRank,
+						Ranking:         fn.Ranking,
+						License:         licenses.License(fn.Path),
+						BinaryPackages:  s.BinaryPackages.For(fn.Path),
+						Version:         versions.For(fn.Path),
+						HighlightRanges: highlightRanges(regexp.EscapeRanges(five[2], ranges)),
+						Encoding:        encoding,
+						Compression:     compression,
+						Size:            matchSize(fn.Size),
+						Mtime:           fn.Mtime,
+					})
+				}
+				for _, match := range capMatches(matches, maxPerFile) {
+					truncateMatch(match, maxLineLength)
 					connMu.Lock()
 					if err := stream.Send(&sourcebackendpb.SearchReply{
-						Type: sourcebackendpb.SearchReply_MATCH,
-						Match: &sourcebackendpb.Match{
-							Path:     fn.Path,
-							Line:     uint32(line),
-							Package:  fn.Path[:strings.Index(fn.Path, "/")],
-							Ctxp2:    html.EscapeString(five[0]),
-							Ctxp1:    html.EscapeString(five[1]),
-							Context:  html.EscapeString(five[2]),
-							Ctxn1:    html.EscapeString(five[3]),
-							Ctxn2:    html.EscapeString(five[4]),
-							Pathrank: match.PathRank,
-							Ranking:  fn.Ranking,
-						},
+						Type:  sourcebackendpb.SearchReply_MATCH,
+						Match: match,
 					}); err != nil {
 						connMu.Unlock()
 						log.Printf("%s %v\n", logprefix, err)
@@ -567,7 +1088,7 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 		wg.Add(len(files) + 1)
 
 		workerFn = func() {
-			re, err := regexp.Compile(in.Query)
+			re, err := regexp.CompileOptions(in.Query, reopts)
 			if err != nil {
 				log.Printf("%s\n", err)
 				return
@@ -577,9 +1098,27 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 				Regexp: re,
 				Stdout: os.Stdout,
 				Stderr: os.Stderr,
+				Raw:    rawEncoding,
+			}
+			if !includeGenerated {
+				grep.Skip = func(head []byte) bool {
+					if isGenerated(head) {
+						atomic.AddInt64(&skippedGenerated, 1)
+						return true
+					}
+					return false
+				}
 			}
 
 			for file := range work {
+				// The client is no longer interested in results (e.g. because
+				// its deadline passed), so skip the remaining work.
+				if ctx.Err() != nil {
+					progress <- 1
+					wg.Done()
+					continue
+				}
+
 				sourcePkgName := file.Path[file.SourcePkgIdx[0]:file.SourcePkgIdx[1]]
 				if rankingopts.Pathmatch {
 					file.Ranking += querystr.Match(&file.Path)
@@ -593,8 +1132,16 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 				}
 
 				// TODO: figure out how to safely clone a dcs/regexp
-				matches := grep.File(path.Join(s.UnpackedPath, file.Path))
-				for _, match := range matches {
+				var matches []*sourcebackendpb.Match
+				compression := decompress.Compression(file.Path)
+				for _, match := range grepFile(&grep, path.Join(s.UnpackedPath, file.Path), compression) {
+					if !includeEncoding(match.Encoding) {
+						// All matches of the file have the same encoding.
+						break
+					}
+					if !lf.Matches(html.UnescapeString(match.Context)) {
+						continue
+					}
 					match.Ranking = ranking.PostRank(rankingopts, &match, &querystr)
 					match.PathRank = file.Ranking
 					//match.Path = match.Path[len(*unpackedPath):]
@@ -605,21 +1152,39 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 					// TODO: ideally, we’d get sourcebackendpb.Match structs from grep.File(), let’s do that after profiling the decoding performance
 
 					path := match.Path[len(s.UnpackedPath):]
+					if countOnly {
+						countsMu.Lock()
+						counts[path[:strings.Index(path, "/")]]++
+						countsMu.Unlock()
+						continue
+					}
+					matches = append(matches, &sourcebackendpb.Match{
+						Path:            path,
+						Line:            uint32(match.Line),
+						Package:         path[:strings.Index(path, "/")],
+						Ctxp2:           match.Ctxp2,
+						Ctxp1:           match.Ctxp1,
+						Context:         match.Context,
+						Ctxn1:           match.Ctxn1,
+						Ctxn2:           match.Ctxn2,
+						Pathrank:        match.PathRank,
+						Ranking:         match.Ranking,
+						License:         licenses.License(path),
+						BinaryPackages:  s.BinaryPackages.For(path),
+						Version:         versions.For(path),
+						HighlightRanges: highlightRanges(match.HighlightRanges),
+						Encoding:        match.Encoding,
+						Compression:     compression,
+						Size:            matchSize(file.Size),
+						Mtime:           file.Mtime,
+					})
+				}
+				for _, match := range capMatches(matches, maxPerFile) {
+					truncateMatch(match, maxLineLength)
 					connMu.Lock()
 					if err := stream.Send(&sourcebackendpb.SearchReply{
-						Type: sourcebackendpb.SearchReply_MATCH,
-						Match: &sourcebackendpb.Match{
-							Path:     path,
-							Line:     uint32(match.Line),
-							Package:  path[:strings.Index(path, "/")],
-							Ctxp2:    match.Ctxp2,
-							Ctxp1:    match.Ctxp1,
-							Context:  match.Context,
-							Ctxn1:    match.Ctxn1,
-							Ctxn2:    match.Ctxn2,
-							Pathrank: match.PathRank,
-							Ranking:  match.Ranking,
-						},
+						Type:  sourcebackendpb.SearchReply_MATCH,
+						Match: match,
 					}); err != nil {
 						connMu.Unlock()
 						log.Printf("%s %v\n", logprefix, err)
@@ -645,6 +1210,24 @@ func (s *Server) Search(in *sourcebackendpb.SearchRequest, stream sourcebackendp
 
 	wg.Wait()
 
+	if skipped := atomic.LoadInt64(&skippedGenerated); skipped > 0 {
+		log.Printf("%s skipped %d generated files\n", logprefix, skipped)
+	}
+
+	if err := ctx.Err(); err != nil {
+		log.Printf("%s Search aborted: %v\n", logprefix, err)
+		return err
+	}
+
+	if countOnly {
+		if err := sendCounts(stream, connMu, counts, &countsMu); err != nil {
+			return fmt.Errorf("%s %v\n", logprefix, err)
+		}
+		if err := sendProgressUpdate(stream, connMu, len(files), len(files)); err != nil {
+			return fmt.Errorf("%s %v\n", logprefix, err)
+		}
+	}
+
 	log.Printf("%s Sent all results.\n", logprefix)
 	return nil
 }
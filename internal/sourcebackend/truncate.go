@@ -0,0 +1,132 @@
+package sourcebackend
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+// ellipsis marks where a context line was truncated.
+const ellipsis = "…"
+
+// maxLineLength returns the context line length limit for the query: the
+// max_line_length= parameter if present (0 meaning unlimited), the server
+// default otherwise.
+func (s *Server) maxLineLength(rewritten *url.URL) int {
+	if v := rewritten.Query().Get("max_line_length"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return s.MaxLineLength
+}
+
+// cutBackward returns the largest position <= pos at which the HTML-escaped
+// line can be cut, i.e. not within a UTF-8 sequence or an escape sequence.
+func cutBackward(line string, pos int) int {
+	if amp := strings.LastIndexByte(line[:pos], '&'); amp > -1 && !strings.Contains(line[amp:pos], ";") {
+		pos = amp
+	}
+	for pos > 0 && !utf8.RuneStart(line[pos]) {
+		pos--
+	}
+	return pos
+}
+
+// cutForward returns the smallest position >= pos at which the HTML-escaped
+// line can be cut, see cutBackward.
+func cutForward(line string, pos int) int {
+	if amp := strings.LastIndexByte(line[:pos], '&'); amp > -1 && !strings.Contains(line[amp:pos], ";") {
+		if semi := strings.IndexByte(line[pos:], ';'); semi > -1 {
+			pos += semi + 1
+		}
+	}
+	for pos < len(line) && !utf8.RuneStart(line[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// truncateLine truncates the (HTML-escaped) surrounding line to max bytes
+// (plus the ellipsis), keeping its beginning.
+func truncateLine(line string, max int) string {
+	if len(line) <= max {
+		return line
+	}
+	return line[:cutBackward(line, max)] + ellipsis
+}
+
+// truncateMatch truncates the context lines of match which are longer than
+// max bytes (0 means unlimited), so that e.g. minified files do not bloat
+// result pages. The matching line is truncated around the first highlighted
+// range, and its original length is recorded in ContextLength.
+func truncateMatch(match *sourcebackendpb.Match, max int) {
+	if max <= 0 {
+		return
+	}
+	match.Ctxp2 = truncateLine(match.Ctxp2, max)
+	match.Ctxp1 = truncateLine(match.Ctxp1, max)
+	match.Ctxn1 = truncateLine(match.Ctxn1, max)
+	match.Ctxn2 = truncateLine(match.Ctxn2, max)
+
+	line := match.Context
+	if len(line) <= max {
+		return
+	}
+	// Center the window on the first highlighted range (or as much of it as
+	// fits).
+	var start int
+	if len(match.HighlightRanges) > 0 {
+		first := match.HighlightRanges[0]
+		length := int(first.End - first.Start)
+		if length > max {
+			length = max
+		}
+		start = int(first.Start) - (max-length)/2
+	}
+	if start+max > len(line) {
+		start = len(line) - max
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := cutBackward(line, start+max)
+	start = cutForward(line, start)
+	if end < start {
+		end = start
+	}
+
+	var truncated strings.Builder
+	if start > 0 {
+		truncated.WriteString(ellipsis)
+	}
+	offset := truncated.Len() - start
+	truncated.WriteString(line[start:end])
+	if end < len(line) {
+		truncated.WriteString(ellipsis)
+	}
+
+	ranges := match.HighlightRanges[:0]
+	for _, r := range match.HighlightRanges {
+		rs, re := int(r.Start), int(r.End)
+		if rs < start {
+			rs = start
+		}
+		if re > end {
+			re = end
+		}
+		if rs >= re {
+			continue
+		}
+		ranges = append(ranges, &sourcebackendpb.Range{
+			Start: uint32(rs + offset),
+			End:   uint32(re + offset),
+		})
+	}
+	match.HighlightRanges = ranges
+	match.ContextLength = uint32(len(line))
+	match.Context = truncated.String()
+}
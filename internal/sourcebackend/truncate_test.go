@@ -0,0 +1,63 @@
+package sourcebackend
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Debian/dcs/internal/proto/sourcebackendpb"
+)
+
+func TestTruncateMatch(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	match := &sourcebackendpb.Match{
+		Ctxp1:           long,
+		Context:         long + "needle" + long,
+		Ctxn1:           "short",
+		HighlightRanges: []*sourcebackendpb.Range{{Start: 100, End: 106}},
+	}
+	truncateMatch(match, 20)
+	if got, want := match.Ctxp1, strings.Repeat("x", 20)+ellipsis; got != want {
+		t.Errorf("Ctxp1 = %q, want %q", got, want)
+	}
+	if got, want := match.Ctxn1, "short"; got != want {
+		t.Errorf("Ctxn1 = %q, want %q", got, want)
+	}
+	if got, want := match.Context, ellipsis+"xxxxxxxneedlexxxxxxx"+ellipsis; got != want {
+		t.Errorf("Context = %q, want %q", got, want)
+	}
+	if got, want := match.ContextLength, uint32(206); got != want {
+		t.Errorf("ContextLength = %d, want %d", got, want)
+	}
+	want := []*sourcebackendpb.Range{{Start: uint32(len(ellipsis) + 7), End: uint32(len(ellipsis) + 13)}}
+	if !reflect.DeepEqual(match.HighlightRanges, want) {
+		t.Errorf("HighlightRanges = %v, want %v", match.HighlightRanges, want)
+	}
+	if got := match.Context[match.HighlightRanges[0].Start:match.HighlightRanges[0].End]; got != "needle" {
+		t.Errorf("highlighted %q, want %q", got, "needle")
+	}
+
+	// Lines are not cut within escape sequences or UTF-8 sequences.
+	match = &sourcebackendpb.Match{
+		Ctxp1:   "ab&amp;cd",
+		Context: "äöü&lt;needle",
+		HighlightRanges: []*sourcebackendpb.Range{{
+			Start: uint32(len("äöü&lt;")),
+			End:   uint32(len("äöü&lt;needle")),
+		}},
+	}
+	truncateMatch(match, 4)
+	if got, want := match.Ctxp1, "ab"+ellipsis; got != want {
+		t.Errorf("Ctxp1 = %q, want %q", got, want)
+	}
+	if got, want := match.Context, ellipsis+"need"+ellipsis; got != want {
+		t.Errorf("Context = %q, want %q", got, want)
+	}
+
+	// Lines within the limit are not modified.
+	match = &sourcebackendpb.Match{Context: "needle"}
+	truncateMatch(match, 20)
+	if match.Context != "needle" || match.ContextLength != 0 {
+		t.Errorf("unexpectedly truncated: %+v", match)
+	}
+}
@@ -0,0 +1,37 @@
+package sourcebackend
+
+import "strings"
+
+// Versions maps source packages (e.g. “vim_8.1.0875-5”) to their full
+// version as declared in their .dsc file (e.g. “2:8.1.0875-5”), as written
+// by dcs-package-importer.
+type Versions map[string]string
+
+// ReadVersions reads the versions of an index shard. A missing file results
+// in empty Versions.
+func ReadVersions(path string) (Versions, error) {
+	v := make(Versions)
+	if err := readJSON(path, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// For returns the version of the source package of the file at path, e.g.
+// “vim_8.1.0875-5/src/main.c”. Packages which were imported before versions
+// were recorded fall back to the version contained in their directory name,
+// which lacks the epoch.
+func (v Versions) For(path string) string {
+	pkg := path
+	if idx := strings.Index(path, "/"); idx != -1 {
+		pkg = path[:idx]
+	}
+	if version, ok := v[pkg]; ok {
+		return version
+	}
+	idx := strings.Index(pkg, "_")
+	if idx == -1 {
+		return ""
+	}
+	return pkg[idx+1:]
+}
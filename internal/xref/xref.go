@@ -0,0 +1,189 @@
+// Package xref extracts include and import statements from source files, so
+// that the files which include a given header (or import a given module) can
+// be looked up directly instead of regular expression matching #include lines.
+package xref
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Index maps includes and imports (e.g. “stdio.h”, “os/exec”, “numpy”) to
+// the files containing them (e.g. “i3-wm_4.16-1/src/main.c”).
+type Index map[string][]string
+
+// Add records that the file at path contains includes.
+func (x Index) Add(path string, includes []string) {
+	for _, include := range includes {
+		x[include] = append(x[include], path)
+	}
+}
+
+// Merge adds all entries of other to x.
+func (x Index) Merge(other Index) {
+	for include, paths := range other {
+		x[include] = append(x[include], paths...)
+	}
+}
+
+// Lookup returns the (sorted) files containing include.
+func (x Index) Lookup(include string) []string {
+	paths := append([]string(nil), x[include]...)
+	sort.Strings(paths)
+	return paths
+}
+
+// ReadIndex reads the cross-reference index of an index shard, as written by
+// the importer. A missing file results in an empty Index.
+func ReadIndex(path string) (Index, error) {
+	x := make(Index)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return x, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&x); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// A language describes how to find the includes/imports of a programming
+// language. Each pattern is matched against every line; its first submatch
+// is a comma-separated list of includes.
+type language struct {
+	patterns []*regexp.Regexp
+	// block, if non-nil, matches the start of a multi-line import block
+	// (e.g. Go’s “import (”), in which blockLine is matched against every
+	// line until a line starting with “)”.
+	block     *regexp.Regexp
+	blockLine *regexp.Regexp
+}
+
+var (
+	cLanguage = &language{
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`^\s*#\s*(?:include|import)\s*[<"]([^>"]+)[>"]`),
+		},
+	}
+
+	languages = map[string]*language{
+		".c":   cLanguage,
+		".h":   cLanguage,
+		".cc":  cLanguage,
+		".cpp": cLanguage,
+		".cxx": cLanguage,
+		".hh":  cLanguage,
+		".hpp": cLanguage,
+		".hxx": cLanguage,
+		".m":   cLanguage,
+		".mm":  cLanguage,
+
+		".py": {
+			patterns: []*regexp.Regexp{
+				regexp.MustCompile(`^\s*import\s+([\w.]+(?:\s+as\s+\w+)?(?:\s*,\s*[\w.]+(?:\s+as\s+\w+)?)*)`),
+				regexp.MustCompile(`^\s*from\s+(\w[\w.]*)\s+import\b`),
+			},
+		},
+
+		".go": {
+			patterns: []*regexp.Regexp{
+				regexp.MustCompile(`^import\s+(?:[\w.]+\s+)?"([^"]+)"`),
+			},
+			block:     regexp.MustCompile(`^import\s*\(`),
+			blockLine: regexp.MustCompile(`^\s*(?:[\w.]+\s+)?"([^"]+)"`),
+		},
+
+		".java": {
+			patterns: []*regexp.Regexp{
+				regexp.MustCompile(`^\s*import\s+(?:static\s+)?([\w.]+(?:\.\*)?)\s*;`),
+			},
+		},
+
+		".pl": {
+			patterns: []*regexp.Regexp{
+				regexp.MustCompile(`^\s*(?:use|require)\s+([A-Z][\w:]*)`),
+			},
+		},
+
+		".js": {
+			patterns: []*regexp.Regexp{
+				regexp.MustCompile(`^\s*import\b.*?['"]([^'"]+)['"]`),
+				regexp.MustCompile(`\brequire\(\s*['"]([^'"]+)['"]\s*\)`),
+			},
+		},
+	}
+)
+
+func init() {
+	languages[".pm"] = languages[".pl"]
+	languages[".ts"] = languages[".js"]
+}
+
+// Supported reports whether Extract supports the file at path.
+func Supported(path string) bool {
+	_, ok := languages[strings.ToLower(filepath.Ext(path))]
+	return ok
+}
+
+// Extract returns the includes/imports of the file at path (only the file
+// extension is used), read from r, in order of appearance and without
+// duplicates.
+func Extract(path string, r io.Reader) ([]string, error) {
+	lang, ok := languages[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return nil, nil
+	}
+	var includes []string
+	seen := make(map[string]bool)
+	add := func(list string) {
+		for _, include := range strings.Split(list, ",") {
+			include = strings.TrimSpace(include)
+			// Strip Python’s “import foo as bar”.
+			if idx := strings.IndexAny(include, " \t"); idx > -1 {
+				include = include[:idx]
+			}
+			if include == "" || seen[include] {
+				continue
+			}
+			seen[include] = true
+			includes = append(includes, include)
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	inBlock := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inBlock {
+			if strings.HasPrefix(strings.TrimSpace(line), ")") {
+				inBlock = false
+			} else if m := lang.blockLine.FindStringSubmatch(line); m != nil {
+				add(m[1])
+			}
+			continue
+		}
+		if lang.block != nil && lang.block.MatchString(line) {
+			inBlock = true
+			continue
+		}
+		for _, re := range lang.patterns {
+			if m := re.FindStringSubmatch(line); m != nil {
+				add(m[1])
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && err != bufio.ErrTooLong {
+		return nil, err
+	}
+	return includes, nil
+}
@@ -0,0 +1,69 @@
+package xref
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	for _, tt := range []struct {
+		path     string
+		contents string
+		want     []string
+	}{
+		{
+			path: "src/main.c",
+			contents: `#include <stdio.h>
+#  include "libi3.h"
+#include <stdio.h>
+/* #include <not/an/include.h> */
+int main() {}
+`,
+			want: []string{"stdio.h", "libi3.h"},
+		},
+		{
+			path: "setup.py",
+			contents: `import os, sys as system
+from setuptools import setup
+from . import version
+`,
+			want: []string{"os", "sys", "setuptools"},
+		},
+		{
+			path: "main.go",
+			contents: `package main
+
+import "fmt"
+
+import (
+	"os/exec"
+	olog "github.com/opentracing/opentracing-go/log"
+)
+`,
+			want: []string{"fmt", "os/exec", "github.com/opentracing/opentracing-go/log"},
+		},
+		{
+			path: "Main.java",
+			contents: `import java.util.List;
+import static org.junit.Assert.*;
+`,
+			want: []string{"java.util.List", "org.junit.Assert.*"},
+		},
+		{
+			path:     "README",
+			contents: "#include <stdio.h>\n",
+			want:     nil,
+		},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := Extract(tt.path, strings.NewReader(tt.contents))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Extract(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package ranking
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+// DirClass classifies the directory of a file within its source package.
+type DirClass uint8
+
+const (
+	DirClassSource    DirClass = iota // anything not classified otherwise
+	DirClassPackaging                 // debian/
+	DirClassTest                      // e.g. tests/, testsuite/
+	DirClassDocs                      // e.g. doc/, docs/
+	DirClassVendored                  // e.g. vendor/, third_party/
+)
+
+var dirClasses = map[string]DirClass{
+	"test":          DirClassTest,
+	"tests":         DirClassTest,
+	"testing":       DirClassTest,
+	"testsuite":     DirClassTest,
+	"doc":           DirClassDocs,
+	"docs":          DirClassDocs,
+	"documentation": DirClassDocs,
+	"vendor":        DirClassVendored,
+	"third_party":   DirClassVendored,
+	"thirdparty":    DirClassVendored,
+	"3rdparty":      DirClassVendored,
+}
+
+// classWeights are the path weights (see FileRank.PathWeight) per DirClass.
+var classWeights = [...]float32{
+	DirClassSource:    1,
+	DirClassPackaging: 0.8,
+	DirClassTest:      0.9,
+	DirClassDocs:      0.85,
+	DirClassVendored:  0.7,
+}
+
+// FileRank contains the static (query-independent) ranking components of a
+// file. They are precomputed at index time (see WriteFileRanks), so that
+// ResultPath.Rank only needs to add the query-dependent components.
+type FileRank struct {
+	// Inst and Rdep are the StoredRanking of the file’s source package.
+	Inst float32
+	Rdep float32
+
+	// PkgEnd is the offset of the first _ in the path, i.e. the end of the
+	// source package name (see ResultPath.SourcePkgIdx). 0 for invalid
+	// paths.
+	PkgEnd uint16
+
+	// Depth is the number of directories between the source package
+	// directory and the file, capped at 255.
+	Depth uint8
+
+	// Class classifies the top-most classifiable directory of the file.
+	Class DirClass
+}
+
+// fileRankSize is the size of an encoded FileRank, see WriteFileRanks.
+const fileRankSize = 12
+
+// NewFileRank computes the FileRank of path (e.g.
+// i3-wm_4.8-1/i3bar/src/main.c) from the ranking data (see ReadRankingData).
+func NewFileRank(path string) FileRank {
+	var fr FileRank
+	pkgEnd := strings.IndexByte(path, '_')
+	if pkgEnd <= 0 || pkgEnd > math.MaxUint16 {
+		return fr
+	}
+	fr.PkgEnd = uint16(pkgEnd)
+	stored := storedRanking[path[:pkgEnd]]
+	fr.Inst = stored.Inst
+	fr.Rdep = stored.Rdep
+
+	dirs := strings.Split(path[pkgEnd:], "/")
+	// Skip the source package directory and the file name.
+	if len(dirs) > 2 {
+		dirs = dirs[1 : len(dirs)-1]
+	} else {
+		dirs = nil
+	}
+	if len(dirs) > math.MaxUint8 {
+		fr.Depth = math.MaxUint8
+	} else {
+		fr.Depth = uint8(len(dirs))
+	}
+	for idx, dir := range dirs {
+		dir = strings.ToLower(dir)
+		if idx == 0 && dir == "debian" {
+			fr.Class = DirClassPackaging
+			break
+		}
+		if class, ok := dirClasses[dir]; ok {
+			fr.Class = class
+			break
+		}
+	}
+	return fr
+}
+
+// PathWeight returns the ranking factor resulting from the file’s location
+// within its source package: files in deep directories, and files which are
+// not the package’s own source code, are ranked lower.
+func (fr *FileRank) PathWeight() float32 {
+	weight := float32(1)
+	if int(fr.Class) < len(classWeights) {
+		weight = classWeights[fr.Class]
+	}
+	return weight / (1 + 0.05*float32(fr.Depth))
+}
+
+// fileRanksMagic identifies the file format written by WriteFileRanks.
+var fileRanksMagic = []byte("dcsrank1")
+
+// FileRanks contains the FileRank of each document of an index shard,
+// indexed by docid.
+type FileRanks []FileRank
+
+// Lookup returns the FileRank of docid, or nil if fr does not cover docid.
+func (fr FileRanks) Lookup(docid uint32) *FileRank {
+	if int64(docid) >= int64(len(fr)) {
+		return nil
+	}
+	return &fr[docid]
+}
+
+// WriteFileRanks writes the FileRank (see NewFileRank) of each path in paths,
+// which contains one path per line in docid order (see
+// index.DocidReader.All), to w. The resulting file is the ranks.bin file of an
+// index shard, which the source backend loads along with the index.
+func WriteFileRanks(w io.Writer, paths io.Reader) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(fileRanksMagic); err != nil {
+		return err
+	}
+	var buf [fileRankSize]byte
+	scanner := bufio.NewScanner(paths)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fr := NewFileRank(scanner.Text())
+		binary.LittleEndian.PutUint32(buf[0:], math.Float32bits(fr.Inst))
+		binary.LittleEndian.PutUint32(buf[4:], math.Float32bits(fr.Rdep))
+		binary.LittleEndian.PutUint16(buf[8:], fr.PkgEnd)
+		buf[10] = fr.Depth
+		buf[11] = byte(fr.Class)
+		if _, err := bw.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ReadFileRanks reads a file written by WriteFileRanks.
+func ReadFileRanks(path string) (FileRanks, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, fileRanksMagic) {
+		return nil, fmt.Errorf("%s: not a file rank file", path)
+	}
+	b = b[len(fileRanksMagic):]
+	if len(b)%fileRankSize != 0 {
+		return nil, fmt.Errorf("%s: truncated", path)
+	}
+	ranks := make(FileRanks, len(b)/fileRankSize)
+	for idx := range ranks {
+		rec := b[idx*fileRankSize:]
+		ranks[idx] = FileRank{
+			Inst:   math.Float32frombits(binary.LittleEndian.Uint32(rec[0:])),
+			Rdep:   math.Float32frombits(binary.LittleEndian.Uint32(rec[4:])),
+			PkgEnd: binary.LittleEndian.Uint16(rec[8:]),
+			Depth:  rec[10],
+			Class:  DirClass(rec[11]),
+		}
+	}
+	return ranks, nil
+}
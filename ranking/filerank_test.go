@@ -0,0 +1,73 @@
+package ranking
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileRanks(t *testing.T) {
+	storedRanking = map[string]StoredRanking{
+		"i3-wm": {Inst: 0.5, Rdep: 0.25},
+	}
+	defer func() { storedRanking = make(map[string]StoredRanking) }()
+
+	paths := []string{
+		"i3-wm_4.8-1/i3bar/src/main.c",
+		"i3-wm_4.8-1/debian/rules",
+		"i3-wm_4.8-1/testcases/t/Tests/main.pl",
+		"zsh_5.7.1-1/Src/main.c",
+		"invalid",
+	}
+	want := []FileRank{
+		{Inst: 0.5, Rdep: 0.25, PkgEnd: 5, Depth: 2, Class: DirClassSource},
+		{Inst: 0.5, Rdep: 0.25, PkgEnd: 5, Depth: 1, Class: DirClassPackaging},
+		{Inst: 0.5, Rdep: 0.25, PkgEnd: 5, Depth: 3, Class: DirClassTest},
+		{PkgEnd: 3, Depth: 1, Class: DirClassSource},
+		{},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteFileRanks(&buf, strings.NewReader(strings.Join(paths, "\n")+"\n")); err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "dcs-ranking")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	fn := filepath.Join(tmp, "ranks.bin")
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ranks, err := ReadFileRanks(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(ranks), len(paths); got != want {
+		t.Fatalf("ReadFileRanks returned %d entries, want %d", got, want)
+	}
+	for docid, path := range paths {
+		if got := *ranks.Lookup(uint32(docid)); got != want[docid] {
+			t.Errorf("FileRank(%q) = %+v, want %+v", path, got, want[docid])
+		}
+	}
+	if got := ranks.Lookup(uint32(len(paths))); got != nil {
+		t.Errorf("Lookup beyond the last docid = %+v, want nil", got)
+	}
+
+	// Precomputed components must result in the same ranking.
+	opts := RankingOpts{Weighted: true, Pathweight: true}
+	for docid, path := range paths[:len(paths)-1] {
+		computed := ResultPath{Path: path}
+		computed.Rank(&opts)
+		precomputed := ResultPath{Path: path, Static: ranks.Lookup(uint32(docid))}
+		precomputed.Rank(&opts)
+		if computed.Ranking != precomputed.Ranking || computed.SourcePkgIdx != precomputed.SourcePkgIdx {
+			t.Errorf("%q: precomputed ranking %+v differs from computed ranking %+v", path, precomputed, computed)
+		}
+	}
+}
@@ -32,6 +32,10 @@ type RankingOpts struct {
 	// pre-ranking: does the search query match the source package name?
 	Sourcepkgmatch bool
 
+	// pre-ranking: location of the file within its source package (see
+	// FileRank.PathWeight). Not enabled by Weighted.
+	Pathweight bool
+
 	// post-ranking
 
 	// post-ranking: in which scope is the match?
@@ -132,6 +136,7 @@ func RankingOptsFromQuery(query url.Values) RankingOpts {
 	result.Filetype = boolFromQuery(query, "filetype")
 	result.Pathmatch = boolFromQuery(query, "pathmatch")
 	result.Sourcepkgmatch = boolFromQuery(query, "sourcepkgmatch")
+	result.Pathweight = boolFromQuery(query, "pathweight")
 	result.Scope = boolFromQuery(query, "scope")
 	result.Linematch = boolFromQuery(query, "linematch")
 	// Special case: weighted is the default, so assume true if unset.
@@ -49,6 +49,16 @@ type ResultPath struct {
 	Position     int
 	SourcePkgIdx [2]int
 	Ranking      float32
+
+	// Static contains the precomputed static ranking components of the
+	// file (see FileRanks), if available. Otherwise, Rank computes them.
+	Static *FileRank
+
+	// Size and Mtime are the file’s metadata as recorded in the index (see
+	// index.DocMeta). If unknown, Size is sizefilter.UnknownSize and Mtime
+	// is 0.
+	Size  uint64
+	Mtime int64
 }
 
 func (rp *ResultPath) Rank(opts *RankingOpts) {
@@ -58,26 +68,23 @@ func (rp *ResultPath) Rank(opts *RankingOpts) {
 	// full ranking: 24s
 	// lookup table: 6.8s
 
-	rp.SourcePkgIdx[0] = 0
-	rp.SourcePkgIdx[1] = 0
-	for i := 0; i < len(rp.Path); i++ {
-		if rp.Path[i] == '_' {
-			rp.SourcePkgIdx[1] = i
-			break
-		}
+	static := rp.Static
+	if static == nil {
+		fr := NewFileRank(rp.Path)
+		static = &fr
 	}
-	if rp.SourcePkgIdx[1] == 0 {
+	if static.PkgEnd == 0 {
 		log.Fatalf("Invalid path in result: %q", rp.Path)
 	}
+	rp.SourcePkgIdx[0] = 0
+	rp.SourcePkgIdx[1] = int(static.PkgEnd)
 
-	sourcePackage := rp.Path[rp.SourcePkgIdx[0]:rp.SourcePkgIdx[1]]
-	ranking := storedRanking[sourcePackage]
 	rp.Ranking = 1
 	if opts.Inst {
-		rp.Ranking += ranking.Inst
+		rp.Ranking += static.Inst
 	}
 	if opts.Rdep {
-		rp.Ranking += ranking.Rdep
+		rp.Ranking += static.Rdep
 	}
 	if (opts.Filetype || opts.Weighted) && len(opts.Suffixes) > 0 {
 		suffix := strings.ToLower(path.Ext(rp.Path))
@@ -97,8 +104,11 @@ func (rp *ResultPath) Rank(opts *RankingOpts) {
 		}
 	}
 	if opts.Weighted {
-		rp.Ranking += 0.3840 * ranking.Inst
-		rp.Ranking += 0.3427 * ranking.Rdep
+		rp.Ranking += 0.3840 * static.Inst
+		rp.Ranking += 0.3427 * static.Rdep
+	}
+	if opts.Pathweight {
+		rp.Ranking *= static.PathWeight()
 	}
 }
 
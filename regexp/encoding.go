@@ -0,0 +1,75 @@
+package regexp
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// EncodingLatin1 is the Encoding of files which are not valid UTF-8. Such
+// files are assumed to be ISO-8859-1 (latin-1), which is by far the most
+// common legacy encoding in Debian sources, and every byte sequence is valid
+// ISO-8859-1.
+const EncodingLatin1 = "latin1"
+
+// DetectEncoding returns the encoding of the file starting with head: "" for
+// UTF-8 (including ASCII) or EncodingLatin1. head may end in the middle of a
+// UTF-8 sequence.
+func DetectEncoding(head []byte) string {
+	for i := 0; i < len(head); {
+		if head[i] < utf8.RuneSelf {
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(head[i:])
+		if r == utf8.RuneError && size == 1 {
+			if !utf8.FullRune(head[i:]) {
+				break // truncated
+			}
+			return EncodingLatin1
+		}
+		i += size
+	}
+	return ""
+}
+
+// Latin1ToUTF8 appends the UTF-8 encoding of the ISO-8859-1 encoded src to
+// dst and returns the extended buffer. ISO-8859-1 bytes are the Unicode code
+// points U+0000 to U+00FF, and newlines are preserved, so line numbers do not
+// change.
+func Latin1ToUTF8(dst, src []byte) []byte {
+	for _, b := range src {
+		if b < utf8.RuneSelf {
+			dst = append(dst, b)
+			continue
+		}
+		dst = append(dst, 0xc0|b>>6, 0x80|b&0x3f)
+	}
+	return dst
+}
+
+// latin1Reader converts the ISO-8859-1 encoded contents of r to UTF-8.
+type latin1Reader struct {
+	r       io.Reader
+	raw     [4096]byte
+	buf     []byte
+	pending []byte
+	err     error
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	if len(l.pending) == 0 {
+		if l.err != nil {
+			return 0, l.err
+		}
+		n, err := l.r.Read(l.raw[:])
+		l.buf = Latin1ToUTF8(l.buf[:0], l.raw[:n])
+		l.pending = l.buf
+		l.err = err
+		if len(l.pending) == 0 {
+			return 0, l.err
+		}
+	}
+	n := copy(p, l.pending)
+	l.pending = l.pending[n:]
+	return n, nil
+}
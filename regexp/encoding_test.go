@@ -0,0 +1,89 @@
+package regexp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDetectEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		head string
+		want string
+	}{
+		{"plain ASCII\n", ""},
+		{"Stra\xc3\x9fe\n", ""},
+		{"Stra\xdfe\n", EncodingLatin1},
+		// Truncated UTF-8 sequence at the end of the buffer.
+		{"Stra\xc3", ""},
+		{"\xe2\x82", ""},
+	} {
+		if got := DetectEncoding([]byte(tt.head)); got != tt.want {
+			t.Errorf("DetectEncoding(%q) = %q, want %q", tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestLatin1Reader(t *testing.T) {
+	var latin1 bytes.Buffer
+	for i := 0; i < 10000; i++ {
+		latin1.WriteByte(byte(i))
+	}
+	want := Latin1ToUTF8(nil, latin1.Bytes())
+	got, err := ioutil.ReadAll(iotest.OneByteReader(&latin1Reader{r: bytes.NewReader(latin1.Bytes())}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("latin1Reader returned %d bytes, want %d bytes", len(got), len(want))
+	}
+	if got, want := string(Latin1ToUTF8(nil, []byte("Stra\xdfe"))), "Straße"; got != want {
+		t.Errorf("Latin1ToUTF8 = %q, want %q", got, want)
+	}
+}
+
+func TestMatchLatin1(t *testing.T) {
+	const input = "first\nG\xfcnther Stra\xdfe\nlast\n"
+	re, err := Compile("Stra.e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := Grep{Regexp: re}
+	matches := g.Reader(strings.NewReader(input), "input")
+	if len(matches) != 1 {
+		t.Fatalf("Expected precisely one match, got %d", len(matches))
+	}
+	m := matches[0]
+	if got, want := m.Context, "Günther Straße"; got != want {
+		t.Errorf("Context = %q, want %q", got, want)
+	}
+	if got, want := m.Encoding, EncodingLatin1; got != want {
+		t.Errorf("Encoding = %q, want %q", got, want)
+	}
+	if m.Line != 2 || m.Ctxp1 != "first" || m.Ctxn1 != "last" {
+		t.Errorf("unexpected match: %+v", m)
+	}
+
+	// Without conversion, . does not match the (invalid UTF-8) byte \xdf.
+	g = Grep{Regexp: re, Raw: true}
+	if matches := g.Reader(strings.NewReader(input), "input"); len(matches) != 0 {
+		t.Errorf("Expected no matches with Raw, got %+v", matches)
+	}
+	re, err = Compile("Stra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g = Grep{Regexp: re, Raw: true}
+	matches = g.Reader(strings.NewReader(input), "input")
+	if len(matches) != 1 {
+		t.Fatalf("Expected precisely one match with Raw, got %d", len(matches))
+	}
+	if got, want := matches[0].Context, "G\xfcnther Stra\xdfe"; got != want {
+		t.Errorf("Context = %q, want %q", got, want)
+	}
+	if got, want := matches[0].Encoding, EncodingLatin1; got != want {
+		t.Errorf("Encoding = %q, want %q", got, want)
+	}
+}
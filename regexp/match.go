@@ -362,6 +362,14 @@ type Grep struct {
 
 	Match bool
 
+	// Skip, if non-nil, is called with the beginning of each file (up to
+	// 1 MB). Files for which it returns true are not searched.
+	Skip func(head []byte) bool
+
+	// Raw disables the conversion of files which are not UTF-8 (see
+	// DetectEncoding), i.e. the regexp is matched against the raw bytes.
+	Raw bool
+
 	buf []byte
 }
 
@@ -413,6 +421,19 @@ type Match struct {
 	// contents of line (Line + 2)
 	Ctxn2 string
 
+	// Ranges of Context (i.e. of the HTML-escaped line) which the regular
+	// expression matched.
+	HighlightRanges []Range `json:"highlight_ranges,omitempty"`
+
+	// Encoding of the file (see DetectEncoding), empty for UTF-8. Unless
+	// Grep.Raw is set, the file was converted to UTF-8 before matching.
+	Encoding string `json:"encoding,omitempty"`
+
+	// Compression of the file, e.g. “gzip” (see sourcebackendpb.Match).
+	// Filled in by the source backend, which decompresses files before
+	// matching.
+	Compression string `json:"compression,omitempty"`
+
 	// This will be filled in by the source backend
 	PathRank float32
 	Ranking  float32
@@ -433,10 +454,24 @@ func (g *Grep) Reader(r io.Reader, name string) []Match {
 		needContext = 0
 		lastp1      = ""
 		lastp2      = ""
+		sniffed     = false
+		encoding    = ""
 	)
 	for {
 		n, err := io.ReadFull(r, buf[len(buf):cap(buf)])
 		buf = buf[:len(buf)+n]
+		if !sniffed {
+			sniffed = true
+			if g.Skip != nil && g.Skip(buf) {
+				return nil
+			}
+			encoding = DetectEncoding(buf)
+			if encoding == EncodingLatin1 && !g.Raw {
+				// Converting may double the size of the buffer.
+				buf = Latin1ToUTF8(make([]byte, 0, 2*cap(buf)), buf)
+				r = &latin1Reader{r: r}
+			}
+		}
 		end := len(buf)
 		if err == nil {
 			// We only look at complete lines
@@ -479,11 +514,14 @@ func (g *Grep) Reader(r io.Reader, name string) []Match {
 			//fmt.Printf("matching line: %s", buf[lineStart:lineEnd])
 
 			lineno += countNL(buf[chunkStart:lineStart])
-			line := html.EscapeString(string(buf[lineStart : lineEnd-1]))
+			rawLine := string(buf[lineStart : lineEnd-1])
+			line := html.EscapeString(rawLine)
 			match := Match{
-				Path:    name,
-				Line:    lineno,
-				Context: string(line),
+				Path:            name,
+				Line:            lineno,
+				Context:         string(line),
+				HighlightRanges: EscapeRanges(rawLine, g.Regexp.MatchRanges(rawLine)),
+				Encoding:        encoding,
 			}
 			// Let’s find the previous two lines, if possible.
 			bufLineNo = countNL(buf[:lineStart])
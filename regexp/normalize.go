@@ -0,0 +1,72 @@
+package regexp
+
+import (
+	"net/url"
+	"regexp/syntax"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Options modify how CompileOptions interprets an expression.
+type Options struct {
+	// Normalize makes literals match regardless of the Unicode normalization
+	// form (NFC or NFD) of the searched text, e.g. “é” matches both U+00E9
+	// and U+0065 U+0301.
+	Normalize bool
+
+	// FoldCase makes the expression case-insensitive (including non-ASCII
+	// characters), as if it was prefixed with (?i).
+	FoldCase bool
+}
+
+// normalizeLiterals replaces each literal in re whose NFC and NFD forms differ
+// with an alternation of all forms. As the alternation is part of re, the
+// trigram index query derived from re (see index.RegexpQuery) covers all
+// forms, too.
+func normalizeLiterals(re *syntax.Regexp) *syntax.Regexp {
+	if re.Op != syntax.OpLiteral {
+		for i, sub := range re.Sub {
+			re.Sub[i] = normalizeLiterals(sub)
+		}
+		return re
+	}
+	literal := string(re.Rune)
+	forms := []string{literal}
+	for _, form := range []norm.Form{norm.NFC, norm.NFD} {
+		normalized := form.String(literal)
+		unique := true
+		for _, f := range forms {
+			if f == normalized {
+				unique = false
+				break
+			}
+		}
+		if unique {
+			forms = append(forms, normalized)
+		}
+	}
+	if len(forms) == 1 {
+		return re
+	}
+	alt := &syntax.Regexp{
+		Op:    syntax.OpAlternate,
+		Flags: re.Flags,
+	}
+	for _, form := range forms {
+		alt.Sub = append(alt.Sub, &syntax.Regexp{
+			Op:    syntax.OpLiteral,
+			Flags: re.Flags,
+			Rune:  []rune(form),
+		})
+	}
+	return alt
+}
+
+// OptionsFromQuery returns the Options selected by the normalize= and fold=
+// parameters of the (rewritten) query URL.
+func OptionsFromQuery(query url.Values) Options {
+	return Options{
+		Normalize: query.Get("normalize") == "1",
+		FoldCase:  query.Get("fold") == "1",
+	}
+}
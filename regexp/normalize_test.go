@@ -0,0 +1,35 @@
+package regexp
+
+import "testing"
+
+func TestCompileOptions(t *testing.T) {
+	const (
+		nfc = "caf\u00e9"  // é as a single code point
+		nfd = "cafe\u0301" // e followed by a combining acute accent
+	)
+	for _, tt := range []struct {
+		expr  string
+		opts  Options
+		s     string
+		match bool
+	}{
+		{nfc, Options{}, nfc, true},
+		{nfc, Options{}, nfd, false},
+		{nfc, Options{Normalize: true}, nfc, true},
+		{nfc, Options{Normalize: true}, nfd, true},
+		{nfd, Options{Normalize: true}, nfc, true},
+		{nfc + "s?", Options{Normalize: true}, "les " + nfd + "s", true},
+		{nfc, Options{Normalize: true}, "cafe", false},
+		{"\u00c4rger", Options{}, "\u00e4rger", false},
+		{"\u00c4rger", Options{FoldCase: true}, "\u00e4rger", true},
+		{"\u00c4rger", Options{FoldCase: true, Normalize: true}, "a\u0308rger", true},
+	} {
+		re, err := CompileOptions(tt.expr, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := re.MatchString(tt.s, true, true) != -1; got != tt.match {
+			t.Errorf("CompileOptions(%q, %+v).MatchString(%q) = %v, want %v", tt.expr, tt.opts, tt.s, got, tt.match)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package regexp
+
+import (
+	"encoding/json"
+	stdregexp "regexp"
+	"strings"
+)
+
+// Range is the byte range [Start, End) of a line.
+type Range struct {
+	Start, End int
+}
+
+// MarshalJSON encodes r as [start, end].
+func (r Range) MarshalJSON() ([]byte, error) {
+	return json.Marshal([2]int{r.Start, r.End})
+}
+
+// UnmarshalJSON decodes r from [start, end].
+func (r *Range) UnmarshalJSON(b []byte) error {
+	var pair [2]int
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	r.Start, r.End = pair[0], pair[1]
+	return nil
+}
+
+// MatchRanges returns the ranges of all non-empty, non-overlapping matches of
+// the regular expression within line, which must not contain a newline.
+func (re *Regexp) MatchRanges(line string) []Range {
+	if re.std == nil {
+		// Syntax already reflects the Options (e.g. case folding) the
+		// expression was compiled with, so the standard library regexp
+		// matches the same text as the grep matcher.
+		std, err := stdregexp.Compile(re.Syntax.String())
+		if err != nil {
+			bug()
+		}
+		re.std = std
+	}
+	var ranges []Range
+	for _, loc := range re.std.FindAllStringIndex(line, -1) {
+		if loc[0] == loc[1] {
+			continue // nothing to highlight
+		}
+		ranges = append(ranges, Range{loc[0], loc[1]})
+	}
+	return ranges
+}
+
+// LiteralRanges returns the ranges of all non-overlapping occurrences of
+// literal within line.
+func LiteralRanges(line, literal string) []Range {
+	if literal == "" {
+		return nil
+	}
+	var ranges []Range
+	for offset := 0; ; {
+		idx := strings.Index(line[offset:], literal)
+		if idx == -1 {
+			return ranges
+		}
+		start := offset + idx
+		offset = start + len(literal)
+		ranges = append(ranges, Range{start, offset})
+	}
+}
+
+// htmlEscapeLen returns the length of c after html.EscapeString.
+func htmlEscapeLen(c byte) int {
+	switch c {
+	case '<', '>':
+		return len("&lt;")
+	case '&':
+		return len("&amp;")
+	case '\'', '"':
+		return len("&#39;")
+	}
+	return 1
+}
+
+// EscapeRanges converts ranges of line into the corresponding ranges of
+// html.EscapeString(line). The converted ranges never start or end within an
+// escape sequence.
+func EscapeRanges(line string, ranges []Range) []Range {
+	if len(ranges) == 0 {
+		return nil
+	}
+	escaped := make([]Range, len(ranges))
+	pos := 0  // position in line
+	epos := 0 // corresponding position in the escaped line
+	advance := func(to int) {
+		for ; pos < to; pos++ {
+			epos += htmlEscapeLen(line[pos])
+		}
+	}
+	for idx, r := range ranges {
+		if r.Start < pos || r.End < r.Start || r.End > len(line) {
+			bug()
+		}
+		advance(r.Start)
+		escaped[idx].Start = epos
+		advance(r.End)
+		escaped[idx].End = epos
+	}
+	return escaped
+}
@@ -0,0 +1,91 @@
+package regexp
+
+import (
+	"encoding/json"
+	"html"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchRanges(t *testing.T) {
+	for _, tt := range []struct {
+		expr string
+		opts Options
+		line string
+		want []Range
+	}{
+		{`foo`, Options{}, "foo bar foo", []Range{{0, 3}, {8, 11}}},
+		{`fo+`, Options{}, "xfooo", []Range{{1, 5}}},
+		{`^foo`, Options{}, "foo foo", []Range{{0, 3}}},
+		{`foo`, Options{FoldCase: true}, "Foo FOO", []Range{{0, 3}, {4, 7}}},
+		{`x*`, Options{}, "abc", nil},
+		{`ä`, Options{}, "aä", []Range{{1, 3}}},
+	} {
+		re, err := CompileOptions(tt.expr, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := re.MatchRanges(tt.line); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q.MatchRanges(%q) = %v, want %v", tt.expr, tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestLiteralRanges(t *testing.T) {
+	got := LiteralRanges("aaaa", "aa")
+	want := []Range{{0, 2}, {2, 4}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LiteralRanges = %v, want %v", got, want)
+	}
+}
+
+func TestEscapeRanges(t *testing.T) {
+	const line = `if (a < b && c) { return "x"; }`
+	re, err := Compile(`a < b && c|"x"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	escaped := html.EscapeString(line)
+	var got []string
+	for _, r := range EscapeRanges(line, re.MatchRanges(line)) {
+		got = append(got, escaped[r.Start:r.End])
+	}
+	want := []string{"a &lt; b &amp;&amp; c", "&#34;x&#34;"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("escaped ranges = %q, want %q", got, want)
+	}
+}
+
+func TestGrepHighlightRanges(t *testing.T) {
+	re, err := Compile(`b+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := Grep{Regexp: re}
+	matches := g.Reader(strings.NewReader("aaa\n<bb> bbb\n"), "test")
+	if len(matches) != 1 {
+		t.Fatalf("unexpected number of matches: got %d, want 1", len(matches))
+	}
+	want := []Range{{4, 6}, {11, 14}}
+	if got := matches[0].HighlightRanges; !reflect.DeepEqual(got, want) {
+		t.Errorf("HighlightRanges = %v, want %v (context %q)", got, want, matches[0].Context)
+	}
+}
+
+func TestRangeJSON(t *testing.T) {
+	b, err := json.Marshal([]Range{{1, 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "[[1,4]]"; got != want {
+		t.Errorf("json.Marshal = %s, want %s", got, want)
+	}
+	var ranges []Range
+	if err := json.Unmarshal(b, &ranges); err != nil {
+		t.Fatal(err)
+	}
+	if want := []Range{{1, 4}}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("json.Unmarshal = %v, want %v", ranges, want)
+	}
+}
@@ -6,7 +6,10 @@
 // use in grep-like programs.
 package regexp
 
-import "regexp/syntax"
+import (
+	stdregexp "regexp"
+	"regexp/syntax"
+)
 
 func bug() {
 	panic("codesearch/regexp: internal error")
@@ -18,6 +21,9 @@ type Regexp struct {
 	Syntax *syntax.Regexp
 	expr   string // original expression
 	m      matcher
+
+	// std is compiled from Syntax on demand, see MatchRanges.
+	std *stdregexp.Regexp
 }
 
 // String returns the source text used to compile the regular expression.
@@ -28,10 +34,23 @@ func (re *Regexp) String() string {
 // Compile parses a regular expression and returns, if successful,
 // a Regexp object that can be used to match against lines of text.
 func Compile(expr string) (*Regexp, error) {
-	re, err := syntax.Parse(expr, syntax.Perl)
+	return CompileOptions(expr, Options{})
+}
+
+// CompileOptions is like Compile, but modifies the expression according to
+// opts.
+func CompileOptions(expr string, opts Options) (*Regexp, error) {
+	flags := syntax.Perl
+	if opts.FoldCase {
+		flags |= syntax.FoldCase
+	}
+	re, err := syntax.Parse(expr, flags)
 	if err != nil {
 		return nil, err
 	}
+	if opts.Normalize {
+		re = normalizeLiterals(re)
+	}
 	sre := re.Simplify()
 	prog, err := syntax.Compile(sre)
 	if err != nil {
@@ -2,13 +2,78 @@ package shardmapping
 
 import (
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/renameio"
 )
 
-func TaskIdxForPackage(pkg string, tasks int) int {
+// Assignment overrides the shard of individual source packages, e.g. to move
+// packages off a hot shard (see cmd/dcs-rebalance). All other packages are
+// assigned by hash, see HashTaskIdx.
+type Assignment struct {
+	// Shards is the number of shards the assignment was computed for. The
+	// assignment is ignored when distributing packages among a different
+	// number of shards.
+	Shards int
+
+	// Packages maps source package names (without version, so that the
+	// assignment survives uploads) to shard indexes.
+	Packages map[string]int
+}
+
+// ReadAssignment reads an Assignment in JSON format from path.
+func ReadAssignment(path string) (*Assignment, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var a Assignment
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for pkg, idx := range a.Packages {
+		if idx < 0 || idx >= a.Shards {
+			return nil, fmt.Errorf("%s: package %q assigned to shard %d, but there are only %d shards", path, pkg, idx, a.Shards)
+		}
+	}
+	return &a, nil
+}
+
+// WriteAssignment atomically writes a in JSON format to path.
+func WriteAssignment(path string, a *Assignment) error {
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(path, append(b, '\n'), 0644)
+}
+
+var current atomic.Value // *Assignment
+
+// SetAssignment makes TaskIdxForPackage use a (nil restores hash-based
+// assignment of all packages).
+func SetAssignment(a *Assignment) {
+	current.Store(a)
+}
+
+// packageName returns the name of pkg, e.g. “i3-wm” for “i3-wm_4.8-1”.
+func packageName(pkg string) string {
+	if idx := strings.IndexByte(pkg, '_'); idx > -1 {
+		return pkg[:idx]
+	}
+	return pkg
+}
+
+// HashTaskIdx returns the shard of pkg (e.g. “i3-wm_4.8-1”) when not
+// overridden by an Assignment.
+func HashTaskIdx(pkg string, tasks int) int {
 	h := md5.New()
 	io.WriteString(h, pkg)
 	i, err := strconv.ParseInt(fmt.Sprintf("%x", h.Sum(nil)[:6]), 16, 64)
@@ -17,3 +82,14 @@ func TaskIdxForPackage(pkg string, tasks int) int {
 	}
 	return int(i) % tasks
 }
+
+// TaskIdxForPackage returns the shard of pkg (e.g. “i3-wm_4.8-1”), as
+// assigned by the current Assignment (see SetAssignment) or by hash.
+func TaskIdxForPackage(pkg string, tasks int) int {
+	if a, _ := current.Load().(*Assignment); a != nil && a.Shards == tasks {
+		if idx, ok := a.Packages[packageName(pkg)]; ok {
+			return idx
+		}
+	}
+	return HashTaskIdx(pkg, tasks)
+}
@@ -3,10 +3,24 @@
 // Opens a WebSocket connection to Debian Code Search to send and receive
 // search results almost instantaneously.
 
-// NB: All of these constants needs to match those in cmd/dcs-web/querymanager.go
+// Defaults of the corresponding dcs-web flags. Overridden by applyUIConfig()
+// with the values dcs-web is configured with.
 var packagesPerPage = 5;
 var resultsPerPackage = 2;
 
+function applyUIConfig(config) {
+    packagesPerPage = config.PackagesPerPage;
+    resultsPerPackage = config.ResultsPerPackage;
+}
+
+// dcs-web injects its configuration into the templates. Pages which are not
+// rendered from templates fetch it instead.
+if (typeof dcsUIConfig !== 'undefined' && dcsUIConfig !== null) {
+    applyUIConfig(dcsUIConfig);
+} else {
+    $.getJSON('/api/v1/uiconfig').done(applyUIConfig);
+}
+
 var animationFallback;
 var searchterm;
 
@@ -68,7 +82,16 @@ function progress(percentage, temporary, text) {
     }
 }
 
+// Archive snapshot selected using the snapshot: keyword, if any. Files of a
+// snapshot need to be displayed using the snapshot’s source backends.
+var snapshot;
+
 function sendQuery(term, literal) {
+    // force: search even if the query is refused as too complex (see
+    // cmd/dcs-web/complexity.go).
+    var force = (new URLSearchParams(location.search.slice(1)).get('force') === '1' ? "&force=1" : "");
+    var snapshotMatch = /(?:^|\s)snapshot:(\S+)/i.exec(searchterm);
+    snapshot = (snapshotMatch ? snapshotMatch[1] : undefined);
     $('#normalresults').show();
     $('#progressbar').show();
     $('#options').hide();
@@ -76,27 +99,112 @@ function sendQuery(term, literal) {
     var query = term;
     if (typeof(EventSource) !== 'undefined') {
         // EventSource is supported by Chrome 9+ and Firefox 6+.
-        var eventsrc = new EventSource("/events/?q=" + query + "&literal=" + (literal ? "1" : "0"));
-        eventsrc.onmessage = onEvent;
+        // v: the newest version of the event protocol we speak (see
+        // /api/v1/eventschema). Since version 2, events which occur in quick
+        // succession are sent as one message, see onEvent.
+        var eventsrc = new EventSource("/events/?q=" + query + "&literal=" + (literal ? "1" : "0") + force + "&v=" + protocolVersion);
+        var received = false;
+        eventsrc.onmessage = function(e) {
+            received = true;
+            onEvent.call(this, e);
+        };
+        eventsrc.onerror = function() {
+            // Some proxies break EventSource (e.g. by refusing or
+            // buffering the never-ending response): if the connection fails
+            // before any event arrives, poll for the events instead.
+            if (!received) {
+                eventsrc.close();
+                longPoll(query, literal, force);
+            }
+        };
     } else {
         // Fall back to WebSockets, which need an additional round trip
         // (because they do not work over HTTP2).
         var websocket_url = window.location.protocol.replace('http', 'ws') + '//' + window.location.host + '/instantws';
         var connection = new WebSocket(websocket_url);
         var queryMsg = JSON.stringify({
-            "Query": "q=" + encodeURIComponent(query) + "&literal=" +  (literal ? "1" : "0"),
+            "Query": "q=" + encodeURIComponent(query) + "&literal=" +  (literal ? "1" : "0") + force,
+            "Version": protocolVersion,
         });
+        var opened = false;
         connection.onopen = function() {
+            opened = true;
             connection.send(queryMsg);
         };
         connection.onmessage = onEvent;
+        connection.onerror = function() {
+            if (!opened) {
+                longPoll(query, literal, force);
+            }
+        };
     }
     document.title = searchterm + ' · Debian Code Search';
     progress(0, false, 'Checking which files to grep…');
 }
 
+// longPoll starts the query using /api/v1/query and polls for its events (see
+// cmd/dcs-web/longpoll.go), for networks in which proxies break both
+// EventSource and WebSockets.
+function longPoll(query, literal, force) {
+    // Passed as this to handleEvent, like the EventSource (or WebSocket).
+    var poller = {
+        closed: false,
+        close: function() { this.closed = true; },
+    };
+    var failures = 0;
+    var poll = function(queryid, since) {
+        $.getJSON('/api/v1/poll/' + encodeURIComponent(queryid), {'since': since, 'v': protocolVersion})
+        .done(function(reply) {
+            failures = 0;
+            for (var i = 0; i < reply.Events.length && !poller.closed; i++) {
+                handleEvent.call(poller, reply.Events[i]);
+            }
+            if (!poller.closed && !reply.Done) {
+                poll(queryid, reply.LastEventId);
+            }
+        })
+        .fail(function(xhr, textStatus, errorThrown) {
+            // Proxies may time out requests, so retry a few times.
+            if (++failures < 3) {
+                setTimeout(function() { poll(queryid, since); }, 1000);
+                return;
+            }
+            error(true, true, null, 'Loading search results failed: ' + errorThrown);
+        });
+    };
+    $.ajax({
+        url: '/api/v1/query',
+        method: 'POST',
+        contentType: 'application/json',
+        dataType: 'json',
+        data: JSON.stringify({
+            'Query': decodeURIComponent(query),
+            'Literal': literal,
+            'Force': force !== '',
+        }),
+    })
+    .done(function(started) {
+        poll(started.QueryId, '');
+    })
+    .fail(function(xhr, textStatus, errorThrown) {
+        // Invalid queries are refused with an error event.
+        if (xhr.responseJSON && xhr.responseJSON.Type === 'error') {
+            handleEvent.call(poller, xhr.responseJSON);
+            return;
+        }
+        error(true, true, null, 'Starting the search failed: ' + errorThrown);
+    });
+}
+
+// The newest version of the event protocol this file handles. Keep in sync
+// with protocolVersion in cmd/dcs-web/eventschema.go.
+var protocolVersion = 4;
+
 var queryid;
 var resultpages;
+// Signed links to the results (see Downloads in the pagination event), which
+// are required if the server signs download links.
+var downloads;
 var currentpage;
 var currentpage_pkg;
 var packages = [];
@@ -122,13 +230,35 @@ function track(ev) {
         {"type": "application/json; charset=UTF-8"}));
 }
 
+// highlightRanges wraps the byte ranges (as reported by the server, see
+// Match.HighlightRanges) of the HTML-escaped line in <mark> elements.
+function highlightRanges(line, ranges) {
+    if (!ranges) {
+        return line;
+    }
+    var bytes = new TextEncoder().encode(line);
+    var decoder = new TextDecoder();
+    var html = '';
+    var pos = 0;
+    for (var i = 0; i < ranges.length; i++) {
+        var start = ranges[i][0], end = ranges[i][1];
+        if (start < pos || end <= start || end > bytes.length) {
+            return line;
+        }
+        html += decoder.decode(bytes.slice(pos, start)) +
+            '<mark>' + decoder.decode(bytes.slice(start, end)) + '</mark>';
+        pos = end;
+    }
+    return html + decoder.decode(bytes.slice(pos));
+}
+
 function addSearchResult(results, result) {
     var context = [];
 
     // NB: All of the following context lines are already HTML-escaped by the server.
     context.push(result.ctxp2);
     context.push(result.ctxp1);
-    context.push('<strong>' + result.context + '</strong>');
+    context.push('<strong>' + highlightRanges(result.context, result.highlight_ranges) + '</strong>');
     context.push(result.ctxn1);
     context.push(result.ctxn2);
     // Remove any empty context lines (e.g. when the match is close to the
@@ -142,8 +272,48 @@ function addSearchResult(results, result) {
     var sourcePackage = result.path.substring(0, delimiter);
     var rest = result.path.substring(delimiter);
 
+    // The source backend limits the number of matches per file.
+    var omitted = '';
+    if (result.file_matches_omitted) {
+        omitted = ', ' + result.file_matches_omitted + ' more matches in this file omitted';
+    }
+
+    // The version includes the epoch, which the path lacks.
+    var version = '';
+    if (result.version) {
+        version = ', Version: ' + escapeForHTML(result.version);
+    }
+
+    var license = '';
+    if (result.license) {
+        license = ', License: ' + escapeForHTML(result.license);
+    }
+
+    var binaries = '';
+    if (result.binary_packages) {
+        binaries = ', Binary packages: ' + escapeForHTML(result.binary_packages.join(', '));
+    }
+
+    // With federation, results are tagged with the cluster they were found in.
+    var origin = '';
+    if (result.origin) {
+        origin = ', Origin: ' + escapeForHTML(result.origin);
+    }
+
+    // Long lines are truncated by the source backend (marked with “…”).
+    var truncated = '';
+    if (result.context_length) {
+        truncated = ', line truncated (' + result.context_length + ' bytes)';
+    }
+
+    // Files which are not UTF-8 are converted by the source backend.
+    var encoding = '';
+    if (result.encoding) {
+        encoding = ', Encoding: ' + escapeForHTML(result.encoding);
+    }
+
     // Append the new search result, then sort the results.
-    var el = $('<li data-ranking="' + result.ranking + '"><a onclick="track(event);" href="/show?file=' + encodeURIComponent(result.path) + '&line=' + result.line + '"><code><strong>' + sourcePackage + '</strong>' + escapeForHTML(rest) + '</code></a><br><pre>' + context + '</pre><small>PathRank: ' + result.pathrank + ', Final: ' + result.ranking + '</small></li>');
+    var el = $('<li data-ranking="' + result.ranking + '"><a onclick="track(event);" href="/show?file=' + encodeURIComponent(result.path) + '&line=' + result.line + (result.compression ? '&compression=' + encodeURIComponent(result.compression) : '') + (snapshot ? '&snapshot=' + encodeURIComponent(snapshot) : '') + (result.version ? '&version=' + encodeURIComponent(result.version) : '') + '"><code><strong>' + sourcePackage + '</strong>' + escapeForHTML(rest) + '</code></a><br><pre>' + context + '</pre><small>PathRank: ' + result.pathrank + ', Final: ' + result.ranking + version + license + binaries + encoding + origin + omitted + truncated + '</small></li>');
     $(el).children('a').attr('data-path', result.path).attr('data-line', result.line);
     results.append(el);
     $('ul#results').append($('ul#results>li').detach().sort(function(a, b) {
@@ -177,7 +347,7 @@ function loadPage(nr) {
     if (location.toString() !== pathname) {
         history.pushState({ searchterm: searchterm, nr: nr, perpkg: false }, 'page ' + nr, pathname);
     }
-    $.ajax('/results/' + queryid + '/page_' + nr + '.json')
+    $.ajax((downloads && downloads.Pages[nr]) || ('/results/' + queryid + '/page_' + nr + '.json'))
         .done(function(data, textStatus, xhr) {
             clearTimeout(progress_bar_start);
             // TODO: experiment and see whether animating the results works
@@ -219,7 +389,7 @@ function loadPerPkgPage(nr, preload) {
             history.pushState({ searchterm: searchterm, nr: nr, perpkg: true }, 'page ' + nr, pathname);
         }
     }
-    $.ajax('/results/' + queryid + '/perpackage_2_page_' + nr + '.json')
+    $.ajax('/results/' + queryid + '/perpackage_' + resultsPerPackage + '_page_' + nr + '.json')
         .done(function(data, textStatus, xhr) {
             if (progress_bar_start !== undefined) {
                 clearTimeout(progress_bar_start);
@@ -230,6 +400,20 @@ function loadPerPkgPage(nr, preload) {
             pp.text('');
             $.each(data, function(idx, meta) {
                 pp.append('<h2>' + meta.Package + '</h2>');
+                if (meta.Description || meta.Section || meta.Homepage) {
+                    var about = $('<p class="packagemeta"></p>');
+                    if (meta.Description) {
+                        about.append(escapeForHTML(meta.Description));
+                    }
+                    if (meta.Section) {
+                        about.append(' <span class="packagesection">(' + escapeForHTML(meta.Section) + ')</span>');
+                    }
+                    if (meta.Homepage && /^https?:\/\//.test(meta.Homepage)) {
+                        about.append(' <a class="packagehomepage"></a>');
+                        about.find('.packagehomepage').attr('href', meta.Homepage).text('homepage');
+                    }
+                    pp.append(about);
+                }
                 var ul = $('<ul></ul>');
                 pp.append(ul);
                 $.each(meta.Results, function(idx, result) {
@@ -307,6 +491,14 @@ function updatePagination(currentpage, resultpages, perpackage) {
     $((perpackage ? '.perpackage-pagination' : '.pagination')).html(html);
 }
 
+// markQueryOffset inserts a marker into query at the byte offset (as
+// reported by the server) of an error.
+function markQueryOffset(query, offset) {
+    var bytes = new TextEncoder().encode(query);
+    var decoder = new TextDecoder();
+    return decoder.decode(bytes.slice(0, offset)) + '⟨here⟩' + decoder.decode(bytes.slice(offset));
+}
+
 function escapeForHTML(input) {
     return $('<div/>').text(input).html();
 }
@@ -332,7 +524,7 @@ function onQueryDone(msg) {
     // user decides to switch to perpackage mode.
     loadPerPkgPage(0, true);
 
-    $.ajax('/results/' + queryid + '/packages.json')
+    $.ajax((downloads && downloads.Packages) || ('/results/' + queryid + '/packages.json'))
         .done(function(data, textStatus, xhr) {
             var p = $('#packages');
             p.text('');
@@ -368,7 +560,7 @@ function onQueryDone(msg) {
                 $('label[for=enable-perpackage]').css('opacity', '1.0');
 
                 if (location.pathname.lastIndexOf('/perpackage-results/', 0) === 0) {
-                    var parts = new RegExp("/perpackage-results/([^/]+)/2/page_([0-9]+)").exec(location.pathname);
+                    var parts = new RegExp("/perpackage-results/([^/]+)/[0-9]+/page_([0-9]+)").exec(location.pathname);
                     $('#enable-perpackage').prop('checked', true);
                     changeGrouping();
                     loadPerPkgPage(parseInt(parts[2]), false);
@@ -393,6 +585,17 @@ function onQueryDone(msg) {
 
 function onEvent(e) {
     var msg = JSON.parse(e.data);
+    if (msg.Type === "batch") {
+        for (var i = 0; i < msg.Events.length; i++) {
+            handleEvent.call(this, msg.Events[i]);
+        }
+        return;
+    }
+    handleEvent.call(this, msg);
+}
+
+// Called with this set to the EventSource (or WebSocket).
+function handleEvent(msg) {
     switch (msg.Type) {
         case "progress":
         queryid = msg.QueryId;
@@ -411,6 +614,7 @@ function onEvent(e) {
         // user requests a different page.
         resultpages = msg.ResultPages;
         queryid = msg.QueryId;
+        downloads = msg.Downloads;
         currentpage = 0;
         currentpage_pkg = 0;
         updatePagination(currentpage, resultpages, false);
@@ -425,27 +629,110 @@ function onEvent(e) {
             if (sp.get('perpkg') !== null) {
                 break;
             }
-            loadPage(parseInt(getDefault(sp, 'page', 0)));
+            var nr = parseInt(getDefault(sp, 'page', 0));
+            // Display the top results right away, they are replaced once the
+            // page is loaded.
+            if (nr === 0 && msg.Preview) {
+                $('ul#results>li').remove();
+                var ul = $('ul#results');
+                $.each(msg.Preview, function(idx, result) {
+                    addSearchResult(ul, result);
+                });
+            }
+            loadPage(nr);
         }
         break;
 
         case "error":
-        if (msg.ErrorType == "backendunavailable") {
-            error(false, true, msg.ErrorType, "The results may be incomplete, not all Debian Code Search servers are okay right now.");
-        } else if (msg.ErrorType == "cancelled") {
-            error(false, true, msg.ErrorType, "This query has been cancelled by the server administrator (to preserve overall service health).");
-        } else if (msg.ErrorType == "failed") {
-            error(false, true, msg.ErrorType, "This query failed due to an unexpected internal server error.");
-        } else if (msg.ErrorType == "invalidquery") {
-            error(false, true, msg.ErrorType, "This query was refused by the server: " + msg.ErrorMessage);
+        // Detail explains the error (see cmd/dcs-web/queryerrors.go).
+        if (msg.ErrorType == "invalidquery") {
+            var message = "This query was refused by the server: " + msg.ErrorMessage;
+            if (msg.Syntax) {
+                message = "This query was refused by the server: " + msg.Syntax.Reason +
+                    " (at ⟨here⟩: " + markQueryOffset(searchterm, msg.Syntax.Offset) + ")";
+            }
+            var div = error(false, true, msg.ErrorType, message);
+            if (div !== undefined && msg.Reason == "toocomplex") {
+                var sp = new URLSearchParams(location.search.slice(1));
+                sp.set('force', '1');
+                var a = $('<a></a>');
+                a.attr('href', '/search?' + sp.toString());
+                a.text('Search anyway');
+                div.append(' ', a);
+            }
         } else {
-            error(false, true, msg.ErrorType, msg.ErrorType);
+            error(false, true, msg.ErrorType, msg.Detail || msg.ErrorType);
         }
         this.close();
         onQueryDone(msg);
         break;
 
+        case "warning":
+        if (msg.WarningType == "broadquery") {
+            error(false, false, msg.WarningType, "This query is very broad: about " + msg.EstimatedFiles + " of " + msg.FilesTotal + " files need to be searched. It may take a long time and the results may be truncated. Consider making your query more specific, e.g. using package: or path:.");
+        } else if (msg.WarningType == "broaden") {
+            // The query is estimated to find very few results, so broader
+            // variants of it are suggested (see cmd/dcs-web/broaden.go).
+            var div = error(false, false, msg.WarningType, "This query is estimated to find results in at most " + msg.EstimatedFiles + " files. Broader queries: ");
+            if (div !== undefined) {
+                $.each(msg.Suggestions, function(idx, suggestion) {
+                    var sp = new URLSearchParams(location.search.slice(1));
+                    sp.set('q', suggestion.Query);
+                    sp["delete"]('page');
+                    var a = $('<a></a>');
+                    a.attr('href', '/search?' + sp.toString());
+                    a.text(suggestion.Query);
+                    div.append(idx > 0 ? ', ' : '', a, ' (' + suggestion.Reason + ', up to ' + suggestion.EstimatedFiles + ' files)');
+                });
+            }
+        } else if (msg.WarningType == "staleindex") {
+            // Sent when reconnecting after the index was replaced: the
+            // results received so far are not served anymore.
+            error(true, true, msg.WarningType, "The index was updated while this query was running, so these results are from an older index. Please search again to get current results.");
+            this.close();
+        } else {
+            error(false, false, msg.WarningType, msg.WarningType);
+        }
+        break;
+
+        case "noresults":
+        // Sent instead of a pagination event, followed by the last progress
+        // update (whose “no results” message is then not displayed again).
+        var div = error(false, true, 'noresults', 'Your query “' + searchterm + '” had no results. Please read the FAQ to make sure your syntax is correct.');
+        if (div !== undefined && msg.Suggestions) {
+            div.append(' Broader queries: ');
+            $.each(msg.Suggestions, function(idx, suggestion) {
+                var sp = new URLSearchParams(location.search.slice(1));
+                sp.set('q', suggestion.Query);
+                sp["delete"]('page');
+                var a = $('<a></a>');
+                a.attr('href', '/search?' + sp.toString());
+                a.text(suggestion.Query);
+                div.append(idx > 0 ? ', ' : '', a, ' (' + suggestion.Reason + ', up to ' + suggestion.EstimatedFiles + ' files)');
+            });
+        }
+        break;
+
+        case "started":
+        // The server derives the query id from the normalized query, so it
+        // is known before the first progress update.
+        queryid = msg.QueryId;
+        downloads = undefined;
+        break;
+
+        case "hello":
+        case "queued":
+        case "counts":
+        case "facets":
+        // Not displayed (yet).
+        break;
+
         default:
+        if (msg.Type !== undefined) {
+            // Unknown event type, e.g. sent by a newer server (see
+            // /api/v1/eventschema). Only matches do not have a Type.
+            break;
+        }
         addSearchResult($('ul#results'), msg);
         break;
     }
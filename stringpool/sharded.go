@@ -0,0 +1,74 @@
+package stringpool
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// ShardedStringPool is a StringPool which can be used by many goroutines
+// concurrently: strings are distributed across independently locked shards,
+// so that concurrent Get calls rarely contend for the same lock.
+type ShardedStringPool struct {
+	shards []*StringPool
+
+	lookups uint64 // accessed atomically
+	hits    uint64 // accessed atomically
+}
+
+// Stats describes the usage of a ShardedStringPool.
+type Stats struct {
+	// Strings is the number of distinct strings stored in the pool.
+	Strings int
+
+	// Lookups is the number of Get calls, Hits the number of Get calls
+	// which returned an already stored string.
+	Lookups uint64
+	Hits    uint64
+}
+
+// HitRate returns the fraction of lookups which were hits, or 0 if there
+// were no lookups.
+func (s Stats) HitRate() float64 {
+	if s.Lookups == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Lookups)
+}
+
+func NewShardedStringPool(shards int) *ShardedStringPool {
+	if shards < 1 {
+		shards = 1
+	}
+	pool := &ShardedStringPool{shards: make([]*StringPool, shards)}
+	for idx := range pool.shards {
+		pool.shards[idx] = NewStringPool()
+	}
+	return pool
+}
+
+func (pool *ShardedStringPool) shard(s string) *StringPool {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return pool.shards[h.Sum32()%uint32(len(pool.shards))]
+}
+
+func (pool *ShardedStringPool) Get(s string) *string {
+	atomic.AddUint64(&pool.lookups, 1)
+	stored, hit := pool.shard(s).get(s)
+	if hit {
+		atomic.AddUint64(&pool.hits, 1)
+	}
+	return stored
+}
+
+// Stats returns the current usage statistics of the pool.
+func (pool *ShardedStringPool) Stats() Stats {
+	stats := Stats{
+		Lookups: atomic.LoadUint64(&pool.lookups),
+		Hits:    atomic.LoadUint64(&pool.hits),
+	}
+	for _, shard := range pool.shards {
+		stats.Strings += shard.Len()
+	}
+	return stats
+}
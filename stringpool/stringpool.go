@@ -19,21 +19,34 @@ func NewStringPool() *StringPool {
 }
 
 func (pool *StringPool) Get(s string) *string {
+	stored, _ := pool.get(s)
+	return stored
+}
+
+// Len returns the number of distinct strings stored in the pool.
+func (pool *StringPool) Len() int {
+	pool.RLock()
+	defer pool.RUnlock()
+	return len(pool.strings)
+}
+
+// get is like Get, but also reports whether s was already stored.
+func (pool *StringPool) get(s string) (*string, bool) {
 	// Check if the entry is already in the pool with a slightly cheaper
 	// (read-only) mutex.
 	pool.RLock()
 	stored, ok := pool.strings[s]
 	pool.RUnlock()
 	if ok {
-		return stored
+		return stored, true
 	}
 
 	pool.Lock()
 	defer pool.Unlock()
 	stored, ok = pool.strings[s]
 	if ok {
-		return stored
+		return stored, true
 	}
 	pool.strings[s] = &s
-	return &s
+	return &s, false
 }
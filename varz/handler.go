@@ -0,0 +1,141 @@
+package varz
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type varzBucket struct {
+	UpperBound      float64
+	CumulativeCount uint64
+}
+
+type varzMetric struct {
+	Labels map[string]string `json:",omitempty"`
+
+	// Set for counters, gauges and untyped metrics.
+	Value *float64 `json:",omitempty"`
+
+	// Set for histograms and summaries.
+	Count   *uint64      `json:",omitempty"`
+	Sum     *float64     `json:",omitempty"`
+	Buckets []varzBucket `json:",omitempty"`
+}
+
+type varzFamily struct {
+	Name    string
+	Help    string
+	Type    string
+	Metrics []varzMetric
+}
+
+func convert(mf *dto.MetricFamily) varzFamily {
+	family := varzFamily{
+		Name: mf.GetName(),
+		Help: mf.GetHelp(),
+		Type: strings.ToLower(mf.GetType().String()),
+	}
+	for _, m := range mf.Metric {
+		var vm varzMetric
+		if len(m.Label) > 0 {
+			vm.Labels = make(map[string]string, len(m.Label))
+			for _, l := range m.Label {
+				vm.Labels[l.GetName()] = l.GetValue()
+			}
+		}
+		var value float64
+		switch {
+		case m.Counter != nil:
+			value = m.Counter.GetValue()
+			vm.Value = &value
+		case m.Gauge != nil:
+			value = m.Gauge.GetValue()
+			vm.Value = &value
+		case m.Untyped != nil:
+			value = m.Untyped.GetValue()
+			vm.Value = &value
+		case m.Histogram != nil:
+			vm.Count = m.Histogram.SampleCount
+			vm.Sum = m.Histogram.SampleSum
+			for _, b := range m.Histogram.Bucket {
+				vm.Buckets = append(vm.Buckets, varzBucket{
+					UpperBound:      b.GetUpperBound(),
+					CumulativeCount: b.GetCumulativeCount(),
+				})
+			}
+		case m.Summary != nil:
+			vm.Count = m.Summary.SampleCount
+			vm.Sum = m.Summary.SampleSum
+		}
+		family.Metrics = append(family.Metrics, vm)
+	}
+	return family
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, v))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Handler serves all registered metrics in a compact human-readable format
+// (one line per value; histograms are shown with their count, sum, mean and
+// non-empty buckets), or as JSON if the format=json parameter is set.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	families := make([]varzFamily, len(mfs))
+	for idx, mf := range mfs {
+		families[idx] = convert(mf)
+	}
+
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(families); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, family := range families {
+		for _, m := range family.Metrics {
+			labels := formatLabels(m.Labels)
+			if m.Value != nil {
+				fmt.Fprintf(w, "%s%s %v\n", family.Name, labels, *m.Value)
+				continue
+			}
+			if m.Count == nil {
+				continue
+			}
+			var mean float64
+			if *m.Count > 0 {
+				mean = *m.Sum / float64(*m.Count)
+			}
+			fmt.Fprintf(w, "%s%s count=%d sum=%v mean=%v\n", family.Name, labels, *m.Count, *m.Sum, mean)
+			var last uint64
+			for _, b := range m.Buckets {
+				if b.CumulativeCount == last {
+					continue
+				}
+				fmt.Fprintf(w, "  ≤ %v: %d\n", b.UpperBound, b.CumulativeCount-last)
+				last = b.CumulativeCount
+			}
+		}
+	}
+}
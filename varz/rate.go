@@ -0,0 +1,85 @@
+package varz
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Rate is a rolling rate: the number of events per second, averaged over the
+// last window (with one-second granularity). Prometheus can compute rates from
+// counters, but /varz readers (and the queryz page) cannot.
+//
+// Rate implements prometheus.Collector and is exported as a gauge.
+type Rate struct {
+	mu      sync.Mutex
+	buckets []int64 // events per second, indexed by unix second % len
+	last    int64   // unix second of the most recent Mark
+	now     func() time.Time
+
+	gauge prometheus.GaugeFunc
+}
+
+// NewRate returns a Rate averaging over window, which must be at least one
+// second.
+func NewRate(opts prometheus.GaugeOpts, window time.Duration) *Rate {
+	seconds := int(window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	r := &Rate{
+		buckets: make([]int64, seconds),
+		now:     time.Now,
+	}
+	r.gauge = prometheus.NewGaugeFunc(opts, r.PerSecond)
+	return r
+}
+
+// advanceLocked clears all buckets between the last Mark and sec.
+func (r *Rate) advanceLocked(sec int64) {
+	if sec <= r.last {
+		return
+	}
+	n := int64(len(r.buckets))
+	if sec-r.last >= n {
+		for i := range r.buckets {
+			r.buckets[i] = 0
+		}
+	} else {
+		for s := r.last + 1; s <= sec; s++ {
+			r.buckets[s%n] = 0
+		}
+	}
+	r.last = sec
+}
+
+// Mark records n events.
+func (r *Rate) Mark(n int64) {
+	sec := r.now().Unix()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.advanceLocked(sec)
+	r.buckets[sec%int64(len(r.buckets))] += n
+}
+
+// PerSecond returns the average number of events per second over the window.
+func (r *Rate) PerSecond() float64 {
+	sec := r.now().Unix()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.advanceLocked(sec)
+	var sum int64
+	for _, n := range r.buckets {
+		sum += n
+	}
+	return float64(sum) / float64(len(r.buckets))
+}
+
+func (r *Rate) Describe(ch chan<- *prometheus.Desc) {
+	r.gauge.Describe(ch)
+}
+
+func (r *Rate) Collect(ch chan<- prometheus.Metric) {
+	r.gauge.Collect(ch)
+}
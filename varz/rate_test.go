@@ -0,0 +1,37 @@
+package varz
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRate(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewRate(prometheus.GaugeOpts{Name: "test_rate"}, 10*time.Second)
+	r.now = func() time.Time { return now }
+
+	if got, want := r.PerSecond(), 0.0; got != want {
+		t.Fatalf("PerSecond() = %v, want %v", got, want)
+	}
+
+	for i := 0; i < 10; i++ {
+		r.Mark(5)
+		now = now.Add(1 * time.Second)
+	}
+	// The oldest second dropped out of the window.
+	if got, want := r.PerSecond(), 4.5; got != want {
+		t.Fatalf("PerSecond() = %v, want %v", got, want)
+	}
+
+	now = now.Add(5 * time.Second)
+	if got, want := r.PerSecond(), 2.0; got != want {
+		t.Fatalf("PerSecond() = %v, want %v", got, want)
+	}
+
+	now = now.Add(1 * time.Hour)
+	if got, want := r.PerSecond(), 0.0; got != want {
+		t.Fatalf("PerSecond() = %v, want %v", got, want)
+	}
+}